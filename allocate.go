@@ -0,0 +1,105 @@
+package partitionresizer
+
+import (
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// Extent is a contiguous range of a disk, from byte Start to byte End,
+// inclusive.
+type Extent struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Size returns the size of e, in bytes.
+func (e Extent) Size() int64 {
+	return e.End - e.Start + 1
+}
+
+// AllocationTarget is a partition to allocate space for with Allocate, and
+// the size it is to have, interpreted as Mode says, as for a PartitionChange:
+// for SizeWeight, Size is the weight.
+type AllocationTarget struct {
+	Label    string
+	Original PartitionGeometry
+	Size     int64
+	Mode     SizeMode
+	// InPlace is set to grow the partition where it is, into the free space
+	// immediately following it, when there is enough of it.
+	InPlace bool
+}
+
+// FreeExtents returns the extents of a disk of size bytes that none of used
+// cover, in order. used need not be sorted, and may overlap. The first byte of
+// the disk is never free, as it is where the protective MBR of a GPT is.
+func FreeExtents(size int64, used []Extent) []Extent {
+	return fromUsableBlocks(computeUnused(size, sortAndCombineUsableBlocks(toUsableBlocks(used))))
+}
+
+// MergeExtents returns extents sorted by their start, with those that overlap
+// or are adjacent merged into one. extents is left as it is.
+func MergeExtents(extents []Extent) []Extent {
+	return fromUsableBlocks(sortAndCombineUsableBlocks(toUsableBlocks(extents)))
+}
+
+// Allocate works out where each of targets goes on a disk of size bytes
+// holding parts, the same way a resize does, without changing anything: a
+// shrink stays where it is, an InPlace grow stays where it is if the free space
+// after it is enough, and any other grow is given a new partition, numbered
+// with the lowest number free, at the start of the first free extent large
+// enough for it. SizeMax and SizeWeight targets then share the largest free
+// extent left. An *InsufficientSpaceError is returned if a target does not fit.
+func Allocate(size int64, parts []*gpt.Partition, targets []AllocationTarget) ([]PartitionResult, error) {
+	var resizes []partitionResizeTarget
+	for _, t := range targets {
+		r := partitionResizeTarget{
+			original: partitionData{
+				label:  t.Label,
+				number: t.Original.Number,
+				start:  t.Original.Start,
+				size:   t.Original.Size,
+				end:    t.Original.Start + t.Original.Size - 1,
+			},
+			mode:    t.Mode,
+			inPlace: t.InPlace,
+		}
+		switch t.Mode {
+		case SizeAbsolute:
+			r.target.size = t.Size
+		case SizeRelative:
+			r.target.size = t.Original.Size + t.Size
+		case SizeWeight:
+			if t.Size <= 0 {
+				return nil, fmt.Errorf("weight of partition %s must be positive, not %d", t.Label, t.Size)
+			}
+			r.weight = t.Size
+		}
+		if t.Mode != SizeMax && t.Mode != SizeWeight && r.target.size <= 0 {
+			return nil, fmt.Errorf("size of partition %s must be positive, not %d", t.Label, r.target.size)
+		}
+		resizes = append(resizes, r)
+	}
+	resizes, err := calculateResizes(size, parts, resizes)
+	if err != nil {
+		return nil, err
+	}
+	return newResult("", resizes, false).Partitions, nil
+}
+
+func toUsableBlocks(extents []Extent) []usableBlock {
+	blocks := make([]usableBlock, 0, len(extents))
+	for _, e := range extents {
+		blocks = append(blocks, usableBlock{start: e.Start, end: e.End, size: e.Size()})
+	}
+	return blocks
+}
+
+func fromUsableBlocks(blocks []usableBlock) []Extent {
+	extents := make([]Extent, 0, len(blocks))
+	for _, b := range blocks {
+		extents = append(extents, Extent{Start: b.start, End: b.end})
+	}
+	return extents
+}
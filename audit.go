@@ -0,0 +1,174 @@
+package partitionresizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// DefaultAuditLogPath is where the CLI keeps its audit log by default.
+const DefaultAuditLogPath = "/var/log/partitionresizer/audit.jsonl"
+
+// The operations recorded in an audit log, each a write of the partition
+// table.
+const (
+	auditPreparePartitions       = "prepare-partitions"
+	auditRemoveCreatedPartitions = "remove-created-partitions"
+	auditCommitPartitions        = "commit-partitions"
+	auditRollback                = "rollback"
+	auditMoveBackupGPT           = "move-backup-gpt"
+)
+
+// auditLog appends a record of each write of a partition table to the file at
+// path, one JSON object per line, for a record of what was changed that is
+// kept apart from the log. A nil *auditLog records nothing.
+type auditLog struct {
+	path   string
+	reason string
+}
+
+// auditRecord is a write of the partition table of a disk, as recorded in an
+// audit log.
+type auditRecord struct {
+	Time      time.Time        `json:"time"`
+	Operation string           `json:"operation"`
+	Device    string           `json:"device"`
+	DiskGUID  string           `json:"diskGUID,omitempty"`
+	Reason    string           `json:"reason,omitempty"`
+	Before    []auditPartition `json:"before"`
+	After     []auditPartition `json:"after"`
+	// Removed are the partitions in Before that are not in After.
+	Removed []auditPartition `json:"removed,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// auditPartition is a partition as recorded in an audit log.
+type auditPartition struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	GUID   string `json:"guid"`
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size"`
+}
+
+// check returns an error if the audit log cannot be appended to, so that a
+// resize that could not be recorded does not start.
+func (a *auditLog) check() error {
+	if a == nil {
+		return nil
+	}
+	f, err := a.open()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (a *auditLog) open() (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// write runs write, a write of the partition table of d for operation, and
+// records it with the partitions on the disk before and after it. A write that
+// fails is recorded too, with its error. Should the record not be made, write
+// returns an error even though the table was written.
+func (a *auditLog) write(d *disk.Disk, operation string, write func() error) error {
+	if a == nil {
+		return write()
+	}
+	before, guid := auditPartitions(d)
+	err := write()
+	after, _ := auditPartitions(d)
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Device:    d.Backend.Path(),
+		DiskGUID:  guid,
+		Reason:    a.reason,
+		Before:    before,
+		After:     after,
+	}
+	for _, p := range before {
+		if !containsPartition(after, p) {
+			record.Removed = append(record.Removed, p)
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if aerr := a.append(record); aerr != nil && err == nil {
+		err = fmt.Errorf("partition table written, but not recorded in audit log %s: %v", a.path, aerr)
+	}
+	return err
+}
+
+// append appends record to the audit log and flushes it to disk.
+func (a *auditLog) append(record auditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := a.open()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditPartitions returns the partitions in the GPT on d, as it is on the
+// disk, and the disk's GUID; none if it cannot be read. Unlike
+// d.GetPartitionTable, it leaves d.Table as it is.
+func auditPartitions(d *disk.Disk) ([]auditPartition, string) {
+	tableRaw, err := partition.Read(d.Backend, int(d.LogicalBlocksize), int(d.PhysicalBlocksize))
+	if err != nil {
+		return nil, ""
+	}
+	table, ok := tableRaw.(*gpt.Table)
+	if !ok {
+		return nil, ""
+	}
+	partitions := []auditPartition{}
+	for _, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		partitions = append(partitions, auditPartition{
+			Number: p.Index,
+			Name:   p.Name,
+			Type:   string(p.Type),
+			GUID:   p.GUID,
+			Start:  p.GetStart(),
+			Size:   p.GetSize(),
+		})
+	}
+	return partitions, table.GUID
+}
+
+// containsPartition reports whether partitions holds p, the same partition at
+// the same place.
+func containsPartition(partitions []auditPartition, p auditPartition) bool {
+	for _, q := range partitions {
+		if q.GUID == p.GUID && q.Start == p.Start {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package partitionresizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestAuditLog stages a resize, creating a partition for partition 1, and then
+// removes the partition again, as after a failed copy: each write of the table
+// must be appended to the audit log, with the partitions before and after it.
+func TestAuditLog(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	grown := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	resizes := []partitionResizeTarget{
+		{original: grown, target: partitionData{number: 2, label: "data_resized2", start: 20 * MB, size: 16 * MB, end: 36*MB - 1}},
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(grown.start / sectorSize), Size: uint64(grown.size), Type: gpt.LinuxFilesystem, Name: grown.label},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+
+	auditPath := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	audit := Options{AuditLog: auditPath, AuditReason: "CHG-1234"}.audit()
+	if err := audit.check(); err != nil {
+		t.Fatalf("check() error: %v", err)
+	}
+	before := []gpt.Partition{*table.Partitions[0]}
+	if _, err := preparePartitions(slog.Default(), audit, d, resizes); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTable(slog.Default(), audit, d, before, auditRemoveCreatedPartitions, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit log line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("audit log has %d records, want 2", len(records))
+	}
+
+	prepare, remove := records[0], records[1]
+	if prepare.Operation != auditPreparePartitions || remove.Operation != auditRemoveCreatedPartitions {
+		t.Errorf("operations are %q and %q, want %q and %q", prepare.Operation, remove.Operation, auditPreparePartitions, auditRemoveCreatedPartitions)
+	}
+	for _, record := range records {
+		if record.Device != diskPath || record.Reason != "CHG-1234" || record.DiskGUID == "" || record.Time.IsZero() || record.Error != "" {
+			t.Errorf("%s record is %+v, want device %s, reason CHG-1234, a disk GUID and a time", record.Operation, record, diskPath)
+		}
+	}
+	if len(prepare.Before) != 1 || len(prepare.After) != 2 || len(prepare.Removed) != 0 {
+		t.Fatalf("prepare-partitions record has %d partitions before, %d after and %d removed, want 1, 2 and 0", len(prepare.Before), len(prepare.After), len(prepare.Removed))
+	}
+	if p := prepare.Before[0]; p.Number != 1 || p.Name != grown.label || p.Start != grown.start || p.Size != grown.size || p.GUID == "" {
+		t.Errorf("partition before prepare-partitions is %+v, want partition 1 at %d of %d bytes", p, grown.start, grown.size)
+	}
+	if len(remove.Removed) != 1 || remove.Removed[0].Start != resizes[0].target.start || remove.Removed[0].Size != resizes[0].target.size {
+		t.Errorf("remove-created-partitions removed %+v, want the partition at %d", remove.Removed, resizes[0].target.start)
+	}
+	if len(remove.After) != 1 || remove.After[0] != prepare.Before[0] {
+		t.Errorf("partitions after remove-created-partitions are %+v, want %+v", remove.After, prepare.Before)
+	}
+}
@@ -1,6 +1,7 @@
 package partitionresizer
 
 import (
+	"fmt"
 	"sort"
 
 	"github.com/diskfs/go-diskfs/partition/gpt"
@@ -18,6 +19,12 @@ type usableBlock struct {
 // based on the current partitions, the partition to shrink (if any), and
 // the partitions to grow. Assume we will not be growing the partitions,
 // but creating new ones in the free space, copying over and deleting the old ones.
+// Targets requested with SizeMax or SizeWeight are resolved in a second pass,
+// after all of the fixed-size targets have been placed: together they divide the
+// largest free block left between them, in proportion to their weights, where a
+// SizeMax target is a single target with the whole block.
+// Targets marked inPlace are instead grown where they are, into the free space
+// immediately following them, when there is enough of it.
 func calculateResizes(size int64, parts []*gpt.Partition, partitionResizes []partitionResizeTarget) (resizes []partitionResizeTarget, err error) {
 	// find the free space on the disk
 	var used, unused []usableBlock
@@ -38,9 +45,63 @@ func calculateResizes(size int64, parts []*gpt.Partition, partitionResizes []par
 	for _, p := range parts {
 		usedPartitionNumbers[int(p.Index)] = true
 	}
+	nextPartitionNumber := func() int {
+		// find the lowest available partition number
+		for pn := 1; ; pn++ {
+			if !usedPartitionNumbers[pn] {
+				usedPartitionNumbers[pn] = true
+				return pn
+			}
+		}
+	}
+
+	// grow the in-place targets first, while the free space immediately
+	// following each partition is still there for it; any that does not have
+	// enough is relocated like any other grow
+	placed := make(map[int]bool)
+	for i, gp := range partitionResizes {
+		if !gp.inPlace {
+			continue
+		}
+		delta := gp.target.size - gp.original.size
+		for j := range unused {
+			u := &unused[j]
+			if u.start != gp.original.end+1 || u.end-u.start+1 < delta {
+				continue
+			}
+			gp.target.start = gp.original.start
+			gp.target.end = gp.target.start + gp.target.size - 1
+			gp.target.number = gp.original.number
+			u.start += delta
+			if u.start > u.end {
+				unused = append(unused[:j], unused[j+1:]...)
+			}
+			resizes = append(resizes, gp)
+			placed[i] = true
+			break
+		}
+	}
 
 	// now go through each of the grow partitions and find space for them
+	var (
+		fillResizes []partitionResizeTarget
+		totalWeight int64
+	)
 	for i, gp := range partitionResizes {
+		if placed[i] {
+			continue
+		}
+		gp.inPlace = false
+		switch gp.mode {
+		case SizeMax:
+			fillResizes = append(fillResizes, gp)
+			totalWeight++
+			continue
+		case SizeWeight:
+			fillResizes = append(fillResizes, gp)
+			totalWeight += gp.weight
+			continue
+		}
 		// if one of these is a shrink, then allocate the space for it
 		if gp.target.size < gp.original.size {
 			// shrinking, so just adjust in place
@@ -69,14 +130,7 @@ func calculateResizes(size int64, parts []*gpt.Partition, partitionResizes []par
 				if u.start > u.end {
 					unused = append(unused[:j], unused[j+1:]...)
 				}
-				// find the lowest available partition number
-				for pn := 1; ; pn++ {
-					if !usedPartitionNumbers[pn] {
-						gp.target.number = pn
-						usedPartitionNumbers[pn] = true
-						break
-					}
-				}
+				gp.target.number = nextPartitionNumber()
 				found = true
 				break
 			}
@@ -87,6 +141,40 @@ func calculateResizes(size int64, parts []*gpt.Partition, partitionResizes []par
 		resizes = append(resizes, gp)
 	}
 
+	// second pass: max and weighted targets share the largest free block left
+	if len(fillResizes) == 0 {
+		return resizes, nil
+	}
+	largest := -1
+	for j, u := range unused {
+		if largest < 0 || u.end-u.start > unused[largest].end-unused[largest].start {
+			largest = j
+		}
+	}
+	var available, next int64
+	if largest >= 0 {
+		available = unused[largest].end - unused[largest].start + 1
+		next = unused[largest].start
+	}
+	for _, gp := range fillResizes {
+		weight := gp.weight
+		if gp.mode == SizeMax {
+			weight = 1
+		}
+		// available*weight can overflow int64 on large disks, so take the
+		// ratio in floating point; keep each partition a whole number of MB
+		share := int64(float64(available)*(float64(weight)/float64(totalWeight))) / MB * MB
+		if share <= gp.original.size {
+			return nil, fmt.Errorf("free space share of %d bytes is not larger than partition %s (%d bytes), cannot grow it", share, gp.original.label, gp.original.size)
+		}
+		gp.target.size = share
+		gp.target.start = next
+		gp.target.end = next + share - 1
+		gp.target.number = nextPartitionNumber()
+		next += share
+		resizes = append(resizes, gp)
+	}
+
 	return resizes, nil
 }
 
@@ -242,6 +242,113 @@ func TestCalculateResizes(t *testing.T) {
 			t.Errorf("resize end = %d, want %d", r.target.end, r.target.start+targetSize-1)
 		}
 	})
+	t.Run("max after fixed", func(t *testing.T) {
+		// the fixed grow takes half of the gap at the end, the max grow the rest
+		gap := unused[len(unused)-1]
+		fixedSize := (gap.end - gap.start + 1) / 2 / MB * MB
+		fixed := partitionResizeTarget{
+			original: partitionData{
+				start:  parts[0].GetStart(),
+				size:   parts[0].GetSize(),
+				label:  parts[0].Name,
+				number: int(parts[0].Index),
+			},
+			target: partitionData{
+				size: fixedSize,
+			},
+		}
+		maxTarget := partitionResizeTarget{
+			original: partitionData{
+				start:  parts[1].GetStart(),
+				size:   parts[1].GetSize(),
+				label:  parts[1].Name,
+				number: int(parts[1].Index),
+			},
+			mode: SizeMax,
+		}
+		// the max target is listed first, but must be placed after the fixed one
+		resizes, err := calculateResizes(d.Size, parts, []partitionResizeTarget{maxTarget, fixed})
+		if err != nil {
+			t.Fatalf("calculateResizes failed: %v", err)
+		}
+		if len(resizes) != 2 {
+			t.Fatalf("got %d resizes, want 2", len(resizes))
+		}
+		if resizes[0].target.start != gap.start {
+			t.Errorf("fixed resize start = %d, want %d", resizes[0].target.start, gap.start)
+		}
+		r := resizes[1]
+		if r.target.start != gap.start+fixedSize {
+			t.Errorf("max resize start = %d, want %d", r.target.start, gap.start+fixedSize)
+		}
+		wantSize := (gap.end - gap.start + 1 - fixedSize) / MB * MB
+		if r.target.size != wantSize {
+			t.Errorf("max resize size = %d, want %d", r.target.size, wantSize)
+		}
+		if r.target.number == resizes[0].target.number {
+			t.Errorf("max resize number %d duplicates fixed resize number", r.target.number)
+		}
+	})
+	t.Run("weighted", func(t *testing.T) {
+		// weights 2 and 1 split the gap at the end two thirds to one third
+		gap := unused[len(unused)-1]
+		available := gap.end - gap.start + 1
+		var targets []partitionResizeTarget
+		for i, w := range []int64{2, 1} {
+			targets = append(targets, partitionResizeTarget{
+				original: partitionData{
+					start:  parts[i].GetStart(),
+					size:   parts[i].GetSize(),
+					label:  parts[i].Name,
+					number: int(parts[i].Index),
+				},
+				mode:   SizeWeight,
+				weight: w,
+			})
+		}
+		resizes, err := calculateResizes(d.Size, parts, targets)
+		if err != nil {
+			t.Fatalf("calculateResizes failed: %v", err)
+		}
+		if len(resizes) != 2 {
+			t.Fatalf("got %d resizes, want 2", len(resizes))
+		}
+		want0 := int64(float64(available)*2/3) / MB * MB
+		want1 := int64(float64(available)/3) / MB * MB
+		if resizes[0].target.size != want0 || resizes[1].target.size != want1 {
+			t.Errorf("sizes = %d, %d, want %d, %d", resizes[0].target.size, resizes[1].target.size, want0, want1)
+		}
+		if resizes[0].target.start != gap.start || resizes[1].target.start != resizes[0].target.end+1 {
+			t.Errorf("weighted targets not laid out back to back from %d: %+v, %+v", gap.start, resizes[0].target, resizes[1].target)
+		}
+	})
+	t.Run("max without space", func(t *testing.T) {
+		// fill the gap with a fixed grow so nothing larger than the max target is left
+		gap := unused[len(unused)-1]
+		fixed := partitionResizeTarget{
+			original: partitionData{
+				start:  parts[0].GetStart(),
+				size:   parts[0].GetSize(),
+				label:  parts[0].Name,
+				number: int(parts[0].Index),
+			},
+			target: partitionData{
+				size: gap.end - gap.start + 1,
+			},
+		}
+		maxTarget := partitionResizeTarget{
+			original: partitionData{
+				start:  parts[1].GetStart(),
+				size:   parts[1].GetSize(),
+				label:  parts[1].Name,
+				number: int(parts[1].Index),
+			},
+			mode: SizeMax,
+		}
+		if _, err := calculateResizes(d.Size, parts, []partitionResizeTarget{fixed, maxTarget}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
 }
 
 func TestSortAndCombineUsableBlocks(t *testing.T) {
@@ -261,3 +368,93 @@ func TestSortAndCombineUsableBlocks(t *testing.T) {
 		t.Errorf("sortAndCombineUsableBlocks() = %v", diff)
 	}
 }
+
+// TestCalculateResizesInPlace verifies that a target marked inPlace grows into
+// the free space immediately following it, and is relocated when that is too
+// small.
+func TestCalculateResizesInPlace(t *testing.T) {
+	// 1MB: part 1 (10MB), 10MB free, 21MB: part 2 (10MB), free to 100MB
+	parts := []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 10 * MB, Name: "one"},
+		{Index: 2, Start: 21 * MB / 512, Size: 10 * MB, Name: "two"},
+	}
+	original := partitionData{label: "one", number: 1, start: 1 * MB, size: 10 * MB, end: 11*MB - 1}
+
+	t.Run("fits", func(t *testing.T) {
+		target := partitionResizeTarget{original: original, target: partitionData{size: 15 * MB}, inPlace: true}
+		resizes, err := calculateResizes(100*MB, parts, []partitionResizeTarget{target})
+		if err != nil {
+			t.Fatalf("calculateResizes failed: %v", err)
+		}
+		r := resizes[0]
+		if !r.inPlace || r.target.start != original.start || r.target.number != original.number || r.target.end != 16*MB-1 {
+			t.Errorf("resize = %+v, want grown in place to end %d", r, 16*MB-1)
+		}
+	})
+	t.Run("relocated", func(t *testing.T) {
+		target := partitionResizeTarget{original: original, target: partitionData{size: 25 * MB}, inPlace: true}
+		resizes, err := calculateResizes(100*MB, parts, []partitionResizeTarget{target})
+		if err != nil {
+			t.Fatalf("calculateResizes failed: %v", err)
+		}
+		r := resizes[0]
+		if r.inPlace || r.target.start != 31*MB || r.target.number != 3 {
+			t.Errorf("resize = %+v, want relocated to partition 3 at %d", r, 31*MB)
+		}
+	})
+}
+
+func TestFreeExtents(t *testing.T) {
+	used := []Extent{
+		{Start: 60, End: 69},
+		{Start: 10, End: 29},
+		{Start: 20, End: 39},
+	}
+	free := FreeExtents(100, used)
+	want := []Extent{
+		{Start: 1, End: 9},
+		{Start: 40, End: 59},
+		{Start: 70, End: 99},
+	}
+	if diff := deep.Equal(free, want); diff != nil {
+		t.Errorf("FreeExtents() = %v", diff)
+	}
+	if used[0].Start != 60 {
+		t.Errorf("FreeExtents() reordered used: %v", used)
+	}
+	merged := MergeExtents(used)
+	if diff := deep.Equal(merged, []Extent{{Start: 10, End: 39}, {Start: 60, End: 69}}); diff != nil {
+		t.Errorf("MergeExtents() = %v", diff)
+	}
+}
+
+// TestAllocate places a relative grow, which is relocated, and a shrink, which
+// stays where it is.
+func TestAllocate(t *testing.T) {
+	const size = 100 * MB
+	parts := []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 10 * MB, Name: "one"},
+		{Index: 2, Start: 11 * MB / 512, Size: 10 * MB, Name: "two"},
+	}
+	targets := []AllocationTarget{
+		{Label: "one", Original: PartitionGeometry{Number: 1, Start: 1 * MB, Size: 10 * MB}, Size: 20 * MB, Mode: SizeRelative},
+		{Label: "two", Original: PartitionGeometry{Number: 2, Start: 11 * MB, Size: 10 * MB}, Size: 5 * MB},
+	}
+	placed, err := Allocate(size, parts, targets)
+	if err != nil {
+		t.Fatalf("Allocate() error: %v", err)
+	}
+	want := []PartitionResult{
+		{Label: "one", Original: PartitionGeometry{Number: 1, Start: 1 * MB, End: 11*MB - 1, Size: 10 * MB}, Final: PartitionGeometry{Number: 3, Start: 21 * MB, End: 51*MB - 1, Size: 30 * MB}, Moved: true},
+		{Label: "two", Original: PartitionGeometry{Number: 2, Start: 11 * MB, End: 21*MB - 1, Size: 10 * MB}, Final: PartitionGeometry{Number: 2, Start: 11 * MB, End: 16*MB - 1, Size: 5 * MB}},
+	}
+	if diff := deep.Equal(placed, want); diff != nil {
+		t.Errorf("Allocate() = %v", diff)
+	}
+
+	targets[0].Size = 100 * MB
+	var ise *InsufficientSpaceError
+	if _, err := Allocate(size, parts, targets); !errors.As(err, &ise) {
+		t.Errorf("Allocate() error = %v, want an InsufficientSpaceError", err)
+	}
+}
@@ -0,0 +1,188 @@
+package partitionresizer
+
+import (
+	"cmp"
+	"context"
+	"encoding"
+	"hash"
+	"sync"
+)
+
+// DefaultCheckpointInterval is how many bytes of each stripe of a raw copy
+// are copied between checkpoints, unless Options.CheckpointInterval says
+// otherwise.
+const DefaultCheckpointInterval = 1 * GB
+
+// journalCopy is how far the raw copy of a partition has got, as recorded in
+// a journal, so that a resumed resize continues it rather than starting over.
+type journalCopy struct {
+	// Stripe is the size of the stripes the copy is split into, see stripes
+	Stripe int64 `json:"stripe"`
+	// Copied is the bytes of each stripe copied and synced to the device
+	Copied []int64 `json:"copied"`
+	// Hashes is the state of the SHA-256 hash of each stripe of the source,
+	// as far as it was copied, for VerifyFull, and the fingerprint a resumed
+	// copy checks the source against, whatever the verification
+	Hashes [][]byte `json:"hashes,omitempty"`
+	// CopyHashes is the state of the SHA-256 hash of each stripe of the copy,
+	// as far as it was read back, where it is read back as it is copied
+	CopyHashes [][]byte `json:"copyHashes,omitempty"`
+	// Resync is set once the copy is written, but did not match its
+	// source, for it to be re-synced rather than copied again, see
+	// resyncWriter
+	Resync bool `json:"resync,omitempty"`
+	// Mounted is set should the source have been mounted, copied frozen,
+	// as it may have been written since, where nothing recorded shows it
+	Mounted bool `json:"mounted,omitempty"`
+}
+
+// copyCheckpoints records how far raw copies have got in the journal of the
+// resize, see withCopyCheckpoints. A nil *copyCheckpoints records nothing.
+type copyCheckpoints struct {
+	j        *journal
+	interval int64
+	// mu serializes the updates of the journal by the copies and stripes
+	// running at once
+	mu sync.Mutex
+}
+
+// newCopyCheckpoints returns the copyCheckpoints recording in j every
+// interval bytes, or DefaultCheckpointInterval if interval is 0; nil without
+// a journal.
+func newCopyCheckpoints(j *journal, interval int64) *copyCheckpoints {
+	if j == nil {
+		return nil
+	}
+	return &copyCheckpoints{j: j, interval: cmp.Or(interval, DefaultCheckpointInterval)}
+}
+
+type copyCheckpointsKey struct{}
+
+// withCopyCheckpoints returns a copy of ctx carrying checkpoints.
+func withCopyCheckpoints(ctx context.Context, checkpoints *copyCheckpoints) context.Context {
+	return context.WithValue(ctx, copyCheckpointsKey{}, checkpoints)
+}
+
+// copyCheckpointsFrom returns the copyCheckpoints ctx carries, if any.
+func copyCheckpointsFrom(ctx context.Context) *copyCheckpoints {
+	checkpoints, _ := ctx.Value(copyCheckpointsKey{}).(*copyCheckpoints)
+	return checkpoints
+}
+
+// start returns how far an earlier run got with the raw copy of partition
+// number, of length bytes, in stripes of stripe bytes each, unless it
+// recorded other stripes, in which case those are the stripes to copy in. It
+// returns a fresh record, for the copy to record to, should nothing, or
+// nothing that fits length, be recorded, or should the source be mounted, as
+// mounted says, or have been when it was recorded: a mounted source is only
+// frozen while it is copied, so may have been written since.
+func (c *copyCheckpoints) start(number int, length, stripe int64, n int, mounted bool) *journalCopy {
+	fresh := &journalCopy{Stripe: stripe, Copied: make([]int64, n), Hashes: make([][]byte, n), CopyHashes: make([][]byte, n), Mounted: mounted}
+	if c == nil {
+		return fresh
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recorded := c.j.Copies[number]
+	if recorded == nil || mounted || recorded.Mounted || recorded.Stripe <= 0 || len(recorded.Copied) != int((length+recorded.Stripe-1)/recorded.Stripe) {
+		return fresh
+	}
+	n = len(recorded.Copied)
+	resumed := &journalCopy{Stripe: recorded.Stripe, Copied: make([]int64, n), Hashes: make([][]byte, n), CopyHashes: make([][]byte, n), Resync: recorded.Resync}
+	for i, copied := range recorded.Copied {
+		if size := min(recorded.Stripe, length-int64(i)*recorded.Stripe); copied > 0 && copied <= size {
+			resumed.Copied[i] = copied
+			if i < len(recorded.Hashes) {
+				resumed.Hashes[i] = recorded.Hashes[i]
+			}
+			if i < len(recorded.CopyHashes) {
+				resumed.CopyHashes[i] = recorded.CopyHashes[i]
+			}
+		}
+	}
+	return resumed
+}
+
+// segment returns how much of the remaining bytes of a stripe to copy before
+// its next checkpoint: all of them without checkpoints.
+func (c *copyCheckpoints) segment(remaining int64) int64 {
+	if c == nil {
+		return remaining
+	}
+	return min(remaining, c.interval)
+}
+
+// record records that stripe i of the raw copy of partition number, as
+// start returned it, has copied copied bytes of its source, hashed to the
+// state of h, and
+// read back and hashed to the state of copyHash, each if set, once they are
+// on the device.
+func (c *copyCheckpoints) record(number int, cp *journalCopy, i int, copied int64, h, copyHash hash.Hash) error {
+	if c == nil {
+		return nil
+	}
+	state, err := hashState(h)
+	if err != nil {
+		return err
+	}
+	copyState, err := hashState(copyHash)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp.Copied[i], cp.Hashes[i], cp.CopyHashes[i] = copied, state, copyState
+	if c.j.Copies == nil {
+		c.j.Copies = map[int]*journalCopy{}
+	}
+	c.j.Copies[number] = &journalCopy{Stripe: cp.Stripe, Copied: append([]int64{}, cp.Copied...), Hashes: append([][]byte{}, cp.Hashes...), CopyHashes: append([][]byte{}, cp.CopyHashes...), Resync: cp.Resync, Mounted: cp.Mounted}
+	return c.j.save()
+}
+
+// resync returns a fresh record for the raw copy of partition number, in the
+// stripes of cp, to be re-synced from the start, see journalCopy.Resync,
+// and records it, so that a resumed copy re-syncs rather than copying again.
+func (c *copyCheckpoints) resync(number int, cp *journalCopy) (*journalCopy, error) {
+	n := len(cp.Copied)
+	fresh := &journalCopy{Stripe: cp.Stripe, Copied: make([]int64, n), Hashes: make([][]byte, n), CopyHashes: make([][]byte, n), Resync: true, Mounted: cp.Mounted}
+	if c == nil {
+		return fresh, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.j.Copies == nil {
+		c.j.Copies = map[int]*journalCopy{}
+	}
+	c.j.Copies[number] = &journalCopy{Stripe: fresh.Stripe, Copied: make([]int64, n), Resync: true, Mounted: cp.Mounted}
+	return fresh, c.j.save()
+}
+
+// clear forgets how far the raw copy of partition number got, once it is
+// done, or is to start over.
+func (c *copyCheckpoints) clear(number int) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.j.Copies[number]; !ok {
+		return nil
+	}
+	delete(c.j.Copies, number)
+	return c.j.save()
+}
+
+// restoreHash restores h to the state recorded for it, and reports whether it
+// could; should it not, the stripe is to be copied again from its start.
+func restoreHash(h hash.Hash, state []byte) bool {
+	u, ok := h.(encoding.BinaryUnmarshaler)
+	return ok && state != nil && u.UnmarshalBinary(state) == nil
+}
+
+// hashState returns the state of h to record, nil if h is not set.
+func hashState(h hash.Hash) ([]byte, error) {
+	if h == nil {
+		return nil, nil
+	}
+	return h.(encoding.BinaryMarshaler).MarshalBinary()
+}
@@ -0,0 +1,173 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// cancellingProgress cancels a copy once it has copied at least after bytes,
+// and records the first bytes copied it is told of.
+type cancellingProgress struct {
+	nopProgress
+	after  int64
+	cancel context.CancelFunc
+	first  int64
+}
+
+func (p *cancellingProgress) BytesCopied(_ int, copied, _ int64) {
+	if p.first == 0 {
+		p.first = copied
+	}
+	if p.after > 0 && copied >= p.after {
+		p.cancel()
+	}
+}
+
+func TestCopyPartitionRawResume(t *testing.T) {
+	dir := t.TempDir()
+	r := partitionResizeTarget{
+		original: partitionData{number: 1, start: 1 * MB, size: 24 * MB},
+		target:   partitionData{number: 2, start: 32 * MB, size: 24 * MB},
+		streams:  2,
+		bufSize:  1 * MB,
+	}
+	diskPath := filepath.Join(dir, "disk.img")
+	data := make([]byte, 64*MB)
+	for i := r.original.start; i < r.original.start+r.original.size; i++ {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(diskPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = storage.Close() }()
+	d := &disk.Disk{Backend: storage}
+	journalPath := filepath.Join(dir, "journal.json")
+	j := &journal{path: journalPath, Completed: []string{}}
+
+	// interrupted once each stripe has passed its first checkpoint
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := &cancellingProgress{after: 14 * MB, cancel: cancel}
+	ctx = withCopyCheckpoints(ctx, newCopyCheckpoints(j, 4*MB))
+	if err := copyPartitionRaw(ctx, slog.Default(), d, r, progress); !errors.Is(err, context.Canceled) {
+		t.Fatalf("copyPartitionRaw() interrupted = %v, want %v", err, context.Canceled)
+	}
+	j, err = readJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := j.Copies[r.original.number]
+	if cp == nil || cp.Stripe != 12*MB || len(cp.Copied) != 2 {
+		t.Fatalf("journal records copy %+v, want 2 stripes of 12 MB", cp)
+	}
+	var recorded int64
+	for i, copied := range cp.Copied {
+		if copied%(4*MB) != 0 || copied >= 12*MB || cp.Hashes[i] == nil && copied > 0 {
+			t.Errorf("stripe %d checkpointed at %d bytes, hash %x", i, copied, cp.Hashes[i])
+		}
+		recorded += copied
+	}
+	if recorded == 0 {
+		t.Fatal("no checkpoint recorded")
+	}
+
+	interrupted, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what was copied before a checkpoint, of a source that has not changed,
+	// is not copied again
+	progress = &cancellingProgress{}
+	ctx = withCopyCheckpoints(context.Background(), newCopyCheckpoints(j, 4*MB))
+	if err := copyPartitionRaw(ctx, slog.Default(), d, r, progress); err != nil {
+		t.Fatalf("copyPartitionRaw() resumed error: %v", err)
+	}
+	if progress.first < min(cp.Copied[0], cp.Copied[1]) {
+		t.Errorf("resumed copy first reported %d bytes copied, want at least %d", progress.first, min(cp.Copied[0], cp.Copied[1]))
+	}
+	got, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[r.target.start:r.target.start+r.original.size], data[r.original.start:r.original.start+r.original.size]) {
+		t.Error("resumed copy differs from its source")
+	}
+	if j, err = readJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+	if len(j.Copies) != 0 {
+		t.Errorf("journal still records copies %v once the copy is done", j.Copies)
+	}
+
+	// the same checkpoints, of a source written since, must not stitch what
+	// was copied of it before onto what is copied of it now
+	if err := os.WriteFile(journalPath, interrupted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if j, err = readJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+	w, err := storage.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(make([]byte, 4*MB), r.original.start); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[r.original.start:], make([]byte, 4*MB))
+	ctx = withCopyCheckpoints(context.Background(), newCopyCheckpoints(j, 4*MB))
+	if err := copyPartitionRaw(ctx, slog.Default(), d, r, &cancellingProgress{}); err != nil {
+		t.Fatalf("copyPartitionRaw() resumed after the source changed error: %v", err)
+	}
+	if got, err = os.ReadFile(diskPath); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[r.target.start:r.target.start+r.original.size], data[r.original.start:r.original.start+r.original.size]) {
+		t.Error("copy resumed after the source changed differs from its source")
+	}
+}
+
+func TestCopyCheckpointsStart(t *testing.T) {
+	var none *copyCheckpoints
+	if cp := none.start(1, 10*MB, 4*MB, 3, false); cp.Stripe != 4*MB || len(cp.Copied) != 3 {
+		t.Errorf("start() without checkpoints = %+v, want 3 fresh stripes of 4 MB", cp)
+	}
+	j := &journal{path: filepath.Join(t.TempDir(), "journal.json"), Copies: map[int]*journalCopy{
+		1: {Stripe: 5 * MB, Copied: []int64{2 * MB, 6 * MB}, Hashes: [][]byte{{1}, {2}}},
+		// recorded for a partition of another size
+		2: {Stripe: 1 * MB, Copied: []int64{1 * MB}},
+	}}
+	c := newCopyCheckpoints(j, 0)
+	if c.interval != DefaultCheckpointInterval {
+		t.Errorf("interval = %d, want %d", c.interval, DefaultCheckpointInterval)
+	}
+	// the second stripe records more than it holds, so starts over
+	cp := c.start(1, 10*MB, 4*MB, 3, false)
+	if cp.Stripe != 5*MB || len(cp.Copied) != 2 || cp.Copied[0] != 2*MB || cp.Copied[1] != 0 || cp.Hashes[1] != nil {
+		t.Errorf("start() = %+v, want the recorded stripes, the second from its start", cp)
+	}
+	if cp := c.start(2, 10*MB, 4*MB, 3, false); cp.Stripe != 4*MB || cp.Copied[0] != 0 {
+		t.Errorf("start() of a copy recorded for another size = %+v, want fresh stripes", cp)
+	}
+	// nor is a copy of a source that is mounted, or was
+	if cp := c.start(1, 10*MB, 4*MB, 3, true); cp.Stripe != 4*MB || cp.Copied[0] != 0 || !cp.Mounted {
+		t.Errorf("start() of a copy of a mounted source = %+v, want fresh stripes recording it mounted", cp)
+	}
+	j.Copies[1].Mounted = true
+	if cp := c.start(1, 10*MB, 4*MB, 3, false); cp.Stripe != 4*MB || cp.Copied[0] != 0 {
+		t.Errorf("start() of a copy recorded of a mounted source = %+v, want fresh stripes", cp)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+// completionIdentifiers are the identifiers completePartitions offers, in the
+// order it offers them; uuid, the older name for partuuid, is left out.
+var completionIdentifiers = []resizer.Identifier{
+	resizer.IdentifierByName,
+	resizer.IdentifierByLabel,
+	resizer.IdentifierByFSLabel,
+	resizer.IdentifierByPartUUID,
+	resizer.IdentifierByFSUUID,
+	resizer.IdentifierByDevice,
+}
+
+// completeDisks completes the disk argument with the disks resizer.ListDisks
+// finds, each described by its size, falling back to file names, as the disk
+// may be an image file. Any argument after the disk is not completed.
+func completeDisks(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	disks, err := resizer.ListDisks("")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	var completions []string
+	for _, d := range disks {
+		if strings.HasPrefix(d.Path, toComplete) {
+			completions = append(completions, fmt.Sprintf("%s\t%s", d.Path, formatSize(d.Size)))
+		}
+	}
+	return completions, cobra.ShellCompDirectiveDefault
+}
+
+// completeGrowpart completes the arguments of growpart: the disk, as
+// completeDisks does, then the number of one of its partitions.
+func completeGrowpart(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 1 {
+		return completeDisks(cmd, args, toComplete)
+	}
+	disks, err := resizer.ListDisks(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var completions []string
+	for _, d := range disks {
+		for _, p := range d.Partitions {
+			if number := strconv.Itoa(p.Number); strings.HasPrefix(number, toComplete) {
+				completions = append(completions, fmt.Sprintf("%s\t%s", number, describePartition(p)))
+			}
+		}
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePartitions completes a partition identifier, for --shrink-partition,
+// --grow-partition, --exclude-partition, --legacy-bootable and
+// --no-legacy-bootable: first the identifier type, e.g.
+// label:, then its value, from the partitions of the disk given as an
+// argument or with --disk, or of every disk should neither be given, e.g.
+// label:rootfs. Neither is followed by a space, as a size may follow.
+func (f *resizeFlags) completePartitions(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	by, value, ok := strings.Cut(toComplete, ":")
+	var completions []string
+	if !ok {
+		for _, id := range completionIdentifiers {
+			if strings.HasPrefix(string(id), toComplete) {
+				completions = append(completions, string(id)+":")
+			}
+		}
+		return completions, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	}
+	var disk string
+	switch {
+	case len(args) > 0:
+		disk = args[0]
+	case f.disk != "":
+		// a disk --disk does not select completes nothing, rather than
+		// every disk's partitions
+		var err error
+		if disk, err = resolveDisk(f.disk); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+	}
+	disks, err := resizer.ListDisks(disk)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	for _, d := range disks {
+		for _, p := range d.Partitions {
+			v := identifierValue(p, resizer.Identifier(by))
+			if v != "" && strings.HasPrefix(v, value) {
+				completions = append(completions, fmt.Sprintf("%s:%s\t%s of %s", by, v, describePartition(p), d.Path))
+			}
+		}
+	}
+	return completions, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+}
+
+// identifierValue returns what identifies p by by, e.g. its label for
+// resizer.IdentifierByLabel, or "" if it has nothing it can be identified by
+// that way.
+func identifierValue(p resizer.PartitionInfo, by resizer.Identifier) string {
+	switch by {
+	case resizer.IdentifierByName:
+		return p.Name
+	case resizer.IdentifierByLabel:
+		return p.Label
+	case resizer.IdentifierByFSLabel:
+		return p.FSLabel
+	case resizer.IdentifierByPartUUID, resizer.IdentifierByUUID:
+		return p.PartUUID
+	case resizer.IdentifierByFSUUID:
+		return p.FSUUID
+	case resizer.IdentifierByDevice:
+		if p.Name != "" {
+			return "/dev/" + p.Name
+		}
+	}
+	return ""
+}
+
+// describePartition describes p for a completion: its number, size, and the
+// type of its filesystem, if known.
+func describePartition(p resizer.PartitionInfo) string {
+	desc := fmt.Sprintf("partition %d, %s", p.Number, formatSize(p.Size))
+	if p.FSType != "" {
+		desc += ", " + p.FSType
+	}
+	return desc
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultConfigPath is where the defaults of the flags are read from
+	// when --config is not given.
+	defaultConfigPath = "/etc/resizer.conf"
+	// noConfigAnnotation marks a flag, see noConfig, that is not given its
+	// value by the config file.
+	noConfigAnnotation = "resizer_no_config"
+)
+
+// noConfig marks the flags of cmd named, those that say what to act on rather
+// than how, so that the config file does not give them values, e.g. the
+// partitions to grow, or the path plan saves the plan to, rather than the
+// format of --output for the other commands.
+func noConfig(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		_ = cmd.Flags().SetAnnotation(name, noConfigAnnotation, []string{"true"})
+	}
+}
+
+// applyConfig sets each flag of cmd not given on the command line to the value
+// the config file at path gives it. The file is a YAML mapping of flag names,
+// without the dashes, to values, a list for a flag that may be repeated, e.g.
+// verify: sampled, or exclude-partition: ["label:EFI System"]. A flag cmd does
+// not have, or has marked with noConfig, is skipped, the file being shared by
+// every command, but one no command has is an error. A missing file is not an
+// error unless required, i.e. named with --config, and an empty path reads
+// none.
+func applyConfig(cmd *cobra.Command, path string, required bool) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config %s: %v", path, err)
+	}
+	known := configFlags(cmd.Root())
+	for _, name := range slices.Sorted(maps.Keys(config)) {
+		value := config[name]
+		if name == "config" || !known[name] {
+			return fmt.Errorf("config %s: unknown flag %s", path, name)
+		}
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed || flag.Annotations[noConfigAnnotation] != nil {
+			continue
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case []any, map[string]any:
+				return fmt.Errorf("config %s: invalid %s value %v", path, name, v)
+			}
+			if err := flag.Value.Set(fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("config %s: invalid %s value %v: %v", path, name, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFlags returns the names of the flags of cmd and of each of its
+// subcommands.
+func configFlags(cmd *cobra.Command) map[string]bool {
+	names := make(map[string]bool)
+	add := func(f *pflag.Flag) { names[f.Name] = true }
+	cmd.Flags().VisitAll(add)
+	cmd.PersistentFlags().VisitAll(add)
+	for _, sub := range cmd.Commands() {
+		for name := range configFlags(sub) {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// newConfirm returns an Options.Confirm that asks on out whether to go ahead
+// with each step, reading the answer from in; anything but y or yes declines.
+// Unless interactive, there is no one to ask, so it declines every step,
+// saying to pass --yes.
+func newConfirm(in io.Reader, out io.Writer, interactive bool) func(string) bool {
+	answers := bufio.NewReader(in)
+	return func(description string) bool {
+		if !interactive {
+			_, _ = fmt.Fprintf(out, "Cannot confirm: %s\nstdin is not a terminal; pass --yes (or --assume-yes) to go ahead without asking\n", description)
+			return false
+		}
+		_, _ = fmt.Fprintf(out, "About to %s. Continue? [y/N] ", description)
+		answer, _ := answers.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		}
+		return false
+	}
+}
+
+// askBeforeResizing sets opts to print the resize on out once it is planned,
+// as a diff of each partition's geometry, and then to ask on out, reading the
+// answers from in, whether to go ahead with it, and before each step that
+// cannot be undone, as newConfirm.
+func askBeforeResizing(opts *resizer.Options, in io.Reader, out io.Writer, interactive bool) {
+	opts.Confirm = newConfirm(in, out, interactive)
+	onEvent := opts.OnEvent
+	opts.OnEvent = func(e resizer.Event) {
+		if e.Kind == resizer.EventPlanComputed {
+			_, _ = fmt.Fprintf(out, "Resize of %s:\n", e.Disk)
+			_ = writeDiff(out, e.Plan)
+			_ = writeLayout(out, e.Disk, e.Plan)
+		}
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
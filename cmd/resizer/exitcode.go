@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// The exit codes of the resizer, and of its subcommands other than growpart,
+// which exits as growpart does, so that automation can tell why a resize did
+// not happen; a command stopped by an interrupt exits with exitInterrupted.
+// 2 is not used, it being the exit code of a panic.
+const (
+	// exitFailure is the exit code of any failure not listed below.
+	exitFailure = 1
+	// exitInvalid is the exit code when the flags, plan or layout given
+	// cannot be used, or the resize they ask for cannot be planned, so that
+	// nothing is changed.
+	exitInvalid = 3
+	// exitNothingToDo is the exit code when the partitions already have the
+	// sizes asked for, so that nothing is resized.
+	exitNothingToDo = 4
+	// exitNoSpace is the exit code when there is not enough free space, or
+	// space the shrinks can free, for the grows.
+	exitNoSpace = 5
+	// exitBusy is the exit code when a partition to resize is in use.
+	exitBusy = 6
+	// exitToolMissing is the exit code when an external tool the resize
+	// needs, e.g. resize2fs, is not installed.
+	exitToolMissing = 7
+	// exitCopyFailed is the exit code when copying a partition, verifying
+	// the copy, or checking the filesystems resized afterwards, fails.
+	exitCopyFailed = 8
+)
+
+// exitCode returns the exit code for err, the error of a resize with results,
+// those of the disks it resized, if any.
+func exitCode(err error, results ...*resizer.Result) int {
+	var (
+		spaceErr *resizer.InsufficientSpaceError
+		inUseErr *resizer.InUseError
+		copyErr  *resizer.CopyError
+		checkErr *resizer.FilesystemCheckError
+		planErr  *resizer.PlanError
+		staleErr *resizer.StalePlanError
+		protErr  *resizer.ProtectedPartitionError
+		bootErr  *resizer.BootPartitionError
+		dryErr   *resizer.DryRunError
+	)
+	switch {
+	case errors.As(err, &spaceErr):
+		return exitNoSpace
+	case errors.As(err, &inUseErr):
+		return exitBusy
+	case errors.Is(err, exec.ErrNotFound) || toolNotFound(results):
+		return exitToolMissing
+	case errors.As(err, &dryErr):
+		for _, p := range dryErr.Problems {
+			if p.Tool != "" {
+				return exitToolMissing
+			}
+		}
+	case errors.As(err, &copyErr), errors.As(err, &checkErr):
+		return exitCopyFailed
+	case errors.As(err, &planErr), errors.As(err, &staleErr), errors.As(err, &protErr), errors.As(err, &bootErr):
+		return exitInvalid
+	}
+	return exitFailure
+}
+
+// toolNotFound reports whether any of results ran an external tool that was
+// not found.
+func toolNotFound(results []*resizer.Result) bool {
+	for _, res := range results {
+		if res == nil {
+			continue
+		}
+		for _, t := range res.Tools {
+			if t.NotFound {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exitIfResizeFailed exits with the exit code for err, logging it, should the
+// resize with results, those of the disks it resized, have failed.
+func exitIfResizeFailed(err error, results ...*resizer.Result) {
+	if err == nil {
+		return
+	}
+	var (
+		checkErr *resizer.FilesystemCheckError
+		dryErr   *resizer.DryRunError
+		bootErr  *resizer.BootPartitionError
+	)
+	if errors.As(err, &checkErr) {
+		exitf(exitCode(err, results...), "Resize completed, but filesystems need attention before use: %v", err)
+	}
+	if errors.As(err, &dryErr) {
+		exitf(exitCode(err, results...), "Dry run found problems: %v", err)
+	}
+	if errors.As(err, &bootErr) {
+		exitf(exitCode(err, results...), "Resize operation failed: %v; pass --force-boot-partitions to resize them regardless", err)
+	}
+	exitf(exitCode(err, results...), "Resize operation failed: %v", err)
+}
+
+// exitIfNothingResized exits with exitNothingToDo should none of results,
+// those of the disks resized, resize a partition.
+func exitIfNothingResized(results ...*resizer.Result) {
+	for _, res := range results {
+		if res != nil && len(res.Partitions) > 0 {
+			return
+		}
+	}
+	log.Printf("Nothing to resize")
+	os.Exit(exitNothingToDo)
+}
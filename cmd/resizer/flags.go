@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+// resizeFlags are the flags that say what to resize and how, shared by the
+// resizer itself and the plan command.
+type resizeFlags struct {
+	shrinkPartitions  []string
+	growPartitions    []string
+	fixErrors         bool
+	preserveNumbers   bool
+	autoShrink        bool
+	shrinkGranularity string
+	shrinkMargin      string
+	luksKeyFile       string
+	onlineGrow        bool
+	freezeMounted     bool
+	acceptLostWrites  bool
+	freezeTimeout     time.Duration
+	temporaryUUID     bool
+	journalPath       string
+	snapshotDir       string
+	auditLog          string
+	reason            string
+	verify            string
+	toolTimeout       time.Duration
+	tools             []string
+	hooks             []string
+	disk              string
+	excludePartitions []string
+	forceBoot         bool
+	updateBootEntries bool
+	legacyBootable    []string
+	notLegacyBootable []string
+	copyWorkers       int
+	copyStreams       int
+	bufferSize        string
+	autoTune          bool
+	checkpoint        string
+	maxThroughput     string
+	ioPriority        string
+	noCacheHints      bool
+	noAtime           bool
+	discard           bool
+	wipeRemoved       string
+	layout            string
+	// interactive is set by the resizer itself, not the plan command
+	interactive bool
+}
+
+// register adds the flags to cmd.
+func (f *resizeFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&f.shrinkPartitions, "shrink-partition", []string{}, "Partitions to shrink to make space, if necessary, in format identifier:partition[:-size]; may be repeated to spread the shrink across several partitions in proportion to their free space, or given a negative size to take exactly that amount")
+	cmd.Flags().StringSliceVar(&f.growPartitions, "grow-partition", []string{}, "Partitions to grow, along with their desired sizes, in format identifier:partition:size, see help (e.g. name:sda1:20G, dev:/dev/nvme0n1p2:20G, label:EFI System:100M, fslabel:rootfs:20G, partuuid:<partuuid>:20G, fsuuid:<filesystem uuid>:20G, name:sda1:+10G to grow by an amount, or name:sda4:max to fill the remaining free space); append :type=<GUID> to also give the partition that GPT partition type as its resize is committed, e.g. label:rootfs:max:type=4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	cmd.Flags().StringVar(&f.layout, "layout", "", "Layout file, in YAML, listing the size each partition of the disk is to end up with, or its min and max, in place of --grow-partition and --shrink-partition; the resize that gives the disk the layout is planned, see help")
+	cmd.Flags().StringSliceVar(&f.excludePartitions, "exclude-partition", []string{}, "Partitions that must never be shrunk, grown, moved, renumbered or removed, in format identifier:partition (e.g. label:EFI System or fslabel:recovery); a plan that would touch one fails; may be repeated")
+	cmd.Flags().BoolVar(&f.forceBoot, "force-boot-partitions", false, "If set, allow shrinking, moving or renumbering a boot partition (EFI system, BIOS boot, or another *-boot type), which can leave the system unable to boot until its firmware and boot loader are updated to find it; without it, a plan that would fails")
+	cmd.Flags().BoolVar(&f.updateBootEntries, "update-boot-entries", false, "If set, re-register with efibootmgr the UEFI boot entries for a loader on an EFI system partition moved to a new location, so that they name it by its new number, start and size; best effort, only for a block device of a system booted with UEFI")
+	cmd.Flags().StringSliceVar(&f.legacyBootable, "legacy-bootable", []string{}, "Partitions moved to a new location whose copies to set the legacy BIOS bootable GPT attribute (bit 2) of, in format identifier:partition (e.g. label:rootfs), as the boot code of some hybrid-boot images needs; may be repeated")
+	cmd.Flags().StringSliceVar(&f.notLegacyBootable, "no-legacy-bootable", []string{}, "Partitions moved to a new location whose copies to clear the legacy BIOS bootable GPT attribute (bit 2) of, in format identifier:partition; may be repeated")
+	cmd.Flags().BoolVar(&f.fixErrors, "fix-errors", false, "If set, repair filesystem errors found while checking the source filesystems (ext4 via e2fsck -y, FAT32 via fsck.fat -a) instead of aborting on an inconsistent source")
+	cmd.Flags().BoolVar(&f.preserveNumbers, "preserve-numbers", false, "If set, a grown partition that is relocated is renumbered back to its original partition number, so labels keep their original partition numbers (e.g. /dev/sda2)")
+	cmd.Flags().BoolVar(&f.autoShrink, "auto-shrink", false, "If set and there is not enough free space and no --shrink-partition is given, shrink the largest ext4 partition with enough free space inside it")
+	cmd.Flags().StringVar(&f.shrinkGranularity, "shrink-granularity", "", "Unit the total space reclaimed by shrinking is rounded up to, e.g. 1M or 1G (default 1M)")
+	cmd.Flags().BoolVar(&f.onlineGrow, "online-grow", false, "If set, grow an ext4 or XFS partition in place when free space immediately follows it, even while it is mounted (e.g. the running root), growing its filesystem online")
+	cmd.Flags().StringVar(&f.luksKeyFile, "luks-key-file", "", "Key file that unlocks LUKS-encrypted partitions being grown or shrunk; required to resize an encrypted partition")
+	cmd.Flags().StringVar(&f.shrinkMargin, "shrink-margin", "", "Free space that must remain inside a shrunk filesystem, as a size (e.g. 512M) or a percentage of the filesystem (e.g. 10%)")
+	cmd.Flags().BoolVar(&f.freezeMounted, "freeze-mounted", false, "If set, allow a mounted partition to be copied to its new location, freezing its filesystem with fsfreeze for the copy")
+	cmd.Flags().BoolVar(&f.acceptLostWrites, "accept-lost-writes", false, "Accept that with --freeze-mounted, whatever is written to a mounted partition once its copy is done is lost, until the reboot that puts the copy in use; --freeze-mounted is refused without it")
+	cmd.Flags().DurationVar(&f.freezeTimeout, "freeze-timeout", resizer.DefaultFreezeTimeout, "Longest a filesystem is kept frozen by --freeze-mounted; a copy taking longer fails")
+	cmd.Flags().BoolVar(&f.temporaryUUID, "temporary-uuid", false, "If set, give each copied ext4, XFS or LUKS partition a temporary filesystem UUID, restoring the original only once the copy is complete and verified")
+	cmd.Flags().StringVar(&f.journalPath, "journal", "", "Record each phase of the resize in a journal at this path (e.g. "+resizer.DefaultJournalPath+"), so that an interrupted resize can be finished with the resume command, or undone with the rollback command")
+	cmd.Flags().StringVar(&f.snapshotDir, "snapshot-dir", resizer.DefaultSnapshotDir, "Directory to save a snapshot of the partition table, and the start and end of each partition being resized, to before changing anything; empty to take none")
+	cmd.Flags().StringVar(&f.auditLog, "audit-log", resizer.DefaultAuditLogPath, "File to append a record of each partition table write to, one JSON object per line: the disk, each partition's number, GUIDs and geometry before and after, the partitions removed, the time and --reason; empty to keep none")
+	cmd.Flags().StringVar(&f.reason, "reason", "", "Why the resize is done, e.g. a change ticket, recorded in the audit log")
+	cmd.Flags().StringArrayVar(&f.hooks, "hook", []string{}, "Command to run with sh at a point of the resize, in format point=command, where point is pre-shrink, post-copy, pre-cutover or post-complete (e.g. post-copy=/usr/local/bin/verify.sh); told of the resize in RESIZER_HOOK, RESIZER_DISK and RESIZER_PARTITIONS, it fails the resize by exiting non-zero; may be repeated")
+	cmd.Flags().StringArrayVar(&f.tools, "tool", []string{}, "Path to run an external tool from, rather than finding it in the PATH, in format name=path (e.g. e2fsck=/usr/local/sbin/e2fsck); may be repeated")
+	cmd.Flags().DurationVar(&f.toolTimeout, "tool-timeout", 0, "Longest any external tool, such as e2fsck or resize2fs, may run before it is killed and the resize fails; killing a tool can leave its filesystem damaged, so this is for tools that hang (default no limit)")
+	cmd.Flags().StringVar(&f.disk, "disk", "", "Disk to resize, in place of the disk argument, either a path or selected by a property in format selector:value, where selector is serial, wwn, model or guid, the GPT disk GUID (e.g. serial:S64DNX0R123456, wwn:0x5000c500a1b2c3d4, \"model:Samsung SSD 980 PRO 2TB\" or guid:5A1C3D2E-7B4F-4E8A-9C6D-0F1E2D3C4B5A); exactly one disk must match")
+	noConfig(cmd, "shrink-partition", "grow-partition", "layout", "disk", "force-boot-partitions")
+	for _, name := range []string{"shrink-partition", "grow-partition", "exclude-partition", "legacy-bootable", "no-legacy-bootable"} {
+		_ = cmd.RegisterFlagCompletionFunc(name, f.completePartitions)
+	}
+	_ = cmd.RegisterFlagCompletionFunc("disk", func(cmd *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeDisks(cmd, nil, toComplete)
+	})
+	cmd.Flags().IntVar(&f.copyWorkers, "copy-workers", 1, "How many partitions to copy to their new locations at once; more than 1 is worth it where they are on independent media, e.g. NVMe or multi-actuator disks, and the progress bar then shows all of them together")
+	cmd.Flags().IntVar(&f.copyStreams, "copy-streams", 0, "How many stripes to split each partition copied byte for byte into, copying and verifying them concurrently; more than 1 speeds up large copies on NVMe (default picked for the disk)")
+	cmd.Flags().StringVar(&f.bufferSize, "buffer-size", "", "Size of the buffer partitions copied byte for byte are read and written in, e.g. 16M (default picked for the disk: 4M for a spinning disk or image file, more for SSDs and NVMe)")
+	cmd.Flags().StringVar(&f.checkpoint, "checkpoint-interval", "", "How much of a partition copied byte for byte to copy between checkpoints recorded in the --journal, e.g. 10G, so that resume continues an interrupted copy from the last rather than starting over (default 1G)")
+	cmd.Flags().BoolVar(&f.autoTune, "auto-tune", false, "If set, pick the buffer size and number of streams not given with --buffer-size and --copy-streams by timing a few of them reading 192M of the largest partition copied, rather than from what the disk is")
+	cmd.Flags().StringVar(&f.maxThroughput, "max-throughput", "", "Most bytes per second the copies of partitions to their new locations may read, and may write, e.g. 50M, so that a resize in the background leaves the disk to the workloads still running from it (default no limit)")
+	cmd.Flags().StringVar(&f.ioPriority, "io-priority", "", "I/O priority to run the resize, and the tools it runs, at, as ionice sets it: low, the lowest best-effort priority, or idle, only while nothing else uses the disk; best effort, only on Linux (default the current priority)")
+	cmd.Flags().BoolVar(&f.noCacheHints, "no-cache-hints", false, "If set, do not drop what is copied byte for byte from the page cache behind the copy, nor tell the kernel the source is read sequentially; for small copies, where what is cached makes verification faster")
+	cmd.Flags().BoolVar(&f.noAtime, "no-atime", false, "If set, give each file of a partition copied file by file its modification time as its access time, rather than keeping the access time of its source, as for a filesystem mounted noatime")
+	cmd.Flags().BoolVar(&f.discard, "discard", false, "If set, discard (TRIM) the space each partition moved to a new location leaves once its original is removed, so that an SSD or thin-provisioned storage reclaims it; punches a hole in an image file instead")
+	cmd.Flags().StringVar(&f.wipeRemoved, "wipe-removed", "", "Overwrite the data of each partition moved to a new location once its original is removed: zero, with zeros, the default should the flag be given without a value, or random, with random data (default not wiped)")
+	cmd.Flags().Lookup("wipe-removed").NoOptDefVal = string(resizer.WipeZero)
+	cmd.Flags().StringVar(&f.verify, "verify", string(resizer.VerifyFull), "How thoroughly to compare a partition copied byte for byte (e.g. XFS or LUKS) with its source before removing the source: full, sampled (the first and last MB and a few MB at random offsets) or none")
+}
+
+// diskPath returns the disk to resize, given as the argument in args or with
+// --disk, exiting should both be given or the disk --disk selects not be
+// found. It is empty if neither is given, for the disk to be found from the
+// partitions.
+func (f *resizeFlags) diskPath(args []string) string {
+	if f.disk == "" {
+		if len(args) > 0 {
+			return args[0]
+		}
+		return ""
+	}
+	if len(args) > 0 {
+		exitf(exitInvalid, "Give the disk either as an argument or with --disk, not both")
+	}
+	disk, err := resolveDisk(f.disk)
+	if err != nil {
+		exitf(exitInvalid, "Invalid disk value '%s': %v", f.disk, err)
+	}
+	return disk
+}
+
+// resolveDisk returns the path of the disk s gives, either a path or a
+// selector:value, e.g. serial:S64DNX0R123456, for resizer.FindDisk.
+func resolveDisk(s string) (string, error) {
+	by, value, ok := strings.Cut(s, ":")
+	if !ok || !slices.Contains(resizer.DiskSelectors, resizer.DiskSelector(by)) {
+		return s, nil
+	}
+	if value == "" {
+		return "", fmt.Errorf("empty %s", by)
+	}
+	return resizer.FindDisk(resizer.DiskSelector(by), value)
+}
+
+// parse returns the partitions to shrink and grow, and the options, the flags
+// give, exiting should any be invalid.
+func (f *resizeFlags) parse() ([]resizer.PartitionIdentifier, []resizer.PartitionChange, resizer.Options) {
+	var (
+		shrinkPartitions []resizer.PartitionIdentifier
+		growPartitions   []resizer.PartitionChange
+	)
+	for _, sp := range f.shrinkPartitions {
+		parsed, err := parseShrinkPartition(sp)
+		if err != nil {
+			exitf(exitInvalid, "Invalid shrink-partition value '%s': %v", sp, err)
+		}
+		shrinkPartitions = append(shrinkPartitions, parsed)
+	}
+	for _, gp := range f.growPartitions {
+		gpParsed, err := parsePartitionChange(gp)
+		if err != nil {
+			exitf(exitInvalid, "Invalid grow-partition value '%s': %v", gp, err)
+		}
+		growPartitions = append(growPartitions, gpParsed)
+	}
+	switch {
+	case f.interactive && (len(growPartitions) > 0 || len(shrinkPartitions) > 0 || f.layout != ""):
+		exitf(exitInvalid, "--interactive asks what to resize, so takes no --grow-partition, --shrink-partition or --layout")
+	case f.layout != "" && (len(growPartitions) > 0 || len(shrinkPartitions) > 0):
+		exitf(exitInvalid, "--layout says how each partition is to be resized, so takes no --grow-partition or --shrink-partition")
+	case f.freezeMounted && !f.acceptLostWrites:
+		exitf(exitInvalid, "--freeze-mounted loses whatever is written to a mounted partition once its copy is done; add --accept-lost-writes to accept that")
+	case f.layout == "" && !f.interactive && len(growPartitions) == 0:
+		exitf(exitInvalid, "At least one --grow-partition, or a --layout, must be specified")
+	}
+	opts := resizer.Options{
+		FixErrors:           f.fixErrors,
+		PreserveNumbers:     f.preserveNumbers,
+		AutoShrink:          f.autoShrink,
+		LUKSKeyFile:         f.luksKeyFile,
+		OnlineGrow:          f.onlineGrow,
+		FreezeMounted:       f.freezeMounted,
+		AcceptLostWrites:    f.acceptLostWrites,
+		FreezeTimeout:       f.freezeTimeout,
+		TemporaryUUID:       f.temporaryUUID,
+		JournalPath:         f.journalPath,
+		SnapshotDir:         f.snapshotDir,
+		AuditLog:            f.auditLog,
+		AuditReason:         f.reason,
+		Verify:              resizer.VerifyMode(f.verify),
+		ToolTimeout:         f.toolTimeout,
+		ForceBootPartitions: f.forceBoot,
+		UpdateBootEntries:   f.updateBootEntries,
+		CopyWorkers:         f.copyWorkers,
+		CopyStreams:         f.copyStreams,
+		AutoTune:            f.autoTune,
+		IOPriority:          resizer.IOPriority(f.ioPriority),
+		NoCacheHints:        f.noCacheHints,
+		NoAtime:             f.noAtime,
+		Discard:             f.discard,
+		WipeRemoved:         resizer.WipeMode(f.wipeRemoved),
+	}
+	if f.copyWorkers < 1 {
+		exitf(exitInvalid, "Invalid copy-workers value %d: must be at least 1", f.copyWorkers)
+	}
+	if f.copyStreams < 0 {
+		exitf(exitInvalid, "Invalid copy-streams value %d: must not be negative", f.copyStreams)
+	}
+	if f.checkpoint != "" {
+		interval, err := parseSize(f.checkpoint)
+		if err != nil || interval <= 0 {
+			exitf(exitInvalid, "Invalid checkpoint-interval value '%s': must be a positive size", f.checkpoint)
+		}
+		opts.CheckpointInterval = interval
+	}
+	if f.bufferSize != "" {
+		size, err := parseSize(f.bufferSize)
+		if err != nil || size <= 0 {
+			exitf(exitInvalid, "Invalid buffer-size value '%s': must be a positive size", f.bufferSize)
+		}
+		opts.BufferSize = size
+	}
+	for _, h := range f.hooks {
+		point, hook, err := parseHook(h)
+		if err != nil {
+			exitf(exitInvalid, "Invalid hook value '%s': %v", h, err)
+		}
+		if opts.Hooks == nil {
+			opts.Hooks = map[resizer.HookPoint][]resizer.Hook{}
+		}
+		opts.Hooks[point] = append(opts.Hooks[point], hook)
+	}
+	for _, t := range f.tools {
+		name, path, err := parseTool(t)
+		if err != nil {
+			exitf(exitInvalid, "Invalid tool value '%s': %v", t, err)
+		}
+		runner, ok := opts.ExecRunner.(toolPathRunner)
+		if !ok {
+			runner = toolPathRunner{}
+			opts.ExecRunner = runner
+		}
+		runner[name] = path
+	}
+	for _, ep := range f.excludePartitions {
+		parsed, err := parsePartitionIdentifier(ep)
+		if err != nil {
+			exitf(exitInvalid, "Invalid exclude-partition value '%s': %v", ep, err)
+		}
+		opts.ExcludePartitions = append(opts.ExcludePartitions, parsed)
+	}
+	for _, flag := range []struct {
+		name     string
+		values   []string
+		bootable bool
+	}{{"legacy-bootable", f.legacyBootable, true}, {"no-legacy-bootable", f.notLegacyBootable, false}} {
+		for _, v := range flag.values {
+			parsed, err := parsePartitionIdentifier(v)
+			if err != nil {
+				exitf(exitInvalid, "Invalid %s value '%s': %v", flag.name, v, err)
+			}
+			opts.LegacyBootable = append(opts.LegacyBootable, resizer.LegacyBootableChange{Identifier: parsed.By(), Partition: parsed.Value(), Bootable: flag.bootable})
+		}
+	}
+	if f.maxThroughput != "" {
+		rate, err := parseSize(f.maxThroughput)
+		if err != nil || rate <= 0 {
+			exitf(exitInvalid, "Invalid max-throughput value '%s': must be a positive size", f.maxThroughput)
+		}
+		opts.MaxThroughput = rate
+	}
+	if f.shrinkGranularity != "" {
+		granularity, err := parseSize(f.shrinkGranularity)
+		if err != nil || granularity <= 0 {
+			exitf(exitInvalid, "Invalid shrink-granularity value '%s': must be a positive size", f.shrinkGranularity)
+		}
+		opts.ShrinkGranularity = granularity
+	}
+	if f.shrinkMargin != "" {
+		margin, percent, err := parseShrinkMargin(f.shrinkMargin)
+		if err != nil {
+			exitf(exitInvalid, "Invalid shrink-margin value '%s': %v", f.shrinkMargin, err)
+		}
+		opts.ShrinkMargin = margin
+		opts.ShrinkMarginPercent = percent
+	}
+	return shrinkPartitions, growPartitions, opts
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+func freeCmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "free [disk]",
+		Short: "Show the free space on the disks",
+		Long: `Show the free space on every disk with partitions, or just the disk given, a device or image file:
+  each gap between partitions, with its start, end, size, the alignment of its start, and how much of
+  it a partition aligned to 1M can be given, and the largest such block on the disk. Should that be
+  enough for the grows, no shrink is needed. Nothing is changed.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeDisks,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			var disks []string
+			if len(args) > 0 {
+				disks = append(disks, args[0])
+			} else {
+				infos, err := resizer.ListDisks("")
+				if err != nil {
+					fatalf("Listing disks failed: %v", err)
+				}
+				for _, info := range infos {
+					disks = append(disks, info.Path)
+				}
+			}
+			maps := []*resizer.FreeSpaceMap{}
+			for _, disk := range disks {
+				m, err := resizer.FreeSpace(disk)
+				if err != nil {
+					fatalf("Cannot read free space of %s: %v", disk, err)
+				}
+				maps = append(maps, m)
+			}
+			if err := writeFreeSpace(os.Stdout, output, maps); err != nil {
+				fatalf("Cannot write free space: %v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&output, "output", outputText, "How to print the free space: text, a table of the gaps on each disk, json or yaml")
+	return cmd
+}
+
+// writeFreeSpace writes maps to w as output says: as indented JSON with
+// outputJSON, YAML with outputYAML, or as a table of the gaps on each disk with outputText.
+func writeFreeSpace(w io.Writer, output string, maps []*resizer.FreeSpaceMap) error {
+	if output != outputText {
+		return writeData(w, output, maps)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, m := range maps {
+		if i > 0 {
+			_, _ = fmt.Fprintln(tw)
+		}
+		// with no tab, the line is not part of the table below it
+		_, _ = fmt.Fprintf(tw, "%s  %s  largest allocatable %s\n", m.Disk, formatSize(m.Size), formatSize(m.Largest))
+		_, _ = fmt.Fprintln(tw, "START\tEND\tSIZE\tALIGNMENT\tALLOCATABLE")
+		for _, g := range m.Gaps {
+			_, _ = fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\n", g.Start, g.End, formatSize(g.Size), formatSize(g.Alignment), formatSize(g.Allocatable))
+		}
+	}
+	return tw.Flush()
+}
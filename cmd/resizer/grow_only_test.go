@@ -17,7 +17,7 @@ import (
 // (no --shrink-partition) against a minimal GPT image. Before the fix, main
 // passed Run a non-nil pointer to a nil PartitionIdentifier, which made
 // filterDisksByPartitions nil-dereference and the process panic (exit 2). After
-// the fix it must fail gracefully (here: insufficient space), never panic.
+// the fix it must fail gracefully, exiting with exitNoSpace, never panic.
 func TestGrowOnlyDoesNotPanic(t *testing.T) {
 	bin := filepath.Join(t.TempDir(), "resizer")
 	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
@@ -25,7 +25,7 @@ func TestGrowOnlyDoesNotPanic(t *testing.T) {
 	}
 	img := makeMinimalGPTImage(t)
 
-	cmd := exec.Command(bin, "--grow-partition", "label:data:1G", img)
+	cmd := exec.Command(bin, "--grow-partition", "label:data:1G", "--yes", img)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
@@ -36,8 +36,9 @@ func TestGrowOnlyDoesNotPanic(t *testing.T) {
 	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 2 {
 		t.Fatalf("grow-only invocation crashed (exit 2 = panic):\n%s", stderr.String())
 	}
-	// a clean non-zero exit (e.g. insufficient space) is the expected behavior
-	t.Logf("grow-only exited cleanly: err=%v\n%s", err, strings.TrimSpace(stderr.String()))
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != exitNoSpace {
+		t.Fatalf("grow-only invocation exited with %v, want status %d for insufficient space:\n%s", err, exitNoSpace, stderr.String())
+	}
 }
 
 // makeMinimalGPTImage writes a small disk image with a valid GPT containing one
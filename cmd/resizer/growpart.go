@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// growpartNoChange and growpartFailed are the exit codes of growpart when
+	// the partition cannot be grown, and when growing it fails
+	growpartNoChange = 1
+	growpartFailed   = 2
+)
+
+func growpartCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "growpart <disk> <partnum>",
+		Short: "Grow a partition into the free space after it, as growpart does",
+		Long: `Grow partition number partnum of disk into all of the free space immediately following it, in
+  place, and then its ext4 or XFS filesystem to fill it, online should it be mounted, e.g. the
+  running root: a drop-in replacement for growpart, as cloud-init runs it, followed by resize2fs or
+  xfs_growfs. Nothing is copied or moved, and a partition holding any other filesystem is refused.
+  As growpart, it prints CHANGED, or CHANGE with --dry-run, and the partition's start, size and end
+  before and after, in 512-byte sectors, and exits 0; or prints NOCHANGE and exits 1 should less
+  than 1M of free space follow the partition; or exits 2 should growing it fail.`,
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: completeGrowpart,
+		Run: func(cmd *cobra.Command, args []string) {
+			number, err := strconv.Atoi(args[1])
+			if err != nil || number <= 0 {
+				exitf(growpartFailed, "Invalid partition number '%s'", args[1])
+			}
+			opts := resizer.Options{
+				DryRun:      dryRun,
+				SnapshotDir: resizer.DefaultSnapshotDir,
+				AuditLog:    resizer.DefaultAuditLogPath,
+			}
+			res, err := resizer.GrowPartContext(cmd.Context(), args[0], number, opts)
+			if errors.Is(err, resizer.ErrNoChange) {
+				fmt.Printf("NOCHANGE: %v\n", err)
+				os.Exit(growpartNoChange)
+			}
+			if err != nil {
+				exitf(growpartFailed, "Growing partition failed: %v", err)
+			}
+			if err := writeGrowpart(os.Stdout, res); err != nil {
+				exitf(growpartFailed, "Cannot write result: %v", err)
+			}
+		},
+	}
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "N", false, "If set, only report what would be done, without making any changes")
+	return cmd
+}
+
+// writeGrowpart writes what res, the result of growing a partition, did to w
+// as growpart reports it: CHANGED, or CHANGE for a dry run, with the start of
+// the partition, and its size and end before and after, in 512-byte sectors,
+// the end being the sector after its last.
+func writeGrowpart(w io.Writer, res *resizer.Result) error {
+	verb := "CHANGED"
+	if res.DryRun {
+		verb = "CHANGE"
+	}
+	for _, p := range res.Partitions {
+		if _, err := fmt.Fprintf(w, "%s: partition=%d start=%d old: size=%d end=%d new: size=%d end=%d\n", verb, p.Original.Number, p.Original.Start/512, p.Original.Size/512, (p.Original.Start+p.Original.Size)/512, p.Final.Size/512, (p.Final.Start+p.Final.Size)/512); err != nil {
+			return err
+		}
+	}
+	return nil
+}
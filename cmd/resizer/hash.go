@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+func hashCmd() *cobra.Command {
+	var (
+		output  string
+		compare string
+	)
+	cmd := &cobra.Command{
+		Use:   "hash <disk> [partnum...]",
+		Short: "Show the SHA-256 digest of each partition of a disk",
+		Long: `Show the SHA-256 digest of each partition of the disk given, a device or image file, or of just the
+  partitions numbered, with the label and PARTUUID of each, e.g. to take them with --output json before a
+  resize and compare them with --compare afterwards, or across disks. Nothing is changed.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeGrowpart,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			var numbers []int
+			for _, arg := range args[1:] {
+				number, err := strconv.Atoi(arg)
+				if err != nil || number < 1 {
+					exitf(exitInvalid, "Invalid partition number %q", arg)
+				}
+				numbers = append(numbers, number)
+			}
+			var before *resizer.DiskDigests
+			if compare != "" {
+				var err error
+				if before, err = readDigests(compare); err != nil {
+					exitf(exitInvalid, "Cannot read digests to compare: %v", err)
+				}
+			}
+			digests, err := resizer.HashPartitions(cmd.Context(), args[0], numbers...)
+			if err != nil {
+				exitIfInterrupted(err, "Nothing was changed; run hash again to take the digests.")
+				fatalf("Cannot hash partitions of %s: %v", args[0], err)
+			}
+			if err := writeDigests(os.Stdout, output, digests); err != nil {
+				fatalf("Cannot write digests: %v", err)
+			}
+			if before == nil {
+				return
+			}
+			differences := before.Compare(digests)
+			for _, d := range differences {
+				log.Print(d)
+			}
+			if len(differences) > 0 {
+				fatalf("%d of the partitions of %s differ from %s", len(differences), args[0], compare)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&output, "output", outputText, "How to print the digests: text, a table of the partitions, json or yaml")
+	cmd.Flags().StringVar(&compare, "compare", "", "Compare the digests with those in this file, as hash --output json writes them, failing should any partition differ or be gone")
+	return cmd
+}
+
+// readDigests reads the digests hash --output json wrote to path.
+func readDigests(path string) (*resizer.DiskDigests, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var digests resizer.DiskDigests
+	if err := json.Unmarshal(data, &digests); err != nil {
+		return nil, fmt.Errorf("parse digests %s: %v", path, err)
+	}
+	return &digests, nil
+}
+
+// writeDigests writes digests to w as output says: as indented JSON with
+// outputJSON, YAML with outputYAML, or as a table of the partitions with outputText.
+func writeDigests(w io.Writer, output string, digests *resizer.DiskDigests) error {
+	if output != outputText {
+		return writeData(w, output, digests)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NUMBER\tLABEL\tSIZE\tSHA256")
+	for _, p := range digests.Partitions {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", p.Number, p.Label, formatSize(p.Size), p.SHA256)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// parseHook parses a --hook value, point=command, into the hook that runs
+// command at point.
+func parseHook(s string) (resizer.HookPoint, resizer.Hook, error) {
+	point, command, ok := strings.Cut(s, "=")
+	if !ok || command == "" {
+		return "", nil, fmt.Errorf("invalid hook format, must be point=command: %s", s)
+	}
+	if !slices.Contains(resizer.HookPoints, resizer.HookPoint(point)) {
+		return "", nil, fmt.Errorf("unknown hook point %q, must be one of %v", point, resizer.HookPoints)
+	}
+	return resizer.HookPoint(point), shellHook(command), nil
+}
+
+// shellHook returns a hook that runs command with sh, with what it writes
+// going to stderr, as stdout is kept for --output. It is told of the resize in
+// its environment: RESIZER_HOOK is the hook point, RESIZER_DISK the disk, and
+// RESIZER_PARTITIONS the partitions resized, as in the JSON result. A command
+// that exits non-zero fails the resize.
+func shellHook(command string) resizer.Hook {
+	return func(_ context.Context, h resizer.HookInfo) error {
+		partitions, err := json.Marshal(h.Partitions)
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"RESIZER_HOOK="+string(h.Point),
+			"RESIZER_DISK="+h.Disk,
+			"RESIZER_PARTITIONS="+string(partitions),
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+		return nil
+	}
+}
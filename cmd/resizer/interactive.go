@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// prompter asks questions on out and reads the answers from in, one per line.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask writes question to out and returns the answer, trimmed, or false should
+// in have no more.
+func (p *prompter) ask(question string) (string, bool) {
+	_, _ = fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil && answer == "" {
+		_, _ = fmt.Fprintln(p.out)
+		return "", false
+	}
+	return strings.TrimSpace(answer), true
+}
+
+// say writes a line to out.
+func (p *prompter) say(format string, args ...any) {
+	_, _ = fmt.Fprintf(p.out, format+"\n", args...)
+}
+
+// partition asks for a partition of disk by its number, with question, until
+// it is given one, returning false once the answer is empty or in has no more.
+func (p *prompter) partition(disk resizer.DiskInfo, question string) (resizer.PartitionInfo, bool) {
+	for {
+		answer, ok := p.ask(question)
+		if !ok || answer == "" {
+			return resizer.PartitionInfo{}, false
+		}
+		number, err := strconv.Atoi(answer)
+		i := slices.IndexFunc(disk.Partitions, func(pi resizer.PartitionInfo) bool { return pi.Number == number })
+		switch {
+		case err != nil || i < 0:
+			p.say("No partition %s on %s; give the number of one listed", answer, disk.Path)
+		case disk.Partitions[i].PartUUID == "":
+			p.say("Partition %d has no PARTUUID to identify it by", number)
+		default:
+			return disk.Partitions[i], true
+		}
+	}
+}
+
+// interactivePlan asks on out, reading the answers from in, what to resize on
+// disk, or on one of the disks it lists should disk be empty: the partitions
+// to grow and their sizes, then, should they not fit, the partitions to
+// shrink to make room. It shows the free space on the disk first, and the
+// plan the answers make so far after each, or why they cannot be planned
+// yet. It returns the plan once it is accepted, or nil should it not be.
+func interactivePlan(in io.Reader, out io.Writer, disk string, opts resizer.Options) (*resizer.Plan, error) {
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	disks, err := resizer.ListDisks(disk)
+	if err != nil {
+		return nil, err
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("no disks with partitions found")
+	}
+	if err := writeDisks(out, outputText, disks); err != nil {
+		return nil, err
+	}
+	info := disks[0]
+	for len(disks) > 1 {
+		answer, ok := p.ask("\nDisk to resize: ")
+		if !ok || answer == "" {
+			return nil, nil
+		}
+		if i := slices.IndexFunc(disks, func(d resizer.DiskInfo) bool { return d.Path == answer || filepath.Base(d.Path) == answer }); i >= 0 {
+			info = disks[i]
+			break
+		}
+		p.say("No disk %s; give the path of one listed", answer)
+	}
+	free, err := resizer.FreeSpace(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	p.say("")
+	if err := writeFreeSpace(out, outputText, []*resizer.FreeSpaceMap{free}); err != nil {
+		return nil, err
+	}
+
+	// planning is quiet, its log being for the resize itself
+	logger := opts.Logger
+	opts.Logger = slog.New(slog.DiscardHandler)
+	var (
+		shrinks []resizer.PartitionIdentifier
+		grows   []resizer.PartitionChange
+		plan    *resizer.Plan
+	)
+	replan := func() {
+		if plan, err = resizer.NewPlan(info.Path, shrinks, grows, opts); err != nil {
+			p.say("Cannot plan this yet: %v", err)
+			return
+		}
+		_ = writePlanDiff(out, plan)
+	}
+	for {
+		part, ok := p.partition(info, "\nPartition to grow, by number, or enter when done: ")
+		if !ok {
+			break
+		}
+		size, _ := p.ask(fmt.Sprintf("Size to grow partition %d (%s, %s now) to, e.g. 20G, +10G, max or weight=2: ", part.Number, orNone(part.Label), formatSize(part.Size)))
+		grow, err := parsePartitionChange(fmt.Sprintf("%s:%s:%s", resizer.IdentifierByPartUUID, part.PartUUID, size))
+		if err != nil {
+			p.say("Invalid answer: %v", err)
+			continue
+		}
+		grows = append(grows, grow)
+		replan()
+	}
+	if len(grows) == 0 {
+		return nil, nil
+	}
+	for plan == nil {
+		part, ok := p.partition(info, "\nPartition to shrink to make room, by number, or enter to give up: ")
+		if !ok {
+			return nil, nil
+		}
+		shrink := fmt.Sprintf("%s:%s", resizer.IdentifierByPartUUID, part.PartUUID)
+		amount, _ := p.ask(fmt.Sprintf("Amount to take from partition %d (%s, %s now), e.g. 10G, or enter for what is needed: ", part.Number, orNone(part.Label), formatSize(part.Size)))
+		if amount != "" {
+			shrink += ":-" + strings.TrimPrefix(amount, "-")
+		}
+		parsed, err := parseShrinkPartition(shrink)
+		if err != nil {
+			p.say("Invalid answer: %v", err)
+			continue
+		}
+		shrinks = append(shrinks, parsed)
+		replan()
+	}
+	answer, _ := p.ask("\nApply this plan? [y/N] ")
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		plan.Options.Logger = logger
+		return plan, nil
+	}
+	return nil, nil
+}
+
+// runInteractive asks what to resize on disk, as interactivePlan, and applies
+// the plan once it is accepted, without asking again before each step. It
+// returns the result of applying it, as Plan.ApplyContext, or nil should
+// nothing be applied.
+func runInteractive(ctx context.Context, in io.Reader, out io.Writer, disk string, opts resizer.Options) (*resizer.Result, error) {
+	plan, err := interactivePlan(in, out, disk, opts)
+	if err != nil || plan == nil {
+		if err == nil {
+			log.Printf("No plan applied; nothing was changed")
+		}
+		return nil, err
+	}
+	plan.Options.Confirm = nil
+	return plan.ApplyContext(ctx, opts.DryRun)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitInterrupted is the exit status of a command stopped by an interrupt
+// before it completed, which can be finished later; EX_TEMPFAIL of sysexits.h.
+const exitInterrupted = 75
+
+// interruptContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so that the resize stops cleanly at the next point it can: the copy
+// buffer or external tool in progress, or the partition table write, is
+// finished first. Later signals are logged but do not kill the process, which
+// would defeat that. stop stops handling signals.
+func interruptContext(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if ctx.Err() == nil {
+					log.Printf("Received %v, stopping once the current step is done", sig)
+					cancel()
+				} else {
+					log.Printf("Received %v, still waiting for the current step to finish before stopping", sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// exitIfInterrupted exits with exitInterrupted if err is from a command
+// stopped by an interrupt, logging hint, how to finish what it was doing.
+func exitIfInterrupted(err error, hint string) {
+	if !errors.Is(err, context.Canceled) {
+		return
+	}
+	log.Printf("Interrupted: %v", err)
+	log.Print(hint)
+	os.Exit(exitInterrupted)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"gopkg.in/yaml.v3"
+)
+
+// layoutFile is a layout file, as --layout reads it, in YAML, or JSON. Each
+// partition is identified either by its label, or by partition, an
+// identifier as --grow-partition takes it, e.g. fsuuid:<filesystem uuid>.
+// Size, min and max are sizes as --grow-partition takes them, and a size of
+// max (or rest) fills the free space.
+type layoutFile struct {
+	Partitions []struct {
+		Label     string `yaml:"label"`
+		Partition string `yaml:"partition"`
+		Type      string `yaml:"type"`
+		Size      string `yaml:"size"`
+		Min       string `yaml:"min"`
+		Max       string `yaml:"max"`
+	} `yaml:"partitions"`
+}
+
+// readLayout reads the layout file at path.
+func readLayout(path string) (resizer.Layout, error) {
+	var layout resizer.Layout
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return layout, err
+	}
+	var f layoutFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// a misspelt field is an error rather than a partition left as it is
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return layout, fmt.Errorf("parse layout %s: %v", path, err)
+	}
+	for i, p := range f.Partitions {
+		var (
+			lp  resizer.LayoutPartition
+			err error
+		)
+		switch {
+		case p.Label != "" && p.Partition != "":
+			return layout, fmt.Errorf("layout partition %d has both a label and a partition", i+1)
+		case p.Label != "":
+			lp.Partition = resizer.NewPartitionIdentifier(resizer.IdentifierByLabel, p.Label)
+		case p.Partition != "":
+			if lp.Partition, err = parsePartitionIdentifier(p.Partition); err != nil {
+				return layout, fmt.Errorf("layout partition %d: %v", i+1, err)
+			}
+		default:
+			return layout, fmt.Errorf("layout partition %d has neither a label nor a partition", i+1)
+		}
+		lp.Type = p.Type
+		switch strings.ToLower(p.Size) {
+		case "":
+		case "max", "rest":
+			lp.Fill = true
+		default:
+			if lp.Size, err = parseSize(p.Size); err != nil || lp.Size == 0 {
+				return layout, fmt.Errorf("layout partition %d: invalid size '%s'", i+1, p.Size)
+			}
+		}
+		for _, s := range []struct {
+			value string
+			size  *int64
+		}{{p.Min, &lp.Min}, {p.Max, &lp.Max}} {
+			if s.value == "" {
+				continue
+			}
+			if *s.size, err = parseSize(s.value); err != nil {
+				return layout, fmt.Errorf("layout partition %d: invalid size '%s': %v", i+1, s.value, err)
+			}
+		}
+		layout.Partitions = append(layout.Partitions, lp)
+	}
+	if len(layout.Partitions) == 0 {
+		return layout, fmt.Errorf("layout %s lists no partitions", path)
+	}
+	return layout, nil
+}
+
+// layoutPlan plans the resize that gives disk the layout in the file at path.
+func layoutPlan(path, disk string, opts resizer.Options) (*resizer.Plan, error) {
+	if disk == "" {
+		return nil, fmt.Errorf("--layout needs the disk to lay out")
+	}
+	layout, err := readLayout(path)
+	if err != nil {
+		return nil, err
+	}
+	return resizer.NewLayoutPlan(disk, layout, opts)
+}
+
+// applyLayout gives disk the layout in the file at path, printing the diff of
+// what it does on stderr first, and returns the result, as Plan.ApplyContext,
+// or nil should the disk already have the layout.
+func applyLayout(ctx context.Context, path, disk string, opts resizer.Options) (*resizer.Result, error) {
+	plan, err := layoutPlan(path, disk, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Partitions) == 0 {
+		log.Printf("%s already has the layout of %s; nothing to do", disk, path)
+		return nil, nil
+	}
+	if err := writePlanDiff(os.Stderr, plan); err != nil {
+		return nil, err
+	}
+	return plan.ApplyContext(ctx, opts.DryRun)
+}
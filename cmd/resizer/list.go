@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+func listCmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "list [disk]",
+		Short: "List the disks and their partitions",
+		Long: `List every disk with partitions, or just the disk given, a device or image file, with what each
+  partition can be identified by in --grow-partition and --shrink-partition: its number, device
+  name, start, end and size, its name in the GPT, type GUID, PARTUUID, and the type, UUID and label
+  of its filesystem. Nothing is changed.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeDisks,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			var disk string
+			if len(args) > 0 {
+				disk = args[0]
+			}
+			disks, err := resizer.ListDisks(disk)
+			if err != nil {
+				fatalf("Listing disks failed: %v", err)
+			}
+			if err := writeDisks(os.Stdout, output, disks); err != nil {
+				fatalf("Cannot write disks: %v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&output, "output", outputText, "How to print the disks: text, a table of the partitions of each disk, or json or yaml, with each partition's PARTUUID and filesystem UUID too")
+	return cmd
+}
+
+// writeDisks writes disks to w as output says: as indented JSON with
+// outputJSON, YAML with outputYAML, or as a table of the partitions of each disk with outputText.
+func writeDisks(w io.Writer, output string, disks []resizer.DiskInfo) error {
+	if output != outputText {
+		return writeData(w, output, disks)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, d := range disks {
+		if i > 0 {
+			_, _ = fmt.Fprintln(tw)
+		}
+		// with no tab, the line is not part of the table below it
+		_, _ = fmt.Fprintf(tw, "%s  %s  GUID %s\n", d.Path, formatSize(d.Size), orNone(d.GUID))
+		_, _ = fmt.Fprintln(tw, "NUMBER\tNAME\tSTART\tEND\tSIZE\tLABEL\tTYPE\tFSTYPE\tFSLABEL")
+		for _, p := range d.Partitions {
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", p.Number, orNone(p.Name), p.Start, p.End, formatSize(p.Size), orNone(p.Label), orNone(p.Type), orNone(p.FSType), orNone(p.FSLabel))
+		}
+	}
+	return tw.Flush()
+}
+
+// formatSize formats a size in bytes in the largest binary unit it is at least
+// one of, rounded down to one decimal place so as never to overstate it, as
+// parseSize reads it back, e.g. 20G or 511.9M.
+func formatSize(size int64) string {
+	for _, u := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= u.multiplier {
+			return strings.TrimSuffix(strconv.FormatFloat(math.Floor(float64(size)*10/float64(u.multiplier))/10, 'f', 1, 64), ".0") + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// orNone returns s, or - should it be empty, for a column of a table.
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
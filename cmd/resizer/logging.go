@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+const (
+	// logFormatText and logFormatJSON are the values of --log-format.
+	logFormatText = "text"
+	logFormatJSON = "json"
+	// progressLogInterval is how often the progress of a copy is logged at
+	// most, with --log-format json.
+	progressLogInterval = 5 * time.Second
+)
+
+// setLogFormat makes format the format of everything logged to w: the
+// resizer's own lines and those of the library, which logs to slog.Default().
+// Text keeps the standard log package's lines, JSON writes one JSON object per
+// line. The library's lines below level are dropped, as are the resizer's own
+// with JSON.
+func setLogFormat(w io.Writer, format string, level slog.Level) error {
+	switch format {
+	case logFormatText:
+		slog.SetLogLoggerLevel(level)
+	case logFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: nameTraceLevel})))
+	default:
+		return fmt.Errorf("unknown log format %q, must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// logLevel returns the level to log at with --verbose given verbose times, or
+// --quiet: warnings and errors only with quiet, and each -v one level more,
+// from slog.LevelInfo to resizer.LevelTrace.
+func logLevel(verbose int, quiet bool) (slog.Level, error) {
+	switch {
+	case quiet && verbose > 0:
+		return 0, fmt.Errorf("--quiet and --verbose cannot be used together")
+	case quiet:
+		return slog.LevelWarn, nil
+	case verbose == 0:
+		return slog.LevelInfo, nil
+	case verbose == 1:
+		return slog.LevelDebug, nil
+	}
+	return resizer.LevelTrace, nil
+}
+
+// nameTraceLevel logs resizer.LevelTrace as TRACE rather than DEBUG-4, as a
+// slog.HandlerOptions.ReplaceAttr.
+func nameTraceLevel(_ []string, a slog.Attr) slog.Attr {
+	if level, ok := a.Value.Any().(slog.Level); ok && a.Key == slog.LevelKey && level == resizer.LevelTrace {
+		a.Value = slog.StringValue("TRACE")
+	}
+	return a
+}
+
+// fatalf logs a message at level Error and exits with status 1, as
+// log.Fatalf does, so that a failure can be told apart in JSON logs.
+func fatalf(format string, args ...any) {
+	exitf(exitFailure, format, args...)
+}
+
+// exitf logs a message at level Error and exits with code, as fatalf does
+// with 1.
+func exitf(code int, format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(code)
+}
+
+// progressLog is a resizer.ProgressReporter that logs the progress of the
+// resize to logger, for when it is not shown as a bar: each phase as it starts
+// and finishes, and the bytes of each copy every progressLogInterval and once
+// it is done.
+type progressLog struct {
+	logger *slog.Logger
+	now    func() time.Time
+	logged time.Time
+}
+
+func newProgressLog(logger *slog.Logger) *progressLog {
+	return &progressLog{logger: logger, now: time.Now}
+}
+
+func (p *progressLog) PhaseStarted(phase string) {
+	p.logger.Info("phase started", "phase", phase)
+}
+
+func (p *progressLog) PhaseFinished(phase string, err error) {
+	if err != nil {
+		p.logger.Error("phase failed", "phase", phase, "error", err)
+		return
+	}
+	p.logger.Info("phase finished", "phase", phase)
+}
+
+func (p *progressLog) CopyStarted(partition, n, total int) {
+	p.logged = p.now()
+	p.logger.Info("copy started", "partition", partition, "copy", n, "copies", total)
+}
+
+func (p *progressLog) BytesCopied(partition int, copied, total int64) {
+	now := p.now()
+	if copied < total && now.Sub(p.logged) < progressLogInterval {
+		return
+	}
+	p.logged = now
+	p.logger.Info("bytes copied", "partition", partition, "copied", copied, "total", total)
+}
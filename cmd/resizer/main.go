@@ -1,22 +1,38 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	resizer "github.com/diskfs/partitionresizer"
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
 var rootCmd = func() *cobra.Command {
 	var (
-		shrinkPartition string
-		growPartitions  []string
-		fixErrors       bool
-		dryRun          bool
-		preserveNumbers bool
+		flags       resizeFlags
+		dryRun      bool
+		yes         bool
+		throughput  string
+		deferToBoot bool
+		multiDisk   bool
+		planFile    string
+		applyPlan   string
+		noProgress  bool
+		logFormat   string
+		verbose     int
+		quiet       bool
+		config      string
+		output      string
 	)
 	cmd := &cobra.Command{
 		Use:   "resizer",
@@ -26,10 +42,68 @@ var rootCmd = func() *cobra.Command {
  
   You must provide at least the --grow-partitions flag, which takes a list of partitions to grow,
   along with their desired sizes. If there is not enough free space on the disk, you must also
-  provide the --shrink-partition flag, which takes a single partition to shrink to make space.
+  provide the --shrink-partition flag, which takes a partition to shrink to make space, or the
+  --auto-shrink flag, which picks the largest ext4 partition with enough free space. The
+  --shrink-partition flag may be repeated, in which case the space is taken from each partition
+  in proportion to the free space inside its filesystem; as each frees it at its own end, a grow that
+  is copied, needing it in one piece, may not fit, and the plan fails. To take an exact amount from a shrink
+  partition instead, append a negative size, e.g. --shrink-partition name:sda3:-10G; it is taken
+  even should the grows fit without it, and must be free inside the filesystem. The
+  --shrink-margin flag keeps headroom free inside each shrunk filesystem, either as a size
+  (e.g. 512M) or as a percentage of the filesystem (e.g. 10%).
   
+  Swap partitions, whether grown or shrunk, are recreated at their new size with the same UUID and
+  label rather than copied; active swap is turned off for the resize and back on afterwards.
+  LUKS-encrypted partitions are resized along with the ext4 filesystem inside them, which needs
+  the --luks-key-file flag to unlock them.
+
+  With --online-grow, a partition holding ext4 or XFS that has enough free space immediately after
+  it is grown in place instead of being copied, and may be mounted, e.g. the running root; its
+  filesystem is then grown online with resize2fs or xfs_growfs.
+
+  With --freeze-mounted, a mounted partition may be copied to its new location: its filesystem is
+  frozen with fsfreeze for the copy, for at most --freeze-timeout, so the copy is crash-consistent.
+  Writes made after the copy are not carried over, and the new partition table takes effect once
+  the disk is no longer in use, so reboot promptly afterwards. As those writes are lost,
+  --freeze-mounted must be accompanied by --accept-lost-writes.
+
+  With --temporary-uuid, a copied partition is given a temporary filesystem UUID until the copy is
+  complete and verified, so that an interrupted resize does not leave two filesystems with the
+  same UUID; the original UUID is restored just before the original partition is removed.
+
+  With --journal, each phase of the resize is recorded in a journal as it completes. Should the
+  resize be interrupted, e.g. by a crash, "resizer resume" finishes it from the journal, or
+  "resizer rollback" undoes it; a completed resize can be rolled back too.
+
+  With --defer-to-boot, a resize that cannot run now because a partition to be resized is in use,
+  e.g. the running root, is instead saved as a plan to --plan-file, and an initramfs-tools hook is
+  installed that applies it early on the next boot, before the root filesystem is in use. Rebuild
+  the initramfs (update-initramfs -u) and reboot to apply it. --apply-plan applies a saved plan
+  directly, and is what the boot hook runs.
+
+  With --layout, the end state of the disk is given instead, in a YAML file listing its partitions:
+  the size each is to have, or the min and max it is to be kept within, or a size of max to fill the
+  free space, up to its max. The resize that gives the disk that layout is planned, printed as a diff
+  and performed; a disk that already has it is left as it is. Partitions are resized, moved and
+  shrunk to make room, but not created, removed, renamed or retyped, so each partition listed must
+  already be on the disk, with the type given, if any, and those not listed are left as they are.
+
+  With --interactive (-i), the disks are listed and what to resize is asked for on the terminal: the
+  partitions to grow and their sizes, then, should there not be room, the partitions to shrink,
+  showing the free space and the plan so far after each answer. The plan is applied once confirmed.
+
   Partitions can be identified by their name (e.g. sda1), or by their label (e.g. EFI System).
-  Sizes can be specified in bytes (B), kilobytes (K), megabytes (M), gigabytes (G), or terabytes (T).
+  Sizes can be specified in bytes (B), kilobytes (K), megabytes (M), gigabytes (G), or terabytes (T),
+  which are binary (powers of 1024), as are KiB, MiB, GiB and TiB. KB, MB, GB and TB are decimal
+  (powers of 1000). Sizes may be fractional, e.g. 1.5G. A grow size is rounded down to whole sectors,
+  and an amount to shrink by up to them.
+  A grow size prefixed with + (e.g. name:sda1:+10G) grows the partition by that amount rather than to it.
+  The amount is resolved to an absolute size when planned, so a saved plan or resumed resize grows the
+  partition once, but running the same command again grows it again.
+  A grow size of max (or rest), e.g. name:sda4:max, grows the partition into all of the free space left
+  once the other grows are satisfied; only one partition may be grown this way. A grow size of
+  weight=N (e.g. name:sda1:weight=2 and name:sda2:weight=1) instead divides that free space between
+  the weighted partitions in proportion to their weights.
 
   Example usage:
     resizer --shrink-partition name:sda3 --grow-partition name:sda1:20G --grow-partition label:Data:100G
@@ -40,54 +114,375 @@ var rootCmd = func() *cobra.Command {
 	- Any of the specified grow partitions do not exist.
 	- The specified shrink partition does not exist.
 	- There is not enough free space on the disk after shrinking to accommodate the growth.
-	- There is not enough free space on the disk and no shrink partition is provided.
+	- There is not enough free space on the disk and no shrink partition is provided or auto-selected.
 	- The shrink partition is of a format for which we do not support resizing.
 	- Any listed partition cannot be found.
 	- Multiple partitions with the same specified label are found.
+	- Any partition to be resized is in use, e.g. mounted or held by a device-mapper device.
+	- Any partition to be resized is a member of an md RAID array.
   `,
+		// the disk, which is optional; anything else is a subcommand
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeDisks,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfig(cmd, config, cmd.Flags().Changed("config")); err != nil {
+				return err
+			}
+			level, err := logLevel(verbose, quiet)
+			if err != nil {
+				return err
+			}
+			return setLogFormat(os.Stderr, logFormat, level)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			// check validity of flags
-			var (
-				shrinkPartitionPtr   *resizer.PartitionIdentifier
-				growPartitionsParsed []resizer.PartitionChange
-				disk                 string
-			)
-			if shrinkPartition != "" {
-				parsed, err := parsePartitionIdentifier(shrinkPartition)
-				if err != nil {
-					log.Fatalf("Invalid shrink-partition value: %v", err)
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			progress := newProgress(noProgress, logFormat)
+			if applyPlan != "" {
+				// the boot hook applies the plan, with no one to confirm it
+				res, err := applyPlanFile(cmd.Context(), applyPlan, dryRun, true, progress, false)
+				if werr := writeResult(os.Stdout, output, res); werr != nil {
+					log.Printf("Cannot write result: %v", werr)
 				}
-				// only pass a non-nil pointer when a shrink partition was given;
-				// passing &(nil interface) makes Run treat it as a real
-				// partition and panic in filterDisksByPartitions
-				shrinkPartitionPtr = &parsed
-			}
-			for _, gp := range growPartitions {
-				gpParsed, err := parsePartitionChange(gp)
-				if err != nil {
-					log.Fatalf("Invalid grow-partition value '%s': %v", gp, err)
+				exitIfInterrupted(err, fmt.Sprintf("The plan is kept at %s; apply it again to finish the resize", applyPlan))
+				exitIfResizeFailed(err, res)
+				exitIfNothingResized(res)
+				return
+			}
+			shrinkPartitionsParsed, growPartitionsParsed, opts := flags.parse()
+			disk := flags.diskPath(args)
+			if multiDisk && (disk != "" || deferToBoot) {
+				exitf(exitInvalid, "--multi-disk finds the disks from the partitions, so takes no disk, nor --defer-to-boot")
+			}
+			if flags.layout != "" && (multiDisk || deferToBoot) {
+				exitf(exitInvalid, "--layout lays out the disk given, so takes neither --multi-disk nor --defer-to-boot")
+			}
+			if flags.interactive && (multiDisk || deferToBoot || !isTerminal(os.Stdin)) {
+				exitf(exitInvalid, "--interactive asks on the terminal what to resize on a single disk, so needs stdin to be a terminal, and takes neither --multi-disk nor --defer-to-boot")
+			}
+			opts.DryRun = dryRun
+			opts.Progress = progress
+			// with no one to confirm the resize, nothing is changed
+			if !yes && !dryRun && !isTerminal(os.Stdin) {
+				exitf(exitInvalid, "Cannot confirm the resize: stdin is not a terminal; pass --yes (or --assume-yes) to go ahead without asking")
+			}
+			// -i asks for its own confirmation of the plan, and a dry run
+			// prints the resize planned as its result
+			if !yes && !dryRun && !flags.interactive {
+				askBeforeResizing(&opts, os.Stdin, os.Stderr, isTerminal(os.Stdin))
+			}
+			if throughput != "" {
+				rate, err := parseSize(throughput)
+				if err != nil || rate <= 0 {
+					exitf(exitInvalid, "Invalid throughput value '%s': must be a positive size", throughput)
 				}
-				growPartitionsParsed = append(growPartitionsParsed, gpParsed)
+				opts.Throughput = rate
 			}
-			if len(growPartitionsParsed) == 0 {
-				log.Fatal("At least one --grow-partition must be specified")
+			if multiDisk {
+				runDisks(cmd.Context(), shrinkPartitionsParsed, growPartitionsParsed, opts, output)
+				return
 			}
-			if len(args) > 0 {
-				disk = args[0]
+			var (
+				res *resizer.Result
+				err error
+			)
+			switch {
+			case flags.interactive:
+				res, err = runInteractive(cmd.Context(), os.Stdin, os.Stderr, disk, opts)
+			case flags.layout != "":
+				res, err = applyLayout(cmd.Context(), flags.layout, disk, opts)
+			default:
+				res, err = resizer.RunContext(cmd.Context(), disk, shrinkPartitionsParsed, growPartitionsParsed, opts)
 			}
-			if err := resizer.Run(disk, shrinkPartitionPtr, growPartitionsParsed, fixErrors, dryRun, preserveNumbers); err != nil {
-				log.Fatalf("Resize operation failed: %v", err)
+			if werr := writeResult(os.Stdout, output, res); werr != nil {
+				log.Printf("Cannot write result: %v", werr)
 			}
+			var inUse *resizer.InUseError
+			if deferToBoot && errors.As(err, &inUse) {
+				log.Printf("Cannot resize now: %v", err)
+				err = deferResize(planFile, disk, shrinkPartitionsParsed, growPartitionsParsed, opts)
+			}
+			if opts.JournalPath != "" {
+				exitIfInterrupted(err, fmt.Sprintf("Finish the resize with: resizer resume --journal %s", opts.JournalPath))
+			}
+			exitIfInterrupted(err, "Run the same command again to finish the resize")
+			exitIfResizeFailed(err, res)
+			exitIfNothingResized(res)
 		},
 	}
-	cmd.Flags().StringVar(&shrinkPartition, "shrink-partition", "", "Partition to shrink to make space, if necessary")
-	cmd.Flags().StringSliceVar(&growPartitions, "grow-partition", []string{}, "Partitions to grow, along with their desired sizes, in format identifier:partition:size, see help (e.g. name:sda1:20G or label:EFI System:100M)")
+	flags.register(cmd)
+	cmd.Flags().BoolVarP(&flags.interactive, "interactive", "i", false, "If set, list the disks and ask on the terminal which partitions to grow and shrink, and by how much, showing the free space and the plan so far after each answer, then the plan, and apply it once confirmed")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "If set, will only simulate the resize operations without making any changes")
-	cmd.Flags().BoolVar(&fixErrors, "fix-errors", false, "If set, repair filesystem errors found while checking the source filesystems (ext4 via e2fsck -y, FAT32 via fsck.fat -a) instead of aborting on an inconsistent source")
-	cmd.Flags().BoolVar(&preserveNumbers, "preserve-numbers", false, "If set, a grown partition that is relocated is renumbered back to its original partition number, so labels keep their original partition numbers (e.g. /dev/sda2)")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "If set, do not show the resize and ask for confirmation before it, and before each partition table write that cannot be undone; without it, the resizer asks on the terminal, and fails, changing nothing, if stdin is not one")
+	cmd.Flags().BoolVar(&yes, "assume-yes", false, "Same as --yes")
+	cmd.Flags().StringVar(&throughput, "throughput", "", "Bytes per second the disk reads and writes at, e.g. 200M, for the duration --dry-run estimates the resize takes; measured by reading the start of the disk if not given")
+	cmd.Flags().StringVar(&output, "output", outputText, "What to print once the resize is done: text, nothing beyond the log but, for a dry run, the diff and layout of the resize planned, or json or yaml, a summary of the resize on stdout, for a dry run the resize planned -- each partition's geometry before and after, the bytes copied, how long each phase took, the filesystem checks and any warnings -- for automation to act on")
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "If set, do not draw a progress bar, with throughput and time remaining, for each partition copied; it is only drawn when stderr is a terminal")
+	cmd.Flags().BoolVar(&deferToBoot, "defer-to-boot", false, "If set and a partition to be resized is in use, e.g. the running root, save the resize as a plan and install an initramfs hook that applies it on the next boot")
+	cmd.Flags().BoolVar(&multiDisk, "multi-disk", false, "If set, resize the partitions on every disk they are found on, e.g. label:data:max on two NVMe drives, planning every disk before changing any, then resizing each in turn with a journal of its own (--journal with the disk's name appended), and stopping at the first that fails")
+	cmd.Flags().StringVar(&planFile, "plan-file", resizer.DefaultPlanPath, "Where --defer-to-boot saves the plan")
+	cmd.Flags().StringVar(&applyPlan, "apply-plan", "", "Apply the plan saved at this path instead of the grow and shrink flags, removing it once applied")
+	noConfig(cmd, "interactive", "apply-plan")
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormatText, "Format of the log: text, or json for one JSON object per line, for automation to parse; with json, the progress of each copy is logged rather than drawn as a bar")
+	cmd.PersistentFlags().StringVar(&config, "config", defaultConfigPath, "Config file giving the defaults of the flags, in YAML, each flag by its name, e.g. verify: sampled, and a list for one that may be repeated; a flag given on the command line overrides it, and an empty path reads none")
+	cmd.PersistentFlags().CountVarP(&verbose, "verbose", "v", "Log more: -v also logs what is skipped and each external tool once it has run, with its output, -vv each partition table written, with its partitions, and each external tool as it starts")
+	cmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "If set, log only warnings and errors, not each partition and phase as the resize goes")
+	cmd.AddCommand(planCmd(), applyCmd(), resumeCmd(), rollbackCmd(), backupTableCmd(), restoreTableCmd(), listCmd(), freeCmd(), validateCmd(), statusCmd(), growpartCmd(), hashCmd())
+	return cmd
+}
+
+func planCmd() *cobra.Command {
+	var (
+		flags    resizeFlags
+		planFile string
+		output   string
+	)
+	cmd := &cobra.Command{
+		Use:   "plan [disk]",
+		Short: "Plan a resize, to be reviewed and applied later",
+		Long: `Plan a resize, taking the same flags as the resizer itself, without changing anything, and save
+  the plan as JSON to --plan-file. The plan lists each partition to resize, with its number, start and
+  size before and after, for review, and is printed as a diff of them, or, with --output json or yaml,
+  printed itself, the diff then going to stderr; "resizer apply" then performs exactly that resize.
+  The plan is pinned to the GUID of the disk and a checksum of its partition table, so a plan that
+  has gone stale, because the disk has changed since, is refused rather than applied.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeDisks,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			shrinkPartitions, growPartitions, opts := flags.parse()
+			disk := flags.diskPath(args)
+			var (
+				plan *resizer.Plan
+				err  error
+			)
+			if flags.layout != "" {
+				plan, err = layoutPlan(flags.layout, disk, opts)
+			} else {
+				plan, err = resizer.NewPlan(disk, shrinkPartitions, growPartitions, opts)
+			}
+			if err != nil {
+				exitf(exitCode(err), "Planning failed: %v", err)
+			}
+			// the diff is for the reader, and stays out of the plan on stdout
+			diffOut := os.Stdout
+			if output != outputText {
+				diffOut = os.Stderr
+			}
+			if err := writePlanDiff(diffOut, plan); err != nil {
+				fatalf("Cannot write plan: %v", err)
+			}
+			if output != outputText {
+				if err := writeData(os.Stdout, output, plan); err != nil {
+					fatalf("Cannot write plan: %v", err)
+				}
+			}
+			if planFile == "" {
+				return
+			}
+			if err := resizer.WritePlan(planFile, plan); err != nil {
+				fatalf("Cannot write plan: %v", err)
+			}
+			log.Printf("Plan saved to %s; apply it with: resizer apply %s", planFile, planFile)
+		},
+	}
+	flags.register(cmd)
+	cmd.Flags().StringVar(&planFile, "plan-file", "", "File to save the plan to, as JSON, for resizer apply")
+	cmd.Flags().StringVar(&output, "output", outputText, "What to print: text, the diff and layout of the resize planned, or json or yaml, the plan itself, the diff then going to stderr")
+	noConfig(cmd, "plan-file")
+	return cmd
+}
+
+func applyCmd() *cobra.Command {
+	var (
+		dryRun     bool
+		yes        bool
+		noProgress bool
+		output     string
+	)
+	cmd := &cobra.Command{
+		Use:   "apply <plan>",
+		Short: "Apply a plan saved by the plan command",
+		Long: `Apply a plan saved by "resizer plan", performing exactly the resize it lists. Should the disk not
+  be the one it was planned for, or its partition table have changed since, the plan is refused and
+  nothing is changed; plan the resize again. The plan file is kept.
+
+  With - for the plan, the plan is read from stdin instead, or a change request document, in JSON,
+  giving the disk and the partitions to grow and shrink, as --grow-partition and --shrink-partition
+  take them, e.g. {"disk": "/dev/sda", "grow-partition": ["label:data:max"]}, which is planned
+  and applied. Stdin being taken, the resize is not confirmed, so --yes or --dry-run is needed.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			progress := newProgress(noProgress, cmd.Flag("log-format").Value.String())
+			fromStdin := args[0] == "-"
+			if !yes && !dryRun && (fromStdin || !isTerminal(os.Stdin)) {
+				exitf(exitInvalid, "Cannot confirm the resize: stdin is not a terminal, or holds the plan; pass --yes (or --assume-yes) to go ahead without asking")
+			}
+			var (
+				res *resizer.Result
+				err error
+			)
+			if fromStdin {
+				res, err = applyInput(cmd.Context(), dryRun, progress)
+			} else {
+				res, err = applyPlanFile(cmd.Context(), args[0], dryRun, false, progress, !yes && !dryRun)
+			}
+			if werr := writeResult(os.Stdout, output, res); werr != nil {
+				log.Printf("Cannot write result: %v", werr)
+			}
+			exitIfInterrupted(err, fmt.Sprintf("Apply the plan again to finish the resize: resizer apply %s", args[0]))
+			var staleErr *resizer.StalePlanError
+			if errors.As(err, &staleErr) {
+				exitf(exitInvalid, "Plan refused, nothing was changed; plan the resize again: %v", err)
+			}
+			exitIfResizeFailed(err, res)
+			exitIfNothingResized(res)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "If set, check the plan against the disk and estimate it, without making any changes")
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "If set, do not draw a progress bar for each partition copied")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "If set, do not show the resize and ask for confirmation before it, and before each partition table write that cannot be undone; without it, the resizer asks on the terminal, and fails, changing nothing, if stdin is not one")
+	cmd.Flags().BoolVar(&yes, "assume-yes", false, "Same as --yes")
+	cmd.Flags().StringVar(&output, "output", outputText, "What to print once the resize is done: text, nothing beyond the log but, for a dry run, the diff and layout of the resize planned, or json or yaml, a summary of the resize on stdout")
 	return cmd
 }
 
+func resumeCmd() *cobra.Command {
+	var journalPath string
+	cmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Finish a resize that was interrupted",
+		Long: `Finish a resize that was interrupted, e.g. by a crash, as recorded in the journal kept with
+  --journal. Exactly the resizes recorded are performed, skipping the phases the journal records as
+  completed.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := resizer.ResumeContext(cmd.Context(), journalPath); err != nil {
+				exitIfInterrupted(err, "Run resume again to finish the resize")
+				exitf(exitCode(err), "Resume failed: %v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&journalPath, "journal", resizer.DefaultJournalPath, "Journal of the interrupted resize")
+	return cmd
+}
+
+func rollbackCmd() *cobra.Command {
+	var journalPath string
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Undo a resize",
+		Long: `Undo a resize, interrupted or completed, as recorded in the journal kept with --journal, while
+  the original partitions' data is still where it was. The partition table from before the resize
+  is restored, deleting the partitions the resize created and giving the originals back their
+  entries and sizes, and any shrunk ext4 filesystem is grown back to fill its partition. Anything
+  written to the new partitions since the resize is lost.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := resizer.RollbackContext(cmd.Context(), journalPath); err != nil {
+				exitIfInterrupted(err, "Run rollback again to finish undoing the resize")
+				exitf(exitCode(err), "Rollback failed: %v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&journalPath, "journal", resizer.DefaultJournalPath, "Journal of the resize to undo")
+	return cmd
+}
+
+func backupTableCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup-table <disk> <file>",
+		Short: "Save the partition table of a disk to a file",
+		Long: `Save the GPT of a disk -- the protective MBR, both GPT headers and the partition entries -- to a
+  file, in the format of sgdisk --backup, before letting a resize touch the disk. restore-table, or
+  sgdisk --load-backup, puts it back.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := resizer.BackupPartitionTable(args[0], args[1]); err != nil {
+				fatalf("Backup failed: %v", err)
+			}
+		},
+	}
+}
+
+func restoreTableCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore-table <disk> <file>",
+		Short: "Restore the partition table of a disk from a file",
+		Long: `Restore the GPT of a disk saved by backup-table, or by sgdisk --backup, exactly as it was. Only the
+  partition table is restored, not the data in the partitions, and the disk must have the size and
+  sector size of the disk the backup was taken from.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := resizer.RestorePartitionTable(args[0], args[1]); err != nil {
+				fatalf("Restore failed: %v", err)
+			}
+		},
+	}
+}
+
+// deferResize saves the resize as a plan at planFile and installs the boot hook
+// that applies it. With opts.DryRun, it only reports what it would do.
+func deferResize(planFile, disk string, shrinkPartitions []resizer.PartitionIdentifier, growPartitions []resizer.PartitionChange, opts resizer.Options) error {
+	plan, err := resizer.NewPlan(disk, shrinkPartitions, growPartitions, opts)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		log.Printf("Dry run specified, not deferring resize %+v to next boot", plan)
+		if estimate, err := resizer.Estimate(plan, opts.Throughput); err != nil {
+			log.Printf("Cannot estimate resize: %v", err)
+		} else {
+			log.Printf("Resize would read %d and write %d bytes, taking about %s at %d bytes/s", estimate.Read, estimate.Write, estimate.Duration.Round(time.Second), estimate.Throughput)
+		}
+		return nil
+	}
+	if err := resizer.WritePlan(planFile, plan); err != nil {
+		return fmt.Errorf("save plan: %v", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := resizer.InstallBootHook("/", executable, planFile); err != nil {
+		return fmt.Errorf("install boot hook: %v", err)
+	}
+	log.Printf("Resize deferred to next boot: plan saved to %s; rebuild the initramfs (update-initramfs -u) and reboot to apply it", planFile)
+	return nil
+}
+
+// applyPlanFile applies the plan saved at path, reporting its progress to
+// progress if it is not nil; with ask, it asks on the terminal whether to go
+// ahead, showing the resize, and before each step that cannot be undone, as
+// askBeforeResizing. With remove and unless dryRun, it removes the plan once
+// applied. It returns the result of applying it, as Plan.ApplyContext.
+func applyPlanFile(ctx context.Context, path string, dryRun, remove bool, progress resizer.ProgressReporter, ask bool) (*resizer.Result, error) {
+	plan, err := resizer.ReadPlan(path)
+	if err != nil {
+		return nil, err
+	}
+	plan.Options.Progress = progress
+	if ask {
+		askBeforeResizing(&plan.Options, os.Stdin, os.Stderr, isTerminal(os.Stdin))
+	}
+	res, err := plan.ApplyContext(ctx, dryRun)
+	if err != nil {
+		return res, err
+	}
+	if remove && !dryRun {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Plan applied, but could not remove %s: %v", path, err)
+		}
+	}
+	return res, nil
+}
+
 func parsePartitionIdentifier(s string) (resizer.PartitionIdentifier, error) {
 	var by resizer.Identifier
 	parts := strings.SplitN(s, ":", 2)
@@ -99,13 +494,85 @@ func parsePartitionIdentifier(s string) (resizer.PartitionIdentifier, error) {
 		by = resizer.IdentifierByName
 	case string(resizer.IdentifierByLabel):
 		by = resizer.IdentifierByLabel
+	case string(resizer.IdentifierByFSLabel):
+		by = resizer.IdentifierByFSLabel
+	case string(resizer.IdentifierByDevice):
+		if !filepath.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("partition device %s is not an absolute path, e.g. /dev/sda3", parts[1])
+		}
+		by = resizer.IdentifierByDevice
+	case string(resizer.IdentifierByPartUUID), string(resizer.IdentifierByUUID):
+		// a PARTUUID, the partition's GUID in the GPT; uuid is kept as the
+		// older name for it
+		if _, err := uuid.Parse(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid partition UUID %s: %v", parts[1], err)
+		}
+		by = resizer.IdentifierByPartUUID
+	case string(resizer.IdentifierByFSUUID):
+		// not necessarily a UUID as such, e.g. the volume ID of a FAT32
+		// filesystem, 1A2B-3C4D
+		if parts[1] == "" {
+			return nil, fmt.Errorf("empty filesystem UUID")
+		}
+		by = resizer.IdentifierByFSUUID
 	default:
 		return nil, fmt.Errorf("unknown identifier type: %s", parts[0])
 	}
 	return resizer.NewPartitionIdentifier(by, parts[1]), nil
 }
 
+// parseShrinkMargin parses a shrink margin, either a size (e.g. 512M), returned
+// as bytes, or a percentage of the filesystem (e.g. 10%).
+func parseShrinkMargin(s string) (int64, float64, error) {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(pct, 64)
+		if err != nil || !(percent >= 0 && percent < 100) {
+			return 0, 0, fmt.Errorf("percentage must be at least 0 and below 100")
+		}
+		return 0, percent, nil
+	}
+	margin, err := parseSize(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return margin, 0, nil
+}
+
+// parseShrinkPartition parses a shrink partition, either a bare identifier
+// (identifier:partition), leaving the amount to the planner, or one with an
+// exact amount to take (identifier:partition:-size).
+func parseShrinkPartition(s string) (resizer.PartitionIdentifier, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return parsePartitionIdentifier(s)
+	}
+	pi, err := parsePartitionIdentifier(strings.Join(parts[0:2], ":"))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(parts[2], "-") {
+		return nil, fmt.Errorf("invalid shrink size '%s': must be negative, e.g. -10G", parts[2])
+	}
+	size, err := parseSize(parts[2][1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid size '%s': %v", parts[2], err)
+	}
+	return resizer.NewRelativePartitionChange(pi.By(), pi.Value(), -size), nil
+}
+
+// parsePartitionChange parses a grow partition, identifier:partition:size,
+// with an optional :type=<GUID> to retype the partition as it is grown.
 func parsePartitionChange(s string) (resizer.PartitionChange, error) {
+	if spec, partType, ok := strings.Cut(s, ":type="); ok {
+		if _, err := uuid.Parse(partType); err != nil {
+			return nil, fmt.Errorf("invalid partition type GUID %s: %v", partType, err)
+		}
+		change, err := parsePartitionChange(spec)
+		if err != nil {
+			return nil, err
+		}
+		return resizer.WithPartitionType(change, partType), nil
+	}
 	parts := strings.SplitN(s, ":", 3)
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("invalid partition change format: %s", s)
@@ -114,6 +581,27 @@ func parsePartitionChange(s string) (resizer.PartitionChange, error) {
 	if err != nil {
 		return nil, err
 	}
+	// max (or rest) grows the partition into all of the remaining free space
+	switch strings.ToLower(parts[2]) {
+	case "max", "rest":
+		return resizer.NewMaxPartitionChange(pi.By(), pi.Value()), nil
+	}
+	// weight=N grows the partition to a share of the remaining free space
+	if w, ok := strings.CutPrefix(parts[2], "weight="); ok {
+		weight, err := strconv.ParseInt(w, 10, 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight '%s': must be a positive integer", w)
+		}
+		return resizer.NewWeightedPartitionChange(pi.By(), pi.Value(), weight), nil
+	}
+	// a leading + grows the partition by the given amount rather than to it
+	if delta, ok := strings.CutPrefix(parts[2], "+"); ok {
+		size, err := parseSize(delta)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size '%s': %v", parts[2], err)
+		}
+		return resizer.NewRelativePartitionChange(pi.By(), pi.Value(), size), nil
+	}
 	size, err := parseSize(parts[2])
 	if err != nil {
 		return nil, fmt.Errorf("invalid size '%s': %v", parts[2], err)
@@ -121,38 +609,65 @@ func parsePartitionChange(s string) (resizer.PartitionChange, error) {
 	return resizer.NewPartitionChange(pi.By(), pi.Value(), size), nil
 }
 
+// sizeUnits maps size suffixes to their multipliers. Single letters (K, M, G,
+// T) and the IEC forms (KiB, MiB, ...) are binary, powers of 1024, while the SI
+// forms (KB, MB, ...) are decimal, powers of 1000. Longer suffixes are listed
+// first so that "GiB" is not mistaken for "B".
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses a size such as 100, 20M, 1.5G, 10GiB or 10GB into bytes.
+// Suffixes are case-insensitive, and fractional sizes are rounded down to a
+// whole number of bytes.
 func parseSize(s string) (int64, error) {
 	var multiplier int64 = 1
-	unit := s[len(s)-1]
 	numberPart := s
-	switch unit {
-	case 'B', 'b':
-		multiplier = 1
-		numberPart = s[:len(s)-1]
-	case 'K', 'k':
-		multiplier = 1024
-		numberPart = s[:len(s)-1]
-	case 'M', 'm':
-		multiplier = 1024 * 1024
-		numberPart = s[:len(s)-1]
-	case 'G', 'g':
-		multiplier = 1024 * 1024 * 1024
-		numberPart = s[:len(s)-1]
-	case 'T', 't':
-		multiplier = 1024 * 1024 * 1024 * 1024
-		numberPart = s[:len(s)-1]
-	default:
-		// assume bytes if no unit
+	for _, u := range sizeUnits {
+		if len(s) > len(u.suffix) && strings.EqualFold(s[len(s)-len(u.suffix):], u.suffix) {
+			multiplier = u.multiplier
+			numberPart = s[:len(s)-len(u.suffix)]
+			break
+		}
 	}
-	number, err := strconv.ParseInt(numberPart, 10, 64)
-	if err != nil {
-		return 0, err
+	// assume bytes if no unit; big.Rat keeps fractional sizes exact, but it
+	// also accepts fractions and exponents, which are not sizes
+	number, ok := new(big.Rat).SetString(numberPart)
+	if !ok || strings.ContainsAny(numberPart, "/eE") {
+		return 0, fmt.Errorf("invalid number '%s'", numberPart)
+	}
+	if number.Sign() < 0 {
+		return 0, fmt.Errorf("size must not be negative")
+	}
+	total := new(big.Rat).Mul(number, new(big.Rat).SetInt64(multiplier))
+	bytes := new(big.Int).Quo(total.Num(), total.Denom())
+	if !bytes.IsInt64() {
+		return 0, fmt.Errorf("size too large")
 	}
-	return number * multiplier, nil
+	return bytes.Int64(), nil
 }
 
 func main() {
-	if err := rootCmd().Execute(); err != nil {
-		log.Fatal(err)
+	// an interrupt stops the resize cleanly, at the next point it can, rather
+	// than killing it midway through a write
+	ctx, stop := interruptContext(context.Background())
+	defer stop()
+	if err := rootCmd().ExecuteContext(ctx); err != nil {
+		exitf(exitInvalid, "%v", err)
 	}
 }
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
 )
 
 // Valid partition identifier formats
@@ -16,6 +29,11 @@ func TestParsePartitionIdentifier_Valid(t *testing.T) {
 	}{
 		{"name:sda1", resizer.IdentifierByName, "sda1"},
 		{"label:EFI System", resizer.IdentifierByLabel, "EFI System"},
+		{"uuid:0fc63daf-8483-4772-8e79-3d69d8477de4", resizer.IdentifierByPartUUID, "0fc63daf-8483-4772-8e79-3d69d8477de4"},
+		{"partuuid:0fc63daf-8483-4772-8e79-3d69d8477de4", resizer.IdentifierByPartUUID, "0fc63daf-8483-4772-8e79-3d69d8477de4"},
+		{"fsuuid:1A2B-3C4D", resizer.IdentifierByFSUUID, "1A2B-3C4D"},
+		{"fslabel:rootfs", resizer.IdentifierByFSLabel, "rootfs"},
+		{"dev:/dev/nvme0n1p2", resizer.IdentifierByDevice, "/dev/nvme0n1p2"},
 	}
 	for _, tt := range tests {
 		pi, err := parsePartitionIdentifier(tt.input)
@@ -35,6 +53,9 @@ func TestParsePartitionIdentifier_Invalid(t *testing.T) {
 	inputs := []string{
 		"no-delimiter",
 		"uuid:1234",
+		"partuuid:1234",
+		"fsuuid:",
+		"dev:sda3",
 	}
 	for _, input := range inputs {
 		if _, err := parsePartitionIdentifier(input); err == nil {
@@ -55,6 +76,13 @@ func TestParseSize_Valid(t *testing.T) {
 		{"3M", 3 * 1024 * 1024},
 		{"4G", 4 * 1024 * 1024 * 1024},
 		{"5T", 5 * 1024 * 1024 * 1024 * 1024},
+		{"1.5G", 1536 * 1024 * 1024},
+		{"10GiB", 10 * 1024 * 1024 * 1024},
+		{"10GB", 10 * 1000 * 1000 * 1000},
+		{"2mib", 2 * 1024 * 1024},
+		{"2.5kB", 2500},
+		{"0.5K", 512},
+		{"1.0001K", 1024},
 	}
 	for _, tt := range tests {
 		got, err := parseSize(tt.input)
@@ -70,7 +98,7 @@ func TestParseSize_Valid(t *testing.T) {
 
 // Invalid size strings
 func TestParseSize_Invalid(t *testing.T) {
-	inputs := []string{"XYZ", "12X", "--5M"}
+	inputs := []string{"XYZ", "12X", "--5M", "", "G", "-5M", "1/2G", "1e3M", "1.2.3G", "99999999T"}
 	for _, input := range inputs {
 		if _, err := parseSize(input); err == nil {
 			t.Errorf("parseSize(%q) expected error, got nil", input)
@@ -91,11 +119,76 @@ func TestParsePartitionChange_Valid(t *testing.T) {
 	if got := pc.Size(); got != 20*1024*1024 {
 		t.Errorf("parsePartitionChange(%q) size = %d, want %d", input, got, 20*1024*1024)
 	}
+	if pc.Mode() != resizer.SizeAbsolute {
+		t.Errorf("parsePartitionChange(%q) mode = %v, want absolute", input, pc.Mode())
+	}
+}
+
+// Max partition change, filling the remaining free space
+func TestParsePartitionChange_Max(t *testing.T) {
+	for _, input := range []string{"name:sda4:max", "label:Data:rest", "name:sda4:MAX"} {
+		pc, err := parsePartitionChange(input)
+		if err != nil {
+			t.Errorf("parsePartitionChange(%q) error: %v", input, err)
+			continue
+		}
+		if pc.Mode() != resizer.SizeMax {
+			t.Errorf("parsePartitionChange(%q) mode = %v, want max", input, pc.Mode())
+		}
+	}
+}
+
+// Weighted partition change, sharing the remaining free space
+func TestParsePartitionChange_Weight(t *testing.T) {
+	pc, err := parsePartitionChange("name:sda1:weight=2")
+	if err != nil {
+		t.Fatalf("parsePartitionChange error: %v", err)
+	}
+	if pc.Mode() != resizer.SizeWeight || pc.Size() != 2 {
+		t.Errorf("parsePartitionChange = (%v, %d), want (weight, 2)", pc.Mode(), pc.Size())
+	}
+	for _, input := range []string{"name:sda1:weight=0", "name:sda1:weight=-1", "name:sda1:weight=x"} {
+		if _, err := parsePartitionChange(input); err == nil {
+			t.Errorf("parsePartitionChange(%q) expected error, got nil", input)
+		}
+	}
+}
+
+// Relative partition change, growing by an amount
+func TestParsePartitionChange_Relative(t *testing.T) {
+	input := "name:sda1:+10G"
+	pc, err := parsePartitionChange(input)
+	if err != nil {
+		t.Fatalf("parsePartitionChange(%q) error: %v", input, err)
+	}
+	if pc.Mode() != resizer.SizeRelative {
+		t.Errorf("parsePartitionChange(%q) mode = %v, want relative", input, pc.Mode())
+	}
+	if got := pc.Size(); got != 10*1024*1024*1024 {
+		t.Errorf("parsePartitionChange(%q) size = %d, want %d", input, got, 10*1024*1024*1024)
+	}
+}
+
+// Partition change that also retypes the partition
+func TestParsePartitionChange_Type(t *testing.T) {
+	pc, err := parsePartitionChange("label:rootfs:max:type=4f68bce3-e8cd-4db1-96e7-fbcaf984b709")
+	if err != nil {
+		t.Fatalf("parsePartitionChange error: %v", err)
+	}
+	tc, ok := pc.(resizer.TypedPartitionChange)
+	if !ok || pc.Mode() != resizer.SizeMax || pc.Value() != "rootfs" || tc.PartitionType() != "4f68bce3-e8cd-4db1-96e7-fbcaf984b709" {
+		t.Errorf("parsePartitionChange = %+v, want rootfs grown to max, retyped", pc)
+	}
+	for _, input := range []string{"label:rootfs:max:type=", "label:rootfs:max:type=root", "label:rootfs:type=4f68bce3-e8cd-4db1-96e7-fbcaf984b709"} {
+		if _, err := parsePartitionChange(input); err == nil {
+			t.Errorf("parsePartitionChange(%q) expected error, got nil", input)
+		}
+	}
 }
 
 // Invalid partition change formats
 func TestParsePartitionChange_Invalid(t *testing.T) {
-	inputs := []string{"badformat", "name:sda1", "name:sda1:XYZ"}
+	inputs := []string{"badformat", "name:sda1", "name:sda1:XYZ", "name:sda1:+XYZ"}
 	for _, input := range inputs {
 		if _, err := parsePartitionChange(input); err == nil {
 			t.Errorf("parsePartitionChange(%q) expected error, got nil", input)
@@ -118,3 +211,983 @@ func TestGrowPartitionSlice(t *testing.T) {
 		t.Errorf("parsed grow-partition flags = %v, want %v", s, []string{"label:X:1G", "name:Y:2G"})
 	}
 }
+
+// Shrink partitions, with and without an exact amount
+func TestParseShrinkPartition(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		tests := []struct {
+			input  string
+			val    string
+			change bool
+			size   int64
+		}{
+			{"name:sda3", "sda3", false, 0},
+			{"label:EFI System", "EFI System", false, 0},
+			{"name:sda3:-10G", "sda3", true, -10 * 1024 * 1024 * 1024},
+		}
+		for _, tt := range tests {
+			pi, err := parseShrinkPartition(tt.input)
+			if err != nil {
+				t.Errorf("parseShrinkPartition(%q) error: %v", tt.input, err)
+				continue
+			}
+			if pi.Value() != tt.val {
+				t.Errorf("parseShrinkPartition(%q) value = %q, want %q", tt.input, pi.Value(), tt.val)
+			}
+			pc, ok := pi.(resizer.PartitionChange)
+			if ok != tt.change {
+				t.Errorf("parseShrinkPartition(%q) is a change = %v, want %v", tt.input, ok, tt.change)
+				continue
+			}
+			if ok && (pc.Mode() != resizer.SizeRelative || pc.Size() != tt.size) {
+				t.Errorf("parseShrinkPartition(%q) = (%v, %d), want (relative, %d)", tt.input, pc.Mode(), pc.Size(), tt.size)
+			}
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, input := range []string{"no-delimiter", "name:sda3:10G", "name:sda3:-XYZ"} {
+			if _, err := parseShrinkPartition(input); err == nil {
+				t.Errorf("parseShrinkPartition(%q) expected error, got nil", input)
+			}
+		}
+	})
+}
+
+func TestParseShrinkMargin(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		tests := []struct {
+			input   string
+			margin  int64
+			percent float64
+		}{
+			{"512M", 512 * 1024 * 1024, 0},
+			{"1G", 1024 * 1024 * 1024, 0},
+			{"10%", 0, 10},
+			{"2.5%", 0, 2.5},
+		}
+		for _, tt := range tests {
+			margin, percent, err := parseShrinkMargin(tt.input)
+			if err != nil {
+				t.Errorf("parseShrinkMargin(%q) error: %v", tt.input, err)
+				continue
+			}
+			if margin != tt.margin || percent != tt.percent {
+				t.Errorf("parseShrinkMargin(%q) = (%d, %v), want (%d, %v)", tt.input, margin, percent, tt.margin, tt.percent)
+			}
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, input := range []string{"XYZ", "-1%", "100%", "NaN%", "%"} {
+			if _, _, err := parseShrinkMargin(input); err == nil {
+				t.Errorf("parseShrinkMargin(%q) expected error, got nil", input)
+			}
+		}
+	})
+}
+
+// The root command takes the disk as its only argument, alongside the plan,
+// apply, resume, rollback, backup-table and restore-table subcommands
+func TestRootCmdArgs(t *testing.T) {
+	cmd := rootCmd()
+	if err := cmd.Args(cmd, []string{"disk.img"}); err != nil {
+		t.Errorf("root command rejected a disk argument: %v", err)
+	}
+	if err := cmd.Args(cmd, []string{"disk.img", "extra"}); err == nil {
+		t.Error("root command accepted two arguments")
+	}
+	for _, name := range []string{"plan", "apply", "resume", "rollback", "backup-table", "restore-table"} {
+		if sub, _, err := cmd.Find([]string{name}); err != nil || sub.Name() != name {
+			t.Errorf("Find(%s) = %v, %v, want the %s command", name, sub, err, name)
+		}
+	}
+}
+
+func TestRenderProgress(t *testing.T) {
+	tests := []struct {
+		copied, total int64
+		elapsed       time.Duration
+		want          string
+	}{
+		{0, 100 * 1024 * 1024, 0, "partition 2 (1/3) [>                             ]   0% 0/100 MB --- MB/s ETA --"},
+		{25 * 1024 * 1024, 100 * 1024 * 1024, 5 * time.Second, "partition 2 (1/3) [=======>                      ]  25% 25/100 MB 5.0 MB/s ETA 15s"},
+		{100 * 1024 * 1024, 100 * 1024 * 1024, 20 * time.Second, "partition 2 (1/3) [==============================] 100% 100/100 MB 5.0 MB/s ETA 0s"},
+	}
+	for _, tt := range tests {
+		if got := renderProgress("partition 2 (1/3)", tt.copied, tt.total, tt.elapsed); got != tt.want {
+			t.Errorf("renderProgress(%d, %d, %v) = %q, want %q", tt.copied, tt.total, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+// The bar is redrawn at most every progressInterval, and always once the copy
+// is done; a log line clears it and redraws it after
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Unix(0, 0)
+	p := newProgressBar(&out)
+	p.now = func() time.Time { return now }
+	p.CopyStarted(2, 1, 1)
+	for copied := int64(1); copied <= 4; copied++ {
+		now = now.Add(progressInterval / 2)
+		p.BytesCopied(2, copied*1024*1024, 4*1024*1024)
+	}
+	if draws := strings.Count(out.String(), "\r"); draws != 3 {
+		t.Errorf("bar drawn %d times, want 3:\n%q", draws, out.String())
+	}
+	if !strings.HasSuffix(out.String(), "\n") || !strings.Contains(out.String(), "100% 4/4 MB") {
+		t.Errorf("finished bar = %q, want it complete and on its own line", out.String())
+	}
+
+	out.Reset()
+	_, _ = p.Write([]byte("after the copy\n"))
+	if out.String() != "after the copy\n" {
+		t.Errorf("log line after the copy written as %q, want it as it is", out.String())
+	}
+	p.CopyStarted(2, 1, 1)
+	now = now.Add(progressInterval)
+	p.BytesCopied(2, 1024*1024, 4*1024*1024)
+	out.Reset()
+	_, _ = p.Write([]byte("during the copy\n"))
+	if want := "\r\033[Kduring the copy\n\rpartition 2 (1/1) ["; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("log line during the copy written as %q, want the bar cleared before it and redrawn after", out.String())
+	}
+	now = now.Add(progressInterval)
+	p.BytesCopied(2, 4*1024*1024, 4*1024*1024)
+
+	// partitions copied concurrently are drawn as one bar
+	out.Reset()
+	p.CopyStarted(1, 1, 2)
+	p.CopyStarted(3, 2, 2)
+	for _, c := range []struct {
+		partition     int
+		copied, total int64
+	}{{1, 2, 2}, {3, 4, 6}, {1, 4, 8}} {
+		now = now.Add(progressInterval)
+		p.BytesCopied(c.partition, c.copied*1024*1024, 4*1024*1024)
+		p.TotalBytesCopied(c.total*1024*1024, 8*1024*1024)
+	}
+	if draws := strings.Count(out.String(), "\r2 partitions ["); draws != 3 || strings.Contains(out.String(), "partition 3") {
+		t.Errorf("concurrent copies drawn as %q, want one bar for both, drawn 3 times", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "\n") || !strings.Contains(out.String(), "100% 8/8 MB") {
+		t.Errorf("finished bar = %q, want it complete and on its own line", out.String())
+	}
+}
+
+// The first interrupt cancels the context, and later ones do not kill the
+// process
+func TestInterruptContext(t *testing.T) {
+	ctx, stop := interruptContext(context.Background())
+	defer stop()
+	for range 2 {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled by SIGTERM")
+	}
+}
+
+// With json, the library's log lines, and the resizer's own, are JSON objects
+func TestSetLogFormat(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var out bytes.Buffer
+	if err := setLogFormat(&out, "yaml", slog.LevelInfo); err == nil {
+		t.Error("setLogFormat(yaml) returned no error")
+	}
+	if err := setLogFormat(&out, logFormatJSON, slog.LevelInfo); err != nil {
+		t.Fatalf("setLogFormat(json) error: %v", err)
+	}
+	slog.Info("phase started", "phase", resizer.PhaseCopy)
+	log.Printf("Plan applied")
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("log line %q is not JSON: %v", line, err)
+		}
+	}
+	if !strings.Contains(out.String(), `"phase":"copy"`) {
+		t.Errorf("log = %q, want the phase as an attribute", out.String())
+	}
+}
+
+// --quiet logs warnings and errors only, each -v one level more, down to
+// resizer.LevelTrace, named TRACE in JSON
+func TestLogLevel(t *testing.T) {
+	for _, tt := range []struct {
+		verbose int
+		quiet   bool
+		want    slog.Level
+	}{
+		{0, false, slog.LevelInfo},
+		{0, true, slog.LevelWarn},
+		{1, false, slog.LevelDebug},
+		{2, false, resizer.LevelTrace},
+		{3, false, resizer.LevelTrace},
+	} {
+		if got, err := logLevel(tt.verbose, tt.quiet); err != nil || got != tt.want {
+			t.Errorf("logLevel(%d, %t) = %s, %v, want %s", tt.verbose, tt.quiet, got, err, tt.want)
+		}
+	}
+	if _, err := logLevel(1, true); err == nil {
+		t.Error("logLevel(1, true) returned no error")
+	}
+
+	defer slog.SetDefault(slog.Default())
+	var out bytes.Buffer
+	if err := setLogFormat(&out, logFormatJSON, slog.LevelWarn); err != nil {
+		t.Fatalf("setLogFormat(json) error: %v", err)
+	}
+	slog.Info("resizing partition", "partition", 1)
+	slog.Warn("partition table written, but the kernel keeps the old one")
+	if log := out.String(); strings.Contains(log, "resizing partition") || !strings.Contains(log, `"level":"WARN"`) {
+		t.Errorf("log at warn = %q, want the warning only", log)
+	}
+	out.Reset()
+	if err := setLogFormat(&out, logFormatJSON, resizer.LevelTrace); err != nil {
+		t.Fatalf("setLogFormat(json) error: %v", err)
+	}
+	slog.Log(context.Background(), resizer.LevelTrace, "writing partition table")
+	if log := out.String(); !strings.Contains(log, `"level":"TRACE"`) {
+		t.Errorf("log at trace = %q, want a TRACE line", log)
+	}
+}
+
+// A copy's progress is logged at most every progressLogInterval, and always
+// once the copy is done
+func TestProgressLog(t *testing.T) {
+	var out bytes.Buffer
+	now := time.Unix(0, 0)
+	p := newProgressLog(slog.New(slog.NewJSONHandler(&out, nil)))
+	p.now = func() time.Time { return now }
+	p.CopyStarted(2, 1, 1)
+	for copied := int64(1); copied <= 4; copied++ {
+		now = now.Add(progressLogInterval / 2)
+		p.BytesCopied(2, copied*1024*1024, 4*1024*1024)
+	}
+	if logged := strings.Count(out.String(), `"msg":"bytes copied"`); logged != 2 {
+		t.Errorf("progress logged %d times, want 2:\n%s", logged, out.String())
+	}
+	if !strings.Contains(out.String(), `"copied":4194304,"total":4194304`) {
+		t.Errorf("log = %q, want the copy logged once done", out.String())
+	}
+}
+
+// With --output json, the result is written as JSON, and otherwise not at all
+func TestWriteResult(t *testing.T) {
+	res := &resizer.Result{
+		Disk: "/dev/sda",
+		Partitions: []resizer.PartitionResult{{
+			Label:    "data",
+			Original: resizer.PartitionGeometry{Number: 1, Start: 1024 * 1024, End: 9*1024*1024 - 1, Size: 8 * 1024 * 1024},
+			Final:    resizer.PartitionGeometry{Number: 2, Start: 20 * 1024 * 1024, End: 36*1024*1024 - 1, Size: 16 * 1024 * 1024},
+			Moved:    true,
+		}},
+	}
+	var out bytes.Buffer
+	if err := writeResult(&out, outputText, res); err != nil || out.Len() != 0 {
+		t.Errorf("writeResult(text) = %q, %v, want nothing written", out.String(), err)
+	}
+	if err := writeResult(&out, outputJSON, res); err != nil {
+		t.Fatalf("writeResult(json) error: %v", err)
+	}
+	var got resizer.Result
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("writeResult(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(&got, res) {
+		t.Errorf("writeResult(json) round trip = %+v, want %+v", got, *res)
+	}
+	// with --multi-disk, the result of each disk
+	out.Reset()
+	multi := &resizer.MultiResult{Disks: []*resizer.Result{res, {Disk: "/dev/sdb", Partitions: []resizer.PartitionResult{}}}}
+	if err := writeResult(&out, outputJSON, multi); err != nil {
+		t.Fatalf("writeResult(json) error: %v", err)
+	}
+	var gotMulti resizer.MultiResult
+	if err := json.Unmarshal(out.Bytes(), &gotMulti); err != nil {
+		t.Fatalf("writeResult(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(&gotMulti, multi) {
+		t.Errorf("writeResult(json) round trip = %+v, want %+v", gotMulti, *multi)
+	}
+	// YAML has the fields of the JSON, in the same order, quoting strings
+	// that would otherwise read as something else
+	out.Reset()
+	res.Partitions[0].Label = "123"
+	if err := writeResult(&out, outputYAML, res); err != nil {
+		t.Fatalf("writeResult(yaml) error: %v", err)
+	}
+	want := `disk: /dev/sda
+partitions:
+  - label: "123"
+    original:
+      number: 1
+      start: 1048576
+      end: 9437183
+      size: 8388608
+    final:
+      number: 2
+      start: 20971520
+      end: 37748735
+      size: 16777216
+    moved: true
+duration: 0
+`
+	if out.String() != want {
+		t.Errorf("writeResult(yaml) = %q, want %q", out.String(), want)
+	}
+	if err := checkOutput("xml"); err == nil {
+		t.Error("checkOutput(xml) returned no error")
+	}
+}
+
+// A --hook value names its point, and its command is run with sh, told of the
+// resize in its environment
+func TestParseHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.out")
+	point, hook, err := parseHook(`post-copy=echo "$RESIZER_HOOK $RESIZER_DISK $RESIZER_PARTITIONS" > ` + out)
+	if err != nil {
+		t.Fatalf("parseHook() error: %v", err)
+	}
+	if point != resizer.HookPostCopy {
+		t.Errorf("parseHook() point = %q, want %q", point, resizer.HookPostCopy)
+	}
+	info := resizer.HookInfo{Point: point, Disk: "/dev/sda", Partitions: []resizer.PartitionResult{{Label: "data"}}}
+	if err := hook(context.Background(), info); err != nil {
+		t.Fatalf("hook error: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); !strings.HasPrefix(got, `post-copy /dev/sda [{"label":"data"`) {
+		t.Errorf("hook was told %q, want the point, disk and partitions", got)
+	}
+
+	_, failing, err := parseHook("pre-cutover=exit 1")
+	if err != nil {
+		t.Fatalf("parseHook() error: %v", err)
+	}
+	if err := failing(context.Background(), info); err == nil {
+		t.Error("hook exiting 1 returned no error")
+	}
+	for _, s := range []string{"post-copy", "post-copy=", "post-shrink=true"} {
+		if _, _, err := parseHook(s); err == nil {
+			t.Errorf("parseHook(%q) returned no error", s)
+		}
+	}
+}
+
+// A --disk value is a path, unless it selects a disk by a property
+func TestResolveDisk(t *testing.T) {
+	for _, s := range []string{"/dev/sda", "disk.img", "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", "name:sda"} {
+		got, err := resolveDisk(s)
+		if err != nil || got != s {
+			t.Errorf("resolveDisk(%q) = %q, %v, want the path itself", s, got, err)
+		}
+	}
+	for _, s := range []string{"serial:", "serial:NO-SUCH-SERIAL-0000", "model:No Such Model"} {
+		if _, err := resolveDisk(s); err == nil {
+			t.Errorf("resolveDisk(%q) returned no error", s)
+		}
+	}
+}
+
+// Each step is asked about, and goes ahead only on y or yes; with no terminal
+// to ask on, none does
+func TestNewConfirm(t *testing.T) {
+	var out bytes.Buffer
+	confirm := newConfirm(strings.NewReader("y\nno\nYes\n\n"), &out, true)
+	for i, want := range []bool{true, false, true, false, false} {
+		if got := confirm("write the partition table"); got != want {
+			t.Errorf("answer %d confirmed %v, want %v", i+1, got, want)
+		}
+	}
+	if !strings.Contains(out.String(), "About to write the partition table. Continue? [y/N]") {
+		t.Errorf("asked %q, want the step described", out.String())
+	}
+	out.Reset()
+	if newConfirm(strings.NewReader("y\n"), &out, false)("write the partition table") {
+		t.Error("confirmed without a terminal, want declined")
+	}
+	if !strings.Contains(out.String(), "--yes") {
+		t.Errorf("declined with %q, want it to say to pass --yes", out.String())
+	}
+}
+
+// TestWriteDisks writes a disk as a table, with - for what is unknown, and as
+// JSON.
+func TestWriteDisks(t *testing.T) {
+	disks := []resizer.DiskInfo{{
+		Path: "/dev/sda",
+		GUID: "5A1C3D2E-7B4F-4E8A-9C6D-0F1E2D3C4B5A",
+		Size: 20 << 30,
+		Partitions: []resizer.PartitionInfo{
+			{Number: 1, Name: "sda1", Start: 1 << 20, End: 513<<20 - 1, Size: 512 << 20, Label: "EFI System", Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", FSType: "vfat", FSLabel: "ESP"},
+			{Number: 2, Name: "sda2", Start: 513 << 20, End: 20<<30 - 1, Size: 20<<30 - 513<<20, Label: "root", Type: "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+		},
+	}}
+	var out bytes.Buffer
+	if err := writeDisks(&out, outputText, disks); err != nil {
+		t.Fatalf("writeDisks(text) error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("writeDisks(text) = %q, want the disk, a header and 2 partitions", out.String())
+	}
+	if fields := strings.Fields(lines[0]); !reflect.DeepEqual(fields, []string{"/dev/sda", "20G", "GUID", "5A1C3D2E-7B4F-4E8A-9C6D-0F1E2D3C4B5A"}) {
+		t.Errorf("writeDisks(text) disk line = %q", lines[0])
+	}
+	if fields := strings.Fields(lines[3]); !reflect.DeepEqual(fields, []string{"2", "sda2", "537919488", "21474836479", "19.4G", "root", "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "-", "-"}) {
+		t.Errorf("writeDisks(text) partition line = %q", lines[3])
+	}
+
+	out.Reset()
+	if err := writeDisks(&out, outputJSON, disks); err != nil {
+		t.Fatalf("writeDisks(json) error: %v", err)
+	}
+	var got []resizer.DiskInfo
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("writeDisks(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(got, disks) {
+		t.Errorf("writeDisks(json) round trip = %+v, want %+v", got, disks)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for size, want := range map[int64]string{
+		512:              "512",
+		1 << 10:          "1K",
+		100 << 20:        "100M",
+		1536 << 20:       "1.5G",
+		20<<30 - 513<<20: "19.4G",
+		1<<20 - 1:        "1023.9K",
+		2 << 40:          "2T",
+	} {
+		if got := formatSize(size); got != want {
+			t.Errorf("formatSize(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
+
+// TestWriteFreeSpace writes the free space of a disk as a table and as JSON.
+func TestWriteFreeSpace(t *testing.T) {
+	maps := []*resizer.FreeSpaceMap{{
+		Disk: "/dev/sda",
+		Size: 20 << 30,
+		Gaps: []resizer.FreeGap{
+			{Extent: resizer.Extent{Start: 1, End: 1<<20 - 1}, Size: 1<<20 - 1, Alignment: 1},
+			{Extent: resizer.Extent{Start: 10 << 30, End: 20<<30 - 1}, Size: 10 << 30, Alignment: 1 << 20, Allocatable: 10 << 30},
+		},
+		Largest: 10 << 30,
+	}}
+	var out bytes.Buffer
+	if err := writeFreeSpace(&out, outputText, maps); err != nil {
+		t.Fatalf("writeFreeSpace(text) error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[0], "largest allocatable 10G") {
+		t.Fatalf("writeFreeSpace(text) = %q, want the disk with its largest block, a header and 2 gaps", out.String())
+	}
+	if fields := strings.Fields(lines[3]); !reflect.DeepEqual(fields, []string{"10737418240", "21474836479", "10G", "1M", "10G"}) {
+		t.Errorf("writeFreeSpace(text) gap line = %q", lines[3])
+	}
+
+	out.Reset()
+	if err := writeFreeSpace(&out, outputJSON, maps); err != nil {
+		t.Fatalf("writeFreeSpace(json) error: %v", err)
+	}
+	var got []*resizer.FreeSpaceMap
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("writeFreeSpace(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(got, maps) {
+		t.Errorf("writeFreeSpace(json) round trip = %+v, want %+v", got, maps)
+	}
+}
+
+// TestWritePlanDiff writes a plan that shrinks one partition in place and moves
+// another, growing it, as a diff of their geometry.
+func TestWritePlanDiff(t *testing.T) {
+	plan := &resizer.Plan{
+		Disk:     "/dev/sda",
+		DiskGUID: "5A1C3D2E-7B4F-4E8A-9C6D-0F1E2D3C4B5A",
+		Partitions: []resizer.PartitionResult{
+			{Label: "home", Original: resizer.PartitionGeometry{Number: 3, Start: 1 << 30, Size: 4 << 30}, Final: resizer.PartitionGeometry{Number: 3, Start: 1 << 30, Size: 3 << 30}},
+			{Label: "root", Original: resizer.PartitionGeometry{Number: 2, Start: 1 << 20, Size: 512 << 20}, Final: resizer.PartitionGeometry{Number: 4, Start: 4 << 30, Size: 1 << 30}, Moved: true},
+		},
+	}
+	var out bytes.Buffer
+	if err := writePlanDiff(&out, plan); err != nil {
+		t.Fatalf("writePlanDiff() error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := [][]string{
+		{"Plan", "for", "/dev/sda,", "GUID", "5A1C3D2E-7B4F-4E8A-9C6D-0F1E2D3C4B5A:"},
+		{"NUMBER", "LABEL", "START", "END", "SIZE"},
+		{"-", "3", "home", "1073741824", "5368709119", "4G"},
+		{"+", "3", "home", "1073741824", "4294967295", "3G"},
+		{"-", "2", "root", "1048576", "537919487", "512M"},
+		{"+", "4", "root", "4294967296", "5368709119", "1G", "moved"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("writePlanDiff() = %q, want %d lines", out.String(), len(want))
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields, want[i]) {
+			t.Errorf("writePlanDiff() line %d = %q, want %q", i, line, strings.Join(want[i], " "))
+		}
+	}
+}
+
+// TestWriteReport writes a report of a disk left mid-resize as text and JSON.
+func TestWriteReport(t *testing.T) {
+	report := &resizer.ValidationReport{
+		Disk:     "/dev/sda",
+		Problems: []string{"partition 3 (root_resized2) is a temporary copy that was never removed or renamed"},
+		Checks:   []resizer.CheckResult{{Partition: 1, Filesystem: "ext4", Outcome: resizer.CheckPassed}, {Partition: 2, Outcome: resizer.CheckSkipped, Detail: "mounted at /"}},
+	}
+	var out bytes.Buffer
+	if err := writeReport(&out, outputText, report); err != nil {
+		t.Fatalf("writeReport(text) error: %v", err)
+	}
+	want := "problem: partition 3 (root_resized2) is a temporary copy that was never removed or renamed\ncheck: partition 1 passed (ext4)\ncheck: partition 2 skipped: mounted at /\n"
+	if out.String() != want {
+		t.Errorf("writeReport(text) = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := writeReport(&out, outputJSON, report); err != nil {
+		t.Fatalf("writeReport(json) error: %v", err)
+	}
+	var got resizer.ValidationReport
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("writeReport(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(&got, report) {
+		t.Errorf("writeReport(json) round trip = %+v, want %+v", got, *report)
+	}
+}
+
+// TestWriteStatus writes the status of a resize interrupted before its commit,
+// recommending it be rolled back.
+func TestWriteStatus(t *testing.T) {
+	status := &resizer.ResizeStatus{
+		Journal:     "/var/lib/partitionresizer/journal.json",
+		Disk:        "/dev/sda",
+		Completed:   []string{resizer.PhaseShrinkFilesystems, resizer.PhasePreparePartitions},
+		Remaining:   []string{resizer.PhaseCopy, resizer.PhaseValidate},
+		Partitions:  []resizer.PartitionResult{{Label: "root", Original: resizer.PartitionGeometry{Number: 2, Start: 1 << 20, Size: 512 << 20}, Final: resizer.PartitionGeometry{Number: 4, Start: 4 << 30, Size: 1 << 30}, Moved: true}},
+		Recommended: resizer.ActionRollback,
+		Reason:      "the original partitions are still in the partition table",
+		CanRollback: true,
+		Copied:      map[int]int64{2: 128 << 20},
+	}
+	var out bytes.Buffer
+	if err := writeStatus(&out, outputText, status); err != nil {
+		t.Fatalf("writeStatus(text) error: %v", err)
+	}
+	for _, want := range []string{
+		"Resize of /dev/sda, unfinished",
+		"partition 2 (root): 512M at 1048576, to be partition 4, 1G at 4294967296",
+		"128M of it copied, as of the last checkpoint",
+		"Remaining: copy, validate",
+		"Recommended: resizer rollback --journal /var/lib/partitionresizer/journal.json",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("writeStatus(text) = %q, want %q in it", out.String(), want)
+		}
+	}
+
+	out.Reset()
+	if err := writeStatus(&out, outputJSON, status); err != nil {
+		t.Fatalf("writeStatus(json) error: %v", err)
+	}
+	var got resizer.ResizeStatus
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("writeStatus(json) = %q: %v", out.String(), err)
+	}
+	if !reflect.DeepEqual(&got, status) {
+		t.Errorf("writeStatus(json) round trip = %+v, want %+v", got, *status)
+	}
+}
+
+// TestReadLayout reads a layout file identifying partitions by label and by
+// filesystem UUID, with sizes, limits and one filling the free space, and
+// refuses files that misspell a field or identify a partition twice over.
+func TestReadLayout(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "layout.yaml")
+	content := `partitions:
+  - label: EFI System
+    type: C12A7328-F81F-11D2-BA4B-00A0C93EC93B
+    size: 512M
+  - partition: fsuuid:0fc63daf-8483-4772-8e79-3d69d8477de4
+    min: 20G
+  - label: data
+    size: max
+    max: 1T
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	layout, err := readLayout(path)
+	if err != nil {
+		t.Fatalf("readLayout() error: %v", err)
+	}
+	want := resizer.Layout{Partitions: []resizer.LayoutPartition{
+		{Partition: resizer.NewPartitionIdentifier(resizer.IdentifierByLabel, "EFI System"), Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", Size: 512 << 20},
+		{Partition: resizer.NewPartitionIdentifier(resizer.IdentifierByFSUUID, "0fc63daf-8483-4772-8e79-3d69d8477de4"), Min: 20 << 30},
+		{Partition: resizer.NewPartitionIdentifier(resizer.IdentifierByLabel, "data"), Fill: true, Max: 1 << 40},
+	}}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("readLayout() = %+v, want %+v", layout, want)
+	}
+
+	for name, content := range map[string]string{
+		"misspelt field": "partitions:\n  - label: data\n    maximum: 1T\n",
+		"label and uuid": "partitions:\n  - label: data\n    partition: partuuid:0fc63daf-8483-4772-8e79-3d69d8477de4\n",
+		"no identifier":  "partitions:\n  - size: 1G\n",
+		"invalid size":   "partitions:\n  - label: data\n    size: lots\n",
+		"no partitions":  "partitions: []\n",
+		"invalid min":    "partitions:\n  - label: data\n    min: -1G\n",
+		"bad partition":  "partitions:\n  - partition: data\n",
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readLayout(path); err == nil {
+			t.Errorf("%s: readLayout() returned no error", name)
+		}
+	}
+}
+
+// TestWriteGrowpart writes the grow of a partition as growpart reports it, in
+// 512-byte sectors, with CHANGE rather than CHANGED for a dry run.
+func TestWriteGrowpart(t *testing.T) {
+	res := &resizer.Result{Partitions: []resizer.PartitionResult{{
+		Label:    "root",
+		Original: resizer.PartitionGeometry{Number: 1, Start: 1 << 20, End: 2<<30 - 1, Size: 2<<30 - 1<<20},
+		Final:    resizer.PartitionGeometry{Number: 1, Start: 1 << 20, End: 10<<30 - 1, Size: 10<<30 - 1<<20},
+	}}}
+	var out bytes.Buffer
+	if err := writeGrowpart(&out, res); err != nil {
+		t.Fatalf("writeGrowpart() error: %v", err)
+	}
+	want := "CHANGED: partition=1 start=2048 old: size=4192256 end=4194304 new: size=20969472 end=20971520\n"
+	if out.String() != want {
+		t.Errorf("writeGrowpart() = %q, want %q", out.String(), want)
+	}
+	res.DryRun = true
+	out.Reset()
+	if err := writeGrowpart(&out, res); err != nil {
+		t.Fatalf("writeGrowpart() error: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "CHANGE: partition=1 ") {
+		t.Errorf("writeGrowpart() of a dry run = %q, want CHANGE", out.String())
+	}
+}
+
+// TestInteractivePlan answers the questions of resizer -i for a minimal GPT
+// image, a wrong partition and size first, and gets the plan the answers make
+// once it is accepted, and none once it is declined or the answers run out.
+func TestInteractivePlan(t *testing.T) {
+	img := makeMinimalGPTImage(t)
+	var out bytes.Buffer
+	plan, err := interactivePlan(strings.NewReader("9\n1\nlots\n1\n+4M\n\ny\n"), &out, img, resizer.Options{})
+	if err != nil {
+		t.Fatalf("interactivePlan() error: %v\n%s", err, out.String())
+	}
+	if plan == nil || len(plan.Partitions) != 1 || plan.Partitions[0].Final.Size != 20*resizer.MB {
+		t.Fatalf("interactivePlan() = %+v, want partition 1 grown to 20 MB\n%s", plan, out.String())
+	}
+	for _, want := range []string{"No partition 9", "invalid size 'lots'", "largest allocatable 46M", "Plan for " + img, "Apply this plan?"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("interactivePlan() wrote %q, want it to say %q", out.String(), want)
+		}
+	}
+
+	for _, answers := range []string{"1\n+4M\n\nn\n", "1\n+4M\n", ""} {
+		out.Reset()
+		plan, err := interactivePlan(strings.NewReader(answers), &out, img, resizer.Options{})
+		if err != nil || plan != nil {
+			t.Errorf("interactivePlan() with answers %q = %+v, %v, want no plan", answers, plan, err)
+		}
+	}
+}
+
+// TestAskBeforeResizing prints the resize once it is planned, before asking
+// whether to go ahead, and still passes each event on.
+func TestAskBeforeResizing(t *testing.T) {
+	var (
+		out    bytes.Buffer
+		passed []resizer.EventKind
+	)
+	opts := resizer.Options{OnEvent: func(e resizer.Event) { passed = append(passed, e.Kind) }}
+	askBeforeResizing(&opts, strings.NewReader("y\n"), &out, true)
+	opts.OnEvent(resizer.Event{Kind: resizer.EventPlanComputed, Disk: "/dev/sda", Plan: []resizer.PartitionResult{{
+		Label:    "root",
+		Original: resizer.PartitionGeometry{Number: 2, Start: 1 << 20, End: 513<<20 - 1, Size: 512 << 20},
+		Final:    resizer.PartitionGeometry{Number: 2, Start: 1 << 20, End: 1025<<20 - 1, Size: 1 << 30},
+	}}})
+	if !opts.Confirm("resize partition 2 (root) of /dev/sda as planned") {
+		t.Error("Confirm() declined, want it to go ahead")
+	}
+	if !strings.HasPrefix(out.String(), "Resize of /dev/sda:\n") || !strings.Contains(out.String(), "+  2       root") || !strings.HasSuffix(out.String(), "Continue? [y/N] ") {
+		t.Errorf("askBeforeResizing() wrote %q, want the resize, then the question", out.String())
+	}
+	if len(passed) != 1 || passed[0] != resizer.EventPlanComputed {
+		t.Errorf("OnEvent passed on %v, want the plan", passed)
+	}
+}
+
+// Each kind of failure has an exit code of its own, found however deep the
+// error is wrapped
+func TestExitCode(t *testing.T) {
+	space := resizer.NewInsufficientSpaceError("data", 1<<30)
+	for _, tt := range []struct {
+		name    string
+		err     error
+		results []*resizer.Result
+		want    int
+	}{
+		{"other", fmt.Errorf("failed to open disk"), nil, exitFailure},
+		{"plan", resizer.NewPlanError("/dev/sda", fmt.Errorf("partition not found")), nil, exitInvalid},
+		{"stale plan", resizer.NewStalePlanError("/dev/sda", []string{"partition 1 moved"}), nil, exitInvalid},
+		{"space", resizer.NewPlanError("/dev/sda", fmt.Errorf("%w, and no shrink partition specified", space)), nil, exitNoSpace},
+		{"in use", fmt.Errorf("disk /dev/sda: %w", resizer.NewInUseError("/dev/sda", []string{"mounted"})), nil, exitBusy},
+		{"tool not found", fmt.Errorf("failed to check filesystem: exit status 127"), []*resizer.Result{nil, {Tools: []resizer.ToolRun{{Name: "e2fsck", NotFound: true}}}}, exitToolMissing},
+		{"copy", resizer.NewCopyError("data", fmt.Errorf("verification failed")), nil, exitCopyFailed},
+		{"check", resizer.NewFilesystemCheckError("/dev/sda", []string{"bad superblock"}), nil, exitCopyFailed},
+		{"boot partition", resizer.NewPlanError("/dev/sda", resizer.NewBootPartitionError("/dev/sda", []string{"partition 1 (EFI System), of type EFI system"})), nil, exitInvalid},
+		{"dry run tool missing", resizer.NewDryRunError("/dev/sda", []resizer.DryRunProblem{{Phase: resizer.PhaseShrinkFilesystems, Partition: 2, Detail: "filesystem too full"}, {Phase: resizer.PhaseShrinkFilesystems, Partition: 2, Tool: "resize2fs", Detail: "not found"}}), nil, exitToolMissing},
+		{"dry run", resizer.NewDryRunError("/dev/sda", []resizer.DryRunProblem{{Phase: resizer.PhaseShrinkFilesystems, Partition: 2, Detail: "filesystem too full"}}), nil, exitFailure},
+	} {
+		if got := exitCode(tt.err, tt.results...); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// The config file gives the flags not given on the command line their values,
+// including those of the root command's persistent flags, and names no flag
+// unknown to every command
+func TestApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resizer.conf")
+	config := `verify: sampled
+exclude-partition: ["label:EFI System", "fslabel:recovery"]
+shrink-granularity: 1G
+tool: [e2fsck=/usr/local/sbin/e2fsck]
+log-format: json
+verbose: 2
+output: json
+plan-file: plan.json
+grow-partition: [label:data:max]
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd, _, err := rootCmd().Find([]string{"plan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.ParseFlags([]string{"--verify", "none"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cmd, path, true); err != nil {
+		t.Fatalf("applyConfig() error: %v", err)
+	}
+	flags := cmd.Flags()
+	for name, want := range map[string]string{
+		"verify":             "none",
+		"exclude-partition":  "[label:EFI System,fslabel:recovery]",
+		"shrink-granularity": "1G",
+		"tool":               "[e2fsck=/usr/local/sbin/e2fsck]",
+		"log-format":         "json",
+		"verbose":            "2",
+		"output":             "json",
+		// plan's --plan-file says what to act on, like --grow-partition
+		"plan-file":      "",
+		"grow-partition": "[]",
+	} {
+		if got := flags.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s = %q, want %q", name, got, want)
+		}
+	}
+
+	if err := applyConfig(cmd, filepath.Join(dir, "missing.conf"), false); err != nil {
+		t.Errorf("applyConfig() of a missing default config error: %v", err)
+	}
+	if err := applyConfig(cmd, filepath.Join(dir, "missing.conf"), true); err == nil {
+		t.Error("applyConfig() of a missing --config returned no error")
+	}
+	if err := os.WriteFile(path, []byte("verfy: none\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cmd, path, true); err == nil || !strings.Contains(err.Error(), "unknown flag verfy") {
+		t.Errorf("applyConfig() of a misspelt flag error = %v, want it named", err)
+	}
+}
+
+// A tool given a path with --tool is run from it
+func TestToolPathRunner(t *testing.T) {
+	for _, s := range []string{"e2fsck", "=/sbin/e2fsck", "e2fsck=sbin/e2fsck"} {
+		if _, _, err := parseTool(s); err == nil {
+			t.Errorf("parseTool(%q) returned no error", s)
+		}
+	}
+	name, path, err := parseTool("resizer-test-tool=/bin/echo")
+	if err != nil {
+		t.Fatalf("parseTool() error: %v", err)
+	}
+	var out bytes.Buffer
+	if err := (toolPathRunner{name: path}).Run(context.Background(), name, []string{"ran"}, 0, &out, &out); err != nil || out.String() != "ran\n" {
+		t.Errorf("Run(%s) = %q, %v, want it run as %s", name, out.String(), err, path)
+	}
+	if found, err := (toolPathRunner{name: path}).LookPath(name); err != nil || found != path {
+		t.Errorf("LookPath(%s) = %q, %v, want %s", name, found, err, path)
+	}
+	if _, err := (toolPathRunner{name: "/nonexistent/" + name}).LookPath(name); err == nil {
+		t.Errorf("LookPath(%s) of a missing path returned no error", name)
+	}
+}
+
+// apply - reads a plan, or a change request document that it plans, from
+// stdin
+func TestReadApplyInput(t *testing.T) {
+	img := makeMinimalGPTImage(t)
+	request := fmt.Sprintf(`{"disk": %q, "grow-partition": ["label:data:20M"], "options": {"Verify": "sampled"}}`, img)
+	var diff bytes.Buffer
+	plan, err := readApplyInput(strings.NewReader(request), &diff)
+	if err != nil {
+		t.Fatalf("readApplyInput() of a change request error: %v", err)
+	}
+	if len(plan.Grow) != 1 || plan.Grow[0].Size != 20<<20 || plan.Options.Verify != resizer.VerifySampled {
+		t.Errorf("readApplyInput() of a change request = %+v, want data grown to 20M, verified sampled", plan)
+	}
+	if !strings.Contains(diff.String(), "data") {
+		t.Errorf("diff = %q, want the partition grown", diff.String())
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readApplyInput(bytes.NewReader(data), io.Discard)
+	if err != nil {
+		t.Fatalf("readApplyInput() of a plan error: %v", err)
+	}
+	if !reflect.DeepEqual(read.Grow, plan.Grow) || read.DiskGUID != plan.DiskGUID {
+		t.Errorf("readApplyInput() of a plan = %+v, want %+v", read, plan)
+	}
+
+	for _, input := range []string{
+		`not json`,
+		fmt.Sprintf(`{"disk": %q, "grow-partition": ["label:data:20M"], "shrink-partitions": ["label:data"]}`, img),
+		fmt.Sprintf(`{"disk": %q, "grow-partition": []}`, img),
+		fmt.Sprintf(`{"disk": %q, "grow-partition": ["label:data"]}`, img),
+	} {
+		if _, err := readApplyInput(strings.NewReader(input), io.Discard); err == nil {
+			t.Errorf("readApplyInput(%s) returned no error", input)
+		}
+	}
+}
+
+// The layout of a disk is drawn before and after, in proportion, with each
+// partition in the character of its number
+func TestWriteLayout(t *testing.T) {
+	img := makeMinimalGPTImage(t)
+	var out bytes.Buffer
+	err := writeLayout(&out, img, []resizer.PartitionResult{{
+		Label:    "data",
+		Original: resizer.PartitionGeometry{Number: 1, Start: 1 << 20, Size: 16 << 20},
+		Final:    resizer.PartitionGeometry{Number: 2, Start: 20 << 20, Size: 24 << 20},
+		Moved:    true,
+	}})
+	if err != nil {
+		t.Fatalf("writeLayout() error: %v", err)
+	}
+	want := "Layout of " + img + ", 64M:\n" +
+		"before |." + strings.Repeat("1", 16) + strings.Repeat(".", 47) + "|\n" +
+		"after  |" + strings.Repeat(".", 20) + strings.Repeat("2", 24) + strings.Repeat(".", 20) + "|\n" +
+		"        1 data  2 data\n"
+	if out.String() != want {
+		t.Errorf("writeLayout() =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	// a partition too small to show is still drawn, and one past 35 as #
+	bar := layoutBar([]resizer.PartitionGeometry{{Number: 1, Start: 0, Size: 1}, {Number: 40, Start: 1 << 30, Size: 1 << 30}}, 2<<30)
+	if want := "1" + strings.Repeat(".", 31) + strings.Repeat("#", 32); bar != want {
+		t.Errorf("layoutBar() = %q, want %q", bar, want)
+	}
+
+	out.Reset()
+	if err := writeLayout(&out, filepath.Join(t.TempDir(), "missing.img"), nil); err != nil || out.Len() != 0 {
+		t.Errorf("writeLayout() of a missing disk = %q, %v, want nothing", out.String(), err)
+	}
+}
+
+// Partition flags complete identifier types, then the partitions of the disk
+// given, and growpart the partition numbers of its disk
+func TestCompletePartitions(t *testing.T) {
+	img := makeMinimalGPTImage(t)
+	cmd := rootCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{cobra.ShellCompRequestCmd, "plan", img, "--grow-partition", "label:"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("completion error: %v", err)
+	}
+	if want := "label:data\tpartition 1, 16M of " + img + "\n"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("completion of label: = %q, want %q first", out.String(), want)
+	}
+
+	f := &resizeFlags{}
+	completions, directive := f.completePartitions(nil, []string{img}, "fs")
+	if want := []string{"fslabel:", "fsuuid:"}; !reflect.DeepEqual(completions, want) || directive&cobra.ShellCompDirectiveNoSpace == 0 {
+		t.Errorf("completePartitions(fs) = %v, %v, want %v without a space", completions, directive, want)
+	}
+	if completions, _ := f.completePartitions(nil, []string{img}, "label:x"); len(completions) != 0 {
+		t.Errorf("completePartitions(label:x) = %v, want none", completions)
+	}
+	if completions, _ := completeGrowpart(nil, []string{img}, ""); !reflect.DeepEqual(completions, []string{"1\tpartition 1, 16M"}) {
+		t.Errorf("completeGrowpart() = %v, want partition 1", completions)
+	}
+}
+
+// TestReadDigests reads back the digests hash --output json writes, as
+// --compare does.
+func TestReadDigests(t *testing.T) {
+	digests := &resizer.DiskDigests{Disk: "disk.img", Partitions: []resizer.PartitionDigest{
+		{Number: 1, Label: "root", PartUUID: "5f7a7b3e-0000-4000-8000-000000000001", Start: 1 << 20, Size: 8 << 20, SHA256: strings.Repeat("ab", 32)},
+	}}
+	var out bytes.Buffer
+	if err := writeDigests(&out, outputJSON, digests); err != nil {
+		t.Fatalf("writeDigests() error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "before.json")
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readDigests(path)
+	if err != nil {
+		t.Fatalf("readDigests() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, digests) {
+		t.Errorf("readDigests() = %+v, want %+v", got, digests)
+	}
+	out.Reset()
+	if err := writeDigests(&out, outputText, digests); err != nil {
+		t.Fatalf("writeDigests() error: %v", err)
+	}
+	if !strings.Contains(out.String(), "1       root   8M    "+strings.Repeat("ab", 32)) {
+		t.Errorf("writeDigests() = %q, want a row for partition 1", out.String())
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// runDisks resizes the partitions on every disk they are found on, for
+// --multi-disk, writing the result of each as output says, and exiting should
+// any fail.
+func runDisks(ctx context.Context, shrinkPartitions []resizer.PartitionIdentifier, growPartitions []resizer.PartitionChange, opts resizer.Options, output string) {
+	res, err := resizer.RunDisksContext(ctx, shrinkPartitions, growPartitions, opts)
+	if werr := writeResult(os.Stdout, output, res); werr != nil {
+		log.Printf("Cannot write result: %v", werr)
+	}
+	if res != nil && opts.JournalPath != "" {
+		var resumes []string
+		for _, r := range res.Disks {
+			resumes = append(resumes, fmt.Sprintf("resizer resume --journal %s", resizer.DiskJournalPath(opts.JournalPath, r.Disk)))
+		}
+		exitIfInterrupted(err, "Finish the resize of each disk with: "+strings.Join(resumes, "; "))
+	}
+	exitIfInterrupted(err, "Run the same command again to finish the resize")
+	var results []*resizer.Result
+	if res != nil {
+		results = res.Disks
+	}
+	exitIfResizeFailed(err, results...)
+	exitIfNothingResized(results...)
+}
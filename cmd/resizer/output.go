@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// outputText, outputJSON and outputYAML are the values of --output.
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// checkOutput returns an error if output is not a known value of --output.
+func checkOutput(output string) error {
+	if output != outputText && output != outputJSON && output != outputYAML {
+		return fmt.Errorf("unknown output %q, must be %s, %s or %s", output, outputText, outputJSON, outputYAML)
+	}
+	return nil
+}
+
+// writeData writes v to w as output says: as indented JSON with outputJSON,
+// or as YAML with outputYAML, with the same fields, in the same order, as the
+// JSON.
+func writeData(w io.Writer, output string, v any) error {
+	if output == outputYAML {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		// JSON is YAML, so the JSON is read as YAML, keeping its fields in
+		// order, and written out again in block style
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		blockStyle(&node)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// blockStyle clears the style of n and all it holds, so that it is written in
+// block style, quoting only the strings that need it.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// writeResult writes res, a *resizer.Result or, for several disks, a
+// *resizer.MultiResult, to w as output says: as indented JSON with outputJSON,
+// YAML with outputYAML, and with outputText, where the log says what was
+// done, only for a dry run, as the diff and layout of the resize planned.
+func writeResult[R resizer.Result | resizer.MultiResult](w io.Writer, output string, res *R) error {
+	if res == nil {
+		return nil
+	}
+	if output != outputText {
+		return writeData(w, output, res)
+	}
+	results := []*resizer.Result{}
+	switch r := any(res).(type) {
+	case *resizer.Result:
+		results = append(results, r)
+	case *resizer.MultiResult:
+		results = r.Disks
+	}
+	for _, r := range results {
+		if !r.DryRun {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "Dry run of %s:\n", r.Disk); err != nil {
+			return err
+		}
+		if err := writeDiff(w, r.Partitions); err != nil {
+			return err
+		}
+		if err := writeLayout(w, r.Disk, r.Partitions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePlanDiff writes what plan does to each partition to w, as a diff of
+// their geometry: each partition before, on a - line, and after, on a + line,
+// marked should it be moved to a new location or retyped, followed by the layout of the
+// disk before and after, as writeLayout draws it.
+func writePlanDiff(w io.Writer, plan *resizer.Plan) error {
+	if _, err := fmt.Fprintf(w, "Plan for %s, GUID %s:\n", plan.Disk, orNone(plan.DiskGUID)); err != nil {
+		return err
+	}
+	if err := writeDiff(w, plan.Partitions); err != nil {
+		return err
+	}
+	return writeLayout(w, plan.Disk, plan.Partitions)
+}
+
+// writeDiff writes the resize of partitions to w as writePlanDiff does,
+// without a header.
+func writeDiff(w io.Writer, partitions []resizer.PartitionResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, " \tNUMBER\tLABEL\tSTART\tEND\tSIZE")
+	for _, p := range partitions {
+		var marks []string
+		if p.Moved {
+			marks = append(marks, "moved")
+		}
+		if p.Type != "" {
+			marks = append(marks, "type "+p.Type)
+		}
+		_, _ = fmt.Fprintf(tw, "-\t%d\t%s\t%d\t%d\t%s\n", p.Original.Number, orNone(p.Label), p.Original.Start, p.Original.Start+p.Original.Size-1, formatSize(p.Original.Size))
+		_, _ = fmt.Fprintf(tw, "+\t%d\t%s\t%d\t%d\t%s\t%s\n", p.Final.Number, orNone(p.Label), p.Final.Start, p.Final.Start+p.Final.Size-1, formatSize(p.Final.Size), strings.Join(marks, ", "))
+	}
+	return tw.Flush()
+}
+
+// layoutWidth is how many characters wide writeLayout draws a disk.
+const layoutWidth = 64
+
+// layoutChars are the characters writeLayout draws partitions 1 to 35 with,
+// by number; any other is drawn with #.
+const layoutChars = "123456789abcdefghijklmnopqrstuvwxyz"
+
+// writeLayout draws disk to w as it is, and as it is to be once partitions,
+// those it has now, are resized: a bar for each, in proportion to the size of
+// the disk, with each partition in the character of its number and free
+// space as dots, and which partition each character is below. Nothing is
+// drawn should disk not be readable.
+func writeLayout(w io.Writer, disk string, partitions []resizer.PartitionResult) error {
+	disks, err := resizer.ListDisks(disk)
+	if err != nil || len(disks) != 1 || disks[0].Size <= 0 {
+		return nil
+	}
+	info := disks[0]
+	labels := make(map[int]string)
+	var before, after []resizer.PartitionGeometry
+	resized := make(map[int]bool)
+	for _, p := range partitions {
+		resized[p.Original.Number] = true
+		after = append(after, p.Final)
+		labels[p.Final.Number] = p.Label
+	}
+	for _, p := range info.Partitions {
+		g := resizer.PartitionGeometry{Number: p.Number, Start: p.Start, Size: p.Size}
+		before = append(before, g)
+		if _, ok := labels[p.Number]; !ok {
+			labels[p.Number] = p.Label
+		}
+		if !resized[p.Number] {
+			after = append(after, g)
+		}
+	}
+	var legend []string
+	for _, n := range slices.Sorted(maps.Keys(labels)) {
+		legend = append(legend, fmt.Sprintf("%c %s", layoutChar(n), orNone(labels[n])))
+	}
+	_, err = fmt.Fprintf(w, "Layout of %s, %s:\nbefore |%s|\nafter  |%s|\n        %s\n", info.Path, formatSize(info.Size), layoutBar(before, info.Size), layoutBar(after, info.Size), strings.Join(legend, "  "))
+	return err
+}
+
+// layoutBar returns partitions drawn as a bar layoutWidth characters wide, in
+// proportion to size, that of their disk; a partition too small to show is
+// drawn one character wide.
+func layoutBar(partitions []resizer.PartitionGeometry, size int64) string {
+	bar := []byte(strings.Repeat(".", layoutWidth))
+	for _, p := range partitions {
+		start := int(p.Start * layoutWidth / size)
+		end := int(((p.Start+p.Size)*layoutWidth + size - 1) / size)
+		end = min(max(end, start+1), layoutWidth)
+		for i := start; i < end; i++ {
+			bar[i] = layoutChar(p.Number)
+		}
+	}
+	return string(bar)
+}
+
+// layoutChar returns the character writeLayout draws partition number with.
+func layoutChar(number int) byte {
+	if number < 1 || number > len(layoutChars) {
+		return '#'
+	}
+	return layoutChars[number-1]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// TestPlanApply builds the resizer, plans a resize of a minimal GPT image to a
+// file, and applies it as a dry run, then again once a partition has been
+// added to the image, which must be refused as the plan is then stale.
+func TestPlanApply(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "resizer")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build resizer: %v\n%s", err, out)
+	}
+	img := makeMinimalGPTImage(t)
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+
+	out, err := exec.Command(bin, "plan", img, "--grow-partition", "label:data:+4M", "--snapshot-dir", "", "--audit-log", "", "--plan-file", planPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("resizer plan: %v\n%s", err, out)
+	}
+	plan, err := resizer.ReadPlan(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.DiskGUID == "" || plan.TableChecksum == "" || len(plan.Partitions) != 1 || plan.Partitions[0].Final.Size != 20*resizer.MB {
+		t.Fatalf("resizer plan saved %+v, want partition 1 grown to 20 MB, pinned to the disk", plan)
+	}
+
+	out, err = exec.Command(bin, "apply", planPath, "--dry-run", "--output", "json").Output()
+	if err != nil {
+		t.Fatalf("resizer apply: %v", err)
+	}
+	var res resizer.Result
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("resizer apply printed %q: %v", out, err)
+	}
+	if !res.DryRun || res.Estimate == nil {
+		t.Errorf("resizer apply printed %+v, want a dry run with an estimate", res)
+	}
+	if _, err := os.Stat(planPath); err != nil {
+		t.Errorf("resizer apply removed the plan: %v", err)
+	}
+
+	// a partition added since the plan was made
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(file.New(f, false), diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gptTable := table.(*gpt.Table)
+	gptTable.Partitions = append(gptTable.Partitions, &gpt.Partition{Index: 2, Start: 50 * 2048, Size: 4 * resizer.MB, Type: gpt.LinuxFilesystem, Name: "other"})
+	if err := d.Partition(gptTable); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	out, err = exec.Command(bin, "apply", planPath, "--dry-run").CombinedOutput()
+	if err == nil {
+		t.Fatalf("resizer apply of a stale plan succeeded:\n%s", out)
+	}
+	if !strings.Contains(string(out), "Plan refused, nothing was changed") || !strings.Contains(string(out), "plan no longer matches") {
+		t.Errorf("resizer apply of a stale plan failed with:\n%s\nwant it refused as stale", out)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+const (
+	// progressWidth is the width of the bar itself, in characters.
+	progressWidth = 30
+	// progressInterval is how often the bar is redrawn at most.
+	progressInterval = 200 * time.Millisecond
+)
+
+// progressBar is a resizer.ProgressReporter that draws a bar for each
+// partition copied on w, a terminal, with the throughput of the copy and the
+// estimated time remaining. Partitions copied concurrently, see
+// --copy-workers, are drawn as one bar for them all, as a
+// resizer.TotalProgressReporter. It is also the io.Writer the log is written
+// through, that a log line clears the bar before it and redraws it after.
+type progressBar struct {
+	// mu guards w and line, that a log line written from another
+	// goroutine does not run into the bar
+	mu    sync.Mutex
+	w     io.Writer
+	line  string
+	now   func() time.Time
+	label string
+	// partition is the partition being drawn, and copies how many there
+	// are to copy
+	partition int
+	copies    int
+	// concurrent is set once another partition reports bytes copied while
+	// one is drawn, and cleared once all are copied
+	concurrent bool
+	// started is when the copy being drawn started, and drawn when its bar
+	// was last drawn
+	started time.Time
+	drawn   time.Time
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w, now: time.Now}
+}
+
+// newProgress returns how to report the progress of a resize: not at all with
+// noProgress, logged with --log-format json, and otherwise as a bar on stderr,
+// should it be a terminal, which the log is then written through.
+func newProgress(noProgress bool, logFormat string) resizer.ProgressReporter {
+	switch {
+	case noProgress:
+		return nil
+	case logFormat == logFormatJSON:
+		return newProgressLog(slog.Default())
+	case !isTerminal(os.Stderr):
+		return nil
+	default:
+		bar := newProgressBar(os.Stderr)
+		log.SetOutput(bar)
+		return bar
+	}
+}
+
+func (p *progressBar) PhaseStarted(string)         {}
+func (p *progressBar) PhaseFinished(string, error) {}
+
+func (p *progressBar) CopyStarted(partition, n, total int) {
+	p.copies = total
+	if p.concurrent {
+		return
+	}
+	p.partition = partition
+	p.label = fmt.Sprintf("partition %d (%d/%d)", partition, n, total)
+	p.started = p.now()
+	p.drawn = time.Time{}
+}
+
+func (p *progressBar) BytesCopied(partition int, copied, total int64) {
+	if partition != p.partition && !p.concurrent {
+		p.concurrent = true
+		p.label = fmt.Sprintf("%d partitions", p.copies)
+	}
+	if !p.concurrent {
+		p.draw(copied, total)
+	}
+}
+
+func (p *progressBar) TotalBytesCopied(copied, total int64) {
+	if !p.concurrent {
+		return
+	}
+	p.draw(copied, total)
+	if copied >= total {
+		p.concurrent = false
+	}
+}
+
+// draw draws the bar for copied of total bytes, at most every
+// progressInterval, and once they are all copied, ending its line.
+func (p *progressBar) draw(copied, total int64) {
+	now := p.now()
+	done := copied >= total
+	if !done && now.Sub(p.drawn) < progressInterval {
+		return
+	}
+	p.drawn = now
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// redraw over the previous bar, clearing what is left of it
+	p.line = fmt.Sprintf("\r%s\033[K", renderProgress(p.label, copied, total, now.Sub(p.started)))
+	_, _ = io.WriteString(p.w, p.line)
+	if done {
+		_, _ = fmt.Fprintln(p.w)
+		p.line = ""
+	}
+}
+
+// Write writes b, a log line, to the terminal, clearing the bar drawn, if
+// any, before it and redrawing it after, on a line of its own.
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.line != "" {
+		_, _ = io.WriteString(p.w, "\r\033[K")
+	}
+	n, err := p.w.Write(b)
+	if p.line != "" {
+		_, _ = io.WriteString(p.w, p.line)
+	}
+	return n, err
+}
+
+// renderProgress renders a progress bar for copied of total bytes, copied in
+// elapsed, with the throughput so far and the time remaining at that rate.
+func renderProgress(label string, copied, total int64, elapsed time.Duration) string {
+	fraction := 1.0
+	if total > 0 {
+		fraction = float64(copied) / float64(total)
+	}
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	rate, eta := "--- MB/s", "ETA --"
+	if seconds := elapsed.Seconds(); seconds > 0 && copied > 0 {
+		bytesPerSecond := float64(copied) / seconds
+		rate = fmt.Sprintf("%.1f MB/s", bytesPerSecond/(1024*1024))
+		remaining := time.Duration(float64(total-copied) / bytesPerSecond * float64(time.Second))
+		eta = "ETA " + remaining.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s [%s] %3d%% %d/%d MB %s %s", label, bar, int(fraction*100), copied/(1024*1024), total/(1024*1024), rate, eta)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// changeRequest is a change request document, which apply reads from stdin
+// in place of a plan: the disk, and the partitions to grow and shrink on it,
+// as --grow-partition and --shrink-partition take them, with the options of
+// the resize, as a plan has them.
+type changeRequest struct {
+	Disk             string          `json:"disk"`
+	GrowPartitions   []string        `json:"grow-partition"`
+	ShrinkPartitions []string        `json:"shrink-partition"`
+	Options          resizer.Options `json:"options"`
+}
+
+// readApplyInput reads from r, both JSON, either a plan, as the plan command
+// saves it, or a change request document, told apart by its grow-partition,
+// and returns the plan to apply: for a change request, the one planned from
+// it, whose diff it writes to diffOut.
+func readApplyInput(r io.Reader, diffOut io.Writer) (*resizer.Plan, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("parse input: %v", err)
+	}
+	if _, ok := fields["grow-partition"]; !ok {
+		return resizer.DecodePlan(bytes.NewReader(data))
+	}
+	var req changeRequest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// a misspelt field is an error rather than an option left unset
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("parse change request: %v", err)
+	}
+	var (
+		shrinks []resizer.PartitionIdentifier
+		grows   []resizer.PartitionChange
+	)
+	for _, sp := range req.ShrinkPartitions {
+		parsed, err := parseShrinkPartition(sp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shrink-partition value '%s': %v", sp, err)
+		}
+		shrinks = append(shrinks, parsed)
+	}
+	for _, gp := range req.GrowPartitions {
+		parsed, err := parsePartitionChange(gp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grow-partition value '%s': %v", gp, err)
+		}
+		grows = append(grows, parsed)
+	}
+	if len(grows) == 0 {
+		return nil, fmt.Errorf("change request grows no partition")
+	}
+	plan, err := resizer.NewPlan(req.Disk, shrinks, grows, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePlanDiff(diffOut, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// applyInput applies the plan, or change request document, read from stdin,
+// as applyPlanFile does the plan saved at a path, without asking before the
+// resize, stdin not being there to answer.
+func applyInput(ctx context.Context, dryRun bool, progress resizer.ProgressReporter) (*resizer.Result, error) {
+	plan, err := readApplyInput(os.Stdin, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	plan.Options.Progress = progress
+	return plan.ApplyContext(ctx, dryRun)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+func statusCmd() *cobra.Command {
+	var (
+		journalPath string
+		output      string
+	)
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show how far a resize got, and what to do about it",
+		Long: `Show how far a resize got, as recorded in the journal kept with --journal, e.g. after a power loss:
+  the partitions it resizes, the phases it completed and those that remain, and whether to run
+  "resizer resume" or "resizer rollback". Rollback is recommended while the original partitions are
+  still in the partition table, and resume once the new partitions have replaced them. Nothing is
+  changed.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			status, err := resizer.JournalStatus(journalPath)
+			if errors.Is(err, fs.ErrNotExist) {
+				fmt.Printf("No resize recorded in %s\n", journalPath)
+				return
+			}
+			if err != nil {
+				fatalf("Cannot read journal: %v", err)
+			}
+			if err := writeStatus(os.Stdout, output, status); err != nil {
+				fatalf("Cannot write status: %v", err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&journalPath, "journal", resizer.DefaultJournalPath, "Journal of the resize")
+	cmd.Flags().StringVar(&output, "output", outputText, "How to print the status: text, or json or yaml, for automation to act on")
+	return cmd
+}
+
+// writeStatus writes status to w as output says: as indented JSON with
+// outputJSON, YAML with outputYAML, or as a summary with the command to run with outputText.
+func writeStatus(w io.Writer, output string, status *resizer.ResizeStatus) error {
+	if output != outputText {
+		return writeData(w, output, status)
+	}
+	state := "unfinished"
+	if status.Finished {
+		state = "finished"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Resize of %s, %s, as recorded in %s\n", status.Disk, state, status.Journal)
+	for _, p := range status.Partitions {
+		fmt.Fprintf(&b, "  partition %d (%s): %s at %d, to be partition %d, %s at %d\n", p.Original.Number, p.Label, formatSize(p.Original.Size), p.Original.Start, p.Final.Number, formatSize(p.Final.Size), p.Final.Start)
+		if copied := status.Copied[p.Original.Number]; copied > 0 {
+			fmt.Fprintf(&b, "    %s of it copied, as of the last checkpoint, to resume from\n", formatSize(copied))
+		}
+	}
+	fmt.Fprintf(&b, "Completed: %s\n", orNone(strings.Join(status.Completed, ", ")))
+	fmt.Fprintf(&b, "Remaining: %s\n", orNone(strings.Join(status.Remaining, ", ")))
+	switch status.Recommended {
+	case resizer.ActionNone:
+		fmt.Fprintf(&b, "Nothing to do: %s\n", status.Reason)
+	default:
+		fmt.Fprintf(&b, "Recommended: resizer %s --journal %s\n  because %s\n", status.Recommended, status.Journal, status.Reason)
+	}
+	if !status.CanRollback {
+		fmt.Fprintln(&b, "The resize cannot be rolled back, as it has grown a partition in place")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	resizer "github.com/diskfs/partitionresizer"
+)
+
+// toolPathRunner is a resizer.ExecRunner that runs each external tool it has
+// a path for, given with --tool, from that path, rather than finding it in the
+// PATH, and any other as resizer.LocalExecRunner does.
+type toolPathRunner map[string]string
+
+func (r toolPathRunner) Run(ctx context.Context, cmd string, args []string, timeout time.Duration, stdout, stderr io.Writer) error {
+	if path, ok := r[cmd]; ok {
+		cmd = path
+	}
+	return resizer.LocalExecRunner{}.Run(ctx, cmd, args, timeout, stdout, stderr)
+}
+
+// LookPath returns the path cmd is run from, checking that it is executable,
+// so that a dry run finds a tool given with --tool that is missing.
+func (r toolPathRunner) LookPath(cmd string) (string, error) {
+	if path, ok := r[cmd]; ok {
+		cmd = path
+	}
+	return exec.LookPath(cmd)
+}
+
+// parseTool parses a --tool value, name=path, e.g.
+// e2fsck=/usr/local/sbin/e2fsck, the path being absolute.
+func parseTool(s string) (string, string, error) {
+	name, path, ok := strings.Cut(s, "=")
+	switch {
+	case !ok || name == "":
+		return "", "", fmt.Errorf("must be name=path")
+	case !filepath.IsAbs(path):
+		return "", "", fmt.Errorf("tool path %s is not absolute", path)
+	}
+	return name, path, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	resizer "github.com/diskfs/partitionresizer"
+	"github.com/spf13/cobra"
+)
+
+func validateCmd() *cobra.Command {
+	var (
+		planPath    string
+		journalPath string
+		output      string
+	)
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check that a disk is as a resize was to leave it",
+		Long: `Check that a disk is as a resize, saved as a plan with --plan or recorded in a journal with --journal,
+  was to leave it, after it has run or been interrupted: each partition resized is at its final number,
+  start and size, with its label, no temporary copy or moved original remains, and each resized
+  filesystem checks cleanly, read-only. A mounted filesystem cannot be checked, and is skipped. With
+  --journal, a journal that has been moved aside once its resize completed is found too, and an
+  unfinished resize is a problem. Nothing is changed. Exits non-zero should any problem be found.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkOutput(output); err != nil {
+				exitf(exitInvalid, "Invalid output value: %v", err)
+			}
+			if (planPath == "") == (journalPath == "") {
+				exitf(exitInvalid, "Give the resize to validate with either --plan or --journal")
+			}
+			var (
+				report *resizer.ValidationReport
+				err    error
+			)
+			if planPath != "" {
+				plan, perr := resizer.ReadPlan(planPath)
+				if perr != nil {
+					fatalf("Cannot read plan: %v", perr)
+				}
+				report, err = resizer.ValidateResize(cmd.Context(), plan.Disk, plan.Partitions, resizer.Options{})
+			} else {
+				report, err = resizer.ValidateJournal(cmd.Context(), journalPath, resizer.Options{})
+			}
+			if err != nil {
+				fatalf("Validation failed: %v", err)
+			}
+			if err := writeReport(os.Stdout, output, report); err != nil {
+				log.Printf("Cannot write report: %v", err)
+			}
+			if !report.Valid {
+				fatalf("Disk %s is not as the resize was to leave it, problems found: %d", report.Disk, len(report.Problems))
+			}
+		},
+	}
+	cmd.Flags().StringVar(&planPath, "plan", "", "Plan of the resize, as saved by the plan command")
+	cmd.Flags().StringVar(&journalPath, "journal", "", "Journal of the resize, as kept with --journal (e.g. "+resizer.DefaultJournalPath+")")
+	cmd.Flags().StringVar(&output, "output", outputText, "How to print the report: text, each problem and filesystem check, or json or yaml, for automation to act on")
+	return cmd
+}
+
+// writeReport writes report to w as output says: as indented JSON with
+// outputJSON, YAML with outputYAML, or as a line for each problem and filesystem check with
+// outputText.
+func writeReport(w io.Writer, output string, report *resizer.ValidationReport) error {
+	if output != outputText {
+		return writeData(w, output, report)
+	}
+	for _, p := range report.Problems {
+		if _, err := fmt.Fprintf(w, "problem: %s\n", p); err != nil {
+			return err
+		}
+	}
+	for _, c := range report.Checks {
+		line := fmt.Sprintf("check: partition %d %s", c.Partition, c.Outcome)
+		if c.Filesystem != "" {
+			line += " (" + c.Filesystem + ")"
+		}
+		if c.Detail != "" {
+			line += ": " + c.Detail
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	if report.Valid {
+		_, err := fmt.Fprintf(w, "%s is as the resize was to leave it\n", report.Disk)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// confirm asks opts.Confirm to confirm the step description says, and returns
+// an error wrapping ErrNotConfirmed if it declines.
+func (o Options) confirm(description string) error {
+	if o.Confirm == nil || o.Confirm(description) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", description, ErrNotConfirmed)
+}
+
+// describeResize describes resizes of disk as a whole, for confirming the
+// resize before anything is changed.
+func describeResize(disk string, resizes []partitionResizeTarget) string {
+	return fmt.Sprintf("resize %s of %s as planned", describePartitions(resizes), disk)
+}
+
+// describePrepare describes the partition table write that stages resizes of
+// disk, "" if there is none: the partitions shrunk, and those copied to a new
+// location, each given a partition for its copy.
+func describePrepare(disk string, resizes []partitionResizeTarget) string {
+	var shrunk, relocated []partitionResizeTarget
+	for _, r := range resizes {
+		switch {
+		case r.original.start != r.target.start:
+			relocated = append(relocated, r)
+		case r.target.size < r.original.size:
+			shrunk = append(shrunk, r)
+		}
+	}
+	var steps []string
+	if len(relocated) > 0 {
+		steps = append(steps, "adding partitions for the copies of "+describePartitions(relocated))
+	}
+	if len(shrunk) > 0 {
+		steps = append(steps, "shrinking "+describePartitions(shrunk))
+	}
+	if len(steps) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("write the partition table of %s, %s", disk, strings.Join(steps, " and "))
+}
+
+// describeCommit describes the partition table write that commits resizes of
+// disk: the originals removed for their copies, the partitions grown in
+// place, the copies made legacy BIOS bootable or not, see
+// Options.LegacyBootable, and the originals wiped once removed, see
+// Options.WipeRemoved.
+func describeCommit(disk string, resizes []partitionResizeTarget) string {
+	var relocated, grown, bootable, notBootable, wiped []partitionResizeTarget
+	for _, r := range resizes {
+		switch {
+		case r.original.start != r.target.start:
+			relocated = append(relocated, r)
+			if r.setAttributes&gptLegacyBIOSBootable != 0 {
+				bootable = append(bootable, r)
+			}
+			if r.clearAttributes&gptLegacyBIOSBootable != 0 {
+				notBootable = append(notBootable, r)
+			}
+			if r.wipe != "" {
+				wiped = append(wiped, r)
+			}
+		case r.target.size > r.original.size:
+			grown = append(grown, r)
+		}
+	}
+	var steps []string
+	if len(relocated) > 0 {
+		steps = append(steps, "replacing "+describePartitions(relocated)+" with "+plural(len(relocated), "its copy", "their copies"))
+	}
+	if len(grown) > 0 {
+		steps = append(steps, "growing "+describePartitions(grown)+" in place")
+	}
+	if len(bootable) > 0 {
+		steps = append(steps, "making "+plural(len(bootable), "the copy of ", "the copies of ")+describePartitions(bootable)+" legacy BIOS bootable")
+	}
+	if len(notBootable) > 0 {
+		steps = append(steps, "making "+plural(len(notBootable), "the copy of ", "the copies of ")+describePartitions(notBootable)+" not legacy BIOS bootable")
+	}
+	if len(wiped) > 0 {
+		steps = append(steps, "wiping the data of "+describePartitions(wiped)+" once removed")
+	}
+	if len(steps) == 0 {
+		return fmt.Sprintf("write the partition table of %s", disk)
+	}
+	return fmt.Sprintf("write the partition table of %s, %s", disk, strings.Join(steps, " and "))
+}
+
+// describePartitions lists the original partitions of resizes, e.g.
+// "partition 1 (data)" or "partitions 1 (data), 3 (home)".
+func describePartitions(resizes []partitionResizeTarget) string {
+	var names []string
+	for _, r := range resizes {
+		names = append(names, fmt.Sprintf("%d (%s)", r.original.number, r.original.label))
+	}
+	return plural(len(names), "partition ", "partitions ") + strings.Join(names, ", ")
+}
+
+// plural returns one if n is 1, and many otherwise.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
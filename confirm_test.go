@@ -0,0 +1,119 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestResizeConfirm runs a resize that is confirmed, one declined before it
+// stages the copy, and one declined at the cutover, which must remove the
+// copy again.
+func TestResizeConfirm(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	tests := []struct {
+		name      string
+		decline   int
+		wantStart int64
+	}{
+		{"confirmed", 0, target.start},
+		{"declined prepare", 1, original.start},
+		{"declined cutover", 2, original.start},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+				{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+			})
+			backend, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = backend.Close() }()
+			d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var asked []string
+			opts := Options{Confirm: func(description string) bool {
+				asked = append(asked, description)
+				return len(asked) != tt.decline
+			}}
+			err = resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, opts, nil, nil)
+			if declined := errors.Is(err, ErrNotConfirmed); declined != (tt.decline > 0) || (tt.decline == 0 && err != nil) {
+				t.Fatalf("resize() error = %v, want declined %v", err, tt.decline > 0)
+			}
+			want := []string{
+				fmt.Sprintf("write the partition table of %s, adding partitions for the copies of partition 1 (data)", diskPath),
+				fmt.Sprintf("write the partition table of %s, replacing partition 1 (data) with its copy", diskPath),
+			}
+			if tt.decline > 0 {
+				want = want[:tt.decline]
+			}
+			if fmt.Sprint(asked) != fmt.Sprint(want) {
+				t.Errorf("asked to confirm %q, want %q", asked, want)
+			}
+
+			table, err := readGPT(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var starts []int64
+			for _, p := range table.Partitions {
+				if p.Type != gpt.Unused {
+					starts = append(starts, p.GetStart())
+				}
+			}
+			if len(starts) != 1 || starts[0] != tt.wantStart {
+				t.Errorf("partitions start at %v, want only %d", starts, tt.wantStart)
+			}
+		})
+	}
+}
+
+// TestRunConfirm declines a resize as planned, which must stop it before
+// anything is checked or changed.
+func TestRunConfirm(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+	})
+	before, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var asked []string
+	opts := Options{Confirm: func(description string) bool {
+		asked = append(asked, description)
+		return false
+	}}
+	res, err := Run(diskPath, nil, []PartitionChange{NewPartitionChange(IdentifierByLabel, "data", 16*MB)}, opts)
+	if !errors.Is(err, ErrNotConfirmed) {
+		t.Fatalf("Run() error = %v, want ErrNotConfirmed", err)
+	}
+	want := []string{fmt.Sprintf("resize partition 1 (data) of %s as planned", diskPath)}
+	if fmt.Sprint(asked) != fmt.Sprint(want) {
+		t.Errorf("asked to confirm %q, want %q", asked, want)
+	}
+	if res == nil || len(res.Partitions) != 1 {
+		t.Errorf("Run() result = %+v, want the resize planned", res)
+	}
+	after, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Run() changed the disk once the resize was declined")
+	}
+}
@@ -2,6 +2,7 @@ package partitionresizer
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/diskfs/go-diskfs/partition"
 )
@@ -13,8 +14,10 @@ func partitionIdentifiersToData(disk partition.Table, diskPartitionData []partit
 	// We can get that from diskPartitionData
 	// in the end, we have the table, so we just want to know the partition indexes
 	namePartMapping := make(map[string]partitionData)
+	numberPartMapping := make(map[int]partitionData)
 	for _, pd := range diskPartitionData {
 		namePartMapping[pd.name] = pd
+		numberPartMapping[pd.number] = pd
 	}
 	parts := disk.GetPartitions()
 	var data []partitionData
@@ -28,12 +31,29 @@ func partitionIdentifiersToData(disk partition.Table, diskPartitionData []partit
 				if ok && mapped.number == p.GetIndex() {
 					match = true
 				}
+			case IdentifierByDevice:
+				mapped, ok := namePartMapping[deviceName(pi.Value())]
+				if ok && mapped.number == p.GetIndex() {
+					match = true
+				}
 			case IdentifierByLabel:
 				if p.Label() == pi.Value() {
 					match = true
 				}
-			case IdentifierByUUID:
-				if p.UUID() == pi.Value() {
+			case IdentifierByPartUUID, IdentifierByUUID:
+				if strings.EqualFold(p.UUID(), pi.Value()) {
+					match = true
+				}
+			case IdentifierByFSUUID:
+				// the table does not know filesystems, so look to what
+				// discovery read of the partition
+				mapped, ok := numberPartMapping[p.GetIndex()]
+				if ok && mapped.fsUUID != "" && strings.EqualFold(mapped.fsUUID, pi.Value()) {
+					match = true
+				}
+			case IdentifierByFSLabel:
+				mapped, ok := numberPartMapping[p.GetIndex()]
+				if ok && mapped.fsLabel != "" && mapped.fsLabel == pi.Value() {
 					match = true
 				}
 			}
@@ -51,7 +71,7 @@ func partitionIdentifiersToData(disk partition.Table, diskPartitionData []partit
 		}
 		if !found {
 			// keep original change if not found
-			return nil, fmt.Errorf("could not find partition for identifier: %s=%s", pi.By(), pi.Value())
+			return nil, fmt.Errorf("could not find partition for identifier: %s=%s%s", pi.By(), pi.Value(), identifierHint(diskPartitionData, pi))
 		}
 	}
 	return data, nil
@@ -70,13 +90,48 @@ func partitionChangesToResizeTarget(disk partition.Table, diskPartitionData []pa
 	if len(updatedData) != len(partitionChanges) {
 		return nil, fmt.Errorf("mismatched partition data and changes lengths")
 	}
-	var res []partitionResizeTarget
+	var (
+		res          []partitionResizeTarget
+		haveMax      bool
+		haveWeighted bool
+		weight       int64
+	)
 	for i, pc := range partitionChanges {
+		size := pc.Size()
+		weight = 0
+		switch pc.Mode() {
+		case SizeRelative:
+			// a relative change is resolved against the partition's current size
+			if size <= 0 {
+				return nil, fmt.Errorf("partition %s=%s: relative grow size %d must be positive", pc.By(), pc.Value(), size)
+			}
+			size += updatedData[i].size
+		case SizeMax:
+			// resolved by calculateResizes once the other grows are placed
+			if haveMax || haveWeighted {
+				return nil, fmt.Errorf("partition %s=%s: only one partition may be grown to the maximum size, and not alongside weighted partitions", pc.By(), pc.Value())
+			}
+			haveMax = true
+			size = 0
+		case SizeWeight:
+			// resolved by calculateResizes once the other grows are placed
+			if size <= 0 {
+				return nil, fmt.Errorf("partition %s=%s: weight %d must be positive", pc.By(), pc.Value(), size)
+			}
+			if haveMax {
+				return nil, fmt.Errorf("partition %s=%s: weighted partitions cannot be combined with a maximum size partition", pc.By(), pc.Value())
+			}
+			haveWeighted = true
+			weight = size
+			size = 0
+		}
 		res = append(res, partitionResizeTarget{
 			original: updatedData[i],
 			target: partitionData{
-				size: pc.Size(),
+				size: size,
 			},
+			mode:   pc.Mode(),
+			weight: weight,
 		})
 	}
 	return res, nil
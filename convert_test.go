@@ -75,3 +75,88 @@ func TestPartitionChangesToResizeTarget_Mismatch(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+// TestPartitionChangesToResizeTarget_Relative verifies that a relative change is
+// resolved against the partition's current size.
+func TestPartitionChangesToResizeTarget_Relative(t *testing.T) {
+	gp := &gpt.Partition{Start: 100, Size: 50 * 512, Name: "p1", GUID: "uuid1"}
+	tbl := &fakeTable{parts: []part.Partition{gp}}
+	t.Run("grow", func(t *testing.T) {
+		pc := NewRelativePartitionChange(IdentifierByLabel, "p1", 10*512)
+		got, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{pc})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got[0].target.size != 60*512 {
+			t.Errorf("target size = %d, want %d", got[0].target.size, 60*512)
+		}
+	})
+	t.Run("non-positive", func(t *testing.T) {
+		pc := NewRelativePartitionChange(IdentifierByLabel, "p1", -10*512)
+		if _, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{pc}); err == nil {
+			t.Fatal("expected error for a negative grow delta, got nil")
+		}
+	})
+}
+
+// TestPartitionChangesToResizeTarget_Max verifies that at most one partition may
+// be grown to the maximum size.
+func TestPartitionChangesToResizeTarget_Max(t *testing.T) {
+	tbl := &fakeTable{parts: []part.Partition{
+		&gpt.Partition{Start: 100, Size: 50 * 512, Name: "p1", GUID: "uuid1"},
+		&gpt.Partition{Start: 200, Size: 50 * 512, Name: "p2", GUID: "uuid2"},
+	}}
+	t.Run("one", func(t *testing.T) {
+		got, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{NewMaxPartitionChange(IdentifierByLabel, "p1")})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got[0].mode != SizeMax {
+			t.Errorf("mode = %v, want max", got[0].mode)
+		}
+	})
+	t.Run("two", func(t *testing.T) {
+		_, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{
+			NewMaxPartitionChange(IdentifierByLabel, "p1"),
+			NewMaxPartitionChange(IdentifierByLabel, "p2"),
+		})
+		if err == nil {
+			t.Fatal("expected error for two max partitions, got nil")
+		}
+	})
+}
+
+// TestPartitionChangesToResizeTarget_Weight verifies weight validation and that
+// weighted partitions cannot be combined with a max partition.
+func TestPartitionChangesToResizeTarget_Weight(t *testing.T) {
+	tbl := &fakeTable{parts: []part.Partition{
+		&gpt.Partition{Start: 100, Size: 50 * 512, Name: "p1", GUID: "uuid1"},
+		&gpt.Partition{Start: 200, Size: 50 * 512, Name: "p2", GUID: "uuid2"},
+	}}
+	t.Run("weighted", func(t *testing.T) {
+		got, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{
+			NewWeightedPartitionChange(IdentifierByLabel, "p1", 2),
+			NewWeightedPartitionChange(IdentifierByLabel, "p2", 1),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got[0].weight != 2 || got[1].weight != 1 {
+			t.Errorf("weights = %d, %d, want 2, 1", got[0].weight, got[1].weight)
+		}
+	})
+	t.Run("zero weight", func(t *testing.T) {
+		if _, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{NewWeightedPartitionChange(IdentifierByLabel, "p1", 0)}); err == nil {
+			t.Fatal("expected error for zero weight, got nil")
+		}
+	})
+	t.Run("with max", func(t *testing.T) {
+		_, err := partitionChangesToResizeTarget(tbl, nil, []PartitionChange{
+			NewWeightedPartitionChange(IdentifierByLabel, "p1", 2),
+			NewMaxPartitionChange(IdentifierByLabel, "p2"),
+		})
+		if err == nil {
+			t.Fatal("expected error for weighted and max partitions, got nil")
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package partitionresizer
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// markDiscards marks each partition to be copied to a new location to have
+// the space its original leaves discarded once it is removed, should
+// opts.Discard ask for it.
+func markDiscards(resizes []partitionResizeTarget, opts Options) {
+	for i, r := range resizes {
+		if r.original.start != r.target.start {
+			resizes[i].discard = opts.Discard
+		}
+	}
+}
+
+// discardOriginals discards the space the originals of the relocated
+// partitions marked to be, see Options.Discard, left once commitPartitions
+// removed them, see removedRanges, with BLKDISCARD on a block device, or by
+// punching a hole in an image file. Discarding is best effort, the resize
+// being complete by now: a range that cannot be discarded is warned of.
+// Discarding again what already is discarded does nothing, so resuming after
+// a crash does no harm.
+func discardOriginals(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) {
+	ranges, err := removedRanges(logger, d, resizes, func(r partitionResizeTarget) bool { return r.discard }, "discarding")
+	if err != nil {
+		logger.Warn("cannot discard original partitions", "error", err)
+		return
+	}
+	if len(ranges) == 0 {
+		return
+	}
+	f, err := d.Backend.Sys()
+	if err != nil {
+		logger.Warn("cannot discard original partitions, as the disk has no file to discard on", "error", err)
+		return
+	}
+	for _, free := range ranges {
+		if err := discardRange(f, free.start, free.size); err != nil {
+			logger.Warn("cannot discard space of original partition", "partition", free.number, "start", free.start, "bytes", free.size, "error", err)
+			continue
+		}
+		logger.Info("discarded space of original partition", "partition", free.number, "start", free.start, "bytes", free.size)
+	}
+}
+
+// removedRanges returns the ranges the originals of the relocated partitions
+// selected left once commitPartitions removed them: those of each no
+// partition of d's table now takes, in order. A source copied frozen that is
+// still mounted, as the kernel keeps the old table until it is not, is left
+// out, warning that it is not being acted on, action being e.g. "wiping".
+func removedRanges(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, selected func(partitionResizeTarget) bool, action string) ([]partitionData, error) {
+	var originals []partitionData
+	for _, r := range resizes {
+		if !selected(r) || r.original.start == r.target.start {
+			continue
+		}
+		if r.freezeTimeout > 0 && d.Backend.Path() != "" {
+			if mountpoint, err := partitionMountpoint(d.Backend.Path(), r.original.number); err != nil || mountpoint != "" {
+				logger.Warn("not "+action+" original partition, as it may still be mounted", "partition", r.original.number, "mountpoint", mountpoint, "error", err)
+				continue
+			}
+		}
+		originals = append(originals, r.original)
+	}
+	if len(originals) == 0 {
+		return nil, nil
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := tableRaw.(*gpt.Table)
+	if !ok {
+		return nil, fmt.Errorf("unsupported partition table type, only GPT is supported")
+	}
+	var ranges []partitionData
+	for _, original := range originals {
+		ranges = append(ranges, unusedRanges(original, table)...)
+	}
+	return ranges, nil
+}
+
+// unusedRanges returns the ranges of p that no partition of table takes, in
+// order.
+func unusedRanges(p partitionData, table *gpt.Table) []partitionData {
+	sectorSize := int64(cmp.Or(table.LogicalSectorSize, 512))
+	var used []partitionData
+	for _, q := range table.Partitions {
+		if q.Type != gpt.Unused {
+			used = append(used, partitionData{start: int64(q.Start) * sectorSize, size: int64(q.Size)})
+		}
+	}
+	slices.SortFunc(used, func(a, b partitionData) int { return cmp.Compare(a.start, b.start) })
+	var free []partitionData
+	start, end := p.start, p.start+p.size
+	for _, q := range used {
+		if q.start+q.size <= start || q.start >= end {
+			continue
+		}
+		if q.start > start {
+			free = append(free, partitionData{number: p.number, start: start, size: q.start - start})
+		}
+		start = max(start, q.start+q.size)
+	}
+	if start < end {
+		free = append(free, partitionData{number: p.number, start: start, size: end - start})
+	}
+	return free
+}
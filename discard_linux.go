@@ -0,0 +1,30 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// discardRange discards the given range of f: with BLKDISCARD should f be a
+// block device, or by punching a hole in it should it be a regular file.
+func discardRange(f *os.File, offset, length int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		return punchHole(f, offset, length)
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0:
+		r := [2]uint64{uint64(offset), uint64(length)}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			return errno
+		}
+		return nil
+	default:
+		return fmt.Errorf("cannot discard on %s, neither a block device nor a regular file", f.Name())
+	}
+}
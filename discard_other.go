@@ -0,0 +1,13 @@
+//go:build !linux
+
+package partitionresizer
+
+import (
+	"errors"
+	"os"
+)
+
+// discardRange fails: discarding is only supported on Linux.
+func discardRange(f *os.File, offset, length int64) error {
+	return errors.New("discarding is only supported on Linux")
+}
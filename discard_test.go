@@ -0,0 +1,121 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestUnusedRanges(t *testing.T) {
+	table := &gpt.Table{LogicalSectorSize: 512, Partitions: []*gpt.Partition{
+		{Index: 1, Start: 2 * MB / 512, Size: 1 * MB, Type: gpt.LinuxFilesystem},
+		{Index: 2, Start: 4 * MB / 512, Size: 2 * MB, Type: gpt.LinuxFilesystem},
+		{Index: 3, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.Unused},
+	}}
+	tests := []struct {
+		name string
+		p    partitionData
+		want []partitionData
+	}{
+		{"free", partitionData{number: 1, start: 8 * MB, size: 1 * MB}, []partitionData{{number: 1, start: 8 * MB, size: 1 * MB}}},
+		{"around partitions", partitionData{number: 1, start: 1 * MB, size: 8 * MB}, []partitionData{
+			{number: 1, start: 1 * MB, size: 1 * MB},
+			{number: 1, start: 3 * MB, size: 1 * MB},
+			{number: 1, start: 6 * MB, size: 3 * MB},
+		}},
+		{"overlapping the end of one", partitionData{number: 1, start: 5 * MB, size: 2 * MB}, []partitionData{{number: 1, start: 6 * MB, size: 1 * MB}}},
+		{"taken", partitionData{number: 1, start: 4 * MB, size: 2 * MB}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unusedRanges(tt.p, table); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unusedRanges() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// removedOriginalDisk returns an image, at the path returned, and its
+// contents, its bytes from 1 MB to 24 MB all 0xa5, and the resize of the
+// partition removed from its first 8 MB, but for 4 MB to 6 MB, which another
+// partition takes, to the partition at 16 MB.
+func removedOriginalDisk(t *testing.T) (*disk.Disk, string, []byte, []partitionResizeTarget) {
+	t.Helper()
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 32*MB, []*gpt.Partition{
+		{Index: 1, Start: 4 * MB / 512, Size: 2 * MB, Type: gpt.LinuxFilesystem, Name: "other"},
+		{Index: 2, Start: 16 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "moved"},
+	})
+	data, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1 * MB; i < 24*MB; i++ {
+		data[i] = 0xa5
+	}
+	if err := os.WriteFile(diskPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = storage.Close() })
+	d, err := diskfs.OpenBackend(storage, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{
+		{
+			original: partitionData{number: 3, start: 1 * MB, size: 8 * MB},
+			target:   partitionData{number: 2, start: 16 * MB, size: 8 * MB},
+		},
+	}
+	return d, diskPath, data, resizes
+}
+
+// TestDiscardOriginals discards the original of a partition moved within an
+// image, which then reads as zeros, but for the part of it a partition of the
+// table still takes.
+func TestDiscardOriginals(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("discarding is only supported on Linux")
+	}
+	d, diskPath, data, resizes := removedOriginalDisk(t)
+	discardOriginals(slog.Default(), d, resizes)
+	got, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("discardOriginals() changed the image without Options.Discard")
+	}
+
+	markDiscards(resizes, Options{Discard: true})
+	discardOriginals(slog.Default(), d, resizes)
+	if got, err = os.ReadFile(diskPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		start, end int64
+		zero       bool
+	}{
+		{1 * MB, 4 * MB, true},
+		{4 * MB, 6 * MB, false},
+		{6 * MB, 9 * MB, true},
+		{9 * MB, 24 * MB, false},
+	} {
+		if zero := isZero(got[tt.start:tt.end]); zero != tt.zero {
+			t.Errorf("bytes %d to %d zero = %v, want %v", tt.start, tt.end, zero, tt.zero)
+		}
+	}
+}
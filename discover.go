@@ -3,15 +3,19 @@ package partitionresizer
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"errors"
+	"fmt"
 	iofs "io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/backend/file"
+	diskpkg "github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
@@ -19,6 +23,16 @@ const (
 	sysDefaultPath = "/sys"
 )
 
+// devPartUUIDPath, devPartLabelPath, devFSUUIDPath and devFSLabelPath are
+// where udev links to each partition by its PARTUUID and GPT name, and by the
+// UUID and label of its filesystem.
+var (
+	devPartUUIDPath  = "/dev/disk/by-partuuid"
+	devPartLabelPath = "/dev/disk/by-partlabel"
+	devFSUUIDPath    = "/dev/disk/by-uuid"
+	devFSLabelPath   = "/dev/disk/by-label"
+)
+
 // findDisks find all disks and their partitions, including reference name and partition position.
 // Does so entirely via sysfs. If the 'disk' parameter is non-empty,
 // scans for all disks, otherwise just for the given disk. Example, if disk is "/dev/sda", only /sys/class/block/sda is scanned,
@@ -41,7 +55,8 @@ func findDisks(disk, syspath string) (map[string][]partitionData, error) {
 	// which candidates to check, depends if we were given a specific disk or not
 	if disk != "" {
 		// only check the given disk, which might be a device or an image file
-		base := filepath.Base(disk)
+		// a stable name, e.g. in /dev/disk/by-id, is a link to the kernel's
+		base := filepath.Base(resolvePath(disk))
 		diskSysPath := filepath.Join(sysClassBlockPath, base)
 		info, err := os.Stat(diskSysPath)
 		switch {
@@ -53,35 +68,18 @@ func findDisks(disk, syspath string) (map[string][]partitionData, error) {
 			if err != nil {
 				return nil, err
 			}
+			defer func() { _ = f.Close() }()
 			backend := file.New(f, false)
 			d, err := diskfs.OpenBackend(backend)
 			if err != nil {
 				return nil, err
 			}
-			tableRaw, err := d.GetPartitionTable()
+			table, err := readGPT(d)
 			if err != nil {
 				return nil, err
 			}
-			table, ok := tableRaw.(*gpt.Table)
-			if !ok {
-				return nil, errors.New("unsupported partition table type, only GPT is supported")
-			}
-			var parts []partitionData
-			for _, p := range table.Partitions {
-				// no name field
-				start := int64(p.Start) * int64(d.LogicalBlocksize)
-				pd := partitionData{
-					label:  p.Name,
-					uuid:   p.UUID(),
-					size:   p.GetSize(),
-					start:  start,
-					end:    start + p.GetSize() - 1,
-					number: p.Index,
-				}
-				parts = append(parts, pd)
-			}
 			allDisks := make(map[string][]partitionData)
-			allDisks[base] = parts
+			allDisks[base] = gptPartitionData(d, table)
 			return allDisks, nil
 		default:
 			candidates = append(candidates, info)
@@ -147,6 +145,23 @@ func findDisks(disk, syspath string) (map[string][]partitionData, error) {
 			return nil, err
 		}
 
+		// sysfs knows neither partition GUIDs nor filesystem UUIDs and
+		// labels, so read them from the disk itself, or, should it not be
+		// readable, from the links udev makes to each partition by them.
+		// Only a disk given is read: discovery opens no disk it is not
+		// asked to, so relies on the links.
+		var onDisk map[int]partitionData
+		if disk != "" {
+			onDisk = readDiskPartitions(filepath.Join("/dev", candidate.Name()))
+		}
+		var linkedUUIDs, linkedLabels, linkedFSUUIDs, linkedFSLabels map[string]string
+		if onDisk == nil {
+			linkedUUIDs = readDiskLinks(devPartUUIDPath)
+			linkedLabels = readDiskLinks(devPartLabelPath)
+			linkedFSUUIDs = readDiskLinks(devFSUUIDPath)
+			linkedFSLabels = readDiskLinks(devFSLabelPath)
+		}
+
 		// find all of the child partitions, and store them in the right order
 		for _, child := range children {
 			if !child.IsDir() {
@@ -183,15 +198,22 @@ func findDisks(disk, syspath string) (map[string][]partitionData, error) {
 			if err != nil {
 				return nil, err
 			}
+			// the kernel's PARTNAME keeps only the low byte of each UTF-16
+			// code unit of the GPT name, mangling any that is not ASCII, so
+			// the name is decoded from the GPT, or taken from udev, which
+			// decodes it, should the GPT not be readable
 			ue := parseKeyValueLines(ueventData)
-			label := ue["PARTNAME"]
+			label := cmp.Or(onDisk[int(id)].label, linkedLabels[name], ue["PARTNAME"])
 			pd := partitionData{
-				name:   name,
-				label:  label,
-				size:   size * blockSize,
-				start:  start * blockSize,
-				end:    end * blockSize,
-				number: int(id),
+				name:    name,
+				label:   label,
+				uuid:    cmp.Or(onDisk[int(id)].uuid, linkedUUIDs[name]),
+				fsUUID:  cmp.Or(onDisk[int(id)].fsUUID, linkedFSUUIDs[name]),
+				fsLabel: cmp.Or(onDisk[int(id)].fsLabel, linkedFSLabels[name]),
+				size:    size * blockSize,
+				start:   start * blockSize,
+				end:     end * blockSize,
+				number:  int(id),
 			}
 			allDisks[candidate.Name()] = append(allDisks[candidate.Name()], pd)
 		}
@@ -199,6 +221,26 @@ func findDisks(disk, syspath string) (map[string][]partitionData, error) {
 	return allDisks, nil
 }
 
+// gptPartitionData returns the partitions in table, the GPT of d. They have no
+// name, which only a block device has.
+func gptPartitionData(d *diskpkg.Disk, table *gpt.Table) []partitionData {
+	var parts []partitionData
+	for _, p := range table.Partitions {
+		start := int64(p.Start) * d.LogicalBlocksize
+		parts = append(parts, partitionData{
+			label:   p.Name,
+			uuid:    p.UUID(),
+			fsUUID:  filesystemUUID(d.Backend, start),
+			fsLabel: filesystemLabel(d, p.Index),
+			size:    p.GetSize(),
+			start:   start,
+			end:     start + p.GetSize() - 1,
+			number:  p.Index,
+		})
+	}
+	return parts
+}
+
 // filterDisksByPartitions returns all of the disks that have all of the given partition identifiers
 func filterDisksByPartitions(disks map[string][]partitionData, partIdentifiers []PartitionIdentifier) ([]string, error) {
 	var found []string
@@ -207,21 +249,8 @@ func filterDisksByPartitions(disks map[string][]partitionData, partIdentifiers [
 		for _, pi := range partIdentifiers {
 			matched := false
 			for _, p := range parts {
-				switch pi.By() {
-				case IdentifierByName:
-					if p.name == pi.Value() {
-						matched = true
-					}
-				case IdentifierByLabel:
-					if p.label == pi.Value() {
-						matched = true
-					}
-				case IdentifierByUUID:
-					if p.uuid == pi.Value() {
-						matched = true
-					}
-				}
-				if matched {
+				if p.matches(pi) {
+					matched = true
 					break
 				}
 			}
@@ -237,6 +266,140 @@ func filterDisksByPartitions(disks map[string][]partitionData, partIdentifiers [
 	return found, nil
 }
 
+// matches reports whether pi identifies p.
+func (p partitionData) matches(pi PartitionIdentifier) bool {
+	switch pi.By() {
+	case IdentifierByName:
+		return p.name == pi.Value()
+	case IdentifierByDevice:
+		return p.name != "" && p.name == deviceName(pi.Value())
+	case IdentifierByLabel:
+		return p.label == pi.Value()
+	case IdentifierByPartUUID, IdentifierByUUID:
+		// GPT has GUIDs in upper case, blkid in lower
+		return p.uuid != "" && strings.EqualFold(p.uuid, pi.Value())
+	case IdentifierByFSUUID:
+		return p.fsUUID != "" && strings.EqualFold(p.fsUUID, pi.Value())
+	case IdentifierByFSLabel:
+		return p.fsLabel != "" && p.fsLabel == pi.Value()
+	}
+	return false
+}
+
+// deviceName returns the name of the partition device at path, e.g. nvme0n1p2
+// for /dev/nvme0n1p2, following it should it be a link such as one in
+// /dev/disk/by-id.
+func deviceName(path string) string {
+	return filepath.Base(resolvePath(path))
+}
+
+// identifierHint returns a note for an error about partitions not being found,
+// should one of partIdentifiers not identify any of parts by one kind of UUID
+// or label but be the other kind of one of them, as the partition's and its
+// filesystem's are easily confused; otherwise "".
+func identifierHint(parts []partitionData, partIdentifiers ...PartitionIdentifier) string {
+	for _, pi := range partIdentifiers {
+		if slices.ContainsFunc(parts, func(p partitionData) bool { return p.matches(pi) }) {
+			continue
+		}
+		for _, p := range parts {
+			switch pi.By() {
+			case IdentifierByPartUUID, IdentifierByUUID:
+				if p.fsUUID != "" && strings.EqualFold(p.fsUUID, pi.Value()) {
+					return fmt.Sprintf(" (%s is the filesystem UUID of partition %d, not its PARTUUID; identify it by %s)", pi.Value(), p.number, IdentifierByFSUUID)
+				}
+			case IdentifierByFSUUID:
+				if p.uuid != "" && strings.EqualFold(p.uuid, pi.Value()) {
+					return fmt.Sprintf(" (%s is the PARTUUID of partition %d, not the UUID of its filesystem; identify it by %s)", pi.Value(), p.number, IdentifierByPartUUID)
+				}
+			case IdentifierByLabel:
+				if p.fsLabel != "" && p.fsLabel == pi.Value() {
+					return fmt.Sprintf(" (%s is the label of the filesystem on partition %d, not the partition's name in the GPT; identify it by %s)", pi.Value(), p.number, IdentifierByFSLabel)
+				}
+			case IdentifierByFSLabel:
+				if p.label != "" && p.label == pi.Value() {
+					return fmt.Sprintf(" (%s is the name of partition %d in the GPT, not the label of its filesystem; identify it by %s)", pi.Value(), p.number, IdentifierByLabel)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// readDiskPartitions returns the partitions in the GPT of the disk device at
+// path, keyed by partition number, for what only the disk knows of them: their
+// GUIDs, and the UUIDs and labels of their filesystems. It is best effort: a
+// disk that cannot be opened or has no GPT yields none.
+func readDiskPartitions(path string) map[int]partitionData {
+	backend, err := file.OpenFromPath(path, true)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return nil
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return nil
+	}
+	parts := make(map[int]partitionData)
+	for _, p := range gptPartitionData(d, table) {
+		parts[p.number] = p
+	}
+	return parts
+}
+
+// filesystemLabel returns the label of the filesystem on partition number of
+// d, as go-diskfs reads it, without the padding FAT32 keeps it with. It is
+// best effort, returning "" for a filesystem go-diskfs cannot read.
+func filesystemLabel(d *diskpkg.Disk, number int) string {
+	fs, err := d.GetFilesystem(number)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(fs.Label(), " \x00")
+}
+
+// readDiskLinks returns the names of the links to partition devices in dir,
+// the UUIDs or labels of /dev/disk/by-partuuid, /dev/disk/by-uuid or
+// /dev/disk/by-label, keyed by the name of the device, e.g. sda1. It is best
+// effort: a dir that cannot be read yields none.
+func readDiskLinks(dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := make(map[string]string)
+	for _, e := range entries {
+		target, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		names[filepath.Base(target)] = unescapeUdev(e.Name())
+	}
+	return names
+}
+
+// unescapeUdev undoes the escaping udev gives the name of a link, such as one
+// in /dev/disk/by-label, of a character it does not allow, e.g. a space as
+// \x20.
+func unescapeUdev(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) && name[i+1] == 'x' {
+			if c, err := strconv.ParseUint(name[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
 func readSysIntValue(path string) (int64, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
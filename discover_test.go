@@ -43,8 +43,8 @@ func TestReadSysIntValue(t *testing.T) {
 // TestFilterDisks exercises matching by name, label, uuid.
 func TestFilterDisks(t *testing.T) {
 	m := map[string][]partitionData{
-		"d1": {{name: "p1", label: "L1", uuid: "U1"}},
-		"d2": {{name: "p2", label: "L2", uuid: "U2"}},
+		"d1": {{name: "p1", label: "L1", uuid: "U1", fsUUID: "F1", fsLabel: "FL1"}},
+		"d2": {{name: "p2", label: "L2", uuid: "U2", fsUUID: "F2", fsLabel: "FL2"}},
 	}
 	t.Run("ByLabel", func(t *testing.T) {
 		id := NewPartitionIdentifier(IdentifierByLabel, "L1")
@@ -76,6 +76,70 @@ func TestFilterDisks(t *testing.T) {
 			t.Errorf("filterDisksByPartitions = %v, want [d1]", got)
 		}
 	})
+	t.Run("ByFSUUID", func(t *testing.T) {
+		id := NewPartitionIdentifier(IdentifierByFSUUID, "f2")
+		got, err := filterDisksByPartitions(m, []PartitionIdentifier{id})
+		if err != nil {
+			t.Fatalf("filterDisksByPartitions error: %v", err)
+		}
+		if !reflect.DeepEqual(got, []string{"d2"}) {
+			t.Errorf("filterDisksByPartitions = %v, want [d2]", got)
+		}
+	})
+	t.Run("ByDevice", func(t *testing.T) {
+		// the device node itself, and a link to it as in /dev/disk/by-id
+		dev := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dev, "p2"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("p2", filepath.Join(dev, "disk-part2")); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"/dev/p2", filepath.Join(dev, "disk-part2")} {
+			id := NewPartitionIdentifier(IdentifierByDevice, path)
+			got, err := filterDisksByPartitions(m, []PartitionIdentifier{id})
+			if err != nil {
+				t.Fatalf("filterDisksByPartitions error: %v", err)
+			}
+			if !reflect.DeepEqual(got, []string{"d2"}) {
+				t.Errorf("filterDisksByPartitions(%s) = %v, want [d2]", path, got)
+			}
+		}
+	})
+	t.Run("ByFSLabel", func(t *testing.T) {
+		id := NewPartitionIdentifier(IdentifierByFSLabel, "FL1")
+		got, err := filterDisksByPartitions(m, []PartitionIdentifier{id})
+		if err != nil {
+			t.Fatalf("filterDisksByPartitions error: %v", err)
+		}
+		if !reflect.DeepEqual(got, []string{"d1"}) {
+			t.Errorf("filterDisksByPartitions = %v, want [d1]", got)
+		}
+	})
+	t.Run("Confused identifiers", func(t *testing.T) {
+		// a filesystem UUID or label given as the partition's, and the other
+		// way round, matches nothing, but the error says which was meant
+		for _, id := range []PartitionIdentifier{
+			NewPartitionIdentifier(IdentifierByPartUUID, "F1"),
+			NewPartitionIdentifier(IdentifierByFSUUID, "U1"),
+			NewPartitionIdentifier(IdentifierByLabel, "FL1"),
+			NewPartitionIdentifier(IdentifierByFSLabel, "L1"),
+		} {
+			got, err := filterDisksByPartitions(m, []PartitionIdentifier{id})
+			if err != nil {
+				t.Fatalf("filterDisksByPartitions error: %v", err)
+			}
+			if len(got) != 0 {
+				t.Errorf("filterDisksByPartitions(%s=%s) = %v, want []", id.By(), id.Value(), got)
+			}
+			if hint := identifierHint(m["d1"], id); hint == "" {
+				t.Errorf("identifierHint(%s=%s) is empty, want a hint", id.By(), id.Value())
+			}
+		}
+		if hint := identifierHint(m["d1"], NewPartitionIdentifier(IdentifierByFSUUID, "F1")); hint != "" {
+			t.Errorf("identifierHint of a matching identifier = %q, want none", hint)
+		}
+	})
 	t.Run("No match", func(t *testing.T) {
 		id := NewPartitionIdentifier(IdentifierByLabel, "NOPE")
 		got, err := filterDisksByPartitions(m, []PartitionIdentifier{id})
@@ -88,6 +152,22 @@ func TestFilterDisks(t *testing.T) {
 	})
 }
 
+// TestUnescapeUdev verifies undoing udev's escaping of link names.
+func TestUnescapeUdev(t *testing.T) {
+	tests := map[string]string{
+		"ESP":           "ESP",
+		`EFI\x20System`: "EFI System",
+		`a\x2fb`:        "a/b",
+		`trailing\x2`:   `trailing\x2`,
+		`not\xzzhex`:    `not\xzzhex`,
+	}
+	for in, want := range tests {
+		if got := unescapeUdev(in); got != want {
+			t.Errorf("unescapeUdev(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
 // TestFindDisks verifies findDisks.
 func TestFindDisks(t *testing.T) {
 	tmp := t.TempDir()
@@ -145,6 +225,50 @@ func TestFindDisks(t *testing.T) {
 			t.Errorf("pd.end = %d, want %d", pd.end, expectedEnd)
 		}
 	})
+	t.Run("partuuid", func(t *testing.T) {
+		// /dev/sdx cannot be read, so the PARTUUID comes from its link
+		links := t.TempDir()
+		const partUUID = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+		if err := os.Symlink("../../sdx1", filepath.Join(links, partUUID)); err != nil {
+			t.Fatal(err)
+		}
+		old := devPartUUIDPath
+		devPartUUIDPath = links
+		defer func() { devPartUUIDPath = old }()
+		disks, err := findDisks("sdx", tmp)
+		if err != nil {
+			t.Fatalf("findDisks error: %v", err)
+		}
+		if data := disks["sdx"]; len(data) != 1 || data[0].uuid != partUUID {
+			t.Fatalf("unexpected disks map: %v", disks)
+		}
+		matched, err := filterDisksByPartitions(disks, []PartitionIdentifier{NewPartitionIdentifier(IdentifierByUUID, "0FC63DAF-8483-4772-8E79-3D69D8477DE4")})
+		if err != nil || len(matched) != 1 {
+			t.Errorf("filterDisksByPartitions by upper case UUID = %v, %v, want sdx", matched, err)
+		}
+	})
+	t.Run("non-ASCII label", func(t *testing.T) {
+		// the kernel mangles a GPT name that is not ASCII in PARTNAME, so
+		// with /dev/sdx not readable, it comes from the link udev makes
+		links := t.TempDir()
+		if err := os.Symlink("../../sdx1", filepath.Join(links, "Données")); err != nil {
+			t.Fatal(err)
+		}
+		old := devPartLabelPath
+		devPartLabelPath = links
+		defer func() { devPartLabelPath = old }()
+		disks, err := findDisks("sdx", tmp)
+		if err != nil {
+			t.Fatalf("findDisks error: %v", err)
+		}
+		if data := disks["sdx"]; len(data) != 1 || data[0].label != "Données" {
+			t.Fatalf("unexpected disks map: %v", disks)
+		}
+		matched, err := filterDisksByPartitions(disks, []PartitionIdentifier{NewPartitionIdentifier(IdentifierByLabel, "Données")})
+		if err != nil || len(matched) != 1 {
+			t.Errorf("filterDisksByPartitions by label = %v, %v, want sdx", matched, err)
+		}
+	})
 	t.Run("single", func(t *testing.T) {
 		// restrict to explicit disk
 		single, err := findDisks("sdx", tmp)
@@ -155,6 +279,24 @@ func TestFindDisks(t *testing.T) {
 			t.Errorf("findDisks(disk,…) failed to restrict to sdx: %v", single)
 		}
 	})
+	t.Run("by-id link", func(t *testing.T) {
+		// a stable name for the disk resolves to the name sysfs knows it by
+		dev := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dev, "sdx"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dev, "ata-QEMU_HARDDISK_QM00001")
+		if err := os.Symlink("sdx", link); err != nil {
+			t.Fatal(err)
+		}
+		disks, err := findDisks(link, tmp)
+		if err != nil {
+			t.Fatalf("findDisks error: %v", err)
+		}
+		if data := disks["sdx"]; len(data) != 1 || data[0].name != "sdx1" {
+			t.Errorf("findDisks(link,…) = %v, want sdx with sdx1", disks)
+		}
+	})
 	t.Run("none", func(t *testing.T) {
 		_, err := findDisks("nosuchdisk", tmp)
 		if err == nil || !errors.Is(err, fs.ErrNotExist) {
@@ -174,5 +316,9 @@ func TestFindDisks(t *testing.T) {
 		if !ok || len(data) != 4 {
 			t.Fatalf("unexpected disks map from disk image: %v", disks)
 		}
+		// the ESP has a FAT32 filesystem labelled ESP, as is its partition
+		if esp := data[0]; esp.label != "ESP" || esp.fsLabel != "ESP" || esp.fsUUID == "" {
+			t.Errorf("ESP of disk image is %+v, want filesystem label ESP and a filesystem UUID", esp)
+		}
 	})
 }
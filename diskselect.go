@@ -0,0 +1,178 @@
+package partitionresizer
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// udevDataPath is where udev keeps the properties of each device, in a file
+// named for its major and minor numbers, e.g. b8:0.
+var udevDataPath = "/run/udev/data"
+
+// DiskSelector says which property of a disk FindDisk selects it by.
+type DiskSelector string
+
+const (
+	// DiskBySerial selects a disk by its serial number, e.g. S64DNX0R123456.
+	DiskBySerial DiskSelector = "serial"
+	// DiskByWWN selects a disk by its World Wide Name, e.g.
+	// 0x5000c500a1b2c3d4, with or without the 0x, or as sysfs has it, e.g.
+	// naa.5000c500a1b2c3d4 or eui.0025388b71b2c4f1.
+	DiskByWWN DiskSelector = "wwn"
+	// DiskByModel selects a disk by its model, e.g. Samsung SSD 980 PRO 2TB,
+	// regardless of case, and with udev's underscores taken as spaces.
+	DiskByModel DiskSelector = "model"
+	// DiskByGUID selects a disk by the GUID in its GPT header, regardless of
+	// case, so that a disk stamped with a known GUID, such as one written
+	// from an image, is found without knowing its device name.
+	DiskByGUID DiskSelector = "guid"
+)
+
+// DiskSelectors lists the ways FindDisk can select a disk.
+var DiskSelectors = []DiskSelector{DiskBySerial, DiskByWWN, DiskByModel, DiskByGUID}
+
+// diskProperties are the properties of a disk FindDisk selects it by.
+type diskProperties struct {
+	serial string
+	wwn    string
+	model  string
+}
+
+// FindDisk returns the device path, e.g. /dev/sda, of the one disk whose
+// serial number, WWN or model, as udev and sysfs report them, or GPT disk
+// GUID, as by says, is value, so that a disk can be chosen the same way on
+// machines that enumerate their disks in a different order. It is an error
+// for no disk, or several, to match.
+func FindDisk(by DiskSelector, value string) (string, error) {
+	return findDisk(by, value, "", udevDataPath, "/dev")
+}
+
+// findDisk is FindDisk, with sysfs at syspath, /sys if empty, the udev
+// database at udevpath and the device nodes in devpath.
+func findDisk(by DiskSelector, value, syspath, udevpath, devpath string) (string, error) {
+	if !slices.Contains(DiskSelectors, by) {
+		return "", fmt.Errorf("unknown disk selector %s, must be one of %v", by, DiskSelectors)
+	}
+	if syspath == "" {
+		syspath = sysDefaultPath
+	}
+	sysClassBlockPath := filepath.Join(syspath, "class", "block")
+	entries, err := os.ReadDir(sysClassBlockPath)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, e := range entries {
+		dir := filepath.Join(sysClassBlockPath, e.Name())
+		// a whole disk, not a partition
+		if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+			continue
+		}
+		devicePath := filepath.Join(devpath, e.Name())
+		if by == DiskByGUID {
+			// any disk may have a GPT, an image attached to a loop device
+			// too
+			if guid := readDiskGUID(devicePath); guid != "" && strings.EqualFold(guid, strings.TrimSpace(value)) {
+				found = append(found, devicePath)
+			}
+			continue
+		}
+		// the properties are those of a device, which a loop or
+		// device-mapper device is not
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+		props := readDiskProperties(dir, udevpath)
+		var matched bool
+		switch by {
+		case DiskBySerial:
+			matched = props.serial != "" && props.serial == strings.TrimSpace(value)
+		case DiskByWWN:
+			matched = props.wwn != "" && normalizeWWN(props.wwn) == normalizeWWN(value)
+		case DiskByModel:
+			matched = props.model != "" && strings.EqualFold(normalizeModel(props.model), normalizeModel(value))
+		}
+		if matched {
+			found = append(found, devicePath)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no disk with %s %s found", by, value)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d disks with %s %s found: %s", len(found), by, value, strings.Join(found, ", "))
+}
+
+// readDiskProperties returns the properties of the disk at dir in sysfs,
+// preferring what udev records of it in its database at udevpath, and falling
+// back to what sysfs has. Anything neither has is left empty.
+func readDiskProperties(dir, udevpath string) diskProperties {
+	var udev map[string]string
+	if dev, err := os.ReadFile(filepath.Join(dir, "dev")); err == nil {
+		if data, err := os.ReadFile(filepath.Join(udevpath, "b"+strings.TrimSpace(string(dev)))); err == nil {
+			udev = parseKeyValueLines(data)
+		}
+	}
+	return diskProperties{
+		serial: cmp.Or(udev["E:ID_SERIAL_SHORT"], readSysString(dir, "device", "serial")),
+		wwn:    cmp.Or(udev["E:ID_WWN"], readSysString(dir, "device", "wwid"), readSysString(dir, "wwid")),
+		model:  cmp.Or(udev["E:ID_MODEL"], readSysString(dir, "device", "model")),
+	}
+}
+
+// readDiskGUID returns the GUID in the GPT header of the disk at path; "" should
+// it not be readable or have no GPT.
+func readDiskGUID(path string) string {
+	backend, err := file.OpenFromPath(path, true)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return ""
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return ""
+	}
+	return table.GUID
+}
+
+// readSysString returns the contents of the sysfs file at the path elem makes,
+// trimmed of space; "" should it not be readable.
+func readSysString(elem ...string) string {
+	data, err := os.ReadFile(filepath.Join(elem...))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// normalizeWWN returns wwn in lower case, without the prefixes udev, sysfs or
+// /dev/disk/by-id give it, so that 0x5000C500A1B2C3D4, naa.5000c500a1b2c3d4
+// and wwn-0x5000c500a1b2c3d4 compare equal.
+func normalizeWWN(wwn string) string {
+	wwn = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(wwn)), "wwn-")
+	for _, prefix := range []string{"0x", "naa.", "eui."} {
+		if s, ok := strings.CutPrefix(wwn, prefix); ok {
+			return s
+		}
+	}
+	return wwn
+}
+
+// normalizeModel returns model with udev's underscores taken as spaces, and
+// runs of spaces, as sysfs pads the model with, collapsed.
+func normalizeModel(model string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(model, "_", " ")), " ")
+}
@@ -0,0 +1,97 @@
+package partitionresizer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestFindDisk selects disks from a fake sysfs and udev database: sda, a SATA
+// disk udev knows, sdb, one only sysfs knows, and nvme0n1, along with a
+// partition, which is never selected, and a loop device, which is only
+// selected by its GPT disk GUID.
+func TestFindDisk(t *testing.T) {
+	tmp := t.TempDir()
+	sys := filepath.Join(tmp, "class", "block")
+	udev := filepath.Join(tmp, "udev")
+	dev := filepath.Join(tmp, "dev")
+	write := func(path, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(sys, "sda", "dev"), "8:0\n")
+	write(filepath.Join(sys, "sda", "device", "model"), "Samsung SSD 870 \n")
+	write(filepath.Join(sys, "sda", "sda1", "partition"), "1\n")
+	write(filepath.Join(udev, "b8:0"), "S:disk/by-id/wwn-0x5002538f42b1c3d4\nE:ID_MODEL=Samsung_SSD_870_EVO_2TB\nE:ID_SERIAL_SHORT=S6PNNS0T123456\nE:ID_WWN=0x5002538f42b1c3d4\n")
+	write(filepath.Join(sys, "sdb", "dev"), "8:16\n")
+	write(filepath.Join(sys, "sdb", "device", "model"), "ST4000NM000A    \n")
+	write(filepath.Join(sys, "sdb", "device", "wwid"), "naa.5000c500a1b2c3d4\n")
+	write(filepath.Join(sys, "nvme0n1", "dev"), "259:0\n")
+	write(filepath.Join(sys, "nvme0n1", "device", "serial"), "S64DNX0R123456      \n")
+	write(filepath.Join(sys, "nvme0n1", "device", "model"), "Samsung SSD 980 PRO 2TB\n")
+	write(filepath.Join(sys, "nvme0n1", "wwid"), "eui.0025388b71b2c4f1\n")
+	write(filepath.Join(sys, "sda1", "partition"), "1\n")
+	write(filepath.Join(sys, "loop0", "dev"), "7:0\n")
+
+	tests := []struct {
+		by    DiskSelector
+		value string
+		want  string
+	}{
+		{DiskBySerial, "S6PNNS0T123456", "sda"},
+		{DiskBySerial, "S64DNX0R123456", "nvme0n1"},
+		{DiskByWWN, "0x5002538F42B1C3D4", "sda"},
+		{DiskByWWN, "wwn-0x5000c500a1b2c3d4", "sdb"},
+		{DiskByWWN, "0025388b71b2c4f1", "nvme0n1"},
+		{DiskByModel, "samsung ssd 870 evo 2tb", "sda"},
+		{DiskByModel, "ST4000NM000A", "sdb"},
+		{DiskByModel, "Samsung_SSD_980_PRO_2TB", "nvme0n1"},
+	}
+	for _, tt := range tests {
+		got, err := findDisk(tt.by, tt.value, tmp, udev, dev)
+		if err != nil {
+			t.Errorf("findDisk(%s, %s) error: %v", tt.by, tt.value, err)
+			continue
+		}
+		if want := filepath.Join(dev, tt.want); got != want {
+			t.Errorf("findDisk(%s, %s) = %s, want %s", tt.by, tt.value, got, want)
+		}
+	}
+
+	// by disk GUID, the disks with a GPT, an image on a loop device among them
+	if err := os.MkdirAll(dev, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sdb", "loop0"} {
+		path := filepath.Join(dev, name)
+		writeTestTable(t, path, 4*MB, []*gpt.Partition{{Index: 1, Start: 1 * MB / 512, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: "data"}})
+		guid := readDiskGUID(path)
+		if guid == "" {
+			t.Fatalf("%s has no disk GUID", path)
+		}
+		got, err := findDisk(DiskByGUID, strings.ToLower(guid), tmp, udev, dev)
+		if err != nil || got != path {
+			t.Errorf("findDisk(%s, %s) = %s, %v, want %s", DiskByGUID, guid, got, err, path)
+		}
+	}
+
+	// two disks of the same model are as good as none
+	write(filepath.Join(sys, "nvme1n1", "device", "model"), "Samsung SSD 980 PRO 2TB\n")
+	if _, err := findDisk(DiskByModel, "Samsung SSD 980 PRO 2TB", tmp, udev, dev); err == nil || !strings.Contains(err.Error(), "2 disks") {
+		t.Errorf("findDisk of a model two disks have: error %v, want 2 disks found", err)
+	}
+	if _, err := findDisk(DiskBySerial, "NOSUCHSERIAL", tmp, udev, dev); err == nil {
+		t.Error("findDisk of an unknown serial succeeded, want an error")
+	}
+	if _, err := findDisk("vendor", "ATA", tmp, udev, dev); err == nil {
+		t.Error("findDisk with an unknown selector succeeded, want an error")
+	}
+}
@@ -0,0 +1,50 @@
+package partitionresizer
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCachedRange flushes the given range of f and drops it from the page
+// cache, so that reading it back reads what is on the device rather than what
+// was just written.
+func dropCachedRange(f *os.File, offset, length int64) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_DONTNEED)
+}
+
+// adviseSequential tells the kernel the given range of f is read from start to
+// end, for it to read further ahead.
+func adviseSequential(f *os.File, offset, length int64) error {
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_SEQUENTIAL)
+}
+
+// dropRead drops the given range of f, read and no longer needed, from the
+// page cache.
+func dropRead(f *os.File, offset, length int64) error {
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_DONTNEED)
+}
+
+// startWriteback starts writing the given range of f back to the device,
+// without waiting for it.
+func startWriteback(f *os.File, offset, length int64) error {
+	return unix.SyncFileRange(int(f.Fd()), offset, length, unix.SYNC_FILE_RANGE_WRITE)
+}
+
+// dropWritten writes the given range of f back to the device, waiting for it,
+// and then drops it from the page cache, which keeps pages not yet written.
+func dropWritten(f *os.File, offset, length int64) error {
+	if err := unix.SyncFileRange(int(f.Fd()), offset, length, unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_DONTNEED)
+}
+
+// punchHole deallocates the given range of f, which then reads as zeros,
+// keeping its size.
+func punchHole(f *os.File, offset, length int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package partitionresizer
+
+import (
+	"errors"
+	"os"
+)
+
+// dropCachedRange flushes f. Dropping the range from the page cache is only
+// supported on Linux.
+func dropCachedRange(f *os.File, offset, length int64) error {
+	return f.Sync()
+}
+
+// adviseSequential does nothing: page cache advice is only supported on Linux.
+func adviseSequential(f *os.File, offset, length int64) error {
+	return nil
+}
+
+// dropRead does nothing: page cache advice is only supported on Linux.
+func dropRead(f *os.File, offset, length int64) error {
+	return nil
+}
+
+// startWriteback does nothing: page cache advice is only supported on Linux.
+func startWriteback(f *os.File, offset, length int64) error {
+	return nil
+}
+
+// dropWritten fails: page cache advice is only supported on Linux, and what
+// was written cannot be read back past the page cache without it.
+func dropWritten(f *os.File, offset, length int64) error {
+	return errors.New("dropping written pages is only supported on Linux")
+}
+
+// punchHole fails: punching holes is only supported on Linux.
+func punchHole(f *os.File, offset, length int64) error {
+	return errors.New("punching holes is only supported on Linux")
+}
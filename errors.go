@@ -1,6 +1,24 @@
 package partitionresizer
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotConfirmed is wrapped by the error a resize returns when
+// Options.Confirm declines one of its steps.
+var ErrNotConfirmed = errors.New("not confirmed")
+
+// ErrTableNotReRead is wrapped by the error a resize returns when it wrote the
+// partition table of its cutover, but the kernel failed to re-read it: the
+// resize is committed on disk, though the kernel still has the old table, and
+// Resume, once what was in the way is, finishes it.
+var ErrTableNotReRead = errors.New("partition table written, but the kernel failed to re-read it")
+
+// ErrNoChange is wrapped by the error GrowPart returns when there is too little
+// free space after the partition to grow it into, as growpart reports NOCHANGE.
+var ErrNoChange = errors.New("partition cannot be grown")
 
 type InsufficientSpaceError struct {
 	Partition string
@@ -17,3 +35,207 @@ func NewInsufficientSpaceError(partition string, requested int64) error {
 		Requested: requested,
 	}
 }
+
+// FragmentedShrinkError is returned when the partitions shrunk to make space
+// for the grows free enough of it in all, but each at its own end, in gaps
+// separate from each other, while a grow copied to a new location needs one
+// contiguous gap. Shrunk are the numbers of the partitions shrunk, and Err is
+// the *InsufficientSpaceError of the grow that does not fit.
+type FragmentedShrinkError struct {
+	Shrunk []int
+	Err    error
+}
+
+func (e *FragmentedShrinkError) Error() string {
+	return fmt.Sprintf("%v: shrinking partitions %v frees space in separate gaps, none large enough; shrink a single partition, or give one an exact amount to shrink by", e.Err, e.Shrunk)
+}
+
+func (e *FragmentedShrinkError) Unwrap() error {
+	return e.Err
+}
+
+func NewFragmentedShrinkError(shrunk []int, err error) error {
+	return &FragmentedShrinkError{
+		Shrunk: shrunk,
+		Err:    err,
+	}
+}
+
+// InUseError is returned when partitions to be resized are in use by the
+// running system, e.g. mounted, so that changing them would corrupt data.
+type InUseError struct {
+	Device  string
+	Reasons []string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("partitions on %s are in use: %s", e.Device, strings.Join(e.Reasons, "; "))
+}
+
+func NewInUseError(device string, reasons []string) error {
+	return &InUseError{
+		Device:  device,
+		Reasons: reasons,
+	}
+}
+
+// PlanError is returned when the resize asked for cannot be planned on the
+// disk, e.g. a partition to resize is not found, or the grows do not fit in
+// the space the shrinks free, so that nothing is changed. Err says why, and
+// is an *InsufficientSpaceError should there be too little space.
+type PlanError struct {
+	Disk string
+	Err  error
+}
+
+func (e *PlanError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PlanError) Unwrap() error {
+	return e.Err
+}
+
+func NewPlanError(disk string, err error) error {
+	return &PlanError{
+		Disk: disk,
+		Err:  err,
+	}
+}
+
+// CopyError is returned when copying a partition to its new location, or
+// verifying the copy, fails. Err says why.
+type CopyError struct {
+	Partition string
+	Err       error
+}
+
+func (e *CopyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+func NewCopyError(partition string, err error) error {
+	return &CopyError{
+		Partition: partition,
+		Err:       err,
+	}
+}
+
+// StalePlanError is returned when a Plan is applied to a disk that no longer
+// matches it, so that applying it would not do what was planned.
+type StalePlanError struct {
+	Disk    string
+	Reasons []string
+}
+
+func (e *StalePlanError) Error() string {
+	return fmt.Sprintf("plan no longer matches %s: %s", e.Disk, strings.Join(e.Reasons, "; "))
+}
+
+func NewStalePlanError(disk string, reasons []string) error {
+	return &StalePlanError{
+		Disk:    disk,
+		Reasons: reasons,
+	}
+}
+
+// ProtectedPartitionError is returned when a resize would shrink, grow, move,
+// renumber or remove a partition that Options.ExcludePartitions protects, so
+// that it is refused before anything is changed.
+type ProtectedPartitionError struct {
+	Disk       string
+	Partitions []string
+}
+
+func (e *ProtectedPartitionError) Error() string {
+	return fmt.Sprintf("resize of %s would change protected partitions: %s", e.Disk, strings.Join(e.Partitions, "; "))
+}
+
+func NewProtectedPartitionError(disk string, partitions []string) error {
+	return &ProtectedPartitionError{
+		Disk:       disk,
+		Partitions: partitions,
+	}
+}
+
+// DryRunProblem is a step of a resize that a dry run found would fail: in
+// Phase, one of the Phase constants, or PhaseCheckSources, for Partition, by
+// its number. Tool, if set, is the external tool the step runs that is not
+// found.
+type DryRunProblem struct {
+	Phase     string `json:"phase"`
+	Partition int    `json:"partition,omitempty"`
+	Tool      string `json:"tool,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+func (p DryRunProblem) String() string {
+	if p.Partition == 0 {
+		return fmt.Sprintf("%s: %s", p.Phase, p.Detail)
+	}
+	return fmt.Sprintf("%s of partition %d: %s", p.Phase, p.Partition, p.Detail)
+}
+
+// DryRunError is returned by a dry run that found the resize would fail,
+// listing the steps it would fail at, in the order it would reach them.
+type DryRunError struct {
+	Device   string
+	Problems []DryRunProblem
+}
+
+func (e *DryRunError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("resize of %s would fail at %s", e.Device, strings.Join(problems, "; "))
+}
+
+func NewDryRunError(device string, problems []DryRunProblem) error {
+	return &DryRunError{
+		Device:   device,
+		Problems: problems,
+	}
+}
+
+// BootPartitionError is returned when a resize would shrink, move or renumber
+// a boot partition, such as the ESP or BIOS boot partition, without
+// Options.ForceBootPartitions, so that it is refused before anything is
+// changed: firmware and boot loaders may no longer find one that is changed.
+type BootPartitionError struct {
+	Disk       string
+	Partitions []string
+}
+
+func (e *BootPartitionError) Error() string {
+	return fmt.Sprintf("resize of %s would shrink, move or renumber boot partitions, which can leave the system unable to boot: %s", e.Disk, strings.Join(e.Partitions, "; "))
+}
+
+func NewBootPartitionError(disk string, partitions []string) error {
+	return &BootPartitionError{
+		Disk:       disk,
+		Partitions: partitions,
+	}
+}
+
+// FilesystemCheckError is returned when a resize completed, but checking the
+// filesystems it resized or copied afterwards found problems with them.
+type FilesystemCheckError struct {
+	Device   string
+	Problems []string
+}
+
+func (e *FilesystemCheckError) Error() string {
+	return fmt.Sprintf("resize of %s completed, but checking its filesystems found problems: %s", e.Device, strings.Join(e.Problems, "; "))
+}
+
+func NewFilesystemCheckError(device string, problems []string) error {
+	return &FilesystemCheckError{
+		Device:   device,
+		Problems: problems,
+	}
+}
@@ -0,0 +1,436 @@
+package partitionresizer
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// efiFirmwareDir is where Linux shows the UEFI firmware, there only on a
+// system booted with it, whose boot entries efibootmgr can then change.
+var efiFirmwareDir = "/sys/firmware/efi"
+
+// ESPResult is the validation of an EFI System Partition copied to a new
+// location: that its copy has every boot loader of the original, that it kept
+// the type GUID and attributes of the original once the copy replaced it, and
+// the boot entries re-registered to point at it, see Options.UpdateBootEntries.
+type ESPResult struct {
+	// Partition is the number the ESP has once the resize is done.
+	Partition int `json:"partition"`
+	// Loaders are the EFI executables under EFI/ of the original, such as
+	// EFI/BOOT/BOOTX64.EFI, all of which the copy must have.
+	Loaders []string `json:"loaders,omitempty"`
+	// Missing are the loaders the copy lacks, or has of another size; any
+	// fails the resize before the cutover.
+	Missing []string `json:"missing,omitempty"`
+	// Type and Attributes are the partition type GUID and GPT attributes
+	// the ESP has once the copy replaced the original.
+	Type       string `json:"type,omitempty"`
+	Attributes uint64 `json:"attributes,omitempty"`
+	// BootEntries are the UEFI boot entries re-registered, e.g.
+	// "Boot0001 debian \EFI\debian\shimx64.efi".
+	BootEntries []string `json:"bootEntries,omitempty"`
+	// Problems are what was found wrong with the ESP once the copy
+	// replaced the original, each also logged as a warning.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// espCopy is an EFI System Partition to be copied to a new location, with the
+// identity of the original in the GPT, which the copy is to keep, but for any
+// attributes Options.LegacyBootable changes.
+type espCopy struct {
+	r          partitionResizeTarget
+	final      int // number of the partition once the resize is done
+	typ        gpt.Type
+	guid       string
+	attributes uint64
+}
+
+// markBootEntries marks each partition to be copied to a new location to
+// have the UEFI boot entries on it re-registered, should it be an ESP, as
+// opts.UpdateBootEntries asks.
+func markBootEntries(resizes []partitionResizeTarget, opts Options) {
+	for i, r := range resizes {
+		if r.original.start != r.target.start {
+			resizes[i].updateBootEntries = opts.UpdateBootEntries
+		}
+	}
+}
+
+// findESPs returns the partitions of resizes copied to a new location whose
+// original is an EFI System Partition, as the GPT of d has them while the
+// originals are still in it.
+func findESPs(d *disk.Disk, resizes []partitionResizeTarget, preserveNumbers bool) ([]espCopy, error) {
+	table, err := readGPT(d)
+	if err != nil {
+		return nil, err
+	}
+	sectorSize := int64(table.LogicalSectorSize)
+	var esps []espCopy
+	for _, r := range resizes {
+		if r.original.start == r.target.start {
+			continue
+		}
+		for _, p := range table.Partitions {
+			if int64(p.Start)*sectorSize != r.original.start || !strings.EqualFold(string(p.Type), string(gpt.EFISystemPartition)) {
+				continue
+			}
+			e := espCopy{r: r, final: r.target.number, typ: cmp.Or(r.partitionType, p.Type), guid: p.GUID, attributes: r.finalAttributes(p.Attributes)}
+			if preserveNumbers {
+				e.final = r.original.number
+			}
+			esps = append(esps, e)
+		}
+	}
+	return esps, nil
+}
+
+// validateESPs checks that the copy of each EFI System Partition of resizes
+// has every boot loader the original has, see espLoaders, each of the same
+// size, returning an error naming those it lacks, so that the resize stops
+// before the cutover rather than leave the system without them.
+func validateESPs(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, preserveNumbers bool) ([]ESPResult, error) {
+	esps, err := findESPs(d, resizes, preserveNumbers)
+	if err != nil {
+		return nil, fmt.Errorf("find EFI system partitions: %w", err)
+	}
+	var results []ESPResult
+	for _, e := range esps {
+		src, err := d.GetFilesystem(e.r.original.number)
+		if err != nil {
+			return results, fmt.Errorf("read EFI system partition %d: %w", e.r.original.number, err)
+		}
+		dst, err := d.GetFilesystem(e.r.target.number)
+		if err != nil {
+			return results, fmt.Errorf("read copy of EFI system partition %d: %w", e.r.original.number, err)
+		}
+		loaders, err := espLoaders(src)
+		if err != nil {
+			return results, fmt.Errorf("list boot loaders of EFI system partition %d: %w", e.r.original.number, err)
+		}
+		res := ESPResult{Partition: e.final}
+		for _, l := range loaders {
+			res.Loaders = append(res.Loaders, l.path)
+			if info, err := dst.Stat(l.path); err != nil || info.Size() != l.size {
+				res.Missing = append(res.Missing, l.path)
+			}
+		}
+		results = append(results, res)
+		if len(res.Missing) > 0 {
+			return results, fmt.Errorf("copy of EFI system partition %d lacks boot loaders %s", e.r.original.number, strings.Join(res.Missing, ", "))
+		}
+		if len(loaders) == 0 {
+			logger.Warn("EFI system partition holds no boot loaders under EFI, none to check its copy for", "partition", e.r.original.number)
+			continue
+		}
+		logger.Info("copy of EFI system partition has its boot loaders", "partition", e.r.original.number, "target", e.r.target.number, "loaders", len(loaders))
+	}
+	return results, nil
+}
+
+// espLoader is an EFI executable on an ESP.
+type espLoader struct {
+	path string
+	size int64
+}
+
+// espLoaders returns the EFI executables under the EFI directory of fsys,
+// whatever the case of their names, as FAT ignores it: the fallback loader
+// under EFI/BOOT, and those of each operating system, under EFI/<vendor>.
+func espLoaders(fsys fs.FS) ([]espLoader, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var loaders []espLoader
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.EqualFold(entry.Name(), "EFI") {
+			continue
+		}
+		err := fs.WalkDir(fsys, entry.Name(), func(p string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || !strings.EqualFold(path.Ext(p), ".efi") {
+				return err
+			}
+			info, err := fs.Stat(fsys, p)
+			if err != nil {
+				return err
+			}
+			loaders = append(loaders, espLoader{path: p, size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loaders, nil
+}
+
+// checkESPs checks, once the copy of each of esps replaced its original, that
+// it has the type GUID, partition GUID and attributes of the original, and,
+// for those marked to, re-registers the boot entries on it, see
+// updateBootEntries. It changes nothing should it find a problem, which is
+// warned of and returned in the ESPResult, as the resize is done by then.
+func checkESPs(ctx context.Context, logger *slog.Logger, d *disk.Disk, esps []espCopy) []ESPResult {
+	if len(esps) == 0 {
+		return nil
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		logger.Warn("cannot read partition table to check EFI system partitions", "error", err)
+		return nil
+	}
+	sectorSize := int64(table.LogicalSectorSize)
+	var results []ESPResult
+	for _, e := range esps {
+		res := ESPResult{Partition: e.final}
+		problem := func(format string, args ...any) {
+			res.Problems = append(res.Problems, fmt.Sprintf(format, args...))
+			logger.Warn("EFI system partition may not boot: "+res.Problems[len(res.Problems)-1], "partition", e.final)
+		}
+		i := slices.IndexFunc(table.Partitions, func(p *gpt.Partition) bool {
+			return p.Type != gpt.Unused && int64(p.Start)*sectorSize == e.r.target.start
+		})
+		if i < 0 {
+			problem("not found in the partition table at %d", e.r.target.start)
+			results = append(results, res)
+			continue
+		}
+		p := table.Partitions[i]
+		res.Type, res.Attributes = string(p.Type), p.Attributes
+		if !strings.EqualFold(string(p.Type), string(e.typ)) {
+			problem("has type %s, not %s", p.Type, e.typ)
+		}
+		if !strings.EqualFold(p.GUID, e.guid) {
+			problem("has partition GUID %s, not %s", p.GUID, e.guid)
+		}
+		if p.Attributes != e.attributes {
+			problem("has attributes %#x, not %#x", p.Attributes, e.attributes)
+		}
+		if e.r.updateBootEntries && len(res.Problems) == 0 {
+			res.BootEntries = registerBootEntries(ctx, logger, d, p, problem)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// registerBootEntries re-registers the UEFI boot entries on partition p of d,
+// see updateBootEntries, should d be a block device of a system booted with
+// UEFI: the boot entries of an image file, or of a disk of a system booted
+// otherwise, are not those of the running firmware. It is best effort, each
+// failure being passed to problem.
+func registerBootEntries(ctx context.Context, logger *slog.Logger, d *disk.Disk, p *gpt.Partition, problem func(string, ...any)) []string {
+	device := d.Backend.Path()
+	if device == "" {
+		logger.Info("disk backend has no path, not updating boot entries", "partition", p.Index)
+		return nil
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		problem("cannot update boot entries: %v", err)
+		return nil
+	}
+	deviceType, err := disk.DetermineDeviceType(f)
+	_ = f.Close()
+	if err != nil {
+		problem("cannot update boot entries: %v", err)
+		return nil
+	}
+	if deviceType != disk.DeviceTypeBlockDevice {
+		logger.Info("not a block device, not updating boot entries", "disk", device, "partition", p.Index)
+		return nil
+	}
+	if _, err := os.Stat(efiFirmwareDir); err != nil {
+		problem("cannot update boot entries, system not booted with UEFI: %v", err)
+		return nil
+	}
+	fsys, err := d.GetFilesystem(p.Index)
+	if err != nil {
+		problem("cannot update boot entries: %v", err)
+		return nil
+	}
+	updated, err := updateBootEntries(ctx, logger, device, fsys, p, problem)
+	if err != nil {
+		problem("cannot update boot entries: %v", err)
+	}
+	return updated
+}
+
+// bootEntryPattern matches a boot entry, as efibootmgr -v lists it, that boots
+// a loader on a GPT partition, before version 18 and since:
+//
+//	Boot0001* debian	HD(1,GPT,<guid>,0x800,0x100000)/File(\EFI\debian\shimx64.efi)
+//	Boot0001* debian	HD(1,GPT,<guid>,0x800,0x100000)/\EFI\debian\shimx64.efi
+var bootEntryPattern = regexp.MustCompile(`^Boot([0-9A-Fa-f]{4})(\*?)\s+(.*?)\s+HD\((\d+),GPT,([0-9A-Fa-f-]+),0x([0-9A-Fa-f]+),0x([0-9A-Fa-f]+)\)/(?:File\()?([^)\s]+)`)
+
+// bootEntry is a boot entry efibootmgr lists, see bootEntryPattern.
+type bootEntry struct {
+	number     string
+	active     bool
+	label      string
+	partition  int
+	guid       string
+	start, end uint64 // in sectors
+	loader     string
+	// data is what the entry passes its loader, as efibootmgr -v lists it,
+	// such as the command line of a kernel booted directly
+	data string
+}
+
+// bootNumberPattern matches the number of any boot entry efibootmgr lists.
+var bootNumberPattern = regexp.MustCompile(`^Boot([0-9A-Fa-f]{4})`)
+
+// parseBootEntries returns the boot entries in the output of efibootmgr -v
+// that boot a loader on a GPT partition, and the boot order, e.g. 0001,0000.
+func parseBootEntries(output string) ([]bootEntry, string) {
+	var (
+		entries []bootEntry
+		order   string
+	)
+	for _, line := range strings.Split(output, "\n") {
+		if rest, ok := strings.CutPrefix(line, "BootOrder:"); ok {
+			order = strings.TrimSpace(rest)
+			continue
+		}
+		m := bootEntryPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		partition, _ := strconv.Atoi(m[4])
+		start, err := strconv.ParseUint(m[6], 16, 64)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseUint(m[7], 16, 64)
+		if err != nil || size == 0 {
+			continue
+		}
+		entries = append(entries, bootEntry{
+			number:    m[1],
+			active:    m[2] == "*",
+			label:     m[3],
+			partition: partition,
+			guid:      m[5],
+			start:     start,
+			end:       start + size - 1,
+			loader:    m[8],
+			data:      strings.TrimSpace(strings.TrimPrefix(line[len(m[0]):], ")")),
+		})
+	}
+	return entries, order
+}
+
+// updateBootEntries re-registers, with efibootmgr, each UEFI boot entry for a
+// loader on the partition with the GUID of ESP p, device being its disk, whose
+// number, start or size is no longer that of p, as it is once the copy of an
+// ESP replaced its original: an entry with the same label and loader, for p
+// as it is now, is created under a number no entry has, and only then is the
+// entry deleted, its replacement taking its place in the boot order. An entry
+// whose loader fsys, the filesystem of p, does not have, or that passes its
+// loader anything, such as the command line of a kernel booted directly,
+// which efibootmgr cannot be given as it lists it, is left as it is, and
+// passed to problem.
+func updateBootEntries(ctx context.Context, logger *slog.Logger, device string, fsys fs.FS, p *gpt.Partition, problem func(string, ...any)) ([]string, error) {
+	output, err := runToolOutput(ctx, "efibootmgr", "-v")
+	if err != nil {
+		return nil, err
+	}
+	entries, order := parseBootEntries(output)
+	used := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		if m := bootNumberPattern.FindStringSubmatch(line); m != nil {
+			used[strings.ToUpper(m[1])] = true
+		}
+	}
+	var updated []string
+	for _, e := range entries {
+		if !strings.EqualFold(e.guid, p.GUID) || e.partition == p.Index && e.start == p.Start && e.end == p.End {
+			continue
+		}
+		loader := strings.TrimPrefix(strings.ReplaceAll(e.loader, `\`, "/"), "/")
+		if _, err := fs.Stat(fsys, loader); err != nil {
+			problem("boot entry Boot%s (%s) boots %s, which is not on the partition, not updating it", e.number, e.label, e.loader)
+			continue
+		}
+		if e.data != "" {
+			problem("boot entry Boot%s (%s) passes %s to its loader, which cannot be kept, not updating it", e.number, e.label, e.data)
+			continue
+		}
+		number := ""
+		for n := 0; n <= 0xffff && number == ""; n++ {
+			if s := fmt.Sprintf("%04X", n); !used[s] {
+				number = s
+			}
+		}
+		if number == "" {
+			return updated, fmt.Errorf("no boot entry number free to re-register Boot%s (%s) under", e.number, e.label)
+		}
+		args := []string{"-q", "--create-only", "-b", number, "-d", device, "-p", strconv.Itoa(p.Index), "-L", e.label, "-l", e.loader}
+		if !e.active {
+			args = append(args, "-A")
+		}
+		if err := runTool(ctx, "efibootmgr", args...); err != nil {
+			return updated, fmt.Errorf("boot entry Boot%s (%s) not re-registered: %w", e.number, e.label, err)
+		}
+		used[number] = true
+		if err := runTool(ctx, "efibootmgr", "-q", "-b", e.number, "-B"); err != nil {
+			return updated, fmt.Errorf("boot entry Boot%s (%s) re-registered as Boot%s, but not deleted: %w", e.number, e.label, number, err)
+		}
+		order = replaceBootNumber(order, e.number, number)
+		logger.Info("re-registered boot entry", "entry", "Boot"+e.number, "as", "Boot"+number, "label", e.label, "partition", p.Index, "loader", e.loader)
+		updated = append(updated, fmt.Sprintf("Boot%s %s %s", number, e.label, e.loader))
+	}
+	if len(updated) > 0 && order != "" {
+		if err := runTool(ctx, "efibootmgr", "-q", "-o", order); err != nil {
+			return updated, fmt.Errorf("restore boot order %s: %w", order, err)
+		}
+	}
+	return updated, nil
+}
+
+// replaceBootNumber returns boot order order, e.g. 0001,0000, with boot entry
+// number old replaced by number.
+func replaceBootNumber(order, old, number string) string {
+	numbers := strings.Split(order, ",")
+	for i, n := range numbers {
+		if strings.EqualFold(n, old) {
+			numbers[i] = number
+		}
+	}
+	return strings.Join(numbers, ",")
+}
+
+// addESPs records esps on res, which may be nil, each merged into what was
+// recorded already of the same partition.
+func (res *Result) addESPs(esps []ESPResult) {
+	if res == nil {
+		return
+	}
+	for _, e := range esps {
+		i := slices.IndexFunc(res.ESP, func(r ESPResult) bool { return r.Partition == e.Partition })
+		if i < 0 {
+			res.ESP = append(res.ESP, e)
+			continue
+		}
+		r := &res.ESP[i]
+		if e.Loaders != nil {
+			r.Loaders, r.Missing = e.Loaders, e.Missing
+		}
+		if e.Type != "" {
+			r.Type, r.Attributes = e.Type, e.Attributes
+		}
+		r.BootEntries = append(r.BootEntries, e.BootEntries...)
+		r.Problems = append(r.Problems, e.Problems...)
+	}
+}
@@ -0,0 +1,182 @@
+package partitionresizer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const espGUID = "6A1B2C3D-0000-4000-8000-00000000E5B1"
+
+// TestValidateESPs copies an ESP to a partition missing one of its loaders,
+// which must fail validation, then adds it, and checks the ESP once it
+// replaced its original, with the attributes of the original and without.
+func TestValidateESPs(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 128*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 40 * MB, Type: gpt.EFISystemPartition, Name: "EFI System", GUID: espGUID, Attributes: 1},
+		{Index: 2, Start: 41 * MB / 512, Size: 64 * MB, Type: gpt.LinuxFilesystem, Name: "EFI System_resized", Attributes: 1},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{{
+		original: partitionData{number: 1, start: 1 * MB, size: 40 * MB},
+		target:   partitionData{number: 2, start: 41 * MB, size: 64 * MB},
+	}}
+	write := func(fs filesystem.FileSystem, p, data string) {
+		t.Helper()
+		if err := fs.Mkdir(filepath.Dir(p)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(src, "/EFI/BOOT/BOOTX64.EFI", "fallback")
+	write(src, "/EFI/debian/shimx64.efi", "shim")
+	write(src, "/EFI/debian/grub.cfg", "config")
+	dst, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 2, FSType: filesystem.TypeFat32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(dst, "/EFI/BOOT/BOOTX64.EFI", "fallback")
+
+	esps, err := validateESPs(slog.Default(), d, resizes, true)
+	if err == nil || !strings.Contains(err.Error(), "EFI/debian/shimx64.efi") {
+		t.Errorf("validateESPs() of a copy without shimx64.efi error = %v, want it named", err)
+	}
+	want := ESPResult{Partition: 1, Loaders: []string{"EFI/BOOT/BOOTX64.EFI", "EFI/debian/shimx64.efi"}, Missing: []string{"EFI/debian/shimx64.efi"}}
+	if len(esps) != 1 || !reflect.DeepEqual(esps[0], want) {
+		t.Errorf("validateESPs() = %+v, want %+v", esps, want)
+	}
+	write(dst, "/EFI/debian/shimx64.efi", "shim")
+	if esps, err = validateESPs(slog.Default(), d, resizes, false); err != nil || len(esps) != 1 || esps[0].Partition != 2 || esps[0].Missing != nil {
+		t.Errorf("validateESPs() = %+v, %v, want partition 2 missing nothing", esps, err)
+	}
+
+	// the cutover, with the attributes of the original and then without
+	copies, err := findESPs(d, resizes, false)
+	if err != nil || len(copies) != 1 {
+		t.Fatalf("findESPs() = %+v, %v, want partition 1", copies, err)
+	}
+	for _, attributes := range []uint64{1, 0} {
+		table, err := readGPT(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.Partitions = []*gpt.Partition{{Index: 2, Start: 41 * MB / 512, Size: 64 * MB, Type: gpt.EFISystemPartition, Name: "EFI System", GUID: espGUID, Attributes: attributes}}
+		if err := d.Partition(table); err != nil {
+			t.Fatal(err)
+		}
+		results := checkESPs(context.Background(), slog.Default(), d, copies)
+		if len(results) != 1 || results[0].Type != string(gpt.EFISystemPartition) || results[0].Attributes != attributes {
+			t.Fatalf("checkESPs() = %+v, want partition 2 of type EFI system", results)
+		}
+		if problems := results[0].Problems; attributes == 1 && len(problems) != 0 || attributes == 0 && !slices.Equal(problems, []string{"has attributes 0x0, not 0x1"}) {
+			t.Errorf("checkESPs() with attributes %#x found problems %q", attributes, problems)
+		}
+	}
+}
+
+// stdoutExecRunner is an ExecRunner that runs nothing, recording each tool it
+// is asked to run, and writes out to the stdout of efibootmgr -v.
+type stdoutExecRunner struct {
+	runs [][]string
+	out  string
+}
+
+func (f *stdoutExecRunner) Run(_ context.Context, cmd string, args []string, _ time.Duration, stdout, _ io.Writer) error {
+	f.runs = append(f.runs, append([]string{cmd}, args...))
+	if slices.Equal(args, []string{"-v"}) {
+		_, _ = io.WriteString(stdout, f.out)
+	}
+	return nil
+}
+
+// TestUpdateBootEntries re-registers the boot entries efibootmgr lists for an
+// ESP copied to partition 2: one as efibootmgr 18 lists it, and one as older
+// versions do, each under a free number before its original is deleted,
+// leaving alone those already for it as it is, on another partition, not on a
+// disk, for a loader it does not have, and passing its loader arguments.
+func TestUpdateBootEntries(t *testing.T) {
+	fake := &stdoutExecRunner{out: strings.Join([]string{
+		"BootCurrent: 0001",
+		"Timeout: 1 seconds",
+		"BootOrder: 0001,0003,0000,0002",
+		`Boot0000* UEFI Shell	HD(1,GPT,` + strings.ToLower(espGUID) + `,0x800,0x14000)/\EFI\BOOT\BOOTX64.EFI`,
+		`Boot0001* debian	HD(1,GPT,` + espGUID + `,0x800,0x14000)/File(\EFI\debian\shimx64.efi)`,
+		`Boot0002  Windows Boot Manager	HD(1,GPT,11111111-2222-4333-8444-555555555555,0x800,0x14000)/File(\EFI\Microsoft\Boot\bootmgfw.efi)`,
+		`Boot0003  old debian	HD(1,GPT,` + espGUID + `,0x800,0x14000)/File(\EFI\old\grubx64.efi)`,
+		`Boot0004* current	HD(2,GPT,` + espGUID + `,0x14800,0x20000)/File(\EFI\BOOT\BOOTX64.EFI)`,
+		`Boot0005* UEFI PXEv4	PciRoot(0x0)/Pci(0x3,0x0)/MAC(525400123456,1)/IPv4(0.0.0.0,0,DHCP,0.0.0.0,0.0.0.0,0.0.0.0)`,
+		`Boot0007* debian single	HD(1,GPT,` + espGUID + `,0x800,0x14000)/File(\EFI\debian\shimx64.efi)s.i.n.g.l.e.`,
+	}, "\n")}
+	ctx := withToolRunner(context.Background(), newToolRunner(Options{ExecRunner: fake}))
+	fsys := fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI":   {Data: []byte("fallback")},
+		"EFI/debian/shimx64.efi": {Data: []byte("shim")},
+	}
+	p := &gpt.Partition{Index: 2, Start: 0x14800, End: 0x14800 + 0x20000 - 1, GUID: espGUID}
+	var problems []string
+	problem := func(format string, args ...any) { problems = append(problems, format) }
+	updated, err := updateBootEntries(ctx, slog.Default(), "/dev/sda", fsys, p, problem)
+	if err != nil {
+		t.Fatalf("updateBootEntries() error: %v", err)
+	}
+	wantUpdated := []string{`Boot0006 UEFI Shell \EFI\BOOT\BOOTX64.EFI`, `Boot0008 debian \EFI\debian\shimx64.efi`}
+	if !slices.Equal(updated, wantUpdated) {
+		t.Errorf("updateBootEntries() = %q, want %q", updated, wantUpdated)
+	}
+	if len(problems) != 2 || !strings.Contains(problems[0], "not on the partition") || !strings.Contains(problems[1], "to its loader") {
+		t.Errorf("updateBootEntries() problems = %q, want Boot0003 and Boot0007 reported", problems)
+	}
+	want := [][]string{
+		{"efibootmgr", "-v"},
+		{"efibootmgr", "-q", "--create-only", "-b", "0006", "-d", "/dev/sda", "-p", "2", "-L", "UEFI Shell", "-l", `\EFI\BOOT\BOOTX64.EFI`},
+		{"efibootmgr", "-q", "-b", "0000", "-B"},
+		{"efibootmgr", "-q", "--create-only", "-b", "0008", "-d", "/dev/sda", "-p", "2", "-L", "debian", "-l", `\EFI\debian\shimx64.efi`},
+		{"efibootmgr", "-q", "-b", "0001", "-B"},
+		{"efibootmgr", "-q", "-o", "0008,0003,0006,0002"},
+	}
+	if !reflect.DeepEqual(fake.runs, want) {
+		t.Errorf("updateBootEntries() ran %q, want %q", fake.runs, want)
+	}
+}
+
+func TestParseBootEntries(t *testing.T) {
+	entries, order := parseBootEntries("BootOrder: 0003\nBoot0003  spare\tHD(4,GPT," + espGUID + ",0x800,0x1000)/File(\\EFI\\spare\\loader.efi)\n")
+	want := []bootEntry{{number: "0003", label: "spare", partition: 4, guid: espGUID, start: 0x800, end: 0x17ff, loader: `\EFI\spare\loader.efi`}}
+	if order != "0003" || !reflect.DeepEqual(entries, want) {
+		t.Errorf("parseBootEntries() = %+v, %q, want %+v, 0003", entries, order, want)
+	}
+}
@@ -0,0 +1,167 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// throughputSampleSize is how much of the disk is read to measure its
+// throughput, for an estimate not given one.
+const throughputSampleSize = 64 * MB
+
+// CopyMethod is how a partition is copied to its new location.
+type CopyMethod string
+
+const (
+	// CopyRaw copies all of the partition byte for byte, as for LUKS,
+	// squashfs and unknown filesystems, and verifies it as Options.Verify
+	// says.
+	CopyRaw CopyMethod = "raw"
+	// CopyFiles copies the files of an ext4 or FAT32 filesystem into a new
+	// one, and then compares the two.
+	CopyFiles CopyMethod = "files"
+	// CopySwap recreates swap, copying nothing.
+	CopySwap CopyMethod = "swap"
+)
+
+// PlanEstimate is how much work a resize is, see Estimate: the bytes it reads
+// and writes, partition by partition, and roughly how long that takes at
+// Throughput bytes per second. Durations are in nanoseconds in JSON.
+type PlanEstimate struct {
+	Disk       string              `json:"disk"`
+	Partitions []PartitionEstimate `json:"partitions"`
+	Read       int64               `json:"read"`
+	Write      int64               `json:"write"`
+	Throughput int64               `json:"throughput"`
+	// Measured is set if Throughput was measured by reading the disk,
+	// rather than given.
+	Measured bool          `json:"measured,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// PartitionEstimate is how much work resizing a single partition is.
+type PartitionEstimate struct {
+	Partition int    `json:"partition"`
+	Label     string `json:"label"`
+	// Relocated is set if the partition is copied to a new location, with
+	// Copy; otherwise it is shrunk or grown where it is, and Read and Write
+	// leave out what its filesystem moves within itself to shrink.
+	Relocated bool       `json:"relocated"`
+	Copy      CopyMethod `json:"copy,omitempty"`
+	Read      int64      `json:"read"`
+	Write     int64      `json:"write"`
+}
+
+// Estimate works out how much work applying p is, without changing anything:
+// which partitions are copied to a new location and which are changed in
+// place, the bytes read and written to copy and verify them, and how long
+// that takes at throughput bytes per second, read and written alike. With a
+// throughput of 0, it is measured by reading the start of the disk. The
+// duration is a rough guide for scheduling: it leaves out the filesystem
+// checks, and shrinking and growing filesystems in place.
+func Estimate(p *Plan, throughput int64) (*PlanEstimate, error) {
+	shrinks, grows := p.changes()
+	d, _, resizes, err := openAndPlan(p.disk(p.Options.logger(), "", "/dev"), shrinks, grows, true, p.Options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Backend.Close() }()
+	return estimate(d, resizes, throughput)
+}
+
+// estimate returns the estimate of resizes of d, see Estimate.
+func estimate(d *disk.Disk, resizes []partitionResizeTarget, throughput int64) (*PlanEstimate, error) {
+	e := &PlanEstimate{Disk: d.Backend.Path(), Partitions: []PartitionEstimate{}, Throughput: throughput}
+	for _, r := range resizes {
+		pe, err := estimatePartition(d, r)
+		if err != nil {
+			return nil, err
+		}
+		e.Partitions = append(e.Partitions, pe)
+		e.Read += pe.Read
+		e.Write += pe.Write
+	}
+	if e.Throughput <= 0 {
+		measured, err := measureThroughput(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure throughput of %s: %v", e.Disk, err)
+		}
+		e.Throughput = measured
+		e.Measured = true
+	}
+	e.Duration = time.Duration(float64(e.Read+e.Write) / float64(e.Throughput) * float64(time.Second))
+	return e, nil
+}
+
+// estimatePartition returns the estimate of r, reading just enough of the
+// original partition to tell how it is copied, the same way copyFilesystems
+// does.
+func estimatePartition(d *disk.Disk, r partitionResizeTarget) (PartitionEstimate, error) {
+	pe := PartitionEstimate{Partition: r.original.number, Label: r.original.label}
+	if r.original.start == r.target.start {
+		return pe, nil
+	}
+	pe.Relocated = true
+	if _, isSwap, err := readSwapHeader(d.Backend, r.original.start); err != nil {
+		return pe, fmt.Errorf("failed to check partition %s for swap: %v", r.original.label, err)
+	} else if isSwap {
+		pe.Copy = CopySwap
+		return pe, nil
+	}
+	_, isLUKS, err := readLUKSHeader(d.Backend, r.original.start)
+	if err != nil {
+		return pe, fmt.Errorf("failed to check partition %s for LUKS: %v", r.original.label, err)
+	}
+	if !isLUKS {
+		// a file-by-file copy writes what the filesystem holds, and then
+		// reads it back from both to compare them
+		if usage, err := readExt4Usage(d.Backend, r.original.start); err == nil {
+			pe.Copy = CopyFiles
+			pe.Read = 3 * usage.used()
+			pe.Write = usage.used()
+			return pe, nil
+		}
+		if fs, err := d.GetFilesystem(r.original.number); err == nil && fs.Type() == filesystem.TypeFat32 {
+			pe.Copy = CopyFiles
+			pe.Read = 3 * r.original.size
+			pe.Write = r.original.size
+			return pe, nil
+		}
+	}
+	pe.Copy = CopyRaw
+	pe.Read = r.original.size
+	pe.Write = r.original.size
+	switch r.verify {
+	case "", VerifyFull:
+		pe.Read += r.original.size
+	case VerifySampled:
+		pe.Read += 2 * min(r.original.size, (sampleExtents+2)*sampleExtentSize)
+	}
+	return pe, nil
+}
+
+// measureThroughput returns the bytes per second d reads at, timing a read of
+// the start of the disk, past the page cache where the backend allows.
+func measureThroughput(d *disk.Disk) (int64, error) {
+	length := min(int64(throughputSampleSize), d.Size)
+	if length <= 0 {
+		return 0, fmt.Errorf("disk is empty")
+	}
+	if f, err := d.Backend.Sys(); err == nil {
+		_ = dropCachedRange(f, 0, length)
+	}
+	buf := make([]byte, copyBufSize)
+	started := time.Now()
+	for read := int64(0); read < length; {
+		n := min(int64(len(buf)), length-read)
+		if _, err := d.Backend.ReadAt(buf[:n], read); err != nil {
+			return 0, err
+		}
+		read += n
+	}
+	elapsed := max(time.Since(started), time.Microsecond)
+	return int64(float64(length) / elapsed.Seconds()), nil
+}
@@ -0,0 +1,99 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestEstimate estimates a resize that copies an ext4 partition file by file,
+// copies an unknown one byte for byte with sampled verification, and shrinks a
+// third in place.
+func TestEstimate(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 128*MB); err != nil {
+		t.Fatal(err)
+	}
+	ext4 := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	raw := partitionData{number: 2, label: "blob", start: 9 * MB, size: 32 * MB, end: 41*MB - 1}
+	shrunk := partitionData{number: 3, label: "shrinker", start: 41 * MB, size: 16 * MB, end: 57*MB - 1}
+	resizes := []partitionResizeTarget{
+		{original: ext4, target: partitionData{number: 4, label: "data_resized4", start: 60 * MB, size: 16 * MB, end: 76*MB - 1}},
+		{original: raw, target: partitionData{number: 5, label: "blob_resized5", start: 76 * MB, size: 48 * MB, end: 124*MB - 1}, verify: VerifySampled},
+		{original: shrunk, target: partitionData{number: 3, label: "shrinker", start: 41 * MB, size: 8 * MB, end: 49*MB - 1}},
+	}
+
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: sectorSize, PhysicalSectorSize: sectorSize}
+	for _, p := range []partitionData{ext4, raw, shrunk} {
+		table.Partitions = append(table.Partitions, &gpt.Partition{Index: p.number, Start: uint64(p.start / sectorSize), Size: uint64(p.size), Type: gpt.LinuxFilesystem, Name: p.label})
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	// an ext4 filesystem of 8 MB with 6 MB of it free
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[0x18:], 2) // 4 KiB blocks
+	binary.LittleEndian.PutUint32(sb[0x04:], uint32(8*MB/(4*KB)))
+	binary.LittleEndian.PutUint32(sb[0x0c:], uint32(6*MB/(4*KB)))
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(sb, ext4.start+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := estimate(d, resizes, 10*MB)
+	if err != nil {
+		t.Fatalf("estimate() error: %v", err)
+	}
+	sampled := int64(2 * (sampleExtents + 2) * sampleExtentSize)
+	want := []PartitionEstimate{
+		{Partition: 1, Label: "data", Relocated: true, Copy: CopyFiles, Read: 3 * 2 * MB, Write: 2 * MB},
+		{Partition: 2, Label: "blob", Relocated: true, Copy: CopyRaw, Read: 32*MB + sampled, Write: 32 * MB},
+		{Partition: 3, Label: "shrinker"},
+	}
+	if len(e.Partitions) != len(want) {
+		t.Fatalf("estimate has %d partitions, want %d: %+v", len(e.Partitions), len(want), e.Partitions)
+	}
+	for i := range want {
+		if e.Partitions[i] != want[i] {
+			t.Errorf("partition estimate %d is %+v, want %+v", i, e.Partitions[i], want[i])
+		}
+	}
+	if e.Read != 38*MB+sampled || e.Write != 34*MB {
+		t.Errorf("estimate reads %d and writes %d bytes, want %d and %d", e.Read, e.Write, 38*MB+sampled, 34*MB)
+	}
+	wantDuration := time.Duration(float64(e.Read+e.Write) / float64(10*MB) * float64(time.Second))
+	if e.Throughput != 10*MB || e.Measured || e.Duration != wantDuration {
+		t.Errorf("estimate takes %s at %d bytes/s (measured %v), want %s at %d bytes/s", e.Duration, e.Throughput, e.Measured, wantDuration, 10*MB)
+	}
+
+	e, err = estimate(d, resizes, 0)
+	if err != nil {
+		t.Fatalf("estimate() error: %v", err)
+	}
+	if !e.Measured || e.Throughput <= 0 || e.Duration <= 0 {
+		t.Errorf("estimate with measured throughput takes %s at %d bytes/s (measured %v), want a throughput measured", e.Duration, e.Throughput, e.Measured)
+	}
+}
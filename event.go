@@ -0,0 +1,74 @@
+package partitionresizer
+
+// EventKind is the kind of an Event.
+type EventKind string
+
+const (
+	// EventPlanComputed is passed once the resizes are planned, before
+	// anything is changed, with the plan.
+	EventPlanComputed EventKind = "plan-computed"
+	// EventFilesystemShrunk is passed for each filesystem shrunk, with the
+	// new size of its partition.
+	EventFilesystemShrunk EventKind = "filesystem-shrunk"
+	// EventPartitionCreated is passed for each partition created for a
+	// partition to be copied to, with where it is.
+	EventPartitionCreated EventKind = "partition-created"
+	// EventCopyProgress is passed as a partition is copied, with the bytes
+	// copied so far.
+	EventCopyProgress EventKind = "copy-progress"
+	// EventValidated is passed for each copy once it is verified and the
+	// validators accept it, with where it is.
+	EventValidated EventKind = "validated"
+	// EventCutover is passed once the partition table that replaces the
+	// originals with their copies, and grows partitions in place, is written.
+	EventCutover EventKind = "cutover"
+	// EventOldRemoved is passed, after EventCutover, for each original
+	// partition the cutover removed, with where it was.
+	EventOldRemoved EventKind = "old-removed"
+)
+
+// Event is something that happened during a resize, passed to
+// Options.OnEvent.
+type Event struct {
+	Kind EventKind `json:"kind"`
+	Disk string    `json:"disk"`
+	// Partition is the number of the partition, before the resize, the
+	// event is about; it is 0 for EventPlanComputed and EventCutover.
+	Partition int `json:"partition,omitempty"`
+	// Geometry is where the partition the event is about is, as each
+	// EventKind says.
+	Geometry *PartitionGeometry `json:"geometry,omitempty"`
+	// Copied and Total are the bytes copied so far and in all, for
+	// EventCopyProgress.
+	Copied int64 `json:"copied,omitempty"`
+	Total  int64 `json:"total,omitempty"`
+	// Plan is the resize of each partition as planned, for
+	// EventPlanComputed.
+	Plan []PartitionResult `json:"plan,omitempty"`
+}
+
+// eventProgress is a ProgressReporter that passes the bytes copied of each
+// partition on to emit, as EventCopyProgress, as well as everything on to the
+// ProgressReporter it embeds.
+type eventProgress struct {
+	ProgressReporter
+	emit func(Event)
+}
+
+func (p eventProgress) BytesCopied(partition int, copied, total int64) {
+	p.emit(Event{Kind: EventCopyProgress, Partition: partition, Copied: copied, Total: total})
+	p.ProgressReporter.BytesCopied(partition, copied, total)
+}
+
+func (p eventProgress) TotalBytesCopied(copied, total int64) {
+	reportTotal(p.ProgressReporter, copied, total)
+}
+
+func (p eventProgress) CopyDigests(partition int, digests []string) {
+	reportDigests(p.ProgressReporter, partition, digests)
+}
+
+// geometry returns where p is.
+func (p partitionData) geometry() *PartitionGeometry {
+	return &PartitionGeometry{Number: p.number, Start: p.start, End: p.start + p.size - 1, Size: p.size}
+}
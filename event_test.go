@@ -0,0 +1,81 @@
+package partitionresizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestResizeEvents(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	rejection := errors.New("no /etc/os-release")
+	// 8 MB is copied in two buffers
+	copied := []string{
+		fmt.Sprintf("copy-progress 1 %d/%d", copyBufSize, original.size),
+		fmt.Sprintf("copy-progress 1 %d/%d", 2*copyBufSize, original.size),
+	}
+	tests := []struct {
+		name   string
+		reject bool
+		want   []string
+	}{
+		{"completed", false, append(append([]string{"partition-created 1 at 2"}, copied...), "validated 1 at 2", "cutover 0", "old-removed 1 at 1")},
+		// the events of the phase that failed are not passed
+		{"rejected", true, append([]string{"partition-created 1 at 2"}, copied...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+				{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+			})
+			backend, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = backend.Close() }()
+			d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var events []string
+			opts := Options{
+				OnEvent: func(e Event) {
+					if e.Disk != diskPath {
+						t.Errorf("event %+v of disk %s, want %s", e, e.Disk, diskPath)
+					}
+					event := fmt.Sprintf("%s %d", e.Kind, e.Partition)
+					switch {
+					case e.Kind == EventCopyProgress:
+						event += fmt.Sprintf(" %d/%d", e.Copied, e.Total)
+					case e.Geometry != nil:
+						event += fmt.Sprintf(" at %d", e.Geometry.Number)
+					}
+					events = append(events, event)
+				},
+				Validators: []Validator{ValidatorFunc(func(CopiedPartition) error {
+					if tt.reject {
+						return rejection
+					}
+					return nil
+				})},
+			}
+			err = resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, opts, nil, nil)
+			if tt.reject != errors.Is(err, rejection) || !tt.reject && err != nil {
+				t.Fatalf("resize() error = %v, want rejected %v", err, tt.reject)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("events = %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
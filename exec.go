@@ -0,0 +1,157 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+// toolErrorTail is how much of the end of a failed tool's stderr its error
+// includes.
+const toolErrorTail = 2000
+
+// ExecRunner runs the external tools a resize needs, such as e2fsck,
+// resize2fs and cryptsetup, see Options.ExecRunner: e.g. to mock them in
+// tests, run them through sudo, or inside a helper container.
+type ExecRunner interface {
+	// Run runs cmd with args, copying what it writes to its stdout and
+	// stderr to stdout and stderr, and returns an error should it not run or
+	// exit non-zero. A positive timeout is the longest it may run before it
+	// is killed. Run should not kill a tool already running when ctx is
+	// done, as the tools change filesystems and partitions in place.
+	Run(ctx context.Context, cmd string, args []string, timeout time.Duration, stdout, stderr io.Writer) error
+}
+
+// LocalExecRunner is the ExecRunner used by default: it runs each tool as a
+// child process, found in the PATH.
+type LocalExecRunner struct{}
+
+// Run runs cmd, see ExecRunner. A tool killed for taking longer than timeout
+// returns an error saying so, wrapping its exit status.
+func (LocalExecRunner) Run(ctx context.Context, cmd string, args []string, timeout time.Duration, stdout, stderr io.Writer) error {
+	c := exec.Command(cmd, args...)
+	var tctx context.Context
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		c = exec.CommandContext(tctx, cmd, args...)
+	}
+	c.Stdout, c.Stderr = stdout, stderr
+	err := c.Run()
+	if err != nil && tctx != nil && tctx.Err() != nil {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// LookPath finds cmd in the PATH, see ToolLocator.
+func (LocalExecRunner) LookPath(cmd string) (string, error) {
+	return exec.LookPath(cmd)
+}
+
+// ToolLocator is implemented by an ExecRunner that can tell, without running
+// a tool, where it would run it from, so that a dry run can report a tool the
+// resize needs that is missing, see Options.DryRun. A dry run with an
+// ExecRunner that is not a ToolLocator takes every tool to be there.
+type ToolLocator interface {
+	// LookPath returns the path cmd would be run from, or an error should
+	// it not be found.
+	LookPath(cmd string) (string, error)
+}
+
+// toolRunner runs each external tool runTool runs with a context that carries
+// it, see withToolRunner, with the ExecRunner and timeout of the resize, and
+// records it for Result.Tools. A nil *toolRunner runs them with a
+// LocalExecRunner, without a timeout, and records nothing.
+type toolRunner struct {
+	runner ExecRunner
+	limit  time.Duration
+	logger *slog.Logger
+	mu     sync.Mutex
+	runs   []ToolRun
+}
+
+// newToolRunner returns the toolRunner for a resize with opts.
+func newToolRunner(opts Options) *toolRunner {
+	return &toolRunner{runner: opts.ExecRunner, limit: opts.ToolTimeout, logger: opts.logger()}
+}
+
+type toolRunnerKey struct{}
+
+// withToolRunner returns a copy of ctx carrying tools.
+func withToolRunner(ctx context.Context, tools *toolRunner) context.Context {
+	return context.WithValue(ctx, toolRunnerKey{}, tools)
+}
+
+// toolRunnerFrom returns the toolRunner ctx carries, if any.
+func toolRunnerFrom(ctx context.Context) *toolRunner {
+	tools, _ := ctx.Value(toolRunnerKey{}).(*toolRunner)
+	return tools
+}
+
+// execRunner returns the effective ExecRunner.
+func (t *toolRunner) execRunner() ExecRunner {
+	if t == nil || t.runner == nil {
+		return LocalExecRunner{}
+	}
+	return t.runner
+}
+
+// timeout returns the longest a tool may run, 0 for no limit.
+func (t *toolRunner) timeout() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return t.limit
+}
+
+// start logs, at LevelTrace, that the tool name is starting with args.
+func (t *toolRunner) start(name string, args []string) {
+	if t == nil {
+		return
+	}
+	t.logger.Log(context.Background(), LevelTrace, "running external tool", "tool", name, "args", args)
+}
+
+func (t *toolRunner) record(run ToolRun) {
+	if t == nil {
+		return
+	}
+	t.logger.Debug("ran external tool", "tool", run.Name, "args", run.Args, "duration", run.Duration, "output", run.Output, "error", run.Error)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runs = append(t.runs, run)
+}
+
+// all returns the tools recorded so far.
+func (t *toolRunner) all() []ToolRun {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.runs)
+}
+
+// transcript is what a tool writes to stdout and stderr, interleaved as it
+// writes it.
+type transcript struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Write(p)
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.String()
+}
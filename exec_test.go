@@ -0,0 +1,130 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunTool runs a tool that writes to stdout and stderr and fails: its
+// error must hold the end of its stderr, and the toolRunner all it wrote.
+func TestRunTool(t *testing.T) {
+	tools := &toolRunner{logger: slog.Default()}
+	ctx := withToolRunner(context.Background(), tools)
+	long := strings.Repeat("x", toolErrorTail)
+	err := runTool(ctx, "sh", "-c", "echo checking; echo "+long+"bad superblock >&2; exit 3")
+	if err == nil {
+		t.Fatal("runTool() succeeded, want an error")
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("runTool() error = %v, want it to wrap exit status 3", err)
+	}
+	if msg := err.Error(); !strings.HasSuffix(msg, "bad superblock") || strings.Contains(msg, "checking") || len(msg) > 2*toolErrorTail {
+		t.Errorf("runTool() error = %q, want the end of stderr only", msg)
+	}
+	runs := tools.all()
+	if len(runs) != 1 {
+		t.Fatalf("recorded %d tools, want 1", len(runs))
+	}
+	// stdout and stderr are interleaved as the tool wrote them, which need
+	// not be the order they are read in
+	r := runs[0]
+	if r.Name != "sh" || r.Error != "exit status 3" {
+		t.Errorf("recorded %s, failed with %q, want sh, failed with exit status 3", r.Name, r.Error)
+	}
+	if !strings.Contains(r.Output, "checking\n") || !strings.Contains(r.Output, long+"bad superblock\n") || len(r.Output) != len("checking\n"+long+"bad superblock\n") {
+		t.Errorf("recorded output of %d bytes, want all %s wrote", len(r.Output), r.Name)
+	}
+
+	// without a toolRunner, the tool is run all the same
+	if err := runTool(context.Background(), "true"); err != nil {
+		t.Errorf("runTool(true) error: %v", err)
+	}
+
+	// a tool that is not installed is recorded as not found
+	if err := runTool(ctx, "resizer-no-such-tool"); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("runTool(resizer-no-such-tool) error = %v, want exec.ErrNotFound", err)
+	}
+	if runs := tools.all(); len(runs) != 2 || !runs[1].NotFound || runs[0].NotFound {
+		t.Errorf("recorded %+v, want the second tool only not found", runs)
+	}
+}
+
+// fakeExecRunner is an ExecRunner that runs nothing, recording each tool it
+// is asked to run, and writes out to the tool's stderr and fails with err.
+type fakeExecRunner struct {
+	runs [][]string
+	out  string
+	err  error
+}
+
+func (f *fakeExecRunner) Run(_ context.Context, cmd string, args []string, _ time.Duration, _, stderr io.Writer) error {
+	f.runs = append(f.runs, append([]string{cmd}, args...))
+	_, _ = io.WriteString(stderr, f.out)
+	return f.err
+}
+
+// TestExecRunner runs e2fsck and resize2fs with an ExecRunner of the test's,
+// and a tool with a LocalExecRunner that takes longer than its timeout.
+func TestExecRunner(t *testing.T) {
+	fake := &fakeExecRunner{}
+	ctx := withToolRunner(context.Background(), newToolRunner(Options{ExecRunner: fake}))
+	if err := execResize2fs(ctx, "/dev/sda3", 100, false); err != nil {
+		t.Fatalf("execResize2fs() error: %v", err)
+	}
+	want := [][]string{{"e2fsck", "-f", "-n", "/dev/sda3"}, {"resize2fs", "/dev/sda3", "100M"}}
+	if !reflect.DeepEqual(fake.runs, want) {
+		t.Errorf("ran %q, want %q", fake.runs, want)
+	}
+
+	fake.out, fake.err = "permission denied", errors.New("sudo failed")
+	if err := execE2fsck(ctx, "/dev/sda3", true); err == nil || !strings.Contains(err.Error(), "permission denied") || !errors.Is(err, fake.err) {
+		t.Errorf("execE2fsck() error = %v, want it to wrap the runner's error with the tool's stderr", err)
+	}
+
+	ctx = withToolRunner(context.Background(), newToolRunner(Options{ToolTimeout: 50 * time.Millisecond}))
+	started := time.Now()
+	if err := runTool(ctx, "sleep", "10"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runTool(sleep) error = %v, want it to time out", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("runTool(sleep) took %s, want it killed after its timeout", elapsed)
+	}
+}
+
+// A tool is logged as it starts at LevelTrace only, and once it has run at
+// slog.LevelDebug.
+func TestToolRunnerTrace(t *testing.T) {
+	for _, tt := range []struct {
+		level slog.Level
+		want  []string
+	}{
+		{LevelTrace, []string{"running external tool", "ran external tool"}},
+		{slog.LevelDebug, []string{"ran external tool"}},
+		{slog.LevelInfo, nil},
+	} {
+		var out bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: tt.level}))
+		ctx := withToolRunner(context.Background(), newToolRunner(Options{ExecRunner: &fakeExecRunner{}, Logger: logger}))
+		if err := runTool(ctx, "e2fsck", "-n", "/dev/sda1"); err != nil {
+			t.Fatalf("runTool() error: %v", err)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if _, msg, ok := strings.Cut(line, `msg="`); ok {
+				got = append(got, strings.SplitN(msg, `"`, 2)[0])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("at level %s, logged %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
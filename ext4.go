@@ -0,0 +1,51 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4SuperblockSize   = 1024
+	ext4Magic            = 0xef53
+	ext4Incompat64Bit    = 0x80
+)
+
+// ext4Usage describes how much of an ext4 filesystem is in use, as recorded in
+// its superblock. All values are in bytes.
+type ext4Usage struct {
+	size int64
+	free int64
+}
+
+// used returns the number of bytes of the filesystem that are not free.
+func (u ext4Usage) used() int64 {
+	return u.size - u.free
+}
+
+// readExt4Usage reads the ext4 superblock of the filesystem starting at byte
+// offset start in r, and returns its total and free size. It only reads the
+// on-disk counters, so it is cheap enough to call for every candidate partition
+// while planning.
+func readExt4Usage(r io.ReaderAt, start int64) (ext4Usage, error) {
+	sb := make([]byte, ext4SuperblockSize)
+	if _, err := r.ReadAt(sb, start+ext4SuperblockOffset); err != nil {
+		return ext4Usage{}, fmt.Errorf("read ext4 superblock: %w", err)
+	}
+	if magic := binary.LittleEndian.Uint16(sb[0x38:]); magic != ext4Magic {
+		return ext4Usage{}, fmt.Errorf("invalid ext4 superblock magic 0x%x", magic)
+	}
+	blockSize := int64(1024) << binary.LittleEndian.Uint32(sb[0x18:])
+	blocks := uint64(binary.LittleEndian.Uint32(sb[0x04:]))
+	free := uint64(binary.LittleEndian.Uint32(sb[0x0c:]))
+	if binary.LittleEndian.Uint32(sb[0x60:])&ext4Incompat64Bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		free |= uint64(binary.LittleEndian.Uint32(sb[0x158:])) << 32
+	}
+	return ext4Usage{
+		size: int64(blocks) * blockSize,
+		free: int64(free) * blockSize,
+	}, nil
+}
@@ -0,0 +1,49 @@
+package partitionresizer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestReadExt4Usage(t *testing.T) {
+	f, err := os.Open(imgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	d, err := diskfs.OpenBackend(file.New(f, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := tableRaw.(*gpt.Table).Partitions
+
+	t.Run("ext4", func(t *testing.T) {
+		p := parts[1]
+		usage, err := readExt4Usage(f, p.GetStart())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if usage.size != p.GetSize() {
+			t.Errorf("size = %d, want %d", usage.size, p.GetSize())
+		}
+		if usage.free <= 0 || usage.free >= usage.size {
+			t.Errorf("free = %d, want between 0 and %d", usage.free, usage.size)
+		}
+		if usage.used() != usage.size-usage.free {
+			t.Errorf("used = %d, want %d", usage.used(), usage.size-usage.free)
+		}
+	})
+	t.Run("not ext4", func(t *testing.T) {
+		if _, err := readExt4Usage(f, parts[0].GetStart()); err == nil {
+			t.Fatal("expected error for FAT32 partition, got nil")
+		}
+	})
+}
@@ -1,13 +1,25 @@
 package partitionresizer
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log/slog"
 	"os"
+	"reflect"
+	"sync"
+
+	"github.com/diskfs/go-diskfs/disk"
 )
 
 const (
-	// 4 MiB is a good default; bump to 8–16 MiB on NVMe
+	// 4 MiB is a good default; probeCopyTuning bumps it to 8–16 MiB on
+	// SSDs and NVMe
 	copyBufSize = 4 * 1024 * 1024
 )
 
@@ -15,6 +27,15 @@ const (
 // into dstPath starting at `dstOffset`.
 // If dstOffset < 0, dst is truncated and written from offset 0.
 func CopyRange(srcPath, dstPath string, srcOffset, dstOffset, length int64, bufsize int) error {
+	return CopyRangeContext(context.Background(), srcPath, dstPath, srcOffset, dstOffset, length, bufsize, nil)
+}
+
+// CopyRangeContext is CopyRange, stopping with ctx.Err() should ctx be done
+// before the copy is, and calling progress, if set, with the bytes copied so
+// far and length as each buffer is written.
+// Should dstPath be a regular file, e.g. a disk image, a hole is punched in it
+// for each buffer of zeros rather than writing it, see sparseWriter.
+func CopyRangeContext(ctx context.Context, srcPath, dstPath string, srcOffset, dstOffset, length int64, bufsize int, progress func(copied, total int64)) error {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return fmt.Errorf("open src: %w", err)
@@ -36,13 +57,87 @@ func CopyRange(srcPath, dstPath string, srcOffset, dstOffset, length int64, bufs
 		dstOffset = 0
 	}
 
+	if _, err := CopyRangeAt(ctx, src, sparseWriterFor(dst, dst), srcOffset, dstOffset, length, bufsize, progress); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+// CopyRangeAt is CopyRangeContext between any src and dst, e.g. block devices
+// opened elsewhere, go-diskfs backends, network-backed readers or in-memory
+// buffers, rather than files named by path. Neither offset may be negative,
+// and dst is not synced. It returns the bytes copied, fewer than length
+// should src end first.
+// src and dst may be the same, e.g. one device, and the ranges overlap, as
+// memmove allows: a range moved to a later offset it overlaps is copied from
+// its end back, so that no buffer is read after it has been overwritten. Such
+// a copy fails should src end before the range does. src and dst are the same
+// if they are, or, as os.SameFile has it, if both are files. Only CopyRangeAt,
+// and CopyRange and CopyRangeContext through it, copy overlapping ranges: the
+// resize's own copy of a partition, see copyPartitionRaw, refuses a target
+// that overlaps its source.
+func CopyRangeAt(ctx context.Context, src io.ReaderAt, dst io.WriterAt, srcOffset, dstOffset, length int64, bufsize int, progress func(copied, total int64)) (int64, error) {
+	if srcOffset < 0 || dstOffset < 0 {
+		return 0, fmt.Errorf("negative offset: src %d, dst %d", srcOffset, dstOffset)
+	}
 	if bufsize <= 0 {
 		bufsize = copyBufSize
 	}
 	buf := make([]byte, bufsize)
 	var copied int64
+	chunk := func(_ int64, data []byte) error {
+		copied += int64(len(data))
+		if progress != nil {
+			progress(copied, length)
+		}
+		return nil
+	}
+	if dstOffset > srcOffset && dstOffset < srcOffset+length && sameStorage(src, dst) {
+		return copyChunksBackward(ctx, dst, src, dstOffset, srcOffset, length, buf, chunk)
+	}
+	return copyChunks(ctx, dst, src, dstOffset, srcOffset, length, buf, chunk)
+}
+
+// sameStorage reports whether src and dst are the same, or, should both be
+// files, the same file, as os.SameFile has it.
+func sameStorage(src io.ReaderAt, dst io.WriterAt) bool {
+	if w, ok := dst.(sparseWriter); ok {
+		dst = w.f
+	}
+	srcFile, srcOK := src.(*os.File)
+	dstFile, dstOK := dst.(*os.File)
+	if srcOK && dstOK {
+		srcInfo, err := srcFile.Stat()
+		if err != nil {
+			return false
+		}
+		dstInfo, err := dstFile.Stat()
+		if err != nil {
+			return false
+		}
+		return os.SameFile(srcInfo, dstInfo)
+	}
+	// comparing values of the same type that is not comparable panics
+	if reflect.TypeOf(src) != reflect.TypeOf(dst) || !reflect.TypeOf(src).Comparable() {
+		return false
+	}
+	return any(src) == any(dst)
+}
 
+// copyChunks copies up to length bytes from src at srcOffset to dst at
+// dstOffset, a buffer at a time, stopping with ctx.Err() should ctx be done
+// before it is, and returns how many it copied, fewer should src end first.
+// chunk, if set, is called with each buffer copied once it is written, and
+// its offset in the range, which is the bytes copied before it; should it
+// fail, so does the copy. It is the loop
+// both CopyRangeAt and copyPartitionRaw copy with.
+func copyChunks(ctx context.Context, dst io.WriterAt, src io.ReaderAt, dstOffset, srcOffset, length int64, buf []byte, chunk func(done int64, data []byte) error) (int64, error) {
+	var copied int64
 	for copied < length {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
 		toRead := int64(len(buf))
 		if remaining := length - copied; remaining < toRead {
 			toRead = remaining
@@ -50,7 +145,7 @@ func CopyRange(srcPath, dstPath string, srcOffset, dstOffset, length int64, bufs
 
 		n, err := src.ReadAt(buf[:toRead], srcOffset+copied)
 		if err != nil && err != io.EOF {
-			return fmt.Errorf("read: %w", err)
+			return copied, fmt.Errorf("read: %w", err)
 		}
 		if n == 0 {
 			break
@@ -58,14 +153,386 @@ func CopyRange(srcPath, dstPath string, srcOffset, dstOffset, length int64, bufs
 
 		wn, werr := dst.WriteAt(buf[:n], dstOffset+copied)
 		if werr != nil {
-			return fmt.Errorf("write: %w", werr)
+			return copied, fmt.Errorf("write: %w", werr)
 		}
 		if wn != n {
-			return fmt.Errorf("short write: %d != %d", wn, n)
+			return copied, fmt.Errorf("short write: %d != %d", wn, n)
 		}
 
+		if chunk != nil {
+			if err := chunk(copied, buf[:n]); err != nil {
+				return copied, err
+			}
+		}
 		copied += int64(n)
 	}
+	return copied, nil
+}
 
-	return dst.Sync()
+// copyChunksBackward is copyChunks, copying the buffers from the end of the
+// range back to its start, for a range moved to a later offset it overlaps,
+// see CopyRangeAt. chunk is called with the offset of each buffer in the
+// range. It fails should src end before the range does.
+func copyChunksBackward(ctx context.Context, dst io.WriterAt, src io.ReaderAt, dstOffset, srcOffset, length int64, buf []byte, chunk func(offset int64, data []byte) error) (int64, error) {
+	var copied int64
+	for end := length; end > 0; {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		n := min(int64(len(buf)), end)
+		start := end - n
+		rn, err := src.ReadAt(buf[:n], srcOffset+start)
+		if int64(rn) < n {
+			if err == nil || err == io.EOF {
+				return copied, fmt.Errorf("read: source ends before byte %d of the range", start+int64(rn))
+			}
+			return copied, fmt.Errorf("read: %w", err)
+		}
+		wn, err := dst.WriteAt(buf[:n], dstOffset+start)
+		if err != nil {
+			return copied, fmt.Errorf("write: %w", err)
+		}
+		if int64(wn) != n {
+			return copied, fmt.Errorf("short write: %d != %d", wn, n)
+		}
+		if chunk != nil {
+			if err := chunk(start, buf[:n]); err != nil {
+				return copied, err
+			}
+		}
+		copied += n
+		end = start
+	}
+	return copied, nil
+}
+
+// copyPartitionRaw copies the original partition of r byte for byte to the
+// start of its target partition, reporting to progress as it goes, and then
+// verifies the copy, see verifyCopy.
+// For VerifyFull, the data is hashed with SHA-256 as it is read, so the source
+// is read only once. A copy that only got the byte count right, but not the
+// bytes, therefore never reaches the removal of its original. Where the page
+// cache advice below is given, each buffer of the copy is also read back from
+// the device and hashed as the copy goes, once it has been written back and
+// dropped from the page cache, rather than in a pass of its own once the copy
+// is done. The digests of the copy are reported to progress, should it be a
+// DigestReporter.
+// With r.streams, see Options.CopyStreams, the partition is split into that
+// many stripes, copied, hashed and verified concurrently, each on its own,
+// in buffers of r.bufSize, or copyBufSize if not set, see tuneCopies.
+// Unless r.noCacheHints, see Options.NoCacheHints, the kernel is told the
+// source is read sequentially, and what has been copied is dropped from the
+// page cache behind the copy, rather than crowding out what else is cached.
+// With a journal, how far each stripe has got is recorded in it every
+// Options.CheckpointInterval bytes, once they are synced to the device, see
+// copyCheckpoints, and a resumed copy continues from there, once it has read
+// back what of the source was copied and found it as it was checkpointed;
+// should it not be, or should the source be mounted, or have been, see
+// FreezeMounted, the copy is not resumed.
+// Should the disk be an image file, a hole is punched in it for each run of
+// zeros rather than writing it, see sparseWriter.
+// A copy that fails verification is re-synced, up to maxCopyResyncs times,
+// rather than copied again: its buffers are compared with the source's, and
+// only those that differ written again, see resyncWriter. So is what a
+// resumed stripe copied before its checkpoint can no longer be trusted.
+// Unlike CopyRangeAt, it does not copy a target that overlaps its source: its
+// stripes are copied concurrently, and verified against a source that must
+// still be there, so it refuses one, which a partition table never has anyway.
+func copyPartitionRaw(ctx context.Context, logger *slog.Logger, d *disk.Disk, r partitionResizeTarget, progress ProgressReporter) error {
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	length := r.original.size
+	// the partitions of a table never overlap, so neither do these, but the
+	// copy below, striped and verified against its source, relies on it
+	if r.target.start < r.original.start+length && r.original.start < r.target.start+length {
+		return fmt.Errorf("copy at %d overlaps its source at %d", r.target.start, r.original.start)
+	}
+	c := &rawCopy{logger: logger, d: d, r: r, progress: progress}
+	// the advice is best effort, so is not given where the backend has no
+	// file to give it on, and failing to give it does not fail the copy
+	if !r.noCacheHints {
+		if c.hints, err = d.Backend.Sys(); err == nil {
+			_ = adviseSequential(c.hints, r.original.start, length)
+		}
+	}
+	// a checkpoint is only taken once what it records is on the device
+	c.checkpoints = copyCheckpointsFrom(ctx)
+	if c.device, err = d.Backend.Sys(); err != nil {
+		c.checkpoints = nil
+	}
+	c.w = sparseWriterFor(w, c.device)
+	c.resync = newResyncWriter(c.w, d.Backend)
+	stripe, n := stripes(length, r.streams, cmp.Or(r.bufSize, copyBufSize))
+	mounted := false
+	if r.freezeTimeout > 0 && d.Backend.Path() != "" {
+		mountpoint, err := partitionMountpoint(d.Backend.Path(), r.original.number)
+		mounted = err != nil || mountpoint != ""
+	}
+	c.cp = c.checkpoints.start(r.original.number, length, stripe, n, mounted)
+	stripe, n = c.cp.Stripe, len(c.cp.Copied)
+	var digests []string
+	for resyncs := 0; ; resyncs++ {
+		c.sums, c.copySums = make([][]byte, n), make([][]byte, n)
+		if err := forEachStripe(ctx, length, stripe, n, c.copyStripe); err != nil {
+			return err
+		}
+		if c.cp.Resync {
+			logger.Info("re-synced partition byte for byte", "partition", r.original.number, "target", r.target.number, "bytes", length, "rewritten", c.resync.rewritten.Swap(0), "streams", n)
+		} else {
+			logger.Info("copied partition byte for byte", "partition", r.original.number, "target", r.target.number, "bytes", length, "streams", n)
+		}
+		if digests, err = verifyCopy(logger, d, r, stripe, c.sums, c.copySums); !errors.Is(err, errCopyMismatch) || resyncs == maxCopyResyncs {
+			break
+		}
+		// rather than copied again, a copy that does not match its source
+		// is compared with it buffer by buffer, and only the buffers that
+		// differ are written again, then verified again
+		logger.Warn("copy does not match its source, re-syncing it", "partition", r.original.number, "target", r.target.number, "error", err)
+		if c.cp, err = c.checkpoints.resync(r.original.number, c.cp); err != nil {
+			return fmt.Errorf("record checkpoint: %w", err)
+		}
+		c.copied = 0
+	}
+	if cerr := c.checkpoints.clear(r.original.number); err == nil && cerr != nil {
+		err = fmt.Errorf("clear checkpoint: %w", cerr)
+	}
+	if err == nil && digests != nil {
+		reportDigests(progress, r.original.number, digests)
+	}
+	return err
+}
+
+// rawCopy is the state copyPartitionRaw shares between the stripes it copies.
+type rawCopy struct {
+	logger *slog.Logger
+	d      *disk.Disk
+	w      io.WriterAt
+	// resync writes, for a copy re-synced, see journalCopy.Resync, through
+	// w, what differs
+	resync   *resyncWriter
+	r        partitionResizeTarget
+	progress ProgressReporter
+	// hints is the file page cache advice is given on, nil for none
+	hints *os.File
+	// device is the file synced before each checkpoint
+	device      *os.File
+	checkpoints *copyCheckpoints
+	cp          *journalCopy
+	// sums and copySums are the SHA-256 hashes of each stripe of the source,
+	// and of the copy as read back, if it was as it was copied
+	sums, copySums [][]byte
+	mu             sync.Mutex
+	copied         int64
+}
+
+// copyStripe copies stripe i, size bytes at offset in the partition.
+func (c *rawCopy) copyStripe(ctx context.Context, i int, offset, size int64) error {
+	r := c.r
+	var hash, copyHash hash.Hash
+	if r.verify == "" || r.verify == VerifyFull {
+		hash = sha256.New()
+		// the copy can only be read back as it goes from the device,
+		// rather than the page cache, where it can be dropped from it
+		if c.hints != nil {
+			copyHash = sha256.New()
+		}
+	}
+	// each checkpoint records the hash of the source as far as it was
+	// copied, for a resumed copy to check the source against
+	fingerprint := hash
+	if fingerprint == nil && c.checkpoints != nil {
+		fingerprint = sha256.New()
+	}
+	w := c.w
+	if c.cp.Resync {
+		w = c.resync
+	}
+	src, dst := r.original.start+offset, r.target.start+offset
+	from := c.cp.Copied[i]
+	if from > 0 {
+		unchanged, err := c.sourceUnchanged(fingerprint, src, from, c.cp.Hashes[i])
+		if err != nil {
+			return err
+		}
+		if !unchanged {
+			// what was copied is still there, to re-sync rather than
+			// copy
+			c.logger.Warn("source changed since the copy was checkpointed, copying it again", "partition", r.original.number, "target", r.target.number, "offset", offset, "bytes", from)
+			fingerprint.Reset()
+			from, w = 0, c.resync
+		}
+	}
+	if from > 0 && copyHash != nil && !restoreHash(copyHash, c.cp.CopyHashes[i]) {
+		// verified in a pass of its own instead
+		copyHash = nil
+	}
+	if from > 0 {
+		c.logger.Info("resuming copy", "partition", r.original.number, "target", r.target.number, "offset", offset+from)
+		c.reportCopied(from)
+	}
+	buf := make([]byte, min(cmp.Or(r.bufSize, copyBufSize), size))
+	// readBack reads back, and hashes, the buffer written at pending, n
+	// bytes long, once it has been written back and dropped from the page
+	// cache
+	var back []byte
+	if copyHash != nil {
+		back = make([]byte, len(buf))
+	}
+	var pending, pendingN int64
+	readBack := func() error {
+		if pendingN == 0 {
+			return nil
+		}
+		n := pendingN
+		pendingN = 0
+		if err := dropWritten(c.hints, dst+pending, n); err != nil || copyHash == nil {
+			// verified in a pass of its own instead
+			copyHash = nil
+			return nil
+		}
+		if _, err := c.d.Backend.ReadAt(back[:n], dst+pending); err != nil {
+			return fmt.Errorf("read back copy: %w", err)
+		}
+		copyHash.Write(back[:n])
+		return nil
+	}
+	for from < size {
+		done, err := copyChunks(ctx, w, c.d.Backend, dst+from, src+from, c.checkpoints.segment(size-from), buf, func(done int64, data []byte) error {
+			n := int64(len(data))
+			done += from
+			if fingerprint != nil {
+				fingerprint.Write(data)
+			}
+			if hash != nil && hash != fingerprint {
+				hash.Write(data)
+			}
+			if c.hints != nil {
+				_ = dropRead(c.hints, src+done, n)
+				_ = startWriteback(c.hints, dst+done, n)
+				// the buffer before has had the time this one took to
+				// be written back
+				if err := readBack(); err != nil {
+					return err
+				}
+				pending, pendingN = done, n
+			}
+			c.reportCopied(n)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if done == 0 {
+			return fmt.Errorf("read: partition ends %d bytes short", size-from)
+		}
+		from += done
+		// a checkpoint records the hash of the copy up to it
+		if err := readBack(); err != nil {
+			return err
+		}
+		if from < size && c.checkpoints != nil {
+			if err := c.device.Sync(); err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+			if err := c.checkpoints.record(r.original.number, c.cp, i, from, fingerprint, copyHash); err != nil {
+				return fmt.Errorf("record checkpoint: %w", err)
+			}
+		}
+	}
+	if hash != nil {
+		c.sums[i] = hash.Sum(nil)
+	}
+	if copyHash != nil {
+		c.copySums[i] = copyHash.Sum(nil)
+	}
+	return nil
+}
+
+// sourceUnchanged reports whether the n bytes of the source at src that a
+// stripe checkpointed as copied, with its source hashed to the state
+// recorded, are as they were then, reading them back and hashing them into h,
+// which is then as it was at the checkpoint. They are not, should nothing be
+// recorded to check them against.
+func (c *rawCopy) sourceUnchanged(h hash.Hash, src, n int64, recorded []byte) (bool, error) {
+	if h == nil || recorded == nil {
+		return false, nil
+	}
+	buf := make([]byte, min(cmp.Or(c.r.bufSize, copyBufSize), n))
+	if _, err := io.CopyBuffer(h, io.NewSectionReader(c.d.Backend, src, n), buf); err != nil {
+		return false, fmt.Errorf("read back source: %w", err)
+	}
+	state, err := hashState(h)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(state, recorded), nil
+}
+
+// reportCopied reports that n more bytes have been copied.
+func (c *rawCopy) reportCopied(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copied += n
+	c.progress.BytesCopied(c.r.original.number, c.copied, c.r.original.size)
+}
+
+// markCopyStreams sets the number of streams every partition that is to be
+// copied to a new location is copied with to opts.CopyStreams, whether it is
+// copied with page cache advice to opts.NoCacheHints, and whether its files
+// keep their access times, should it be copied file by file, to opts.NoAtime.
+func markCopyStreams(resizes []partitionResizeTarget, opts Options) {
+	for i, r := range resizes {
+		if r.original.start != r.target.start {
+			resizes[i].streams = opts.CopyStreams
+			resizes[i].noCacheHints = opts.NoCacheHints
+			resizes[i].noAtime = opts.NoAtime
+		}
+	}
+}
+
+// stripes returns how a copy of length bytes in buffers of bufSize is split
+// for streams concurrent streams: the size of each stripe, a multiple of
+// bufSize, but for the last, which is what is left, and how many there are. A
+// copy of no more than bufSize is not split.
+func stripes(length int64, streams int, bufSize int64) (int64, int) {
+	if streams <= 1 || length <= bufSize {
+		return length, 1
+	}
+	stripe := (length + int64(streams) - 1) / int64(streams)
+	stripe = (stripe + bufSize - 1) / bufSize * bufSize
+	return stripe, int((length + stripe - 1) / stripe)
+}
+
+// forEachStripe calls fn for each of the n stripes of length bytes, stripe
+// bytes each but the last, see stripes, concurrently should there be more
+// than one, and returns the error of the first to fail. The ctx fn is given
+// is cancelled once one has failed, so that the others stop too.
+func forEachStripe(ctx context.Context, length, stripe int64, n int, fn func(ctx context.Context, i int, offset, size int64) error) error {
+	if n <= 1 {
+		return fn(ctx, 0, 0, length)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		err  error
+	)
+	for i := range n {
+		offset := int64(i) * stripe
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if serr := fn(ctx, i, offset, min(stripe, length-offset)); serr != nil {
+				once.Do(func() {
+					err = serr
+					cancel(serr)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return err
 }
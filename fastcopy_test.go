@@ -0,0 +1,437 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// corruptingStorage is a backend whose writes flip the first byte of every
+// write at corruptAt.
+type corruptingStorage struct {
+	backend.Storage
+	corruptAt int64
+}
+
+type corruptingFile struct {
+	backend.WritableFile
+	corruptAt int64
+}
+
+func (s corruptingStorage) Writable() (backend.WritableFile, error) {
+	w, err := s.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	return corruptingFile{WritableFile: w, corruptAt: s.corruptAt}, nil
+}
+
+func (f corruptingFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == f.corruptAt {
+		p = bytes.Clone(p)
+		p[0] ^= 0xff
+	}
+	return f.WritableFile.WriteAt(p, off)
+}
+
+// digestProgress is a ProgressReporter recording the digests reported to it.
+type digestProgress struct {
+	nopProgress
+	digests map[int][]string
+}
+
+func (p *digestProgress) CopyDigests(partition int, digests []string) {
+	if p.digests == nil {
+		p.digests = map[int][]string{}
+	}
+	p.digests[partition] = digests
+}
+
+func TestCopyPartitionRaw(t *testing.T) {
+	tests := []struct {
+		name   string
+		verify VerifyMode
+		// corruptAt, if not negative, is the offset in the copy of a write
+		// that goes wrong
+		corruptAt    int64
+		mismatch     bool
+		streams      int
+		noCacheHints bool
+	}{
+		{"full", VerifyFull, -1, false, 0, false},
+		{"full, corrupted", VerifyFull, copyBufSize, true, 0, false},
+		{"default, corrupted", "", copyBufSize, true, 0, false},
+		{"sampled", VerifySampled, -1, false, 0, false},
+		// the first extent is always sampled
+		{"sampled, corrupted", VerifySampled, 0, true, 0, false},
+		{"none, corrupted", VerifyNone, copyBufSize, false, 0, false},
+		{"full, 4 streams", VerifyFull, -1, false, 4, false},
+		{"full, 4 streams, last stripe corrupted", VerifyFull, copyBufSize, true, 4, false},
+		{"sampled, 4 streams", VerifySampled, -1, false, 4, false},
+		// read back in a pass of their own, rather than as they are copied
+		{"full, no cache hints", VerifyFull, -1, false, 0, true},
+		{"full, no cache hints, corrupted", VerifyFull, copyBufSize, true, 0, true},
+		{"full, 4 streams, no cache hints", VerifyFull, -1, false, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := partitionResizeTarget{
+				original:     partitionData{number: 1, start: 1 * MB, size: 6 * MB},
+				target:       partitionData{number: 2, start: 8 * MB, size: 8 * MB},
+				verify:       tt.verify,
+				streams:      tt.streams,
+				noCacheHints: tt.noCacheHints,
+			}
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			data := make([]byte, 16*MB)
+			for i := r.original.start; i < r.original.start+r.original.size; i++ {
+				data[i] = byte(i % 251)
+			}
+			if err := os.WriteFile(diskPath, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			storage, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = storage.Close() }()
+			d := &disk.Disk{Backend: storage}
+			if tt.corruptAt >= 0 {
+				d.Backend = corruptingStorage{Storage: storage, corruptAt: r.target.start + tt.corruptAt}
+			}
+			progress := &digestProgress{}
+			err = copyPartitionRaw(context.Background(), slog.Default(), d, r, progress)
+			if tt.mismatch {
+				if err == nil || !strings.Contains(err.Error(), "does not match") {
+					t.Errorf("copyPartitionRaw() of a corrupted copy = %v, want a mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("copyPartitionRaw() error: %v", err)
+			}
+			if tt.corruptAt >= 0 {
+				return
+			}
+			got, err := os.ReadFile(diskPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[r.target.start:r.target.start+r.original.size], data[r.original.start:r.original.start+r.original.size]) {
+				t.Error("copy differs from its source")
+			}
+			if tt.verify != VerifyFull {
+				if progress.digests != nil {
+					t.Errorf("copyPartitionRaw() reported digests %v, want none", progress.digests)
+				}
+				return
+			}
+			stripe, n := stripes(r.original.size, tt.streams, copyBufSize)
+			var want []string
+			for i := range int64(n) {
+				from := r.original.start + i*stripe
+				to := min(from+stripe, r.original.start+r.original.size)
+				want = append(want, fmt.Sprintf("%x", sha256.Sum256(data[from:to])))
+			}
+			if !slices.Equal(progress.digests[1], want) {
+				t.Errorf("copyPartitionRaw() reported digests %v, want %v", progress.digests, want)
+			}
+		})
+	}
+
+	// unlike CopyRangeAt, it refuses a target that overlaps its source
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, make([]byte, 16*MB), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = storage.Close() }()
+	r := partitionResizeTarget{original: partitionData{number: 1, start: 1 * MB, size: 6 * MB}, target: partitionData{number: 2, start: 4 * MB, size: 8 * MB}}
+	if err := copyPartitionRaw(context.Background(), slog.Default(), &disk.Disk{Backend: storage}, r, nopProgress{}); err == nil || !strings.Contains(err.Error(), "overlaps its source") {
+		t.Errorf("copyPartitionRaw() of an overlapping target error = %v, want it refused", err)
+	}
+}
+
+// failingReaderAt is an io.ReaderAt over data failing every read from failAt.
+type failingReaderAt struct {
+	data   []byte
+	failAt int64
+}
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.failAt {
+		return 0, errors.New("I/O error")
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestHashRange(t *testing.T) {
+	data := make([]byte, 3*copyBufSize+512)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	tests := []struct {
+		name           string
+		offset, length int64
+		// want is what is hashed, shorter than length should data end
+		want []byte
+	}{
+		{"within a buffer", 512, 4096, data[512 : 512+4096]},
+		{"many buffers", 512, 3 * copyBufSize, data[512:]},
+		{"past the end", copyBufSize, 4 * copyBufSize, data[copyBufSize:]},
+		{"nothing", 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hashRange(bytes.NewReader(data), tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("hashRange() error: %v", err)
+			}
+			if want := sha256.Sum256(tt.want); !bytes.Equal(got, want[:]) {
+				t.Errorf("hashRange() = %x, want %x", got, want)
+			}
+		})
+	}
+	if _, err := hashRange(failingReaderAt{data: data, failAt: 2 * copyBufSize}, 0, int64(len(data))); err == nil {
+		t.Error("hashRange() of a failing read succeeded")
+	}
+}
+
+func TestSampleOffsets(t *testing.T) {
+	tests := []struct {
+		length int64
+		min    int
+	}{
+		{512 * KB, 1},
+		{1 * MB, 1},
+		{6 * MB, 2},
+		{1 * GB, 2},
+	}
+	for _, tt := range tests {
+		offsets := sampleOffsets(tt.length)
+		if len(offsets) < tt.min || len(offsets) > sampleExtents+2 {
+			t.Errorf("sampleOffsets(%d) = %d offsets, want %d to %d", tt.length, len(offsets), tt.min, sampleExtents+2)
+			continue
+		}
+		if offsets[0] != 0 {
+			t.Errorf("sampleOffsets(%d) starts at %d, want 0", tt.length, offsets[0])
+		}
+		if last := max(tt.length-sampleExtentSize, 0); offsets[len(offsets)-1] != last {
+			t.Errorf("sampleOffsets(%d) ends at %d, want %d", tt.length, offsets[len(offsets)-1], last)
+		}
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] <= offsets[i-1] {
+				t.Errorf("sampleOffsets(%d) = %v, not in order", tt.length, offsets)
+				break
+			}
+		}
+	}
+}
+
+func TestStripes(t *testing.T) {
+	tests := []struct {
+		length  int64
+		streams int
+		stripe  int64
+		n       int
+	}{
+		{6 * MB, 0, 6 * MB, 1},
+		{6 * MB, 1, 6 * MB, 1},
+		// stripes are whole buffers
+		{6 * MB, 4, copyBufSize, 2},
+		{64 * MB, 4, 16 * MB, 4},
+		{64 * MB, 3, 24 * MB, 3},
+		{64 * MB, 5, 16 * MB, 4},
+		{copyBufSize, 4, copyBufSize, 1},
+		{copyBufSize + 1, 4, copyBufSize, 2},
+	}
+	for _, tt := range tests {
+		stripe, n := stripes(tt.length, tt.streams, copyBufSize)
+		if stripe != tt.stripe || n != tt.n {
+			t.Errorf("stripes(%d, %d) = %d, %d, want %d, %d", tt.length, tt.streams, stripe, n, tt.stripe, tt.n)
+		}
+		if int64(n-1)*stripe >= tt.length || int64(n)*stripe < tt.length {
+			t.Errorf("stripes(%d, %d) do not cover it exactly", tt.length, tt.streams)
+		}
+	}
+}
+
+func TestCopyRangeContext(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img")
+	data := make([]byte, 10*MB)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls [][2]int64
+	progress := func(copied, total int64) { calls = append(calls, [2]int64{copied, total}) }
+	if err := CopyRangeContext(context.Background(), src, dst, 1*MB, -1, 9*MB, 4*MB, progress); err != nil {
+		t.Fatalf("CopyRangeContext() error: %v", err)
+	}
+	want := [][2]int64{{4 * MB, 9 * MB}, {8 * MB, 9 * MB}, {9 * MB, 9 * MB}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("progress called with %v, want %v", calls, want)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[1*MB:]) {
+		t.Error("copy differs from its source")
+	}
+
+	// a copy cancelled midway stops at the buffer it is at
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = nil
+	err = CopyRangeContext(ctx, src, dst, 0, -1, 10*MB, 4*MB, func(copied, total int64) {
+		calls = append(calls, [2]int64{copied, total})
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("CopyRangeContext() cancelled = %v, want %v", err, context.Canceled)
+	}
+	if len(calls) != 1 {
+		t.Errorf("progress of a cancelled copy called %d times, want 1", len(calls))
+	}
+}
+
+// memWriterAt is an io.WriterAt, and io.ReaderAt, in memory, growing as
+// written to.
+type memWriterAt struct {
+	data []byte
+}
+
+func (m *memWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func TestCopyRangeAt(t *testing.T) {
+	data := make([]byte, 3*MB)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	tests := []struct {
+		name              string
+		srcOffset, length int64
+		want              int64
+		wantErr           bool
+	}{
+		{"whole", 0, 3 * MB, 3 * MB, false},
+		{"middle", 1 * MB, 1*MB + 17, 1*MB + 17, false},
+		{"past the end of src", 2 * MB, 4 * MB, 1 * MB, false},
+		{"negative offset", -1, 1 * MB, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := &memWriterAt{}
+			var last int64
+			copied, err := CopyRangeAt(context.Background(), bytes.NewReader(data), dst, tt.srcOffset, 512, tt.length, 256*KB, func(copied, total int64) {
+				if total != tt.length || copied <= last {
+					t.Errorf("progress(%d, %d) after %d, want it to grow to %d", copied, total, last, tt.length)
+				}
+				last = copied
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("CopyRangeAt() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CopyRangeAt() error: %v", err)
+			}
+			if copied != tt.want || last != tt.want {
+				t.Errorf("CopyRangeAt() copied %d, progress %d, want %d", copied, last, tt.want)
+			}
+			if !bytes.Equal(dst.data[512:], data[tt.srcOffset:tt.srcOffset+tt.want]) {
+				t.Error("copy differs from its source")
+			}
+		})
+	}
+}
+
+func TestCopyRangeAtOverlapping(t *testing.T) {
+	data := make([]byte, 3*MB)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	tests := []struct {
+		name                 string
+		srcOffset, dstOffset int64
+	}{
+		// a forward copy would read what it had just written
+		{"later, overlapping", 0, 1*MB + 512},
+		{"earlier, overlapping", 1*MB + 512, 0},
+		{"later, by less than a buffer", 512, 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			length := int64(len(data)) - max(tt.srcOffset, tt.dstOffset)
+			want := bytes.Clone(data[tt.srcOffset : tt.srcOffset+length])
+
+			mem := &memWriterAt{data: bytes.Clone(data)}
+			if _, err := CopyRangeAt(context.Background(), mem, mem, tt.srcOffset, tt.dstOffset, length, 256*KB, nil); err != nil {
+				t.Fatalf("CopyRangeAt() error: %v", err)
+			}
+			if !bytes.Equal(mem.data[tt.dstOffset:tt.dstOffset+length], want) {
+				t.Error("CopyRangeAt() in memory corrupted the overlapping range")
+			}
+
+			path := filepath.Join(t.TempDir(), "disk.img")
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := CopyRange(path, path, tt.srcOffset, tt.dstOffset, length, 256*KB); err != nil {
+				t.Fatalf("CopyRange() error: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[tt.dstOffset:tt.dstOffset+length], want) {
+				t.Error("CopyRange() of one file corrupted the overlapping range")
+			}
+		})
+	}
+
+	// a backward copy cannot copy what is past the end of its source
+	mem := &memWriterAt{data: bytes.Clone(data)}
+	if _, err := CopyRangeAt(context.Background(), mem, mem, 0, 1*MB, 4*MB, 256*KB, nil); err == nil {
+		t.Error("CopyRangeAt() of an overlapping range past the end of its source succeeded")
+	}
+}
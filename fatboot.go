@@ -0,0 +1,113 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	// fat32BootSectorSize is the size of the boot sector of a FAT32
+	// filesystem, whose bytes per sector are at 0x0b and the sector of the
+	// copy of it, its backup, at 0x32
+	fat32BootSectorSize = 512
+	fat32SectorSizeAt   = 0x0b
+	fat32BackupBootAt   = 0x32
+)
+
+// fat32BootFields are the fields of a FAT32 boot sector that keepFAT32Boot
+// carries over from the source to the FAT32 filesystem made for its copy:
+// those firmware and boot loaders may key on, and that do not depend on the
+// size or location of the filesystem. The OEM name and volume label are those
+// of the BIOS parameter block; the label CreateFilesystem is given is that of
+// the root directory.
+var fat32BootFields = []fat32BootField{
+	{"OEM name", 0x03, 8},
+	{"sectors per track", 0x18, 2},
+	{"heads", 0x1a, 2},
+	{"drive number", 0x40, 1},
+	fat32VolumeSerial,
+	{"volume label", 0x47, 11},
+	{"boot code", 0x5a, 420},
+}
+
+// fat32VolumeSerial is the field of fat32BootFields with the volume serial
+// number, which a copy with a temporary UUID is only given by restoreUUIDs.
+var fat32VolumeSerial = fat32BootField{"volume serial", fat32VolumeIDAt, 4}
+
+// fat32BootField is a field of a FAT32 boot sector, at offset, size bytes
+// long.
+type fat32BootField struct {
+	name         string
+	offset, size int
+}
+
+// keepFAT32Boot gives the FAT32 filesystem copyPartition made on the target
+// of r the volume serial number and other boot sector fields of the
+// original, see fat32BootFields, in its boot sector and the backup of it, so
+// that firmware that finds an ESP by its serial, as some do, still finds it.
+// With r.temporaryUUID, the copy keeps the serial it was made with until
+// restoreUUIDs gives it its original's, just before the original is removed.
+// Should it fail, the copy is kept, as it holds all of the files, but it is
+// warned of, the serial having changed.
+func keepFAT32Boot(logger *slog.Logger, d *disk.Disk, r partitionResizeTarget) {
+	fields := fat32BootFields
+	if r.temporaryUUID {
+		fields = slices.DeleteFunc(slices.Clone(fields), func(f fat32BootField) bool { return f == fat32VolumeSerial })
+	}
+	serial, err := copyFAT32Boot(d, r, fields)
+	if err != nil {
+		logger.Warn("FAT32 copy has a new volume serial number and boot parameters, firmware or boot entries keyed on the original's may not find it",
+			"partition", r.original.number, "target", r.target.number, "error", err)
+		return
+	}
+	logger.Info("kept FAT32 volume serial number and boot parameters", "partition", r.original.number, "target", r.target.number, "serial", serial)
+}
+
+// copyFAT32Boot copies fields from the boot sector of the original of r to
+// the boot sector, and its backup, of the target, returning the volume serial
+// number they now have, e.g. 1A2B-3C4D.
+func copyFAT32Boot(d *disk.Disk, r partitionResizeTarget, fields []fat32BootField) (string, error) {
+	src, err := readFAT32Boot(d.Backend, r.original.start)
+	if err != nil {
+		return "", fmt.Errorf("read boot sector of original: %w", err)
+	}
+	dst, err := readFAT32Boot(d.Backend, r.target.start)
+	if err != nil {
+		return "", fmt.Errorf("read boot sector of copy: %w", err)
+	}
+	for _, f := range fields {
+		copy(dst[f.offset:f.offset+f.size], src[f.offset:f.offset+f.size])
+	}
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.WriteAt(dst, r.target.start); err != nil {
+		return "", fmt.Errorf("write boot sector: %w", err)
+	}
+	sectorSize := int64(binary.LittleEndian.Uint16(dst[fat32SectorSizeAt:]))
+	if backup := int64(binary.LittleEndian.Uint16(dst[fat32BackupBootAt:])); backup != 0 && backup != 0xffff {
+		if _, err := w.WriteAt(dst, r.target.start+backup*sectorSize); err != nil {
+			return "", fmt.Errorf("write backup boot sector: %w", err)
+		}
+	}
+	return fat32VolumeID(d.Backend, r.target.start), nil
+}
+
+// readFAT32Boot reads the boot sector of the FAT32 filesystem on the partition
+// starting at byte offset start in r.
+func readFAT32Boot(r io.ReaderAt, start int64) ([]byte, error) {
+	boot := make([]byte, fat32BootSectorSize)
+	if _, err := r.ReadAt(boot, start); err != nil {
+		return nil, err
+	}
+	if string(boot[fat32TypeAt:fat32TypeAt+8]) != "FAT32   " || boot[510] != 0x55 || boot[511] != 0xaa {
+		return nil, fmt.Errorf("not a FAT32 boot sector")
+	}
+	return boot, nil
+}
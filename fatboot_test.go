@@ -0,0 +1,119 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestKeepFAT32Boot gives a FAT32 filesystem made for a copy the volume serial
+// number, OEM name and boot code of its source, in its boot sector and the
+// backup of it, and warns, changing nothing, when the source is not FAT32.
+// With a temporary UUID, the serial is only given to it by restoreUUIDs.
+func TestKeepFAT32Boot(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 128*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 40 * MB, Type: gpt.EFISystemPartition, Name: "source"},
+		{Index: 2, Start: 41 * MB / 512, Size: 64 * MB, Type: gpt.EFISystemPartition, Name: "target"},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := partitionResizeTarget{
+		original: partitionData{number: 1, start: 1 * MB, size: 40 * MB},
+		target:   partitionData{number: 2, start: 41 * MB, size: 64 * MB},
+	}
+
+	var logs bytes.Buffer
+	keepFAT32Boot(slog.New(slog.NewTextHandler(&logs, nil)), d, r)
+	if !strings.Contains(logs.String(), "level=WARN") {
+		t.Errorf("keepFAT32Boot() of no FAT32 logged %q, want a warning", logs.String())
+	}
+
+	for _, p := range []int{1, 2} {
+		if _, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: p, FSType: filesystem.TypeFat32, VolumeLabel: "EFI"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// what firmware or a boot loader may have left in the boot sector
+	src := make([]byte, fat32BootSectorSize)
+	if _, err := d.Backend.ReadAt(src, r.original.start); err != nil {
+		t.Fatal(err)
+	}
+	copy(src[0x03:], "MSWIN4.1")
+	copy(src[0x5a:], "boot code")
+	copy(src[fat32VolumeIDAt:], []byte{0x4d, 0x3c, 0x2b, 0x1a})
+	w, err := d.Backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(src, r.original.start); err != nil {
+		t.Fatal(err)
+	}
+
+	logs.Reset()
+	keepFAT32Boot(slog.New(slog.NewTextHandler(&logs, nil)), d, r)
+	if strings.Contains(logs.String(), "level=WARN") {
+		t.Fatalf("keepFAT32Boot() logged %q, want no warning", logs.String())
+	}
+	if got := fat32VolumeID(d.Backend, r.target.start); got != "1A2B-3C4D" {
+		t.Errorf("copy has volume serial %s, want 1A2B-3C4D", got)
+	}
+	dst := make([]byte, fat32BootSectorSize)
+	if _, err := d.Backend.ReadAt(dst, r.target.start); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst[0x03:0x0b], []byte("MSWIN4.1")) || !bytes.HasPrefix(dst[0x5a:], []byte("boot code")) {
+		t.Errorf("copy boot sector has OEM name %q and boot code %q, want those of its source", dst[0x03:0x0b], dst[0x5a:0x63])
+	}
+	backup := make([]byte, fat32BootSectorSize)
+	if _, err := d.Backend.ReadAt(backup, r.target.start+6*512); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, dst) {
+		t.Error("backup boot sector of the copy differs from its boot sector")
+	}
+	if fs, err := d.GetFilesystem(2); err != nil || fs.Type() != filesystem.TypeFat32 {
+		t.Errorf("copy does not read as FAT32 once its boot sector is changed: %v", err)
+	}
+
+	// with a temporary UUID, the copy keeps its own serial until
+	// restoreUUIDs gives it its original's
+	for _, at := range []int64{r.target.start, r.target.start + 6*512} {
+		if _, err := w.WriteAt([]byte{0x44, 0x33, 0x22, 0x11}, at+fat32VolumeIDAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.temporaryUUID = true
+	keepFAT32Boot(slog.Default(), d, r)
+	if got := fat32VolumeID(d.Backend, r.target.start); got != "1122-3344" {
+		t.Errorf("copy with a temporary UUID has volume serial %s, want its own 1122-3344", got)
+	}
+	if err := restoreUUIDs(context.Background(), slog.Default(), d, []partitionResizeTarget{r}); err != nil {
+		t.Fatalf("restoreUUIDs() error: %v", err)
+	}
+	if got := fat32VolumeID(d.Backend, r.target.start); got != "1A2B-3C4D" {
+		t.Errorf("copy has volume serial %s once restored, want 1A2B-3C4D", got)
+	}
+	if _, err := d.Backend.ReadAt(backup, r.target.start+6*512); err != nil {
+		t.Fatal(err)
+	}
+	if got := backup[fat32VolumeIDAt : fat32VolumeIDAt+4]; !bytes.Equal(got, []byte{0x4d, 0x3c, 0x2b, 0x1a}) {
+		t.Errorf("backup boot sector of the copy has volume serial % x once restored, want its original's", got)
+	}
+}
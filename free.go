@@ -0,0 +1,76 @@
+package partitionresizer
+
+import (
+	"fmt"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// maxGapAlignment is the largest alignment FreeSpace reports, that partitions
+// are conventionally aligned to.
+const maxGapAlignment = MB
+
+// FreeSpaceMap is the free space on a disk, as a resize sees it: the gaps
+// between its partitions, up to the last sector the GPT lets a partition use,
+// and the largest block of them a partition can be given, in bytes. Should
+// Largest be enough for the grows, no shrink is needed.
+type FreeSpaceMap struct {
+	Disk    string    `json:"disk"`
+	Size    int64     `json:"size"`
+	Gaps    []FreeGap `json:"gaps"`
+	Largest int64     `json:"largest"`
+}
+
+// FreeGap is a gap between partitions. Alignment is the largest power of two,
+// up to 1 MB, that its start is a multiple of, and Allocatable the bytes of it
+// a partition aligned to 1 MB can occupy, e.g. none of the gap that holds the
+// primary GPT before the first partition.
+type FreeGap struct {
+	Extent
+	Size        int64 `json:"size"`
+	Alignment   int64 `json:"alignment"`
+	Allocatable int64 `json:"allocatable"`
+}
+
+// FreeSpace returns the map of the free space on the disk device or image
+// file disk, without changing anything.
+func FreeSpace(disk string) (*FreeSpaceMap, error) {
+	backend, err := file.OpenFromPath(disk, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", disk, err)
+	}
+	var used []Extent
+	for _, p := range table.Partitions {
+		used = append(used, Extent{Start: p.GetStart(), End: p.GetStart() + p.GetSize() - 1})
+	}
+	return newFreeSpaceMap(disk, d.Size, FreeExtents(usableDiskSize(d, table), used)), nil
+}
+
+// newFreeSpaceMap returns the FreeSpaceMap of disk, of size bytes, whose free
+// extents are free.
+func newFreeSpaceMap(disk string, size int64, free []Extent) *FreeSpaceMap {
+	m := &FreeSpaceMap{Disk: disk, Size: size, Gaps: []FreeGap{}}
+	for _, e := range free {
+		gap := FreeGap{Extent: e, Size: e.Size(), Alignment: maxGapAlignment}
+		for gap.Alignment > 1 && e.Start%gap.Alignment != 0 {
+			gap.Alignment /= 2
+		}
+		// round the start up, and the end down, to whole MB
+		if start, end := (e.Start+MB-1)/MB*MB, (e.End+1)/MB*MB; end > start {
+			gap.Allocatable = end - start
+		}
+		m.Largest = max(m.Largest, gap.Allocatable)
+		m.Gaps = append(m.Gaps, gap)
+	}
+	return m
+}
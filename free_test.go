@@ -0,0 +1,48 @@
+package partitionresizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestNewFreeSpaceMap maps the gap holding the primary GPT, which no partition
+// can be given, a gap between two partitions, and one that starts unaligned.
+func TestNewFreeSpaceMap(t *testing.T) {
+	free := []Extent{
+		{Start: 1, End: MB - 1},
+		{Start: 100 * MB, End: 300*MB - 1},
+		{Start: 500*MB + 4*KB, End: 800*MB - 1},
+	}
+	got := newFreeSpaceMap("disk.img", GB, free)
+	want := &FreeSpaceMap{
+		Disk: "disk.img",
+		Size: GB,
+		Gaps: []FreeGap{
+			{Extent: free[0], Size: MB - 1, Alignment: 1, Allocatable: 0},
+			{Extent: free[1], Size: 200 * MB, Alignment: MB, Allocatable: 200 * MB},
+			{Extent: free[2], Size: 300*MB - 4*KB, Alignment: 4 * KB, Allocatable: 299 * MB},
+		},
+		Largest: 299 * MB,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newFreeSpaceMap() = %+v, want %+v", got, want)
+	}
+}
+
+// TestFreeSpace maps a disk image its partitions fill, so that nothing can be
+// allocated without a shrink.
+func TestFreeSpace(t *testing.T) {
+	m, err := FreeSpace(diskfullImg)
+	if err != nil {
+		t.Fatalf("FreeSpace() error: %v", err)
+	}
+	if m.Disk != diskfullImg || m.Size != 10*GB {
+		t.Errorf("FreeSpace() = %s of %d bytes, want %s of %d", m.Disk, m.Size, diskfullImg, 10*GB)
+	}
+	if len(m.Gaps) == 0 || m.Gaps[0].Start != 1 || m.Gaps[0].Allocatable != 0 {
+		t.Errorf("FreeSpace() gaps = %+v, want the primary GPT first, with nothing allocatable", m.Gaps)
+	}
+	if m.Largest != 0 {
+		t.Errorf("FreeSpace() largest = %d, want 0", m.Largest)
+	}
+}
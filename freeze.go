@@ -0,0 +1,163 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition"
+)
+
+// execFsfreeze freezes, or thaws, the filesystem mounted at mountpoint.
+var execFsfreeze = func(ctx context.Context, mountpoint string, freeze bool) error {
+	flag := "--unfreeze"
+	if freeze {
+		flag = "--freeze"
+	}
+	return runTool(ctx, "fsfreeze", flag, mountpoint)
+}
+
+// markFrozenCopies sets the freeze timeout on every partition that is to be
+// copied to a new location, if opts.FreezeMounted is set. As whatever is
+// written to a mounted source once it is thawed is lost, it returns an error
+// should there be one to copy without opts.AcceptLostWrites.
+func markFrozenCopies(resizes []partitionResizeTarget, opts Options) error {
+	if !opts.FreezeMounted {
+		return nil
+	}
+	for i, r := range resizes {
+		if r.original.start != r.target.start && r.target.size >= r.original.size {
+			if !opts.AcceptLostWrites {
+				return fmt.Errorf("partition %d would be copied frozen should it be mounted, and what is written to it once it is thawed, until the copy is in use, would be lost; set AcceptLostWrites to accept that", r.original.number)
+			}
+			resizes[i].freezeTimeout = opts.freezeTimeout()
+		}
+	}
+	return nil
+}
+
+// anyFrozen reports whether any of resizes may copy a mounted filesystem.
+func anyFrozen(resizes []partitionResizeTarget) bool {
+	for _, r := range resizes {
+		if r.freezeTimeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionMountpoint returns where partition number of the disk device is
+// mounted, or "" if it is not mounted. A disk image file is never mounted.
+func partitionMountpoint(device string, number int) (string, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	deviceType, err := disk.DetermineDeviceType(f)
+	_ = f.Close()
+	if err != nil {
+		return "", err
+	}
+	if deviceType != disk.DeviceTypeBlockDevice {
+		return "", nil
+	}
+	partDevice, err := partitionDevicePath(device, number, "")
+	if err != nil {
+		return "", fmt.Errorf("cannot find partition device for %s partition %d: %w", device, number, err)
+	}
+	mounts, err := mountedDevices()
+	if err != nil {
+		return "", fmt.Errorf("list mounts: %w", err)
+	}
+	if mountpoints := mounts[resolvePath(partDevice)]; len(mountpoints) > 0 {
+		return mountpoints[0], nil
+	}
+	return "", nil
+}
+
+// freezeFilesystem freezes the filesystem mounted at mountpoint and returns the
+// function that thaws it. Should the filesystem still be frozen after timeout,
+// it is thawed regardless, so that a stuck copy cannot block writers to it
+// indefinitely, and the returned function then reports that the copy is not
+// consistent. Thawing is not cancelled along with ctx: a filesystem is never
+// left frozen.
+func freezeFilesystem(ctx context.Context, logger *slog.Logger, mountpoint string, timeout time.Duration) (func() error, error) {
+	logger.Info("freezing filesystem", "mountpoint", mountpoint, "timeout", timeout)
+	if err := execFsfreeze(ctx, mountpoint, true); err != nil {
+		return nil, err
+	}
+	ctx = context.WithoutCancel(ctx)
+	var (
+		mu      sync.Mutex
+		thawed  bool
+		expired bool
+	)
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if thawed {
+			return
+		}
+		thawed, expired = true, true
+		logger.Warn("filesystem still frozen at timeout, thawing it", "mountpoint", mountpoint, "timeout", timeout)
+		if err := execFsfreeze(ctx, mountpoint, false); err != nil {
+			logger.Error("failed to thaw filesystem", "mountpoint", mountpoint, "error", err)
+		}
+	})
+	return func() error {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		if expired {
+			return fmt.Errorf("filesystem at %s was thawed after the %v freeze timeout, so its copy is not consistent", mountpoint, timeout)
+		}
+		if thawed {
+			return nil
+		}
+		thawed = true
+		logger.Info("thawing filesystem", "mountpoint", mountpoint)
+		return execFsfreeze(ctx, mountpoint, false)
+	}, nil
+}
+
+// freezeSource freezes the source filesystem of r for its copy, if r is to be
+// copied frozen and its source is mounted, and returns the function that thaws
+// it again; otherwise it returns a function that does nothing.
+func freezeSource(ctx context.Context, logger *slog.Logger, d *disk.Disk, r partitionResizeTarget) (func() error, error) {
+	noop := func() error { return nil }
+	if r.freezeTimeout <= 0 {
+		return noop, nil
+	}
+	mountpoint, err := partitionMountpoint(d.Backend.Path(), r.original.number)
+	if err != nil || mountpoint == "" {
+		return noop, err
+	}
+	return freezeFilesystem(ctx, logger, mountpoint, r.freezeTimeout)
+}
+
+// writePartitionTable writes table to d and has the kernel re-read it, as
+// d.Partition does. With allowBusy, a kernel that cannot re-read the table,
+// because a partition of the disk is in use, is not an error: the table on
+// disk is correct, and the kernel picks it up once the disk is no longer in
+// use, e.g. on the next boot.
+func writePartitionTable(logger *slog.Logger, d *disk.Disk, table partition.Table, allowBusy bool) error {
+	if !allowBusy {
+		return d.Partition(table)
+	}
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	if err := table.Write(w, d.Size); err != nil {
+		return fmt.Errorf("failed to write partition table: %v", err)
+	}
+	d.Table = table
+	if err := d.ReReadPartitionTable(); err != nil {
+		logger.Warn("partition table written, but the kernel keeps the old one until the disk is no longer in use", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package partitionresizer
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubFsfreeze replaces execFsfreeze for the test, recording each call as
+// "freeze <mountpoint>" or "thaw <mountpoint>".
+func stubFsfreeze(t *testing.T) func() []string {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	orig := execFsfreeze
+	t.Cleanup(func() { execFsfreeze = orig })
+	execFsfreeze = func(_ context.Context, mountpoint string, freeze bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		action := "thaw"
+		if freeze {
+			action = "freeze"
+		}
+		calls = append(calls, action+" "+mountpoint)
+		return nil
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}
+}
+
+func TestFreezeFilesystem(t *testing.T) {
+	t.Run("thawed after copy", func(t *testing.T) {
+		calls := stubFsfreeze(t)
+		thaw, err := freezeFilesystem(context.Background(), slog.Default(), "/data", time.Minute)
+		if err != nil {
+			t.Fatalf("freezeFilesystem() error: %v", err)
+		}
+		if err := thaw(); err != nil {
+			t.Fatalf("thaw() error: %v", err)
+		}
+		// a second thaw is a no-op
+		if err := thaw(); err != nil {
+			t.Fatalf("second thaw() error: %v", err)
+		}
+		if want := []string{"freeze /data", "thaw /data"}; !reflect.DeepEqual(calls(), want) {
+			t.Errorf("fsfreeze calls = %v, want %v", calls(), want)
+		}
+	})
+	t.Run("thawed on timeout", func(t *testing.T) {
+		calls := stubFsfreeze(t)
+		thaw, err := freezeFilesystem(context.Background(), slog.Default(), "/data", time.Millisecond)
+		if err != nil {
+			t.Fatalf("freezeFilesystem() error: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(calls()) < 2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if err := thaw(); err == nil {
+			t.Error("thaw() after timeout returned no error")
+		}
+		if want := []string{"freeze /data", "thaw /data"}; !reflect.DeepEqual(calls(), want) {
+			t.Errorf("fsfreeze calls = %v, want %v", calls(), want)
+		}
+	})
+}
+
+func TestMarkFrozenCopies(t *testing.T) {
+	newResizes := func() []partitionResizeTarget {
+		return []partitionResizeTarget{
+			// relocated grow: copied
+			{original: partitionData{number: 1, start: 1 * MB, size: 8 * MB}, target: partitionData{start: 20 * MB, size: 16 * MB}},
+			// shrink in place: not copied
+			{original: partitionData{number: 2, start: 9 * MB, size: 8 * MB}, target: partitionData{start: 9 * MB, size: 4 * MB}},
+		}
+	}
+	resizes := newResizes()
+	if err := markFrozenCopies(resizes, Options{}); err != nil || anyFrozen(resizes) {
+		t.Errorf("without FreezeMounted, resizes = %+v, want none frozen", resizes)
+	}
+	resizes = newResizes()
+	if err := markFrozenCopies(resizes, Options{FreezeMounted: true}); err == nil || anyFrozen(resizes) {
+		t.Errorf("without AcceptLostWrites, markFrozenCopies() error = %v, resizes = %+v, want it refused", err, resizes)
+	}
+	if err := markFrozenCopies(resizes, Options{FreezeMounted: true, AcceptLostWrites: true, FreezeTimeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if resizes[0].freezeTimeout != time.Second || resizes[1].freezeTimeout != 0 {
+		t.Errorf("freeze timeouts = %v, %v, want 1s for the copy only", resizes[0].freezeTimeout, resizes[1].freezeTimeout)
+	}
+	resizes = newResizes()
+	if err := markFrozenCopies(resizes, Options{FreezeMounted: true, AcceptLostWrites: true}); err != nil {
+		t.Fatal(err)
+	}
+	if resizes[0].freezeTimeout != DefaultFreezeTimeout {
+		t.Errorf("freeze timeout = %v, want default %v", resizes[0].freezeTimeout, DefaultFreezeTimeout)
+	}
+}
@@ -0,0 +1,537 @@
+package partitionresizer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+)
+
+// excludedPaths are the names of the entries copyFileSystem neither copies
+// nor compares, as sync.CopyFileSystem does not, each filesystem having its
+// own.
+var excludedPaths = map[string]bool{
+	"lost+found":                true,
+	".DS_Store":                 true,
+	"System Volume Information": true,
+}
+
+// fileCopyBuffer is the size of the buffer copyFileSystem copies file
+// contents through.
+const fileCopyBuffer = 1 * MB
+
+// The file types of a mode as mknod(2) takes it, the same on every platform
+// ext4 is written on.
+const (
+	modeFIFO   = 0o010000
+	modeChar   = 0o020000
+	modeBlock  = 0o060000
+	modeSocket = 0o140000
+)
+
+// readlinker is a filesystem that can read the target of a symbolic link, as
+// ext4 can.
+type readlinker interface {
+	ReadLink(p string) (string, error)
+}
+
+// xattrReader is a filesystem that can read the extended attributes of a
+// file, as ext4 can.
+type xattrReader interface {
+	GetXattr(p string) (map[string][]byte, error)
+}
+
+// xattrWriter is a filesystem that can set an extended attribute of a file.
+type xattrWriter interface {
+	SetXattr(p, name string, value []byte) error
+}
+
+// lostMetadata is what of one kind of metadata copyFileSystem could not carry
+// over to the copy: how many entries lost it, and the first of them.
+type lostMetadata struct {
+	entries int
+	first   string
+	err     error
+}
+
+// fileSystemCopy copies one filesystem to another, see copyFileSystem.
+type fileSystemCopy struct {
+	logger   *slog.Logger
+	src, dst filesystem.FileSystem
+	// links holds the path each file with more than one link was first
+	// copied to, by inode, for each later link to it to be linked to that
+	links map[uint32]string
+	// noLinks is set once dst turns out not to make hard links, each later
+	// link then being copied as a file of its own
+	noLinks bool
+	// lost is what metadata dst could not keep, by kind, e.g. "ownership"
+	lost map[string]*lostMetadata
+	// noAtime gives each copy its modification time as its access time,
+	// see Options.NoAtime
+	noAtime bool
+	buf     []byte
+	// written is the bytes of file data written to dst so far, reported to
+	// report, if set, as each buffer of it is written
+	written int64
+	report  func(written int64)
+}
+
+// copyFileSystem copies the files and directories of src to dst, as
+// sync.CopyFileSystem does, and what else src holds that it would drop:
+// symbolic links, FIFOs, sockets and device files, made with dst.Symlink and
+// dst.Mknod, and hard links, a file being copied only once and each other
+// link to it made with dst.Link, so that its data is not duplicated. Should
+// dst not make hard links, each is copied as a file of its own, with a
+// warning; should it not make an entry otherwise, the copy fails rather than
+// leaving it out.
+//
+// The owner, group and permissions of each entry, and its extended
+// attributes, including security.* ones such as SELinux labels, are carried
+// over too, as far as dst supports them; what it does not is logged as a
+// warning once the copy is done, each kind of metadata with the number of
+// entries that lost it. So are the times of each entry, but that its access
+// time is its modification time should noAtime be set, see Options.NoAtime.
+//
+// report, if not nil, is called with the bytes of file data written to dst so
+// far as each buffer of it is written, for the copy to report its progress.
+func copyFileSystem(logger *slog.Logger, src, dst filesystem.FileSystem, noAtime bool, report func(written int64)) error {
+	c := &fileSystemCopy{logger: logger, src: src, dst: dst, links: map[uint32]string{}, lost: map[string]*lostMetadata{}, noAtime: noAtime, buf: make([]byte, fileCopyBuffer), report: report}
+	if err := c.copyDir("."); err != nil {
+		return err
+	}
+	for _, kind := range slices.Sorted(maps.Keys(c.lost)) {
+		l := c.lost[kind]
+		logger.Warn("target filesystem cannot keep metadata of the copy", "metadata", kind, "entries", l.entries, "first", l.first, "error", l.err)
+	}
+	return nil
+}
+
+// copyDir copies the entries of the directory dir, and of those beneath it.
+func (c *fileSystemCopy) copyDir(dir string) error {
+	entries, err := fs.ReadDir(c.src, dir)
+	if err != nil {
+		return fmt.Errorf("read dir %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if excludedPaths[entry.Name()] {
+			continue
+		}
+		p := path.Join(dir, entry.Name())
+		// unlike Stat, the Info of an ext4 entry has no permissions
+		info, err := c.src.Stat(p)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", p, err)
+		}
+		// FAT does not give the mode of a directory ModeDir
+		switch mode := info.Mode(); {
+		case info.IsDir():
+			if err := c.dst.Mkdir(p); err != nil {
+				return fmt.Errorf("create dir %s: %w", p, err)
+			}
+			if err := c.copyDir(p); err != nil {
+				return err
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := linkTarget(c.src, p, info)
+			if err != nil {
+				return fmt.Errorf("read symlink %s: %w", p, err)
+			}
+			if err := c.dst.Symlink(target, p); err != nil {
+				return fmt.Errorf("create symlink %s: %w", p, err)
+			}
+		case mode.IsRegular():
+			linked, err := c.copyFile(p, info)
+			if err != nil {
+				return fmt.Errorf("copy file %s: %w", p, err)
+			}
+			if linked {
+				// a hard link shares its metadata with the file it links to
+				continue
+			}
+		default:
+			nodeMode, ok := mknodMode(mode)
+			if !ok {
+				return fmt.Errorf("%s is of type %v, which cannot be copied", p, mode.Type())
+			}
+			var dev int
+			if st, ok := info.Sys().(*ext4.StatT); ok {
+				dev = mkdev(st.Major, st.Minor)
+			}
+			if err := c.dst.Mknod(p, nodeMode, dev); err != nil {
+				return fmt.Errorf("create %v %s: %w", mode.Type(), p, err)
+			}
+		}
+		if err := c.preserve(p, info); err != nil {
+			return err
+		}
+		// last, that nothing else changes them, a directory's once what is
+		// in it is copied
+		c.restoreTimes(p, info)
+	}
+	return nil
+}
+
+// restoreTimes gives the copy of the entry p of src, whose FileInfo is info,
+// the creation, access and modification times of p, as far as src records
+// them, its modification time standing in for those it does not, and for
+// its access time should c.noAtime be set. It is best effort, what dst
+// cannot set being recorded in c.lost.
+func (c *fileSystemCopy) restoreTimes(p string, info fs.FileInfo) {
+	mtime := info.ModTime()
+	ctime, atime := mtime, mtime
+	if st, ok := info.Sys().(*ext4.StatT); ok {
+		if !st.CreateTime.IsZero() {
+			ctime = st.CreateTime
+		}
+		if !st.AccessTime.IsZero() && !c.noAtime {
+			atime = st.AccessTime
+		}
+	}
+	if err := c.dst.Chtimes(p, ctime, atime, mtime); err != nil {
+		c.lose("times", p, err)
+	}
+}
+
+// preserve carries the owner, group, permissions and extended attributes of
+// the entry p of src, whose FileInfo is info, over to its copy, recording
+// what dst does not support in c.lost. Only an ext4 source has them to carry
+// over.
+func (c *fileSystemCopy) preserve(p string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*ext4.StatT)
+	if !ok {
+		return nil
+	}
+	// Chown, Chmod and SetXattr follow a symbolic link, so a link keeps what
+	// dst gives it, which is all a link's permissions ever are
+	symlink := info.Mode()&fs.ModeSymlink != 0
+	switch {
+	case symlink:
+		if st.UID != 0 || st.GID != 0 {
+			c.lose("ownership", p, nil)
+		}
+	default:
+		if err := c.dst.Chown(p, int(st.UID), int(st.GID)); err != nil {
+			if !isUnsupported(err) {
+				return fmt.Errorf("chown %s: %w", p, err)
+			}
+			c.lose("ownership", p, err)
+		}
+		if err := c.dst.Chmod(p, info.Mode()); err != nil {
+			if !isUnsupported(err) {
+				return fmt.Errorf("chmod %s: %w", p, err)
+			}
+			c.lose("permissions", p, err)
+		}
+	}
+	xr, ok := c.src.(xattrReader)
+	if !ok {
+		return nil
+	}
+	xattrs, err := xr.GetXattr(p)
+	if err != nil {
+		return fmt.Errorf("read extended attributes of %s: %w", p, err)
+	}
+	xw, ok := c.dst.(xattrWriter)
+	for _, name := range slices.Sorted(maps.Keys(xattrs)) {
+		kind := "extended attribute " + name
+		if !ok || symlink {
+			c.lose(kind, p, nil)
+			continue
+		}
+		if err := xw.SetXattr(p, name, xattrs[name]); err != nil {
+			if !isUnsupported(err) {
+				return fmt.Errorf("set extended attribute %s of %s: %w", name, p, err)
+			}
+			c.lose(kind, p, err)
+		}
+	}
+	return nil
+}
+
+// lose records that the copy of p does not have the metadata kind, dst
+// having failed with err to give it, or not supporting it at all should err
+// be nil.
+func (c *fileSystemCopy) lose(kind, p string, err error) {
+	l := c.lost[kind]
+	if l == nil {
+		l = &lostMetadata{first: p, err: err}
+		c.lost[kind] = l
+	}
+	l.entries++
+}
+
+// copyFile copies the regular file p, or links it to the copy of another link
+// to the same file, should it have been copied already, returning true if so.
+func (c *fileSystemCopy) copyFile(p string, info fs.FileInfo) (bool, error) {
+	st, linked := info.Sys().(*ext4.StatT)
+	linked = linked && st.Nlink > 1
+	if linked && !c.noLinks {
+		if first, ok := c.links[st.Ino]; ok {
+			err := c.dst.Link(first, p)
+			if !isUnsupported(err) {
+				return err == nil, err
+			}
+			c.noLinks = true
+			c.logger.Warn("target filesystem cannot make hard links, copying each link as a file of its own", "path", p, "link", first, "error", err)
+		}
+	}
+	in, err := c.src.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := c.dst.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_RDWR)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = out.Close() }()
+	if _, err := io.CopyBuffer(countingWriter{out, c}, struct{ io.Reader }{in}, c.buf); err != nil {
+		return false, err
+	}
+	if linked && !c.noLinks {
+		c.links[st.Ino] = p
+	}
+	return false, nil
+}
+
+// countingWriter counts the bytes written to the Writer it embeds as
+// written by c, see fileSystemCopy.written.
+type countingWriter struct {
+	io.Writer
+	c *fileSystemCopy
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.c.written += int64(n)
+	if w.c.report != nil {
+		w.c.report(w.c.written)
+	}
+	return n, err
+}
+
+// maxTreeDiffs is how many differences a treeDiff lists in its Error, the
+// rest being counted.
+const maxTreeDiffs = 10
+
+// treeDiff is what compareFileSystems finds to differ between a filesystem
+// and its copy, one difference each, e.g. "missing: EFI/BOOT/BOOTX64.EFI".
+type treeDiff []string
+
+func (d treeDiff) Error() string {
+	msg := fmt.Sprintf("%d differences between the filesystem and its copy: %s", len(d), strings.Join(d[:min(len(d), maxTreeDiffs)], "; "))
+	if len(d) > maxTreeDiffs {
+		msg += fmt.Sprintf("; and %d more", len(d)-maxTreeDiffs)
+	}
+	return msg
+}
+
+// compareFileSystems walks src and dst, the copy copyFileSystem made of it,
+// and returns every difference it finds between them as a treeDiff: an entry
+// missing from dst, or that dst has and src does not, or whose type, size,
+// symbolic link target, device or SHA-256 digest differs, or its
+// permissions, where both are ext4, and copyFileSystem carries them over.
+// It returns any other error should it fail to read either. It is a check of
+// what the filesystems hold, not of their integrity.
+func compareFileSystems(src, dst filesystem.FileSystem) error {
+	var diff treeDiff
+	seen := map[string]bool{}
+	err := fs.WalkDir(src, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if excludedPaths[path.Base(p)] {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		seen[p] = true
+		want, err := src.Stat(p)
+		if err != nil {
+			return err
+		}
+		got, err := dst.Stat(p)
+		if err != nil {
+			diff = append(diff, "missing: "+p)
+			if want.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		wantType, gotType := want.Mode().Type()&^fs.ModeDir, got.Mode().Type()&^fs.ModeDir
+		if want.IsDir() != got.IsDir() || wantType != gotType {
+			diff = append(diff, fmt.Sprintf("type: %s is %s, was %s", p, entryType(got), entryType(want)))
+			if want.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		wantStat, _ := want.Sys().(*ext4.StatT)
+		gotStat, _ := got.Sys().(*ext4.StatT)
+		if wantStat != nil && gotStat != nil && want.Mode()&fs.ModeSymlink == 0 && want.Mode() != got.Mode() {
+			diff = append(diff, fmt.Sprintf("mode: %s is %v, was %v", p, got.Mode(), want.Mode()))
+		}
+		switch mode := want.Mode(); {
+		case want.IsDir():
+		case mode&fs.ModeSymlink != 0:
+			wantTarget, err := linkTarget(src, p, want)
+			if err != nil {
+				return err
+			}
+			gotTarget, err := linkTarget(dst, p, got)
+			if err != nil {
+				return err
+			}
+			if gotTarget != wantTarget {
+				diff = append(diff, fmt.Sprintf("symlink: %s points to %q, was %q", p, gotTarget, wantTarget))
+			}
+		case mode.IsRegular():
+			if want.Size() != got.Size() {
+				diff = append(diff, fmt.Sprintf("size: %s is %d bytes, was %d", p, got.Size(), want.Size()))
+				return nil
+			}
+			wantSum, err := fileDigest(src, p)
+			if err != nil {
+				return err
+			}
+			gotSum, err := fileDigest(dst, p)
+			if err != nil {
+				return err
+			}
+			if gotSum != wantSum {
+				diff = append(diff, fmt.Sprintf("content: %s has SHA-256 %s, was %s", p, gotSum, wantSum))
+			}
+		default:
+			if wantStat != nil && gotStat != nil && (wantStat.Major != gotStat.Major || wantStat.Minor != gotStat.Minor) {
+				diff = append(diff, fmt.Sprintf("device: %s is %d:%d, was %d:%d", p, gotStat.Major, gotStat.Minor, wantStat.Major, wantStat.Minor))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = fs.WalkDir(dst, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if excludedPaths[path.Base(p)] {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !seen[p] {
+			diff = append(diff, "extra: "+p)
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(diff) > 0 {
+		return diff
+	}
+	return nil
+}
+
+// logTreeDiff logs each difference err lists, should it be a treeDiff,
+// between the original of r and its copy.
+func logTreeDiff(logger *slog.Logger, r partitionResizeTarget, err error) {
+	var diff treeDiff
+	if !errors.As(err, &diff) {
+		return
+	}
+	for _, d := range diff {
+		logger.Error("copy differs from its source", "partition", r.original.number, "target", r.target.number, "difference", d)
+	}
+}
+
+// fileDigest returns the SHA-256 digest, in hex, of the file p of fsys.
+func fileDigest(fsys fs.FS, p string) (string, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("read %s: %w", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entryType describes the type of the entry whose FileInfo is info, e.g.
+// "a directory".
+func entryType(info fs.FileInfo) string {
+	switch mode := info.Mode(); {
+	case info.IsDir():
+		return "a directory"
+	case mode.IsRegular():
+		return "a file"
+	case mode&fs.ModeSymlink != 0:
+		return "a symlink"
+	default:
+		return "a " + mode.Type().String()
+	}
+}
+
+// linkTarget returns the target of the symbolic link p of fsys, whose
+// FileInfo is info.
+func linkTarget(fsys fs.FS, p string, info fs.FileInfo) (string, error) {
+	if rl, ok := fsys.(readlinker); ok {
+		return rl.ReadLink(p)
+	}
+	if st, ok := info.Sys().(*ext4.StatT); ok {
+		return st.LinkTarget, nil
+	}
+	return "", fmt.Errorf("filesystem cannot read symlink %s", p)
+}
+
+// mknodMode returns mode as mknod(2) takes it, or false should it not be of a
+// type mknod makes.
+func mknodMode(mode fs.FileMode) (uint32, bool) {
+	var t uint32
+	switch mode.Type() {
+	case fs.ModeNamedPipe:
+		t = modeFIFO
+	case fs.ModeSocket:
+		t = modeSocket
+	case fs.ModeDevice | fs.ModeCharDevice:
+		t = modeChar
+	case fs.ModeDevice:
+		t = modeBlock
+	default:
+		return 0, false
+	}
+	return t | uint32(mode.Perm()), true
+}
+
+// mkdev returns the device number of major and minor, as mknod(2) takes it on
+// Linux.
+func mkdev(major, minor uint32) int {
+	dev := uint64(major&0xfffff000)<<32 | uint64(major&0xfff)<<8 |
+		uint64(minor&0xffffff00)<<12 | uint64(minor&0xff)
+	return int(dev)
+}
+
+// isUnsupported reports whether err is from a filesystem that does not do
+// what it was asked to.
+func isUnsupported(err error) bool {
+	return errors.Is(err, filesystem.ErrNotImplemented) || errors.Is(err, filesystem.ErrNotSupported)
+}
@@ -0,0 +1,289 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// recordingFS is a filesystem that records the hard links and nodes it is
+// asked to make, rather than failing to, as ext4 does, a node being made a
+// regular file.
+type recordingFS struct {
+	filesystem.FileSystem
+	links, nodes []string
+	opened       int
+}
+
+func (f *recordingFS) Link(oldpath, newpath string) error {
+	f.links = append(f.links, oldpath+" "+newpath)
+	return nil
+}
+
+func (f *recordingFS) Mknod(pathname string, mode uint32, dev int) error {
+	f.nodes = append(f.nodes, fmt.Sprintf("%s %o %d", pathname, mode, dev))
+	node, err := f.FileSystem.OpenFile(pathname, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	return node.Close()
+}
+
+func (f *recordingFS) OpenFile(pathname string, flag int) (filesystem.File, error) {
+	f.opened++
+	return f.FileSystem.OpenFile(pathname, flag)
+}
+
+// ext4Copy returns an ext4 filesystem made by mkfs.ext4 from the tree
+// populate makes, and an empty one to copy it to.
+func ext4Copy(t *testing.T, populate func(dir string)) (src, dst filesystem.FileSystem) {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	tree := t.TempDir()
+	populate(tree)
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 16 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 2, Start: 17 * MB / 512, Size: 32 * MB, Type: gpt.LinuxFilesystem, Name: "data_resized2"},
+	})
+	mkfs := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", "-d", tree, "-E", fmt.Sprintf("offset=%d", 1*MB), diskPath, fmt.Sprint(16*MB/4096))
+	if out, err := mkfs.CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v\n%s", err, out)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, err = d.GetFilesystem(1); err != nil {
+		t.Fatal(err)
+	}
+	if dst, err = d.CreateFilesystem(disk.FilesystemSpec{Partition: 2, FSType: filesystem.TypeExt4}); err != nil {
+		t.Fatal(err)
+	}
+	return src, dst
+}
+
+// TestCopyFileSystem copies an ext4 filesystem holding a symbolic link, a
+// file with two hard links and a FIFO: to a filesystem that makes them all,
+// linking the second link rather than copying it, and to ext4, which makes
+// no hard links or FIFOs, so that the link is copied as a file of its own,
+// and the FIFO fails the copy rather than being left out, reporting the file
+// data it writes as it goes.
+func TestCopyFileSystem(t *testing.T) {
+	populate := func(fifo bool) func(string) {
+		return func(dir string) {
+			if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "sub", "data"), []byte("linked data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(dir, "sub", "data"), filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("sub/data", filepath.Join(dir, "symlink")); err != nil {
+				t.Fatal(err)
+			}
+			if fifo {
+				if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	src, dst := ext4Copy(t, populate(true))
+	rec := &recordingFS{FileSystem: dst}
+	if err := copyFileSystem(slog.Default(), src, rec, false, nil); err != nil {
+		t.Fatalf("copyFileSystem() error: %v", err)
+	}
+	if len(rec.links) != 1 || (rec.links[0] != "link sub/data" && rec.links[0] != "sub/data link") {
+		t.Errorf("copyFileSystem() links = %q, want link and sub/data linked", rec.links)
+	}
+	if rec.opened != 1 {
+		t.Errorf("copyFileSystem() wrote %d files, want the two links to one written once", rec.opened)
+	}
+	if want := fmt.Sprintf("fifo %o 0", modeFIFO|0o640); len(rec.nodes) != 1 || rec.nodes[0] != want {
+		t.Errorf("copyFileSystem() nodes = %q, want %q", rec.nodes, want)
+	}
+	if target, err := dst.(readlinker).ReadLink("symlink"); err != nil || target != "sub/data" {
+		t.Errorf("copied symlink = %q, %v, want sub/data", target, err)
+	}
+
+	src, dst = ext4Copy(t, populate(false))
+	var reported []int64
+	if err := copyFileSystem(slog.Default(), src, dst, false, func(written int64) { reported = append(reported, written) }); err != nil {
+		t.Fatalf("copyFileSystem() to ext4 error: %v", err)
+	}
+	if want := int64(2 * len("linked data")); len(reported) == 0 || reported[len(reported)-1] != want {
+		t.Errorf("copyFileSystem() reported %v bytes written, want the two links' %d in the end", reported, want)
+	}
+	if err := compareFileSystems(src, dst); err != nil {
+		t.Errorf("compareFileSystems() error: %v", err)
+	}
+	for _, p := range []string{"link", "sub/data"} {
+		if data, err := dst.ReadFile(p); err != nil || string(data) != "linked data" {
+			t.Errorf("copy of %s = %q, %v, want %q", p, data, err, "linked data")
+		}
+	}
+	if err := dst.Symlink("sub/data", "extra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Remove("link"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := dst.OpenFile("sub/data", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("LINKED")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if err := dst.Chmod("sub", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	err = compareFileSystems(src, dst)
+	var diff treeDiff
+	if !errors.As(err, &diff) {
+		t.Fatalf("compareFileSystems() of a changed copy error = %v, want a treeDiff", err)
+	}
+	want := []string{"missing: link", "mode: sub is drwx------, was drwxr-xr-x", "content: sub/data has SHA-256", "extra: extra"}
+	if len(diff) != len(want) {
+		t.Fatalf("compareFileSystems() = %q, want %d differences", diff, len(want))
+	}
+	for _, w := range want {
+		if !slices.ContainsFunc(diff, func(d string) bool { return strings.HasPrefix(d, w) }) {
+			t.Errorf("compareFileSystems() = %q, want %q", diff, w)
+		}
+	}
+
+	src, dst = ext4Copy(t, populate(true))
+	if err := copyFileSystem(slog.Default(), src, dst, false, nil); err == nil || !strings.Contains(err.Error(), "fifo") {
+		t.Errorf("copyFileSystem() of a FIFO to ext4 error = %v, want it to fail on the FIFO", err)
+	}
+}
+
+// TestCopyFileSystemMetadata copies a file and a directory with an owner,
+// group and permissions of their own, and a file with an extended attribute,
+// which ext4 can read but not write, so that it is reported rather than kept.
+func TestCopyFileSystemMetadata(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	var xattrs bool
+	src, dst := ext4Copy(t, func(dir string) {
+		if err := os.Mkdir(filepath.Join(dir, "private"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "private", "tool"), []byte("#!/bin/sh\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for p, mode := range map[string]fs.FileMode{"private": fs.ModeSticky | 0o750, "private/tool": fs.ModeSetuid | 0o755} {
+			if err := os.Chown(filepath.Join(dir, p), 1000, 1001); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(filepath.Join(dir, p), mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		xattrs = syscall.Setxattr(filepath.Join(dir, "private", "tool"), "user.origin", []byte("test"), 0) == nil
+	})
+	var logs bytes.Buffer
+	if err := copyFileSystem(slog.New(slog.NewTextHandler(&logs, nil)), src, dst, false, nil); err != nil {
+		t.Fatalf("copyFileSystem() error: %v", err)
+	}
+	for p, want := range map[string]fs.FileMode{"private": fs.ModeDir | fs.ModeSticky | 0o750, "private/tool": fs.ModeSetuid | 0o755} {
+		info, err := dst.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*ext4.StatT)
+		if st.UID != 1000 || st.GID != 1001 || info.Mode() != want {
+			t.Errorf("copy of %s is %d:%d %v, want 1000:1001 %v", p, st.UID, st.GID, info.Mode(), want)
+		}
+	}
+	if !xattrs {
+		t.Log("extended attributes not supported by the temporary directory, not checking them")
+	} else if !strings.Contains(logs.String(), `metadata="extended attribute user.origin" entries=1 first=private/tool`) {
+		t.Errorf("copyFileSystem() logged %q, want the extended attribute it could not keep reported", logs.String())
+	}
+}
+
+// TestCopyFileSystemTimes copies a file and a directory read since they were
+// last modified, so that their access times differ from their modification
+// times, keeping them, and with noAtime, giving the copies their
+// modification times instead.
+func TestCopyFileSystemTimes(t *testing.T) {
+	atime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, noAtime := range []bool{false, true} {
+		src, dst := ext4Copy(t, func(dir string) {
+			if err := os.Mkdir(filepath.Join(dir, "dir"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "dir", "file"), []byte("data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"dir/file", "dir"} {
+				if err := os.Chtimes(filepath.Join(dir, p), atime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		if err := copyFileSystem(slog.Default(), src, dst, noAtime, nil); err != nil {
+			t.Fatalf("copyFileSystem(noAtime %t) error: %v", noAtime, err)
+		}
+		want := atime
+		if noAtime {
+			want = mtime
+		}
+		for _, p := range []string{"dir", "dir/file"} {
+			info, err := dst.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Sys().(*ext4.StatT).AccessTime; !got.Equal(want) || !info.ModTime().Equal(mtime) {
+				t.Errorf("copy of %s with noAtime %t has access time %v, modification time %v, want %v and %v", p, noAtime, got, info.ModTime(), want, mtime)
+			}
+		}
+	}
+}
+
+func TestMkdev(t *testing.T) {
+	for _, tt := range []struct {
+		major, minor uint32
+		want         int
+	}{
+		{8, 1, 0x801},
+		{259, 0x12345, 0x12310345},
+	} {
+		if got := mkdev(tt.major, tt.minor); got != tt.want {
+			t.Errorf("mkdev(%d, %d) = %#x, want %#x", tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
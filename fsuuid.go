@@ -0,0 +1,203 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/google/uuid"
+)
+
+const (
+	// offsets of the filesystem UUID from the start of the partition
+	ext4UUIDAt = ext4SuperblockOffset + 0x68
+	xfsUUIDAt  = 32
+	// LUKS1 and LUKS2 both keep the UUID as a NUL-padded string
+	luksUUIDAt   = 168
+	luksUUIDSize = 40
+	// a FAT32 boot sector has its type at 0x52 and its volume ID at 0x43
+	fat32TypeAt     = 0x52
+	fat32VolumeIDAt = 0x43
+)
+
+// readFilesystemUUID returns the type and UUID of the ext4 filesystem, XFS
+// filesystem or LUKS container on the partition starting at byte offset start
+// in r. It returns an empty type for anything else.
+func readFilesystemUUID(r io.ReaderAt, start int64) (string, string, error) {
+	if _, err := readExt4Usage(r, start); err == nil {
+		id, err := readUUIDAt(r, start+ext4UUIDAt)
+		return "ext4", id, err
+	}
+	if inPlaceFilesystem(r, start) == "xfs" {
+		id, err := readUUIDAt(r, start+xfsUUIDAt)
+		return "xfs", id, err
+	}
+	if _, isLUKS, err := readLUKSHeader(r, start); err != nil || !isLUKS {
+		return "", "", err
+	}
+	buf := make([]byte, luksUUIDSize)
+	if _, err := r.ReadAt(buf, start+luksUUIDAt); err != nil {
+		return "", "", fmt.Errorf("read LUKS UUID: %w", err)
+	}
+	return "luks", string(bytes.TrimRight(buf, "\x00")), nil
+}
+
+// filesystemUUID returns the UUID of the filesystem on the partition starting
+// at byte offset start in r, as blkid reports it: that of an ext4 or XFS
+// filesystem, LUKS container or swap area, or the volume ID of a FAT32
+// filesystem (e.g. 1A2B-3C4D). It is best effort, returning "" for a partition
+// it cannot read or whose filesystem it does not know.
+func filesystemUUID(r io.ReaderAt, start int64) string {
+	if fsType, id, err := readFilesystemUUID(r, start); err == nil && fsType != "" {
+		return id
+	}
+	if hdr, isSwap, err := readSwapHeader(r, start); err == nil && isSwap {
+		return hdr.uuid
+	}
+	return fat32VolumeID(r, start)
+}
+
+// fat32VolumeID returns the volume ID of the FAT32 filesystem on the partition
+// starting at byte offset start in r, e.g. 1A2B-3C4D, or "" if there is none.
+func fat32VolumeID(r io.ReaderAt, start int64) string {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, start); err != nil {
+		return ""
+	}
+	if string(boot[fat32TypeAt:fat32TypeAt+8]) != "FAT32   " || boot[510] != 0x55 || boot[511] != 0xaa {
+		return ""
+	}
+	id := binary.LittleEndian.Uint32(boot[fat32VolumeIDAt:])
+	return fmt.Sprintf("%04X-%04X", id>>16, id&0xffff)
+}
+
+// readUUIDAt reads a binary 16-byte UUID at offset in r.
+func readUUIDAt(r io.ReaderAt, offset int64) (string, error) {
+	var id uuid.UUID
+	if _, err := r.ReadAt(id[:], offset); err != nil {
+		return "", fmt.Errorf("read filesystem UUID: %w", err)
+	}
+	return id.String(), nil
+}
+
+// execSetFSUUID sets the UUID of the filesystem of type fsType, as returned by
+// readFilesystemUUID, on the given device or image file.
+var execSetFSUUID = func(ctx context.Context, fsType, partDevice, id string) error {
+	switch fsType {
+	case "ext4":
+		return runTool(ctx, "tune2fs", "-U", id, partDevice)
+	case "xfs":
+		return runTool(ctx, "xfs_admin", "-U", id, partDevice)
+	case "luks":
+		return runTool(ctx, "cryptsetup", "luksUUID", "--batch-mode", "--uuid", id, partDevice)
+	}
+	return fmt.Errorf("cannot set the UUID of a %s filesystem", fsType)
+}
+
+// setFilesystemUUID sets the UUID of the filesystem of type fsType on the
+// partition part of device, a block device or image file.
+func setFilesystemUUID(ctx context.Context, device string, part partitionData, fsType, id string) error {
+	// checkFilesystem locates the partition, and writes an image file's back
+	// when "fixing"
+	return checkFilesystem(ctx, device, part, func(ctx context.Context, partDevice string, _ bool) error {
+		return execSetFSUUID(ctx, fsType, partDevice, id)
+	}, true)
+}
+
+// markTemporaryUUIDs marks every partition that is to be copied to a new
+// location to be given a temporary filesystem UUID, if opts.TemporaryUUID is
+// set.
+func markTemporaryUUIDs(resizes []partitionResizeTarget, opts Options) {
+	if !opts.TemporaryUUID {
+		return
+	}
+	for i, r := range resizes {
+		if r.original.start != r.target.start && r.target.size >= r.original.size {
+			resizes[i].temporaryUUID = true
+		}
+	}
+}
+
+// assignTemporaryUUID gives the copy of r a new, random filesystem UUID, if it
+// was copied raw and so carries the same UUID as its original, so that while
+// both exist a lookup by UUID does not find two filesystems. A copy that
+// already has a UUID of its own, such as a file-by-file ext4 copy, is left as
+// it is.
+func assignTemporaryUUID(ctx context.Context, logger *slog.Logger, d *disk.Disk, r partitionResizeTarget) error {
+	if !r.temporaryUUID {
+		return nil
+	}
+	fsType, original, err := readFilesystemUUID(d.Backend, r.original.start)
+	if err != nil || fsType == "" {
+		return err
+	}
+	_, copied, err := readFilesystemUUID(d.Backend, r.target.start)
+	if err != nil {
+		return err
+	}
+	if copied != original {
+		return nil
+	}
+	temporary := uuid.NewString()
+	logger.Info("giving copy a temporary filesystem UUID", "partition", r.original.number, "target", r.target.number, "filesystem", fsType, "uuid", temporary)
+	return setFilesystemUUID(ctx, d.Backend.Path(), r.target, fsType, temporary)
+}
+
+// restoreUUIDs gives each copy made with a temporary filesystem UUID the UUID
+// of its original back, or, for FAT32, its volume serial number, see
+// keepFAT32Boot. It runs once every copy has been made and verified,
+// just before the originals are removed from the partition table, so that
+// two filesystems share a UUID only between the two. An ext4 copy is checked
+// with e2fsck first, as it will replace its original. Restoring a UUID a copy
+// already has is a no-op, so this is safe to re-run.
+func restoreUUIDs(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) error {
+	device := d.Backend.Path()
+	for _, r := range resizes {
+		if !r.temporaryUUID {
+			continue
+		}
+		fsType, original, err := readFilesystemUUID(d.Backend, r.original.start)
+		if err != nil {
+			return fmt.Errorf("failed to read filesystem UUID of partition %d: %v", r.original.number, err)
+		}
+		if fsType == "" {
+			if err := restoreFAT32Serial(logger, d, r); err != nil {
+				return fmt.Errorf("failed to restore volume serial number on partition %d: %v", r.target.number, err)
+			}
+			continue
+		}
+		_, copied, err := readFilesystemUUID(d.Backend, r.target.start)
+		if err != nil {
+			return fmt.Errorf("failed to read filesystem UUID of partition %d: %v", r.target.number, err)
+		}
+		if copied == original {
+			continue
+		}
+		if fsType == "ext4" {
+			if err := checkFilesystem(ctx, device, r.target, execE2fsck, false); err != nil {
+				return fmt.Errorf("integrity check failed for copy of partition %d: %w", r.original.number, err)
+			}
+		}
+		logger.Info("restoring filesystem UUID", "partition", r.original.number, "target", r.target.number, "filesystem", fsType, "uuid", original)
+		if err := setFilesystemUUID(ctx, device, r.target, fsType, original); err != nil {
+			return fmt.Errorf("failed to restore filesystem UUID on partition %d: %v", r.target.number, err)
+		}
+	}
+	return nil
+}
+
+// restoreFAT32Serial gives the FAT32 copy of r the volume serial number of its
+// original, should the original be FAT32 and the copy not have it already.
+func restoreFAT32Serial(logger *slog.Logger, d *disk.Disk, r partitionResizeTarget) error {
+	original := fat32VolumeID(d.Backend, r.original.start)
+	if original == "" || fat32VolumeID(d.Backend, r.target.start) == original {
+		return nil
+	}
+	logger.Info("restoring FAT32 volume serial number", "partition", r.original.number, "target", r.target.number, "serial", original)
+	_, err := copyFAT32Boot(d, r, []fat32BootField{fat32VolumeSerial})
+	return err
+}
@@ -0,0 +1,172 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestReadFilesystemUUID(t *testing.T) {
+	const (
+		start    = 4096
+		wantUUID = "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+	)
+	raw := []byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78, 0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0}
+	tests := []struct {
+		name   string
+		fsType string
+		write  func(buf []byte)
+	}{
+		{"xfs", "xfs", func(buf []byte) {
+			copy(buf, xfsMagic)
+			copy(buf[xfsUUIDAt:], raw)
+		}},
+		{"luks", "luks", func(buf []byte) {
+			copy(buf, luksMagic)
+			buf[7] = 1
+			copy(buf[luksUUIDAt:], wantUUID)
+		}},
+		{"unknown", "", func(buf []byte) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 64*KB)
+			tt.write(buf[start:])
+			path := filepath.Join(t.TempDir(), "disk.img")
+			if err := os.WriteFile(path, buf, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = f.Close() }()
+			fsType, id, err := readFilesystemUUID(f, start)
+			if err != nil {
+				t.Fatalf("readFilesystemUUID() error: %v", err)
+			}
+			if fsType != tt.fsType {
+				t.Errorf("readFilesystemUUID() type = %q, want %q", fsType, tt.fsType)
+			}
+			if tt.fsType != "" && id != wantUUID {
+				t.Errorf("readFilesystemUUID() UUID = %q, want %q", id, wantUUID)
+			}
+		})
+	}
+}
+
+// TestFilesystemUUID reads the UUIDs blkid would report of an XFS and a FAT32
+// filesystem, and none of an unknown one.
+func TestFilesystemUUID(t *testing.T) {
+	const start = 4096
+	raw := []byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78, 0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0}
+	tests := []struct {
+		name  string
+		want  string
+		write func(buf []byte)
+	}{
+		{"xfs", "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0", func(buf []byte) {
+			copy(buf, xfsMagic)
+			copy(buf[xfsUUIDAt:], raw)
+		}},
+		{"fat32", "1A2B-3C4D", func(buf []byte) {
+			copy(buf[fat32TypeAt:], "FAT32   ")
+			binary.LittleEndian.PutUint32(buf[fat32VolumeIDAt:], 0x1a2b3c4d)
+			buf[510], buf[511] = 0x55, 0xaa
+		}},
+		{"unknown", "", func(buf []byte) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 64*KB)
+			tt.write(buf[start:])
+			if got := filesystemUUID(bytes.NewReader(buf), start); got != tt.want {
+				t.Errorf("filesystemUUID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTemporaryUUID raw-copies an ext4 filesystem within an image, gives the
+// copy a temporary UUID and then restores the original's, using the real
+// mkfs.ext4, tune2fs and e2fsck.
+func TestTemporaryUUID(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "tune2fs", "e2fsck"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: "data_resized2", start: 16 * MB, size: 16 * MB, end: 32*MB - 1}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(original.start / sectorSize), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+			{Index: 2, Start: uint64(target.start / sectorSize), Size: uint64(target.size), Type: gpt.LinuxFilesystem, Name: target.label},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	mkfs := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", "-E", fmt.Sprintf("offset=%d", original.start), diskPath, fmt.Sprint(original.size/4096))
+	if out, err := mkfs.CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v\n%s", err, out)
+	}
+	if err := CopyRange(diskPath, diskPath, original.start, target.start, original.size, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	uuidOf := func(part partitionData) string {
+		t.Helper()
+		fsType, id, err := readFilesystemUUID(d.Backend, part.start)
+		if err != nil || fsType != "ext4" {
+			t.Fatalf("readFilesystemUUID(partition %d) = %q, %v, want ext4", part.number, fsType, err)
+		}
+		return id
+	}
+	want := uuidOf(original)
+	r := partitionResizeTarget{original: original, target: target, temporaryUUID: true}
+	if err := assignTemporaryUUID(context.Background(), slog.Default(), d, r); err != nil {
+		t.Fatalf("assignTemporaryUUID() error: %v", err)
+	}
+	if got := uuidOf(target); got == want {
+		t.Fatalf("copy still has the original UUID %s", want)
+	}
+	if got := uuidOf(original); got != want {
+		t.Fatalf("original UUID changed to %s, want %s", got, want)
+	}
+	if err := restoreUUIDs(context.Background(), slog.Default(), d, []partitionResizeTarget{r}); err != nil {
+		t.Fatalf("restoreUUIDs() error: %v", err)
+	}
+	if got := uuidOf(target); got != want {
+		t.Errorf("copy UUID = %s after restore, want %s", got, want)
+	}
+}
@@ -2,7 +2,9 @@ package partitionresizer
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"testing"
@@ -175,7 +177,7 @@ func TestCopyFilesystemsSquashfs(t *testing.T) {
 			},
 		},
 	}
-	if err := copyFilesystems(d, resizes); err != nil {
+	if err := copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1); err != nil {
 		t.Fatalf("copyFilesystems (squashfs grow): %v", err)
 	}
 
@@ -206,7 +208,7 @@ func TestCopyFilesystemsSquashfs(t *testing.T) {
 // which never tests the grow case.
 //
 // The FAT32 branch in copyFilesystems uses CreateFilesystem +
-// CopyFileSystem + CompareFS rather than CopyPartitionRaw, so the
+// copyFileSystem + compareFileSystems rather than CopyPartitionRaw, so the
 // EVE-style ESP grow workflow has to go through this code path. The
 // test creates a small FAT32 source partition with known files, then
 // grows it 4x and verifies the file content round-trips.
@@ -306,7 +308,7 @@ func TestCopyFilesystemsFat32Grow(t *testing.T) {
 			},
 		},
 	}
-	if err := copyFilesystems(d, resizes); err != nil {
+	if err := copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1); err != nil {
 		t.Fatalf("copyFilesystems (fat32 grow): %v", err)
 	}
 
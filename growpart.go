@@ -0,0 +1,114 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	diskpkg "github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// GrowPart grows partition number of disk into all of the free space
+// immediately following it, in place, and then grows the ext4 or XFS
+// filesystem on it to fill it, online should it be mounted, as growpart
+// followed by resize2fs or xfs_growfs would, first moving the backup GPT of a
+// disk grown since it was partitioned to its end. Nothing is copied or moved: a
+// partition holding any other filesystem is refused, and should less than a
+// MB follow it, GrowPart returns an error wrapping ErrNoChange. opts.OnlineGrow
+// is implied. It returns a *Result as Run does.
+func GrowPart(disk string, number int, opts Options) (*Result, error) {
+	return GrowPartContext(context.Background(), disk, number, opts)
+}
+
+// GrowPartContext is GrowPart, stopping cleanly should ctx be done, as
+// RunContext.
+func GrowPartContext(ctx context.Context, disk string, number int, opts Options) (*Result, error) {
+	uuid, size, err := followingSpace(disk, number, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.OnlineGrow = true
+	grow := NewPartitionChange(IdentifierByPartUUID, uuid, size)
+	return run(ctx, func(opts Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+		// on a dry run, the backup GPT followingSpace found short of the end
+		// of the disk is still there
+		d, table, resizes, err := openAndPlanTable(disk, nil, []PartitionChange{grow}, false, opts, func(d *diskpkg.Disk, table *gpt.Table) {
+			moveBackupGPT(d, table)
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, r := range resizes {
+			if !r.inPlace {
+				_ = d.Backend.Close()
+				return nil, nil, nil, fmt.Errorf("partition %d of %s holds no ext4 or XFS filesystem to grow in place", number, disk)
+			}
+		}
+		return d, table, resizes, nil
+	}, opts, nil, true)
+}
+
+// followingSpace returns the PARTUUID of partition number of disk, and the
+// size it has grown into the free space immediately following it, up to the
+// next partition or the end of the usable space. A disk grown since it was
+// partitioned, as a cloud volume or VM image often is, has its backup GPT
+// where the disk used to end, so that is first moved to its end, as growpart
+// does, though only in memory with opts.DryRun. It returns an error wrapping
+// ErrNoChange should less than a MB follow it.
+func followingSpace(disk string, number int, opts Options) (string, int64, error) {
+	backend, err := file.OpenFromPath(disk, opts.DryRun)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return "", 0, err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return "", 0, err
+	}
+	if end := int64(table.TotalSize()); moveBackupGPT(d, table) {
+		logger := opts.logger()
+		logger.Info("disk has grown, moving its backup GPT to its end", "disk", disk, "from", end, "to", d.Size, "dryRun", opts.DryRun)
+		if !opts.DryRun {
+			traceTableWrite(logger, d, table, auditMoveBackupGPT)
+			if err := opts.audit().write(d, auditMoveBackupGPT, func() error { return d.Partition(table) }); err != nil {
+				return "", 0, fmt.Errorf("failed to move backup GPT to the end of %s: %v", disk, err)
+			}
+		}
+	}
+	var part *gpt.Partition
+	for _, p := range table.Partitions {
+		if p.Type != gpt.Unused && p.Index == number {
+			part = p
+		}
+	}
+	if part == nil {
+		return "", 0, fmt.Errorf("partition %d not found on %s", number, disk)
+	}
+	start, size := part.GetStart(), int64(part.GetSize())
+	end := usableDiskSize(d, table)
+	for _, p := range table.Partitions {
+		if p.Type != gpt.Unused && p.GetStart() > start && p.GetStart() < end {
+			end = p.GetStart()
+		}
+	}
+	if free := end - start - size; free < MB {
+		return "", 0, fmt.Errorf("%w: partition %d of %s is %d bytes, and only %d bytes follow it", ErrNoChange, number, disk, size, max(free, 0))
+	}
+	return part.UUID(), end - start, nil
+}
+
+// moveBackupGPT moves the backup GPT of table, the partition table of d, to the
+// end of d, in memory, should d have grown since, and reports whether it did.
+func moveBackupGPT(d *diskpkg.Disk, table *gpt.Table) bool {
+	if int64(table.TotalSize()) >= d.Size {
+		return false
+	}
+	table.Resize(uint64(d.Size))
+	return true
+}
@@ -0,0 +1,118 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestGrowPart plans, as a dry run, the grow of an ext4 partition into the
+// free space up to the next partition, in place, and refuses one with no
+// filesystem to grow, one with nothing after it and one not on the disk.
+func TestGrowPart(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "root"},
+		{Index: 2, Start: 32 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 3, Start: 40 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "scratch"},
+	})
+	// just enough of an ext4 superblock to be recognized
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(sb, 1*MB+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	res, err := GrowPart(diskPath, 1, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("GrowPart() error: %v", err)
+	}
+	want := PartitionResult{
+		Label:    "root",
+		Original: PartitionGeometry{Number: 1, Start: 1 * MB, End: 9*MB - 1, Size: 8 * MB},
+		Final:    PartitionGeometry{Number: 1, Start: 1 * MB, End: 32*MB - 1, Size: 31 * MB},
+	}
+	if len(res.Partitions) != 1 || !reflect.DeepEqual(res.Partitions[0], want) {
+		t.Errorf("GrowPart() partitions = %+v, want %+v", res.Partitions, want)
+	}
+
+	if _, err := GrowPart(diskPath, 2, Options{DryRun: true}); !errors.Is(err, ErrNoChange) {
+		t.Errorf("GrowPart() of a partition another follows error = %v, want ErrNoChange", err)
+	}
+	if _, err := GrowPart(diskPath, 3, Options{DryRun: true}); err == nil || errors.Is(err, ErrNoChange) {
+		t.Errorf("GrowPart() of a partition with no filesystem error = %v, want it refused", err)
+	}
+	if _, err := GrowPart(diskPath, 4, Options{DryRun: true}); err == nil {
+		t.Error("GrowPart() of a missing partition returned no error")
+	}
+}
+
+// TestGrowPartGrownDisk grows a partition into the space a disk gained after it
+// was partitioned, beyond its backup GPT: a dry run plans it without moving
+// the backup GPT, and otherwise it is moved to the new end of the disk.
+func TestGrowPartGrownDisk(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "root"},
+	})
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(sb, 1*MB+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if err := os.Truncate(diskPath, 128*MB); err != nil {
+		t.Fatal(err)
+	}
+	tableSize := func() int64 {
+		t.Helper()
+		backend, err := file.OpenFromPath(diskPath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = backend.Close() }()
+		d, err := diskfs.OpenBackend(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := readGPT(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int64(table.TotalSize())
+	}
+
+	res, err := GrowPart(diskPath, 1, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("GrowPart() error: %v", err)
+	}
+	if len(res.Partitions) != 1 || res.Partitions[0].Final.End < 120*MB {
+		t.Errorf("GrowPart() partitions = %+v, want partition 1 grown to near the new end of the disk", res.Partitions)
+	}
+	if size := tableSize(); size != 64*MB {
+		t.Errorf("GPT spans %d bytes after a dry run, want the backup GPT left at %d", size, 64*MB)
+	}
+
+	if _, _, err := followingSpace(diskPath, 1, Options{}); err != nil {
+		t.Fatalf("followingSpace() error: %v", err)
+	}
+	if size := tableSize(); size != 128*MB {
+		t.Errorf("GPT spans %d bytes, want the backup GPT moved to the end of the disk at %d", size, 128*MB)
+	}
+}
@@ -0,0 +1,110 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// PartitionDigest is the SHA-256 digest, in hex, of all of a partition, as
+// HashPartitions takes it, with what identifies the partition: Label, its
+// name in the GPT, and PartUUID, which a partition keeps when a resize moves
+// it. Start and Size are in bytes.
+type PartitionDigest struct {
+	Number   int    `json:"number"`
+	Label    string `json:"label,omitempty"`
+	PartUUID string `json:"partUUID,omitempty"`
+	Start    int64  `json:"start"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// DiskDigests is the digests HashPartitions took of the partitions of Disk,
+// in order of their numbers.
+type DiskDigests struct {
+	Disk       string            `json:"disk"`
+	Partitions []PartitionDigest `json:"partitions"`
+}
+
+// HashPartitions returns the SHA-256 digest of each partition of the disk
+// device or image file disk, or of just the partitions numbers, should any be
+// given, without changing anything, e.g. to take digests before a resize and
+// compare them with those taken after, see DiskDigests.Compare. It stops with
+// ctx.Err() should ctx be done before the next partition is hashed. A
+// partition whose filesystem is mounted read-write may change as it is read.
+func HashPartitions(ctx context.Context, disk string, numbers ...int) (*DiskDigests, error) {
+	backend, err := file.OpenFromPath(disk, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", disk, err)
+	}
+	parts := gptPartitionData(d, table)
+	slices.SortFunc(parts, func(a, b partitionData) int { return a.number - b.number })
+	for _, number := range numbers {
+		if !slices.ContainsFunc(parts, func(p partitionData) bool { return p.number == number }) {
+			return nil, fmt.Errorf("%s has no partition %d", disk, number)
+		}
+	}
+	digests := &DiskDigests{Disk: disk, Partitions: []PartitionDigest{}}
+	for _, p := range parts {
+		if len(numbers) > 0 && !slices.Contains(numbers, p.number) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sum, err := hashRange(d.Backend, p.start, p.size)
+		if err != nil {
+			return nil, fmt.Errorf("read partition %d: %w", p.number, err)
+		}
+		digests.Partitions = append(digests.Partitions, PartitionDigest{
+			Number:   p.number,
+			Label:    p.label,
+			PartUUID: p.uuid,
+			Start:    p.start,
+			Size:     p.size,
+			SHA256:   fmt.Sprintf("%x", sum),
+		})
+	}
+	return digests, nil
+}
+
+// Compare returns how the partitions of after differ from those of before,
+// d, one line each, none should they not: a partition of d that after does
+// not have, or whose digest differs, matched by PartUUID, as a resize that
+// moves a partition keeps it, or by number should it have none. A partition
+// resized between the two, so that its digest cannot but differ, is reported
+// as resized rather than compared.
+func (d *DiskDigests) Compare(after *DiskDigests) []string {
+	var differences []string
+	for _, b := range d.Partitions {
+		i := slices.IndexFunc(after.Partitions, func(a PartitionDigest) bool {
+			if b.PartUUID != "" {
+				return a.PartUUID == b.PartUUID
+			}
+			return a.Number == b.Number
+		})
+		if i < 0 {
+			differences = append(differences, fmt.Sprintf("partition %d (%s) is gone", b.Number, b.Label))
+			continue
+		}
+		switch a := after.Partitions[i]; {
+		case a.Size != b.Size:
+			differences = append(differences, fmt.Sprintf("partition %d (%s) was resized from %d to %d bytes, so is not compared", b.Number, b.Label, b.Size, a.Size))
+		case a.SHA256 != b.SHA256:
+			differences = append(differences, fmt.Sprintf("partition %d (%s) has changed: SHA-256 %s, was %s", b.Number, b.Label, a.SHA256, b.SHA256))
+		}
+	}
+	return differences
+}
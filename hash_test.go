@@ -0,0 +1,74 @@
+package partitionresizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestHashPartitions(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 2, Start: 9 * MB / 512, Size: 4 * MB, Type: gpt.LinuxSwap, Name: "swap"},
+	})
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 1*MB+4096); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	data := make([]byte, 8*MB)
+	copy(data[4096:], "data")
+	wantData := fmt.Sprintf("%x", sha256.Sum256(data))
+	wantSwap := fmt.Sprintf("%x", sha256.Sum256(make([]byte, 4*MB)))
+
+	before, err := HashPartitions(context.Background(), diskPath)
+	if err != nil {
+		t.Fatalf("HashPartitions() error: %v", err)
+	}
+	if len(before.Partitions) != 2 || before.Partitions[0].SHA256 != wantData || before.Partitions[1].SHA256 != wantSwap {
+		t.Fatalf("HashPartitions() = %+v, want digests %s and %s", before.Partitions, wantData, wantSwap)
+	}
+	if p := before.Partitions[0]; p.Number != 1 || p.Label != "data" || p.PartUUID == "" || p.Start != 1*MB || p.Size != 8*MB {
+		t.Errorf("HashPartitions() partition 1 = %+v, want data at 1M of 8M with a PARTUUID", p)
+	}
+	only, err := HashPartitions(context.Background(), diskPath, 2)
+	if err != nil {
+		t.Fatalf("HashPartitions(2) error: %v", err)
+	}
+	if len(only.Partitions) != 1 || only.Partitions[0].Number != 2 {
+		t.Errorf("HashPartitions(2) = %+v, want just partition 2", only.Partitions)
+	}
+	if _, err := HashPartitions(context.Background(), diskPath, 3); err == nil {
+		t.Error("HashPartitions(3) succeeded, want an error for a partition the disk does not have")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := HashPartitions(ctx, diskPath); err != context.Canceled {
+		t.Errorf("HashPartitions() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	if differences := before.Compare(before); len(differences) != 0 {
+		t.Errorf("Compare() with itself = %q, want no differences", differences)
+	}
+	after := &DiskDigests{Disk: diskPath, Partitions: []PartitionDigest{before.Partitions[0]}}
+	after.Partitions[0].Number = 3
+	after.Partitions[0].SHA256 = wantSwap
+	differences := before.Compare(after)
+	if len(differences) != 2 || !strings.Contains(differences[0], "has changed") || !strings.Contains(differences[1], "is gone") {
+		t.Errorf("Compare() = %q, want partition 1, matched by PARTUUID though renumbered, changed and partition 2 gone", differences)
+	}
+	after.Partitions[0].Size = 16 * MB
+	if differences := before.Compare(after); len(differences) != 2 || !strings.Contains(differences[0], "resized") {
+		t.Errorf("Compare() = %q, want partition 1 resized rather than compared", differences)
+	}
+}
@@ -0,0 +1,72 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// HookPoint is a point in a resize at which the Hooks of Options are run.
+type HookPoint string
+
+const (
+	// HookPreShrink is before anything on the disk is changed, at the start
+	// of PhaseShrinkFilesystems.
+	HookPreShrink HookPoint = "pre-shrink"
+	// HookPostCopy is once every relocated partition is copied to its new
+	// location and the copy verified, at the end of PhaseCopy, before the
+	// Validators are run.
+	HookPostCopy HookPoint = "post-copy"
+	// HookPreCutover is once every copy is verified and validated, at the end
+	// of PhaseValidate, just before the partition table is committed.
+	HookPreCutover HookPoint = "pre-cutover"
+	// HookPostComplete is once the resize is complete, and the journal, if
+	// there is one, finished.
+	HookPostComplete HookPoint = "post-complete"
+)
+
+// HookPoints are all of the HookPoints, in the order a resize reaches them.
+var HookPoints = []HookPoint{HookPreShrink, HookPostCopy, HookPreCutover, HookPostComplete}
+
+// Hook is a callback run at a HookPoint of a resize, for a caller to
+// interleave checks of its own. An error it returns fails the resize: before
+// the cutover, the partitions created for the copies are removed again, as
+// when a Validator fails. Once the resize is complete, the error is returned
+// all the same, though nothing is undone.
+type Hook func(ctx context.Context, h HookInfo) error
+
+// HookInfo is what a Hook is told of the resize it is run in.
+type HookInfo struct {
+	Point HookPoint
+	Disk  string
+	// Partitions are the partitions resized, as planned.
+	Partitions []PartitionResult
+}
+
+// checkHooks returns an error if hooks has any point that is not one of
+// HookPoints.
+func checkHooks(hooks map[HookPoint][]Hook) error {
+	for point := range hooks {
+		if !slices.Contains(HookPoints, point) {
+			return fmt.Errorf("unknown hook point %q, must be one of %v", point, HookPoints)
+		}
+	}
+	return nil
+}
+
+// runHooks runs each of the hooks at point, in order, and returns the first
+// error any of them returns.
+func runHooks(ctx context.Context, logger *slog.Logger, hooks map[HookPoint][]Hook, point HookPoint, disk string, resizes []partitionResizeTarget, preserveNumbers bool) error {
+	if len(hooks[point]) == 0 {
+		return nil
+	}
+	info := HookInfo{Point: point, Disk: disk, Partitions: newResult(disk, resizes, preserveNumbers).Partitions}
+	logger.Info("running hooks", "hook", point, "hooks", len(hooks[point]))
+	for i, hook := range hooks[point] {
+		if err := hook(ctx, info); err != nil {
+			return fmt.Errorf("%s hook %d failed: %w", point, i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package partitionresizer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestResizeHooks runs a resize with a hook at each point, and again with a
+// pre-cutover hook that fails, which must remove the copy it was given.
+func TestResizeHooks(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	rejection := errors.New("image not signed")
+	for _, fail := range []bool{false, true} {
+		name := "passed"
+		if fail {
+			name = "failed"
+		}
+		t.Run(name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+				{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+			})
+			backend, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = backend.Close() }()
+			d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var run []HookPoint
+			hook := func(_ context.Context, h HookInfo) error {
+				run = append(run, h.Point)
+				if h.Disk != diskPath || len(h.Partitions) != 1 || h.Partitions[0].Final.Start != target.start {
+					t.Errorf("%s hook told of %s, %+v, want %s and the partition planned", h.Point, h.Disk, h.Partitions, diskPath)
+				}
+				if fail && h.Point == HookPreCutover {
+					return rejection
+				}
+				return nil
+			}
+			hooks := map[HookPoint][]Hook{}
+			for _, point := range HookPoints {
+				hooks[point] = []Hook{hook}
+			}
+			err = resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, Options{Hooks: hooks}, nil, nil)
+			if fail != errors.Is(err, rejection) || (!fail && err != nil) {
+				t.Fatalf("resize() error = %v, want failed %v", err, fail)
+			}
+			want := HookPoints
+			if fail {
+				want = HookPoints[:3]
+			}
+			if !reflect.DeepEqual(run, want) {
+				t.Errorf("hooks run at %v, want %v", run, want)
+			}
+
+			table, err := readGPT(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var starts []int64
+			for _, p := range table.Partitions {
+				if p.Type != gpt.Unused {
+					starts = append(starts, p.GetStart())
+				}
+			}
+			wantStart := target.start
+			if fail {
+				wantStart = original.start
+			}
+			if len(starts) != 1 || starts[0] != wantStart {
+				t.Errorf("partitions start at %v, want only %d", starts, wantStart)
+			}
+		})
+	}
+
+	if err := checkHooks(map[HookPoint][]Hook{"post-shrink": nil}); err == nil {
+		t.Error("checkHooks() with an unknown point succeeded, want an error")
+	}
+}
@@ -0,0 +1,128 @@
+package partitionresizer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// procMountsPath is the kernel's list of mounted filesystems.
+var procMountsPath = "/proc/mounts"
+
+// mountedDevices returns the mount points of each mounted device, keyed by the
+// resolved device path, as listed in procMountsPath.
+func mountedDevices() (map[string][]string, error) {
+	f, err := os.Open(procMountsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	mounts := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		dev := resolvePath(fields[0])
+		mounts[dev] = append(mounts[dev], fields[1])
+	}
+	return mounts, scanner.Err()
+}
+
+// partitionInUse returns the reasons, if any, that the partition device
+// partDevice is in use: it is mounted, is held by another device such as a
+// device-mapper or md device, or cannot be opened exclusively. Active swap is
+// not counted, as the resize turns it off and back on itself, and neither is
+// being mounted, with allowMounted.
+func partitionInUse(partDevice, syspath string, mounts map[string][]string, swaps map[string]bool, allowMounted bool) []string {
+	var reasons []string
+	resolved := resolvePath(partDevice)
+	mounted := len(mounts[resolved]) > 0
+	if !allowMounted {
+		for _, mp := range mounts[resolved] {
+			reasons = append(reasons, fmt.Sprintf("%s is mounted at %s", partDevice, mp))
+		}
+	}
+	holdersDir := filepath.Join(syspath, "class", "block", filepath.Base(resolved), "holders")
+	if entries, err := os.ReadDir(holdersDir); err == nil {
+		for _, e := range entries {
+			reasons = append(reasons, fmt.Sprintf("%s is held by %s", partDevice, e.Name()))
+		}
+	}
+	if len(reasons) > 0 || swaps[resolved] || mounted {
+		return reasons
+	}
+	// the kernel refuses an exclusive open of a block device that is in use in
+	// any way, including ways the checks above do not see
+	f, err := os.OpenFile(partDevice, os.O_RDONLY|os.O_EXCL, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EBUSY) {
+			reasons = append(reasons, fmt.Sprintf("%s is busy and cannot be opened exclusively", partDevice))
+		}
+		return reasons
+	}
+	_ = f.Close()
+	return reasons
+}
+
+// checkInUse verifies that none of the partitions to be resized is in use by
+// the running system, returning an *InUseError listing why if any is. Only a
+// block device can be in use; a disk image file is never checked. A partition
+// grown in place may be in use, as its filesystem is grown online, and one to
+// be copied frozen may be mounted, see Options.FreezeMounted.
+func checkInUse(d *disk.Disk, resizes []partitionResizeTarget, syspath string) error {
+	if syspath == "" {
+		syspath = sysDefaultPath
+	}
+	device := d.Backend.Path()
+	if device == "" {
+		return nil
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	deviceType, err := disk.DetermineDeviceType(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if deviceType != disk.DeviceTypeBlockDevice {
+		return nil
+	}
+	mounts, err := mountedDevices()
+	if err != nil {
+		return fmt.Errorf("list mounts: %w", err)
+	}
+	swaps, err := activeSwaps()
+	if err != nil {
+		return fmt.Errorf("list active swap: %w", err)
+	}
+	var reasons []string
+	checked := map[int]bool{}
+	for _, r := range resizes {
+		if checked[r.original.number] || r.inPlace {
+			continue
+		}
+		checked[r.original.number] = true
+		partDevice, err := partitionDevicePath(device, r.original.number, syspath)
+		if err != nil {
+			return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, r.original.number, err)
+		}
+		reasons = append(reasons, partitionInUse(partDevice, syspath, mounts, swaps, r.freezeTimeout > 0)...)
+	}
+	if len(reasons) > 0 {
+		return NewInUseError(device, reasons)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package partitionresizer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+func TestMountedDevices(t *testing.T) {
+	orig := procMountsPath
+	defer func() { procMountsPath = orig }()
+	procMountsPath = filepath.Join(t.TempDir(), "mounts")
+	data := "proc /proc proc rw 0 0\n/dev/sda2 / ext4 rw 0 0\n/dev/sda2 /mnt ext4 rw 0 0\n/dev/sda1 /boot/efi vfat rw 0 0\n"
+	if err := os.WriteFile(procMountsPath, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := mountedDevices()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mounts) != 2 || len(mounts["/dev/sda2"]) != 2 || mounts["/dev/sda1"][0] != "/boot/efi" {
+		t.Errorf("mounts = %v, want sda2 at / and /mnt, sda1 at /boot/efi", mounts)
+	}
+}
+
+func TestPartitionInUse(t *testing.T) {
+	syspath := t.TempDir()
+	holders := filepath.Join(syspath, "class", "block", "sdz3", "holders")
+	if err := os.MkdirAll(filepath.Join(holders, "dm-0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mounts := map[string][]string{"/dev/sdz2": {"/data"}}
+
+	tests := []struct {
+		name         string
+		device       string
+		swaps        map[string]bool
+		allowMounted bool
+		want         string
+	}{
+		{"mounted", "/dev/sdz2", nil, false, "/dev/sdz2 is mounted at /data"},
+		{"mounted allowed", "/dev/sdz2", nil, true, ""},
+		{"held", "/dev/sdz3", nil, false, "/dev/sdz3 is held by dm-0"},
+		{"held with mounted allowed", "/dev/sdz3", nil, true, "/dev/sdz3 is held by dm-0"},
+		{"swap", "/dev/sdz4", map[string]bool{"/dev/sdz4": true}, false, ""},
+		{"unused", "/dev/sdz5", nil, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(partitionInUse(tt.device, syspath, mounts, tt.swaps, tt.allowMounted), "; ")
+			if got != tt.want {
+				t.Errorf("partitionInUse(%s) = %q, want %q", tt.device, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckInUse(t *testing.T) {
+	// a disk image file is never in use
+	f, err := os.Open(imgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	d, err := diskfs.OpenBackend(file.New(f, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{{original: partitionData{number: 1}}}
+	if err := checkInUse(d, resizes, t.TempDir()); err != nil {
+		t.Errorf("unexpected error for image file: %v", err)
+	}
+
+	err = NewInUseError("/dev/sda", []string{"/dev/sda2 is mounted at /", "/dev/sda3 is held by dm-0"})
+	var inUse *InUseError
+	if !errors.As(err, &inUse) || len(inUse.Reasons) != 2 {
+		t.Fatalf("NewInUseError() = %v, want *InUseError with 2 reasons", err)
+	}
+	if want := "partitions on /dev/sda are in use: /dev/sda2 is mounted at /; /dev/sda3 is held by dm-0"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
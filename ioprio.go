@@ -0,0 +1,27 @@
+package partitionresizer
+
+import "fmt"
+
+// IOPriority is the I/O scheduling priority a resize runs at, see
+// Options.IOPriority.
+type IOPriority string
+
+const (
+	// IOPriorityLow is the lowest priority of the best-effort class, the
+	// class all I/O is in unless given another: the resize still gets its
+	// share of the disk, after everything else.
+	IOPriorityLow IOPriority = "low"
+	// IOPriorityIdle is the idle class: the resize only gets the disk while
+	// nothing else is using it, so may take as long as the disk is busy.
+	IOPriorityIdle IOPriority = "idle"
+)
+
+// check returns an error unless p is a known IOPriority, or empty for the
+// priority the process already has.
+func (p IOPriority) check() error {
+	switch p {
+	case "", IOPriorityLow, IOPriorityIdle:
+		return nil
+	}
+	return fmt.Errorf("unknown I/O priority %q, must be %s or %s", p, IOPriorityLow, IOPriorityIdle)
+}
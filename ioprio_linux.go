@@ -0,0 +1,44 @@
+package partitionresizer
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) classes and who values, which golang.org/x/sys/unix does not
+// define.
+const (
+	ioprioClassBE     = 2
+	ioprioClassIdle   = 3
+	ioprioClassShift  = 13
+	ioprioWhoProcess  = 1
+	ioprioLowestLevel = 7
+)
+
+// setIOPriority sets the I/O priority of every thread of the process to p, so
+// that the goroutines of the resize, which run on any of them, and the tools
+// it starts, which inherit it, run at p. Threads started later inherit it
+// from the thread that starts them.
+func setIOPriority(p IOPriority) error {
+	prio := ioprioClassBE<<ioprioClassShift | ioprioLowestLevel
+	if p == IOPriorityIdle {
+		prio = ioprioClassIdle << ioprioClassShift
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 && errno != unix.ESRCH {
+			// ESRCH is a thread that has exited since
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package partitionresizer
+
+import "errors"
+
+// setIOPriority fails: setting the I/O priority is only supported on Linux.
+func setIOPriority(p IOPriority) error {
+	return errors.New("setting the I/O priority is only supported on Linux")
+}
@@ -0,0 +1,390 @@
+package partitionresizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const (
+	// DefaultJournalPath is where the CLI keeps its journal by default.
+	DefaultJournalPath = "/var/lib/partitionresizer/journal.json"
+	// completedJournalSuffix is appended to the path of the journal of a
+	// completed resize, which is kept for Rollback
+	completedJournalSuffix = ".completed"
+)
+
+// The phases of a resize, as recorded in a journal and reported to a
+// ProgressReporter, in the order they complete.
+const (
+	PhaseShrinkFilesystems = "shrink-filesystems"
+	PhasePreparePartitions = "prepare-partitions"
+	PhaseCopy              = "copy"
+	PhaseValidate          = "validate"
+	PhaseCommitPartitions  = "commit-partitions"
+	PhaseGrowFilesystems   = "grow-filesystems"
+	PhaseCheckFilesystems  = "check-filesystems"
+)
+
+// journal records a resize as it runs: the exact resizes planned, and each
+// phase of resize as it completes, so that after a crash Resume can finish the
+// same resizes, skipping the completed phases, rather than planning afresh
+// against a half-resized disk. A nil *journal records nothing.
+type journal struct {
+	path string
+	Disk string `json:"disk"`
+	// DiskGUID is the GUID of the disk's GPT, which identifies it even
+	// should its device path change between boots
+	DiskGUID        string  `json:"diskGUID,omitempty"`
+	FixErrors       bool    `json:"fixErrors"`
+	PreserveNumbers bool    `json:"preserveNumbers"`
+	Options         Options `json:"options"`
+	// Table is the partition table as it was before the resize
+	Table     []gpt.Partition `json:"table"`
+	Resizes   []journalResize `json:"resizes"`
+	Swaps     []string        `json:"swaps,omitempty"`
+	Completed []string        `json:"completed"`
+	// Started is each phase that has started, whether or not it completed
+	Started []string `json:"started,omitempty"`
+	// Copies is how far the raw copy of each partition, by number, has got
+	Copies map[int]*journalCopy `json:"copies,omitempty"`
+	// Finished is set once the resize has completed
+	Finished bool `json:"finished,omitempty"`
+}
+
+// journalResize is a partitionResizeTarget as recorded in a journal.
+type journalResize struct {
+	Original          journalPartition `json:"original"`
+	Target            journalPartition `json:"target"`
+	InPlace           bool             `json:"inPlace,omitempty"`
+	FreezeTimeout     time.Duration    `json:"freezeTimeout,omitempty"`
+	TemporaryUUID     bool             `json:"temporaryUUID,omitempty"`
+	Verify            VerifyMode       `json:"verify,omitempty"`
+	Streams           int              `json:"streams,omitempty"`
+	NoCacheHints      bool             `json:"noCacheHints,omitempty"`
+	NoAtime           bool             `json:"noAtime,omitempty"`
+	Discard           bool             `json:"discard,omitempty"`
+	Wipe              WipeMode         `json:"wipe,omitempty"`
+	UpdateBootEntries bool             `json:"updateBootEntries,omitempty"`
+	SetAttributes     uint64           `json:"setAttributes,omitempty"`
+	ClearAttributes   uint64           `json:"clearAttributes,omitempty"`
+	PartitionType     gpt.Type         `json:"partitionType,omitempty"`
+}
+
+// journalPartition is a partitionData as recorded in a journal.
+type journalPartition struct {
+	Number int    `json:"number"`
+	Name   string `json:"name,omitempty"`
+	Label  string `json:"label"`
+	UUID   string `json:"uuid,omitempty"`
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size"`
+}
+
+func toJournalPartition(p partitionData) journalPartition {
+	return journalPartition{Number: p.number, Name: p.name, Label: p.label, UUID: p.uuid, Start: p.start, Size: p.size}
+}
+
+func (p journalPartition) partitionData() partitionData {
+	return partitionData{number: p.Number, name: p.Name, label: p.Label, uuid: p.UUID, start: p.Start, size: p.Size, end: p.Start + p.Size - 1}
+}
+
+// newJournal starts a journal at path for the given resizes of disk, whose
+// partition table is table. It fails if a journal is already there, as that
+// records a resize that has not finished.
+func newJournal(path, disk string, table *gpt.Table, resizes []partitionResizeTarget, fixErrors, preserveNumbers bool, opts Options) (*journal, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("journal %s records an unfinished resize; resume it first", path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	j := &journal{
+		path:            path,
+		Disk:            disk,
+		DiskGUID:        table.GUID,
+		FixErrors:       fixErrors,
+		PreserveNumbers: preserveNumbers,
+		Options:         opts,
+		Completed:       []string{},
+	}
+	for _, p := range table.Partitions {
+		j.Table = append(j.Table, *p)
+	}
+	for _, r := range resizes {
+		j.Resizes = append(j.Resizes, journalResize{
+			Original:          toJournalPartition(r.original),
+			Target:            toJournalPartition(r.target),
+			InPlace:           r.inPlace,
+			FreezeTimeout:     r.freezeTimeout,
+			TemporaryUUID:     r.temporaryUUID,
+			Verify:            r.verify,
+			Streams:           r.streams,
+			NoCacheHints:      r.noCacheHints,
+			NoAtime:           r.noAtime,
+			Discard:           r.discard,
+			Wipe:              r.wipe,
+			UpdateBootEntries: r.updateBootEntries,
+			SetAttributes:     r.setAttributes,
+			ClearAttributes:   r.clearAttributes,
+			PartitionType:     r.partitionType,
+		})
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return j, j.save()
+}
+
+// readJournal loads the journal at path.
+func readJournal(path string) (*journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("parse journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// resizes returns the resizes recorded in the journal.
+func (j *journal) resizes() []partitionResizeTarget {
+	var resizes []partitionResizeTarget
+	for _, r := range j.Resizes {
+		resizes = append(resizes, partitionResizeTarget{
+			original:          r.Original.partitionData(),
+			target:            r.Target.partitionData(),
+			inPlace:           r.InPlace,
+			freezeTimeout:     r.FreezeTimeout,
+			temporaryUUID:     r.TemporaryUUID,
+			verify:            r.Verify,
+			streams:           r.Streams,
+			noCacheHints:      r.NoCacheHints,
+			noAtime:           r.NoAtime,
+			discard:           r.Discard,
+			wipe:              r.Wipe,
+			updateBootEntries: r.UpdateBootEntries,
+			setAttributes:     r.SetAttributes,
+			clearAttributes:   r.ClearAttributes,
+			partitionType:     r.PartitionType,
+		})
+	}
+	return resizes
+}
+
+// save writes the journal out, replacing the previous copy atomically so that
+// a crash leaves either the old or the new one.
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// done reports whether phase has completed.
+func (j *journal) done(phase string) bool {
+	return j != nil && slices.Contains(j.Completed, phase)
+}
+
+// started reports whether phase has started, as a phase that completed has.
+func (j *journal) started(phase string) bool {
+	return j != nil && (slices.Contains(j.Started, phase) || j.done(phase))
+}
+
+// start records that phase has started.
+func (j *journal) start(phase string) error {
+	if j == nil || slices.Contains(j.Started, phase) {
+		return nil
+	}
+	j.Started = append(j.Started, phase)
+	return j.save()
+}
+
+// complete records that phase has completed.
+func (j *journal) complete(phase string) error {
+	if j == nil || j.done(phase) {
+		return nil
+	}
+	j.Completed = append(j.Completed, phase)
+	return j.save()
+}
+
+// reopen records that phase, and every phase completed after it, has not
+// completed, as their changes have been undone, so that a resumed resize
+// runs them again.
+func (j *journal) reopen(phase string) error {
+	if j == nil {
+		return nil
+	}
+	i := slices.Index(j.Completed, phase)
+	if i < 0 {
+		return nil
+	}
+	j.Completed = j.Completed[:i]
+	j.Started = slices.DeleteFunc(j.Started, func(p string) bool { return !slices.Contains(j.Completed, p) })
+	// what was copied is gone with the partitions it was copied to
+	j.Copies = nil
+	return j.save()
+}
+
+// checkTable returns an error unless table, the partition table of the disk
+// the journal is for, is that of the disk it records, by its GUID, and has
+// each partition the journal records as it was before the resize as it was
+// then: every partition the resize does not change where it was, with the
+// same GUID, and, until the commit starts, each original of a resize still in
+// its place too, as a resume or rollback would otherwise act on partitions
+// that are not those planned for.
+func (j *journal) checkTable(table *gpt.Table) error {
+	if j.DiskGUID != "" && !strings.EqualFold(table.GUID, j.DiskGUID) {
+		return fmt.Errorf("disk %s has GUID %s, not %s as journaled; it is not the disk that was being resized", j.Disk, table.GUID, j.DiskGUID)
+	}
+	resized := map[int]bool{}
+	for _, r := range j.Resizes {
+		resized[r.Original.Number] = true
+	}
+	committing := j.started(PhaseCommitPartitions)
+	for _, want := range j.Table {
+		if resized[want.Index] && committing {
+			continue
+		}
+		var got *gpt.Partition
+		for _, p := range table.Partitions {
+			if p.Index == want.Index && p.Type != gpt.Unused {
+				got = p
+			}
+		}
+		switch {
+		case got == nil:
+			return fmt.Errorf("partition %d (%s) journaled as on disk %s is no longer there", want.Index, want.Name, j.Disk)
+		case got.Start != want.Start || want.GUID != "" && !strings.EqualFold(got.GUID, want.GUID):
+			return fmt.Errorf("partition %d (%s) on disk %s is not as journaled", want.Index, want.Name, j.Disk)
+		case !resized[want.Index] && got.GetSize() != want.GetSize():
+			return fmt.Errorf("partition %d (%s) on disk %s is not as journaled", want.Index, want.Name, j.Disk)
+		}
+	}
+	return nil
+}
+
+// recordSwaps records the swap areas turned off for the resize, which are to
+// be turned back on at its end, and returns all of them, including any
+// recorded by an earlier, interrupted run.
+func (j *journal) recordSwaps(uuids []string) ([]string, error) {
+	if j == nil {
+		return uuids, nil
+	}
+	for _, u := range uuids {
+		if !slices.Contains(j.Swaps, u) {
+			j.Swaps = append(j.Swaps, u)
+		}
+	}
+	return j.Swaps, j.save()
+}
+
+// finish marks the journal of a resize that has completed as finished, and
+// moves it aside, replacing any from an earlier resize, so that a new resize
+// may start while this one can still be rolled back.
+func (j *journal) finish() error {
+	if j == nil {
+		return nil
+	}
+	path := j.path
+	j.Finished = true
+	j.path = path + completedJournalSuffix
+	if err := j.save(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// runPhase runs fn as phase of a resize, unless the journal records it as
+// already completed, and records it as completed once it has.
+func (j *journal) runPhase(phase string, fn func() error) error {
+	if j.done(phase) {
+		return nil
+	}
+	if err := j.start(phase); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return j.complete(phase)
+}
+
+// Resume finishes a resize interrupted by a crash, as recorded in the journal
+// at journalPath by Run with Options.JournalPath. It performs exactly the
+// resizes recorded, skipping the phases recorded as completed, and moves the
+// journal aside once the resize is done, as Run does. It refuses a disk that
+// is not the one journaled, by the GUID of its GPT, or whose partitions are
+// not as journaled.
+func Resume(journalPath string) error {
+	return ResumeContext(context.Background(), journalPath)
+}
+
+// ResumeContext is Resume, stopping cleanly should ctx be done before the
+// resize is, as RunContext does.
+func ResumeContext(ctx context.Context, journalPath string) error {
+	return ResumeWithOptions(ctx, journalPath, Options{})
+}
+
+// ResumeWithOptions is ResumeContext, with what of opts a journal cannot save:
+// its Validators, Hooks, Confirm, Progress, Logger, OnEvent and ExecRunner.
+// The rest of opts is ignored; the resize is finished with the options it was
+// journaled with.
+func ResumeWithOptions(ctx context.Context, journalPath string, opts Options) error {
+	j, err := readJournal(journalPath)
+	if err != nil {
+		return err
+	}
+	opts = j.Options.withUnsaved(opts)
+	opts.logger().Info("resuming resize", "disk", j.Disk, "completed", j.Completed)
+	ctx = withToolRunner(ctx, newToolRunner(opts))
+	backend, err := file.OpenFromPath(j.Disk, false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return err
+	}
+	if err := j.checkTable(table); err != nil {
+		return err
+	}
+	resizes := j.resizes()
+	if err := checkInUse(d, resizes, ""); err != nil {
+		return err
+	}
+	return resize(ctx, d, resizes, j.FixErrors, j.PreserveNumbers, opts, j, nil)
+}
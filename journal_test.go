@@ -0,0 +1,251 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "journal.json")
+	resizes := []partitionResizeTarget{
+		{
+			original:      partitionData{number: 1, label: "data", uuid: "U1", start: 1 * MB, size: 8 * MB, end: 9*MB - 1},
+			target:        partitionData{number: 3, label: "data", start: 20 * MB, size: 16 * MB, end: 36*MB - 1},
+			freezeTimeout: time.Minute,
+			temporaryUUID: true,
+		},
+		{
+			original: partitionData{number: 2, label: "shrinker", start: 9 * MB, size: 8 * MB, end: 17*MB - 1},
+			target:   partitionData{number: 2, label: "shrinker", start: 9 * MB, size: 4 * MB, end: 13*MB - 1},
+		},
+	}
+	table := &gpt.Table{Partitions: []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data", GUID: "U1"},
+	}}
+	j, err := newJournal(path, "disk.img", table, resizes, true, false, Options{AutoShrink: true})
+	if err != nil {
+		t.Fatalf("newJournal() error: %v", err)
+	}
+	var ran []string
+	for _, phase := range []string{PhaseShrinkFilesystems, PhaseShrinkFilesystems, PhasePreparePartitions} {
+		if err := j.runPhase(phase, func() error {
+			ran = append(ran, phase)
+			return nil
+		}); err != nil {
+			t.Fatalf("runPhase(%s) error: %v", phase, err)
+		}
+	}
+	if want := []string{PhaseShrinkFilesystems, PhasePreparePartitions}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("phases run = %v, want %v", ran, want)
+	}
+	failure := errors.New("copy failed")
+	if err := j.runPhase(PhaseCopy, func() error { return failure }); !errors.Is(err, failure) {
+		t.Errorf("runPhase() of failing phase = %v, want %v", err, failure)
+	}
+	if _, err := j.recordSwaps([]string{"S1"}); err != nil {
+		t.Fatalf("recordSwaps() error: %v", err)
+	}
+
+	read, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("readJournal() error: %v", err)
+	}
+	if !read.done(PhasePreparePartitions) || read.done(PhaseCopy) {
+		t.Errorf("completed phases = %v, want up to %s", read.Completed, PhasePreparePartitions)
+	}
+	if !reflect.DeepEqual(read.resizes(), resizes) {
+		t.Errorf("resizes = %+v, want %+v", read.resizes(), resizes)
+	}
+	if swaps, _ := read.recordSwaps(nil); !reflect.DeepEqual(swaps, []string{"S1"}) {
+		t.Errorf("swaps = %v, want [S1]", swaps)
+	}
+	if read.Disk != "disk.img" || !read.FixErrors || !read.Options.AutoShrink {
+		t.Errorf("journal = %+v, want disk, fixErrors and options kept", read)
+	}
+
+	if !reflect.DeepEqual(read.Table, []gpt.Partition{*table.Partitions[0]}) {
+		t.Errorf("table = %+v, want %+v", read.Table, *table.Partitions[0])
+	}
+
+	if _, err := newJournal(path, "disk.img", table, resizes, false, false, Options{}); err == nil {
+		t.Error("newJournal() over an unfinished journal returned no error")
+	}
+	if err := read.finish(); err != nil {
+		t.Fatalf("finish() error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after finish: %v", err)
+	}
+	if completed, err := readJournal(path + completedJournalSuffix); err != nil || !completed.Finished {
+		t.Errorf("completed journal = %+v, %v, want it kept and finished", completed, err)
+	}
+
+	// without a journal, every phase runs
+	var none *journal
+	calls := 0
+	for range 2 {
+		if err := none.runPhase(PhaseCopy, func() error { calls++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("nil journal ran phase %d times, want 2", calls)
+	}
+}
+
+// TestResume verifies that Resume skips the phases a journal records as
+// completed, leaving the disk untouched, and removes the journal once done.
+func TestResume(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: 1 * MB / sectorSize, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	_ = backend.Close()
+	before, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a relocation of partition 1 whose every phase has completed
+	resizes := []partitionResizeTarget{{
+		original: partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1},
+		target:   partitionData{number: 2, label: "data", start: 20 * MB, size: 16 * MB, end: 36*MB - 1},
+	}}
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	j, err := newJournal(journalPath, diskPath, table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhaseShrinkFilesystems, PhasePreparePartitions, PhaseCopy, PhaseValidate, PhaseCommitPartitions, PhaseGrowFilesystems, PhaseCheckFilesystems} {
+		if err := j.complete(phase); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var logs bytes.Buffer
+	if err := ResumeWithOptions(context.Background(), journalPath, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))}); err != nil {
+		t.Fatalf("ResumeWithOptions() error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "resuming resize") {
+		t.Errorf("ResumeWithOptions() logged %q, want the resume logged to the options' Logger", logs.String())
+	}
+	after, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Error("Resume() changed the disk although every phase had completed")
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after Resume: %v", err)
+	}
+	if err := Resume(journalPath); err == nil {
+		t.Error("Resume() without a journal returned no error")
+	}
+}
+
+// TestResumeChecksDisk verifies that Resume refuses a disk whose GPT is not
+// that of the disk journaled, or whose partitions are not as journaled.
+func TestResumeChecksDisk(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	partitions := func(otherStart uint64) []*gpt.Partition {
+		return []*gpt.Partition{
+			{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data", GUID: "5B1B3AB6-5C4B-4F2C-9E4C-0C1F6A7D4E01"},
+			{Index: 2, Start: otherStart, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "other", GUID: "5B1B3AB6-5C4B-4F2C-9E4C-0C1F6A7D4E02"},
+		}
+	}
+	writeTestTable(t, diskPath, 64*MB, partitions(9*MB/512))
+	backend, err := file.OpenFromPath(diskPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(backend, diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := readGPT(d)
+	_ = backend.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{{
+		original: partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1},
+		target:   partitionData{number: 3, label: "data", start: 20 * MB, size: 16 * MB, end: 36*MB - 1},
+	}}
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	j, err := newJournal(journalPath, diskPath, table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DiskGUID == "" || j.DiskGUID != table.GUID {
+		t.Fatalf("journal records disk GUID %q, want %q", j.DiskGUID, table.GUID)
+	}
+
+	j.DiskGUID = "5B1B3AB6-5C4B-4F2C-9E4C-0C1F6A7D4E99"
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(journalPath); err == nil || !strings.Contains(err.Error(), "not the disk") {
+		t.Errorf("Resume() of another disk error = %v, want it refused", err)
+	}
+
+	j.DiskGUID = table.GUID
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTable(t, diskPath, 64*MB, partitions(40*MB/512))
+	backend, err = file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved.GUID = table.GUID
+	err = d.Partition(moved)
+	_ = backend.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(journalPath); err == nil || !strings.Contains(err.Error(), "partition 2") {
+		t.Errorf("Resume() with partition 2 moved error = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,200 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Layout is the layout a disk is to end up with, for NewLayoutPlan: what
+// each of its partitions is to be, rather than what to do to them. The
+// partitions a Layout lists must already be on the disk, as a resize copies,
+// grows, shrinks and moves partitions, but does not create, remove, rename or
+// retype them; those it does not list are left as they are.
+type Layout struct {
+	Partitions []LayoutPartition
+}
+
+// LayoutPartition is a partition of a Layout. Size, if not 0, is the size it
+// is to have, in bytes. With Fill, it is instead grown into the free space
+// left once the other partitions are laid out, as by NewMaxPartitionChange,
+// but to no more than Max. Otherwise it keeps its size, grown to Min or shrunk
+// to Max should it be outside them; either may be 0 for no limit. Type, if not
+// empty, is the GPT partition type GUID it must have.
+type LayoutPartition struct {
+	Partition PartitionIdentifier
+	Type      string
+	Size      int64
+	Fill      bool
+	Min       int64
+	Max       int64
+}
+
+// NewLayoutPlan plans the resize that gives disk the layout, a disk device or
+// image file, without changing anything, and returns it as a Plan, as NewPlan
+// does, for review and to apply. A partition is only shrunk to make room for
+// another to grow, so a layout that shrinks partitions but grows none, or
+// whose grows fit without shrinking them, cannot be planned, and neither can
+// one the partitions could not be resized to. Should the disk already have
+// the layout, the Plan has no Partitions, and nothing to apply.
+func NewLayoutPlan(disk string, layout Layout, opts Options) (*Plan, error) {
+	disks, err := findDisks(disk, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find disks: %v", err)
+	}
+	if len(disks) != 1 {
+		return nil, fmt.Errorf("layout needs a single disk, found %d", len(disks))
+	}
+	var parts []partitionData
+	for _, p := range disks {
+		parts = p
+	}
+	info := listDisk(disk, parts)
+	types := make(map[int]string)
+	for _, p := range info.Partitions {
+		types[p.Number] = p.Type
+	}
+	matched, err := matchLayout(parts, types, layout)
+	if err != nil {
+		return nil, NewPlanError(disk, err)
+	}
+	shrinks, grows, err := layoutChanges(matched, layout, nil)
+	if err != nil {
+		return nil, NewPlanError(disk, err)
+	}
+	if len(grows) == 0 {
+		return &Plan{Disk: disk, DiskGUID: info.GUID, Partitions: []PartitionResult{}, Options: opts}, nil
+	}
+	plan, err := NewPlan(disk, shrinks, grows, opts)
+	if err != nil {
+		return nil, err
+	}
+	// a partition filling the free space past its Max is planned again at
+	// its Max
+	capped := make(map[int]bool)
+	for i, lp := range layout.Partitions {
+		if lp.Fill && lp.Max > 0 && finalSize(plan, matched[i]) > lp.Max {
+			capped[i] = true
+		}
+	}
+	if len(capped) > 0 {
+		if shrinks, grows, err = layoutChanges(matched, layout, capped); err != nil {
+			return nil, NewPlanError(disk, err)
+		}
+		if plan, err = NewPlan(disk, shrinks, grows, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLayout(plan, matched, layout); err != nil {
+		return nil, NewPlanError(disk, err)
+	}
+	return plan, nil
+}
+
+// matchLayout returns the partition of parts each partition of layout
+// identifies, in order, checking that it identifies exactly one, of the type
+// it is to have, as types, the type GUID of each partition by number, says.
+func matchLayout(parts []partitionData, types map[int]string, layout Layout) ([]partitionData, error) {
+	var matched []partitionData
+	for _, lp := range layout.Partitions {
+		if lp.Partition == nil {
+			return nil, fmt.Errorf("layout partition has no identifier")
+		}
+		name := fmt.Sprintf("%s=%s", lp.Partition.By(), lp.Partition.Value())
+		var found []partitionData
+		for _, p := range parts {
+			if p.matches(lp.Partition) {
+				found = append(found, p)
+			}
+		}
+		switch {
+		case len(found) == 0:
+			return nil, fmt.Errorf("layout partition %s not found; partitions cannot be created%s", name, identifierHint(parts, lp.Partition))
+		case len(found) > 1:
+			return nil, fmt.Errorf("layout partition %s matches %d partitions", name, len(found))
+		case lp.Type != "" && !strings.EqualFold(types[found[0].number], lp.Type):
+			return nil, fmt.Errorf("layout partition %s is of type %s, not %s; partitions cannot be retyped", name, types[found[0].number], lp.Type)
+		case lp.Min > 0 && lp.Max > 0 && lp.Min > lp.Max:
+			return nil, fmt.Errorf("layout partition %s: min %d is more than max %d", name, lp.Min, lp.Max)
+		case lp.Fill && lp.Size > 0:
+			return nil, fmt.Errorf("layout partition %s: cannot both fill the free space and be %d bytes", name, lp.Size)
+		case lp.Size > 0 && (lp.Size < lp.Min || lp.Max > 0 && lp.Size > lp.Max):
+			return nil, fmt.Errorf("layout partition %s: size %d is outside min %d and max %d", name, lp.Size, lp.Min, lp.Max)
+		}
+		for _, m := range matched {
+			if m.number == found[0].number {
+				return nil, fmt.Errorf("layout partition %s is partition %d, listed already", name, m.number)
+			}
+		}
+		matched = append(matched, found[0])
+	}
+	return matched, nil
+}
+
+// layoutChanges returns the partitions to shrink and grow, as Run takes them,
+// to give matched, the partitions of layout, their sizes, identified by
+// PARTUUID so that the plan pins them. The partitions of layout in capped fill
+// the free space only up to their Max.
+func layoutChanges(matched []partitionData, layout Layout, capped map[int]bool) ([]PartitionIdentifier, []PartitionChange, error) {
+	var (
+		shrinks []PartitionIdentifier
+		grows   []PartitionChange
+	)
+	for i, lp := range layout.Partitions {
+		p := matched[i]
+		if lp.Fill && !capped[i] {
+			grows = append(grows, NewMaxPartitionChange(IdentifierByPartUUID, p.uuid))
+			continue
+		}
+		size := p.size
+		switch {
+		case lp.Size > 0:
+			size = lp.Size
+		case capped[i], lp.Max > 0 && size > lp.Max:
+			size = lp.Max
+		case size < lp.Min:
+			size = lp.Min
+		}
+		switch {
+		case size > p.size:
+			grows = append(grows, NewPartitionChange(IdentifierByPartUUID, p.uuid, size))
+		case size < p.size:
+			shrinks = append(shrinks, NewRelativePartitionChange(IdentifierByPartUUID, p.uuid, size-p.size))
+		}
+	}
+	if len(grows) == 0 && len(shrinks) > 0 {
+		return nil, nil, fmt.Errorf("layout shrinks partitions but grows none; a partition is only shrunk to make room for another")
+	}
+	return shrinks, grows, nil
+}
+
+// checkLayout returns an error should plan not give matched, the partitions
+// of layout, the sizes layout says.
+func checkLayout(plan *Plan, matched []partitionData, layout Layout) error {
+	var reasons []string
+	for i, lp := range layout.Partitions {
+		size := finalSize(plan, matched[i])
+		name := fmt.Sprintf("partition %d (%s)", matched[i].number, matched[i].label)
+		switch {
+		case lp.Size > 0 && size != lp.Size:
+			reasons = append(reasons, fmt.Sprintf("%s would be %d bytes, not %d", name, size, lp.Size))
+		case size < lp.Min:
+			reasons = append(reasons, fmt.Sprintf("%s would be %d bytes, less than min %d", name, size, lp.Min))
+		case lp.Max > 0 && size > lp.Max:
+			reasons = append(reasons, fmt.Sprintf("%s would be %d bytes, more than max %d", name, size, lp.Max))
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("cannot plan layout of %s: %s", plan.Disk, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// finalSize returns the size part has once plan is applied.
+func finalSize(plan *Plan, part partitionData) int64 {
+	for _, r := range plan.Partitions {
+		if r.Original.Number == part.number {
+			return r.Final.Size
+		}
+	}
+	return part.size
+}
@@ -0,0 +1,77 @@
+package partitionresizer
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestNewLayoutPlan plans a layout that fills the free space with a partition
+// up to its max, leaving another within its min, and refuses layouts a resize
+// cannot give a disk.
+func TestNewLayoutPlan(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 2, Start: 9 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "scratch"},
+	})
+	data := NewPartitionIdentifier(IdentifierByLabel, "data")
+	scratch := NewPartitionIdentifier(IdentifierByLabel, "scratch")
+
+	plan, err := NewLayoutPlan(diskPath, Layout{Partitions: []LayoutPartition{
+		{Partition: data, Type: string(gpt.LinuxFilesystem), Fill: true, Max: 20 * MB},
+		{Partition: scratch, Min: 4 * MB},
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("NewLayoutPlan() error: %v", err)
+	}
+	if len(plan.Grow) != 1 || plan.Grow[0].Label != "data" || plan.Grow[0].Size != 20*MB || len(plan.Shrink) != 0 {
+		t.Errorf("NewLayoutPlan() grow = %+v, shrink = %+v, want data grown to its max of %d", plan.Grow, plan.Shrink, 20*MB)
+	}
+
+	plan, err = NewLayoutPlan(diskPath, Layout{Partitions: []LayoutPartition{
+		{Partition: data, Size: 8 * MB},
+		{Partition: scratch, Max: 16 * MB},
+	}}, Options{})
+	if err != nil {
+		t.Fatalf("NewLayoutPlan() of the layout the disk has error: %v", err)
+	}
+	if plan.Partitions == nil || len(plan.Partitions) != 0 || len(plan.Grow) != 0 {
+		t.Errorf("NewLayoutPlan() of the layout the disk has = %+v, want nothing to resize", plan)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		layout []LayoutPartition
+		want   string
+	}{
+		{"not found", []LayoutPartition{{Partition: NewPartitionIdentifier(IdentifierByLabel, "home"), Size: 8 * MB}}, "not found"},
+		{"other type", []LayoutPartition{{Partition: data, Type: string(gpt.LinuxSwap)}}, "cannot be retyped"},
+		{"min over max", []LayoutPartition{{Partition: data, Min: 16 * MB, Max: 8 * MB}}, "more than max"},
+		{"listed twice", []LayoutPartition{{Partition: data}, {Partition: NewPartitionIdentifier(IdentifierByPartUUID, strings.ToLower(partUUID(t, diskPath, 1)))}}, "listed already"},
+		{"shrink only", []LayoutPartition{{Partition: scratch, Size: 4 * MB}}, "grows none"},
+		{"shrink of no filesystem", []LayoutPartition{{Partition: data, Size: 12 * MB}, {Partition: scratch, Size: 4 * MB}}, "shrink partition 2"},
+	} {
+		if _, err := NewLayoutPlan(diskPath, Layout{Partitions: tt.layout}, Options{}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: NewLayoutPlan() error = %v, want one saying %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// partUUID returns the PARTUUID of partition number of the disk image at path.
+func partUUID(t *testing.T, path string, number int) string {
+	t.Helper()
+	disks, err := ListDisks(path)
+	if err != nil || len(disks) != 1 {
+		t.Fatalf("ListDisks() = %+v, %v", disks, err)
+	}
+	for _, p := range disks[0].Partitions {
+		if p.Number == number {
+			return p.PartUUID
+		}
+	}
+	t.Fatalf("partition %d not found", number)
+	return ""
+}
@@ -0,0 +1,66 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// gptLegacyBIOSBootable is GPT attribute bit 2, legacy BIOS bootable, which
+// the boot code of a hybrid-boot image, or a BIOS booting from a GPT disk,
+// looks for on the partition to boot from.
+const gptLegacyBIOSBootable uint64 = 1 << 2
+
+// LegacyBootableChange sets, or with Bootable false clears, the legacy BIOS
+// bootable attribute of the partition Partition identifies by Identifier,
+// e.g. label and rootfs, see Options.LegacyBootable.
+type LegacyBootableChange struct {
+	Identifier Identifier `json:"identifier"`
+	Partition  string     `json:"partition"`
+	Bootable   bool       `json:"bootable"`
+}
+
+func (c LegacyBootableChange) String() string {
+	return fmt.Sprintf("%s=%s", c.Identifier, c.Partition)
+}
+
+// markLegacyBootable marks each partition to be copied to a new location that
+// one of changes identifies to have the legacy BIOS bootable attribute set or
+// cleared as it replaces its original, see Options.LegacyBootable. A change
+// that identifies no partition to be copied changes nothing, and is warned
+// of; one that would both set and clear the attribute of a partition is an
+// error.
+func markLegacyBootable(logger *slog.Logger, disk string, resizes []partitionResizeTarget, changes []LegacyBootableChange) error {
+	for _, c := range changes {
+		pi := NewPartitionIdentifier(c.Identifier, c.Partition)
+		matched := false
+		for i, r := range resizes {
+			if !r.original.matches(pi) {
+				continue
+			}
+			if r.original.start == r.target.start {
+				logger.Warn("partition not copied to a new location, keeping its legacy BIOS bootable attribute as it is", "disk", disk, "partition", r.original.number, "label", r.original.label, "change", c.String())
+				matched = true
+				continue
+			}
+			add, remove := &resizes[i].setAttributes, &resizes[i].clearAttributes
+			if !c.Bootable {
+				add, remove = remove, add
+			}
+			if *remove&gptLegacyBIOSBootable != 0 {
+				return fmt.Errorf("partition %d (%s) is both to be legacy BIOS bootable and not", r.original.number, r.original.label)
+			}
+			*add |= gptLegacyBIOSBootable
+			matched = true
+		}
+		if !matched {
+			logger.Warn("partition to change the legacy BIOS bootable attribute of not found among those resized", "disk", disk, "change", c.String())
+		}
+	}
+	return nil
+}
+
+// finalAttributes returns the GPT attributes the copy of r is to have once it
+// replaced its original, whose attributes are original.
+func (r partitionResizeTarget) finalAttributes(original uint64) uint64 {
+	return original&^r.clearAttributes | r.setAttributes
+}
@@ -0,0 +1,92 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestLegacyBootable makes the copy of one partition legacy BIOS bootable and
+// that of another not, warning of one grown in place and one not resized,
+// and commits them, each copy getting the attributes of its original with
+// bit 2 set or cleared.
+func TestLegacyBootable(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "boot", Attributes: 1},
+		{Index: 2, Start: 9 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "rootfs", Attributes: gptLegacyBIOSBootable | 1<<60},
+		{Index: 3, Start: 17 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 4, Start: 33 * MB / 512, Size: 12 * MB, Type: gpt.LinuxFilesystem, Name: getAlternateLabel("boot")},
+		{Index: 5, Start: 45 * MB / 512, Size: 12 * MB, Type: gpt.LinuxFilesystem, Name: getAlternateLabel("rootfs")},
+	})
+	resizes := []partitionResizeTarget{
+		{original: partitionData{number: 1, label: "boot", start: 1 * MB, size: 8 * MB}, target: partitionData{number: 4, start: 33 * MB, size: 12 * MB}},
+		{original: partitionData{number: 2, label: "rootfs", start: 9 * MB, size: 8 * MB}, target: partitionData{number: 5, start: 45 * MB, size: 12 * MB}},
+		{original: partitionData{number: 3, label: "data", start: 17 * MB, size: 8 * MB}, target: partitionData{number: 3, start: 17 * MB, size: 16 * MB}, inPlace: true},
+	}
+	changes := []LegacyBootableChange{
+		{Identifier: IdentifierByLabel, Partition: "boot", Bootable: true},
+		{Identifier: IdentifierByLabel, Partition: "rootfs"},
+		{Identifier: IdentifierByLabel, Partition: "data", Bootable: true},
+		{Identifier: IdentifierByLabel, Partition: "swap", Bootable: true},
+	}
+	var logs bytes.Buffer
+	if err := markLegacyBootable(slog.New(slog.NewTextHandler(&logs, nil)), "disk.img", resizes, changes); err != nil {
+		t.Fatalf("markLegacyBootable() error: %v", err)
+	}
+	for _, want := range []string{`change="label=data"`, `change="label=swap"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("markLegacyBootable() logged %q, want a warning with %s", logs.String(), want)
+		}
+	}
+	if r := resizes[2]; r.setAttributes != 0 || r.clearAttributes != 0 {
+		t.Errorf("markLegacyBootable() marked partition grown in place with %#x and %#x, want nothing", r.setAttributes, r.clearAttributes)
+	}
+	if desc := describeCommit("disk.img", resizes); !strings.Contains(desc, "making the copy of partition 1 (boot) legacy BIOS bootable and making the copy of partition 2 (rootfs) not legacy BIOS bootable") {
+		t.Errorf("describeCommit() = %q, want the copies made legacy BIOS bootable and not", desc)
+	}
+
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitPartitions(context.Background(), slog.Default(), nil, d, resizes[:2], true); err != nil {
+		t.Fatalf("commitPartitions() error: %v", err)
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]uint64{1: 1 | gptLegacyBIOSBootable, 2: 1 << 60, 3: 0}
+	for _, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		if attributes, ok := want[p.Index]; !ok || p.Attributes != attributes {
+			t.Errorf("partition %d (%s) has attributes %#x, want %#x", p.Index, p.Name, p.Attributes, attributes)
+		}
+		delete(want, p.Index)
+	}
+	if len(want) > 0 {
+		t.Errorf("partitions %v not in the table", want)
+	}
+
+	// a partition cannot be both
+	resizes[0].setAttributes, resizes[0].clearAttributes = 0, 0
+	both := []LegacyBootableChange{{Identifier: IdentifierByLabel, Partition: "boot", Bootable: true}, {Identifier: IdentifierByLabel, Partition: "boot"}}
+	if err := markLegacyBootable(slog.Default(), "disk.img", resizes[:1], both); err == nil || !strings.Contains(err.Error(), "partition 1 (boot)") {
+		t.Errorf("markLegacyBootable() of a partition both to be bootable and not error = %v, want it named", err)
+	}
+}
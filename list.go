@@ -0,0 +1,129 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// DiskInfo is a disk ListDisks found, with its partitions in order of their
+// numbers. GUID is the disk GUID of its GPT, and Size its size in bytes; both
+// are left out should the disk not be readable.
+type DiskInfo struct {
+	Path       string          `json:"path"`
+	GUID       string          `json:"guid,omitempty"`
+	Size       int64           `json:"size,omitempty"`
+	Partitions []PartitionInfo `json:"partitions"`
+}
+
+// PartitionInfo is a partition of a disk ListDisks found, with what it can be
+// identified by: Name, its device name, by IdentifierByName, Label, its name in
+// the GPT, by IdentifierByLabel, PartUUID by IdentifierByPartUUID, FSUUID by
+// IdentifierByFSUUID and FSLabel by IdentifierByFSLabel. Start, End, its last
+// byte, and Size are in bytes. Type is its GPT partition type GUID, and FSType
+// the type of what is on it, such as ext4, xfs, vfat, swap or luks, or empty
+// if it is not known.
+type PartitionInfo struct {
+	Number   int    `json:"number"`
+	Name     string `json:"name,omitempty"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Size     int64  `json:"size"`
+	Label    string `json:"label,omitempty"`
+	Type     string `json:"type,omitempty"`
+	PartUUID string `json:"partUUID,omitempty"`
+	FSType   string `json:"fsType,omitempty"`
+	FSUUID   string `json:"fsUUID,omitempty"`
+	FSLabel  string `json:"fsLabel,omitempty"`
+}
+
+// ListDisks returns the disks with partitions, in order of their names, with
+// all that is needed to identify their partitions to Run, without changing
+// anything. With disk, a disk device or image file, it returns just that disk.
+func ListDisks(disk string) ([]DiskInfo, error) {
+	disks, err := findDisks(disk, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find disks: %v", err)
+	}
+	var names []string
+	for name := range disks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	infos := []DiskInfo{}
+	for _, name := range names {
+		path := filepath.Join("/dev", name)
+		if disk != "" {
+			path = disk
+		}
+		infos = append(infos, listDisk(path, disks[name]))
+	}
+	return infos, nil
+}
+
+// listDisk returns the DiskInfo of the disk at path with partitions parts, as
+// findDisks found them, adding what only the disk itself knows: its GUID and
+// size, and the type GUID and filesystem type of each partition. It is best
+// effort: a disk that cannot be read has just what findDisks found.
+func listDisk(path string, parts []partitionData) DiskInfo {
+	info := DiskInfo{Path: path, Partitions: []PartitionInfo{}}
+	var r io.ReaderAt
+	types := make(map[int]string)
+	if backend, err := file.OpenFromPath(path, true); err == nil {
+		defer func() { _ = backend.Close() }()
+		if d, err := diskfs.OpenBackend(backend); err == nil {
+			info.Size = d.Size
+			r = d.Backend
+			if table, err := readGPT(d); err == nil {
+				info.GUID = table.GUID
+				for _, p := range table.Partitions {
+					types[p.Index] = string(p.Type)
+				}
+			}
+		}
+	}
+	for _, p := range parts {
+		pi := PartitionInfo{
+			Number:   p.number,
+			Name:     p.name,
+			Start:    p.start,
+			End:      p.end,
+			Size:     p.size,
+			Label:    p.label,
+			Type:     types[p.number],
+			PartUUID: p.uuid,
+			FSUUID:   p.fsUUID,
+			FSLabel:  p.fsLabel,
+		}
+		if r != nil {
+			pi.FSType = filesystemType(r, p)
+		}
+		info.Partitions = append(info.Partitions, pi)
+	}
+	slices.SortFunc(info.Partitions, func(a, b PartitionInfo) int { return a.Number - b.Number })
+	return info
+}
+
+// filesystemType returns the type of what is on part of r: an ext4 or XFS
+// filesystem, a LUKS container, a swap area, a FAT32 filesystem, as vfat, or
+// the storage subsystem probeSignature finds. It is best effort, returning ""
+// for anything else.
+func filesystemType(r io.ReaderAt, part partitionData) string {
+	if fsType, _, err := readFilesystemUUID(r, part.start); err == nil && fsType != "" {
+		return fsType
+	}
+	if _, isSwap, err := readSwapHeader(r, part.start); err == nil && isSwap {
+		return "swap"
+	}
+	if fat32VolumeID(r, part.start) != "" {
+		return "vfat"
+	}
+	if name, err := probeSignature(r, part); err == nil {
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package partitionresizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestListDisks lists the partitions of a disk image: a FAT32 ESP and three
+// ext4 partitions, all of the Linux filesystem type.
+func TestListDisks(t *testing.T) {
+	disks, err := ListDisks(diskfullImg)
+	if err != nil {
+		t.Fatalf("ListDisks() error: %v", err)
+	}
+	if len(disks) != 1 {
+		t.Fatalf("ListDisks() found %d disks, want 1", len(disks))
+	}
+	disk := disks[0]
+	if disk.Path != diskfullImg || disk.GUID == "" || disk.Size == 0 {
+		t.Errorf("ListDisks() disk = %s, GUID %q, size %d, want %s with a GUID and size", disk.Path, disk.GUID, disk.Size, diskfullImg)
+	}
+	if len(disk.Partitions) != 4 {
+		t.Fatalf("ListDisks() found %d partitions, want 4", len(disk.Partitions))
+	}
+	for i, p := range disk.Partitions {
+		if p.Number != i+1 {
+			t.Errorf("partition %d has number %d, want %d", i, p.Number, i+1)
+		}
+		if p.PartUUID == "" || p.FSUUID == "" || p.End != p.Start+p.Size-1 {
+			t.Errorf("partition %d is %+v, want a PARTUUID, a filesystem UUID and its end", p.Number, p)
+		}
+		want := "ext4"
+		if p.Number == 1 {
+			want = "vfat"
+		}
+		if p.FSType != want || !strings.EqualFold(p.Type, string(gpt.LinuxFilesystem)) {
+			t.Errorf("partition %d (%s) is %s of type %s, want %s of type %s", p.Number, p.Label, p.FSType, p.Type, want, gpt.LinuxFilesystem)
+		}
+	}
+	if esp := disk.Partitions[0]; esp.Label != "ESP" || esp.FSLabel != "ESP" {
+		t.Errorf("ESP is labelled %q with filesystem label %q, want ESP", esp.Label, esp.FSLabel)
+	}
+}
@@ -0,0 +1,230 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	luksMagic         = "LUKS\xba\xbe"
+	luksHeaderSize    = 512
+	luks1PayloadAt    = 104
+	luks2HeaderSizeAt = 8
+	luks2BinarySize   = 4096
+	luksSectorSize    = 512
+	luksMapperPrefix  = "partresizer-luks-"
+)
+
+// luksHeader describes a LUKS container, as recorded in its header.
+type luksHeader struct {
+	version int
+	// payloadOffset is the byte offset of the encrypted data from the start of
+	// the container; everything before it is header and keyslots.
+	payloadOffset int64
+}
+
+// luks2Metadata is the part of the LUKS2 JSON metadata area we need.
+type luks2Metadata struct {
+	Segments map[string]struct {
+		Offset string `json:"offset"`
+	} `json:"segments"`
+}
+
+// readLUKSHeader reads the LUKS header of the partition starting at byte offset
+// start in r. It returns false if the partition does not hold a LUKS container.
+func readLUKSHeader(r io.ReaderAt, start int64) (luksHeader, bool, error) {
+	hdr := make([]byte, luksHeaderSize)
+	if _, err := r.ReadAt(hdr, start); err != nil {
+		return luksHeader{}, false, fmt.Errorf("read LUKS header: %w", err)
+	}
+	if string(hdr[:len(luksMagic)]) != luksMagic {
+		return luksHeader{}, false, nil
+	}
+	h := luksHeader{version: int(binary.BigEndian.Uint16(hdr[6:]))}
+	switch h.version {
+	case 1:
+		h.payloadOffset = int64(binary.BigEndian.Uint32(hdr[luks1PayloadAt:])) * luksSectorSize
+	case 2:
+		// the payload offset is in the JSON metadata that follows the binary header
+		hdrSize := int64(binary.BigEndian.Uint64(hdr[luks2HeaderSizeAt:]))
+		if hdrSize <= luks2BinarySize || hdrSize > 4*MB {
+			return luksHeader{}, false, fmt.Errorf("invalid LUKS2 header size %d", hdrSize)
+		}
+		data := make([]byte, hdrSize-luks2BinarySize)
+		if _, err := r.ReadAt(data, start+luks2BinarySize); err != nil {
+			return luksHeader{}, false, fmt.Errorf("read LUKS2 metadata: %w", err)
+		}
+		var meta luks2Metadata
+		if err := json.Unmarshal(bytes.TrimRight(data, "\x00"), &meta); err != nil {
+			return luksHeader{}, false, fmt.Errorf("parse LUKS2 metadata: %w", err)
+		}
+		segment, ok := meta.Segments["0"]
+		if !ok {
+			return luksHeader{}, false, fmt.Errorf("LUKS2 metadata has no data segment")
+		}
+		offset, err := strconv.ParseInt(segment.Offset, 10, 64)
+		if err != nil {
+			return luksHeader{}, false, fmt.Errorf("invalid LUKS2 segment offset %q", segment.Offset)
+		}
+		h.payloadOffset = offset
+	default:
+		return luksHeader{}, false, fmt.Errorf("unsupported LUKS version %d", h.version)
+	}
+	return h, true, nil
+}
+
+// execCryptsetup runs cryptsetup with the given arguments.
+var execCryptsetup = func(ctx context.Context, args ...string) error {
+	return runTool(ctx, "cryptsetup", args...)
+}
+
+// requireLUKSKey verifies, before anything is changed, that a key file was given
+// if any of the partitions being resized holds a LUKS container, since the
+// filesystem inside cannot be resized without unlocking it.
+func requireLUKSKey(d *disk.Disk, resizes []partitionResizeTarget, keyFile string) error {
+	if keyFile != "" {
+		return nil
+	}
+	for _, r := range resizes {
+		_, isLUKS, err := readLUKSHeader(d.Backend, r.original.start)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", r.original.number, err)
+		}
+		if isLUKS {
+			return fmt.Errorf("partition %d is LUKS encrypted, a key file is required to resize it", r.original.number)
+		}
+	}
+	return nil
+}
+
+// resizeLUKS unlocks the LUKS container on the partition described by part with
+// keyFile and resizes it and the ext4 filesystem inside it to fit a partition of
+// size bytes. When shrinking, which must happen before the partition itself is
+// shrunk, the filesystem is shrunk first and then the dm-crypt mapping; when
+// growing, which must happen after the partition has been grown, the mapping is
+// grown to the partition first and then the filesystem.
+func resizeLUKS(ctx context.Context, logger *slog.Logger, device string, part partitionData, size int64, hdr luksHeader, keyFile string, fixErrors bool) error {
+	if device == "" {
+		return fmt.Errorf("cannot resize LUKS container: disk backend has no path")
+	}
+	innerSize := size - hdr.payloadOffset
+	if innerSize <= 0 {
+		return fmt.Errorf("partition %d of %d bytes is too small for its LUKS header of %d bytes", part.number, size, hdr.payloadOffset)
+	}
+	logger.Info("resizing LUKS container", "partition", part.number, "version", hdr.version, "bytes", size, "filesystemMB", innerSize/MB)
+	name := fmt.Sprintf("%s%d", luksMapperPrefix, part.number)
+	resizeInner := func(containerDevice string) (err error) {
+		if err := execCryptsetup(ctx, "open", "--key-file", keyFile, containerDevice, name); err != nil {
+			return err
+		}
+		defer func() {
+			// an open container is closed, however the resize ends
+			if cerr := execCryptsetup(context.WithoutCancel(ctx), "close", name); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		mapper := filepath.Join("/dev/mapper", name)
+		if size < part.size {
+			if err := execResize2fs(ctx, mapper, innerSize/MB, fixErrors); err != nil {
+				return err
+			}
+			return execCryptsetup(ctx, "resize", "--key-file", keyFile, "--size", strconv.FormatInt(innerSize/luksSectorSize, 10), name)
+		}
+		if err := execCryptsetup(ctx, "resize", "--key-file", keyFile, name); err != nil {
+			return err
+		}
+		return execResize2fs(ctx, mapper, innerSize/MB, fixErrors)
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	deviceType, err := disk.DetermineDeviceType(f)
+	if err != nil {
+		return err
+	}
+	switch deviceType {
+	case disk.DeviceTypeBlockDevice:
+		partDevice, err := partitionDevicePath(device, part.number, "")
+		if err != nil {
+			return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, part.number, err)
+		}
+		return resizeInner(partDevice)
+	case disk.DeviceTypeFile:
+		// copy the partition out, resize it there, then copy it back into the
+		// image; cryptsetup sets up a loop device for a file by itself
+		tmpFile, err := os.CreateTemp("", partTmpFilename)
+		if err != nil {
+			return err
+		}
+		_ = tmpFile.Close()
+		defer func() {
+			_ = os.RemoveAll(tmpFile.Name())
+		}()
+		if err := CopyRangeContext(ctx, device, tmpFile.Name(), part.start, 0, part.size, 0, nil); err != nil {
+			return fmt.Errorf("copy to temp file: %w", err)
+		}
+		if err := resizeInner(tmpFile.Name()); err != nil {
+			return err
+		}
+		// a copy back that stopped midway would leave the partition half
+		// resized, so it is not cancelled
+		return CopyRange(tmpFile.Name(), device, 0, part.start, min(part.size, size), 0)
+	default:
+		return fmt.Errorf("unknown device type for %s", device)
+	}
+}
+
+// shrinkLUKSFilesystems shrinks the LUKS containers, and the filesystems inside
+// them, of any encrypted partitions being shrunk, ahead of shrinkPartitions.
+func shrinkLUKSFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, keyFile string, fixErrors bool) error {
+	for _, r := range resizes {
+		if r.original.size <= r.target.size {
+			continue
+		}
+		hdr, isLUKS, err := readLUKSHeader(d.Backend, r.original.start)
+		if err != nil {
+			return fmt.Errorf("failed to check shrink partition %d for LUKS: %v", r.original.number, err)
+		}
+		if !isLUKS {
+			continue
+		}
+		if err := resizeLUKS(ctx, logger, d.Backend.Path(), r.original, r.target.size, hdr, keyFile, fixErrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// growLUKSFilesystems grows the LUKS containers, and the filesystems inside
+// them, that copyFilesystems copied raw into their larger target partitions.
+func growLUKSFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, keyFile string, fixErrors bool) error {
+	for _, r := range resizes {
+		if r.original.start == r.target.start || r.target.size <= r.original.size {
+			continue
+		}
+		hdr, isLUKS, err := readLUKSHeader(d.Backend, r.target.start)
+		if err != nil {
+			return fmt.Errorf("failed to check partition %d for LUKS: %v", r.target.number, err)
+		}
+		if !isLUKS {
+			continue
+		}
+		if err := resizeLUKS(ctx, logger, d.Backend.Path(), r.target, r.target.size, hdr, keyFile, fixErrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// testLUKSHeader returns a minimal LUKS header of the given version whose data
+// segment starts at payloadOffset bytes.
+func testLUKSHeader(version int, payloadOffset int64) []byte {
+	buf := make([]byte, 16384)
+	copy(buf, luksMagic)
+	binary.BigEndian.PutUint16(buf[6:], uint16(version))
+	switch version {
+	case 1:
+		binary.BigEndian.PutUint32(buf[luks1PayloadAt:], uint32(payloadOffset/luksSectorSize))
+	case 2:
+		binary.BigEndian.PutUint64(buf[luks2HeaderSizeAt:], uint64(len(buf)))
+		meta := `{"segments":{"0":{"type":"crypt","offset":"` + strconv.FormatInt(payloadOffset, 10) + `","size":"dynamic"}}}`
+		copy(buf[luks2BinarySize:], meta)
+	}
+	return buf
+}
+
+func TestReadLUKSHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		isLUKS  bool
+		version int
+		offset  int64
+	}{
+		{"luks1", testLUKSHeader(1, 2*MB), true, 1, 2 * MB},
+		{"luks2", testLUKSHeader(2, 16*MB), true, 2, 16 * MB},
+		{"not luks", make([]byte, 16384), false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr, ok, err := readLUKSHeader(bytes.NewReader(tt.data), 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.isLUKS {
+				t.Fatalf("isLUKS = %v, want %v", ok, tt.isLUKS)
+			}
+			if hdr.version != tt.version || hdr.payloadOffset != tt.offset {
+				t.Errorf("header = %+v, want version %d offset %d", hdr, tt.version, tt.offset)
+			}
+		})
+	}
+	t.Run("unsupported version", func(t *testing.T) {
+		if _, _, err := readLUKSHeader(bytes.NewReader(testLUKSHeader(3, 0)), 0); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+// TestResizeLUKS verifies the order in which a LUKS container and the
+// filesystem inside it are resized, with cryptsetup and resize2fs stubbed out.
+func TestResizeLUKS(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := partitionData{number: 1, label: "crypt", start: 1 * MB, size: 32 * MB}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(part.start / sectorSize), Size: uint64(part.size), Type: gpt.LinuxFilesystem, Name: "crypt"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(testLUKSHeader(2, 16*MB), part.start); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	origC, origR := execCryptsetup, execResize2fs
+	defer func() { execCryptsetup, execResize2fs = origC, origR }()
+	execCryptsetup = func(_ context.Context, args ...string) error {
+		// drop the device path of open, which is a temp file
+		if args[0] == "open" {
+			args = append(args[:3:3], args[4:]...)
+		}
+		calls = append(calls, "cryptsetup "+strings.Join(args, " "))
+		return nil
+	}
+	execResize2fs = func(_ context.Context, partDevice string, newSizeMB int64, _ bool) error {
+		calls = append(calls, "resize2fs "+partDevice+" "+strconv.FormatInt(newSizeMB, 10))
+		return nil
+	}
+
+	t.Run("key required", func(t *testing.T) {
+		resizes := []partitionResizeTarget{{original: part, target: part}}
+		if err := requireLUKSKey(d, resizes, ""); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if err := requireLUKSKey(d, resizes, "/key"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("shrink", func(t *testing.T) {
+		calls = nil
+		target := part
+		target.size = 24 * MB
+		resizes := []partitionResizeTarget{{original: part, target: target}}
+		if err := shrinkLUKSFilesystems(context.Background(), slog.Default(), d, resizes, "/key", false); err != nil {
+			t.Fatalf("shrinkLUKSFilesystems failed: %v", err)
+		}
+		want := []string{
+			"cryptsetup open --key-file /key partresizer-luks-1",
+			"resize2fs /dev/mapper/partresizer-luks-1 8",
+			"cryptsetup resize --key-file /key --size 16384 partresizer-luks-1",
+			"cryptsetup close partresizer-luks-1",
+		}
+		if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+			t.Errorf("calls = %q, want %q", calls, want)
+		}
+		// the filesystem inside is shrunk with the container, not by shrinkFilesystems
+		calls = nil
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
+			t.Fatalf("shrinkFilesystems failed: %v", err)
+		}
+		if len(calls) != 0 {
+			t.Errorf("shrinkFilesystems made calls %q, want none", calls)
+		}
+	})
+	t.Run("grow", func(t *testing.T) {
+		calls = nil
+		original := partitionData{number: 2, start: 40 * MB, size: 20 * MB}
+		resizes := []partitionResizeTarget{{original: original, target: part}}
+		if err := growLUKSFilesystems(context.Background(), slog.Default(), d, resizes, "/key", false); err != nil {
+			t.Fatalf("growLUKSFilesystems failed: %v", err)
+		}
+		want := []string{
+			"cryptsetup open --key-file /key partresizer-luks-1",
+			"cryptsetup resize --key-file /key partresizer-luks-1",
+			"resize2fs /dev/mapper/partresizer-luks-1 16",
+			"cryptsetup close partresizer-luks-1",
+		}
+		if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+			t.Errorf("calls = %q, want %q", calls, want)
+		}
+	})
+	t.Run("shrink usage", func(t *testing.T) {
+		if _, err := readShrinkUsage(d.Backend, part); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
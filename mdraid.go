@@ -0,0 +1,63 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	mdMagic = 0xa92b4efc
+	// a 0.90 superblock sits in the last 64 KiB aligned 64 KiB block of the
+	// device, a 1.0 superblock 8 KiB from the end aligned to 4 KiB
+	md090Reserved = 64 * KB
+	md10Offset    = 8 * KB
+	md10Align     = 4 * KB
+	// 1.1 and 1.2 superblocks sit at the start of the device and 4 KiB in
+	md12Offset = 4 * KB
+)
+
+// readMDVersion looks for an md RAID superblock on the partition described by
+// part in r, returning its metadata version, e.g. "1.2", or "" if there is none.
+func readMDVersion(r io.ReaderAt, part partitionData) (string, error) {
+	candidates := []struct {
+		version string
+		offset  int64
+	}{
+		{"1.1", 0},
+		{"1.2", md12Offset},
+		{"1.0", (part.size - md10Offset) &^ (md10Align - 1)},
+		{"0.90", (part.size &^ (md090Reserved - 1)) - md090Reserved},
+	}
+	buf := make([]byte, 4)
+	for _, c := range candidates {
+		ok, err := readAtPartition(r, part, buf, c.offset)
+		if err != nil {
+			return "", fmt.Errorf("read md superblock: %w", err)
+		}
+		if ok && binary.LittleEndian.Uint32(buf) == mdMagic {
+			return c.version, nil
+		}
+	}
+	return "", nil
+}
+
+// refuseMDMembers returns an error if any partition to be resized is a member
+// of an md RAID array. Copying a member to a new partition, or shrinking it,
+// behind the array's back would corrupt the array, so resizing one is left to
+// mdadm: fail and remove the member, resize it, and re-add it to the array.
+func refuseMDMembers(d *disk.Disk, resizes []partitionResizeTarget) error {
+	for _, r := range resizes {
+		version, err := readMDVersion(d.Backend, r.original)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", r.original.number, err)
+		}
+		if version != "" {
+			return fmt.Errorf("partition %d is a member of an md RAID array (metadata %s) and cannot be resized directly; "+
+				"fail and remove it from the array with mdadm, resize it, then re-add it", r.original.number, version)
+		}
+	}
+	return nil
+}
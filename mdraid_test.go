@@ -0,0 +1,40 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadMDVersion(t *testing.T) {
+	const size = 1 * MB
+	part := partitionData{number: 1, start: 512 * KB, size: size}
+	tests := []struct {
+		version string
+		offset  int64
+	}{
+		{"1.1", 0},
+		{"1.2", 4 * KB},
+		{"1.0", size - 8*KB},
+		{"0.90", size - 64*KB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			buf := make([]byte, part.start+size)
+			binary.LittleEndian.PutUint32(buf[part.start+tt.offset:], mdMagic)
+			got, err := readMDVersion(bytes.NewReader(buf), part)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.version {
+				t.Errorf("version = %q, want %q", got, tt.version)
+			}
+		})
+	}
+	t.Run("none", func(t *testing.T) {
+		got, err := readMDVersion(bytes.NewReader(make([]byte, part.start+size)), part)
+		if err != nil || got != "" {
+			t.Errorf("readMDVersion() = %q, %v, want no superblock", got, err)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// MultiResult describes what RunDisks did: the Result of each disk it
+// resized, in the order it resized them. Durations are in nanoseconds in JSON.
+type MultiResult struct {
+	Disks    []*Result     `json:"disks"`
+	Duration time.Duration `json:"duration"`
+}
+
+// diskChanges are the partitions to shrink and grow on a single disk.
+type diskChanges struct {
+	disk    string
+	shrink  []PartitionIdentifier
+	grow    []PartitionChange
+	exclude []PartitionIdentifier
+}
+
+// RunDisks is Run for a resize that touches more than one disk, e.g. growing
+// the data partitions of two NVMe drives. Each partition identifier applies
+// to every disk it is found on, so a grow of label:data grows the partition
+// labelled data on each disk that has one, and a shrink partition is used
+// for the disks it is found on. Each disk is then planned and resized on its
+// own, with just the partitions found on it. The same goes for
+// opts.ExcludePartitions: each must be found on a disk with a partition to
+// grow, and protects the partitions it identifies on that disk.
+//
+// Every disk is planned before any is changed, so that a resize that cannot
+// be planned on one disk changes none. The disks are then resized one after
+// another, stopping at the first that fails. With opts.JournalPath, each disk
+// has a journal of its own, at DiskJournalPath, so that each can be resumed
+// or rolled back on its own.
+//
+// RunDisks returns a *MultiResult with the Result of each disk it resized,
+// the one that failed included, once every disk is planned; it is nil only if
+// planning failed.
+func RunDisks(shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*MultiResult, error) {
+	return RunDisksContext(context.Background(), shrinkPartitions, growPartitions, opts)
+}
+
+// RunDisksContext is RunDisks, stopping cleanly should ctx be done, as
+// RunContext. The disks not yet resized are left as they are.
+func RunDisksContext(ctx context.Context, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*MultiResult, error) {
+	started := time.Now()
+	disks, err := findDisks("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find disks: %v", err)
+	}
+	changes, err := splitByDisk(disks, shrinkPartitions, growPartitions, opts.ExcludePartitions)
+	if err != nil {
+		return nil, err
+	}
+	// plan every disk before changing any
+	for _, c := range changes {
+		diskOpts := opts
+		diskOpts.ExcludePartitions = c.exclude
+		d, _, _, err := openAndPlan(c.disk, c.shrink, c.grow, true, diskOpts)
+		if err != nil {
+			return nil, fmt.Errorf("disk %s: %w", c.disk, err)
+		}
+		_ = d.Backend.Close()
+	}
+	res := &MultiResult{Disks: []*Result{}}
+	defer func() { res.Duration = time.Since(started) }()
+	for _, c := range changes {
+		diskOpts := opts
+		diskOpts.ExcludePartitions = c.exclude
+		if opts.JournalPath != "" {
+			diskOpts.JournalPath = DiskJournalPath(opts.JournalPath, c.disk)
+		}
+		opts.logger().Info("resizing disk", "disk", c.disk, "disks", len(changes))
+		r, err := RunContext(ctx, c.disk, c.shrink, c.grow, diskOpts)
+		if r != nil {
+			res.Disks = append(res.Disks, r)
+		}
+		if err != nil {
+			return res, fmt.Errorf("disk %s: %w", c.disk, err)
+		}
+	}
+	return res, nil
+}
+
+// DiskJournalPath returns the journal RunDisks keeps for disk, given
+// Options.JournalPath: journalPath with the name of the disk appended, e.g.
+// /var/lib/partitionresizer/journal.json.nvme0n1 for /dev/nvme0n1.
+func DiskJournalPath(journalPath, disk string) string {
+	return journalPath + "." + filepath.Base(disk)
+}
+
+// splitByDisk returns the partitions to shrink and grow on each of disks, as
+// found by findDisks, that has a partition to grow, in order of the disks'
+// names, with the partitions of excluded on each. Each identifier applies to
+// every disk it is found on. It is an error for a partition to grow not to be
+// found on any disk, or one to shrink or exclude not on any disk with a
+// partition to grow.
+func splitByDisk(disks map[string][]partitionData, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, excluded []PartitionIdentifier) ([]diskChanges, error) {
+	var names []string
+	for name := range disks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	found := func(name string, pi PartitionIdentifier) bool {
+		return slices.ContainsFunc(disks[name], func(p partitionData) bool { return p.matches(pi) })
+	}
+	var changes []diskChanges
+	for _, name := range names {
+		c := diskChanges{disk: filepath.Join("/dev", name)}
+		for _, gp := range growPartitions {
+			if found(name, gp) {
+				c.grow = append(c.grow, gp)
+			}
+		}
+		if len(c.grow) == 0 {
+			continue
+		}
+		for _, sp := range shrinkPartitions {
+			if found(name, sp) {
+				c.shrink = append(c.shrink, sp)
+			}
+		}
+		for _, ep := range excluded {
+			if found(name, ep) {
+				c.exclude = append(c.exclude, ep)
+			}
+		}
+		changes = append(changes, c)
+	}
+	for _, gp := range growPartitions {
+		if !slices.ContainsFunc(changes, func(c diskChanges) bool { return slices.Contains(c.grow, gp) }) {
+			return nil, NewPlanError("", fmt.Errorf("partition to grow %s=%s not found on any disk", gp.By(), gp.Value()))
+		}
+	}
+	for _, sp := range shrinkPartitions {
+		if !slices.ContainsFunc(changes, func(c diskChanges) bool { return slices.Contains(c.shrink, sp) }) {
+			return nil, NewPlanError("", fmt.Errorf("partition to shrink %s=%s not found on any disk with a partition to grow", sp.By(), sp.Value()))
+		}
+	}
+	for _, ep := range excluded {
+		if !slices.ContainsFunc(changes, func(c diskChanges) bool { return slices.Contains(c.exclude, ep) }) {
+			return nil, NewPlanError("", fmt.Errorf("excluded partition %s=%s not found on any disk with a partition to grow", ep.By(), ep.Value()))
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,56 @@
+package partitionresizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSplitByDisk splits a resize of two NVMe drives, each with a partition
+// labelled data, and a third disk without one, into a resize of each drive.
+func TestSplitByDisk(t *testing.T) {
+	disks := map[string][]partitionData{
+		"nvme1n1": {{name: "nvme1n1p1", label: "data"}, {name: "nvme1n1p2", label: "scratch"}},
+		"nvme0n1": {{name: "nvme0n1p1", label: "data"}, {name: "nvme0n1p2", label: "scratch"}},
+		"sda":     {{name: "sda1", label: "root"}},
+	}
+	data := NewMaxPartitionChange(IdentifierByLabel, "data")
+	scratch := NewPartitionIdentifier(IdentifierByLabel, "scratch")
+	root := NewPartitionIdentifier(IdentifierByLabel, "root")
+	changes, err := splitByDisk(disks, []PartitionIdentifier{scratch}, []PartitionChange{data}, []PartitionIdentifier{scratch})
+	if err != nil {
+		t.Fatalf("splitByDisk() error: %v", err)
+	}
+	want := []diskChanges{
+		{disk: "/dev/nvme0n1", shrink: []PartitionIdentifier{scratch}, grow: []PartitionChange{data}, exclude: []PartitionIdentifier{scratch}},
+		{disk: "/dev/nvme1n1", shrink: []PartitionIdentifier{scratch}, grow: []PartitionChange{data}, exclude: []PartitionIdentifier{scratch}},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("splitByDisk() = %+v, want %+v", changes, want)
+	}
+
+	// each disk gets just the partitions found on it
+	first := NewPartitionChange(IdentifierByName, "nvme0n1p1", 10*GB)
+	second := NewPartitionChange(IdentifierByName, "nvme1n1p1", 20*GB)
+	changes, err = splitByDisk(disks, nil, []PartitionChange{first, second}, nil)
+	if err != nil {
+		t.Fatalf("splitByDisk() error: %v", err)
+	}
+	if len(changes) != 2 || !reflect.DeepEqual(changes[0].grow, []PartitionChange{first}) || !reflect.DeepEqual(changes[1].grow, []PartitionChange{second}) {
+		t.Errorf("splitByDisk() = %+v, want nvme0n1p1 grown on nvme0n1 and nvme1n1p1 on nvme1n1", changes)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		shrink  []PartitionIdentifier
+		grow    []PartitionChange
+		exclude []PartitionIdentifier
+	}{
+		{"grow not found", nil, []PartitionChange{data, NewPartitionChange(IdentifierByLabel, "nope", GB)}, nil},
+		{"shrink not on a grown disk", []PartitionIdentifier{root}, []PartitionChange{data}, nil},
+		{"exclusion not on a grown disk", nil, []PartitionChange{data}, []PartitionIdentifier{root}},
+	} {
+		if _, err := splitByDisk(disks, tt.shrink, tt.grow, tt.exclude); err == nil {
+			t.Errorf("%s: splitByDisk() returned no error", tt.name)
+		}
+	}
+}
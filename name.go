@@ -1,18 +1,70 @@
 package partitionresizer
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
 
 const (
 	alternateLabelSuffix = "_resized2"
+	// gptNameUnits is the most UTF-16 code units a GPT partition name holds
+	gptNameUnits = 36
 )
 
 // getAlternateName returns an alternate label for a partition.
 // It must be predictable, so that we can go away, come back, and connect them.
+// Should the original be too long for the suffix to fit after it in a GPT
+// name, it is cut short, a whole character at a time, counting characters
+// outside the Basic Multilingual Plane as the two code units they take.
 func getAlternateLabel(original string) string {
-	return original + alternateLabelSuffix
+	runes := []rune(original)
+	for len(runes) > 0 && gptNameLength(string(runes))+len(alternateLabelSuffix) > gptNameUnits {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + alternateLabelSuffix
+}
+
+// checkAlternateLabels returns an error should the alternate label of any
+// partition of resizes copied to a new location, see getAlternateLabel, be
+// that of another one, as the names of both, cut short, are the same, or be
+// the name of a partition of table other than the one a resumed resize
+// copies it to: the partition it is copied to is found by that name.
+func checkAlternateLabels(table *gpt.Table, resizes []partitionResizeTarget) error {
+	names := map[int]string{}
+	for _, p := range table.Partitions {
+		if p.Type != gpt.Unused {
+			names[p.Index] = p.Name
+		}
+	}
+	copiedTo := map[string]int{}
+	for _, r := range resizes {
+		if r.original.start == r.target.start {
+			continue
+		}
+		alt := getAlternateLabel(names[r.original.number])
+		if other, ok := copiedTo[alt]; ok {
+			return fmt.Errorf("partitions %d and %d would both be copied to a partition named %q, as their names are the same once cut short to fit it; rename one of them", other, r.original.number, alt)
+		}
+		copiedTo[alt] = r.original.number
+		for _, p := range table.Partitions {
+			if p.Type != gpt.Unused && p.Name == alt && p.Index != r.target.number {
+				return fmt.Errorf("partition %d is named %q, the name the copy of partition %d would be given; rename one of them", p.Index, alt, r.original.number)
+			}
+		}
+	}
+	return nil
 }
 
 //nolint:unused // getOriginalLabel returns the original label from an alternate label.
 func getOriginalLabel(alternate string) string {
 	return strings.TrimSuffix(alternate, alternateLabelSuffix)
 }
+
+// gptNameLength returns the length of name as a GPT holds it, in UTF-16 code
+// units.
+func gptNameLength(name string) int {
+	return len(utf16.Encode([]rune(name)))
+}
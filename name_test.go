@@ -0,0 +1,97 @@
+package partitionresizer
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestGetAlternateLabel(t *testing.T) {
+	tests := map[string]string{
+		"rootfs":                      "rootfs_resized2",
+		"Données":                     "Données_resized2",
+		strings.Repeat("é", 30):       strings.Repeat("é", 27) + "_resized2",
+		strings.Repeat("🚀", 20):       strings.Repeat("🚀", 13) + "_resized2",
+		"a" + strings.Repeat("🚀", 14): "a" + strings.Repeat("🚀", 13) + "_resized2",
+	}
+	for original, want := range tests {
+		got := getAlternateLabel(original)
+		if got != want {
+			t.Errorf("getAlternateLabel(%q) = %q, want %q", original, got, want)
+		}
+		if n := gptNameLength(got); n > gptNameUnits {
+			t.Errorf("getAlternateLabel(%q) is %d UTF-16 code units, more than a GPT name holds", original, n)
+		}
+	}
+}
+
+// TestNonASCIINames writes partitions with names outside ASCII, including
+// characters that take two UTF-16 code units, and their alternates, and reads
+// them back from the GPT, matching them by label.
+func TestNonASCIINames(t *testing.T) {
+	names := []string{"Données", "系统分区", "EFI 🚀", strings.Repeat("🚀", 18)}
+	var partitions []*gpt.Partition
+	for i, name := range names {
+		for j, n := range []string{name, getAlternateLabel(name)} {
+			index := 2*i + j + 1
+			partitions = append(partitions, &gpt.Partition{Index: index, Start: uint64(index) * MB / 512, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: n})
+		}
+	}
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 16*MB, partitions)
+
+	backend, err := file.OpenFromPath(diskPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := gptPartitionData(d, table)
+	for _, p := range partitions {
+		var matched []int
+		for _, pd := range parts {
+			if pd.matches(NewPartitionIdentifier(IdentifierByLabel, p.Name)) {
+				matched = append(matched, pd.number)
+			}
+		}
+		if len(matched) != 1 || matched[0] != p.Index {
+			t.Errorf("label %q matches partitions %v, want just %d", p.Name, matched, p.Index)
+		}
+	}
+}
+
+// TestCheckAlternateLabels refuses to copy two partitions whose long names
+// share the part of them their alternate labels keep, or one whose alternate
+// label another partition already has, but not one resumed, whose copy has it.
+func TestCheckAlternateLabels(t *testing.T) {
+	prefix := strings.Repeat("x", gptNameUnits-len(alternateLabelSuffix))
+	table := &gpt.Table{Partitions: []*gpt.Partition{
+		{Index: 1, Start: 2048, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: prefix + "-one"},
+		{Index: 2, Start: 4096, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: prefix + "-two"},
+		{Index: 3, Start: 6144, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 4, Start: 8192, Size: 1 * MB, Type: gpt.LinuxFilesystem, Name: "data_resized2"},
+	}}
+	moved := func(number, target int) partitionResizeTarget {
+		return partitionResizeTarget{original: partitionData{number: number, start: int64(number) * MB}, target: partitionData{number: target, start: 64 * MB}}
+	}
+	if err := checkAlternateLabels(table, []partitionResizeTarget{moved(1, 5), moved(2, 6)}); err == nil || !strings.Contains(err.Error(), "partitions 1 and 2") {
+		t.Errorf("checkAlternateLabels() of names sharing a prefix error = %v, want both named", err)
+	}
+	if err := checkAlternateLabels(table, []partitionResizeTarget{moved(1, 5), moved(3, 6)}); err == nil || !strings.Contains(err.Error(), "partition 4") {
+		t.Errorf("checkAlternateLabels() of a name taken error = %v, want partition 4 named", err)
+	}
+	if err := checkAlternateLabels(table, []partitionResizeTarget{moved(1, 5), moved(3, 4)}); err != nil {
+		t.Errorf("checkAlternateLabels() of a resumed copy error: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const xfsMagic = "XFSB"
+
+// inPlaceFilesystem returns the type of the filesystem on the partition starting
+// at byte offset start in r, if it is one that can be grown in place: "ext4",
+// online or offline, or "xfs", online only. It returns "" for anything else.
+func inPlaceFilesystem(r io.ReaderAt, start int64) string {
+	if _, err := readExt4Usage(r, start); err == nil {
+		return "ext4"
+	}
+	buf := make([]byte, len(xfsMagic))
+	if _, err := r.ReadAt(buf, start); err == nil && string(buf) == xfsMagic {
+		return "xfs"
+	}
+	return ""
+}
+
+// execResize2fsOnline grows the mounted ext4 filesystem on the given partition
+// device to fill it. Unlike execResize2fs it runs no e2fsck, which cannot check
+// a mounted filesystem.
+var execResize2fsOnline = func(ctx context.Context, partDevice string) error {
+	return runTool(ctx, "resize2fs", partDevice)
+}
+
+// execXfsGrowfs grows the XFS filesystem mounted at mountpoint to fill its
+// partition.
+var execXfsGrowfs = func(ctx context.Context, mountpoint string) error {
+	return runTool(ctx, "xfs_growfs", mountpoint)
+}
+
+// execPartxUpdate tells the kernel the new size of one partition of the disk
+// device. Unlike re-reading the whole partition table, which the kernel refuses
+// while any partition of the disk is in use, this works with the partition
+// mounted.
+var execPartxUpdate = func(ctx context.Context, device string, number int) error {
+	return runTool(ctx, "partx", "-u", "--nr", strconv.Itoa(number), device)
+}
+
+// growPartitionEntries sets the partitions in table planned to grow in place,
+// see Options.OnlineGrow, to their target sizes, and returns their numbers.
+// Setting a partition to the size it already has is a no-op.
+func growPartitionEntries(logger *slog.Logger, table *gpt.Table, resizes []partitionResizeTarget) ([]int, error) {
+	byIndex := make(map[int]*gpt.Partition)
+	for _, p := range table.Partitions {
+		byIndex[p.Index] = p
+	}
+	var grown []int
+	for _, r := range resizes {
+		if !r.inPlace {
+			continue
+		}
+		p, ok := byIndex[r.original.number]
+		if !ok {
+			return nil, fmt.Errorf("partition %d not found in partition table", r.original.number)
+		}
+		logger.Info("growing partition in place", "partition", r.original.number, "bytes", r.target.size)
+		p.Size = uint64(r.target.size)
+		p.End = 0
+		if r.partitionType != "" && r.partitionType != p.Type {
+			logger.Info("retyping partition", "partition", r.original.number, "from", p.Type, "to", r.partitionType)
+			p.Type = r.partitionType
+		}
+		grown = append(grown, r.original.number)
+	}
+	return grown, nil
+}
+
+// growInPlace grows the filesystems on the partitions grown in place by
+// commitPartitions to fill them. A mounted filesystem is grown online, with
+// resize2fs for ext4 or xfs_growfs for XFS; an unmounted ext4 filesystem is
+// grown as in resizeFilesystem. Growing a filesystem to fill a partition it
+// already fills is a no-op, so this is safe to re-run.
+func growInPlace(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, fixErrors bool) error {
+	var grows []partitionResizeTarget
+	for _, r := range resizes {
+		if r.inPlace {
+			grows = append(grows, r)
+		}
+	}
+	if len(grows) == 0 {
+		return nil
+	}
+	device := d.Backend.Path()
+	if device == "" {
+		return fmt.Errorf("cannot grow in place: disk backend has no path")
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	deviceType, err := disk.DetermineDeviceType(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mountedDevices()
+	if err != nil {
+		return fmt.Errorf("list mounts: %w", err)
+	}
+	for _, r := range grows {
+		fsType := inPlaceFilesystem(d.Backend, r.original.start)
+		var mountpoints []string
+		if deviceType == disk.DeviceTypeBlockDevice {
+			partDevice, err := partitionDevicePath(device, r.original.number, "")
+			if err != nil {
+				return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, r.original.number, err)
+			}
+			if mountpoints = mounts[resolvePath(partDevice)]; len(mountpoints) > 0 {
+				logger.Info("growing mounted filesystem online", "partition", r.original.number, "filesystem", fsType)
+				switch fsType {
+				case "ext4":
+					err = execResize2fsOnline(ctx, partDevice)
+				case "xfs":
+					err = execXfsGrowfs(ctx, mountpoints[0])
+				default:
+					err = fmt.Errorf("cannot grow mounted filesystem on partition %d online", r.original.number)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if fsType != "ext4" {
+			return fmt.Errorf("cannot grow %s filesystem on partition %d while it is not mounted", fsType, r.original.number)
+		}
+		if err := resizeFilesystem(ctx, logger, device, r.original, r.target.size-r.original.size, fixErrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package partitionresizer
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestGrowInPlace verifies that an in-place grow on an image file extends the
+// partition in the table, in commitPartitions, and grows its ext4 filesystem
+// offline, with resize2fs stubbed out.
+func TestGrowInPlace(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(part.start / sectorSize), Size: uint64(part.size), Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	// just enough of an ext4 superblock to be recognized
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(sb, part.start+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+	if got := inPlaceFilesystem(d.Backend, part.start); got != "ext4" {
+		t.Fatalf("inPlaceFilesystem() = %q, want ext4", got)
+	}
+
+	var resizedMB int64
+	orig := execResize2fs
+	defer func() { execResize2fs = orig }()
+	execResize2fs = func(_ context.Context, _ string, newSizeMB int64, _ bool) error {
+		resizedMB = newSizeMB
+		return nil
+	}
+	target := part
+	target.size = 16 * MB
+	target.end = part.start + target.size - 1
+	resizes := []partitionResizeTarget{{original: part, target: target, inPlace: true}}
+	if err := commitPartitions(context.Background(), slog.Default(), nil, d, resizes, false); err != nil {
+		t.Fatalf("commitPartitions failed: %v", err)
+	}
+	if err := growInPlace(context.Background(), slog.Default(), d, resizes, false); err != nil {
+		t.Fatalf("growInPlace failed: %v", err)
+	}
+	if resizedMB != 16 {
+		t.Errorf("resize2fs to %d MB, want 16", resizedMB)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := tableRaw.(*gpt.Table).Partitions[0].GetSize(); size != target.size {
+		t.Errorf("partition size = %d, want %d", size, target.size)
+	}
+}
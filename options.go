@@ -0,0 +1,382 @@
+package partitionresizer
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultShrinkGranularity is the unit the space reclaimed by shrinking is
+	// rounded up to when Options.ShrinkGranularity is not set.
+	DefaultShrinkGranularity = MB
+	// DefaultFreezeTimeout is the longest a filesystem is kept frozen when
+	// Options.FreezeTimeout is not set.
+	DefaultFreezeTimeout = 5 * time.Minute
+)
+
+// LevelTrace is the level, below slog.LevelDebug, at which a resize logs each
+// partition table it writes, with the partitions in it, and each external tool
+// as it starts. At slog.LevelDebug it logs each tool once it has run, with all
+// it wrote.
+const LevelTrace = slog.LevelDebug - 4
+
+// Options holds the optional settings for Run. The zero value gives the default
+// behavior for each of them. New settings are added here, rather than as
+// arguments to Run, so that adding one does not change its signature.
+type Options struct {
+	// FixErrors repairs the errors found checking a filesystem (e2fsck -y,
+	// fsck.fat -a), rather than failing on them with a read-only check.
+	FixErrors bool
+	// DryRun plans the resize, and estimates it, but changes nothing. It
+	// also simulates the steps the resize would take, probing each
+	// filesystem to shrink and looking for each external tool to run, and
+	// returns a *DryRunError listing the steps that would fail. It is not
+	// saved in a journal or a plan, so neither is ever a dry run.
+	DryRun bool `json:"-"`
+	// PreserveNumbers renumbers each partition relocated to grow it back to
+	// its original partition number, once its data has been copied, so that
+	// its partition number (e.g. /dev/sda2) is unchanged by the resize.
+	PreserveNumbers bool
+	// AutoShrink picks the partition to shrink when none is given but there is
+	// not enough free space for the grows: the largest ext4 partition with
+	// enough free space inside its filesystem.
+	AutoShrink bool
+	// ShrinkGranularity is the unit, in bytes, that the total space to reclaim
+	// by shrinking is rounded up to, so the shrunk partitions stay aligned.
+	// Zero means DefaultShrinkGranularity. A coarse granularity such as GB
+	// leaves round sizes but can over-shrink by up to one unit.
+	ShrinkGranularity int64
+	// ShrinkMargin is the headroom, in bytes, that must remain free inside a
+	// filesystem after it is shrunk, so that it is not left within a few MB
+	// of its data and immediately short of space.
+	ShrinkMargin int64
+	// ShrinkMarginPercent is the headroom, as a percentage of a filesystem's
+	// current size, that must remain free inside it after it is shrunk. When
+	// both margins are set, the larger applies.
+	ShrinkMarginPercent float64
+	// LUKSKeyFile is the path to a key file that unlocks the LUKS containers of
+	// any encrypted partitions being resized. It is required to resize an
+	// encrypted partition, as the filesystem inside is resized along with the
+	// container.
+	LUKSKeyFile string
+	// OnlineGrow grows an ext4 or XFS partition in place, when enough free
+	// space immediately follows it, rather than copying it to a new partition.
+	// Such a partition may be mounted -- even the running root -- and its
+	// filesystem is then grown online, with resize2fs or xfs_growfs. A grow
+	// that does not fit in place is relocated as usual.
+	OnlineGrow bool
+	// FreezeMounted allows a mounted partition to be copied to its new,
+	// larger location, freezing its filesystem with fsfreeze for the copy so
+	// that the copy is crash-consistent. The filesystem is thawed once the
+	// copy is done or fails. Writes made after the thaw are not in the copy,
+	// and the kernel keeps using the old partition until the disk is no longer
+	// in use, so they are lost once the system is rebooted, which it should
+	// be promptly afterwards. As that loses data, FreezeMounted is refused
+	// unless AcceptLostWrites is set too.
+	FreezeMounted bool
+	// AcceptLostWrites accepts that what is written to a partition copied
+	// with FreezeMounted once its copy is done is lost.
+	AcceptLostWrites bool
+	// FreezeTimeout is the longest a filesystem is kept frozen. A copy still
+	// running then is no longer consistent: the filesystem is thawed and the
+	// resize fails. Zero means DefaultFreezeTimeout.
+	FreezeTimeout time.Duration
+	// TemporaryUUID gives a partition copied raw -- XFS, LUKS, or anything
+	// else copied byte for byte -- a temporary filesystem UUID, so that mounting
+	// by UUID is not ambiguous should the resize be interrupted while the copy
+	// and its original both exist. Once every copy is made and verified, each
+	// is given its original's UUID back, immediately before the original is
+	// removed. A file-by-file ext4 copy, which otherwise keeps the new UUID it
+	// is created with, is given its original's UUID back too, and a FAT32
+	// copy its original's volume serial number, which it is otherwise given
+	// as it is copied.
+	TemporaryUUID bool
+	// JournalPath, if set, is where Run keeps a journal of the resize: the
+	// partition table before it, the exact resizes planned, and each phase as
+	// it completes. Should the resize be interrupted, Resume finishes it from
+	// the journal, or Rollback undoes it. Once the resize completes, the
+	// journal is moved aside, with ".completed" appended to its path, where
+	// Rollback can still find it. Run refuses to start while a journal from an
+	// unfinished resize is there.
+	JournalPath string
+	// SnapshotDir, if set, is where Run saves a snapshot of the disk's
+	// metadata before changing anything: a timestamped tar archive of the
+	// partition table, in the format of sgdisk --backup, and the first and
+	// last few MB of each partition being resized, which hold their
+	// superblocks, with a manifest of where on the disk each came from. An
+	// error from the resize names the snapshot, so that what it changed can
+	// be put back.
+	SnapshotDir string
+	// Verify is how thoroughly a partition copied raw -- XFS, LUKS, or
+	// anything else copied byte for byte -- is compared with its source
+	// before the source is removed: VerifyFull, the default when empty, reads
+	// all of both, VerifySampled only the first and last MB and a few MB at
+	// random offsets, and VerifyNone not at all. On multi-terabyte partitions,
+	// VerifyFull doubles the I/O of the copy.
+	Verify VerifyMode
+	// Validators are run against each partition copied to a new location,
+	// once every copy is complete and verified but before any original is
+	// removed, for checks only the caller knows to make, see Validator.
+	// Should any return an error, the resize fails and the copies are removed,
+	// leaving the originals as they were. Validators cannot be saved in a
+	// journal or a plan, so Resume runs them only if given them again, see
+	// ResumeWithOptions, and Plan.Apply only if they are set again.
+	Validators []Validator `json:"-"`
+	// ExcludePartitions are partitions, by any identifier, that the resize
+	// must never shrink, grow, move, renumber or remove, e.g. the ESP or a
+	// recovery partition, as a guard against a mistyped identifier. A resize
+	// that would change one fails as it is planned, with a
+	// *ProtectedPartitionError, and AutoShrink never picks one. One that is
+	// not found on the disk is likely mistyped, and fails the plan with a
+	// *PlanError. Like
+	// Validators, they are not saved in a journal or a plan; the plan was
+	// checked against them when it was made.
+	ExcludePartitions []PartitionIdentifier `json:"-"`
+	// ForceBootPartitions allows the resize to shrink, move or renumber a
+	// boot partition: one of type EFI system, BIOS boot, or another *-boot
+	// type. Without it, a resize that would fails as it is planned, with a
+	// *BootPartitionError, and AutoShrink never picks one; with it, each is
+	// warned of, as the system may not boot until its firmware and boot
+	// loader are updated to find the partition. Growing a boot partition in
+	// place needs no force.
+	ForceBootPartitions bool
+	// UpdateBootEntries, if set, re-registers with efibootmgr the UEFI boot
+	// entries for a loader on an EFI System Partition copied to a new
+	// location once the copy replaced it, so that each names it by its new
+	// number, start and size: each is created again under a free number,
+	// with its label and loader, before it is deleted, and takes its place in
+	// the boot order; one that passes its loader arguments is left as it is.
+	// It is best effort, and only for a block device of a system booted with
+	// UEFI; what goes wrong is warned of, and reported in Result.ESP. The
+	// copy keeps the partition GUID, type and attributes of the original
+	// either way, and is checked for its boot loaders before the cutover.
+	UpdateBootEntries bool
+	// LegacyBootable sets, or clears, the legacy BIOS bootable attribute,
+	// GPT attribute bit 2, of the partitions it identifies that are copied
+	// to a new location, as each copy replaces its original, rather than the
+	// copy keeping the attributes of the original: e.g. for a hybrid-boot
+	// image whose BIOS boot code looks for it on the root or boot partition.
+	// One that identifies a partition not copied, or none resized, changes
+	// nothing, and is warned of.
+	LegacyBootable []LegacyBootableChange
+	// CopyWorkers is how many partitions are copied to their new locations
+	// at once. At 0 or 1, the default, they are copied one after another;
+	// more is worth it where the partitions are on independent media, e.g.
+	// NVMe or multi-actuator disks. The first copy to fail stops the others.
+	// Progress is told of each copy as it runs, and may be told of
+	// them all at once, see TotalProgressReporter.
+	CopyWorkers int
+	// CopyStreams is how many stripes a partition copied byte for byte is
+	// split into, each copied, and then verified, by its own goroutine. At 1,
+	// it is copied from start to end, and at 0, the default, the number is
+	// picked for the disk, see BufferSize. On NVMe, a few streams typically
+	// copy two or three times as fast. With VerifyFull, each stripe is hashed
+	// on its own, so the source is still read once.
+	CopyStreams int
+	// BufferSize, if set, is the size of the buffer partitions copied byte
+	// for byte are read and written in. When 0, it is picked for the disk,
+	// as is CopyStreams when 0: a single stream of 4 MiB for a spinning disk
+	// or image file, and larger buffers and more streams for SSDs and NVMe,
+	// rounded to the disk's largest request and optimal I/O size.
+	BufferSize int64
+	// AutoTune, if set, picks the buffer size and streams BufferSize and
+	// CopyStreams leave to be picked by timing a few of them reading the
+	// largest partition copied, rather than from what the disk is. It reads
+	// 192 MiB, and is skipped for a partition smaller, or with
+	// MaxThroughput.
+	AutoTune bool
+	// CheckpointInterval is how many bytes of a partition copied byte for
+	// byte, of each stream of it, are copied between checkpoints recorded
+	// in the journal, see JournalPath, DefaultCheckpointInterval if 0. Each
+	// checkpoint syncs the copy so far to the device first, so that Resume
+	// continues an interrupted copy from its last checkpoint rather than
+	// copying all of a multi-terabyte partition again, once it has checked
+	// that what of the source was copied has not changed since. The copy
+	// of a source copied frozen, see FreezeMounted, is not continued.
+	CheckpointInterval int64
+	// MaxThroughput, if set, is the most bytes a second the copies of
+	// partitions to their new locations read, and the most they write, all
+	// of them together, so that a resize in the background leaves the rest
+	// of the disk's bandwidth to what else runs from it. The external tools
+	// the resize runs, such as resize2fs, are not held to it.
+	MaxThroughput int64
+	// NoCacheHints, if set, gives the kernel no advice on the page cache for
+	// partitions copied byte for byte. Without it, the source is read with
+	// FADV_SEQUENTIAL, and what is copied is dropped from the page cache
+	// behind the copy, so that a large copy does not push out of it what
+	// the workloads still running need; set it for small copies, where what
+	// is cached makes verification faster.
+	NoCacheHints bool
+	// NoAtime, if set, gives each file of a partition copied file by file,
+	// FAT32 or ext4, the modification time of its source as its access time,
+	// rather than the source's access time, as suits a filesystem mounted
+	// noatime, whose access times say nothing, and keeps the copy from
+	// recording when its files were last read.
+	NoAtime bool
+	// Discard, if set, discards the space the original of each partition
+	// copied to a new location leaves once it is removed, so that an SSD or
+	// thin-provisioned storage reclaims it: with BLKDISCARD on a block
+	// device, or by punching a hole in an image file. It is best effort,
+	// and only on Linux; the source of a copy made frozen, see
+	// FreezeMounted, is not discarded while it is still mounted. A resize
+	// that discards cannot be rolled back once its commit has started.
+	Discard bool
+	// WipeRemoved, if set, overwrites the original of each partition copied
+	// to a new location once it is removed, with WipeZero or WipeRandom,
+	// for data hygiene when a partition that held sensitive data moves.
+	// Should Discard also be set, the space is discarded once it is wiped.
+	// The source of a copy made frozen, see FreezeMounted, is not wiped
+	// while it is still mounted. A resize that wipes cannot be rolled back
+	// once its commit has started.
+	WipeRemoved WipeMode
+	// IOPriority, if set, is the I/O priority the resize runs at, and the
+	// external tools it runs, as ionice sets it, so that it does not starve
+	// the workloads still running from other partitions or disks. It is set
+	// for the whole process, and kept once the resize is done. Setting it is
+	// best effort: should it fail, as it does but on Linux, it is warned of,
+	// and the resize runs at the priority it has; and only I/O schedulers
+	// such as BFQ and mq-deadline honour it.
+	IOPriority IOPriority
+	// Hooks are run at each HookPoint of the resize, in order, see Hook.
+	// Like Validators, they are not saved in a journal or a plan, so Resume
+	// and Plan.Apply run them only if given them again.
+	Hooks map[HookPoint][]Hook `json:"-"`
+	// Confirm, if set, is asked first whether to go ahead with the resize
+	// as planned, once EventPlanComputed is passed and before anything is
+	// changed, and then before each step of the resize that cannot be
+	// undone, the partition table writes that stage the resize and then
+	// cut over to it, removing the originals, with a description of the
+	// step. Should it return false, the resize stops there with an error
+	// wrapping ErrNotConfirmed; declining the cutover removes the copies
+	// again. Like Hooks, it is not saved in a journal or a plan, so neither
+	// Resume nor a plan read with ReadPlan asks it unless given it again.
+	Confirm func(description string) bool `json:"-"`
+	// Progress, if set, is told of the progress of the resize as it runs:
+	// each phase as it starts and finishes, and each partition copied to a
+	// new location, with the bytes copied so far. Like Validators, it is not
+	// saved in a journal or a plan.
+	Progress ProgressReporter `json:"-"`
+	// Logger, if set, is where the resize logs what it does, rather than
+	// slog.Default(): each step at level Info, steps skipped as unneeded at
+	// Debug, and problems it works around at Warn. Like Progress, it is not
+	// saved in a journal or a plan, so Resume and Rollback log to
+	// slog.Default() unless given it with ResumeWithOptions and
+	// RollbackWithOptions.
+	Logger *slog.Logger `json:"-"`
+	// OnEvent, if set, is passed each Event of the resize, for a caller to
+	// take its own checkpoints or telemetry from. The events of a phase are
+	// passed once the phase is complete, and recorded in the journal if there
+	// is one, so that a checkpoint taken then agrees with it; those of a
+	// phase an earlier run completed are not passed again. EventCopyProgress
+	// is passed as the copy runs. OnEvent is called on the goroutine running
+	// the resize, which waits for it. Like Progress, it is not saved in a
+	// journal or a plan.
+	OnEvent func(Event) `json:"-"`
+	// AuditLog, if set, is a file each write of the partition table is
+	// appended to, one JSON object per line, as a record of the resize kept
+	// apart from the log: the disk and its GUID, the number, name, type and
+	// partition GUIDs, start and size of each partition before and after the
+	// write, those it removed, and when, with AuditReason. Run refuses to
+	// start if it cannot append to it, and fails should a write not be
+	// recorded. Unlike Logger, it is saved in a journal and a plan, so that
+	// Resume, Rollback and Plan.Apply record their writes too.
+	AuditLog string
+	// AuditReason is why the resize is done, as the operator gives it, for
+	// AuditLog.
+	AuditReason string
+	// Throughput is the bytes per second the disk is taken to read and write
+	// at, for the estimate a dry run returns, see Estimate. When 0, it is
+	// measured by reading the start of the disk.
+	Throughput int64
+	// ExecRunner, if set, runs the external tools the resize needs, such as
+	// e2fsck and resize2fs, rather than a LocalExecRunner. Like Logger, it is
+	// not saved in a journal or a plan, so Resume and Rollback run the tools
+	// with a LocalExecRunner unless given it with ResumeWithOptions and
+	// RollbackWithOptions.
+	ExecRunner ExecRunner `json:"-"`
+	// ToolTimeout, if set, is the longest any external tool may run before
+	// it is killed and the resize fails. Killing a tool can leave the
+	// filesystem it was changing damaged, so it is for tools that hang, not
+	// to bound the resize.
+	ToolTimeout time.Duration
+}
+
+// shrinkGranularity returns the effective ShrinkGranularity.
+func (o Options) shrinkGranularity() int64 {
+	if o.ShrinkGranularity <= 0 {
+		return DefaultShrinkGranularity
+	}
+	return o.ShrinkGranularity
+}
+
+// freezeTimeout returns the effective FreezeTimeout.
+func (o Options) freezeTimeout() time.Duration {
+	if o.FreezeTimeout <= 0 {
+		return DefaultFreezeTimeout
+	}
+	return o.FreezeTimeout
+}
+
+// progress returns the effective Progress.
+func (o Options) progress() ProgressReporter {
+	if o.Progress == nil {
+		return nopProgress{}
+	}
+	return o.Progress
+}
+
+// logger returns the effective Logger.
+func (o Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.Default()
+	}
+	return o.Logger
+}
+
+// withUnsaved returns o, options saved in a journal, with what a journal
+// cannot save taken from given: the Validators, Hooks, Confirm, Progress,
+// Logger, OnEvent and ExecRunner.
+func (o Options) withUnsaved(given Options) Options {
+	o.Validators = given.Validators
+	o.Hooks = given.Hooks
+	o.Confirm = given.Confirm
+	o.Progress = given.Progress
+	o.Logger = given.Logger
+	o.OnEvent = given.OnEvent
+	o.ExecRunner = given.ExecRunner
+	return o
+}
+
+// audit returns the audit log to record writes of the partition table in, nil
+// if there is none.
+func (o Options) audit() *auditLog {
+	if o.AuditLog == "" {
+		return nil
+	}
+	return &auditLog{path: o.AuditLog, reason: o.AuditReason}
+}
+
+// emit passes e to OnEvent, if it is set.
+func (o Options) emit(e Event) {
+	if o.OnEvent != nil {
+		o.OnEvent(e)
+	}
+}
+
+// hasShrinkMargin reports whether any shrink margin is configured.
+func (o Options) hasShrinkMargin() bool {
+	return o.ShrinkMargin > 0 || o.ShrinkMarginPercent > 0
+}
+
+// shrinkable returns how many bytes a filesystem with the given usage can give
+// up while keeping the configured shrink margin free inside it.
+func (o Options) shrinkable(usage ext4Usage) int64 {
+	margin := o.ShrinkMargin
+	if pct := int64(float64(usage.size) * o.ShrinkMarginPercent / 100); pct > margin {
+		margin = pct
+	}
+	if usage.free <= margin {
+		return 0
+	}
+	return usage.free - margin
+}
@@ -0,0 +1,25 @@
+package partitionresizer
+
+import "testing"
+
+func TestOptionsShrinkable(t *testing.T) {
+	usage := ext4Usage{size: 1000 * MB, free: 400 * MB}
+	tests := []struct {
+		name string
+		opts Options
+		want int64
+	}{
+		{"no margin", Options{}, 400 * MB},
+		{"absolute", Options{ShrinkMargin: 100 * MB}, 300 * MB},
+		{"percent", Options{ShrinkMarginPercent: 20}, 200 * MB},
+		{"larger of both", Options{ShrinkMargin: 100 * MB, ShrinkMarginPercent: 25}, 150 * MB},
+		{"margin exceeds free", Options{ShrinkMargin: 500 * MB}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.shrinkable(usage); got != tt.want {
+				t.Errorf("shrinkable() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	diskpkg "github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const (
+	// DefaultPlanPath is where a plan deferred to the next boot is kept by default.
+	DefaultPlanPath = "/var/lib/partitionresizer/plan.json"
+	// bootHookName is the name of the initramfs hook and script that apply a
+	// deferred plan
+	bootHookName = "partitionresizer"
+)
+
+// Plan is a resize worked out now, to be applied later: once it has been
+// reviewed and approved, by a person or another system, or early on the next
+// boot when the partitions to resize -- such as the running root -- are not
+// yet in use. Partitions are identified by partition GUID, the disk by its
+// GPT disk GUID, Disk being only where it was when planned, and grow sizes are
+// absolute, so that a plan means the same thing however device names change
+// across the reboot. Partitions records exactly what the resize does to each
+// partition, for review, and Apply refuses to do anything else. DiskGUID and
+// TableChecksum pin the plan to the partition table it was planned against, so
+// that it is not applied to another disk, or to one whose partitions have
+// changed since.
+type Plan struct {
+	Disk          string            `json:"disk"`
+	DiskGUID      string            `json:"diskGUID,omitempty"`
+	TableChecksum string            `json:"tableChecksum,omitempty"`
+	Grow          []PlannedChange   `json:"grow"`
+	Shrink        []PlannedChange   `json:"shrink,omitempty"`
+	Partitions    []PartitionResult `json:"partitions,omitempty"`
+	Options       Options           `json:"options"`
+}
+
+// PlannedChange is one partition of a Plan. For a grow, Size is the final size
+// of the partition in bytes; for a shrink, it is the number of bytes to take
+// from it, should the grows need them. Type is the GPT partition type a grow
+// gives the partition, if any, see WithPartitionType.
+type PlannedChange struct {
+	UUID  string `json:"uuid"`
+	Label string `json:"label,omitempty"`
+	Size  int64  `json:"size"`
+	Type  string `json:"type,omitempty"`
+}
+
+// NewPlan plans the resize Run would perform with the same arguments, without
+// changing anything, and returns it as a Plan to apply later. opts.DryRun is
+// not kept; Plan.Apply takes its own.
+func NewPlan(disk string, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*Plan, error) {
+	d, table, resizes, err := openAndPlan(disk, shrinkPartitions, growPartitions, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Backend.Close() }()
+	checksum, err := tableChecksum(d, table)
+	if err != nil {
+		return nil, err
+	}
+	guids := make(map[int]string)
+	for _, p := range table.Partitions {
+		guids[p.Index] = p.UUID()
+	}
+	opts.DryRun = false
+	plan := &Plan{
+		Disk:          disk,
+		DiskGUID:      table.GUID,
+		TableChecksum: checksum,
+		Partitions:    newResult(disk, resizes, opts.PreserveNumbers).Partitions,
+		Options:       opts,
+	}
+	for _, r := range resizes {
+		change := PlannedChange{UUID: guids[r.original.number], Label: r.original.label}
+		if change.UUID == "" {
+			return nil, fmt.Errorf("partition %d has no partition GUID to identify it by", r.original.number)
+		}
+		if r.target.size < r.original.size {
+			change.Size = r.original.size - r.target.size
+			plan.Shrink = append(plan.Shrink, change)
+			continue
+		}
+		change.Size = r.target.size
+		change.Type = string(r.partitionType)
+		plan.Grow = append(plan.Grow, change)
+	}
+	return plan, nil
+}
+
+// Apply performs the planned resize, as Run, and returns its Result. Should
+// the disk not be the one planned against, or its partition table have
+// changed since, or the resize otherwise not be the one in p.Partitions, it
+// returns a *StalePlanError and changes nothing. A plan saved without these is
+// applied as it is planned now.
+func (p *Plan) Apply(dryRun bool) (*Result, error) {
+	return p.ApplyContext(context.Background(), dryRun)
+}
+
+// ApplyContext is Apply, stopping cleanly should ctx be done, as RunContext.
+func (p *Plan) ApplyContext(ctx context.Context, dryRun bool) (*Result, error) {
+	shrinks, grows := p.changes()
+	opts := p.Options
+	opts.DryRun = dryRun
+	return run(ctx, func(opts Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+		return openAndPlan(p.disk(opts.logger(), "", "/dev"), shrinks, grows, false, opts)
+	}, opts, p, true)
+}
+
+// disk returns the path of the disk p is for. The kernel's name for a disk,
+// as Disk is, can change across a reboot, so should Disk no longer have the
+// GUID p was planned against, the disk that does is found by it, as FindDisk,
+// with sysfs at syspath and the device nodes in devpath. Should none, Disk is
+// returned, for check to refuse.
+func (p *Plan) disk(logger *slog.Logger, syspath, devpath string) string {
+	if p.DiskGUID == "" || strings.EqualFold(readDiskGUID(p.Disk), p.DiskGUID) {
+		return p.Disk
+	}
+	path, err := findDisk(DiskByGUID, p.DiskGUID, syspath, udevDataPath, devpath)
+	if err != nil {
+		return p.Disk
+	}
+	logger.Info("planned disk found under another name", "disk", p.Disk, "path", path, "guid", p.DiskGUID)
+	return path
+}
+
+// check returns a *StalePlanError unless table, the partition table of d,
+// is the one p was planned against, and now, the resize of each partition as
+// planned now, is as planned.
+func (p *Plan) check(d *diskpkg.Disk, table *gpt.Table, now []PartitionResult) error {
+	var reasons []string
+	if p.DiskGUID != "" && p.DiskGUID != table.GUID {
+		reasons = append(reasons, fmt.Sprintf("disk GUID is %s, but the plan is for %s", table.GUID, p.DiskGUID))
+	}
+	if p.TableChecksum != "" {
+		checksum, err := tableChecksum(d, table)
+		if err != nil {
+			return err
+		}
+		if p.TableChecksum != checksum {
+			reasons = append(reasons, "partition table has changed since the plan was made")
+		}
+	}
+	switch {
+	case p.Partitions == nil:
+	case len(p.Partitions) != len(now):
+		reasons = append(reasons, fmt.Sprintf("%d partitions are planned to be resized, but %d would be now", len(p.Partitions), len(now)))
+	default:
+		for i := range p.Partitions {
+			if !reflect.DeepEqual(p.Partitions[i], now[i]) {
+				reasons = append(reasons, fmt.Sprintf("partition %d is planned as %+v, but would be %+v now", p.Partitions[i].Original.Number, p.Partitions[i], now[i]))
+			}
+		}
+	}
+	if len(reasons) > 0 {
+		return NewStalePlanError(d.Backend.Path(), reasons)
+	}
+	return nil
+}
+
+// tableChecksum returns the CRC32 of the partition entry array of table, the
+// GPT of d, in hex, as its primary header records it: the GPT's own checksum
+// of every partition entry, which changes with any change to a partition.
+func tableChecksum(d *diskpkg.Disk, table *gpt.Table) (string, error) {
+	header := make([]byte, 92)
+	if _, err := d.Backend.ReadAt(header, int64(cmp.Or(table.LogicalSectorSize, 512))); err != nil {
+		return "", fmt.Errorf("failed to read GPT header: %v", err)
+	}
+	if !bytes.Equal(header[:8], []byte("EFI PART")) {
+		return "", fmt.Errorf("no primary GPT header to take the partition table checksum from")
+	}
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(header[88:92])), nil
+}
+
+// changes returns the partitions to shrink and grow, as Run takes them.
+func (p *Plan) changes() ([]PartitionIdentifier, []PartitionChange) {
+	var (
+		shrinks []PartitionIdentifier
+		grows   []PartitionChange
+	)
+	for _, s := range p.Shrink {
+		shrinks = append(shrinks, NewRelativePartitionChange(IdentifierByPartUUID, s.UUID, -s.Size))
+	}
+	for _, g := range p.Grow {
+		change := NewPartitionChange(IdentifierByPartUUID, g.UUID, g.Size)
+		if g.Type != "" {
+			change = WithPartitionType(change, g.Type)
+		}
+		grows = append(grows, change)
+	}
+	return shrinks, grows
+}
+
+// WritePlan saves the plan as JSON to path, creating its directory if needed.
+func WritePlan(path string, p *Plan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// ReadPlan loads a plan saved by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlan(data, path)
+}
+
+// DecodePlan reads a plan, as WritePlan saves it, from r, e.g. piped to
+// stdin, as ReadPlan does from a file.
+func DecodePlan(r io.Reader) (*Plan, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlan(data, "from input")
+}
+
+// parsePlan parses data, a plan read from name, as WritePlan saves it.
+func parsePlan(data []byte, name string) (*Plan, error) {
+	var p struct {
+		Plan
+		// a plan saved before FixErrors and PreserveNumbers were options
+		// has them here instead
+		FixErrors       bool `json:"fixErrors"`
+		PreserveNumbers bool `json:"preserveNumbers"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse plan %s: %w", name, err)
+	}
+	p.Options.FixErrors = p.Options.FixErrors || p.FixErrors
+	p.Options.PreserveNumbers = p.Options.PreserveNumbers || p.PreserveNumbers
+	// a plan saved before partitions had their end recorded is not stale
+	// for lacking it
+	for i := range p.Partitions {
+		for _, g := range []*PartitionGeometry{&p.Partitions[i].Original, &p.Partitions[i].Final} {
+			if g.End == 0 && g.Size > 0 {
+				g.End = g.Start + g.Size - 1
+			}
+		}
+	}
+	return &p.Plan, nil
+}
+
+// InitramfsHook returns an initramfs-tools hook script that copies the resizer
+// binary at resizerPath, and the external tools it may run, into the initramfs.
+func InitramfsHook(resizerPath string) string {
+	return `#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case "$1" in
+prereqs) prereqs; exit 0 ;;
+esac
+. /usr/share/initramfs-tools/hook-functions
+copy_exec ` + shellQuote(resizerPath) + ` /sbin/partitionresizer
+for tool in e2fsck fsck.fat resize2fs mkswap swapon swapoff cryptsetup partx xfs_growfs; do
+	path=$(command -v "$tool") && copy_exec "$path"
+done
+exit 0
+`
+}
+
+// InitramfsScript returns an initramfs-tools local-bottom boot script that
+// applies the plan at planPath, on the root filesystem, once the root has been
+// found and mounted read-only but before the system is started from it. It
+// unmounts the root, applies the plan, and mounts it again. The plan is then
+// removed from the root, or kept as planPath.failed if it could not be applied,
+// so that it is tried only once.
+func InitramfsScript(planPath string) string {
+	return `#!/bin/sh
+PREREQ=""
+prereqs() { echo "$PREREQ"; }
+case "$1" in
+prereqs) prereqs; exit 0 ;;
+esac
+. /scripts/functions
+plan="${rootmnt}"` + shellQuote(planPath) + `
+[ -f "$plan" ] || exit 0
+cp "$plan" /run/partitionresizer-plan.json || exit 0
+if ! umount "${rootmnt}"; then
+	log_failure_msg "partitionresizer: cannot unmount root, not resizing"
+	exit 0
+fi
+log_begin_msg "partitionresizer: applying deferred resize"
+/sbin/partitionresizer --apply-plan /run/partitionresizer-plan.json
+result=$?
+log_end_msg
+# the root partition may have moved
+if command -v udevadm >/dev/null; then
+	udevadm trigger --subsystem-match=block
+	udevadm settle
+fi
+mount -r ${ROOTFSTYPE:+-t "${ROOTFSTYPE}"} ${ROOTFLAGS} "${ROOT}" "${rootmnt}" || panic "partitionresizer: cannot mount root again"
+mount -o remount,rw "${rootmnt}" || exit 0
+if [ "$result" -eq 0 ]; then
+	rm -f "$plan"
+else
+	mv -f "$plan" "$plan.failed"
+fi
+mount -o remount,ro "${rootmnt}"
+exit 0
+`
+}
+
+// InstallBootHook installs the InitramfsHook and InitramfsScript into the
+// initramfs-tools configuration under root, normally "/". The initramfs must be
+// rebuilt, e.g. with update-initramfs -u, for them to take effect.
+func InstallBootHook(root, resizerPath, planPath string) error {
+	base := filepath.Join(root, "etc", "initramfs-tools")
+	files := map[string]string{
+		filepath.Join(base, "hooks", bootHookName):                   InitramfsHook(resizerPath),
+		filepath.Join(base, "scripts", "local-bottom", bootHookName): InitramfsScript(planPath),
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote returns s quoted for a POSIX shell, as a single word that
+// nothing in it is expanded in.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
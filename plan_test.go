@@ -0,0 +1,290 @@
+package partitionresizer
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestNewPlan verifies that a plan identifies the grown partition by its GUID,
+// with its resolved absolute size, so that applying it again does not grow
+// the partition again, and survives a write and read unchanged.
+func TestNewPlan(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: 1 * MB / sectorSize, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	_ = backend.Close()
+	guid := table.Partitions[0].UUID()
+	if guid == "" {
+		t.Fatal("partition has no GUID")
+	}
+
+	grow := []PartitionChange{NewRelativePartitionChange(IdentifierByLabel, "data", 4*MB)}
+	plan, err := NewPlan(diskPath, nil, grow, Options{FixErrors: true, OnlineGrow: true})
+	if err != nil {
+		t.Fatalf("NewPlan() error: %v", err)
+	}
+	want := []PlannedChange{{UUID: guid, Label: "data", Size: 12 * MB}}
+	if !reflect.DeepEqual(plan.Grow, want) || len(plan.Shrink) != 0 {
+		t.Fatalf("NewPlan() grow = %+v, shrink = %+v, want grow %+v", plan.Grow, plan.Shrink, want)
+	}
+	if _, grows := plan.changes(); len(grows) != 1 || grows[0].Mode() != SizeAbsolute || grows[0].Size() != 12*MB {
+		t.Errorf("Plan.changes() = %+v, want the grow to an absolute %d bytes", grows, 12*MB)
+	}
+	if plan.Disk != diskPath || !plan.Options.FixErrors || !plan.Options.OnlineGrow {
+		t.Errorf("NewPlan() = %+v, want disk %s, fixErrors and OnlineGrow kept", plan, diskPath)
+	}
+	// with no filesystem to grow online, copied into the free space after it
+	wantPartitions := []PartitionResult{{
+		Label:    "data",
+		Original: PartitionGeometry{Number: 1, Start: 1 * MB, End: 9*MB - 1, Size: 8 * MB},
+		Final:    PartitionGeometry{Number: 2, Start: 9 * MB, End: 21*MB - 1, Size: 12 * MB},
+		Moved:    true,
+	}}
+	if !reflect.DeepEqual(plan.Partitions, wantPartitions) {
+		t.Errorf("NewPlan() partitions = %+v, want %+v", plan.Partitions, wantPartitions)
+	}
+
+	planPath := filepath.Join(t.TempDir(), "state", "plan.json")
+	if err := WritePlan(planPath, plan); err != nil {
+		t.Fatalf("WritePlan() error: %v", err)
+	}
+	read, err := ReadPlan(planPath)
+	if err != nil {
+		t.Fatalf("ReadPlan() error: %v", err)
+	}
+	if !reflect.DeepEqual(read, plan) {
+		t.Errorf("ReadPlan() = %+v, want %+v", read, plan)
+	}
+	f, err := os.Open(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if decoded, err := DecodePlan(f); err != nil || !reflect.DeepEqual(decoded, plan) {
+		t.Errorf("DecodePlan() = %+v, %v, want %+v", decoded, err, plan)
+	}
+}
+
+func TestInstallBootHook(t *testing.T) {
+	root := t.TempDir()
+	if err := InstallBootHook(root, "/usr/sbin/resizer", DefaultPlanPath); err != nil {
+		t.Fatalf("InstallBootHook() error: %v", err)
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"etc/initramfs-tools/hooks/partitionresizer", []string{"copy_exec '/usr/sbin/resizer' /sbin/partitionresizer", "resize2fs"}},
+		{"etc/initramfs-tools/scripts/local-bottom/partitionresizer", []string{
+			`plan="${rootmnt}"'` + DefaultPlanPath + `'`,
+			`umount "${rootmnt}"`,
+			"/sbin/partitionresizer --apply-plan /run/partitionresizer-plan.json",
+		}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(root, tt.path)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0o111 == 0 {
+			t.Errorf("%s is not executable", tt.path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(data), w) {
+				t.Errorf("%s does not contain %q", tt.path, w)
+			}
+		}
+	}
+
+	// a path with a space, a quote or a $ in it is one word, expanded nowhere
+	if got, want := InitramfsScript("/var/lib/it's a $plan"), `plan="${rootmnt}"'/var/lib/it'\''s a $plan'`; !strings.Contains(got, want) {
+		t.Errorf("InitramfsScript() does not contain %q", want)
+	}
+}
+
+func TestReadPlanInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPlan(path); err == nil {
+		t.Error("ReadPlan() of invalid plan returned no error")
+	}
+}
+
+// TestReadPlanLegacy reads a plan saved with fixErrors and preserveNumbers
+// beside its options, as they were before they became options, and partitions
+// without their end.
+func TestReadPlanLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	data := `{"disk": "/dev/sda", "grow": [{"uuid": "5CA3360B-5DE6-4FCF-B4CE-419CEE433B51", "size": 1048576}], "partitions": [{"label": "data", "original": {"number": 1, "start": 1048576, "size": 1048576}, "final": {"number": 1, "start": 1048576, "size": 2097152}}], "fixErrors": true, "preserveNumbers": true, "options": {"OnlineGrow": true}}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ReadPlan(path)
+	if err != nil {
+		t.Fatalf("ReadPlan() error: %v", err)
+	}
+	if want := (Options{FixErrors: true, PreserveNumbers: true, OnlineGrow: true}); !reflect.DeepEqual(plan.Options, want) {
+		t.Errorf("ReadPlan() options = %+v, want %+v", plan.Options, want)
+	}
+	if p := plan.Partitions[0]; p.Original.End != 2*MB-1 || p.Final.End != 3*MB-1 {
+		t.Errorf("ReadPlan() partition = %+v, want the ends of its geometry filled in", p)
+	}
+}
+
+// TestPlanApplyStale applies a plan, as a dry run, to the disk it was planned
+// for, as if for another disk, and again after its partitions were changed:
+// the last two must be refused.
+func TestPlanApplyStale(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: 1 * MB / sectorSize, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+
+	grow := []PartitionChange{NewPartitionChange(IdentifierByLabel, "data", 16*MB)}
+	plan, err := NewPlan(diskPath, nil, grow, Options{})
+	if err != nil {
+		t.Fatalf("NewPlan() error: %v", err)
+	}
+	res, err := plan.Apply(true)
+	if err != nil {
+		t.Fatalf("Apply() error: %v", err)
+	}
+	if !res.DryRun || !reflect.DeepEqual(res.Partitions, plan.Partitions) {
+		t.Errorf("Apply() = %+v, want a dry run of %+v", res, plan.Partitions)
+	}
+	if plan.DiskGUID == "" || len(plan.TableChecksum) != 8 {
+		t.Errorf("NewPlan() = %+v, want it pinned to the disk GUID and the CRC32 of the partition entries", plan)
+	}
+
+	// a plan for another disk
+	other := *plan
+	other.DiskGUID = "00000000-0000-0000-0000-000000000001"
+	var stale *StalePlanError
+	if _, err := other.Apply(true); !errors.As(err, &stale) {
+		t.Fatalf("Apply() of plan for another disk error = %v, want a *StalePlanError", err)
+	}
+	if len(stale.Reasons) != 1 || !strings.Contains(stale.Reasons[0], "disk GUID") {
+		t.Errorf("Apply() of plan for another disk reasons = %q, want one for the disk GUID", stale.Reasons)
+	}
+
+	// the disk, given another name across a reboot, is found by its GUID
+	sys, dev := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sys, "class", "block", "sdy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(diskPath, filepath.Join(dev, "sdy")); err != nil {
+		t.Fatal(err)
+	}
+	moved := *plan
+	moved.Disk = filepath.Join(dev, "sdx")
+	if got := moved.disk(slog.Default(), sys, dev); got != filepath.Join(dev, "sdy") {
+		t.Errorf("Plan.disk() = %s, want the disk with its GUID, %s", got, filepath.Join(dev, "sdy"))
+	}
+	if got := other.disk(slog.Default(), sys, dev); got != other.Disk {
+		t.Errorf("Plan.disk() of plan for another disk = %s, want %s", got, other.Disk)
+	}
+
+	// a partition now takes the space the grown one was to be copied to, so
+	// it would be copied elsewhere
+	table.Partitions = append(table.Partitions, &gpt.Partition{Index: 2, Start: 10 * MB / sectorSize, Size: 4 * MB, Type: gpt.LinuxFilesystem, Name: "other"})
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plan.Apply(true); !errors.As(err, &stale) {
+		t.Fatalf("Apply() of stale plan error = %v, want a *StalePlanError", err)
+	}
+	if len(stale.Reasons) != 2 || !strings.Contains(stale.Reasons[0], "partition table") || !strings.Contains(stale.Reasons[1], "partition 1") {
+		t.Errorf("Apply() of stale plan reasons = %q, want the partition table and partition 1", stale.Reasons)
+	}
+}
+
+// TestNewPlanError verifies that a resize that cannot be planned returns a
+// *PlanError, wrapping an *InsufficientSpaceError should the grow not fit.
+func TestNewPlanError(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+	})
+	for _, tt := range []struct {
+		name      string
+		grow      PartitionChange
+		wantSpace bool
+	}{
+		{"not found", NewPartitionChange(IdentifierByLabel, "home", 16*MB), false},
+		{"too big", NewPartitionChange(IdentifierByLabel, "data", 1*GB), true},
+	} {
+		_, err := NewPlan(diskPath, nil, []PartitionChange{tt.grow}, Options{})
+		var (
+			planErr  *PlanError
+			spaceErr *InsufficientSpaceError
+		)
+		if !errors.As(err, &planErr) {
+			t.Errorf("%s: NewPlan() error = %v, want a *PlanError", tt.name, err)
+		}
+		if got := errors.As(err, &spaceErr); got != tt.wantSpace {
+			t.Errorf("%s: NewPlan() error = %v, an *InsufficientSpaceError: %t, want %t", tt.name, err, got, tt.wantSpace)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package partitionresizer
 
 import (
+	"context"
 	"errors"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/diskfs/go-diskfs"
@@ -63,11 +67,11 @@ func TestCheckSourceFilesystems(t *testing.T) {
 		origE, origF := execE2fsck, execFsckFat
 		defer func() { execE2fsck, execFsckFat = origE, origF }()
 		var e2fsckCalls, fatCalls int
-		execE2fsck = func(string, bool) error { e2fsckCalls++; return nil }
-		execFsckFat = func(string, bool) error { fatCalls++; return nil }
+		execE2fsck = func(context.Context, string, bool) error { e2fsckCalls++; return nil }
+		execFsckFat = func(context.Context, string, bool) error { fatCalls++; return nil }
 
 		resizes := []partitionResizeTarget{{original: ext4, target: partitionData{number: 99}}}
-		if err := checkSourceFilesystems(d, resizes, false); err != nil {
+		if err := checkSourceFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("checkSourceFilesystems: %v", err)
 		}
 		if e2fsckCalls != 1 {
@@ -85,10 +89,10 @@ func TestCheckSourceFilesystems(t *testing.T) {
 		origE := execE2fsck
 		defer func() { execE2fsck = origE }()
 		sentinel := errors.New("e2fsck failed: exit status 4")
-		execE2fsck = func(string, bool) error { return sentinel }
+		execE2fsck = func(context.Context, string, bool) error { return sentinel }
 
 		resizes := []partitionResizeTarget{{original: ext4, target: partitionData{number: 99}}}
-		err := checkSourceFilesystems(d, resizes, false)
+		err := checkSourceFilesystems(context.Background(), slog.Default(), d, resizes, false)
 		if err == nil {
 			t.Fatal("expected error from an inconsistent source, got nil")
 		}
@@ -104,11 +108,11 @@ func TestCheckSourceFilesystems(t *testing.T) {
 		origE, origF := execE2fsck, execFsckFat
 		defer func() { execE2fsck, execFsckFat = origE, origF }()
 		var e2fsckCalls, fatCalls int
-		execE2fsck = func(string, bool) error { e2fsckCalls++; return nil }
-		execFsckFat = func(string, bool) error { fatCalls++; return nil }
+		execE2fsck = func(context.Context, string, bool) error { e2fsckCalls++; return nil }
+		execFsckFat = func(context.Context, string, bool) error { fatCalls++; return nil }
 
 		resizes := []partitionResizeTarget{{original: src, target: partitionData{number: 99}}}
-		if err := checkSourceFilesystems(d, resizes, false); err != nil {
+		if err := checkSourceFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("checkSourceFilesystems: %v", err)
 		}
 		if fatCalls != 1 {
@@ -126,11 +130,11 @@ func TestCheckSourceFilesystems(t *testing.T) {
 		origE, origF := execE2fsck, execFsckFat
 		defer func() { execE2fsck, execFsckFat = origE, origF }()
 		var e2fsckCalls, fatCalls int
-		execE2fsck = func(string, bool) error { e2fsckCalls++; return nil }
-		execFsckFat = func(string, bool) error { fatCalls++; return nil }
+		execE2fsck = func(context.Context, string, bool) error { e2fsckCalls++; return nil }
+		execFsckFat = func(context.Context, string, bool) error { fatCalls++; return nil }
 
 		resizes := []partitionResizeTarget{{original: src, target: partitionData{number: 99}}}
-		if err := checkSourceFilesystems(d, resizes, false); err != nil {
+		if err := checkSourceFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("checkSourceFilesystems should skip squashfs, got error: %v", err)
 		}
 		if e2fsckCalls != 0 || fatCalls != 0 {
@@ -254,3 +258,33 @@ func newSquashfsSourceDisk(t *testing.T) (*disk.Disk, partitionData, func()) {
 	pd := partitionData{number: 1, start: sourceStart * sectorSize, size: sourceSize, label: "source"}
 	return d, pd, func() { _ = bk.Close() }
 }
+
+func TestCheckResizedFilesystems(t *testing.T) {
+	d, ext4, cleanup := openFixtureExt4(t)
+	defer cleanup()
+
+	origE, origF := execE2fsck, execFsckFat
+	defer func() { execE2fsck, execFsckFat = origE, origF }()
+	var e2fsckCalls int
+	var fixed bool
+	execE2fsck = func(_ context.Context, _ string, fixErrors bool) error { e2fsckCalls++; fixed = fixErrors; return nil }
+	execFsckFat = func(context.Context, string, bool) error { t.Error("fsck.fat run on an ext4 filesystem"); return nil }
+
+	// grown in place, so original and target share a start
+	grown := ext4
+	grown.size += 1 * MB
+	resizes := []partitionResizeTarget{{original: ext4, target: grown}}
+	checks := checkResizedFilesystems(context.Background(), slog.Default(), d, resizes, false, false)
+	if want := []CheckResult{{Partition: ext4.number, Filesystem: "ext4", Outcome: CheckPassed}}; !reflect.DeepEqual(checks, want) {
+		t.Errorf("checkResizedFilesystems() = %+v, want %+v", checks, want)
+	}
+	if e2fsckCalls != 1 || fixed {
+		t.Errorf("e2fsck calls = %d, repairing = %v, want 1 read-only call", e2fsckCalls, fixed)
+	}
+
+	execE2fsck = func(context.Context, string, bool) error { return errors.New("e2fsck failed: exit status 4") }
+	checks = checkResizedFilesystems(context.Background(), slog.Default(), d, resizes, false, false)
+	if len(checks) != 1 || checks[0].Outcome != CheckFailed || !strings.Contains(checks[0].problem(), "(ext4): e2fsck failed: exit status 4") {
+		t.Errorf("checkResizedFilesystems() of a damaged filesystem = %+v, want its e2fsck error", checks)
+	}
+}
@@ -0,0 +1,123 @@
+package partitionresizer
+
+import (
+	"sync"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// ProgressReporter is told of the progress of a resize as it runs, so that a
+// caller embedding the resizer can show it in its own interface, see
+// Options.Progress. Its methods are called one at a time, from the goroutine
+// running the resize or, for partitions copied concurrently, see
+// Options.CopyWorkers, from the goroutine copying each, and should return
+// promptly.
+type ProgressReporter interface {
+	// PhaseStarted is called as a phase of the resize starts, one of the
+	// Phase constants. A phase an interrupted resize already completed is
+	// skipped when it is resumed, and not reported.
+	PhaseStarted(phase string)
+	// PhaseFinished is called as a phase of the resize ends, with the error
+	// it failed with, if any.
+	PhaseFinished(phase string, err error)
+	// CopyStarted is called as the copy of a partition to its new location
+	// starts: partition is its number, the nth of total partitions to copy.
+	CopyStarted(partition, n, total int)
+	// BytesCopied reports that copied of the total bytes of partition have
+	// been copied, as the copy goes. A partition copied file by file, e.g.
+	// ext4 or FAT32, reports the file data written so far, which falls short
+	// of the size of the partition, then all of it once its copy is done.
+	BytesCopied(partition int, copied, total int64)
+}
+
+// TotalProgressReporter is implemented by a ProgressReporter that is also to
+// be told the bytes copied of all the partitions to copy, in all, e.g. to show
+// one bar for partitions copied concurrently, see Options.CopyWorkers.
+type TotalProgressReporter interface {
+	// TotalBytesCopied reports, each time BytesCopied is called, that
+	// copied of the total bytes of all the partitions to copy have been
+	// copied. Swap, recreated rather than copied, is not counted.
+	TotalBytesCopied(copied, total int64)
+}
+
+// reportTotal tells progress of the bytes copied in all, should it be a
+// TotalProgressReporter.
+func reportTotal(progress ProgressReporter, copied, total int64) {
+	if t, ok := progress.(TotalProgressReporter); ok {
+		t.TotalBytesCopied(copied, total)
+	}
+}
+
+// DigestReporter is implemented by a ProgressReporter that is also to be told
+// the digests of each partition copied byte for byte and verified in full,
+// see VerifyFull.
+type DigestReporter interface {
+	// CopyDigests reports the SHA-256 digests, in hex, of the copy of
+	// partition, one for each stripe it was copied in, see
+	// Options.CopyStreams, in order; the copy matched its source.
+	CopyDigests(partition int, digests []string)
+}
+
+// reportDigests tells progress of the digests of the copy of partition,
+// should it be a DigestReporter.
+func reportDigests(progress ProgressReporter, partition int, digests []string) {
+	if r, ok := progress.(DigestReporter); ok {
+		r.CopyDigests(partition, digests)
+	}
+}
+
+// copyTotals is a ProgressReporter for the copy phase that passes the
+// progress of each copy on to the ProgressReporter it embeds one call at a
+// time, as the copies may run concurrently, with the bytes copied of them all,
+// see TotalProgressReporter.
+type copyTotals struct {
+	ProgressReporter
+	mu     sync.Mutex
+	copied map[int]int64
+	total  int64
+}
+
+// newCopyTotals returns the copyTotals passing on to progress the progress of
+// copies, the partitions of d to copy.
+func newCopyTotals(progress ProgressReporter, d *disk.Disk, copies []partitionResizeTarget) *copyTotals {
+	p := &copyTotals{ProgressReporter: progress, copied: make(map[int]int64)}
+	for _, r := range copies {
+		if _, isSwap, err := readSwapHeader(d.Backend, r.original.start); err == nil && isSwap {
+			continue
+		}
+		p.total += r.original.size
+	}
+	return p
+}
+
+func (p *copyTotals) CopyStarted(partition, n, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ProgressReporter.CopyStarted(partition, n, total)
+}
+
+func (p *copyTotals) BytesCopied(partition int, copied, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ProgressReporter.BytesCopied(partition, copied, total)
+	p.copied[partition] = copied
+	var sum int64
+	for _, c := range p.copied {
+		sum += c
+	}
+	reportTotal(p.ProgressReporter, sum, p.total)
+}
+
+func (p *copyTotals) CopyDigests(partition int, digests []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reportDigests(p.ProgressReporter, partition, digests)
+}
+
+// nopProgress is the ProgressReporter used when Options.Progress is nil.
+type nopProgress struct{}
+
+func (nopProgress) PhaseStarted(string)           {}
+func (nopProgress) PhaseFinished(string, error)   {}
+func (nopProgress) CopyStarted(int, int, int)     {}
+func (nopProgress) BytesCopied(int, int64, int64) {}
@@ -0,0 +1,198 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// recordingProgress records what it is told, one line per call.
+type recordingProgress struct {
+	events []string
+	copied []int64
+}
+
+func (p *recordingProgress) PhaseStarted(phase string) {
+	p.events = append(p.events, "start "+phase)
+}
+
+func (p *recordingProgress) PhaseFinished(phase string, err error) {
+	p.events = append(p.events, fmt.Sprintf("finish %s %v", phase, err))
+}
+
+func (p *recordingProgress) CopyStarted(partition, n, total int) {
+	p.events = append(p.events, fmt.Sprintf("copy %d %d/%d", partition, n, total))
+}
+
+func (p *recordingProgress) BytesCopied(partition int, copied, total int64) {
+	p.copied = append(p.copied, copied)
+	if copied == total {
+		p.events = append(p.events, fmt.Sprintf("copied %d %d", partition, total))
+	}
+}
+
+func TestResizeProgress(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := &recordingProgress{}
+	if err := resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, Options{Progress: progress}, nil, nil); err != nil {
+		t.Fatalf("resize() error: %v", err)
+	}
+	var want []string
+	for _, phase := range []string{PhaseShrinkFilesystems, PhasePreparePartitions, PhaseCopy, PhaseValidate, PhaseCommitPartitions, PhaseGrowFilesystems, PhaseCheckFilesystems} {
+		want = append(want, "start "+phase)
+		if phase == PhaseCopy {
+			want = append(want, "copy 1 1/1", fmt.Sprintf("copied 1 %d", original.size))
+		}
+		want = append(want, fmt.Sprintf("finish %s <nil>", phase))
+	}
+	if !reflect.DeepEqual(progress.events, want) {
+		t.Errorf("progress reported %q, want %q", progress.events, want)
+	}
+	// 8 MB is copied in two buffers
+	if want := []int64{copyBufSize, 2 * copyBufSize}; !reflect.DeepEqual(progress.copied, want) {
+		t.Errorf("bytes copied reported %v, want %v", progress.copied, want)
+	}
+}
+
+// The resize logs to Options.Logger, with the partitions as attributes
+func TestResizeLogger(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	if err := resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, Options{Logger: logger}, nil, nil); err != nil {
+		t.Fatalf("resize() error: %v", err)
+	}
+	var copying bool
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		var record struct {
+			Msg       string
+			Partition int `json:"partition"`
+			Target    int `json:"target"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if record.Msg == "copying partition" {
+			copying = record.Partition == 1 && record.Target == 2
+		}
+	}
+	if !copying {
+		t.Errorf("no record of copying partition 1 to 2 in:\n%s", out.String())
+	}
+}
+
+// totalProgress is a recordingProgress that also records the bytes copied
+// of all the partitions.
+type totalProgress struct {
+	recordingProgress
+	totals []int64
+	total  int64
+}
+
+func (p *totalProgress) TotalBytesCopied(copied, total int64) {
+	p.totals = append(p.totals, copied)
+	p.total = total
+}
+
+// With CopyWorkers, partitions are copied concurrently, and the bytes copied
+// of all of them reported as they go
+func TestResizeCopyWorkers(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	var (
+		resizes    []partitionResizeTarget
+		partitions []*gpt.Partition
+	)
+	for i := range 3 {
+		original := partitionData{number: i + 1, label: fmt.Sprintf("data%d", i+1), start: int64(1+4*i) * MB, size: 4 * MB}
+		original.end = original.start + original.size - 1
+		target := partitionData{number: i + 4, label: getAlternateLabel(original.label), start: int64(20+8*i) * MB, size: 8 * MB}
+		target.end = target.start + target.size - 1
+		resizes = append(resizes, partitionResizeTarget{original: original, target: target})
+		partitions = append(partitions, &gpt.Partition{Index: original.number, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label})
+	}
+	writeTestTable(t, diskPath, 64*MB, partitions)
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range resizes {
+		if _, err := w.WriteAt(bytes.Repeat([]byte{byte(r.original.number)}, int(r.original.size)), r.original.start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress := &totalProgress{}
+	if err := resize(context.Background(), d, resizes, false, false, Options{Progress: progress, CopyWorkers: 3}, nil, nil); err != nil {
+		t.Fatalf("resize() error: %v", err)
+	}
+	var copies int
+	for _, e := range progress.events {
+		if strings.HasPrefix(e, "copied ") {
+			copies++
+		}
+	}
+	if copies != 3 {
+		t.Errorf("progress reported %d copies done, want 3: %q", copies, progress.events)
+	}
+	if n := len(progress.totals); progress.total != 12*MB || n == 0 || progress.totals[n-1] != 12*MB {
+		t.Errorf("total bytes copied reported %v of %d, want 12M of 12M last", progress.totals, progress.total)
+	}
+	for _, r := range resizes {
+		buf := make([]byte, r.original.size)
+		if _, err := backend.ReadAt(buf, r.target.start); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, bytes.Repeat([]byte{byte(r.original.number)}, len(buf))) {
+			t.Errorf("partition %d not copied to %d", r.original.number, r.target.start)
+		}
+	}
+}
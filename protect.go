@@ -0,0 +1,110 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// protectedPartitions returns the numbers of the partitions among parts that
+// excluded identifies, see Options.ExcludePartitions, each with the
+// identifier that protects it, and the identifiers that identify none of
+// them.
+func protectedPartitions(parts []partitionData, excluded []PartitionIdentifier) (map[int]string, []PartitionIdentifier) {
+	protected := make(map[int]string)
+	var unmatched []PartitionIdentifier
+	for _, pi := range excluded {
+		matched := false
+		for _, p := range parts {
+			if p.matches(pi) {
+				protected[p.number] = fmt.Sprintf("%s=%s", pi.By(), pi.Value())
+				matched = true
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, pi)
+		}
+	}
+	return protected, unmatched
+}
+
+// checkProtected returns a *ProtectedPartitionError should any of resizes of
+// disk shrink, grow, move, renumber or remove a partition that
+// opts.ExcludePartitions protects, among parts. An excluded identifier that
+// is not found on the disk is likely mistyped, so protects nothing it was
+// meant to: it is a *PlanError.
+func checkProtected(disk string, parts []partitionData, resizes []partitionResizeTarget, excluded []PartitionIdentifier) error {
+	protected, unmatched := protectedPartitions(parts, excluded)
+	if len(unmatched) > 0 {
+		return NewPlanError(disk, fmt.Errorf("excluded partition %s=%s not found on disk %s", unmatched[0].By(), unmatched[0].Value(), disk))
+	}
+	var touched []string
+	for _, r := range resizes {
+		if by, ok := protected[r.original.number]; ok {
+			touched = append(touched, fmt.Sprintf("partition %d (%s), excluded as %s", r.original.number, r.original.label, by))
+		}
+	}
+	if len(touched) == 0 {
+		return nil
+	}
+	slices.Sort(touched)
+	return NewProtectedPartitionError(disk, touched)
+}
+
+// bootPartitionTypes are the GPT partition types firmware or a boot loader
+// relies on, by the name of each: the ESP and BIOS boot partition, and the
+// *-boot types. Firmware and boot loaders find these by location or number as
+// much as by type, so shrinking, moving or renumbering one can leave the
+// system unable to boot.
+var bootPartitionTypes = map[gpt.Type]string{
+	gpt.EFISystemPartition:  "EFI system",
+	gpt.BIOSBoot:            "BIOS boot",
+	gpt.LinuxExtendedBoot:   "Linux extended boot",
+	gpt.AppleBoot:           "Apple boot",
+	gpt.FreeBSDBoot:         "FreeBSD boot",
+	gpt.MidnightBSDBoot:     "MidnightBSD boot",
+	gpt.SolarisBoot:         "Solaris boot",
+	gpt.SonyBootPartition:   "Sony boot",
+	gpt.LenovoBootPartition: "Lenovo boot",
+	gpt.PowerPCPRePBoot:     "PowerPC PReP boot",
+	gpt.ONIEBoot:            "ONIE boot",
+}
+
+// bootPartitionType returns the name of partition type t, and whether it is
+// a boot partition type, see bootPartitionTypes.
+func bootPartitionType(t gpt.Type) (string, bool) {
+	name, ok := bootPartitionTypes[gpt.Type(strings.ToUpper(string(t)))]
+	return name, ok
+}
+
+// checkBootPartitions returns a *BootPartitionError should any of resizes of
+// disk shrink, move or renumber a partition of table of a boot partition type,
+// unless force is set, see Options.ForceBootPartitions, in which case it warns
+// of each instead. Growing one in place leaves it where the firmware expects
+// it, so is allowed.
+func checkBootPartitions(logger *slog.Logger, disk string, table *gpt.Table, resizes []partitionResizeTarget, force bool) error {
+	types := make(map[int]gpt.Type)
+	for _, p := range table.Partitions {
+		types[p.Index] = p.Type
+	}
+	var touched []string
+	for _, r := range resizes {
+		name, ok := bootPartitionType(types[r.original.number])
+		if !ok || r.target.start == r.original.start && r.target.number == r.original.number && r.target.size >= r.original.size {
+			continue
+		}
+		if force {
+			logger.Warn("changing boot partition, the system may not boot until its firmware and boot loader are updated to find it", "disk", disk, "partition", r.original.number, "label", r.original.label, "type", name)
+			continue
+		}
+		touched = append(touched, fmt.Sprintf("partition %d (%s), of type %s", r.original.number, r.original.label, name))
+	}
+	if len(touched) == 0 {
+		return nil
+	}
+	slices.Sort(touched)
+	return NewBootPartitionError(disk, touched)
+}
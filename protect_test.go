@@ -0,0 +1,91 @@
+package partitionresizer
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestCheckProtected refuses a plan that would shrink the ESP or grow the
+// recovery partition when either is excluded, lets through one that touches
+// neither, and refuses an exclusion not found on the disk.
+func TestCheckProtected(t *testing.T) {
+	parts := []partitionData{
+		{number: 1, name: "sda1", label: "EFI System", fsLabel: "ESP"},
+		{number: 2, name: "sda2", label: "recovery"},
+		{number: 3, name: "sda3", label: "root"},
+		{number: 4, name: "sda4", label: "data"},
+	}
+	esp := NewPartitionIdentifier(IdentifierByFSLabel, "ESP")
+	recovery := NewPartitionIdentifier(IdentifierByLabel, "recovery")
+	missing := NewPartitionIdentifier(IdentifierByLabel, "nope")
+
+	protected, unmatched := protectedPartitions(parts, []PartitionIdentifier{esp, recovery, missing})
+	if want := map[int]string{1: "fslabel=ESP", 2: "label=recovery"}; !reflect.DeepEqual(protected, want) {
+		t.Errorf("protectedPartitions() protected = %v, want %v", protected, want)
+	}
+	if !reflect.DeepEqual(unmatched, []PartitionIdentifier{missing}) {
+		t.Errorf("protectedPartitions() unmatched = %v, want %v", unmatched, []PartitionIdentifier{missing})
+	}
+
+	resizes := []partitionResizeTarget{{original: parts[3]}, {original: parts[1]}, {original: parts[0]}}
+	err := checkProtected("/dev/sda", parts, resizes, []PartitionIdentifier{esp, recovery})
+	var protErr *ProtectedPartitionError
+	if !errors.As(err, &protErr) {
+		t.Fatalf("checkProtected() error = %v, want a *ProtectedPartitionError", err)
+	}
+	want := []string{"partition 1 (EFI System), excluded as fslabel=ESP", "partition 2 (recovery), excluded as label=recovery"}
+	if protErr.Disk != "/dev/sda" || !reflect.DeepEqual(protErr.Partitions, want) {
+		t.Errorf("checkProtected() error = %+v, want partitions %v of /dev/sda", protErr, want)
+	}
+
+	if err := checkProtected("/dev/sda", parts, resizes[:1], []PartitionIdentifier{esp, recovery}); err != nil {
+		t.Errorf("checkProtected() of a plan touching no excluded partition: %v", err)
+	}
+	err = checkProtected("/dev/sda", parts, resizes[:1], []PartitionIdentifier{esp, recovery, missing})
+	var planErr *PlanError
+	if !errors.As(err, &planErr) || !strings.Contains(err.Error(), "label=nope") {
+		t.Errorf("checkProtected() of an exclusion not on the disk error = %v, want a *PlanError naming it", err)
+	}
+}
+
+// TestCheckBootPartitions refuses a plan that would move the ESP or shrink the
+// BIOS boot partition, but not one that grows the ESP in place, and lets the
+// move through with force.
+func TestCheckBootPartitions(t *testing.T) {
+	table := &gpt.Table{Partitions: []*gpt.Partition{
+		{Index: 1, Type: gpt.EFISystemPartition, Name: "EFI System"},
+		{Index: 2, Type: gpt.Type(strings.ToLower(string(gpt.BIOSBoot))), Name: "bios"},
+		{Index: 3, Type: gpt.LinuxFilesystem, Name: "root"},
+	}}
+	esp := partitionData{number: 1, label: "EFI System", start: 1 * MB, size: 100 * MB}
+	bios := partitionData{number: 2, label: "bios", start: 101 * MB, size: 2 * MB}
+	root := partitionData{number: 3, label: "root", start: 103 * MB, size: 1 * GB}
+	moved := esp
+	moved.number, moved.start, moved.size = 4, 2*GB, 200*MB
+	shrunk := bios
+	shrunk.size = 1 * MB
+	grown := esp
+	grown.size = 200 * MB
+	resizes := []partitionResizeTarget{{original: root, target: root}, {original: esp, target: moved}, {original: bios, target: shrunk}}
+
+	err := checkBootPartitions(slog.Default(), "/dev/sda", table, resizes, false)
+	var bootErr *BootPartitionError
+	if !errors.As(err, &bootErr) {
+		t.Fatalf("checkBootPartitions() error = %v, want a *BootPartitionError", err)
+	}
+	want := []string{"partition 1 (EFI System), of type EFI system", "partition 2 (bios), of type BIOS boot"}
+	if bootErr.Disk != "/dev/sda" || !reflect.DeepEqual(bootErr.Partitions, want) {
+		t.Errorf("checkBootPartitions() error = %+v, want partitions %v of /dev/sda", bootErr, want)
+	}
+	if err := checkBootPartitions(slog.Default(), "/dev/sda", table, resizes, true); err != nil {
+		t.Errorf("checkBootPartitions() with force: %v", err)
+	}
+	if err := checkBootPartitions(slog.Default(), "/dev/sda", table, []partitionResizeTarget{{original: esp, target: grown}}, false); err != nil {
+		t.Errorf("checkBootPartitions() of the ESP grown in place: %v", err)
+	}
+}
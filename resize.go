@@ -1,14 +1,18 @@
 package partitionresizer
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/partition/gpt"
-	"github.com/diskfs/go-diskfs/sync"
 )
 
 // isUnknownFilesystem reports whether err is a *disk.UnknownFilesystemError.
@@ -23,65 +27,344 @@ func isUnknownFilesystem(err error) bool {
 // When preserveNumbers is set, a relocated partition is renumbered back to its
 // original partition number after the copy, so that consumers referencing a
 // partition by number (e.g. boot loaders) continue to find it.
-func resize(d *disk.Disk, resizes []partitionResizeTarget, fixErrors, preserveNumbers bool) error {
+// opts.LUKSKeyFile unlocks any LUKS containers being resized.
+// Each phase is recorded in j as it completes, and a phase j records as
+// completed by an earlier, interrupted run is skipped; j may be nil.
+// The phases run, the bytes copied and the filesystem checks are recorded on
+// res, which may be nil too.
+// Should ctx be done, resize stops as RunContext describes.
+func resize(ctx context.Context, d *disk.Disk, resizes []partitionResizeTarget, fixErrors, preserveNumbers bool, opts Options, j *journal, res *Result) error {
+	// each phase not already completed is reported to opts.Progress as it
+	// starts and finishes, and is not started once ctx is done, leaving it
+	// for Resume
+	progress := opts.progress()
+	if res != nil {
+		progress = resultProgress{ProgressReporter: progress, res: res}
+	}
+	logger := opts.logger()
+	// the events of a phase are held until it is complete
+	var pending []Event
+	emit := func(e Event) {
+		e.Disk = d.Backend.Path()
+		opts.emit(e)
+	}
+	if opts.OnEvent != nil {
+		progress = eventProgress{ProgressReporter: progress, emit: emit}
+	}
+	if opts.IOPriority != "" {
+		if err := setIOPriority(opts.IOPriority); err != nil {
+			logger.Warn("cannot set I/O priority, running at the current one", "priority", opts.IOPriority, "error", err)
+		} else {
+			logger.Debug("set I/O priority", "priority", opts.IOPriority)
+		}
+	}
+	// raw copies record how far they got in the journal, to resume from
+	ctx = withCopyCheckpoints(ctx, newCopyCheckpoints(j, opts.CheckpointInterval))
+	// a resize that is stopped leaves what it wrote on the device, to resume
+	defer func() {
+		if ctx.Err() != nil {
+			flushDisk(logger, d)
+		}
+	}()
+	runPhase := func(phase string, fn func() error) error {
+		if j.done(phase) {
+			logger.Debug("phase already completed, skipping", "phase", phase)
+			res.addPhase(phase, 0, true, nil)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("resize stopped before phase %s: %w", phase, err)
+		}
+		progress.PhaseStarted(phase)
+		started := time.Now()
+		err := j.runPhase(phase, fn)
+		if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			// a step that does not know of ctx failed as it stopped
+			err = fmt.Errorf("resize stopped in phase %s: %w: %w", phase, ctx.Err(), err)
+		}
+		res.addPhase(phase, time.Since(started), false, err)
+		progress.PhaseFinished(phase, err)
+		if err == nil {
+			for _, e := range pending {
+				emit(e)
+			}
+		}
+		pending = nil
+		return err
+	}
+
+	// an encrypted partition cannot be resized without its key, so find that
+	// out before anything is changed
+	if err := requireLUKSKey(d, resizes, opts.LUKSKeyFile); err != nil {
+		return err
+	}
+	// the partition table as it was before the resize, to restore should it
+	// fail: as journaled, for a resumed resize that has already changed it
+	var before []gpt.Partition
+	if j != nil {
+		before = j.Table
+	} else {
+		table, err := readGPT(d)
+		if err != nil {
+			return err
+		}
+		for _, p := range table.Partitions {
+			before = append(before, *p)
+		}
+	}
+
+	// turn off any active swap being resized; swap is recreated rather than
+	// copied, and the kernel must not be writing to it while we do so
+	swaps, err := deactivateSwaps(ctx, logger, d, resizes)
+	// should the resize fail, turn the swap it turned off back on, rather than
+	// leave the system without it; a resumed resize turns it off again
+	reactivated := false
+	defer func() {
+		if reactivated {
+			return
+		}
+		if err := reactivateSwaps(ctx, logger, swaps); err != nil {
+			logger.Warn("failed to turn swap back on after the resize failed", "error", err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if swaps, err = j.recordSwaps(swaps); err != nil {
+		return err
+	}
+
 	// do any shrinks first
 	// this is idempotent. If I have a 500MB partition with a 500MB filesystem,
 	// and shrink it to 400MB. If I stop, and then run it again, it will just say
 	// it already is 400MB and move on.
-	if err := shrinkFilesystems(d, resizes, fixErrors); err != nil {
-		return err
+	// Encrypted filesystems are shrunk along with their LUKS container.
+	hooks := func(point HookPoint) error {
+		return runHooks(ctx, logger, opts.Hooks, point, d.Backend.Path(), resizes, preserveNumbers)
 	}
-	// next shrink partitions
-	// This is idempotent as well. I tell the GPT partition table what size
-	// I want, and it will just set it again if it's already that size.
-	if err := shrinkPartitions(d, resizes); err != nil {
+	if err := runPhase(PhaseShrinkFilesystems, func() error {
+		if err := hooks(HookPreShrink); err != nil {
+			return err
+		}
+		if err := shrinkLUKSFilesystems(ctx, logger, d, resizes, opts.LUKSKeyFile, fixErrors); err != nil {
+			return err
+		}
+		if err := shrinkFilesystems(ctx, logger, d, resizes, fixErrors); err != nil {
+			return err
+		}
+		for _, r := range resizes {
+			if r.target.size < r.original.size {
+				shrunk := r.original
+				shrunk.size = r.target.size
+				pending = append(pending, Event{Kind: EventFilesystemShrunk, Partition: r.original.number, Geometry: shrunk.geometry()})
+			}
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
-
-	// next create new partitions
-	// It is important that they have different UUID, Type GUID, and predictable
-	// but different names, so that we can identify them later for copying data.
-	// Should it stop and then reboot, we want the original partitions to still be there.
-	// They should have their original UUID and Label, so there is no conflict.
-	// We also want the new partitions to have unique Type GUIDs and Names,
-	// in case something relies on that to boot. For example, EFI System Partition.
-	if err := createPartitions(d, resizes); err != nil {
+	// next stage the new partitions: in a single partition table write,
+	// shrink the shrunk partitions and add a partition for each relocated one.
+	// The originals keep their place, sizes and identities, so that should it
+	// stop and then reboot, they are still there as they were.
+	// The new partitions have a different UUID, Type GUID, and predictable
+	// but different names, so that we can identify them later for copying data,
+	// and nothing that relies on those to boot (e.g. the EFI System Partition)
+	// picks them up.
+	// This is idempotent: shrinking sets the size again if it already is that
+	// size, and a new partition already there is not added again.
+	var created []partitionData
+	if err := runPhase(PhasePreparePartitions, func() error {
+		if description := describePrepare(d.Backend.Path(), resizes); description != "" {
+			if err := opts.confirm(description); err != nil {
+				return err
+			}
+		}
+		var err error
+		if created, err = preparePartitions(logger, opts.audit(), d, resizes); err != nil {
+			return err
+		}
+		for _, r := range resizes {
+			for _, p := range created {
+				if p.start == r.target.start {
+					pending = append(pending, Event{Kind: EventPartitionCreated, Partition: r.original.number, Geometry: p.geometry()})
+				}
+			}
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
+	// should the copy or its validation fail, put the partition table back as
+	// it was before the resize, removing the partitions created for it, by
+	// this run or an interrupted one, rather than leave them orphaned and
+	// half-filled, and giving the shrunk originals back their sizes, then grow
+	// their filesystems back to fill them, as Rollback does
+	cleanup := func(cause error) error {
+		logger.Warn("resize failed, restoring the partition table as it was before it", "error", cause)
+		if err := restoreTable(logger, opts.audit(), d, before, auditRemoveCreatedPartitions, anyFrozen(resizes)); err != nil {
+			return fmt.Errorf("%w; failed to remove the partitions created for it: %v", cause, err)
+		}
+		reopen := PhasePreparePartitions
+		if ctx.Err() == nil {
+			grown, err := growBack(ctx, logger, d, resizes, opts.LUKSKeyFile, fixErrors)
+			if err != nil {
+				return fmt.Errorf("%w; failed to grow the shrunk filesystems back: %v", cause, err)
+			}
+			if grown {
+				reopen = PhaseShrinkFilesystems
+			}
+		}
+		if err := j.reopen(reopen); err != nil {
+			return fmt.Errorf("%w; failed to update journal: %v", cause, err)
+		}
+		return cause
+	}
 
 	// next copy filesystems
 	// After the copy is done, verify the contents.
-	if err := copyFilesystems(d, resizes); err != nil {
+	// LUKS containers are copied raw, so grow each, and the filesystem inside
+	// it, into its larger partition
+	if err := runPhase(PhaseCopy, func() error {
+		tuneCopies(logger, d, resizes, opts)
+		// only the copies are held to MaxThroughput, through a disk of
+		// their own
+		if err := copyFilesystems(ctx, logger, throttledDisk(d, opts.MaxThroughput), resizes, progress, opts.CopyWorkers); err != nil {
+			return err
+		}
+		if err := growLUKSFilesystems(ctx, logger, d, resizes, opts.LUKSKeyFile, fixErrors); err != nil {
+			return err
+		}
+		return hooks(HookPostCopy)
+	}); err != nil {
+		return cleanup(err)
+	}
+
+	// copies given a temporary filesystem UUID get their original's back,
+	// now that they are complete and just before the originals are removed,
+	// the copy of an ESP is checked for the boot loaders of its original, and
+	// then the caller's validators get their say on each copy
+	if err := runPhase(PhaseValidate, func() error {
+		if err := restoreUUIDs(ctx, logger, d, resizes); err != nil {
+			return err
+		}
+		esps, err := validateESPs(logger, d, resizes, preserveNumbers)
+		res.addESPs(esps)
+		if err != nil {
+			return err
+		}
+		if err := runValidators(logger, d, resizes, opts.Validators); err != nil {
+			return err
+		}
+		for _, r := range resizes {
+			if r.original.start != r.target.start {
+				pending = append(pending, Event{Kind: EventValidated, Partition: r.original.number, Geometry: r.target.geometry()})
+			}
+		}
+		return hooks(HookPreCutover)
+	}); err != nil {
+		return cleanup(err)
+	}
+
+	// commit: in a single partition table write, the cutover. Each relocated
+	// target gets the original partition's identity (name, type GUID,
+	// partition GUID, attributes) and its partition number (the original
+	// number when preserveNumbers, otherwise the number it was created with),
+	// the superseded original is removed, and the partitions planned to grow
+	// in place get their new sizes. Until this write the table describes the
+	// originals as they were, so a crash leaves either the old layout or the
+	// new one. With Options.WipeRemoved and Options.Discard, the space the
+	// originals leave is then wiped, and discarded. Each ESP copied is then
+	// checked to have kept its original's identity, and with
+	// Options.UpdateBootEntries, the boot entries on it re-registered.
+	if err := runPhase(PhaseCommitPartitions, func() error {
+		if err := opts.confirm(describeCommit(d.Backend.Path(), resizes)); err != nil {
+			return err
+		}
+		esps, err := findESPs(d, resizes, preserveNumbers)
+		if err != nil {
+			return fmt.Errorf("find EFI system partitions: %w", err)
+		}
+		if err := commitPartitions(ctx, logger, opts.audit(), d, resizes, preserveNumbers); err != nil {
+			return err
+		}
+		res.addESPs(checkESPs(ctx, logger, d, esps))
+		if err := wipeOriginals(ctx, logger, d, resizes); err != nil {
+			return err
+		}
+		discardOriginals(logger, d, resizes)
+		pending = append(pending, Event{Kind: EventCutover})
+		for _, r := range resizes {
+			if r.original.start != r.target.start {
+				pending = append(pending, Event{Kind: EventOldRemoved, Partition: r.original.number, Geometry: r.original.geometry()})
+			}
+		}
+		return nil
+	}); err != nil {
+		// the copies are of no use without the cutover
+		if errors.Is(err, ErrNotConfirmed) {
+			return cleanup(err)
+		}
 		return err
 	}
 
-	// finalize: in a single idempotent step, give each relocated target the
-	// original partition's identity (name, type GUID, partition GUID,
-	// attributes), set its partition number (the original number when
-	// preserveNumbers, otherwise the number it was created with), and remove the
-	// superseded original partition.
-	if err := updatePartitions(d, resizes, preserveNumbers); err != nil {
+	// grow the filesystems on the partitions grown in place, online if they
+	// are mounted
+	if err := runPhase(PhaseGrowFilesystems, func() error {
+		return growInPlace(ctx, logger, d, resizes, fixErrors)
+	}); err != nil {
+		return err
+	}
+
+	// check every filesystem the resize shrank, grew or copied, read-only
+	// unless fixErrors, so that any damage is reported now rather than found
+	// on its next mount. The resize itself is complete by now, so problems are
+	// reported once it is finished rather than stopping it.
+	var problems []string
+	if err := runPhase(PhaseCheckFilesystems, func() error {
+		checks := checkResizedFilesystems(ctx, logger, d, resizes, fixErrors, preserveNumbers)
+		for _, c := range checks {
+			if c.Outcome == CheckFailed {
+				problems = append(problems, c.problem())
+			}
+		}
+		if res != nil {
+			res.Checks = checks
+		}
+		// checks that were not run are not problems; they are run on resume
+		return ctx.Err()
+	}); err != nil {
 		return err
 	}
 
+	// turn back on any swap we turned off, now under its final partition
+	reactivated = true
+	if err := reactivateSwaps(ctx, logger, swaps); err != nil {
+		return err
+	}
+	if err := j.finish(); err != nil {
+		return err
+	}
+	if err := hooks(HookPostComplete); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return NewFilesystemCheckError(d.Backend.Path(), problems)
+	}
 	return nil
 }
 
-// updatePartitions performs the final, idempotent phase of a resize. For each
-// relocated partition it gives the target the identity of its original (name,
-// type GUID, partition GUID, attributes), assigns the target's partition number
-// (the original number when preserveNumbers, otherwise the number it was created
-// with), and removes the now-superseded original -- all in a single partition
-// table write.
+// commitPartitions performs the cutover of a resize, once the relocated
+// partitions have been copied and validated, in a single partition table write:
+// see finalizeRelocations and growPartitionEntries. Like each of those, it is
+// idempotent, so re-running it after an interruption converges.
 //
-// It supersedes the swapPartitions + removePartitions/removeAndRenumberPartitions
-// sequence (still defined below but no longer called). Unlike the swap, it is idempotent:
-// it identifies partitions by their on-disk start offset -- the one identifier
-// that is stable across this phase, since names and numbers change -- sets the
-// desired final state directly rather than exchanging values, and treats an
-// already-removed original as a no-op. Re-running after an interruption
-// therefore converges instead of undoing a completed operation.
-func updatePartitions(d *disk.Disk, resizes []partitionResizeTarget, preserveNumbers bool) error {
+// The kernel is then told of the new table. A partition grown in place may be
+// mounted, and a frozen copy's source still is, and while any partition of the
+// disk is in use the kernel refuses to re-read the whole table; it then keeps
+// the old one until the disk is no longer in use, e.g. on the next boot, and is
+// told the new size of each partition grown in place with partx instead.
+func commitPartitions(ctx context.Context, logger *slog.Logger, audit *auditLog, d *disk.Disk, resizes []partitionResizeTarget, preserveNumbers bool) error {
 	tableRaw, err := d.GetPartitionTable()
 	if err != nil {
 		return err
@@ -90,6 +373,57 @@ func updatePartitions(d *disk.Disk, resizes []partitionResizeTarget, preserveNum
 	if !ok {
 		return fmt.Errorf("unsupported partition table type, only GPT is supported")
 	}
+	if err := finalizeRelocations(logger, table, resizes, preserveNumbers); err != nil {
+		return err
+	}
+	grown, err := growPartitionEntries(logger, table, resizes)
+	if err != nil {
+		return err
+	}
+	// nothing relocated or grown, nothing to commit; skipping the write also
+	// spares the kernel a table re-read it refuses while a partition is in use
+	if !anyRelocated(resizes) && len(grown) == 0 {
+		return nil
+	}
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	traceTableWrite(logger, d, table, auditCommitPartitions)
+	if err := audit.write(d, auditCommitPartitions, func() error { return table.Write(w, d.Size) }); err != nil {
+		return fmt.Errorf("failed to write updated partition table: %v", err)
+	}
+	d.Table = table
+
+	if err := d.ReReadPartitionTable(); err == nil {
+		return nil
+	} else if !anyFrozen(resizes) && len(grown) == 0 {
+		return fmt.Errorf("%w: %v", ErrTableNotReRead, err)
+	} else if anyRelocated(resizes) {
+		logger.Warn("partition table written, but the kernel keeps the old one until the disk is no longer in use", "error", err)
+	}
+	for _, number := range grown {
+		if err := execPartxUpdate(ctx, d.Backend.Path(), number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizeRelocations updates table for each relocated partition: it gives the
+// target the identity of its original (name, type GUID, partition GUID,
+// attributes), assigns the target's partition number (the original number when
+// preserveNumbers, otherwise the number it was created with), and removes the
+// now-superseded original.
+//
+// It supersedes the swapPartitions + removePartitions/removeAndRenumberPartitions
+// sequence (still defined below but no longer called). Unlike the swap, it is idempotent:
+// it identifies partitions by their on-disk start offset -- the one identifier
+// that is stable across this phase, since names and numbers change -- sets the
+// desired final state directly rather than exchanging values, and treats an
+// already-removed original as a no-op. Re-running after an interruption
+// therefore converges instead of undoing a completed operation.
+func finalizeRelocations(logger *slog.Logger, table *gpt.Table, resizes []partitionResizeTarget, preserveNumbers bool) error {
 	// Index active partitions by start sector. Start is the only identifier that
 	// does not change during this phase (names and numbers do), so it is the
 	// stable key for locating the target and the original on a re-run.
@@ -104,7 +438,7 @@ func updatePartitions(d *disk.Disk, resizes []partitionResizeTarget, preserveNum
 	removeStart := make(map[uint64]bool)
 	for _, r := range resizes {
 		if r.original.start == r.target.start {
-			// shrunk in place: not relocated, so no identity move or removal
+			// resized in place: not relocated, so no identity move or removal
 			continue
 		}
 		targetStart := uint64(r.target.start / sectorSize)
@@ -117,11 +451,17 @@ func updatePartitions(d *disk.Disk, resizes []partitionResizeTarget, preserveNum
 		// original is still present. Once a prior (interrupted) run has removed
 		// it, the target already carries the final identity and this is skipped.
 		if original := byStart[originalStart]; original != nil {
-			log.Printf("finalizing partition at start %d to identity of %s (partition %d); removing original", r.target.start, r.original.label, r.original.number)
+			logger.Info("finalizing copy as the original partition, removing the original", "partition", r.original.number, "label", r.original.label, "start", r.target.start)
 			target.Name = original.Name
-			target.Type = original.Type
+			target.Type = cmp.Or(r.partitionType, original.Type)
+			if target.Type != original.Type {
+				logger.Info("retyping copy", "partition", r.original.number, "from", original.Type, "to", target.Type)
+			}
 			target.GUID = original.GUID
-			target.Attributes = original.Attributes
+			target.Attributes = r.finalAttributes(original.Attributes)
+			if target.Attributes != original.Attributes {
+				logger.Info("changing GPT attributes of copy", "partition", r.original.number, "from", fmt.Sprintf("%#x", original.Attributes), "to", fmt.Sprintf("%#x", target.Attributes))
+			}
 			removeStart[originalStart] = true
 		}
 		if preserveNumbers {
@@ -138,24 +478,58 @@ func updatePartitions(d *disk.Disk, resizes []partitionResizeTarget, preserveNum
 		}
 		table.Partitions = kept
 	}
-	if err := d.Partition(table); err != nil {
-		return fmt.Errorf("failed to write updated partition table: %v", err)
-	}
 	return nil
 }
 
-// createPartitions creates new partitions as per the resize targets, taking
-// all of the characteristics from the original partitions except for start/end/size.
-func createPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
-	// first create the new partitions in the partition table and write it
+// anyRelocated reports whether any of resizes moves its partition to a new
+// location, i.e. is a copy-based grow rather than an in-place change.
+func anyRelocated(resizes []partitionResizeTarget) bool {
+	for _, r := range resizes {
+		if r.original.start != r.target.start {
+			return true
+		}
+	}
+	return false
+}
+
+// preparePartitions stages a resize in a single partition table write: it
+// shrinks the partitions being shrunk, see shrinkPartitions, and adds the new
+// partitions the relocated ones are copied to, see createPartitions. It returns
+// the partitions it added, leaving out any an earlier run already had.
+func preparePartitions(logger *slog.Logger, audit *auditLog, d *disk.Disk, resizes []partitionResizeTarget) ([]partitionData, error) {
 	tableRaw, err := d.GetPartitionTable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	table, ok := tableRaw.(*gpt.Table)
 	if !ok {
-		return fmt.Errorf("unsupported partition table type, only GPT is supported")
+		return nil, fmt.Errorf("unsupported partition table type, only GPT is supported")
+	}
+	shrunk, err := shrinkPartitions(logger, table, resizes)
+	if err != nil {
+		return nil, err
+	}
+	created, err := createPartitions(logger, table, resizes)
+	if err != nil {
+		return nil, err
 	}
+	if shrunk == 0 && len(created) == 0 {
+		return nil, nil
+	}
+	// we rely on the GPT implementation to sort out the ordering
+	traceTableWrite(logger, d, table, auditPreparePartitions)
+	if err := audit.write(d, auditPreparePartitions, func() error {
+		return writePartitionTable(logger, d, table, anyFrozen(resizes))
+	}); err != nil {
+		return nil, fmt.Errorf("failed to write updated partition table: %v", err)
+	}
+	return created, nil
+}
+
+// createPartitions adds new partitions to table as per the resize targets,
+// taking all of the characteristics from the original partitions except for
+// start/end/size, and returns the targets it added partitions for.
+func createPartitions(logger *slog.Logger, table *gpt.Table, resizes []partitionResizeTarget) ([]partitionData, error) {
 	partitions := table.Partitions
 	indexMap := map[int]*gpt.Partition{}
 	for _, p := range partitions {
@@ -165,22 +539,23 @@ func createPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 	for _, p := range partitions {
 		labelMap[p.Name] = true
 	}
+	var created []partitionData
 	for _, r := range resizes {
 		// no change in start, just copy over, it already was handled
 		if r.original.start == r.target.start {
-			log.Printf("partition %d %s: no location change, no need to create additional partition", r.original.number, r.original.label)
+			logger.Debug("partition not moving, no new partition needed", "partition", r.original.number, "label", r.original.label)
 			continue
 		}
-		log.Printf("creating new partition %s: original %+v, target %+v", r.original.label, r.original, r.target)
+		logger.Info("creating new partition", "partition", r.original.number, "target", r.target.number, "label", r.original.label, "start", r.target.start, "bytes", r.target.size)
 		// get existing partition info
 		p, ok := indexMap[r.original.number]
 		if !ok {
-			return fmt.Errorf("original partition %d not found in partition table", r.original.number)
+			return nil, fmt.Errorf("original partition %d not found in partition table", r.original.number)
 		}
 		altName := getAlternateLabel(p.Name)
 		// see if it already exists
 		if labelMap[altName] {
-			log.Printf("alternate partition name %s already exists, assuming partition was already created", altName)
+			logger.Info("partition already created", "label", altName)
 			continue
 		}
 		// create the new partition
@@ -194,88 +569,210 @@ func createPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 			// explicitly leave GUID blank so it autogenerates a new one
 		}
 		partitions = append(partitions, &newPart)
+		created = append(created, r.target)
 	}
-	// write the updated partition table; we rely on the GPT implementation to sort out the ordering
 	table.Partitions = partitions
-	if err := d.Partition(table); err != nil {
-		return fmt.Errorf("failed to write updated partition table: %v", err)
-	}
-	return nil
+	return created, nil
 }
 
-func copyFilesystems(d *disk.Disk, resizes []partitionResizeTarget) error {
+// copyFilesystems copies each partition of resizes that moves to its new
+// location, up to workers of them at once, see Options.CopyWorkers, stopping
+// at the first copy to fail; those still running are stopped too. progress is
+// told of each, and, should it be a TotalProgressReporter, of the bytes copied
+// of all of them.
+func copyFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, progress ProgressReporter, workers int) error {
 	// it depends on the filesystem type:
 	// - squashfs, ext4, unknown: raw data copy
 	// - fat32: use filesystem copy
+	// - swap: recreate with the same UUID and label, nothing to copy
+	// - LUKS: raw data copy, grown afterwards by growLUKSFilesystems
+	var copies []partitionResizeTarget
 	for _, r := range resizes {
 		if r.original.start == r.target.start {
-			log.Printf("partition %d %s: no location change, no need to copy filesystem", r.original.number, r.original.label)
+			logger.Debug("partition not moving, no copy needed", "partition", r.original.number, "label", r.original.label)
 			continue
 		}
-		log.Printf("copying data from original partition %d to new partition %d", r.original.number, r.target.number)
-		fs, err := d.GetFilesystem(r.original.number)
-		switch {
-		case err != nil && !isUnknownFilesystem(err):
-			return fmt.Errorf("failed to get filesystem for partition %s: %v", r.original.label, err)
-		case err != nil || fs.Type() == filesystem.TypeSquashfs:
-			log.Printf("partition %d -> %d: performing raw data copy", r.original.number, r.target.number)
-			if err := sync.CopyPartitionRaw(d, r.original.number, r.target.number); err != nil {
-				return fmt.Errorf("failed to copy raw data for partition %s: %v", r.original.label, err)
-			}
-		case fs.Type() == filesystem.TypeExt4:
-			// On resume, the target may already hold a complete, matching copy
-			// from a prior run; in that case skip the reformat+recopy. CompareFS
-			// is a structural/content equality check against the source, not a
-			// filesystem integrity check.
-			if existing, eerr := d.GetFilesystem(r.target.number); eerr == nil && sync.CompareFS(fs, existing) == nil {
-				log.Printf("partition %d -> %d: target filesystem already matches source, skipping copy", r.original.number, r.target.number)
-				continue
-			}
-			newFS, err := d.CreateFilesystem(disk.FilesystemSpec{
-				Partition:   r.target.number,
-				FSType:      filesystem.TypeExt4,
-				VolumeLabel: fs.Label(),
-			})
-			if err != nil {
-				return fmt.Errorf("failed to create ext4 filesystem for new partition %s: %v", r.original.label, err)
-			}
-			// use filesystem copy
-			if err := sync.CopyFileSystem(fs, newFS); err != nil {
-				return fmt.Errorf("failed to copy ext4 filesystem data for partition %s: %v", r.original.label, err)
-			}
-			if err := sync.CompareFS(fs, newFS); err != nil {
-				return fmt.Errorf("verification failed for partition %s: %v", r.original.label, err)
-			}
-			log.Printf("partition %d -> %d: filesystem %v copy verified", r.original.number, r.target.number, fs.Type())
-		case fs.Type() == filesystem.TypeFat32:
-			// create a new filesystem on the new partition
-			newFS, err := d.CreateFilesystem(disk.FilesystemSpec{
-				Partition:   r.target.number,
-				FSType:      filesystem.TypeFat32,
-				VolumeLabel: fs.Label(),
-			})
-			if err != nil {
-				return fmt.Errorf("failed to create FAT32 filesystem for new partition %s: %v", r.original.label, err)
-			}
-			// use filesystem copy
-			if err := sync.CopyFileSystem(fs, newFS); err != nil {
-				return fmt.Errorf("failed to copy FAT32 filesystem data for partition %s: %v", r.original.label, err)
+		copies = append(copies, r)
+	}
+	if len(copies) == 0 {
+		return nil
+	}
+	totals := newCopyTotals(progress, d, copies)
+	if workers <= 1 {
+		for i, r := range copies {
+			if err := copyFilesystem(ctx, logger, d, r, i+1, len(copies), totals); err != nil {
+				return err
 			}
-			log.Printf("partition %d -> %d: filesystem %v copied file content", r.original.number, r.target.number, fs.Type())
-			if err := sync.CompareFS(fs, newFS); err != nil {
-				return fmt.Errorf("verification failed for partition %s: %v", r.original.label, err)
+		}
+		return nil
+	}
+	logger.Debug("copying partitions concurrently", "partitions", len(copies), "workers", workers)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		wg       sync.WaitGroup
+		firstErr error
+		once     sync.Once
+		slots    = make(chan struct{}, workers)
+	)
+	for i, r := range copies {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			if err := copyFilesystem(ctx, logger, d, r, i+1, len(copies), totals); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel(err)
+				})
 			}
-			log.Printf("partition %d -> %d: filesystem %v copy verified", r.original.number, r.target.number, fs.Type())
-		default:
-			return fmt.Errorf("unsupported filesystem type %v for partition %s", fs.Type(), r.original.label)
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		// stopped by the caller before any copy failed
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// copyFilesystem copies r, the nth of total partitions to copy, to its new
+// location, see copyFilesystems.
+func copyFilesystem(ctx context.Context, logger *slog.Logger, d *disk.Disk, r partitionResizeTarget, n, total int, progress ProgressReporter) error {
+	// a file-by-file copy cannot be stopped midway, so stop before it
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	progress.CopyStarted(r.original.number, n, total)
+	hdr, isSwap, err := readSwapHeader(d.Backend, r.original.start)
+	if err != nil {
+		return fmt.Errorf("failed to check partition %s for swap: %v", r.original.label, err)
+	}
+	if isSwap {
+		if err := recreateSwap(ctx, logger, d.Backend.Path(), r.target, r.target.size, hdr); err != nil {
+			return fmt.Errorf("failed to recreate swap for partition %s: %v", r.original.label, err)
 		}
+		return nil
+	}
+	// a mounted source, allowed with Options.FreezeMounted, is frozen for
+	// the copy, and thawed again however the copy ends
+	thaw, err := freezeSource(ctx, logger, d, r)
+	if err != nil {
+		return fmt.Errorf("failed to freeze filesystem on partition %s: %v", r.original.label, err)
+	}
+	err = copyPartition(ctx, logger, d, r, progress)
+	if terr := thaw(); err == nil && terr != nil {
+		err = fmt.Errorf("failed to thaw filesystem on partition %s: %v", r.original.label, terr)
+	}
+	if err != nil {
+		return NewCopyError(r.original.label, err)
+	}
+	if err := assignTemporaryUUID(ctx, logger, d, r); err != nil {
+		return fmt.Errorf("failed to give copy of partition %s a temporary UUID: %v", r.original.label, err)
+	}
+	return nil
+}
 
+// copyPartition copies the data of the original partition of r, other than
+// swap, to its target partition, see copyFilesystems.
+func copyPartition(ctx context.Context, logger *slog.Logger, d *disk.Disk, r partitionResizeTarget, progress ProgressReporter) error {
+	_, isLUKS, err := readLUKSHeader(d.Backend, r.original.start)
+	if err != nil {
+		return fmt.Errorf("failed to check partition %s for LUKS: %v", r.original.label, err)
+	}
+	logger.Info("copying partition", "partition", r.original.number, "target", r.target.number)
+	fs, err := d.GetFilesystem(r.original.number)
+	switch {
+	case isLUKS:
+		logger.Info("LUKS container, copying byte for byte", "partition", r.original.number, "target", r.target.number)
+		if err := copyPartitionRaw(ctx, logger, d, r, progress); err != nil {
+			return fmt.Errorf("failed to copy raw data for partition %s: %w", r.original.label, err)
+		}
+	case err != nil && !isUnknownFilesystem(err):
+		return fmt.Errorf("failed to get filesystem for partition %s: %v", r.original.label, err)
+	case err != nil || fs.Type() == filesystem.TypeSquashfs:
+		// an unknown filesystem is raw-copied, unless it belongs to a
+		// subsystem that would take the copy for a duplicate device
+		if name, perr := probeSignature(d.Backend, r.original); perr != nil {
+			return fmt.Errorf("failed to probe partition %s: %v", r.original.label, perr)
+		} else if name != "" {
+			return fmt.Errorf("partition %s holds a %s device, refusing to copy it", r.original.label, name)
+		}
+		logger.Info("copying byte for byte", "partition", r.original.number, "target", r.target.number)
+		if err := copyPartitionRaw(ctx, logger, d, r, progress); err != nil {
+			return fmt.Errorf("failed to copy raw data for partition %s: %w", r.original.label, err)
+		}
+	case fs.Type() == filesystem.TypeExt4:
+		// On resume, the target may already hold a complete, matching copy
+		// from a prior run; in that case skip the reformat+recopy.
+		// compareFileSystems is a structural/content equality check against
+		// the source, not a filesystem integrity check.
+		if existing, eerr := d.GetFilesystem(r.target.number); eerr == nil && compareFileSystems(fs, existing) == nil {
+			logger.Info("target filesystem already matches its source, skipping copy", "partition", r.original.number, "target", r.target.number)
+			return nil
+		}
+		newFS, err := d.CreateFilesystem(disk.FilesystemSpec{
+			Partition:   r.target.number,
+			FSType:      filesystem.TypeExt4,
+			VolumeLabel: fs.Label(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create ext4 filesystem for new partition %s: %v", r.original.label, err)
+		}
+		// use filesystem copy
+		if err := copyFileSystem(logger, fs, newFS, r.noAtime, fileProgress(progress, r)); err != nil {
+			return fmt.Errorf("failed to copy ext4 filesystem data for partition %s: %v", r.original.label, err)
+		}
+		if err := compareFileSystems(fs, newFS); err != nil {
+			logTreeDiff(logger, r, err)
+			return fmt.Errorf("verification failed for partition %s: %v", r.original.label, err)
+		}
+		logger.Info("copy verified", "partition", r.original.number, "target", r.target.number, "filesystem", filesystemName(fs.Type()))
+		progress.BytesCopied(r.original.number, r.original.size, r.original.size)
+	case fs.Type() == filesystem.TypeFat32:
+		// create a new filesystem on the new partition
+		newFS, err := d.CreateFilesystem(disk.FilesystemSpec{
+			Partition:   r.target.number,
+			FSType:      filesystem.TypeFat32,
+			VolumeLabel: fs.Label(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create FAT32 filesystem for new partition %s: %v", r.original.label, err)
+		}
+		// use filesystem copy
+		if err := copyFileSystem(logger, fs, newFS, r.noAtime, fileProgress(progress, r)); err != nil {
+			return fmt.Errorf("failed to copy FAT32 filesystem data for partition %s: %v", r.original.label, err)
+		}
+		logger.Info("copied file content", "partition", r.original.number, "target", r.target.number, "filesystem", filesystemName(fs.Type()))
+		if err := compareFileSystems(fs, newFS); err != nil {
+			logTreeDiff(logger, r, err)
+			return fmt.Errorf("verification failed for partition %s: %v", r.original.label, err)
+		}
+		logger.Info("copy verified", "partition", r.original.number, "target", r.target.number, "filesystem", filesystemName(fs.Type()))
+		keepFAT32Boot(logger, d, r)
+		progress.BytesCopied(r.original.number, r.original.size, r.original.size)
+	default:
+		return fmt.Errorf("unsupported filesystem type %v for partition %s", fs.Type(), r.original.label)
 	}
 	return nil
 }
 
+// fileProgress returns the function copyFileSystem reports the file data it
+// has written with, for the copy of the original partition of r, reporting
+// it to progress against the size of the partition. The file data is less
+// than that, so the copy reports the whole partition copied once it is done.
+func fileProgress(progress ProgressReporter, r partitionResizeTarget) func(int64) {
+	return func(written int64) {
+		progress.BytesCopied(r.original.number, min(written, r.original.size), r.original.size)
+	}
+}
+
 // remove partitions removes the original partitions after data has been copied
-func removePartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
+func removePartitions(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) error {
 	// first create the new partitions in the partition table and write it
 	tableRaw, err := d.GetPartitionTable()
 	if err != nil {
@@ -288,21 +785,22 @@ func removePartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 	toRemove := make(map[int]bool)
 	for _, r := range resizes {
 		if r.original.number == r.target.number {
-			log.Printf("partition %d %s: no change in partition number, no need to remove old partition", r.original.number, r.original.label)
+			logger.Debug("partition number unchanged, nothing to remove", "partition", r.original.number, "label", r.original.label)
 			continue
 		}
-		log.Printf("removing old partition %d", r.original.number)
+		logger.Info("removing original partition", "partition", r.original.number)
 		// mark this partition for removal
 		toRemove[r.original.number] = true
 	}
 	// remove any marked for removal
 	for _, p := range table.Partitions {
 		if toRemove[p.Index] {
-			log.Printf("removing partition %d from partition table", p.Index)
+			logger.Info("removing partition from partition table", "partition", p.Index)
 			p.Type = gpt.Unused
 		}
 	}
 	// write the updated partition table
+	traceTableWrite(logger, d, table, "remove-partitions")
 	if err := d.Partition(table); err != nil {
 		return fmt.Errorf("failed to write updated partition table: %v", err)
 	}
@@ -323,7 +821,7 @@ func removePartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 // invisible to consumers that locate a partition by its number (e.g. a boot loader
 // referencing (hd0,gptN)); no common tool treats it as an error, though some offer an
 // optional manual sort to restore offset order.
-func removeAndRenumberPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
+func removeAndRenumberPartitions(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) error {
 	tableRaw, err := d.GetPartitionTable()
 	if err != nil {
 		return err
@@ -344,7 +842,7 @@ func removeAndRenumberPartitions(d *disk.Disk, resizes []partitionResizeTarget)
 	removePositions := make(map[int]bool)
 	for _, r := range resizes {
 		if r.original.number == r.target.number {
-			log.Printf("partition %d %s: no change in partition number, no need to renumber", r.original.number, r.original.label)
+			logger.Debug("partition number unchanged, nothing to renumber", "partition", r.original.number, "label", r.original.label)
 			continue
 		}
 		origPos, ok := indexToPosition[r.original.number]
@@ -355,7 +853,7 @@ func removeAndRenumberPartitions(d *disk.Disk, resizes []partitionResizeTarget)
 		if !ok {
 			return fmt.Errorf("target partition %d not found in partition table", r.target.number)
 		}
-		log.Printf("renumbering partition %d -> %d (label %s) and removing original slot", r.target.number, r.original.number, r.original.label)
+		logger.Info("renumbering copy as the original partition, removing the original", "partition", r.original.number, "target", r.target.number, "label", r.original.label)
 		table.Partitions[targetPos].Index = r.original.number
 		removePositions[origPos] = true
 	}
@@ -368,6 +866,7 @@ func removeAndRenumberPartitions(d *disk.Disk, resizes []partitionResizeTarget)
 		partitions = append(partitions, p)
 	}
 	table.Partitions = partitions
+	traceTableWrite(logger, d, table, "renumber-partitions")
 	if err := d.Partition(table); err != nil {
 		return fmt.Errorf("failed to write renumbered partition table: %v", err)
 	}
@@ -376,7 +875,7 @@ func removeAndRenumberPartitions(d *disk.Disk, resizes []partitionResizeTarget)
 
 // swapPartitions swaps the labels, Type GUIDs, and UUIDs of the original and target partitions,
 // as well as any attributes flags.
-func swapPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
+func swapPartitions(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) error {
 	// first create the new partitions in the partition table and write it
 	tableRaw, err := d.GetPartitionTable()
 	if err != nil {
@@ -392,10 +891,10 @@ func swapPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 	}
 	for _, r := range resizes {
 		if r.original.number == r.target.number {
-			log.Printf("partition %d %s: no change in partition number, no need to swap partitions", r.original.number, r.original.label)
+			logger.Debug("partition number unchanged, nothing to swap", "partition", r.original.number, "label", r.original.label)
 			continue
 		}
-		log.Printf("swapping values on partitions original %d -> %d ", r.original.number, r.target.number)
+		logger.Info("swapping partition entries", "partition", r.original.number, "target", r.target.number)
 		// mark this partition for removal
 		original := table.Partitions[indexToPosition[r.original.number]]
 		target := table.Partitions[indexToPosition[r.target.number]]
@@ -416,6 +915,7 @@ func swapPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 		target.Attributes = originalAttributes
 	}
 	// write the updated partition table
+	traceTableWrite(logger, d, table, "swap-partitions")
 	if err := d.Partition(table); err != nil {
 		return fmt.Errorf("failed to write updated partition table: %v", err)
 	}
@@ -431,53 +931,200 @@ func swapPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 // reproduced faithfully. This makes the integrity guarantee symmetric across
 // the shrink source and the grow sources, rather than only checking the shrink
 // partition that resize2fs would have checked anyway.
-func checkSourceFilesystems(d *disk.Disk, resizes []partitionResizeTarget, fixErrors bool) error {
+func checkSourceFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, fixErrors bool) error {
+	// a disk opened without a path, see RunDisk, cannot be mounted, nor its
+	// filesystems checked
 	device := d.Backend.Path()
-	if device == "" {
-		return fmt.Errorf("cannot check source filesystems: disk backend has no path")
-	}
 	checked := map[int]bool{}
 	for _, r := range resizes {
 		if checked[r.original.number] {
 			continue
 		}
 		checked[r.original.number] = true
+		if r.inPlace {
+			// grown in place, and possibly mounted, so neither copied nor
+			// checkable; resize2fs checks it itself when it is not mounted
+			logger.Debug("grown in place, skipping integrity check", "partition", r.original.number)
+			continue
+		}
+		if r.freezeTimeout > 0 && device != "" {
+			// a mounted filesystem cannot be checked; it is frozen for its copy
+			mountpoint, err := partitionMountpoint(device, r.original.number)
+			if err != nil {
+				return err
+			}
+			if mountpoint != "" {
+				logger.Info("mounted, skipping integrity check", "partition", r.original.number, "mountpoint", mountpoint)
+				continue
+			}
+		}
 		fs, err := d.GetFilesystem(r.original.number)
 		if err != nil {
 			if isUnknownFilesystem(err) {
 				// no recognized filesystem (e.g. squashfs on a 512-byte
 				// sector disk, or raw data) -- nothing we can check
-				log.Printf("partition %d: no recognized filesystem, skipping integrity check", r.original.number)
+				logger.Info("no recognized filesystem, skipping integrity check", "partition", r.original.number)
 				continue
 			}
 			return fmt.Errorf("failed to get filesystem for source partition %d: %w", r.original.number, err)
 		}
-		var fsck func(string, bool) error
-		switch fs.Type() {
-		case filesystem.TypeExt4:
-			fsck = execE2fsck
-		case filesystem.TypeFat32:
-			fsck = execFsckFat
-		default:
+		fsck := filesystemChecker(fs.Type())
+		if fsck == nil {
 			// squashfs and other types have no applicable integrity check
-			log.Printf("partition %d: filesystem type %v has no integrity check, skipping", r.original.number, fs.Type())
+			logger.Info("filesystem has no integrity check, skipping", "partition", r.original.number, "filesystem", filesystemName(fs.Type()))
 			continue
 		}
-		log.Printf("checking source filesystem on partition %d (%v)", r.original.number, fs.Type())
-		if err := checkFilesystem(device, r.original, fsck, fixErrors); err != nil {
+		if device == "" {
+			return fmt.Errorf("cannot check source partition %d: disk backend has no path", r.original.number)
+		}
+		logger.Info("checking source filesystem", "partition", r.original.number, "filesystem", filesystemName(fs.Type()))
+		if err := checkFilesystem(ctx, device, r.original, fsck, fixErrors); err != nil {
 			return fmt.Errorf("integrity check failed for source partition %d: %w", r.original.number, err)
 		}
 	}
 	return nil
 }
 
-func shrinkFilesystems(d *disk.Disk, resizes []partitionResizeTarget, fixErrors bool) error {
+// filesystemChecker returns the checker for filesystems of type fsType, or nil
+// if there is none: e2fsck for ext4 and fsck.fat for fat32.
+func filesystemChecker(fsType filesystem.Type) func(context.Context, string, bool) error {
+	switch fsType {
+	case filesystem.TypeExt4:
+		return execE2fsck
+	case filesystem.TypeFat32:
+		return execFsckFat
+	}
+	return nil
+}
+
+// filesystemName returns the name of a filesystem type, as in its check
+// results and logs.
+func filesystemName(fsType filesystem.Type) string {
+	switch fsType {
+	case filesystem.TypeExt4:
+		return "ext4"
+	case filesystem.TypeFat32:
+		return "fat32"
+	case filesystem.TypeFat16:
+		return "fat16"
+	case filesystem.TypeFat12:
+		return "fat12"
+	case filesystem.TypeSquashfs:
+		return "squashfs"
+	case filesystem.TypeISO9660:
+		return "iso9660"
+	}
+	return fmt.Sprint(fsType)
+}
+
+// checkResizedFilesystems checks each ext4 and fat32 filesystem resizes
+// shrank, grew or copied, once the new partition table is committed, and
+// returns the outcome for each partition. Like checkSourceFilesystems, the
+// checks are read-only unless fixErrors is set. A mounted filesystem, e.g. one
+// grown online, cannot be checked, nor can a partition of a block device the
+// kernel still has at its old location because it could not re-read the
+// table; both are skipped.
+func checkResizedFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, fixErrors, preserveNumbers bool) []CheckResult {
+	// a disk opened without a path, see RunDisk, is not a block device, and
+	// its filesystems cannot be checked
+	device := d.Backend.Path()
+	deviceType := disk.DeviceTypeFile
+	if device != "" {
+		f, err := os.Open(device)
+		if err != nil {
+			return []CheckResult{{Outcome: CheckFailed, Detail: fmt.Sprintf("cannot check filesystems: %v", err)}}
+		}
+		deviceType, err = disk.DetermineDeviceType(f)
+		_ = f.Close()
+		if err != nil {
+			return []CheckResult{{Outcome: CheckFailed, Detail: fmt.Sprintf("cannot check filesystems: %v", err)}}
+		}
+	}
+	var checks []CheckResult
+	checked := map[int64]bool{}
+	for _, r := range resizes {
+		p := r.target
+		if r.original.start != r.target.start && preserveNumbers {
+			p.number = r.original.number
+		}
+		if checked[p.start] {
+			continue
+		}
+		checked[p.start] = true
+		if deviceType == disk.DeviceTypeBlockDevice {
+			mountpoint, err := partitionMountpoint(device, p.number)
+			if err != nil {
+				checks = append(checks, CheckResult{Partition: p.number, Outcome: CheckFailed, Detail: err.Error()})
+				continue
+			}
+			if mountpoint != "" {
+				logger.Info("mounted, skipping filesystem check", "partition", p.number, "mountpoint", mountpoint)
+				checks = append(checks, CheckResult{Partition: p.number, Outcome: CheckSkipped, Detail: "mounted at " + mountpoint})
+				continue
+			}
+			if start, err := kernelPartitionStart(device, p.number, ""); err != nil || start != p.start {
+				logger.Info("kernel has not re-read the partition table, skipping filesystem check", "partition", p.number)
+				checks = append(checks, CheckResult{Partition: p.number, Outcome: CheckSkipped, Detail: "kernel has not re-read the partition table"})
+				continue
+			}
+		}
+		fs, err := d.GetFilesystem(p.number)
+		if err != nil {
+			if isUnknownFilesystem(err) {
+				checks = append(checks, CheckResult{Partition: p.number, Outcome: CheckSkipped, Detail: "no recognized filesystem"})
+			} else {
+				checks = append(checks, CheckResult{Partition: p.number, Outcome: CheckFailed, Detail: err.Error()})
+			}
+			continue
+		}
+		check := CheckResult{Partition: p.number, Filesystem: filesystemName(fs.Type()), Outcome: CheckPassed}
+		fsck := filesystemChecker(fs.Type())
+		if fsck == nil {
+			check.Outcome, check.Detail = CheckSkipped, "no check for filesystem"
+			checks = append(checks, check)
+			continue
+		}
+		if device == "" {
+			check.Outcome, check.Detail = CheckFailed, "disk backend has no path"
+			checks = append(checks, check)
+			continue
+		}
+		logger.Info("checking resized filesystem", "partition", p.number, "filesystem", filesystemName(fs.Type()))
+		if err := checkFilesystem(ctx, device, p, fsck, fixErrors); err != nil {
+			check.Outcome, check.Detail = CheckFailed, err.Error()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func shrinkFilesystems(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, fixErrors bool) error {
 	for _, r := range resizes {
 		if r.original.size <= r.target.size {
-			log.Printf("filesystem on partition %d does not require shrinking, skipping", r.original.number)
+			logger.Debug("filesystem does not need shrinking", "partition", r.original.number)
+			continue
+		}
+		logger.Info("shrinking filesystem", "partition", r.original.number, "label", r.original.label, "from", r.original.size, "to", r.target.size)
+		// swap has no data to keep, so it is recreated at the smaller size
+		hdr, isSwap, err := readSwapHeader(d.Backend, r.original.start)
+		if err != nil {
+			return fmt.Errorf("failed to check shrink partition for swap: %v", err)
+		}
+		if isSwap {
+			if r.target.size < hdr.minSize() {
+				return fmt.Errorf("cannot shrink swap on partition %d to %d bytes, below its minimum of %d", r.original.number, r.target.size, hdr.minSize())
+			}
+			if err := recreateSwap(ctx, logger, d.Backend.Path(), r.original, r.target.size, hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, isLUKS, err := readLUKSHeader(d.Backend, r.original.start); err != nil {
+			return fmt.Errorf("failed to check shrink partition for LUKS: %v", err)
+		} else if isLUKS {
+			logger.Info("LUKS encrypted filesystem, shrunk with its container", "partition", r.original.number)
 			continue
 		}
-		log.Printf("shrinking filesystem on partition %d label '%s' from %d to %d bytes / %d to %d MB", r.original.number, r.original.label, r.original.size, r.target.size, r.original.size/MB, r.target.size/MB)
 		// verify ext4 fs on shrink partition
 		fs, err := d.GetFilesystem(r.original.number)
 		if err != nil {
@@ -494,19 +1141,17 @@ func shrinkFilesystems(d *disk.Disk, resizes []partitionResizeTarget, fixErrors
 			return fmt.Errorf("cannot shrink filesystem: disk backend has no path")
 		}
 		delta := r.target.size - r.original.size
-		if err := resizeFilesystem(p, r.original, delta, fixErrors); err != nil {
+		if err := resizeFilesystem(ctx, logger, p, r.original, delta, fixErrors); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func shrinkPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
-	table, ok := d.Table.(*gpt.Table)
+// shrinkPartitions sets the partitions in table being shrunk to their target
+// sizes, and returns how many it shrank.
+func shrinkPartitions(logger *slog.Logger, table *gpt.Table, resizes []partitionResizeTarget) (int, error) {
 	var resizeCount int
-	if !ok {
-		return fmt.Errorf("unsupported partition table type, only GPT is supported")
-	}
 	// Look up partitions by their GPT Index, not by slice position.
 	// table.Partitions is compacted (only active entries), so the old
 	// table.Partitions[number-1] assumed a contiguous 1..N numbering and
@@ -518,24 +1163,47 @@ func shrinkPartitions(d *disk.Disk, resizes []partitionResizeTarget) error {
 	}
 	for _, r := range resizes {
 		if r.original.size <= r.target.size {
-			log.Printf("partition %d does not require shrinking, skipping", r.original.number)
+			logger.Debug("partition does not need shrinking", "partition", r.original.number)
 			continue
 		}
 		p, ok := byIndex[r.original.number]
 		if !ok {
-			return fmt.Errorf("partition %d not found in partition table", r.original.number)
+			return 0, fmt.Errorf("partition %d not found in partition table", r.original.number)
 		}
-		log.Printf("Resizing partition %d to %d bytes", r.original.number, r.target.size)
+		logger.Info("resizing partition", "partition", r.original.number, "bytes", r.target.size)
 		// set the new desired size; set End to 0 so it is recalculated
 		p.Size = uint64(r.target.size)
 		p.End = 0
 		resizeCount++
 	}
-	if resizeCount == 0 {
-		return nil
+	return resizeCount, nil
+}
+
+// flushDisk flushes what has been written to d to the device, so that a resize
+// stopped part way leaves the disk as its journal records it.
+func flushDisk(logger *slog.Logger, d *disk.Disk) {
+	f, err := d.Backend.Sys()
+	if err != nil {
+		return
 	}
-	if err := d.Partition(table); err != nil {
-		return fmt.Errorf("failed to write partition table after shrinking: %v", err)
+	if err := f.Sync(); err != nil {
+		logger.Warn("failed to flush disk", "disk", d.Backend.Path(), "error", err)
 	}
-	return nil
+}
+
+// traceTableWrite logs, at LevelTrace, that table is about to be written to d
+// for operation, with each partition in it: its number, name, and start and
+// size in bytes.
+func traceTableWrite(logger *slog.Logger, d *disk.Disk, table *gpt.Table, operation string) {
+	if !logger.Enabled(context.Background(), LevelTrace) {
+		return
+	}
+	var partitions []string
+	for _, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		partitions = append(partitions, fmt.Sprintf("%d %q start=%d size=%d", p.Index, p.Name, p.GetStart(), p.GetSize()))
+	}
+	logger.Log(context.Background(), LevelTrace, "writing partition table", "disk", d.Backend.Path(), "operation", operation, "partitions", partitions)
 }
@@ -2,10 +2,12 @@ package partitionresizer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	iofs "io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,8 +19,8 @@ import (
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
-func TestCreatePartitions(t *testing.T) {
-	// create a disk with GPT partitions, call createPartitions, verify partitions created correctly
+func TestPreparePartitions(t *testing.T) {
+	// create a disk with GPT partitions, call preparePartitions, verify partitions created correctly
 	workDir := t.TempDir()
 	f, err := os.CreateTemp(workDir, "disk.img")
 	if err != nil {
@@ -91,9 +93,9 @@ func TestCreatePartitions(t *testing.T) {
 			},
 		},
 	}
-	// call createPartitions
-	if err := createPartitions(d, resizes); err != nil {
-		t.Fatalf("createPartitions failed: %v", err)
+	// call preparePartitions
+	if _, err := preparePartitions(slog.Default(), nil, d, resizes); err != nil {
+		t.Fatalf("preparePartitions failed: %v", err)
 	}
 	// verify partitions created
 	tableRaw, err := d.GetPartitionTable()
@@ -221,7 +223,7 @@ func TestRemovePartitions(t *testing.T) {
 	}
 
 	// call removePartitions
-	if err := removePartitions(d, resizes); err != nil {
+	if err := removePartitions(slog.Default(), d, resizes); err != nil {
 		t.Fatalf("removePartitions failed: %v", err)
 	}
 	// verify partitions removed
@@ -293,7 +295,7 @@ func TestRemoveAndRenumberPartitions(t *testing.T) {
 		},
 	}
 
-	if err := removeAndRenumberPartitions(d, resizes); err != nil {
+	if err := removeAndRenumberPartitions(slog.Default(), d, resizes); err != nil {
 		t.Fatalf("removeAndRenumberPartitions failed: %v", err)
 	}
 
@@ -414,7 +416,7 @@ func TestCopyFilesystems(t *testing.T) {
 		t.Fatalf("failed to write updated partition table: %v", err)
 	}
 	// call copyFilesystems
-	if err := copyFilesystems(d, resizes); err != nil {
+	if err := copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1); err != nil {
 		t.Fatalf("copyFilesystems failed: %v", err)
 	}
 	// get old FS
@@ -600,7 +602,7 @@ func TestCopyFilesystemsRawCopy(t *testing.T) {
 			},
 		},
 	}
-	if err := copyFilesystems(d, resizes); err != nil {
+	if err := copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1); err != nil {
 		t.Fatalf("copyFilesystems failed: %v", err)
 	}
 
@@ -693,7 +695,7 @@ func TestSwapPartitions(t *testing.T) {
 			target:   partitionData{number: 3},
 		},
 	}
-	if err := swapPartitions(d, resizes); err != nil {
+	if err := swapPartitions(slog.Default(), d, resizes); err != nil {
 		t.Fatalf("swapPartitions failed: %v", err)
 	}
 
@@ -814,7 +816,7 @@ func TestShrinkFilesystems(t *testing.T) {
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
 		called := false
-		execResize2fs = func(_ string, _ int64, _ bool) error {
+		execResize2fs = func(_ context.Context, _ string, _ int64, _ bool) error {
 			called = true
 			return nil
 		}
@@ -824,7 +826,7 @@ func TestShrinkFilesystems(t *testing.T) {
 				target:   partitionData{size: ext4Size},
 			},
 		}
-		if err := shrinkFilesystems(d, resizes, false); err != nil {
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("shrinkFilesystems failed: %v", err)
 		}
 		if called {
@@ -836,7 +838,7 @@ func TestShrinkFilesystems(t *testing.T) {
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
 		called := false
-		execResize2fs = func(_ string, _ int64, _ bool) error {
+		execResize2fs = func(_ context.Context, _ string, _ int64, _ bool) error {
 			called = true
 			return nil
 		}
@@ -846,7 +848,7 @@ func TestShrinkFilesystems(t *testing.T) {
 				target:   partitionData{size: ext4Size + 8*MB},
 			},
 		}
-		if err := shrinkFilesystems(d, resizes, false); err != nil {
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("shrinkFilesystems failed: %v", err)
 		}
 		if called {
@@ -859,7 +861,7 @@ func TestShrinkFilesystems(t *testing.T) {
 		defer func() { execResize2fs = orig }()
 		var gotPartDevice string
 		var gotMB int64
-		execResize2fs = func(partDevice string, newSizeMB int64, _ bool) error {
+		execResize2fs = func(_ context.Context, partDevice string, newSizeMB int64, _ bool) error {
 			gotPartDevice = partDevice
 			gotMB = newSizeMB
 			return nil
@@ -871,7 +873,7 @@ func TestShrinkFilesystems(t *testing.T) {
 				target:   partitionData{size: targetSize},
 			},
 		}
-		if err := shrinkFilesystems(d, resizes, false); err != nil {
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
 			t.Fatalf("shrinkFilesystems failed: %v", err)
 		}
 		if gotPartDevice == "" {
@@ -886,7 +888,7 @@ func TestShrinkFilesystems(t *testing.T) {
 	t.Run("propagates resize2fs error", func(t *testing.T) {
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
-		execResize2fs = func(_ string, _ int64, _ bool) error {
+		execResize2fs = func(_ context.Context, _ string, _ int64, _ bool) error {
 			return fmt.Errorf("simulated resize failure")
 		}
 		resizes := []partitionResizeTarget{
@@ -895,7 +897,7 @@ func TestShrinkFilesystems(t *testing.T) {
 				target:   partitionData{size: ext4Size - 8*MB},
 			},
 		}
-		err := shrinkFilesystems(d, resizes, false)
+		err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false)
 		if err == nil {
 			t.Fatal("expected error from shrinkFilesystems when resize2fs fails")
 		}
@@ -923,7 +925,7 @@ func TestShrinkFilesystems(t *testing.T) {
 				target:   partitionData{size: 20 * MB},
 			},
 		}
-		err := shrinkFilesystems(d, resizes, false)
+		err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false)
 		if err == nil {
 			t.Fatal("expected error for non-ext4 source partition")
 		}
@@ -933,13 +935,13 @@ func TestShrinkFilesystems(t *testing.T) {
 	})
 }
 
-// TestUpdatePartitions verifies the idempotent finalize step: relocated copies
+// TestCommitPartitions verifies the idempotent commit step: relocated copies
 // take on their originals' identities (and, with preserveNumbers, their
 // numbers), the originals are removed, and re-running is a no-op. The input
 // models the state right after copyFilesystems: the originals (2, 3) still
 // carry the real identities at their old locations, and the relocated copies
 // (5, 6) carry the alternate "<label>_resized2" identities at new locations.
-func TestUpdatePartitions(t *testing.T) {
+func TestCommitPartitions(t *testing.T) {
 	const sector = 512
 	// layout in sectors (Start is an LBA; Size is in bytes for gpt.Partition)
 	const (
@@ -996,10 +998,10 @@ func TestUpdatePartitions(t *testing.T) {
 			}
 
 			// (idempotency across a re-run is covered end-to-end by
-			// TestRunResumeAfterInterruption/*/afterUpdatePartitions, which uses
+			// TestRunResumeAfterInterruption/*/afterCommitPartitions, which uses
 			// a fresh disk handle as a real resume does.)
-			if err := updatePartitions(d, resizes, preserveNumbers); err != nil {
-				t.Fatalf("updatePartitions failed: %v", err)
+			if err := commitPartitions(context.Background(), slog.Default(), nil, d, resizes, preserveNumbers); err != nil {
+				t.Fatalf("commitPartitions failed: %v", err)
 			}
 
 			tableRaw, err := d.GetPartitionTable()
@@ -1060,3 +1062,258 @@ func TestUpdatePartitions(t *testing.T) {
 		})
 	}
 }
+
+// TestResizeRemovesCreatedPartitions verifies that when a copy fails, resize
+// removes the partitions it created itself, but not one an earlier run left
+// behind, and journals the partitions as no longer prepared.
+func TestResizeRemovesCreatedPartitions(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap := partitionData{number: 1, label: "swap", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	data := partitionData{number: 2, label: "data", start: 9 * MB, size: 8 * MB, end: 17*MB - 1}
+	leftover := partitionData{number: 4, label: getAlternateLabel(data.label), start: 40 * MB, size: 16 * MB, end: 56*MB - 1}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(swap.start / sectorSize), Size: uint64(swap.size), Type: gpt.LinuxSwap, Name: swap.label},
+			{Index: 2, Start: uint64(data.start / sectorSize), Size: uint64(data.size), Type: gpt.LinuxFilesystem, Name: data.label},
+			// the new partition for data, created by an earlier, interrupted run
+			{Index: 4, Start: uint64(leftover.start / sectorSize), Size: uint64(leftover.size), Type: gpt.LinuxFilesystem, Name: leftover.label},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, 4096)
+	copy(page[4096-swapSignatureLen:], swapSignature)
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(page, swap.start); err != nil {
+		t.Fatal(err)
+	}
+
+	resizes := []partitionResizeTarget{
+		{original: swap, target: partitionData{number: 3, label: getAlternateLabel(swap.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}},
+		{original: data, target: leftover},
+	}
+	j, err := newJournal(filepath.Join(t.TempDir(), "journal.json"), diskPath, table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("mkswap failed")
+	orig := execMkswap
+	defer func() { execMkswap = orig }()
+	execMkswap = func(context.Context, string, string, string, int64, int64) error { return failure }
+
+	if err := resize(context.Background(), d, resizes, false, false, Options{}, j, nil); err == nil || !strings.Contains(err.Error(), failure.Error()) {
+		t.Fatalf("resize() error = %v, want %v", err, failure)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []int
+	for _, p := range tableRaw.(*gpt.Table).Partitions {
+		if p.Type != gpt.Unused {
+			indexes = append(indexes, p.Index)
+		}
+	}
+	if want := []int{1, 2, 4}; fmt.Sprint(indexes) != fmt.Sprint(want) {
+		t.Errorf("partitions after failed resize = %v, want %v", indexes, want)
+	}
+	if j.done(PhasePreparePartitions) {
+		t.Errorf("journal records %s as completed after its partitions were removed", PhasePreparePartitions)
+	}
+}
+
+// TestResumeRemovesCreatedPartitions verifies that when the copy of a resumed
+// resize fails, the partitions the interrupted run created are removed, and
+// the table is as journaled before the resize.
+func TestResumeRemovesCreatedPartitions(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	swap := partitionData{number: 1, label: "swap", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	data := partitionData{number: 2, label: "data", start: 9 * MB, size: 8 * MB, end: 17*MB - 1}
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(swap.start / sectorSize), Size: uint64(swap.size), Type: gpt.LinuxSwap, Name: swap.label},
+		{Index: 2, Start: uint64(data.start / sectorSize), Size: uint64(data.size), Type: gpt.LinuxFilesystem, Name: data.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, 4096)
+	copy(page[4096-swapSignatureLen:], swapSignature)
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(page, swap.start); err != nil {
+		t.Fatal(err)
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{
+		{original: swap, target: partitionData{number: 3, label: getAlternateLabel(swap.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}},
+		{original: data, target: partitionData{number: 4, label: getAlternateLabel(data.label), start: 40 * MB, size: 16 * MB, end: 56*MB - 1}},
+	}
+	j, err := newJournal(filepath.Join(t.TempDir(), "journal.json"), diskPath, table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the interrupted run prepared the partitions before it stopped
+	if err := j.runPhase(PhasePreparePartitions, func() error {
+		_, err := preparePartitions(slog.Default(), nil, d, resizes)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("mkswap failed")
+	orig := execMkswap
+	defer func() { execMkswap = orig }()
+	execMkswap = func(context.Context, string, string, string, int64, int64) error { return failure }
+
+	if err := resize(context.Background(), d, resizes, false, false, Options{}, j, nil); err == nil || !strings.Contains(err.Error(), failure.Error()) {
+		t.Fatalf("resize() error = %v, want %v", err, failure)
+	}
+	if table, err = readGPT(d); err != nil {
+		t.Fatal(err)
+	}
+	var indexes []int
+	for _, p := range table.Partitions {
+		if p.Type != gpt.Unused {
+			indexes = append(indexes, p.Index)
+		}
+	}
+	if want := []int{1, 2}; fmt.Sprint(indexes) != fmt.Sprint(want) {
+		t.Errorf("partitions after failed resumed resize = %v, want %v", indexes, want)
+	}
+	if j.done(PhasePreparePartitions) {
+		t.Errorf("journal records %s as completed after its partitions were removed", PhasePreparePartitions)
+	}
+}
+
+// cancelOnCopy is a ProgressReporter that cancels the resize as its first copy
+// starts.
+type cancelOnCopy struct {
+	nopProgress
+	cancel context.CancelFunc
+}
+
+func (c cancelOnCopy) CopyStarted(int, int, int) {
+	c.cancel()
+}
+
+func TestResizeCancelled(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resizes := []partitionResizeTarget{{original: original, target: target}}
+	j, err := newJournal(filepath.Join(t.TempDir(), "journal.json"), diskPath, tableRaw.(*gpt.Table), resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = resize(ctx, d, resizes, false, false, Options{Progress: cancelOnCopy{cancel: cancel}}, j, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("resize() error = %v, want it cancelled", err)
+	}
+	// the partition created for the copy is removed, and the journal left
+	// to resume from before it was created
+	tableRaw, err = d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var starts []int64
+	for _, p := range tableRaw.(*gpt.Table).Partitions {
+		if p.Type != gpt.Unused {
+			starts = append(starts, int64(p.Start)*512)
+		}
+	}
+	if len(starts) != 1 || starts[0] != original.start {
+		t.Errorf("partitions after cancelled resize start at %v, want only %d", starts, original.start)
+	}
+	if !j.done(PhaseShrinkFilesystems) || j.done(PhasePreparePartitions) || j.done(PhaseCopy) {
+		t.Errorf("journal records %v as completed, want only %s", j.Completed, PhaseShrinkFilesystems)
+	}
+
+	// a resize cancelled before it starts changes nothing
+	if err := resize(ctx, d, resizes, false, false, Options{}, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("resize() with a cancelled context = %v, want it cancelled", err)
+	}
+}
+
+// A partition table about to be written is logged at LevelTrace, with the
+// partitions in it, and not at all above it.
+func TestTraceTableWrite(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+	})
+	backend, err := file.OpenFromPath(diskPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, ok := d.Table.(*gpt.Table)
+	if !ok {
+		t.Fatalf("table is %T, want GPT", d.Table)
+	}
+	var out bytes.Buffer
+	traceTableWrite(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})), d, table, auditCommitPartitions)
+	if out.Len() != 0 {
+		t.Errorf("logged %q at slog.LevelDebug, want nothing", out.String())
+	}
+	traceTableWrite(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: LevelTrace})), d, table, auditCommitPartitions)
+	want := fmt.Sprintf(`1 \"data\" start=%d size=%d`, 1*MB, 8*MB)
+	if log := out.String(); !strings.Contains(log, "writing partition table") || !strings.Contains(log, auditCommitPartitions) || !strings.Contains(log, want) {
+		t.Errorf("logged %q, want the write and %s", log, want)
+	}
+}
@@ -0,0 +1,225 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Result describes what Run did: each partition resized, with its geometry
+// before and after and how much of it was copied, each phase run and how long
+// it took, the outcome of checking each resized filesystem, and anything that
+// was worked around along the way. Durations are in nanoseconds in JSON.
+type Result struct {
+	Disk       string            `json:"disk"`
+	DryRun     bool              `json:"dryRun,omitempty"`
+	Partitions []PartitionResult `json:"partitions"`
+	Phases     []PhaseResult     `json:"phases,omitempty"`
+	Checks     []CheckResult     `json:"checks,omitempty"`
+	// ESP is the validation of each EFI System Partition copied to a new
+	// location.
+	ESP []ESPResult `json:"esp,omitempty"`
+	// Snapshot is the metadata snapshot taken before the resize, see
+	// Options.SnapshotDir.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Warnings are the problems the resize logged at level Warn or above
+	// and carried on regardless.
+	Warnings []string `json:"warnings,omitempty"`
+	// Estimate is how much work the resize is, for a dry run, see Estimate.
+	Estimate *PlanEstimate `json:"estimate,omitempty"`
+	// Problems are the steps a dry run found the resize would fail at, see
+	// DryRunError.
+	Problems []DryRunProblem `json:"problems,omitempty"`
+	// Tools are the external tools run, such as e2fsck and resize2fs, in
+	// the order they were run, with all they wrote.
+	Tools    []ToolRun     `json:"tools,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// PartitionResult is the resize of a single partition.
+type PartitionResult struct {
+	Label    string            `json:"label"`
+	Original PartitionGeometry `json:"original"`
+	Final    PartitionGeometry `json:"final"`
+	// Moved is set if the partition was copied to a new location, rather
+	// than shrunk or grown where it was.
+	Moved       bool  `json:"moved"`
+	BytesCopied int64 `json:"bytesCopied,omitempty"`
+	// SHA256 is the SHA-256 digests, in hex, of the copy of a partition
+	// copied byte for byte and verified in full, one for each stripe it
+	// was copied in, see DigestReporter.
+	SHA256 []string `json:"sha256,omitempty"`
+	// Type is the GPT partition type the partition is given, if it is
+	// retyped, see WithPartitionType.
+	Type string `json:"type,omitempty"`
+}
+
+// PartitionGeometry is where a partition is on the disk, in bytes. End is its
+// last byte.
+type PartitionGeometry struct {
+	Number int   `json:"number"`
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+	Size   int64 `json:"size"`
+}
+
+// PhaseResult is a phase of the resize, one of the Phase constants.
+type PhaseResult struct {
+	Phase    string        `json:"phase"`
+	Duration time.Duration `json:"duration"`
+	// Resumed is set if the phase was completed by an earlier run, as
+	// recorded in the journal, and not run again.
+	Resumed bool   `json:"resumed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ToolRun is an external tool run during the resize.
+type ToolRun struct {
+	Name     string        `json:"name"`
+	Args     []string      `json:"args"`
+	Duration time.Duration `json:"duration"`
+	// Output is what the tool wrote to stdout and stderr, interleaved.
+	Output string `json:"output,omitempty"`
+	// Error is set if the tool failed, e.g. "exit status 1".
+	Error string `json:"error,omitempty"`
+	// NotFound is set if the tool was not run as it is not installed.
+	NotFound bool `json:"notFound,omitempty"`
+}
+
+// CheckOutcome is the outcome of checking a resized filesystem.
+type CheckOutcome string
+
+const (
+	CheckPassed  CheckOutcome = "passed"
+	CheckFailed  CheckOutcome = "failed"
+	CheckSkipped CheckOutcome = "skipped"
+)
+
+// CheckResult is the outcome of checking a filesystem once the resize is
+// complete. Partition is 0 when no filesystem on the disk could be checked.
+type CheckResult struct {
+	Partition  int          `json:"partition"`
+	Filesystem string       `json:"filesystem,omitempty"`
+	Outcome    CheckOutcome `json:"outcome"`
+	Detail     string       `json:"detail,omitempty"`
+}
+
+// problem describes a failed check, for FilesystemCheckError.
+func (c CheckResult) problem() string {
+	switch {
+	case c.Partition == 0:
+		return c.Detail
+	case c.Filesystem == "":
+		return fmt.Sprintf("partition %d: %s", c.Partition, c.Detail)
+	default:
+		return fmt.Sprintf("partition %d (%s): %s", c.Partition, c.Filesystem, c.Detail)
+	}
+}
+
+// newResult returns the Result of resizes of disk, as planned, before any is
+// performed.
+func newResult(disk string, resizes []partitionResizeTarget, preserveNumbers bool) *Result {
+	res := &Result{Disk: disk, Partitions: []PartitionResult{}}
+	for _, r := range resizes {
+		moved := r.original.start != r.target.start
+		final := r.target
+		if moved && preserveNumbers {
+			final.number = r.original.number
+		}
+		res.Partitions = append(res.Partitions, PartitionResult{
+			Label:    r.original.label,
+			Original: *r.original.geometry(),
+			Final:    *final.geometry(),
+			Moved:    moved,
+			Type:     string(r.partitionType),
+		})
+	}
+	return res
+}
+
+// addPhase records a phase run, or skipped as resumed, on res, which may be
+// nil.
+func (res *Result) addPhase(phase string, duration time.Duration, resumed bool, err error) {
+	if res == nil {
+		return
+	}
+	p := PhaseResult{Phase: phase, Duration: duration, Resumed: resumed}
+	if err != nil {
+		p.Error = err.Error()
+	}
+	res.Phases = append(res.Phases, p)
+}
+
+// resultProgress is a ProgressReporter that records the bytes copied, and the
+// digests, of each partition on res, and passes everything on to the ProgressReporter it
+// embeds.
+type resultProgress struct {
+	ProgressReporter
+	res *Result
+}
+
+func (p resultProgress) BytesCopied(partition int, copied, total int64) {
+	for i := range p.res.Partitions {
+		if p.res.Partitions[i].Original.Number == partition {
+			p.res.Partitions[i].BytesCopied = copied
+		}
+	}
+	p.ProgressReporter.BytesCopied(partition, copied, total)
+}
+
+func (p resultProgress) TotalBytesCopied(copied, total int64) {
+	reportTotal(p.ProgressReporter, copied, total)
+}
+
+func (p resultProgress) CopyDigests(partition int, digests []string) {
+	for i := range p.res.Partitions {
+		if p.res.Partitions[i].Original.Number == partition {
+			p.res.Partitions[i].SHA256 = digests
+		}
+	}
+	reportDigests(p.ProgressReporter, partition, digests)
+}
+
+// warningHandler is a slog.Handler that records the message of each record
+// at level Warn or above on warnings, and passes every record on to the
+// handler it embeds.
+type warningHandler struct {
+	slog.Handler
+	mu       *sync.Mutex
+	warnings *[]string
+}
+
+func newWarningHandler(h slog.Handler, warnings *[]string) *warningHandler {
+	return &warningHandler{Handler: h, mu: &sync.Mutex{}, warnings: warnings}
+}
+
+func (h *warningHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h *warningHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		warning := r.Message
+		r.Attrs(func(a slog.Attr) bool {
+			warning += fmt.Sprintf(" %s=%v", a.Key, a.Value)
+			return true
+		})
+		h.mu.Lock()
+		*h.warnings = append(*h.warnings, warning)
+		h.mu.Unlock()
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *warningHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningHandler{Handler: h.Handler.WithAttrs(attrs), mu: h.mu, warnings: h.warnings}
+}
+
+func (h *warningHandler) WithGroup(name string) slog.Handler {
+	return &warningHandler{Handler: h.Handler.WithGroup(name), mu: h.mu, warnings: h.warnings}
+}
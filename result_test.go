@@ -0,0 +1,87 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestResizeResult(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, preserveNumbers := range []bool{false, true} {
+		resizes := []partitionResizeTarget{{original: original, target: target}}
+		res := newResult(diskPath, resizes, preserveNumbers)
+		want := PartitionGeometry{Number: 2, Start: 20 * MB, End: 36*MB - 1, Size: 16 * MB}
+		if preserveNumbers {
+			want.Number = 1
+		}
+		if p := res.Partitions[0]; !p.Moved || p.Final != want || p.Original != (PartitionGeometry{Number: 1, Start: 1 * MB, End: 9*MB - 1, Size: 8 * MB}) {
+			t.Errorf("newResult(preserveNumbers %v) partition = %+v, want moved to %+v", preserveNumbers, p, want)
+		}
+	}
+
+	res := newResult(diskPath, []partitionResizeTarget{{original: original, target: target}}, false)
+	if err := resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, Options{}, nil, res); err != nil {
+		t.Fatalf("resize() error: %v", err)
+	}
+	var phases []string
+	for _, p := range res.Phases {
+		phases = append(phases, p.Phase)
+		if p.Resumed || p.Error != "" {
+			t.Errorf("phase %+v, want it run without error", p)
+		}
+	}
+	if want := []string{PhaseShrinkFilesystems, PhasePreparePartitions, PhaseCopy, PhaseValidate, PhaseCommitPartitions, PhaseGrowFilesystems, PhaseCheckFilesystems}; !reflect.DeepEqual(phases, want) {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+	if copied := res.Partitions[0].BytesCopied; copied != original.size {
+		t.Errorf("bytes copied = %d, want %d", copied, original.size)
+	}
+	// the copy holds no filesystem to check
+	if want := []CheckResult{{Partition: 2, Outcome: CheckSkipped, Detail: "no recognized filesystem"}}; !reflect.DeepEqual(res.Checks, want) {
+		t.Errorf("checks = %+v, want %+v", res.Checks, want)
+	}
+}
+
+// Warnings are recorded whatever the level of the handler, which still
+// filters what it writes
+func TestWarningHandler(t *testing.T) {
+	var out bytes.Buffer
+	var warnings []string
+	logger := slog.New(newWarningHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelError}), &warnings))
+	logger.Info("copying partition", "partition", 1)
+	logger.With("disk", "/dev/sda").Warn("failed to flush disk", "error", "EIO")
+	if want := []string{"failed to flush disk error=EIO"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+	if out.Len() != 0 {
+		t.Errorf("handler below its level wrote %q", out.String())
+	}
+	logger.Error("failed to thaw filesystem")
+	if len(warnings) != 2 || !strings.Contains(out.String(), "failed to thaw filesystem") {
+		t.Errorf("error not recorded and written: warnings %q, log %q", warnings, out.String())
+	}
+}
@@ -1,6 +1,8 @@
 package partitionresizer
 
 import (
+	"context"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"testing"
@@ -17,10 +19,9 @@ import (
 // point.
 const (
 	stepShrinkFilesystems = iota + 1
-	stepShrinkPartitions
-	stepCreatePartitions
+	stepPreparePartitions
 	stepCopyFilesystems
-	stepUpdatePartitions // idempotent finalize: relabel/reindex + delete original
+	stepCommitPartitions // idempotent cutover: relabel/reindex + delete original
 )
 
 // runResizeStepsUpTo replays resize()'s pipeline against a freshly planned
@@ -56,7 +57,7 @@ func runResizeStepsUpTo(t *testing.T, path string, shrink PartitionIdentifier, g
 		t.Fatalf("findDisks: %v", err)
 	}
 	parts := disks[filepath.Base(path)]
-	resizes, err := planResizes(d, table, parts, grow, &shrink)
+	resizes, err := planResizes(d, table, parts, grow, []PartitionIdentifier{shrink}, Options{})
 	if err != nil {
 		t.Fatalf("planResizes: %v", err)
 	}
@@ -65,11 +66,14 @@ func runResizeStepsUpTo(t *testing.T, path string, shrink PartitionIdentifier, g
 		name string
 		fn   func() error
 	}{
-		{"shrinkFilesystems", func() error { return shrinkFilesystems(d, resizes, false) }},
-		{"shrinkPartitions", func() error { return shrinkPartitions(d, resizes) }},
-		{"createPartitions", func() error { return createPartitions(d, resizes) }},
-		{"copyFilesystems", func() error { return copyFilesystems(d, resizes) }},
-		{"updatePartitions", func() error { return updatePartitions(d, resizes, preserveNumbers) }},
+		{"shrinkFilesystems", func() error { return shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false) }},
+		{"preparePartitions", func() error { _, err := preparePartitions(slog.Default(), nil, d, resizes); return err }},
+		{"copyFilesystems", func() error {
+			return copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1)
+		}},
+		{"commitPartitions", func() error {
+			return commitPartitions(context.Background(), slog.Default(), nil, d, resizes, preserveNumbers)
+		}},
 	}
 	for i := 0; i < stopAfter && i < len(steps); i++ {
 		if err := steps[i].fn(); err != nil {
@@ -102,7 +106,7 @@ func runResizeStepsUpTo(t *testing.T, path string, shrink PartitionIdentifier, g
 				}
 				if writeExtraFile {
 					// Leave a stale file behind so the target is non-empty and
-					// does NOT match the source: CompareFS must report the
+					// does NOT match the source: compareFileSystems must report the
 					// difference and the resume must reformat+recopy (the stale
 					// file must be gone in the final result).
 					fh, err := newFS.OpenFile("/resume-junk.bin", os.O_CREATE|os.O_RDWR)
@@ -151,25 +155,24 @@ func TestRunResumeAfterInterruption(t *testing.T) {
 		writeExtraFile bool
 	}{
 		{name: "afterShrinkFilesystems", stopAfter: stepShrinkFilesystems},
-		{name: "afterShrinkPartitions", stopAfter: stepShrinkPartitions},
 		{
-			name:      "afterCreatePartitions",
-			stopAfter: stepCreatePartitions,
+			name:      "afterPreparePartitions",
+			stopAfter: stepPreparePartitions,
 		},
 		{
 			// crash mid-copy: target fs created but empty, so resume must
 			// CreateFilesystem over an already-formatted partition, then copy.
 			name:                "midCopyTargetFsCreated",
-			stopAfter:           stepCreatePartitions,
+			stopAfter:           stepPreparePartitions,
 			formatTargetsNoCopy: true,
 		},
 		{
 			// crash mid-copy with a non-empty, mismatched target (a stale file
-			// from a prior run): CompareFS reports the difference, so resume
+			// from a prior run): compareFileSystems reports the difference, so resume
 			// reformats over the populated fs and recopies; the stale file is
 			// gone in the final result.
 			name:                "midCopyTargetFsHasStaleFile",
-			stopAfter:           stepCreatePartitions,
+			stopAfter:           stepPreparePartitions,
 			formatTargetsNoCopy: true,
 			writeExtraFile:      true,
 		},
@@ -179,10 +182,10 @@ func TestRunResumeAfterInterruption(t *testing.T) {
 		},
 		{
 			// the whole resize completed, then the tool was re-run: the
-			// idempotent updatePartitions plus the "already at target size"
+			// idempotent commitPartitions plus the "already at target size"
 			// short-circuit in planResizes must make this a no-op.
-			name:      "afterUpdatePartitions",
-			stopAfter: stepUpdatePartitions,
+			name:      "afterCommitPartitions",
+			stopAfter: stepCommitPartitions,
 		},
 	}
 
@@ -204,7 +207,7 @@ func TestRunResumeAfterInterruption(t *testing.T) {
 				runResizeStepsUpTo(t, tmpFile, shrink, grow, preserveNumbers, tc.stopAfter, tc.formatTargetsNoCopy, tc.writeExtraFile)
 
 				// resume: a fresh Run() must finish the resize correctly
-				if err := Run(tmpFile, &shrink, grow, false, false, preserveNumbers); err != nil {
+				if _, err := Run(tmpFile, []PartitionIdentifier{shrink}, grow, Options{PreserveNumbers: preserveNumbers}); err != nil {
 					t.Fatalf("resume Run failed: %v", err)
 				}
 
@@ -353,7 +356,7 @@ func TestRunAbortsOnFsckFailure(t *testing.T) {
 
 	// fixErrors=false: e2fsck -n must refuse the corrupt fs and the resize must
 	// abort before touching the partition layout.
-	err := Run(tmpFile, &shrink, grow, false, false, false)
+	_, err := Run(tmpFile, []PartitionIdentifier{shrink}, grow, Options{})
 	if err == nil {
 		t.Fatal("expected Run to fail on a corrupt shrink filesystem, got nil")
 	}
@@ -0,0 +1,45 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCopyResyncs is how many times a raw copy that does not match its source
+// is re-synced, see resyncWriter, before it fails.
+const maxCopyResyncs = 2
+
+// resyncWriter is an io.WriterAt for a copy already written once, that reads
+// back what is at each offset written to from r, the device, and writes p,
+// through the io.WriterAt it embeds, only should it differ, so that a copy
+// gone wrong in a few places is put right in those places rather than
+// written all over again. It counts the bytes it rewrites.
+type resyncWriter struct {
+	io.WriterAt
+	r io.ReaderAt
+	// bufs holds the buffers what is at each offset is read into, one for
+	// each stripe writing at once
+	bufs      sync.Pool
+	rewritten atomic.Int64
+}
+
+func newResyncWriter(w io.WriterAt, r io.ReaderAt) *resyncWriter {
+	return &resyncWriter{WriterAt: w, r: r}
+}
+
+func (w *resyncWriter) WriteAt(p []byte, off int64) (int, error) {
+	buf, _ := w.bufs.Get().(*[]byte)
+	if buf == nil || len(*buf) < len(p) {
+		b := make([]byte, len(p))
+		buf = &b
+	}
+	defer w.bufs.Put(buf)
+	// what cannot be read back is rewritten
+	if n, err := w.r.ReadAt((*buf)[:len(p)], off); n == len(p) && (err == nil || err == io.EOF) && bytes.Equal((*buf)[:len(p)], p) {
+		return len(p), nil
+	}
+	w.rewritten.Add(int64(len(p)))
+	return w.WriterAt.WriteAt(p, off)
+}
@@ -0,0 +1,94 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// flakyStorage is a backend whose first write at corruptAt flips its first
+// byte, and that records the offset of each write in writes.
+type flakyStorage struct {
+	backend.Storage
+	corruptAt int64
+	writes    *[]int64
+}
+
+type flakyFile struct {
+	backend.WritableFile
+	s flakyStorage
+}
+
+func (s flakyStorage) Writable() (backend.WritableFile, error) {
+	w, err := s.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	return flakyFile{WritableFile: w, s: s}, nil
+}
+
+func (f flakyFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == f.s.corruptAt && !slices.Contains(*f.s.writes, off) {
+		p = bytes.Clone(p)
+		p[0] ^= 0xff
+	}
+	*f.s.writes = append(*f.s.writes, off)
+	return f.WritableFile.WriteAt(p, off)
+}
+
+// TestCopyPartitionRawResync copies a partition whose second buffer is
+// written wrong, and checks that the copy, once it fails verification, is put
+// right by writing that buffer again, and none other.
+func TestCopyPartitionRawResync(t *testing.T) {
+	for _, verify := range []VerifyMode{VerifyFull, VerifySampled} {
+		t.Run(string(verify), func(t *testing.T) {
+			r := partitionResizeTarget{
+				original: partitionData{number: 1, start: 1 * MB, size: 12 * MB},
+				target:   partitionData{number: 2, start: 16 * MB, size: 12 * MB},
+				verify:   verify,
+			}
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			data := make([]byte, 32*MB)
+			for i := r.original.start; i < r.original.start+r.original.size; i++ {
+				data[i] = byte(i%251 + 1)
+			}
+			if err := os.WriteFile(diskPath, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			storage, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = storage.Close() }()
+			var writes []int64
+			// sampled verification always compares the first extent
+			corruptAt := r.target.start + copyBufSize
+			if verify == VerifySampled {
+				corruptAt = r.target.start
+			}
+			d := &disk.Disk{Backend: flakyStorage{Storage: storage, corruptAt: corruptAt, writes: &writes}}
+			if err := copyPartitionRaw(context.Background(), slog.Default(), d, r, nopProgress{}); err != nil {
+				t.Fatalf("copyPartitionRaw() error: %v", err)
+			}
+			got, err := os.ReadFile(diskPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[r.target.start:r.target.start+r.original.size], data[r.original.start:r.original.start+r.original.size]) {
+				t.Error("re-synced copy differs from its source")
+			}
+			// the 3 buffers of the copy, and the one re-synced
+			if want := []int64{r.target.start, r.target.start + copyBufSize, r.target.start + 2*copyBufSize, corruptAt}; !slices.Equal(writes, want) {
+				t.Errorf("copyPartitionRaw() wrote at %v, want %v", writes, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+)
+
+// TypedPartitionChange is a PartitionChange that also gives the partition a
+// new GPT partition type, see WithPartitionType.
+type TypedPartitionChange interface {
+	PartitionChange
+	// PartitionType is the type GUID the partition is given, e.g.
+	// 4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709.
+	PartitionType() string
+}
+
+// WithPartitionType returns change, also giving the partition it grows the
+// GPT partition type partType, a type GUID: e.g. gpt.LinuxRootX86_64, to turn
+// a generic Linux filesystem partition into the root partition the
+// Discoverable Partitions Specification has systemd find. The partition is
+// retyped in the partition table write that commits its resize, so that it is
+// never seen with its new type but its old geometry: the cutover, for one
+// copied to a new location, whose copy is given the type in place of its
+// original's, which is also the write that grows one in place. A change to a
+// partition the resize does not grow or move retypes nothing, and is warned
+// of.
+func WithPartitionType(change PartitionChange, partType string) PartitionChange {
+	return &typedPartitionChange{PartitionChange: change, partType: partType}
+}
+
+type typedPartitionChange struct {
+	PartitionChange
+	partType string
+}
+
+func (c *typedPartitionChange) PartitionType() string {
+	return c.partType
+}
+
+// markPartitionTypes marks each partition of resizes of disk grown or moved
+// that one of growPartitions, a TypedPartitionChange, identifies to be given
+// its type, see WithPartitionType, returning an error should the type not be
+// a GUID.
+func markPartitionTypes(logger *slog.Logger, disk string, resizes []partitionResizeTarget, growPartitions []PartitionChange) error {
+	for _, gp := range growPartitions {
+		tc, ok := gp.(TypedPartitionChange)
+		if !ok || tc.PartitionType() == "" {
+			continue
+		}
+		partType, err := parsePartitionType(tc.PartitionType())
+		if err != nil {
+			return fmt.Errorf("partition %s=%s: %w", gp.By(), gp.Value(), err)
+		}
+		matched := false
+		for i, r := range resizes {
+			if !r.original.matches(gp) {
+				continue
+			}
+			matched = true
+			if r.original.start == r.target.start && !r.inPlace {
+				logger.Warn("partition not grown or moved, not retyping it", "disk", disk, "partition", r.original.number, "label", r.original.label, "type", partType)
+				continue
+			}
+			resizes[i].partitionType = partType
+		}
+		if !matched {
+			logger.Warn("partition to retype not found among those resized", "disk", disk, "partition", fmt.Sprintf("%s=%s", gp.By(), gp.Value()), "type", partType)
+		}
+	}
+	return nil
+}
+
+// parsePartitionType returns the GPT partition type s, a type GUID, in upper
+// case, as the GPT has them.
+func parsePartitionType(s string) (gpt.Type, error) {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid partition type GUID %s: %v", s, err)
+	}
+	if id == uuid.Nil {
+		return "", fmt.Errorf("partition type GUID %s is that of an unused entry", s)
+	}
+	return gpt.Type(strings.ToUpper(id.String())), nil
+}
@@ -0,0 +1,108 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestPartitionTypes retypes a partition copied to a new location and one
+// grown in place, as their resizes are committed, warning of one not grown
+// and one not resized, and rejects a type that is not a GUID.
+func TestPartitionTypes(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "rootfs", GUID: espGUID},
+		{Index: 2, Start: 9 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "home"},
+		{Index: 3, Start: 17 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 4, Start: 33 * MB / 512, Size: 12 * MB, Type: gpt.LinuxFilesystem, Name: getAlternateLabel("rootfs")},
+	})
+	resizes := []partitionResizeTarget{
+		{original: partitionData{number: 1, label: "rootfs", start: 1 * MB, size: 8 * MB}, target: partitionData{number: 4, start: 33 * MB, size: 12 * MB}},
+		{original: partitionData{number: 2, label: "home", start: 9 * MB, size: 8 * MB}, target: partitionData{number: 2, start: 9 * MB, size: 6 * MB}},
+		{original: partitionData{number: 3, label: "data", start: 17 * MB, size: 8 * MB}, target: partitionData{number: 3, start: 17 * MB, size: 16 * MB}, inPlace: true},
+	}
+	grows := []PartitionChange{
+		WithPartitionType(NewMaxPartitionChange(IdentifierByLabel, "rootfs"), strings.ToLower(string(gpt.LinuxRootX86_64))),
+		WithPartitionType(NewPartitionChange(IdentifierByLabel, "home", 6*MB), string(gpt.LinuxHome)),
+		WithPartitionType(NewPartitionChange(IdentifierByLabel, "data", 16*MB), string(gpt.LinuxServerData)),
+		WithPartitionType(NewPartitionChange(IdentifierByLabel, "swap", 4*MB), string(gpt.LinuxSwap)),
+		NewPartitionChange(IdentifierByLabel, "rootfs", 12*MB),
+	}
+	var logs bytes.Buffer
+	if err := markPartitionTypes(slog.New(slog.NewTextHandler(&logs, nil)), "disk.img", resizes, grows); err != nil {
+		t.Fatalf("markPartitionTypes() error: %v", err)
+	}
+	for _, want := range []string{"partition=2 label=home", `partition="label=swap"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("markPartitionTypes() logged %q, want a warning with %s", logs.String(), want)
+		}
+	}
+	if got := []gpt.Type{resizes[0].partitionType, resizes[1].partitionType, resizes[2].partitionType}; got[0] != gpt.LinuxRootX86_64 || got[1] != "" || got[2] != gpt.LinuxServerData {
+		t.Errorf("markPartitionTypes() marked %q, want rootfs and data retyped, in upper case", got)
+	}
+	if res := newResult("disk.img", resizes, false); res.Partitions[0].Type != string(gpt.LinuxRootX86_64) || res.Partitions[1].Type != "" {
+		t.Errorf("newResult() = %+v, want rootfs retyped", res.Partitions)
+	}
+
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitPartitions(context.Background(), slog.Default(), nil, d, []partitionResizeTarget{resizes[0], resizes[2]}, true); err != nil {
+		t.Fatalf("commitPartitions() error: %v", err)
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]gpt.Type{1: gpt.LinuxRootX86_64, 2: gpt.LinuxFilesystem, 3: gpt.LinuxServerData}
+	for _, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		if typ, ok := want[p.Index]; !ok || p.Type != typ {
+			t.Errorf("partition %d (%s) has type %s, want %s", p.Index, p.Name, p.Type, typ)
+		}
+		if p.Index == 1 && (p.Start != 33*MB/512 || p.GUID != espGUID) {
+			t.Errorf("partition 1 at %d with GUID %s, want the copy at %d with the original's GUID", p.Start, p.GUID, 33*MB/512)
+		}
+		delete(want, p.Index)
+	}
+	if len(want) > 0 {
+		t.Errorf("partitions %v not in the table", want)
+	}
+
+	bad := []PartitionChange{WithPartitionType(NewMaxPartitionChange(IdentifierByLabel, "rootfs"), "root")}
+	if err := markPartitionTypes(slog.Default(), "disk.img", resizes, bad); err == nil || !strings.Contains(err.Error(), "label=rootfs") {
+		t.Errorf("markPartitionTypes() of a type that is not a GUID error = %v, want it named", err)
+	}
+}
+
+// TestPlanPartitionTypes saves the type a grow gives its partition in a plan,
+// and applies it again.
+func TestPlanPartitionTypes(t *testing.T) {
+	p := &Plan{Grow: []PlannedChange{
+		{UUID: espGUID, Size: 12 * MB, Type: string(gpt.LinuxRootX86_64)},
+		{UUID: "11111111-2222-4333-8444-555555555555", Size: 16 * MB},
+	}}
+	_, grows := p.changes()
+	if tc, ok := grows[0].(TypedPartitionChange); !ok || tc.PartitionType() != string(gpt.LinuxRootX86_64) || tc.Size() != 12*MB {
+		t.Errorf("Plan.changes() = %+v, want the first grow retyping its partition", grows[0])
+	}
+	if _, ok := grows[1].(TypedPartitionChange); ok {
+		t.Errorf("Plan.changes() = %+v, want the second grow not retyping its partition", grows[1])
+	}
+}
@@ -0,0 +1,231 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// Rollback undoes a resize recorded in the journal at journalPath by Run with
+// Options.JournalPath, whether it was interrupted or has completed, in which
+// case its journal was moved aside and is found there. It restores the
+// partition table recorded before the resize -- removing the partitions the
+// resize created and giving the originals back their entries and sizes -- and
+// grows each filesystem that was shrunk back to fill its partition: an ext4
+// filesystem, one inside a LUKS container, with Options.LUKSKeyFile, along
+// with its container, or a swap area, which is recreated. It refuses a disk
+// that is not the one journaled, by the GUID of its GPT, or whose partitions
+// are not as journaled, before it changes anything.
+//
+// This relies on the data of the original partitions still being where it
+// was: a relocating resize only ever copies from them, and a shrink leaves the
+// shrunk filesystem in place. A resize that grew a partition in place cannot
+// be rolled back once it has done so, nor can one that wipes or discards the
+// originals once its commit phase has started, see Options.WipeRemoved and
+// Options.Discard. Anything written to the new partitions after the resize is
+// lost. The journal is removed once rolled back.
+func Rollback(journalPath string) error {
+	return RollbackContext(context.Background(), journalPath)
+}
+
+// RollbackContext is Rollback, stopping before the next filesystem it would
+// grow back should ctx be done. The partition table is restored either way; a
+// rollback stopped partway can be run again.
+func RollbackContext(ctx context.Context, journalPath string) error {
+	return RollbackWithOptions(ctx, journalPath, Options{})
+}
+
+// RollbackWithOptions is RollbackContext, with what of opts a journal cannot
+// save, as ResumeWithOptions, of which a rollback uses only the Logger and
+// ExecRunner. The rest of opts is ignored; the resize is rolled back with the
+// options it was journaled with.
+func RollbackWithOptions(ctx context.Context, journalPath string, opts Options) error {
+	return rollback(ctx, journalPath, func(journaled Options) Options { return journaled.withUnsaved(opts) }, "")
+}
+
+// Rollback undoes the resize p applied, as the package Rollback, from the
+// journal at p.Options.JournalPath, which p.Apply kept, with p.Options. It
+// refuses a journal of a disk other than the one p was planned for.
+func (p *Plan) Rollback() error {
+	return p.RollbackContext(context.Background())
+}
+
+// RollbackContext is Rollback, stopping as the package RollbackContext does.
+func (p *Plan) RollbackContext(ctx context.Context) error {
+	if p.Options.JournalPath == "" {
+		return fmt.Errorf("plan for %s has no journal path to roll back from", p.Disk)
+	}
+	return rollback(ctx, p.Options.JournalPath, func(Options) Options { return p.Options }, p.DiskGUID)
+}
+
+// rollback rolls back the resize journaled at journalPath, with the options
+// options returns given those journaled. With diskGUID, the journal must be of
+// the disk whose GPT has that GUID.
+func rollback(ctx context.Context, journalPath string, options func(journaled Options) Options, diskGUID string) error {
+	path := journalPath
+	j, err := readJournal(path)
+	if os.IsNotExist(err) {
+		path = journalPath + completedJournalSuffix
+		j, err = readJournal(path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(j.Table) == 0 {
+		return fmt.Errorf("journal %s records no partition table to roll back to", path)
+	}
+	if diskGUID != "" && j.DiskGUID != "" && !strings.EqualFold(diskGUID, j.DiskGUID) {
+		return fmt.Errorf("journal %s is of disk %s, not %s", path, j.DiskGUID, diskGUID)
+	}
+	opts := options(j.Options)
+	resizes := j.resizes()
+	if number, action := j.lostOriginal(); number != 0 {
+		return fmt.Errorf("original partition %d may have been %s, cannot roll back", number, action)
+	}
+	if j.done(PhaseCommitPartitions) {
+		for _, r := range resizes {
+			if r.inPlace {
+				return fmt.Errorf("partition %d may have been grown in place, cannot roll back", r.original.number)
+			}
+		}
+	}
+	logger := opts.logger()
+	logger.Info("rolling back resize", "disk", j.Disk, "completed", j.Completed)
+	ctx = withToolRunner(ctx, newToolRunner(opts))
+	backend, err := file.OpenFromPath(j.Disk, false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return err
+	}
+	if err := j.checkTable(table); err != nil {
+		return err
+	}
+	if err := checkInUse(d, resizes, ""); err != nil {
+		return err
+	}
+	if err := restoreTable(logger, opts.audit(), d, j.Table, auditRollback, false); err != nil {
+		return err
+	}
+	if _, err := growBack(ctx, logger, d, resizes, opts.LUKSKeyFile, j.FixErrors); err != nil {
+		return err
+	}
+
+	// swap turned off by an interrupted resize is still off
+	if !j.Finished {
+		if err := reactivateSwaps(ctx, logger, j.Swaps); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// lostOriginal returns the number of a relocated partition whose original the
+// resize j records has overwritten, or may have, as its commit phase, which
+// does so once the original is removed, has started, and what it did to it,
+// e.g. "wiped"; or 0 should the data of every original still be there.
+func (j *journal) lostOriginal() (int, string) {
+	if !j.started(PhaseCommitPartitions) {
+		return 0, ""
+	}
+	for _, r := range j.Resizes {
+		if r.Wipe != "" {
+			return r.Original.Number, "wiped"
+		}
+		if r.Discard {
+			return r.Original.Number, "discarded"
+		}
+	}
+	return 0, ""
+}
+
+// restoreTable writes before, the partition table of d as it was before a
+// resize, back to it, as operation, see auditLog: removing the partitions the
+// resize created, and giving the originals back their entries and sizes. With
+// allowBusy, see writePartitionTable, a kernel that cannot re-read it is not
+// an error.
+func restoreTable(logger *slog.Logger, audit *auditLog, d *disk.Disk, before []gpt.Partition, operation string, allowBusy bool) error {
+	table, err := readGPT(d)
+	if err != nil {
+		return err
+	}
+	table.Partitions = nil
+	for i := range before {
+		p := before[i]
+		table.Partitions = append(table.Partitions, &p)
+	}
+	traceTableWrite(logger, d, table, operation)
+	if err := audit.write(d, operation, func() error { return writePartitionTable(logger, d, table, allowBusy) }); err != nil {
+		return fmt.Errorf("failed to restore partition table: %v", err)
+	}
+	return nil
+}
+
+// growBack grows each filesystem resizes shrank, still in its partition, which
+// restoreTable gave back its original size, to fill it again, as it was
+// shrunk: an ext4 filesystem, a LUKS container along with the ext4 filesystem
+// inside it, unlocked with keyFile, and a swap area, recreated. Anything else
+// was not shrunk, and is left as it is. It stops before the next should ctx be
+// done, and reports whether it grew any.
+func growBack(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, keyFile string, fixErrors bool) (bool, error) {
+	grown := false
+	for _, r := range resizes {
+		if r.target.size >= r.original.size {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return grown, err
+		}
+		if hdr, isSwap, err := readSwapHeader(d.Backend, r.original.start); err != nil {
+			return grown, fmt.Errorf("failed to check partition %d for swap: %v", r.original.number, err)
+		} else if isSwap {
+			if err := recreateSwap(ctx, logger, d.Backend.Path(), r.original, r.original.size, hdr); err != nil {
+				return grown, fmt.Errorf("failed to recreate swap on partition %d at its size: %v", r.original.number, err)
+			}
+			grown = true
+			continue
+		}
+		if hdr, isLUKS, err := readLUKSHeader(d.Backend, r.original.start); err != nil {
+			return grown, fmt.Errorf("failed to check partition %d for LUKS: %v", r.original.number, err)
+		} else if isLUKS {
+			if keyFile == "" {
+				return grown, fmt.Errorf("partition %d is LUKS encrypted, a key file is required to grow it back", r.original.number)
+			}
+			if err := resizeLUKS(ctx, logger, d.Backend.Path(), r.original, r.original.size, hdr, keyFile, fixErrors); err != nil {
+				return grown, fmt.Errorf("failed to grow LUKS container on partition %d back: %v", r.original.number, err)
+			}
+			grown = true
+			continue
+		}
+		usage, err := readExt4Usage(d.Backend, r.original.start)
+		if err != nil {
+			logger.Warn("no filesystem that can be grown back, leaving it as it is", "partition", r.original.number, "type", inPlaceFilesystem(d.Backend, r.original.start))
+			continue
+		}
+		if usage.size >= r.original.size {
+			continue
+		}
+		current := r.original
+		current.size = usage.size
+		current.end = current.start + current.size - 1
+		if err := resizeFilesystem(ctx, logger, d.Backend.Path(), current, r.original.size-usage.size, fixErrors); err != nil {
+			return grown, fmt.Errorf("failed to grow filesystem on partition %d back: %v", r.original.number, err)
+		}
+		grown = true
+	}
+	return grown, nil
+}
@@ -0,0 +1,294 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestRollback interrupts a resize that shrank partition 2 and created a new
+// partition for partition 1, then rolls it back: the table must be as it was,
+// and the shrunk filesystem grown back, with resize2fs stubbed out.
+func TestRollback(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	grown := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	shrunk := partitionData{number: 2, label: "shrinker", start: 9 * MB, size: 8 * MB, end: 17*MB - 1}
+	resizes := []partitionResizeTarget{
+		{original: grown, target: partitionData{number: 3, label: "data_resized2", start: 20 * MB, size: 16 * MB, end: 36*MB - 1}},
+		{original: shrunk, target: partitionData{number: 2, label: "shrinker", start: 9 * MB, size: 4 * MB, end: 13*MB - 1}},
+	}
+
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(grown.start / sectorSize), Size: uint64(grown.size), Type: gpt.LinuxFilesystem, Name: grown.label},
+			{Index: 2, Start: uint64(shrunk.start / sectorSize), Size: uint64(shrunk.size), Type: gpt.LinuxFilesystem, Name: shrunk.label},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	j, err := newJournal(journalPath, diskPath, table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := append([]gpt.Partition(nil), j.Table...)
+
+	// the resize shrank the filesystem on partition 2 to 4 MB, then shrank the
+	// partition and created partition 3, before it was interrupted
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[0x18:], 2) // 4 KiB blocks
+	binary.LittleEndian.PutUint32(sb[0x04:], uint32(4*MB/(4*KB)))
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(sb, shrunk.start+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := preparePartitions(slog.Default(), nil, d, resizes); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{PhaseShrinkFilesystems, PhasePreparePartitions} {
+		if err := j.complete(phase); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = backend.Close()
+
+	var grownToMB int64
+	orig := execResize2fs
+	defer func() { execResize2fs = orig }()
+	execResize2fs = func(_ context.Context, partDevice string, newSizeMB int64, fixErrors bool) error {
+		grownToMB = newSizeMB
+		return nil
+	}
+	var logs bytes.Buffer
+	if err := RollbackWithOptions(context.Background(), journalPath, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))}); err != nil {
+		t.Fatalf("RollbackWithOptions() error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "rolling back resize") {
+		t.Errorf("RollbackWithOptions() logged %q, want the rollback logged to the options' Logger", logs.String())
+	}
+
+	backend, err = file.OpenFromPath(diskPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err = diskfs.OpenBackend(backend, diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after []gpt.Partition
+	for _, p := range tableRaw.(*gpt.Table).Partitions {
+		if p.Type != gpt.Unused {
+			after = append(after, *p)
+		}
+	}
+	if len(after) != len(before) {
+		t.Fatalf("partitions after rollback = %+v, want %+v", after, before)
+	}
+	for i := range before {
+		a, b := after[i], before[i]
+		if a.Index != b.Index || a.Start != b.Start || a.Size != b.Size || a.Name != b.Name || a.GUID != b.GUID || a.Type != b.Type {
+			t.Errorf("partition %d after rollback = %+v, want %+v", b.Index, a, b)
+		}
+	}
+	if grownToMB != shrunk.size/MB {
+		t.Errorf("filesystem grown back to %d MB, want %d MB", grownToMB, shrunk.size/MB)
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after Rollback: %v", err)
+	}
+}
+
+func TestRollbackGrownInPlace(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	resizes := []partitionResizeTarget{{
+		original: partitionData{number: 1, start: 1 * MB, size: 8 * MB},
+		target:   partitionData{number: 1, start: 1 * MB, size: 16 * MB},
+		inPlace:  true,
+	}}
+	table := &gpt.Table{Partitions: []*gpt.Partition{{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem}}}
+	j, err := newJournal(journalPath, "disk.img", table, resizes, false, false, Options{OnlineGrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.complete(PhaseCommitPartitions); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rollback(journalPath); err == nil {
+		t.Error("Rollback() of a partition grown in place returned no error")
+	}
+}
+
+// TestRollbackWiped refuses to roll back a resize that has started to commit
+// a partition whose original it wipes or discards, as the original may be
+// gone, though not before.
+func TestRollbackWiped(t *testing.T) {
+	for _, tt := range []struct {
+		action string
+		resize partitionResizeTarget
+	}{
+		{"wiped", partitionResizeTarget{wipe: WipeZero}},
+		{"discarded", partitionResizeTarget{discard: true}},
+	} {
+		t.Run(tt.action, func(t *testing.T) {
+			testRollbackWiped(t, tt.action, tt.resize)
+		})
+	}
+}
+
+func testRollbackWiped(t *testing.T, action string, r partitionResizeTarget) {
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	r.original = partitionData{number: 1, start: 1 * MB, size: 8 * MB}
+	r.target = partitionData{number: 2, start: 9 * MB, size: 16 * MB}
+	resizes := []partitionResizeTarget{r}
+	table := &gpt.Table{Partitions: []*gpt.Partition{{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem}}}
+	j, err := newJournal(journalPath, "disk.img", table, resizes, false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := JournalStatus(journalPath); err != nil || !status.CanRollback {
+		t.Errorf("JournalStatus() before commit = %+v, %v, want it able to roll back", status, err)
+	}
+	if err := j.start(PhaseCommitPartitions); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := JournalStatus(journalPath); err != nil || status.CanRollback {
+		t.Errorf("JournalStatus() once commit started = %+v, %v, want it unable to roll back", status, err)
+	}
+	if err := Rollback(journalPath); err == nil || !strings.Contains(err.Error(), "partition 1 may have been "+action) {
+		t.Errorf("Rollback() of a partition %s error = %v, want it refused", action, err)
+	}
+}
+
+// TestGrowBack grows back a shrunk swap area, by recreating it, and a shrunk
+// LUKS container, along with its filesystem, requiring a key file for it, and
+// leaves a partition that holds neither nor ext4 as it is.
+func TestGrowBack(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	swap := partitionData{number: 1, label: "swap", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	crypt := partitionData{number: 2, label: "crypt", start: 9 * MB, size: 32 * MB, end: 41*MB - 1}
+	other := partitionData{number: 3, label: "other", start: 41 * MB, size: 8 * MB, end: 49*MB - 1}
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(swap.start / 512), Size: uint64(swap.size), Type: gpt.LinuxSwap, Name: swap.label},
+		{Index: 2, Start: uint64(crypt.start / 512), Size: uint64(crypt.size), Type: gpt.LinuxFilesystem, Name: crypt.label},
+		{Index: 3, Start: uint64(other.start / 512), Size: uint64(other.size), Type: gpt.LinuxFilesystem, Name: other.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := make([]byte, 4096)
+	copy(page[4096-swapSignatureLen:], swapSignature)
+	if _, err := w.WriteAt(page, swap.start); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(testLUKSHeader(2, 16*MB), crypt.start); err != nil {
+		t.Fatal(err)
+	}
+	shrunk := func(p partitionData) partitionResizeTarget {
+		target := p
+		target.size /= 2
+		target.end = target.start + target.size - 1
+		return partitionResizeTarget{original: p, target: target}
+	}
+	resizes := []partitionResizeTarget{shrunk(swap), shrunk(crypt), shrunk(other)}
+
+	var calls []string
+	origM, origC, origR := execMkswap, execCryptsetup, execResize2fs
+	defer func() { execMkswap, execCryptsetup, execResize2fs = origM, origC, origR }()
+	execMkswap = func(_ context.Context, _, _, _ string, _, sizeKB int64) error {
+		calls = append(calls, fmt.Sprintf("mkswap %d", sizeKB))
+		return nil
+	}
+	execCryptsetup = func(_ context.Context, args ...string) error {
+		calls = append(calls, "cryptsetup "+args[0])
+		return nil
+	}
+	execResize2fs = func(_ context.Context, _ string, newSizeMB int64, _ bool) error {
+		calls = append(calls, fmt.Sprintf("resize2fs %d", newSizeMB))
+		return nil
+	}
+
+	if _, err := growBack(context.Background(), slog.Default(), d, resizes[1:], "", false); err == nil || !strings.Contains(err.Error(), "key file") {
+		t.Errorf("growBack() of LUKS without a key error = %v, want a key file required", err)
+	}
+	calls = nil
+	grown, err := growBack(context.Background(), slog.Default(), d, resizes, "/key", false)
+	if err != nil {
+		t.Fatalf("growBack() error: %v", err)
+	}
+	want := []string{
+		fmt.Sprintf("mkswap %d", swap.size/KB),
+		"cryptsetup open", "cryptsetup resize", fmt.Sprintf("resize2fs %d", (crypt.size-16*MB)/MB), "cryptsetup close",
+	}
+	if !grown || fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("growBack() = %v, ran %q, want true, %q", grown, calls, want)
+	}
+}
+
+// TestPlanRollback refuses to roll back the journal of a disk other than the
+// one a plan is for, and one without a journal path.
+func TestPlanRollback(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal.json")
+	table := &gpt.Table{GUID: "5B1B3AB6-5C4B-4F2C-9E4C-0C1F6A7D4E01", Partitions: []*gpt.Partition{{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem}}}
+	resizes := []partitionResizeTarget{{
+		original: partitionData{number: 1, start: 1 * MB, size: 8 * MB},
+		target:   partitionData{number: 2, start: 9 * MB, size: 16 * MB},
+	}}
+	if _, err := newJournal(journalPath, "disk.img", table, resizes, false, false, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	p := &Plan{Disk: "disk.img", DiskGUID: "5B1B3AB6-5C4B-4F2C-9E4C-0C1F6A7D4E02", Options: Options{JournalPath: journalPath}}
+	if err := p.Rollback(); err == nil || !strings.Contains(err.Error(), "not "+p.DiskGUID) {
+		t.Errorf("Plan.Rollback() of another disk's journal error = %v, want it refused", err)
+	}
+	p.Options.JournalPath = ""
+	if err := p.Rollback(); err == nil {
+		t.Error("Plan.Rollback() without a journal path returned no error")
+	}
+}
@@ -1,101 +1,354 @@
 package partitionresizer
 
 import (
+	"cmp"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/backend/file"
+	diskpkg "github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
 // Run performs the partition resizing operations on the specified disk image or device.
-// The shrinkPartition may be nil if no shrinking is to be performed. If it is provided, and there is not enough
-// space for the grow operations, then it will attempt to shrink the specified partition to make room, but only
-// if it has an identifiable ext4 filesystem to shrink, and there is enough space to shrink it.
-// It always will try to run e2fsck before shrinking. By default, it will not fix any found errors, in which case it will
-// error out if any filesystem errors are found. If fixErrors is true, it will attempt to fix any found errors.
-// If preserveNumbers is true, any partition that is relocated while growing is renumbered back to its original
-// partition number once the data has been copied, so its partition number (e.g. /dev/sda2) is unchanged by the resize.
+// The shrinkPartitions may be empty if no shrinking is to be performed. If any are provided, and there is not enough
+// space for the grow operations, then it will attempt to shrink them to make room, but only if they have an ext4
+// filesystem or swap area to shrink; with several, the space is taken from each in proportion to the free space
+// inside it, and see NewRelativePartitionChange to shrink one by an exact amount. A partition that cannot be grown
+// where it is is copied to a new location, which then replaces the original.
+// Everything else -- repairing filesystems, dry runs, journaling for Resume and Rollback, preserving partition
+// numbers, and more -- is controlled by opts, see Options; its zero value gives the defaults.
+//
+// In-use checks. Before anything else, Run refuses to resize a partition the running system is using, returning an
+// *InUseError, or one that is an md RAID member or holds a ZFS, bcache or Ceph device. To resize a partition in
+// use, e.g. the running root, on the next boot instead, see NewPlan.
 //
 // Pre-flight integrity checks. Before any destructive operation, Run
 // integrity-checks every source filesystem it will read or modify -- the shrink
 // partition and each grow source. ext4 sources are checked with e2fsck and
 // fat32 sources with fsck.fat; by default the checks are read-only and an
-// inconsistent filesystem aborts the resize, while fixErrors upgrades them to
+// inconsistent filesystem aborts the resize, while opts.FixErrors upgrades them to
 // repair (e2fsck -y / fsck.fat -a). squashfs sources (read-only,
 // content-addressed, copied raw) have no applicable check and are copied as-is,
 // so a corrupt squashfs source is reproduced faithfully. Run does NOT perform
 // usage-specific pre-flight checks such as free-space policy; that remains the
 // caller's responsibility. When resuming a previously-interrupted run, Run
 // reuses an already-written target only when it structurally matches its source
-// via CompareFS; that comparison is a structure/content equality check, not a
-// filesystem integrity check.
-func Run(disk string, shrinkPartition *PartitionIdentifier, growPartitions []PartitionChange, fixErrors, dryRun, preserveNumbers bool) error {
+// via compareFileSystems; that comparison is a structure/content equality check, not a
+// filesystem integrity check. Once the resize is complete, each ext4 and FAT
+// filesystem it changed is checked the same way, and should any check fail, Run
+// returns a *FilesystemCheckError listing the problems.
+//
+// Run returns a *Result describing what it did, whether or not it succeeded,
+// once it has planned the resize; it is nil only if planning failed.
+//
+// Run cannot be cancelled; see RunContext.
+func Run(disk string, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*Result, error) {
+	return RunContext(context.Background(), disk, shrinkPartitions, growPartitions, opts)
+}
+
+// RunContext is Run, stopping cleanly should ctx be done before the resize is.
+// It stops before the next phase of the resize, partway through a copy, or
+// before the next external tool it would run, but never stops a tool that is
+// already running, or a partition table write. A copy that is stopped has the
+// partition table put back as it was before the resize, removing the
+// partitions it was copying to. With opts.JournalPath, the
+// journal records the phases completed before it stopped, so that Resume can
+// finish the resize, or Rollback undo it. The error returned wraps ctx.Err().
+func RunContext(ctx context.Context, disk string, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*Result, error) {
+	return run(ctx, func(opts Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+		return openAndPlan(disk, shrinkPartitions, growPartitions, false, opts)
+	}, opts, nil, true)
+}
+
+// RunDisk is Run on d, a disk the caller has already opened read-write, rather
+// than one Run opens by path: e.g. one opened with diskfs.OpenBackend on an
+// in-memory backend, a network block device, or a file opened with flags of
+// its own. d is left open. The partitions are found in the GPT of d, so may be
+// identified by label or UUID, but not by name, which only a block device the
+// kernel knows has. The steps that run external tools, such as checking a
+// filesystem or resizing one in place, run them on d.Backend.Path(), so need d
+// opened from a path; without one, a resize needing any of them fails.
+func RunDisk(d *diskpkg.Disk, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*Result, error) {
+	return RunDiskContext(context.Background(), d, shrinkPartitions, growPartitions, opts)
+}
+
+// RunDiskContext is RunDisk, stopping cleanly should ctx be done, as
+// RunContext.
+func RunDiskContext(ctx context.Context, d *diskpkg.Disk, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*Result, error) {
+	return run(ctx, func(opts Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+		table, resizes, err := planDisk(d, shrinkPartitions, growPartitions, opts)
+		return d, table, resizes, err
+	}, opts, nil, false)
+}
+
+// run is RunContext, on the disk open opens and plans the resize of. With
+// plan, the Plan being applied, it refuses to resize unless the disk and what
+// it plans now are as plan says. With closeDisk, it closes the disk once done
+// with it, as it does one open opens by path; RunDisk leaves its caller's open.
+func run(ctx context.Context, open func(Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error), opts Options, plan *Plan, closeDisk bool) (*Result, error) {
+	started := time.Now()
+	fixErrors, preserveNumbers := opts.FixErrors, opts.PreserveNumbers
+	// what is logged as a warning is also returned as one
+	var warnings []string
+	opts.Logger = slog.New(newWarningHandler(opts.logger().Handler(), &warnings))
+	logger := opts.logger()
+	if err := checkHooks(opts.Hooks); err != nil {
+		return nil, err
+	}
+	d, table, resizes, err := open(opts)
+	if err != nil {
+		return nil, err
+	}
+	if closeDisk {
+		defer func() { _ = d.Backend.Close() }()
+	}
+	res := newResult(d.Backend.Path(), resizes, preserveNumbers)
+	tools := newToolRunner(opts)
+	ctx = withToolRunner(ctx, tools)
+	defer func() {
+		res.Tools = tools.all()
+		res.Warnings = warnings
+		res.Duration = time.Since(started)
+	}()
+	if plan != nil {
+		if err := plan.check(d, table, res.Partitions); err != nil {
+			return res, err
+		}
+	}
+	opts.emit(Event{Kind: EventPlanComputed, Disk: res.Disk, Plan: slices.Clone(res.Partitions)})
+	// md RAID members are managed by mdadm, not by us, and likewise ZFS,
+	// bcache and Ceph devices by their own tools
+	if err := refuseMDMembers(d, resizes); err != nil {
+		return res, err
+	}
+	if err := refuseForeignSignatures(d, resizes); err != nil {
+		return res, err
+	}
+	// refuse to touch partitions the running system is using; a dry run
+	// reports this too, as the real run would fail
+	if err := checkInUse(d, resizes, ""); err != nil {
+		return res, err
+	}
+	if opts.DryRun {
+		logger.Info("dry run, not performing resizes", "partitions", res.Partitions)
+		res.DryRun = true
+		// an estimate that cannot be made does not fail the dry run
+		if res.Estimate, err = estimate(d, resizes, opts.Throughput); err != nil {
+			logger.Warn("cannot estimate resize", "error", err)
+		} else {
+			logger.Info("estimated resize", "read", res.Estimate.Read, "write", res.Estimate.Write, "throughput", res.Estimate.Throughput, "duration", res.Estimate.Duration.Round(time.Second))
+		}
+		if res.Problems = simulate(d, resizes, opts); len(res.Problems) > 0 {
+			return res, NewDryRunError(res.Disk, res.Problems)
+		}
+		return res, nil
+	}
+	// nothing is changed, not even by an integrity check that repairs, until
+	// the resize as planned is confirmed
+	if err := opts.confirm(describeResize(res.Disk, resizes)); err != nil {
+		return res, err
+	}
+	// a resize that could not be recorded is not started
+	if err := opts.audit().check(); err != nil {
+		return res, fmt.Errorf("cannot write audit log: %v", err)
+	}
+	// snapshot the metadata of the disk before anything changes it, including
+	// a repairing integrity check, and name it in any error from here on
+	snapshot := func(err error) error { return err }
+	if opts.SnapshotDir != "" {
+		path, err := takeSnapshot(logger, d, resizes, opts.SnapshotDir)
+		if err != nil {
+			return res, fmt.Errorf("failed to take metadata snapshot: %v", err)
+		}
+		res.Snapshot = path
+		snapshot = func(err error) error {
+			if err == nil {
+				return nil
+			}
+			return fmt.Errorf("%w (metadata snapshot from before the resize: %s)", err, path)
+		}
+	}
+	// integrity-check the source filesystems before anything destructive, so a
+	// corrupt source aborts the resize rather than being shrunk in place or
+	// copied into a new partition
+	if err := checkSourceFilesystems(ctx, logger, d, resizes, fixErrors); err != nil {
+		return res, snapshot(err)
+	}
+	var j *journal
+	if opts.JournalPath != "" {
+		if j, err = newJournal(opts.JournalPath, d.Backend.Path(), table, resizes, fixErrors, preserveNumbers, opts); err != nil {
+			return res, snapshot(fmt.Errorf("failed to start journal: %v", err))
+		}
+	}
+	logger.Info("performing resizes", "partitions", res.Partitions)
+	return res, snapshot(resize(ctx, d, resizes, fixErrors, preserveNumbers, opts, j, res))
+}
+
+// openAndPlan finds and opens the disk holding the given partitions, read-only
+// if readOnly is set, and plans the resizes on it. The caller closes the disk;
+// on an error, it is not left open.
+func openAndPlan(disk string, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, readOnly bool, opts Options) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+	return openAndPlanTable(disk, shrinkPartitions, growPartitions, readOnly, opts, nil)
+}
+
+// openAndPlanTable is openAndPlan, passing the partition table of the disk to
+// adjust, if set, before planning on it.
+func openAndPlanTable(disk string, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, readOnly bool, opts Options, adjust func(*diskpkg.Disk, *gpt.Table)) (*diskpkg.Disk, *gpt.Table, []partitionResizeTarget, error) {
+	if err := opts.Verify.check(); err != nil {
+		return nil, nil, nil, NewPlanError(disk, err)
+	}
+	if err := opts.IOPriority.check(); err != nil {
+		return nil, nil, nil, NewPlanError(disk, err)
+	}
+	if err := opts.WipeRemoved.check(); err != nil {
+		return nil, nil, nil, NewPlanError(disk, err)
+	}
 	// we always work solely with partition UUIDs internally, so convert any other identifiers to UUIDs
 	// see if a disk was specified
 	// no disk specified, try to discover
 	var err error
-	var partIdentifiers []PartitionIdentifier
-	if shrinkPartition != nil {
-		partIdentifiers = append(partIdentifiers, *shrinkPartition)
-	}
+	partIdentifiers := append([]PartitionIdentifier{}, shrinkPartitions...)
 	for _, gp := range growPartitions {
 		partIdentifiers = append(partIdentifiers, gp)
 	}
 	disks, err := findDisks(disk, "")
 	if err != nil {
-		return fmt.Errorf("failed to find disks: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to find disks: %v", err)
 	}
 	filteredDisks, err := filterDisksByPartitions(disks, partIdentifiers)
 	if err != nil {
-		return fmt.Errorf("failed to filter disks by partiton: %v", err)
+		return nil, nil, nil, NewPlanError(disk, fmt.Errorf("failed to filter disks by partiton: %v", err))
 	}
 	if len(filteredDisks) == 0 {
-		return fmt.Errorf("no disks found matching specified partitions")
+		var hint string
+		for _, parts := range disks {
+			hint = cmp.Or(hint, identifierHint(parts, partIdentifiers...))
+		}
+		return nil, nil, nil, NewPlanError(disk, fmt.Errorf("no disks found matching specified partitions%s", hint))
 	}
 	if len(filteredDisks) > 1 {
-		return fmt.Errorf("multiple disks found matching specified partitions: %+v", filteredDisks)
+		return nil, nil, nil, NewPlanError(disk, fmt.Errorf("multiple disks found matching specified partitions: %+v", filteredDisks))
 	}
 	matchedDisk := filteredDisks[0]
 	diskPartitionData := disks[matchedDisk]
-	log.Printf("Using disk: %s via path %s", matchedDisk, disk)
+	// a disk found by discovery is opened by its kernel name
+	disk = cmp.Or(disk, filepath.Join("/dev", matchedDisk))
+	opts.logger().Info("using disk", "disk", matchedDisk, "path", disk)
 
 	// now we have the desired disk, either passed explicitly or found by discovery
 
-	backend, err := file.OpenFromPath(disk, false)
+	backend, err := file.OpenFromPath(disk, readOnly)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
+	// the disk is left open for the caller only once it is planned on
 	d, err := diskfs.OpenBackend(backend)
 	if err != nil {
-		return err
+		_ = backend.Close()
+		return nil, nil, nil, err
 	}
 
 	// get the table and partition information
-	tableRaw, err := d.GetPartitionTable()
+	table, err := readGPT(d)
 	if err != nil {
-		return err
+		_ = backend.Close()
+		return nil, nil, nil, err
 	}
-	table, ok := tableRaw.(*gpt.Table)
-	if !ok {
-		return fmt.Errorf("unsupported partition table type, only GPT is supported")
+	if adjust != nil {
+		adjust(d, table)
 	}
-	// plan what changes we will make
-	resizes, err := planResizes(d, table, diskPartitionData, growPartitions, shrinkPartition)
+	resizes, err := planOn(d, table, diskPartitionData, shrinkPartitions, growPartitions, opts)
 	if err != nil {
-		return err
+		_ = backend.Close()
+		return nil, nil, nil, NewPlanError(matchedDisk, err)
 	}
-	if dryRun {
-		log.Printf("Dry run specified, not performing resizes %+v", resizes)
-		return nil
+	return d, table, resizes, nil
+}
+
+// planDisk plans the resizes on d, already open, finding the partitions in its
+// GPT.
+func planDisk(d *diskpkg.Disk, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) (*gpt.Table, []partitionResizeTarget, error) {
+	if err := opts.Verify.check(); err != nil {
+		return nil, nil, NewPlanError(d.Backend.Path(), err)
 	}
-	// integrity-check the source filesystems before anything destructive, so a
-	// corrupt source aborts the resize rather than being shrunk in place or
-	// copied into a new partition
-	if err := checkSourceFilesystems(d, resizes, fixErrors); err != nil {
-		return err
+	if err := opts.IOPriority.check(); err != nil {
+		return nil, nil, NewPlanError(d.Backend.Path(), err)
+	}
+	if err := opts.WipeRemoved.check(); err != nil {
+		return nil, nil, NewPlanError(d.Backend.Path(), err)
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := gptPartitionData(d, table)
+	partIdentifiers := append([]PartitionIdentifier{}, shrinkPartitions...)
+	for _, gp := range growPartitions {
+		partIdentifiers = append(partIdentifiers, gp)
+	}
+	found, err := filterDisksByPartitions(map[string][]partitionData{d.Backend.Path(): parts}, partIdentifiers)
+	if err != nil {
+		return nil, nil, NewPlanError(d.Backend.Path(), fmt.Errorf("failed to filter disks by partiton: %v", err))
+	}
+	if len(found) == 0 {
+		return nil, nil, NewPlanError(d.Backend.Path(), fmt.Errorf("specified partitions not all found on disk %s%s", d.Backend.Path(), identifierHint(parts, partIdentifiers...)))
+	}
+	resizes, err := planOn(d, table, parts, shrinkPartitions, growPartitions, opts)
+	if err != nil {
+		return nil, nil, NewPlanError(d.Backend.Path(), err)
+	}
+	return table, resizes, nil
+}
+
+// planOn plans what changes to make to d, whose partition table is table and
+// partitions parts.
+func planOn(d *diskpkg.Disk, table *gpt.Table, parts []partitionData, shrinkPartitions []PartitionIdentifier, growPartitions []PartitionChange, opts Options) ([]partitionResizeTarget, error) {
+	resizes, err := planResizes(d, table, parts, growPartitions, shrinkPartitions, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProtected(d.Backend.Path(), parts, resizes, opts.ExcludePartitions); err != nil {
+		return nil, err
+	}
+	if err := checkAlternateLabels(table, resizes); err != nil {
+		return nil, err
+	}
+	if err := checkBootPartitions(opts.logger(), d.Backend.Path(), table, resizes, opts.ForceBootPartitions); err != nil {
+		return nil, err
+	}
+	if err := markFrozenCopies(resizes, opts); err != nil {
+		return nil, err
+	}
+	markTemporaryUUIDs(resizes, opts)
+	markVerification(resizes, opts)
+	markCopyStreams(resizes, opts)
+	markDiscards(resizes, opts)
+	markWipes(resizes, opts)
+	markBootEntries(resizes, opts)
+	if err := markLegacyBootable(opts.logger(), d.Backend.Path(), resizes, opts.LegacyBootable); err != nil {
+		return nil, err
+	}
+	if err := markPartitionTypes(opts.logger(), d.Backend.Path(), resizes, growPartitions); err != nil {
+		return nil, err
+	}
+	return resizes, nil
+}
+
+// readGPT returns the GPT of d.
+func readGPT(d *diskpkg.Disk) (*gpt.Table, error) {
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := tableRaw.(*gpt.Table)
+	if !ok {
+		return nil, fmt.Errorf("unsupported partition table type, only GPT is supported")
 	}
-	log.Printf("Will perform resizes %+v", resizes)
-	return resize(d, resizes, fixErrors, preserveNumbers)
+	return table, nil
 }
@@ -2,17 +2,22 @@ package partitionresizer
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
@@ -20,59 +25,84 @@ const (
 	partTmpFilename = "partresizer-shrinkfs-XXXXXXXX"
 )
 
-// runTool runs an external filesystem tool, streaming its output live to the
-// process's stdout/stderr while also capturing stderr. On a non-zero exit the
-// returned error wraps the exit status and includes the tool's own stderr
-// diagnostic, so a programmatic caller gets the reason for the failure rather
-// than a bare "exit status N".
-func runTool(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	var stderr bytes.Buffer
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
-	if err := cmd.Run(); err != nil {
+// runTool runs an external filesystem tool with the ExecRunner of the
+// toolRunner ctx carries, or a LocalExecRunner without one, capturing its
+// output rather than writing it to the process's stdout/stderr. On a non-zero
+// exit the returned error wraps the exit status and includes the end of the
+// tool's own stderr diagnostic, so a programmatic caller gets the reason for
+// the failure rather than a bare "exit status N". The tool, with all it wrote,
+// is recorded by the toolRunner.
+//
+// A tool is not started once ctx is done, but one already running is not
+// killed when it is: the tools change filesystems and partitions in place, and
+// interrupting one midway could leave it damaged. Cancellation takes effect at
+// the next tool, or the next point at which the resize checks ctx.
+func runTool(ctx context.Context, name string, args ...string) error {
+	_, err := runToolOutput(ctx, name, args...)
+	return err
+}
+
+// runToolOutput runs an external tool as runTool does, returning what it
+// wrote to stdout, for a tool whose output is read, such as efibootmgr.
+func runToolOutput(ctx context.Context, name string, args ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%s not run: %w", name, err)
+	}
+	tools := toolRunnerFrom(ctx)
+	var (
+		output         transcript
+		stdout, stderr bytes.Buffer
+	)
+	tools.start(name, args)
+	started := time.Now()
+	err := tools.execRunner().Run(ctx, name, args, tools.timeout(), io.MultiWriter(&output, &stdout), io.MultiWriter(&output, &stderr))
+	run := ToolRun{Name: name, Args: args, Duration: time.Since(started), Output: output.String()}
+	if err != nil {
+		run.Error = err.Error()
+		run.NotFound = errors.Is(err, exec.ErrNotFound)
 		if msg := strings.TrimSpace(stderr.String()); msg != "" {
-			const max = 2000
-			if len(msg) > max {
-				msg = "..." + msg[len(msg)-max:]
+			if len(msg) > toolErrorTail {
+				msg = "..." + msg[len(msg)-toolErrorTail:]
 			}
-			return fmt.Errorf("%s failed: %w\n%s", name, err, msg)
+			err = fmt.Errorf("%s failed: %w\n%s", name, err, msg)
+		} else {
+			err = fmt.Errorf("%s failed: %w", name, err)
 		}
-		return fmt.Errorf("%s failed: %w", name, err)
 	}
-	return nil
+	tools.record(run)
+	return stdout.String(), err
 }
 
 // execE2fsck runs a forced e2fsck on the given device or image file. By default
 // it is read-only (-n) and returns an error if the filesystem is inconsistent;
 // with fixErrors it repairs in place (-y).
-var execE2fsck = func(partDevice string, fixErrors bool) error {
+var execE2fsck = func(ctx context.Context, partDevice string, fixErrors bool) error {
 	fixFlag := "-n"
 	if fixErrors {
 		fixFlag = "-y"
 	}
-	return runTool("e2fsck", "-f", fixFlag, partDevice)
+	return runTool(ctx, "e2fsck", "-f", fixFlag, partDevice)
 }
 
 // execFsckFat runs fsck.fat on the given device or image file. By default it is
 // read-only (-n) and returns an error if the filesystem is inconsistent; with
 // fixErrors it auto-repairs (-a).
-var execFsckFat = func(partDevice string, fixErrors bool) error {
+var execFsckFat = func(ctx context.Context, partDevice string, fixErrors bool) error {
 	fixFlag := "-n"
 	if fixErrors {
 		fixFlag = "-a"
 	}
-	return runTool("fsck.fat", fixFlag, partDevice)
+	return runTool(ctx, "fsck.fat", fixFlag, partDevice)
 }
 
 // execResize2fs is the function used to invoke resize2fs. partDevice may be a block device pointing to the actual
 // filesystem partition, or an image file with the filesystem at byte 0. resize2fs requires a clean filesystem, so
 // e2fsck is always run first.
-var execResize2fs = func(partDevice string, newSizeMB int64, fixErrors bool) error {
-	if err := execE2fsck(partDevice, fixErrors); err != nil {
+var execResize2fs = func(ctx context.Context, partDevice string, newSizeMB int64, fixErrors bool) error {
+	if err := execE2fsck(ctx, partDevice, fixErrors); err != nil {
 		return err
 	}
-	return runTool("resize2fs", partDevice, fmt.Sprintf("%dM", newSizeMB))
+	return runTool(ctx, "resize2fs", partDevice, fmt.Sprintf("%dM", newSizeMB))
 }
 
 // resizeFilesystem resizes an ext4 filesystem, given a full path to the device and partition data
@@ -81,6 +111,8 @@ var execResize2fs = func(partDevice string, newSizeMB int64, fixErrors bool) err
 // filesystemData is expected to be the *current* partition data, i.e. before resizing,
 // while delta is the expected delta in size.
 func resizeFilesystem(
+	ctx context.Context,
+	logger *slog.Logger,
 	device string,
 	filesystemData partitionData,
 	delta int64,
@@ -88,10 +120,7 @@ func resizeFilesystem(
 ) error {
 	newSize := filesystemData.size + delta
 	newSizeMB := newSize / (1024 * 1024)
-	log.Printf(
-		"Resizing filesystem on partition %d to %d MB",
-		filesystemData.number, newSizeMB,
-	)
+	logger.Info("resizing filesystem", "partition", filesystemData.number, "sizeMB", newSizeMB)
 	f, err := os.Open(device)
 	if err != nil {
 		return err
@@ -111,7 +140,7 @@ func resizeFilesystem(
 		if err != nil {
 			return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, filesystemData.number, err)
 		}
-		return execResize2fs(partDevice, newSizeMB, fixErrors)
+		return execResize2fs(ctx, partDevice, newSizeMB, fixErrors)
 	case disk.DeviceTypeFile:
 		// copy the partition, then resize it, then copy it back into the original disk image
 		tmpFile, err2 := os.CreateTemp("", partTmpFilename)
@@ -123,12 +152,20 @@ func resizeFilesystem(
 			_ = os.RemoveAll(tmpFile.Name())
 		}()
 		// copy the file over
-		if err = CopyRange(device, tmpFile.Name(), filesystemData.start, 0, filesystemData.size, 0); err != nil {
+		if err = CopyRangeContext(ctx, device, tmpFile.Name(), filesystemData.start, 0, filesystemData.size, 0, nil); err != nil {
 			return fmt.Errorf("copy to temp file: %w", err)
 		}
-		if err = execResize2fs(tmpFile.Name(), newSizeMB, fixErrors); err != nil {
+		// when growing, resize2fs needs the file to be as large as the new filesystem
+		if delta > 0 {
+			if err = os.Truncate(tmpFile.Name(), newSize); err != nil {
+				return err
+			}
+		}
+		if err = execResize2fs(ctx, tmpFile.Name(), newSizeMB, fixErrors); err != nil {
 			return err
 		}
+		// not cancelled, as a copy back stopped midway would leave the
+		// filesystem half resized
 		err = CopyRange(tmpFile.Name(), device, 0, filesystemData.start, newSize, 0)
 	case disk.DeviceTypeUnknown:
 		err = fmt.Errorf("unknown device type for %s", device)
@@ -145,7 +182,7 @@ func resizeFilesystem(
 // device the partition's device node is checked directly; for an image file the
 // partition byte-range is extracted to a temp file, checked, and -- only when
 // repairing -- copied back.
-func checkFilesystem(device string, fsData partitionData, fsck func(string, bool) error, fixErrors bool) error {
+func checkFilesystem(ctx context.Context, device string, fsData partitionData, fsck func(context.Context, string, bool) error, fixErrors bool) error {
 	f, err := os.Open(device)
 	if err != nil {
 		return err
@@ -161,7 +198,7 @@ func checkFilesystem(device string, fsData partitionData, fsck func(string, bool
 		if err != nil {
 			return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, fsData.number, err)
 		}
-		return fsck(partDevice, fixErrors)
+		return fsck(ctx, partDevice, fixErrors)
 	case disk.DeviceTypeFile:
 		tmpFile, err := os.CreateTemp("", partTmpFilename)
 		if err != nil {
@@ -169,14 +206,15 @@ func checkFilesystem(device string, fsData partitionData, fsck func(string, bool
 		}
 		_ = tmpFile.Close()
 		defer func() { _ = os.RemoveAll(tmpFile.Name()) }()
-		if err := CopyRange(device, tmpFile.Name(), fsData.start, 0, fsData.size, 0); err != nil {
+		if err := CopyRangeContext(ctx, device, tmpFile.Name(), fsData.start, 0, fsData.size, 0, nil); err != nil {
 			return fmt.Errorf("copy to temp file: %w", err)
 		}
-		if err := fsck(tmpFile.Name(), fixErrors); err != nil {
+		if err := fsck(ctx, tmpFile.Name(), fixErrors); err != nil {
 			return err
 		}
 		// Only a repairing run mutates the filesystem; persist it back into
-		// the image. A read-only check leaves the source untouched.
+		// the image, without cancelling it midway. A read-only check leaves
+		// the source untouched.
 		if fixErrors {
 			return CopyRange(tmpFile.Name(), device, 0, fsData.start, fsData.size, 0)
 		}
@@ -188,14 +226,22 @@ func checkFilesystem(device string, fsData partitionData, fsck func(string, bool
 }
 
 // planResizes computes the resize plan, including both growing the relevant partitions as well as
-// optionally performing an ext4 shrink, if there is insufficient space initially.
+// optionally performing ext4 shrinks, if there is insufficient space initially.
+// When several shrinkPartitions are given, the space to reclaim is distributed across them in proportion
+// to the free space inside each filesystem, see distributeShrink.
+// If no shrinkPartitions are given and opts.AutoShrink is set, the shrink partition is
+// chosen automatically via selectShrinkCandidate. The space to reclaim is rounded up to
+// opts.ShrinkGranularity. With opts.OnlineGrow, grows of ext4 and XFS filesystems are planned in
+// place where free space immediately follows the partition. A grow size is rounded down to whole logical
+// sectors, and an exact amount to shrink by up to them.
 // Returns the final plan or an error.
 func planResizes(
 	d *disk.Disk,
 	table *gpt.Table,
 	diskPartitionData []partitionData,
 	growPartitions []PartitionChange,
-	shrinkPartition *PartitionIdentifier,
+	shrinkPartitions []PartitionIdentifier,
+	opts Options,
 ) (
 	[]partitionResizeTarget,
 	error,
@@ -205,6 +251,22 @@ func planResizes(
 	if err != nil {
 		return nil, err
 	}
+	// a size such as 1.3G or 10GB need not be a whole number of sectors,
+	// which a partition must be, so a grow is rounded down to one
+	sectorSize := int64(cmp.Or(table.LogicalSectorSize, 512))
+	for i := range prTargets {
+		prTargets[i].target.size -= prTargets[i].target.size % sectorSize
+	}
+	// with OnlineGrow, a grow of a filesystem that can be grown in place is
+	// tried in place first; calculateResizes relocates it if it does not fit
+	if opts.OnlineGrow {
+		for i, pr := range prTargets {
+			if pr.mode != SizeAbsolute && pr.mode != SizeRelative || pr.target.size <= pr.original.size {
+				continue
+			}
+			prTargets[i].inPlace = inPlaceFilesystem(d.Backend, pr.original.start) != ""
+		}
+	}
 
 	// Resume support: an interrupted run may already have created the relocated
 	// "<label>_resized2" partition for some grows. Those targets already occupy
@@ -253,59 +315,341 @@ func planResizes(
 		return done, nil
 	}
 
+	// an exact amount to shrink a partition by, such as -10G, is taken from
+	// it whether or not the grows need it, so it is checked against the free
+	// space of its filesystem before anything else is planned
+	var (
+		shrinkDataList []partitionData
+		fixedAmounts   []int64
+	)
+	if len(shrinkPartitions) > 0 {
+		shrinkDataList, err = partitionIdentifiersToData(table, diskPartitionData, shrinkPartitions)
+		if err != nil {
+			return nil, err
+		}
+		if len(shrinkDataList) != len(shrinkPartitions) {
+			return nil, fmt.Errorf("could not find shrink partition data")
+		}
+		fixedAmounts, err = shrinkAmounts(shrinkPartitions)
+		if err != nil {
+			return nil, err
+		}
+		// and an exact shrink up to one, so that it is never rounded away
+		for i, a := range fixedAmounts {
+			if a%sectorSize != 0 {
+				fixedAmounts[i] = (a/sectorSize + 1) * sectorSize
+			}
+		}
+		if err := checkExactShrinks(d, shrinkDataList, fixedAmounts, opts); err != nil {
+			return nil, err
+		}
+	}
+	exact := slices.ContainsFunc(fixedAmounts, func(a int64) bool { return a > 0 })
+
 	// try to calculate without shrinking, for the pending grows only
-	resizes, err := calculateResizes(d.Size, table.Partitions, pending)
-	if err == nil {
+	size := usableDiskSize(d, table)
+	resizes, err := calculateResizes(size, table.Partitions, pending)
+	if err == nil && !exact {
 		return append(done, resizes...), nil
 	}
 	var spaceErr *InsufficientSpaceError
-	if !errors.As(err, &spaceErr) {
+	if err != nil && !errors.As(err, &spaceErr) {
 		return nil, err
 	}
-
-	// need to shrink: ensure shrinkPartition provided
-	if shrinkPartition == nil {
-		return nil, fmt.Errorf("insufficient space to perform requested partition grows, and no shrink partition specified")
+	// wrapSpace wraps err, a reason the shrinks cannot make the space the
+	// grows need, in the InsufficientSpaceError they were to make it for
+	wrapSpace := func(err error) error {
+		if spaceErr == nil {
+			return err
+		}
+		return fmt.Errorf("%w: %v", spaceErr, err)
 	}
 
-	// compute total space to grow (rounded up to next GB) for the pending grows
+	// compute total space to grow (rounded up to the shrink granularity) for the pending grows
 	var totalGrow int64
 	for _, gp := range pending {
 		totalGrow += gp.target.size
 	}
-	if totalGrow%GB != 0 {
-		totalGrow = ((totalGrow / GB) + 1) * GB
+	if granularity := opts.shrinkGranularity(); totalGrow%granularity != 0 {
+		totalGrow = ((totalGrow / granularity) + 1) * granularity
 	}
 
-	// locate shrink partition data
-	shrinkDataList, err := partitionIdentifiersToData(table, diskPartitionData, []PartitionIdentifier{*shrinkPartition})
-	if err != nil {
-		return nil, err
-	}
-	if len(shrinkDataList) != 1 {
-		return nil, fmt.Errorf("could not find shrink partition data")
+	// the grows fit without shrinking, so only the exact amounts are taken,
+	// and a shrink partition without one, only there should space be short,
+	// is left as it is
+	amounts := fixedAmounts
+	if spaceErr != nil {
+		// need to shrink: use the given shrink partitions, or pick one if allowed
+		switch {
+		case len(shrinkPartitions) > 0:
+			// found, with their exact amounts, above
+		case opts.AutoShrink:
+			protected, _ := protectedPartitions(diskPartitionData, opts.ExcludePartitions)
+			shrinkData, err := selectShrinkCandidate(d, table, prTargets, totalGrow, protected, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", spaceErr, err)
+			}
+			opts.logger().Info("auto-shrink selected partition", "partition", shrinkData.number, "label", shrinkData.label, "bytes", totalGrow)
+			shrinkDataList = []partitionData{shrinkData}
+			fixedAmounts = []int64{0}
+		default:
+			return nil, fmt.Errorf("%w, and no shrink partition specified", err)
+		}
+		if amounts, err = distributeShrink(d, shrinkDataList, fixedAmounts, totalGrow, opts); err != nil {
+			return nil, wrapSpace(err)
+		}
 	}
-	shrinkData := shrinkDataList[0]
 
-	// mark the shrink as first for the resize
-	target := shrinkData
-	target.size = shrinkData.size - totalGrow
-	target.end = shrinkData.end - totalGrow
-	shrink := partitionResizeTarget{
-		original: shrinkData,
-		target:   target,
-	}
-	prTargetsWithShrink := []partitionResizeTarget{shrink}
+	// mark the shrinks as first for the resize
+	var (
+		prTargetsWithShrink []partitionResizeTarget
+		shrunk              []int
+	)
+	for i, shrinkData := range shrinkDataList {
+		if amounts[i] == 0 {
+			continue
+		}
+		shrunk = append(shrunk, shrinkData.number)
+		target := shrinkData
+		target.size = shrinkData.size - amounts[i]
+		target.end = shrinkData.end - amounts[i]
+		prTargetsWithShrink = append(prTargetsWithShrink, partitionResizeTarget{
+			original: shrinkData,
+			target:   target,
+		})
+	}
 	prTargetsWithShrink = append(prTargetsWithShrink, pending...)
 
-	// recalculate resizes with shrinking
-	resizes, err = calculateResizes(d.Size, table.Partitions, prTargetsWithShrink)
+	// recalculate resizes with shrinking; the space several shrinks free is
+	// in a gap at the end of each, so a grow that is copied may fit in none
+	resizes, err = calculateResizes(size, table.Partitions, prTargetsWithShrink)
 	if err != nil {
+		if len(shrunk) > 1 && errors.As(err, &spaceErr) {
+			return nil, NewFragmentedShrinkError(shrunk, err)
+		}
 		return nil, err
 	}
 	return append(done, resizes...), nil
 }
 
+// usableDiskSize returns the number of bytes at the start of the disk that
+// partitions may occupy: everything up to the GPT's last usable sector, so that
+// a grow -- in particular one filling the rest of the disk -- never lands on the
+// backup GPT at the end of the disk. A table that was not read from disk has no
+// last usable sector, in which case the whole disk size is returned.
+func usableDiskSize(d *disk.Disk, table *gpt.Table) int64 {
+	last := table.LastDataSector()
+	if last == 0 || table.LogicalSectorSize == 0 {
+		return d.Size
+	}
+	return int64(last+1) * int64(table.LogicalSectorSize)
+}
+
+// shrinkAmounts returns, for each shrink partition, the exact number of bytes
+// the caller asked to take from it, or 0 where the planner is to decide. A shrink
+// partition carries an exact amount when it is a relative PartitionChange, see
+// NewRelativePartitionChange, with a negative delta.
+func shrinkAmounts(shrinkPartitions []PartitionIdentifier) ([]int64, error) {
+	amounts := make([]int64, len(shrinkPartitions))
+	for i, sp := range shrinkPartitions {
+		pc, ok := sp.(PartitionChange)
+		if !ok {
+			continue
+		}
+		switch {
+		case pc.Mode() != SizeRelative:
+			return nil, fmt.Errorf("shrink partition %s=%s: only relative sizes are supported", pc.By(), pc.Value())
+		case pc.Size() >= 0:
+			return nil, fmt.Errorf("shrink partition %s=%s: size delta %d must be negative", pc.By(), pc.Value(), pc.Size())
+		}
+		amounts[i] = -pc.Size()
+	}
+	return amounts, nil
+}
+
+// distributeShrink splits total, the number of bytes to reclaim, across the
+// given shrink partitions. Partitions with a non-zero entry in fixed give up
+// exactly that many bytes, unrounded. Whatever remains of total is taken from
+// the other partitions: a single one gives up all of it, while several each give
+// up a share proportional to the space they can spare -- the free space inside
+// their ext4 filesystem, or all but the minimum size of a swap area, less any
+// configured shrink margin -- so that a nearly full donor is not shrunk as far
+// as a mostly empty one. Each frees its share at its own end, so the space is
+// not contiguous, and a grow that is copied to a new location may fit in none of
+// it: planResizes then fails with a *FragmentedShrinkError. Each such share is rounded up to a whole MB, the
+// granularity resize2fs is driven at. When a shrink margin is configured, every
+// amount is checked against it.
+func distributeShrink(d *disk.Disk, shrinks []partitionData, fixed []int64, total int64, opts Options) ([]int64, error) {
+	amounts := make([]int64, len(shrinks))
+	var flexible []int
+	remaining := total
+	for i := range shrinks {
+		if fixed[i] > 0 {
+			amounts[i] = fixed[i]
+			remaining -= fixed[i]
+			continue
+		}
+		flexible = append(flexible, i)
+	}
+	switch {
+	case len(flexible) == 0 || remaining <= 0:
+		return amounts, checkShrinkMargins(d, shrinks, amounts, opts)
+	case len(flexible) == 1:
+		amounts[flexible[0]] = remaining
+		return amounts, checkShrinkMargins(d, shrinks, amounts, opts)
+	}
+	spare := make(map[int]int64, len(flexible))
+	var totalSpare int64
+	for _, i := range flexible {
+		usage, err := readShrinkUsage(d.Backend, shrinks[i])
+		if err != nil {
+			return nil, fmt.Errorf("shrink partition %d: %w", shrinks[i].number, err)
+		}
+		spare[i] = opts.shrinkable(usage)
+		totalSpare += spare[i]
+	}
+	if totalSpare < remaining {
+		return nil, fmt.Errorf("shrink partitions can spare %d bytes in total, need %d", totalSpare, remaining)
+	}
+	for _, i := range flexible {
+		// remaining*spare[i] can overflow int64 on large disks, so take the
+		// ratio in floating point
+		share := int64(float64(remaining) * (float64(spare[i]) / float64(totalSpare)))
+		if share%MB != 0 {
+			share = ((share / MB) + 1) * MB
+		}
+		if share > spare[i] {
+			return nil, fmt.Errorf("shrink partition %d can spare %d bytes, cannot give up %d", shrinks[i].number, spare[i], share)
+		}
+		amounts[i] = share
+		opts.logger().Info("sharing shrink", "partition", shrinks[i].number, "label", shrinks[i].label, "bytes", share, "spare", spare[i])
+	}
+	return amounts, nil
+}
+
+// readShrinkUsage returns how much of the shrink partition part is in use: for
+// ext4 as recorded in its superblock, and for swap, whose contents need not be
+// kept, only the minimum size of a swap area. The usage of a filesystem inside a
+// LUKS container cannot be read without unlocking it.
+func readShrinkUsage(r io.ReaderAt, part partitionData) (ext4Usage, error) {
+	hdr, isSwap, err := readSwapHeader(r, part.start)
+	if err != nil {
+		return ext4Usage{}, err
+	}
+	if isSwap {
+		return ext4Usage{size: part.size, free: max(part.size-hdr.minSize(), 0)}, nil
+	}
+	if _, isLUKS, err := readLUKSHeader(r, part.start); err != nil {
+		return ext4Usage{}, err
+	} else if isLUKS {
+		return ext4Usage{}, fmt.Errorf("filesystem is LUKS encrypted and its free space cannot be read, give an exact amount to shrink it by")
+	}
+	return readExt4Usage(r, part.start)
+}
+
+// checkExactShrinks verifies that each shrink partition given an exact amount
+// to give up, a non-zero entry in amounts, can spare it: that as much is free
+// inside its filesystem, less any configured shrink margin. The free space of
+// a filesystem inside a LUKS container cannot be read, so one is left to the
+// shrink itself to refuse.
+func checkExactShrinks(d *disk.Disk, shrinks []partitionData, amounts []int64, opts Options) error {
+	for i, s := range shrinks {
+		if amounts[i] == 0 {
+			continue
+		}
+		if _, isLUKS, err := readLUKSHeader(d.Backend, s.start); err != nil {
+			return fmt.Errorf("shrink partition %d: %w", s.number, err)
+		} else if isLUKS {
+			continue
+		}
+		usage, err := readShrinkUsage(d.Backend, s)
+		if err != nil {
+			return fmt.Errorf("shrink partition %d: %w", s.number, err)
+		}
+		if spare := opts.shrinkable(usage); amounts[i] > spare {
+			return fmt.Errorf("shrink partition %d can spare %d bytes, cannot give up the %d asked", s.number, spare, amounts[i])
+		}
+	}
+	return nil
+}
+
+// checkShrinkMargins verifies that each shrink partition can give up its
+// amount while keeping the configured shrink margin free inside its
+// filesystem. Without a margin there is nothing to check here; resize2fs itself
+// refuses to shrink a filesystem below its data.
+func checkShrinkMargins(d *disk.Disk, shrinks []partitionData, amounts []int64, opts Options) error {
+	if !opts.hasShrinkMargin() {
+		return nil
+	}
+	for i, s := range shrinks {
+		if amounts[i] == 0 {
+			continue
+		}
+		usage, err := readShrinkUsage(d.Backend, s)
+		if err != nil {
+			return fmt.Errorf("shrink partition %d: %w", s.number, err)
+		}
+		if spare := opts.shrinkable(usage); amounts[i] > spare {
+			return fmt.Errorf("shrink partition %d can spare %d bytes while keeping its shrink margin, cannot give up %d", s.number, spare, amounts[i])
+		}
+	}
+	return nil
+}
+
+// selectShrinkCandidate picks the partition to shrink when the caller did not
+// name one: the largest partition holding an ext4 filesystem -- the only type
+// we can shrink -- that can spare at least required bytes while keeping the
+// configured shrink margin. Partitions that are themselves being grown are never
+// candidates, nor are those protected, as protectedPartitions returns them, nor
+// boot partitions, without opts.ForceBootPartitions.
+func selectShrinkCandidate(d *disk.Disk, table *gpt.Table, grows []partitionResizeTarget, required int64, protected map[int]string, opts Options) (partitionData, error) {
+	growing := make(map[int]bool)
+	for _, g := range grows {
+		growing[g.original.number] = true
+	}
+	var best *gpt.Partition
+	for _, p := range table.Partitions {
+		if p.Type == gpt.Unused || growing[p.Index] {
+			continue
+		}
+		if by, ok := protected[p.Index]; ok {
+			opts.logger().Debug("excluded, not a shrink candidate", "partition", p.Index, "excluded", by)
+			continue
+		}
+		if name, ok := bootPartitionType(p.Type); ok && !opts.ForceBootPartitions {
+			opts.logger().Debug("boot partition, not a shrink candidate", "partition", p.Index, "type", name)
+			continue
+		}
+		fs, err := d.GetFilesystem(p.Index)
+		if err != nil || fs.Type() != filesystem.TypeExt4 {
+			continue
+		}
+		usage, err := readExt4Usage(d.Backend, p.GetStart())
+		if err != nil {
+			opts.logger().Debug("cannot read ext4 usage, not a shrink candidate", "partition", p.Index, "error", err)
+			continue
+		}
+		if spare := opts.shrinkable(usage); spare < required {
+			opts.logger().Debug("too little spare space, not a shrink candidate", "partition", p.Index, "spare", spare, "required", required)
+			continue
+		}
+		if best == nil || p.GetSize() > best.GetSize() {
+			best = p
+		}
+	}
+	if best == nil {
+		return partitionData{}, fmt.Errorf("no ext4 partition that can spare at least %d bytes found to shrink", required)
+	}
+	return partitionData{
+		label:  best.Name,
+		uuid:   best.UUID(),
+		size:   best.GetSize(),
+		start:  best.GetStart(),
+		end:    best.GetStart() + best.GetSize() - 1,
+		number: best.Index,
+	}, nil
+}
+
 // partitionDevicePath maps a whole-disk path (e.g. "/dev/sda") and a
 // partition number to the partition's device path (e.g. "/dev/sda9",
 // "/dev/nvme0n1p9", "/dev/mmcblk0p9").
@@ -322,7 +666,7 @@ func partitionDevicePath(diskPath string, partNumber int, syspath string) (strin
 	if syspath == "" {
 		syspath = sysDefaultPath
 	}
-	diskBase := filepath.Base(diskPath)
+	diskBase := filepath.Base(resolvePath(diskPath))
 	diskSysDir := filepath.Join(syspath, "class", "block", diskBase)
 	entries, err := os.ReadDir(diskSysDir)
 	if err != nil {
@@ -347,3 +691,28 @@ func partitionDevicePath(diskPath string, partNumber int, syspath string) (strin
 	}
 	return "", fmt.Errorf("partition %d not found under %s", partNumber, diskSysDir)
 }
+
+// kernelPartitionStart returns the offset in bytes at which the kernel has
+// partition partNumber of diskPath start, as sysfs reports it. Until the
+// kernel re-reads the partition table, this is where the partition started
+// before, whatever the table on disk says. If syspath is empty, /sys is used.
+func kernelPartitionStart(diskPath string, partNumber int, syspath string) (int64, error) {
+	if syspath == "" {
+		syspath = sysDefaultPath
+	}
+	partDevice, err := partitionDevicePath(diskPath, partNumber, syspath)
+	if err != nil {
+		return 0, err
+	}
+	startFile := filepath.Join(syspath, "class", "block", filepath.Base(resolvePath(diskPath)), filepath.Base(partDevice), "start")
+	raw, err := os.ReadFile(startFile)
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", startFile, err)
+	}
+	// sysfs counts 512-byte sectors, whatever the disk's sector size
+	return sectors * 512, nil
+}
@@ -1,14 +1,20 @@
 package partitionresizer
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
@@ -35,13 +41,13 @@ func TestShrinkFilesystem(t *testing.T) {
 	t.Run("nonexistent", func(t *testing.T) {
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
-		execResize2fs = func(_ string, _ int64, _ bool) error {
+		execResize2fs = func(_ context.Context, _ string, _ int64, _ bool) error {
 			return fmt.Errorf("resize failure")
 		}
 
 		data := partitionData{name: "pY", number: 1, size: 5 * 1024 * 1024}
 		totalGrow := int64(1 * 1024 * 1024)
-		err := resizeFilesystem(filepath.Join("/dev", data.name), data, -1*totalGrow, true)
+		err := resizeFilesystem(context.Background(), slog.Default(), filepath.Join("/dev", data.name), data, -1*totalGrow, true)
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -58,13 +64,13 @@ func TestShrinkFilesystem(t *testing.T) {
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
 		resizeErr := fmt.Errorf("resize failure")
-		execResize2fs = func(_ string, _ int64, _ bool) error {
+		execResize2fs = func(_ context.Context, _ string, _ int64, _ bool) error {
 			return resizeErr
 		}
 
 		data := partitionData{name: "pY", number: 1, size: 5 * 1024 * 1024}
 		totalGrow := int64(1 * 1024 * 1024)
-		err := resizeFilesystem(tmpFile, data, -1*totalGrow, true)
+		err := resizeFilesystem(context.Background(), slog.Default(), tmpFile, data, -1*totalGrow, true)
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -84,7 +90,7 @@ func TestShrinkFilesystem(t *testing.T) {
 		)
 		orig := execResize2fs
 		defer func() { execResize2fs = orig }()
-		execResize2fs = func(dev string, mb int64, _ bool) error {
+		execResize2fs = func(_ context.Context, dev string, mb int64, _ bool) error {
 			calledDevice = dev
 			calledMB = mb
 			return nil
@@ -97,7 +103,7 @@ func TestShrinkFilesystem(t *testing.T) {
 			start:  2048,
 		}
 		totalGrow := int64(2 * 1024 * 1024) // 2MB
-		if err := resizeFilesystem(tmpFile, data, -1*totalGrow, true); err != nil {
+		if err := resizeFilesystem(context.Background(), slog.Default(), tmpFile, data, -1*totalGrow, true); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
@@ -139,6 +145,7 @@ func TestPlanResizes(t *testing.T) {
 			diskData,
 			[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 3*GB)},
 			nil,
+			Options{},
 		)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
@@ -162,6 +169,7 @@ func TestPlanResizes(t *testing.T) {
 				diskData,
 				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 8*GB)},
 				nil,
+				Options{},
 			)
 			if err == nil {
 				t.Fatal("expected error due to insufficient space and no shrinkPartition, got nil")
@@ -177,7 +185,8 @@ func TestPlanResizes(t *testing.T) {
 				table,
 				diskData,
 				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 5*GB)},
-				&shrink,
+				[]PartitionIdentifier{shrink},
+				Options{},
 			)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
@@ -193,9 +202,233 @@ func TestPlanResizes(t *testing.T) {
 				t.Errorf("target %d size = %d, want %d", resizes[1].target.number, resizes[1].target.size, 5*GB)
 			}
 		})
+		t.Run("with shrink granularity", func(t *testing.T) {
+			for _, tt := range []struct {
+				name        string
+				granularity int64
+				want        int64
+			}{
+				{"default", 0, 15*GB - MB},
+				{"GB", GB, 14 * GB},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					table := makeTable(1*GB, 20*GB)
+					diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+					d := &disk.Disk{Size: 21 * GB}
+					resizes, err := planResizes(
+						d,
+						table,
+						diskData,
+						[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 5*GB+512)},
+						[]PartitionIdentifier{NewPartitionIdentifier(IdentifierByName, "p2")},
+						Options{ShrinkGranularity: tt.granularity},
+					)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if resizes[0].target.size != tt.want {
+						t.Errorf("shrink target size = %d, want %d", resizes[0].target.size, tt.want)
+					}
+				})
+			}
+		})
+		t.Run("with exact shrink amount", func(t *testing.T) {
+			table := makeTable(1*GB, 20*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+			d := ext4ShrinkDisk(t, 21*GB, table.Partitions[1], 10*GB)
+			resizes, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 5*GB)},
+				[]PartitionIdentifier{NewRelativePartitionChange(IdentifierByName, "p2", -6*GB)},
+				Options{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(resizes) != 2 {
+				t.Fatalf("expected 2 resizes, got %d", len(resizes))
+			}
+			// exactly 6GB taken, rather than the planner's GB-rounded 5GB
+			if resizes[0].target.size != 14*GB {
+				t.Errorf("target %d size = %d, want %d", resizes[0].target.number, resizes[0].target.size, 14*GB)
+			}
+		})
+		t.Run("with positive shrink amount", func(t *testing.T) {
+			table := makeTable(1*GB, 20*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+			d := &disk.Disk{Size: 21 * GB}
+			_, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 5*GB)},
+				[]PartitionIdentifier{NewRelativePartitionChange(IdentifierByName, "p2", 6*GB)},
+				Options{},
+			)
+			if err == nil {
+				t.Fatal("expected error for a positive shrink delta, got nil")
+			}
+		})
+		t.Run("with exact shrink amount not needed", func(t *testing.T) {
+			table := makeTable(1*GB, 10*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+			d := ext4ShrinkDisk(t, 21*GB, table.Partitions[1], 5*GB)
+			resizes, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 2*GB)},
+				[]PartitionIdentifier{NewRelativePartitionChange(IdentifierByName, "p2", -3*GB)},
+				Options{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the grow fits without it, but the shrink is still made
+			if len(resizes) != 2 || resizes[0].original.number != 2 || resizes[0].target.size != 7*GB {
+				t.Errorf("resizes = %+v, want partition 2 shrunk by exactly 3GB", resizes)
+			}
+		})
+		t.Run("with exact and bare shrink partitions not needed", func(t *testing.T) {
+			table := makeTable(1*GB, 10*GB, 5*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2", "p3"}, table)
+			d := ext4ShrinkDisk(t, 21*GB, table.Partitions[1], 5*GB)
+			resizes, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 4*GB)},
+				[]PartitionIdentifier{
+					NewRelativePartitionChange(IdentifierByName, "p2", -3*GB),
+					NewPartitionIdentifier(IdentifierByName, "p3"),
+				},
+				Options{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the exact shrink is made, but p3, only for a grow that does
+			// not fit, is left as it is
+			if len(resizes) != 2 || resizes[0].original.number != 2 || resizes[0].target.size != 7*GB || resizes[1].original.number != 1 {
+				t.Errorf("resizes = %+v, want partition 2 shrunk by exactly 3GB and partition 1 grown", resizes)
+			}
+		})
+		t.Run("with sizes not whole sectors", func(t *testing.T) {
+			// 1.3G, as parseSize gives it
+			const size = 1395864371
+			table := makeTable(1*GB, 20*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+			d := ext4ShrinkDisk(t, 21*GB, table.Partitions[1], 10*GB)
+			resizes, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", size)},
+				[]PartitionIdentifier{NewRelativePartitionChange(IdentifierByName, "p2", -size)},
+				Options{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(resizes) != 2 {
+				t.Fatalf("resizes = %+v, want partition 2 shrunk and partition 1 grown", resizes)
+			}
+			for _, r := range resizes {
+				if r.target.size%testSectorSize != 0 || r.target.start%testSectorSize != 0 {
+					t.Errorf("partition %d planned at %d for %d bytes, want whole sectors", r.original.number, r.target.start, r.target.size)
+				}
+			}
+			if shrunk := resizes[0].original.size - resizes[0].target.size; shrunk < size || resizes[1].target.size > size {
+				t.Errorf("partition 2 shrunk by %d and partition 1 grown to %d, want the shrink rounded up and the grow down from %d", shrunk, resizes[1].target.size, size)
+			}
+		})
+		t.Run("with shrinks freeing space in separate gaps", func(t *testing.T) {
+			table := makeTable(1*GB, 4*GB, 4*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2", "p3"}, table)
+			d := ext4ShrinkDisk(t, 9*GB+1*MB, table.Partitions[1], 3*GB)
+			// p3 has the same filesystem as p2
+			sb := make([]byte, ext4SuperblockSize)
+			if _, err := d.Backend.ReadAt(sb, table.Partitions[1].GetStart()+ext4SuperblockOffset); err != nil {
+				t.Fatal(err)
+			}
+			w, err := d.Backend.Writable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.WriteAt(sb, table.Partitions[2].GetStart()+ext4SuperblockOffset); err != nil {
+				t.Fatal(err)
+			}
+			_, err = planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 4*GB)},
+				[]PartitionIdentifier{
+					NewRelativePartitionChange(IdentifierByName, "p2", -2*GB),
+					NewRelativePartitionChange(IdentifierByName, "p3", -2*GB),
+				},
+				Options{},
+			)
+			// 4GB is freed, but as 2GB after each of p2 and p3
+			var fragmented *FragmentedShrinkError
+			var spaceErr *InsufficientSpaceError
+			if !errors.As(err, &fragmented) || !errors.As(err, &spaceErr) || !slices.Equal(fragmented.Shrunk, []int{2, 3}) {
+				t.Errorf("planResizes() error = %v, want a *FragmentedShrinkError of partitions 2 and 3", err)
+			}
+		})
+		t.Run("with exact shrink amount beyond free space", func(t *testing.T) {
+			table := makeTable(1*GB, 20*GB)
+			diskData := makeDiskPartitionData([]string{"p1", "p2"}, table)
+			d := ext4ShrinkDisk(t, 21*GB, table.Partitions[1], 2*GB)
+			_, err := planResizes(
+				d,
+				table,
+				diskData,
+				[]PartitionChange{NewPartitionChange(IdentifierByName, "p1", 2*GB)},
+				[]PartitionIdentifier{NewRelativePartitionChange(IdentifierByName, "p2", -3*GB)},
+				Options{},
+			)
+			if err == nil || !strings.Contains(err.Error(), "cannot give up") {
+				t.Errorf("planResizes() error = %v, want the exact shrink refused", err)
+			}
+		})
 	})
 }
 
+// ext4ShrinkDisk returns a sparse disk image of size bytes with, at the start
+// of partition p, just enough of an ext4 superblock for p to have free bytes
+// free.
+func ext4ShrinkDisk(t *testing.T, size int64, p *gpt.Partition, free int64) *disk.Disk {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[0x18:], 2) // 4 KiB blocks
+	binary.LittleEndian.PutUint32(sb[0x04:], uint32(int64(p.Size)/(4*KB)))
+	binary.LittleEndian.PutUint32(sb[0x0c:], uint32(free/(4*KB)))
+	backend, err := file.OpenFromPath(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(sb, p.GetStart()+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+	return &disk.Disk{Size: size, Backend: backend}
+}
+
 // TestPartitionDevicePath verifies that partitionDevicePath resolves
 // a whole-disk path + partition number to the kernel-named partition
 // device path via a sysfs lookup. Two fake-sysfs trees cover the
@@ -264,6 +497,24 @@ func TestPartitionDevicePath(t *testing.T) {
 			t.Errorf("partitionDevicePath = %q, want /dev/nvme0n1p9", got)
 		}
 	})
+	t.Run("by-id link", func(t *testing.T) {
+		// a stable name links to the kernel's, which sysfs knows the disk by
+		dev := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dev, "nvme0n1"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dev, "nvme-Samsung_SSD_980_S64DNX0R123456")
+		if err := os.Symlink("nvme0n1", link); err != nil {
+			t.Fatal(err)
+		}
+		got, err := partitionDevicePath(link, 9, tmp)
+		if err != nil {
+			t.Fatalf("partitionDevicePath: %v", err)
+		}
+		if got != "/dev/nvme0n1p9" {
+			t.Errorf("partitionDevicePath = %q, want /dev/nvme0n1p9", got)
+		}
+	})
 	t.Run("partition not found", func(t *testing.T) {
 		_, err := partitionDevicePath("/dev/sda", 42, tmp)
 		if err == nil {
@@ -277,3 +528,175 @@ func TestPartitionDevicePath(t *testing.T) {
 		}
 	})
 }
+
+func TestKernelPartitionStart(t *testing.T) {
+	tmp := t.TempDir()
+	partDir := filepath.Join(tmp, "class", "block", "sda", "sda2")
+	if err := os.MkdirAll(partDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(partDir, "partition"), []byte("2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(partDir, "start"), []byte("2048\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := kernelPartitionStart("/dev/sda", 2, tmp)
+	if err != nil {
+		t.Fatalf("kernelPartitionStart: %v", err)
+	}
+	if got != 1*MB {
+		t.Errorf("kernelPartitionStart = %d, want %d", got, 1*MB)
+	}
+	if _, err := kernelPartitionStart("/dev/sda", 3, tmp); err == nil {
+		t.Error("expected error for non-existent partition number")
+	}
+}
+
+// TestSelectShrinkCandidate verifies that auto-shrink picks an ext4 partition
+// with enough free space, and never one that is being grown or is too full.
+func TestSelectShrinkCandidate(t *testing.T) {
+	tmpDir := t.TempDir()
+	tmpFile := filepath.Join(tmpDir, "disk.img")
+	if err := testCopyFile(imgFile, tmpFile); err != nil {
+		t.Fatalf("failed to copy disk image: %v", err)
+	}
+	f, err := os.Open(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	d, err := diskfs.OpenBackend(file.New(f, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := tableRaw.(*gpt.Table)
+
+	t.Run("ext4 with enough space", func(t *testing.T) {
+		grows := []partitionResizeTarget{{original: partitionData{number: 1}}}
+		got, err := selectShrinkCandidate(d, table, grows, 16*MB, nil, Options{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.number != 2 {
+			t.Errorf("selected partition %d, want 2", got.number)
+		}
+	})
+	t.Run("not enough free space", func(t *testing.T) {
+		if _, err := selectShrinkCandidate(d, table, nil, 1*GB, nil, Options{}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+	t.Run("margin excludes partition", func(t *testing.T) {
+		grows := []partitionResizeTarget{{original: partitionData{number: 1}}}
+		if _, err := selectShrinkCandidate(d, table, grows, 16*MB, nil, Options{ShrinkMarginPercent: 100}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+	t.Run("protected partition is excluded", func(t *testing.T) {
+		grows := []partitionResizeTarget{{original: partitionData{number: 1}}}
+		if _, err := selectShrinkCandidate(d, table, grows, 16*MB, map[int]string{2: "label=partb"}, Options{}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+	t.Run("grown partition is excluded", func(t *testing.T) {
+		grows := []partitionResizeTarget{{original: partitionData{number: 2}}}
+		if _, err := selectShrinkCandidate(d, table, grows, 16*MB, nil, Options{}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+// TestDistributeShrink verifies that the space to reclaim is split across
+// several shrink partitions in proportion to their free space.
+func TestDistributeShrink(t *testing.T) {
+	f, err := os.Open(diskfullImg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	d, err := diskfs.OpenBackend(file.New(f, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableRaw, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shrinks []partitionData
+	for _, p := range tableRaw.(*gpt.Table).Partitions {
+		if p.Name == "parta" || p.Name == "shrinker" {
+			shrinks = append(shrinks, partitionData{label: p.Name, number: p.Index, start: p.GetStart(), size: p.GetSize()})
+		}
+	}
+	if len(shrinks) != 2 {
+		t.Fatalf("found %d shrink partitions, want 2", len(shrinks))
+	}
+
+	t.Run("single", func(t *testing.T) {
+		amounts, err := distributeShrink(&disk.Disk{}, shrinks[:1], []int64{0}, 3*GB, Options{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(amounts) != 1 || amounts[0] != 3*GB {
+			t.Errorf("amounts = %v, want [%d]", amounts, 3*GB)
+		}
+	})
+	t.Run("proportional", func(t *testing.T) {
+		total := int64(1 * GB)
+		amounts, err := distributeShrink(d, shrinks, []int64{0, 0}, total, Options{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var sum int64
+		for i, a := range amounts {
+			if a%MB != 0 {
+				t.Errorf("amount[%d] = %d, not MB aligned", i, a)
+			}
+			sum += a
+		}
+		if sum < total {
+			t.Errorf("sum of amounts = %d, want at least %d", sum, total)
+		}
+		// the large, mostly empty shrinker must give up more than parta
+		if amounts[1] <= amounts[0] {
+			t.Errorf("amounts = %v, want shrinker share larger than parta share", amounts)
+		}
+	})
+	t.Run("fixed", func(t *testing.T) {
+		// parta gives up exactly 10MB+1 byte, unrounded; shrinker covers the rest
+		amounts, err := distributeShrink(d, shrinks, []int64{10*MB + 1, 0}, 1*GB, Options{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := []int64{10*MB + 1, 1*GB - 10*MB - 1}
+		if amounts[0] != want[0] || amounts[1] != want[1] {
+			t.Errorf("amounts = %v, want %v", amounts, want)
+		}
+	})
+	t.Run("insufficient", func(t *testing.T) {
+		if _, err := distributeShrink(d, shrinks, []int64{0, 0}, 100*GB, Options{}); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+	t.Run("margin", func(t *testing.T) {
+		usage, err := readExt4Usage(d.Backend, shrinks[0].start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount := usage.free / 2
+		if _, err := distributeShrink(d, shrinks[:1], []int64{0}, amount, Options{ShrinkMargin: usage.free / 4}); err != nil {
+			t.Errorf("unexpected error within margin: %v", err)
+		}
+		if _, err := distributeShrink(d, shrinks[:1], []int64{0}, amount, Options{ShrinkMargin: usage.free/2 + 1}); err == nil {
+			t.Error("expected error when margin is not kept, got nil")
+		}
+		if _, err := distributeShrink(d, shrinks[:1], []int64{amount}, amount, Options{ShrinkMarginPercent: 100}); err == nil {
+			t.Error("expected error for fixed amount breaking percentage margin, got nil")
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package partitionresizer
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -70,7 +71,7 @@ func runResizeTest(t *testing.T, preserveNumbers bool) {
 		NewPartitionChange(IdentifierByLabel, "partb", 2*GB),
 		NewPartitionChange(IdentifierByLabel, "ESP", 1*GB),
 	}
-	if err := Run(tmpFile, &shrink, growList, false, false, preserveNumbers); err != nil {
+	if _, err := Run(tmpFile, []PartitionIdentifier{shrink}, growList, Options{PreserveNumbers: preserveNumbers}); err != nil {
 		t.Fatalf("Run failed: %v", err)
 	}
 
@@ -143,3 +144,58 @@ func runResizeTest(t *testing.T, preserveNumbers bool) {
 		}
 	}
 }
+
+// TestRunDisk resizes a disk image the test opened itself, without a path,
+// relocating an unformatted partition, which is copied byte for byte.
+func TestRunDisk(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+	})
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := file.New(f, false)
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// partitions are found in the GPT, which has no names for them
+	byName := []PartitionChange{NewPartitionChange(IdentifierByName, "sda1", 16*MB)}
+	if _, err := RunDisk(d, nil, byName, Options{DryRun: true}); err == nil {
+		t.Error("RunDisk() with a partition identified by name succeeded, want an error")
+	}
+
+	grow := []PartitionChange{NewPartitionChange(IdentifierByLabel, "data", 16*MB)}
+	// options are checked as Run checks them
+	var planErr *PlanError
+	if _, err := RunDisk(d, nil, grow, Options{DryRun: true, IOPriority: "realtime"}); !errors.As(err, &planErr) {
+		t.Errorf("RunDisk() with an invalid I/O priority error = %v, want a *PlanError", err)
+	}
+
+	res, err := RunDisk(d, nil, grow, Options{})
+	if err != nil {
+		t.Fatalf("RunDisk() error: %v", err)
+	}
+	if len(res.Partitions) != 1 || !res.Partitions[0].Moved || res.Partitions[0].Final.Size != 16*MB {
+		t.Errorf("RunDisk() partitions = %+v, want data moved and grown to %d bytes", res.Partitions, 16*MB)
+	}
+
+	// the disk is left open, and holds the new table
+	table, err := readGPT(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grown *gpt.Partition
+	for _, p := range table.Partitions {
+		if p.Name == "data" {
+			grown = p
+		}
+	}
+	if grown == nil || grown.GetSize() != 16*MB || grown.GetStart() != res.Partitions[0].Final.Start {
+		t.Errorf("partition data is %+v after RunDisk(), want it at %d of %d bytes", grown, res.Partitions[0].Final.Start, 16*MB)
+	}
+}
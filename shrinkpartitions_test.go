@@ -1,6 +1,7 @@
 package partitionresizer
 
 import (
+	"log/slog"
 	"os"
 	"path/filepath"
 	"testing"
@@ -10,7 +11,8 @@ import (
 	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
-// TestShrinkPartitionsSparseIndex verifies shrinkPartitions on a non-contiguous
+// TestShrinkPartitionsSparseIndex verifies shrinkPartitions, by way of
+// preparePartitions, on a non-contiguous
 // GPT layout, where a partition's number is not its slice position + 1 (e.g.
 // EVE's persist partition at index 9 with gaps below it). d.Table.Partitions is
 // a compacted slice of only the active partitions, so the previous
@@ -51,8 +53,8 @@ func TestShrinkPartitionsSparseIndex(t *testing.T) {
 		original: partitionData{number: 9, label: "P9", size: 128 * MB},
 		target:   partitionData{number: 9, size: 64 * MB},
 	}}
-	if err := shrinkPartitions(d, resizes); err != nil {
-		t.Fatalf("shrinkPartitions failed: %v", err)
+	if _, err := preparePartitions(slog.Default(), nil, d, resizes); err != nil {
+		t.Fatalf("preparePartitions failed: %v", err)
 	}
 
 	tr, err := d.GetPartitionTable()
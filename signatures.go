@@ -0,0 +1,123 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	// ZFS keeps four 256 KiB vdev labels, two at the start of the device and two
+	// at the end, each with its uberblock array in its second 128 KiB: a ring
+	// of slots of 1 KiB, or of the sector size of the pool if larger, any of
+	// which may hold the only uberblock written so far
+	zfsLabelSize      = 256 * KB
+	zfsUberblockAt    = 128 * KB
+	zfsUberblockRing  = 128 * KB
+	zfsUberblockSlot  = 1 * KB
+	zfsUberblockMagic = 0x00bab10c
+	// bcache keeps its superblock 4 KiB in, with the magic 24 bytes into it
+	bcacheMagicAt = 4*KB + 24
+)
+
+var (
+	bcacheMagic     = []byte{0xc6, 0x85, 0x73, 0xf6, 0x4e, 0x1a, 0x45, 0xca, 0x82, 0x65, 0xf5, 0x7f, 0x48, 0xba, 0x6d, 0x81}
+	cephBlueStore   = []byte("bluestore block device\n")
+	signatureProbes = []struct {
+		name  string
+		probe func(r io.ReaderAt, part partitionData) (bool, error)
+	}{
+		{"ZFS", probeZFS},
+		{"bcache", probeBcache},
+		{"Ceph BlueStore OSD", probeCeph},
+	}
+)
+
+// readAtPartition reads len(buf) bytes at offset within the partition part,
+// returning false if that lies beyond the end of the partition or the disk.
+func readAtPartition(r io.ReaderAt, part partitionData, buf []byte, offset int64) (bool, error) {
+	if offset < 0 || offset+int64(len(buf)) > part.size {
+		return false, nil
+	}
+	if _, err := r.ReadAt(buf, part.start+offset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// probeZFS looks for an uberblock in every slot of the uberblock ring of each
+// vdev label of part. Slots larger than 1 KiB are aligned to their size, so
+// every one starts at a multiple of 1 KiB into the ring.
+func probeZFS(r io.ReaderAt, part partitionData) (bool, error) {
+	end := part.size &^ (zfsLabelSize - 1)
+	buf := make([]byte, zfsUberblockRing)
+	for _, label := range []int64{0, zfsLabelSize, end - 2*zfsLabelSize, end - zfsLabelSize} {
+		ok, err := readAtPartition(r, part, buf, label+zfsUberblockAt)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		for slot := 0; slot < zfsUberblockRing; slot += zfsUberblockSlot {
+			// the uberblock is written in the host's byte order
+			if binary.LittleEndian.Uint64(buf[slot:]) == zfsUberblockMagic || binary.BigEndian.Uint64(buf[slot:]) == zfsUberblockMagic {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func probeBcache(r io.ReaderAt, part partitionData) (bool, error) {
+	buf := make([]byte, len(bcacheMagic))
+	ok, err := readAtPartition(r, part, buf, bcacheMagicAt)
+	return ok && bytes.Equal(buf, bcacheMagic), err
+}
+
+func probeCeph(r io.ReaderAt, part partitionData) (bool, error) {
+	buf := make([]byte, len(cephBlueStore))
+	ok, err := readAtPartition(r, part, buf, 0)
+	return ok && bytes.Equal(buf, cephBlueStore), err
+}
+
+// probeSignature looks for the on-disk signature of a storage subsystem that
+// identifies its devices by content -- ZFS, bcache or a Ceph OSD -- on the
+// partition described by part, returning the subsystem's name, or "" if none is
+// found. Such a partition must not be raw-copied like an unknown filesystem: a
+// duplicate of it can be picked up by the subsystem as a second copy of the
+// same device.
+func probeSignature(r io.ReaderAt, part partitionData) (string, error) {
+	for _, p := range signatureProbes {
+		found, err := p.probe(r, part)
+		if err != nil {
+			return "", fmt.Errorf("probe for %s: %w", p.name, err)
+		}
+		if found {
+			return p.name, nil
+		}
+	}
+	return "", nil
+}
+
+// refuseForeignSignatures returns an error if any partition to be resized
+// carries the signature of a storage subsystem found by probeSignature.
+func refuseForeignSignatures(d *disk.Disk, resizes []partitionResizeTarget) error {
+	for _, r := range resizes {
+		name, err := probeSignature(d.Backend, r.original)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", r.original.number, err)
+		}
+		if name != "" {
+			return fmt.Errorf("partition %d holds a %s device and cannot be resized; use that subsystem's own tools", r.original.number, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestProbeSignature(t *testing.T) {
+	const size = 2 * MB
+	part := partitionData{number: 1, start: 1 * MB, size: size}
+	tests := []struct {
+		name  string
+		write func(buf []byte)
+		want  string
+	}{
+		{"zfs first label", func(buf []byte) {
+			binary.LittleEndian.PutUint64(buf[zfsUberblockAt:], zfsUberblockMagic)
+		}, "ZFS"},
+		{"zfs first label, a later slot of the ring", func(buf []byte) {
+			binary.LittleEndian.PutUint64(buf[zfsUberblockAt+37*zfsUberblockSlot:], zfsUberblockMagic)
+		}, "ZFS"},
+		{"zfs last label big endian", func(buf []byte) {
+			binary.BigEndian.PutUint64(buf[size-zfsLabelSize+zfsUberblockAt:], zfsUberblockMagic)
+		}, "ZFS"},
+		{"bcache", func(buf []byte) {
+			copy(buf[bcacheMagicAt:], bcacheMagic)
+		}, "bcache"},
+		{"ceph", func(buf []byte) {
+			copy(buf, cephBlueStore)
+		}, "Ceph BlueStore OSD"},
+		{"none", func([]byte) {}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := make([]byte, part.start+size)
+			tt.write(disk[part.start:])
+			got, err := probeSignature(bytes.NewReader(disk), part)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("probeSignature() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package partitionresizer
+
+import (
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// PhaseCheckSources names, in a DryRunProblem, the integrity checks of the
+// source filesystems that come before the first phase of a resize.
+const PhaseCheckSources = "check-sources"
+
+// simulation collects the problems simulate finds.
+type simulation struct {
+	device string
+	// locator finds the tools the resize runs, nil if its ExecRunner
+	// cannot tell, in which case every tool is taken to be there
+	locator  ToolLocator
+	needed   map[string]bool
+	noPath   bool
+	problems []DryRunProblem
+}
+
+// simulate returns the steps of the resizes of d that would fail, going
+// further than planning does, but changing nothing and running no tool: each
+// filesystem to shrink is probed to see that it can be shrunk, and is not
+// holding more than its target size, and each external tool the resize would
+// run is looked for, with opts.ExecRunner should it be a ToolLocator. A tool
+// missing is reported once, at the first step to need it. The problems are in
+// the order the resize would reach them, partition by partition within a
+// phase.
+func simulate(d *disk.Disk, resizes []partitionResizeTarget, opts Options) []DryRunProblem {
+	s := &simulation{device: d.Backend.Path(), needed: map[string]bool{}}
+	if opts.ExecRunner == nil {
+		s.locator = LocalExecRunner{}
+	} else if locator, ok := opts.ExecRunner.(ToolLocator); ok {
+		s.locator = locator
+	}
+	checked := map[int]bool{}
+	for _, r := range resizes {
+		if r.inPlace || checked[r.original.number] {
+			continue
+		}
+		checked[r.original.number] = true
+		fs, err := d.GetFilesystem(r.original.number)
+		if err != nil {
+			if !isUnknownFilesystem(err) {
+				s.fail(PhaseCheckSources, r.original.number, "", "cannot read filesystem: %v", err)
+			}
+			continue
+		}
+		if tool := checkerTool(fs.Type()); tool != "" {
+			s.need(PhaseCheckSources, r.original.number, tool)
+		}
+	}
+	for _, r := range resizes {
+		if r.original.size > r.target.size {
+			s.shrink(d, r)
+		}
+	}
+	for _, r := range resizes {
+		if r.original.start != r.target.start {
+			s.copy(d, r)
+		}
+	}
+	for _, r := range resizes {
+		if r.inPlace {
+			s.growInPlace(d, r)
+		} else if r.original.start != r.target.start && r.target.size > r.original.size {
+			if _, isLUKS, err := readLUKSHeader(d.Backend, r.original.start); err == nil && isLUKS {
+				s.need(PhaseGrowFilesystems, r.original.number, "cryptsetup", "e2fsck", "resize2fs")
+			}
+		}
+	}
+	return s.problems
+}
+
+// shrink simulates shrinking the filesystem of r, see shrinkFilesystems and
+// shrinkLUKSFilesystems.
+func (s *simulation) shrink(d *disk.Disk, r partitionResizeTarget) {
+	number := r.original.number
+	hdr, isSwap, err := readSwapHeader(d.Backend, r.original.start)
+	if err != nil {
+		s.fail(PhaseShrinkFilesystems, number, "", "cannot check for swap: %v", err)
+		return
+	}
+	if isSwap {
+		if r.target.size < hdr.minSize() {
+			s.fail(PhaseShrinkFilesystems, number, "", "swap would shrink to %d bytes, below its minimum of %d", r.target.size, hdr.minSize())
+		}
+		s.need(PhaseShrinkFilesystems, number, "mkswap")
+		return
+	}
+	luks, isLUKS, err := readLUKSHeader(d.Backend, r.original.start)
+	if err != nil {
+		s.fail(PhaseShrinkFilesystems, number, "", "cannot check for LUKS: %v", err)
+		return
+	}
+	if isLUKS {
+		// the filesystem inside cannot be read without opening the container
+		if r.target.size <= luks.payloadOffset {
+			s.fail(PhaseShrinkFilesystems, number, "", "%d bytes is too small for its LUKS header of %d bytes", r.target.size, luks.payloadOffset)
+		}
+		s.need(PhaseShrinkFilesystems, number, "cryptsetup", "e2fsck", "resize2fs")
+		return
+	}
+	usage, err := readExt4Usage(d.Backend, r.original.start)
+	if err != nil {
+		s.fail(PhaseShrinkFilesystems, number, "", "only ext4, swap and LUKS can be shrunk: %v", err)
+		return
+	}
+	if usage.used() > r.target.size {
+		s.fail(PhaseShrinkFilesystems, number, "", "filesystem holds %d bytes, more than the %d bytes it would shrink to", usage.used(), r.target.size)
+	}
+	s.need(PhaseShrinkFilesystems, number, "e2fsck", "resize2fs")
+}
+
+// copy simulates copying r to its new location, see copyFilesystems.
+func (s *simulation) copy(d *disk.Disk, r partitionResizeTarget) {
+	if _, isSwap, err := readSwapHeader(d.Backend, r.original.start); err == nil && isSwap {
+		s.need(PhaseCopy, r.original.number, "mkswap")
+		return
+	}
+	if !r.temporaryUUID {
+		return
+	}
+	fsType, _, err := readFilesystemUUID(d.Backend, r.original.start)
+	if err != nil {
+		return
+	}
+	switch fsType {
+	case "ext4":
+		s.need(PhaseCopy, r.original.number, "tune2fs")
+	case "xfs":
+		s.need(PhaseCopy, r.original.number, "xfs_admin")
+	case "luks":
+		s.need(PhaseCopy, r.original.number, "cryptsetup")
+	}
+}
+
+// growInPlace simulates growing the filesystem of r where it is, see
+// growInPlace.
+func (s *simulation) growInPlace(d *disk.Disk, r partitionResizeTarget) {
+	number := r.original.number
+	var mountpoint string
+	if s.device != "" {
+		var err error
+		if mountpoint, err = partitionMountpoint(s.device, number); err != nil {
+			s.fail(PhaseGrowFilesystems, number, "", "%v", err)
+			return
+		}
+	}
+	switch fsType := inPlaceFilesystem(d.Backend, r.original.start); {
+	case fsType == "ext4" && mountpoint != "":
+		s.need(PhaseGrowFilesystems, number, "resize2fs")
+	case fsType == "ext4":
+		s.need(PhaseGrowFilesystems, number, "e2fsck", "resize2fs")
+	case fsType == "xfs" && mountpoint != "":
+		s.need(PhaseGrowFilesystems, number, "xfs_growfs")
+	case fsType == "xfs":
+		s.fail(PhaseGrowFilesystems, number, "", "cannot grow xfs filesystem while it is not mounted")
+	default:
+		s.fail(PhaseGrowFilesystems, number, "", "only ext4 and xfs filesystems can be grown in place")
+	}
+}
+
+// need records that the step phase of partition number runs tools, failing
+// should any not be found, or the disk have no path to run them on.
+func (s *simulation) need(phase string, number int, tools ...string) {
+	if s.device == "" {
+		if !s.noPath {
+			s.noPath = true
+			s.fail(phase, number, "", "disk backend has no path to run %s on", tools[0])
+		}
+		return
+	}
+	for _, tool := range tools {
+		if s.needed[tool] {
+			continue
+		}
+		s.needed[tool] = true
+		if s.locator == nil {
+			continue
+		}
+		if _, err := s.locator.LookPath(tool); err != nil {
+			s.fail(phase, number, tool, "%s not found: %v", tool, err)
+		}
+	}
+}
+
+// fail records that the step phase of partition number would fail.
+func (s *simulation) fail(phase string, number int, tool, format string, args ...any) {
+	s.problems = append(s.problems, DryRunProblem{Phase: phase, Partition: number, Tool: tool, Detail: fmt.Sprintf(format, args...)})
+}
+
+// checkerTool returns the tool filesystemChecker runs for filesystems of type
+// fsType, or "" if there is none.
+func checkerTool(fsType filesystem.Type) string {
+	switch fsType {
+	case filesystem.TypeExt4:
+		return "e2fsck"
+	case filesystem.TypeFat32:
+		return "fsck.fat"
+	}
+	return ""
+}
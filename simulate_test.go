@@ -0,0 +1,115 @@
+package partitionresizer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// locatingExecRunner is an ExecRunner that runs nothing, and finds only the
+// tools it has.
+type locatingExecRunner map[string]bool
+
+func (locatingExecRunner) Run(context.Context, string, []string, time.Duration, io.Writer, io.Writer) error {
+	return nil
+}
+
+func (r locatingExecRunner) LookPath(cmd string) (string, error) {
+	if !r[cmd] {
+		return "", exec.ErrNotFound
+	}
+	return "/sbin/" + cmd, nil
+}
+
+// TestSimulate simulates shrinking an ext4 filesystem holding more than its
+// target size, and a partition with no filesystem that can be shrunk, with
+// resize2fs missing, and an ExecRunner that cannot look tools up.
+func TestSimulate(t *testing.T) {
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 64*MB); err != nil {
+		t.Fatal(err)
+	}
+	ext4 := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	raw := partitionData{number: 2, label: "blob", start: 9 * MB, size: 8 * MB, end: 17*MB - 1}
+	resizes := []partitionResizeTarget{
+		{original: ext4, target: partitionData{number: 1, label: "data", start: 1 * MB, size: 4 * MB, end: 5*MB - 1}},
+		{original: raw, target: partitionData{number: 2, label: "blob", start: 9 * MB, size: 4 * MB, end: 13*MB - 1}},
+	}
+
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: sectorSize, PhysicalSectorSize: sectorSize}
+	for _, p := range []partitionData{ext4, raw} {
+		table.Partitions = append(table.Partitions, &gpt.Partition{Index: p.number, Start: uint64(p.start / sectorSize), Size: uint64(p.size), Type: gpt.LinuxFilesystem, Name: p.label})
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	// an ext4 filesystem of 8 MB with 6 MB of it in use
+	sb := make([]byte, ext4SuperblockSize)
+	binary.LittleEndian.PutUint16(sb[0x38:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[0x18:], 2) // 4 KiB blocks
+	binary.LittleEndian.PutUint32(sb[0x04:], uint32(8*MB/(4*KB)))
+	binary.LittleEndian.PutUint32(sb[0x0c:], uint32(2*MB/(4*KB)))
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(sb, ext4.start+ext4SuperblockOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	var shrinks []DryRunProblem
+	for _, p := range simulate(d, resizes, Options{ExecRunner: locatingExecRunner{"e2fsck": true}}) {
+		if p.Phase == PhaseShrinkFilesystems {
+			shrinks = append(shrinks, p)
+		}
+	}
+	if len(shrinks) != 3 {
+		t.Fatalf("simulate() found %d shrink problems, want 3: %+v", len(shrinks), shrinks)
+	}
+	if p := shrinks[0]; p.Partition != 1 || p.Tool != "" || !strings.Contains(p.Detail, "holds 6291456 bytes") {
+		t.Errorf("first problem = %+v, want partition 1 holding too much", p)
+	}
+	if p := shrinks[1]; p.Partition != 1 || p.Tool != "resize2fs" {
+		t.Errorf("second problem = %+v, want resize2fs not found for partition 1", p)
+	}
+	if p := shrinks[2]; p.Partition != 2 || p.Tool != "" || !strings.Contains(p.Detail, "only ext4") {
+		t.Errorf("third problem = %+v, want partition 2 that cannot be shrunk", p)
+	}
+
+	// a runner that cannot look tools up is taken to have them all
+	for _, p := range simulate(d, resizes, Options{ExecRunner: &fakeExecRunner{}}) {
+		if p.Tool != "" {
+			t.Errorf("simulate() with a runner that is not a ToolLocator reported %+v", p)
+		}
+	}
+
+	err = NewDryRunError(diskPath, shrinks[:1])
+	var dryErr *DryRunError
+	if !errors.As(err, &dryErr) || !strings.Contains(err.Error(), "shrink-filesystems of partition 1: filesystem holds") {
+		t.Errorf("NewDryRunError() = %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package partitionresizer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	// DefaultSnapshotDir is where the CLI keeps its metadata snapshots by
+	// default.
+	DefaultSnapshotDir = "/var/lib/partitionresizer/snapshots"
+	// snapshotRegionSize is how much of the start, and of the end, of each
+	// affected partition a snapshot keeps: enough for the superblocks, FAT
+	// boot sectors and headers that say what a partition holds.
+	snapshotRegionSize = 4 * MB
+	// snapshotTableFile is the name of the partition table backup in a
+	// snapshot, see BackupPartitionTable.
+	snapshotTableFile = "table.bak"
+	// snapshotManifestFile is the name of the snapshot's manifest.
+	snapshotManifestFile = "manifest.json"
+)
+
+// snapshotManifest describes a snapshot: the disk it was taken of, and where
+// on the disk each region it keeps came from.
+type snapshotManifest struct {
+	Disk       string           `json:"disk"`
+	Taken      time.Time        `json:"taken"`
+	SectorSize int64            `json:"sectorSize"`
+	Table      string           `json:"table"`
+	Regions    []snapshotRegion `json:"regions"`
+}
+
+// snapshotRegion is a region of the disk kept in a snapshot, in the file of
+// that name.
+type snapshotRegion struct {
+	File      string `json:"file"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+}
+
+// snapshotRegions returns the regions of the disk a snapshot keeps for
+// resizes: the first and the last snapshotRegionSize bytes of each partition
+// being resized, or all of a partition no larger than both.
+func snapshotRegions(resizes []partitionResizeTarget) []snapshotRegion {
+	var regions []snapshotRegion
+	seen := map[int]bool{}
+	for _, r := range resizes {
+		p := r.original
+		if seen[p.number] {
+			continue
+		}
+		seen[p.number] = true
+		head := min(p.size, snapshotRegionSize)
+		regions = append(regions, snapshotRegion{
+			File:      fmt.Sprintf("partition-%d-head.bin", p.number),
+			Partition: p.number,
+			Offset:    p.start,
+			Size:      head,
+		})
+		tailStart := max(p.start+head, p.start+p.size-snapshotRegionSize)
+		if tail := p.start + p.size - tailStart; tail > 0 {
+			regions = append(regions, snapshotRegion{
+				File:      fmt.Sprintf("partition-%d-tail.bin", p.number),
+				Partition: p.number,
+				Offset:    tailStart,
+				Size:      tail,
+			})
+		}
+	}
+	return regions
+}
+
+// takeSnapshot saves the metadata of d that resizes may change -- the
+// partition table, in the format of sgdisk --backup, and the start and end of
+// each partition being resized -- to a timestamped tar archive in dir, and
+// returns its path. Along with them, the archive holds a manifest recording
+// where on the disk each region came from, so that it can be written back,
+// e.g. with dd, should the resize go wrong.
+func takeSnapshot(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, dir string) (string, error) {
+	table, err := partitionTableBackup(d)
+	if err != nil {
+		return "", err
+	}
+	taken := time.Now().UTC()
+	manifest := snapshotManifest{
+		Disk:       d.Backend.Path(),
+		Taken:      taken,
+		SectorSize: d.LogicalBlocksize,
+		Table:      snapshotTableFile,
+		Regions:    snapshotRegions(resizes),
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.tar", filepath.Base(manifest.Disk), taken.Format("20060102T150405Z")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := writeSnapshot(f, d, manifest, table); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return "", fmt.Errorf("failed to write snapshot %s: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	logger.Info("saved metadata snapshot", "disk", manifest.Disk, "path", path)
+	return path, nil
+}
+
+// writeSnapshot writes the snapshot described by manifest to w as a tar
+// archive, reading its regions from d.
+func writeSnapshot(w io.Writer, d *disk.Disk, manifest snapshotManifest, table []byte) error {
+	tw := tar.NewWriter(w)
+	addFile := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: size, ModTime: manifest.Taken}); err != nil {
+			return err
+		}
+		_, err := io.CopyN(tw, r, size)
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addFile(snapshotManifestFile, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := addFile(manifest.Table, int64(len(table)), bytes.NewReader(table)); err != nil {
+		return err
+	}
+	for _, region := range manifest.Regions {
+		if err := addFile(region.File, region.Size, io.NewSectionReader(d.Backend, region.Offset, region.Size)); err != nil {
+			return fmt.Errorf("partition %d: %v", region.Partition, err)
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,117 @@
+package partitionresizer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestSnapshotRegions(t *testing.T) {
+	resizes := []partitionResizeTarget{
+		{original: partitionData{number: 1, start: 1 * MB, size: 16 * MB}},
+		{original: partitionData{number: 2, start: 17 * MB, size: 6 * MB}},
+		{original: partitionData{number: 3, start: 23 * MB, size: 2 * MB}},
+		{original: partitionData{number: 1, start: 1 * MB, size: 16 * MB}},
+	}
+	want := []snapshotRegion{
+		{File: "partition-1-head.bin", Partition: 1, Offset: 1 * MB, Size: 4 * MB},
+		{File: "partition-1-tail.bin", Partition: 1, Offset: 13 * MB, Size: 4 * MB},
+		{File: "partition-2-head.bin", Partition: 2, Offset: 17 * MB, Size: 4 * MB},
+		{File: "partition-2-tail.bin", Partition: 2, Offset: 21 * MB, Size: 2 * MB},
+		{File: "partition-3-head.bin", Partition: 3, Offset: 23 * MB, Size: 2 * MB},
+	}
+	if got := snapshotRegions(resizes); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshotRegions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	diskPath := filepath.Join(dir, "disk.img")
+	part := partitionData{number: 1, label: "data", start: 1 * MB, size: 16 * MB, end: 17*MB - 1}
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: uint64(part.start / 512), Size: uint64(part.size), Type: gpt.LinuxFilesystem, Name: part.label},
+	})
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	w, err := backend.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := bytes.Repeat([]byte("superblock"), 100)
+	tail := bytes.Repeat([]byte("backup superblock"), 100)
+	if _, err := w.WriteAt(head, part.start); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt(tail, part.start+part.size-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotDir := filepath.Join(dir, "snapshots")
+	path, err := takeSnapshot(slog.Default(), d, []partitionResizeTarget{{original: part}}, snapshotDir)
+	if err != nil {
+		t.Fatalf("takeSnapshot() error: %v", err)
+	}
+	if filepath.Dir(path) != snapshotDir {
+		t.Errorf("snapshot at %s, want it in %s", path, snapshotDir)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	files := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var manifest snapshotManifest
+	if err := json.Unmarshal(files[snapshotManifestFile], &manifest); err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if manifest.Disk != diskPath || len(manifest.Regions) != 2 {
+		t.Errorf("manifest = %+v, want disk %s and 2 regions", manifest, diskPath)
+	}
+	if table, err := partitionTableBackup(d); err != nil || !bytes.Equal(files[snapshotTableFile], table) {
+		t.Errorf("snapshot table does not match the disk's partition table (%v)", err)
+	}
+	for _, region := range manifest.Regions {
+		want := make([]byte, region.Size)
+		if _, err := d.Backend.ReadAt(want, region.Offset); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(files[region.File], want) {
+			t.Errorf("%s does not match the disk at %d", region.File, region.Offset)
+		}
+	}
+	if !bytes.HasPrefix(files["partition-1-head.bin"], head) || !bytes.HasSuffix(files["partition-1-tail.bin"], tail) {
+		t.Error("snapshot misses the start or end of the partition")
+	}
+}
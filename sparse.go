@@ -0,0 +1,88 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// zeroBlock is the granularity of the runs of zeros a sparseWriter punches
+// holes for, rather than writing them, and is compared against to find them.
+var zeroBlock = make([]byte, 64*KB)
+
+// sparseWriter is an io.WriterAt writing to f, a regular file, through the
+// io.WriterAt it embeds, that punches a hole in f for each run of zeroBlock
+// or more bytes of nothing but zeros rather than writing it, so that an image
+// file copied to stays as sparse as its source rather than growing to its
+// full size.
+type sparseWriter struct {
+	io.WriterAt
+	f *os.File
+}
+
+// sparseWriterFor returns w, writing to f, as a sparseWriter should f be a
+// regular file, or as it is otherwise, e.g. for a block device.
+func sparseWriterFor(w io.WriterAt, f *os.File) io.WriterAt {
+	if f == nil {
+		return w
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return w
+	}
+	return sparseWriter{WriterAt: w, f: f}
+}
+
+func (w sparseWriter) WriteAt(p []byte, off int64) (int, error) {
+	var written int
+	for written < len(p) {
+		// the run of blocks from written that are all zeros, or none are
+		end := min(written+len(zeroBlock), len(p))
+		zero := isZero(p[written:end])
+		for end < len(p) {
+			next := min(end+len(zeroBlock), len(p))
+			if isZero(p[end:next]) != zero {
+				break
+			}
+			end = next
+		}
+		run := p[written:end]
+		// a filesystem without holes is written the zeros instead
+		if !zero || punchZeros(w.f, off+int64(written), int64(len(run))) != nil {
+			n, err := w.WriterAt.WriteAt(run, off+int64(written))
+			if err != nil {
+				return written + n, err
+			}
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// punchZeros makes the given range of f read as zeros, without writing them,
+// but for its last byte, should f end before it, which extends f, as a write
+// would, without ever truncating what another write extended it to.
+func punchZeros(f *os.File, offset, length int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset+length {
+		if _, err := f.WriteAt([]byte{0}, offset+length-1); err != nil {
+			return err
+		}
+	}
+	return punchHole(f, offset, length)
+}
+
+// isZero reports whether p is all zeros.
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), len(zeroBlock))
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// allocated returns the bytes allocated to the file at path.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// TestSparseCopies copies partitions of 8 MB, with data only in their first
+// and last MB, and checks that the copies read the same but leave the zeros
+// in between as holes, both for CopyRange to a new file, which it extends,
+// and for a partition copied byte for byte within an image.
+func TestSparseCopies(t *testing.T) {
+	dir := t.TempDir()
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = probe.Close() }()
+	if err := probe.Truncate(1 * MB); err != nil {
+		t.Fatal(err)
+	}
+	if err := punchHole(probe, 0, 1*MB); err != nil {
+		t.Skipf("filesystem does not support holes: %v", err)
+	}
+
+	r := partitionResizeTarget{
+		original: partitionData{number: 1, start: 1 * MB, size: 8 * MB},
+		target:   partitionData{number: 2, start: 16 * MB, size: 8 * MB},
+	}
+	data := make([]byte, 32*MB)
+	for i := range 1 * MB {
+		data[r.original.start+int64(i)] = byte(i%251 + 1)
+		data[r.original.start+r.original.size-1*MB+int64(i)] = byte(i%251 + 1)
+	}
+	source := data[r.original.start : r.original.start+r.original.size]
+	diskPath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(diskPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// the target is allocated, as a partition copied over another would be
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xff}, int(r.target.size)), r.target.start); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	t.Run("CopyRange", func(t *testing.T) {
+		copyPath := filepath.Join(dir, "copy.img")
+		if err := CopyRange(diskPath, copyPath, r.original.start, -1, r.original.size, 0); err != nil {
+			t.Fatalf("CopyRange() error: %v", err)
+		}
+		got, err := os.ReadFile(copyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, source) {
+			t.Error("copy differs from its source")
+		}
+		if n := allocated(t, copyPath); n >= 4*MB {
+			t.Errorf("copy has %d bytes allocated, want under %d", n, 4*MB)
+		}
+	})
+
+	t.Run("copyPartitionRaw", func(t *testing.T) {
+		storage, err := file.OpenFromPath(diskPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = storage.Close() }()
+		before := allocated(t, diskPath)
+		if err := copyPartitionRaw(context.Background(), slog.Default(), &disk.Disk{Backend: storage}, r, nopProgress{}); err != nil {
+			t.Fatalf("copyPartitionRaw() error: %v", err)
+		}
+		got, err := os.ReadFile(diskPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[r.target.start:r.target.start+r.original.size], source) {
+			t.Error("copy differs from its source")
+		}
+		if n := allocated(t, diskPath); n > before-4*MB {
+			t.Errorf("image has %d bytes allocated after the copy, want under %d", n, before-4*MB)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+// RecoveryAction is what to do about a resize a journal records, see
+// ResizeStatus.
+type RecoveryAction string
+
+const (
+	// ActionNone is for a resize that has completed.
+	ActionNone RecoveryAction = "none"
+	// ActionResume is to finish the resize, with Resume.
+	ActionResume RecoveryAction = "resume"
+	// ActionRollback is to undo the resize, with Rollback.
+	ActionRollback RecoveryAction = "rollback"
+)
+
+// resizePhases are the phases of a resize, in the order they complete.
+var resizePhases = []string{
+	PhaseShrinkFilesystems,
+	PhasePreparePartitions,
+	PhaseCopy,
+	PhaseValidate,
+	PhaseCommitPartitions,
+	PhaseGrowFilesystems,
+	PhaseCheckFilesystems,
+}
+
+// ResizeStatus is how far a resize got, as its journal records: the phases it
+// completed and those that remain, and what to do about it. Recommended is
+// ActionNone once it has finished; ActionRollback, while the originals of the
+// partitions are still in the partition table and in use, so that the disk is
+// put back as it was before; and ActionResume once the new partitions have
+// replaced them, so that the resize is finished. Reason says why. CanRollback
+// is set unless the resize has grown a partition in place, which cannot be
+// undone, or has started to commit a partition whose original it wipes or
+// discards.
+// Copied is the bytes of each partition, by its original number, that an
+// unfinished raw copy had copied as of its last checkpoint, which Resume
+// continues it from.
+type ResizeStatus struct {
+	Journal     string            `json:"journal"`
+	Disk        string            `json:"disk"`
+	Finished    bool              `json:"finished"`
+	Completed   []string          `json:"completed"`
+	Remaining   []string          `json:"remaining"`
+	Partitions  []PartitionResult `json:"partitions"`
+	Recommended RecoveryAction    `json:"recommended"`
+	Reason      string            `json:"reason"`
+	CanRollback bool              `json:"canRollback"`
+	Copied      map[int]int64     `json:"copied,omitempty"`
+}
+
+// JournalStatus returns the status of the resize recorded in the journal at
+// journalPath, or, once the resize has completed and its journal has been
+// moved aside, at journalPath with .completed appended, without changing
+// anything. It returns an error satisfying errors.Is(err, fs.ErrNotExist)
+// should there be neither, as there is no resize to report on.
+func JournalStatus(journalPath string) (*ResizeStatus, error) {
+	path := journalPath
+	j, err := readJournal(path)
+	if os.IsNotExist(err) {
+		path = journalPath + completedJournalSuffix
+		j, err = readJournal(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resizes := j.resizes()
+	status := &ResizeStatus{
+		Journal:     path,
+		Disk:        j.Disk,
+		Finished:    j.Finished,
+		Completed:   append([]string{}, j.Completed...),
+		Remaining:   []string{},
+		Partitions:  newResult(j.Disk, resizes, j.PreserveNumbers).Partitions,
+		CanRollback: len(j.Table) > 0,
+	}
+	for number, cp := range j.Copies {
+		if status.Copied == nil {
+			status.Copied = map[int]int64{}
+		}
+		for _, copied := range cp.Copied {
+			status.Copied[number] += copied
+		}
+	}
+	for _, phase := range resizePhases {
+		if !j.Finished && !j.done(phase) {
+			status.Remaining = append(status.Remaining, phase)
+		}
+	}
+	committed := j.done(PhaseCommitPartitions)
+	if committed && slices.ContainsFunc(resizes, func(r partitionResizeTarget) bool { return r.inPlace }) {
+		status.CanRollback = false
+	}
+	if number, _ := j.lostOriginal(); number != 0 {
+		status.CanRollback = false
+	}
+	switch {
+	case j.Finished:
+		status.Recommended = ActionNone
+		status.Reason = "the resize completed"
+		if status.CanRollback {
+			status.Reason += "; it can still be rolled back while its original partitions' data is where it was"
+		}
+	case !committed && status.CanRollback:
+		status.Recommended = ActionRollback
+		status.Reason = "the original partitions are still in the partition table, and rolling back removes the partitions the resize created and grows back any filesystem it shrank, leaving the disk as it was; resuming would finish the resize instead"
+	default:
+		status.Recommended = ActionResume
+		stopped := "once its last phase completed"
+		if len(status.Remaining) > 0 {
+			stopped = "before " + status.Remaining[0]
+		}
+		status.Reason = fmt.Sprintf("the resize stopped %s; resuming finishes it", stopped)
+		if committed {
+			status.Reason = fmt.Sprintf("the new partitions have replaced the originals in the partition table, but the resize stopped %s; resuming finishes it", stopped)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,68 @@
+package partitionresizer
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestJournalStatus follows the status of a resize through its journal: to be
+// rolled back before its new partitions are committed, resumed after, and
+// needing nothing once finished.
+func TestJournalStatus(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "journal.json")
+	if _, err := JournalStatus(journalPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("JournalStatus() without a journal error = %v, want fs.ErrNotExist", err)
+	}
+
+	data := partitionData{number: 2, label: "data", start: 1 * MB, size: 4 * MB, end: 5*MB - 1}
+	moved := partitionData{number: 3, label: "data", start: 8 * MB, size: 8 * MB, end: 16*MB - 1}
+	table := &gpt.Table{Partitions: []*gpt.Partition{{Index: 2, Start: 1 * MB / 512, Size: 4 * MB, Name: "data"}}}
+	j, err := newJournal(journalPath, "disk.img", table, []partitionResizeTarget{{original: data, target: moved}}, false, false, Options{})
+	if err != nil {
+		t.Fatalf("newJournal() error: %v", err)
+	}
+	for _, phase := range []string{PhaseShrinkFilesystems, PhasePreparePartitions, PhaseCopy} {
+		if err := j.complete(phase); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err := JournalStatus(journalPath)
+	if err != nil {
+		t.Fatalf("JournalStatus() error: %v", err)
+	}
+	if status.Recommended != ActionRollback || !status.CanRollback || status.Finished {
+		t.Errorf("JournalStatus() before commit = %+v, want rollback recommended", status)
+	}
+	if want := []string{PhaseValidate, PhaseCommitPartitions, PhaseGrowFilesystems, PhaseCheckFilesystems}; !reflect.DeepEqual(status.Remaining, want) {
+		t.Errorf("JournalStatus() remaining = %v, want %v", status.Remaining, want)
+	}
+	if len(status.Partitions) != 1 || status.Partitions[0].Final.Number != 3 || !status.Partitions[0].Moved {
+		t.Errorf("JournalStatus() partitions = %+v, want partition 2 moved to 3", status.Partitions)
+	}
+
+	for _, phase := range []string{PhaseValidate, PhaseCommitPartitions} {
+		if err := j.complete(phase); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status, err = JournalStatus(journalPath); err != nil || status.Recommended != ActionResume {
+		t.Errorf("JournalStatus() after commit = %+v, %v, want resume recommended", status, err)
+	}
+
+	if err := j.finish(); err != nil {
+		t.Fatal(err)
+	}
+	status, err = JournalStatus(journalPath)
+	if err != nil || status.Recommended != ActionNone || !status.Finished || len(status.Remaining) != 0 {
+		t.Errorf("JournalStatus() once finished = %+v, %v, want nothing to do", status, err)
+	}
+	if status != nil && status.Journal != journalPath+completedJournalSuffix {
+		t.Errorf("JournalStatus() read %s, want the journal moved aside", status.Journal)
+	}
+}
@@ -0,0 +1,267 @@
+package partitionresizer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/google/uuid"
+)
+
+const (
+	swapSignature    = "SWAPSPACE2"
+	swapSignatureV0  = "SWAP-SPACE"
+	swapSignatureLen = 10
+	// the version 1 header follows the first 1024 bytes of the partition, which
+	// are left for boot loaders: version, last_page and nr_badpages (4 bytes
+	// each), then the 16 byte UUID and the 16 byte volume label
+	swapUUIDOffset  = 1024 + 12
+	swapLabelOffset = swapUUIDOffset + 16
+	swapLabelSize   = 16
+	// mkswap refuses to create a swap area of fewer than 10 pages
+	swapMinPages = 10
+)
+
+// swapPageSizes are the page sizes a swap signature may be found for; the
+// signature occupies the last 10 bytes of the first page.
+var swapPageSizes = []int64{4096, 8192, 16384, 32768, 65536}
+
+// procSwapsPath is the kernel's list of active swap areas.
+var procSwapsPath = "/proc/swaps"
+
+// swapHeader describes a Linux swap area, as recorded in its header page.
+type swapHeader struct {
+	pageSize int64
+	uuid     string // empty for a version 0 area or one without a UUID
+	label    string
+}
+
+// readSwapHeader looks for a swap signature at the end of the first page of the
+// partition starting at byte offset start in r, for each supported page size.
+// It returns false if the partition does not hold a swap area.
+func readSwapHeader(r io.ReaderAt, start int64) (swapHeader, bool, error) {
+	sig := make([]byte, swapSignatureLen)
+	for _, pageSize := range swapPageSizes {
+		if _, err := r.ReadAt(sig, start+pageSize-swapSignatureLen); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				continue
+			}
+			return swapHeader{}, false, fmt.Errorf("read swap signature: %w", err)
+		}
+		switch string(sig) {
+		case swapSignatureV0:
+			return swapHeader{pageSize: pageSize}, true, nil
+		case swapSignature:
+		default:
+			continue
+		}
+		hdr := make([]byte, swapLabelOffset+swapLabelSize-swapUUIDOffset)
+		if _, err := r.ReadAt(hdr, start+swapUUIDOffset); err != nil {
+			return swapHeader{}, false, fmt.Errorf("read swap header: %w", err)
+		}
+		h := swapHeader{
+			pageSize: pageSize,
+			label:    string(bytes.TrimRight(hdr[swapLabelOffset-swapUUIDOffset:], "\x00")),
+		}
+		if u, err := uuid.FromBytes(hdr[:16]); err == nil && u != uuid.Nil {
+			h.uuid = u.String()
+		}
+		return h, true, nil
+	}
+	return swapHeader{}, false, nil
+}
+
+// minSize returns the smallest size, in bytes, mkswap will create a swap area
+// of with the header's page size.
+func (h swapHeader) minSize() int64 {
+	return swapMinPages * h.pageSize
+}
+
+// execMkswap runs mkswap on the given device or image file, giving the new swap
+// area the given UUID and label, if set, pages of pageSize bytes, if set,
+// rather than those of the running kernel, and a size of sizeKB 1 KiB blocks.
+var execMkswap = func(ctx context.Context, partDevice, uuid, label string, pageSize, sizeKB int64) error {
+	var args []string
+	if pageSize != 0 {
+		args = append(args, "-p", strconv.FormatInt(pageSize, 10))
+	}
+	if uuid != "" {
+		args = append(args, "-U", uuid)
+	}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	args = append(args, partDevice, strconv.FormatInt(sizeKB, 10))
+	return runTool(ctx, "mkswap", args...)
+}
+
+// execSwapoff deactivates the swap area on the given partition device.
+var execSwapoff = func(ctx context.Context, partDevice string) error {
+	return runTool(ctx, "swapoff", partDevice)
+}
+
+// execSwapon activates the swap area with the given UUID.
+var execSwapon = func(ctx context.Context, uuid string) error {
+	return runTool(ctx, "swapon", "-U", uuid)
+}
+
+// recreateSwap writes a new swap area of size bytes to the partition described
+// by part, carrying over the UUID and label of hdr, so that anything referring
+// to the swap by UUID or label (e.g. /etc/fstab) still finds it, and its page
+// size, so that a kernel with the pages it was made for can still use it. Swap
+// contents are not preserved across a resize, so nothing needs to be copied;
+// the swap must not be active.
+func recreateSwap(ctx context.Context, logger *slog.Logger, device string, part partitionData, size int64, hdr swapHeader) error {
+	if device == "" {
+		return fmt.Errorf("cannot recreate swap: disk backend has no path")
+	}
+	logger.Info("recreating swap", "partition", part.number, "bytes", size, "uuid", hdr.uuid, "label", hdr.label)
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	deviceType, err := disk.DetermineDeviceType(f)
+	if err != nil {
+		return err
+	}
+	switch deviceType {
+	case disk.DeviceTypeBlockDevice:
+		partDevice, err := partitionDevicePath(device, part.number, "")
+		if err != nil {
+			return fmt.Errorf("cannot find partition device for %s partition %d: %w", device, part.number, err)
+		}
+		return execMkswap(ctx, partDevice, hdr.uuid, hdr.label, hdr.pageSize, size/KB)
+	case disk.DeviceTypeFile:
+		// mkswap the swap area into a temp file, then copy its header page into
+		// the image; mkswap writes nothing beyond the first page
+		tmpFile, err := os.CreateTemp("", partTmpFilename)
+		if err != nil {
+			return err
+		}
+		_ = tmpFile.Close()
+		defer func() {
+			_ = os.RemoveAll(tmpFile.Name())
+		}()
+		if err := os.Truncate(tmpFile.Name(), size); err != nil {
+			return err
+		}
+		if err := execMkswap(ctx, tmpFile.Name(), hdr.uuid, hdr.label, hdr.pageSize, size/KB); err != nil {
+			return err
+		}
+		if err := CopyRange(tmpFile.Name(), device, 0, part.start, hdr.pageSize, 0); err != nil {
+			return fmt.Errorf("copy swap header: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown device type for %s", device)
+	}
+}
+
+// activeSwaps returns the resolved paths of the swap areas the kernel has
+// active, as listed in procSwapsPath. A missing list means no swap is active.
+func activeSwaps() (map[string]bool, error) {
+	f, err := os.Open(procSwapsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	active := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	// the first line is a header: Filename Type Size Used Priority
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		active[resolvePath(fields[0])] = true
+	}
+	return active, scanner.Err()
+}
+
+// resolvePath returns p with any symlinks resolved, or p itself if that fails.
+func resolvePath(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	return p
+}
+
+// deactivateSwaps turns off any active swap area among the partitions being
+// resized, so that it can be recreated, and returns the UUIDs of those it
+// turned off for reactivateSwaps. Only a block device can have active swap.
+func deactivateSwaps(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) ([]string, error) {
+	device := d.Backend.Path()
+	if device == "" {
+		return nil, nil
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	deviceType, err := disk.DetermineDeviceType(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if deviceType != disk.DeviceTypeBlockDevice {
+		return nil, nil
+	}
+	active, err := activeSwaps()
+	if err != nil {
+		return nil, fmt.Errorf("list active swap: %w", err)
+	}
+	var deactivated []string
+	for _, r := range resizes {
+		hdr, ok, err := readSwapHeader(d.Backend, r.original.start)
+		if err != nil {
+			return deactivated, fmt.Errorf("partition %d: %w", r.original.number, err)
+		}
+		if !ok {
+			continue
+		}
+		partDevice, err := partitionDevicePath(device, r.original.number, "")
+		if err != nil {
+			return deactivated, fmt.Errorf("cannot find partition device for %s partition %d: %w", device, r.original.number, err)
+		}
+		if !active[resolvePath(partDevice)] {
+			continue
+		}
+		logger.Info("deactivating swap", "partition", r.original.number, "device", partDevice)
+		if err := execSwapoff(ctx, partDevice); err != nil {
+			return deactivated, err
+		}
+		if hdr.uuid == "" {
+			logger.Warn("swap has no UUID, it will not be reactivated", "partition", r.original.number)
+			continue
+		}
+		deactivated = append(deactivated, hdr.uuid)
+	}
+	return deactivated, nil
+}
+
+// reactivateSwaps turns the swap areas with the given UUIDs back on once the
+// resize is complete, even should ctx be done by then.
+func reactivateSwaps(ctx context.Context, logger *slog.Logger, uuids []string) error {
+	ctx = context.WithoutCancel(ctx)
+	for _, u := range uuids {
+		logger.Info("reactivating swap", "uuid", u)
+		if err := execSwapon(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const (
+	testSwapUUID  = "5e9d8c4a-3b1f-4f6e-9a2d-7c0b1e2f3a4b"
+	testSwapLabel = "myswap"
+)
+
+func TestReadSwapHeader(t *testing.T) {
+	t.Run("version 1", func(t *testing.T) {
+		const start = 4096
+		buf := make([]byte, start+16384)
+		copy(buf[start+8192-swapSignatureLen:], swapSignature)
+		copy(buf[start+swapUUIDOffset:], []byte{0x5e, 0x9d, 0x8c, 0x4a, 0x3b, 0x1f, 0x4f, 0x6e, 0x9a, 0x2d, 0x7c, 0x0b, 0x1e, 0x2f, 0x3a, 0x4b})
+		copy(buf[start+swapLabelOffset:], testSwapLabel)
+		hdr, ok, err := readSwapHeader(bytes.NewReader(buf), start)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok {
+			t.Fatal("swap signature not found")
+		}
+		want := swapHeader{pageSize: 8192, uuid: testSwapUUID, label: testSwapLabel}
+		if hdr != want {
+			t.Errorf("header = %+v, want %+v", hdr, want)
+		}
+	})
+	t.Run("version 0", func(t *testing.T) {
+		buf := make([]byte, 8192)
+		copy(buf[4096-swapSignatureLen:], swapSignatureV0)
+		hdr, ok, err := readSwapHeader(bytes.NewReader(buf), 0)
+		if err != nil || !ok {
+			t.Fatalf("readSwapHeader() = %v, %v, want swap", ok, err)
+		}
+		if hdr.uuid != "" || hdr.pageSize != 4096 {
+			t.Errorf("header = %+v, want page size 4096 and no uuid", hdr)
+		}
+	})
+	t.Run("not swap", func(t *testing.T) {
+		_, ok, err := readSwapHeader(bytes.NewReader(make([]byte, 8192)), 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Error("found swap signature in empty data")
+		}
+	})
+}
+
+func TestActiveSwaps(t *testing.T) {
+	orig := procSwapsPath
+	defer func() { procSwapsPath = orig }()
+	procSwapsPath = filepath.Join(t.TempDir(), "swaps")
+	data := "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n/dev/sda3                               partition\t2097148\t\t0\t\t-2\n"
+	if err := os.WriteFile(procSwapsPath, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	active, err := activeSwaps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(active) != 1 || !active["/dev/sda3"] {
+		t.Errorf("active = %v, want only /dev/sda3", active)
+	}
+
+	procSwapsPath = filepath.Join(t.TempDir(), "missing")
+	if active, err := activeSwaps(); err != nil || len(active) != 0 {
+		t.Errorf("activeSwaps() with no list = %v, %v, want none", active, err)
+	}
+}
+
+// testSwapDisk creates a disk image with a swap partition 1 and an empty
+// partition 2, both of the given size, returning the open disk and the
+// partition data of both.
+func testSwapDisk(t *testing.T, size int64) (*disk.Disk, partitionData, partitionData) {
+	t.Helper()
+	if _, err := exec.LookPath("mkswap"); err != nil {
+		t.Skip("mkswap not available")
+	}
+	const sectorSize = 512
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(diskPath, 2*size+4*MB); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapPart := partitionData{number: 1, label: "swap", start: 1 * MB, size: size}
+	emptyPart := partitionData{number: 2, label: "empty", start: 2*MB + size, size: size}
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		Partitions: []*gpt.Partition{
+			{Index: 1, Start: uint64(swapPart.start / sectorSize), Size: uint64(size), Type: gpt.LinuxSwap, Name: "swap"},
+			{Index: 2, Start: uint64(emptyPart.start / sectorSize), Size: uint64(size), Type: gpt.LinuxFilesystem, Name: "empty"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	hdr := swapHeader{pageSize: int64(os.Getpagesize()), uuid: testSwapUUID, label: testSwapLabel}
+	if err := recreateSwap(context.Background(), slog.Default(), diskPath, swapPart, size, hdr); err != nil {
+		t.Fatalf("failed to create swap: %v", err)
+	}
+	return d, swapPart, emptyPart
+}
+
+func TestRecreateSwap(t *testing.T) {
+	d, swapPart, emptyPart := testSwapDisk(t, 8*MB)
+
+	t.Run("copy", func(t *testing.T) {
+		resizes := []partitionResizeTarget{{original: swapPart, target: emptyPart}}
+		if err := copyFilesystems(context.Background(), slog.Default(), d, resizes, nopProgress{}, 1); err != nil {
+			t.Fatalf("copyFilesystems failed: %v", err)
+		}
+		hdr, ok, err := readSwapHeader(d.Backend, emptyPart.start)
+		if err != nil || !ok {
+			t.Fatalf("readSwapHeader() = %v, %v, want swap on target", ok, err)
+		}
+		if hdr.uuid != testSwapUUID || hdr.label != testSwapLabel {
+			t.Errorf("target header = %+v, want uuid %s label %s", hdr, testSwapUUID, testSwapLabel)
+		}
+	})
+	t.Run("shrink", func(t *testing.T) {
+		target := swapPart
+		target.size = 4 * MB
+		resizes := []partitionResizeTarget{{original: swapPart, target: target}}
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err != nil {
+			t.Fatalf("shrinkFilesystems failed: %v", err)
+		}
+		hdr, ok, err := readSwapHeader(d.Backend, swapPart.start)
+		if err != nil || !ok {
+			t.Fatalf("readSwapHeader() = %v, %v, want swap", ok, err)
+		}
+		if hdr.uuid != testSwapUUID {
+			t.Errorf("uuid = %s, want %s", hdr.uuid, testSwapUUID)
+		}
+	})
+	t.Run("shrink below minimum", func(t *testing.T) {
+		target := swapPart
+		target.size = 4 * KB
+		resizes := []partitionResizeTarget{{original: swapPart, target: target}}
+		if err := shrinkFilesystems(context.Background(), slog.Default(), d, resizes, false); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+	t.Run("shrink usage", func(t *testing.T) {
+		usage, err := readShrinkUsage(d.Backend, swapPart)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if usage.size != swapPart.size || usage.used() != swapMinPages*int64(os.Getpagesize()) {
+			t.Errorf("usage = %+v, want size %d and only the minimum used", usage, swapPart.size)
+		}
+	})
+}
+
+// TestExecMkswapPageSize gives mkswap the page size of the swap area it
+// recreates, which need not be that of the running kernel.
+func TestExecMkswapPageSize(t *testing.T) {
+	fake := &stdoutExecRunner{}
+	ctx := withToolRunner(context.Background(), newToolRunner(Options{ExecRunner: fake}))
+	if err := execMkswap(ctx, "/dev/sda1", testSwapUUID, testSwapLabel, 65536, 8192); err != nil {
+		t.Fatalf("execMkswap() error: %v", err)
+	}
+	want := [][]string{{"mkswap", "-p", "65536", "-U", testSwapUUID, "-L", testSwapLabel, "/dev/sda1", "8192"}}
+	if !reflect.DeepEqual(fake.runs, want) {
+		t.Errorf("execMkswap() ran %q, want %q", fake.runs, want)
+	}
+}
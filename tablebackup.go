@@ -0,0 +1,207 @@
+package partitionresizer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// A partition table backup is laid out as sgdisk --backup writes it, so that
+// sgdisk --load-backup can restore it and the other way around: in 512-byte
+// slots whatever the sector size of the disk, the protective MBR, the primary GPT
+// header, the backup GPT header, and then the partition entries.
+const (
+	backupSlotSize    = 512
+	gptSignature      = "EFI PART"
+	gptMinHeaderSize  = 92
+	backupEntriesSlot = 3
+)
+
+// gptHeader holds the fields of a GPT header needed to back it up and restore
+// it, along with the 512 bytes it was read from.
+type gptHeader struct {
+	raw          []byte
+	myLBA        uint64
+	entriesLBA   uint64
+	numEntries   uint32
+	entrySize    uint32
+	entriesCRC   uint32
+	alternateLBA uint64
+}
+
+// parseGPTHeader parses and verifies the GPT header in raw.
+func parseGPTHeader(raw []byte) (gptHeader, error) {
+	if string(raw[:len(gptSignature)]) != gptSignature {
+		return gptHeader{}, fmt.Errorf("no GPT header signature")
+	}
+	size := binary.LittleEndian.Uint32(raw[12:16])
+	if size < gptMinHeaderSize || size > backupSlotSize {
+		return gptHeader{}, fmt.Errorf("invalid GPT header size %d", size)
+	}
+	check := make([]byte, size)
+	copy(check, raw[:size])
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	if crc := crc32.ChecksumIEEE(check); crc != binary.LittleEndian.Uint32(raw[16:20]) {
+		return gptHeader{}, fmt.Errorf("GPT header checksum mismatch")
+	}
+	h := gptHeader{
+		raw:          raw[:backupSlotSize],
+		myLBA:        binary.LittleEndian.Uint64(raw[24:32]),
+		alternateLBA: binary.LittleEndian.Uint64(raw[32:40]),
+		entriesLBA:   binary.LittleEndian.Uint64(raw[72:80]),
+		numEntries:   binary.LittleEndian.Uint32(raw[80:84]),
+		entrySize:    binary.LittleEndian.Uint32(raw[84:88]),
+		entriesCRC:   binary.LittleEndian.Uint32(raw[88:92]),
+	}
+	if h.entrySize == 0 || int64(h.numEntries)*int64(h.entrySize) > 1*MB {
+		return gptHeader{}, fmt.Errorf("invalid GPT partition entries: %d of %d bytes", h.numEntries, h.entrySize)
+	}
+	return h, nil
+}
+
+// entriesSize returns the size in bytes of the partition entries of h.
+func (h gptHeader) entriesSize() int64 {
+	return int64(h.numEntries) * int64(h.entrySize)
+}
+
+// BackupPartitionTable saves the GPT of disk -- the protective MBR, both GPT
+// headers and the partition entries -- to the file at path, in the format of
+// sgdisk --backup, so that RestorePartitionTable or sgdisk --load-backup can
+// put it back should a resize go wrong. The disk is only read.
+func BackupPartitionTable(disk, path string) error {
+	backend, err := file.OpenFromPath(disk, true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return err
+	}
+	data, err := partitionTableBackup(d)
+	if err != nil {
+		return fmt.Errorf("%s: %v", disk, err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	slog.Info("saved partition table", "disk", disk, "path", path)
+	return nil
+}
+
+// partitionTableBackup returns the GPT of d in the format of sgdisk --backup.
+func partitionTableBackup(d *disk.Disk) ([]byte, error) {
+	sectorSize := d.LogicalBlocksize
+	mbr := make([]byte, backupSlotSize)
+	if _, err := d.Backend.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read protective MBR: %v", err)
+	}
+	raw := make([]byte, backupSlotSize)
+	if _, err := d.Backend.ReadAt(raw, sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %v", err)
+	}
+	primary, err := parseGPTHeader(raw)
+	if err != nil {
+		return nil, fmt.Errorf("primary GPT header: %v", err)
+	}
+	raw = make([]byte, backupSlotSize)
+	if _, err := d.Backend.ReadAt(raw, int64(primary.alternateLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read backup GPT header: %v", err)
+	}
+	backup, err := parseGPTHeader(raw)
+	if err != nil {
+		return nil, fmt.Errorf("backup GPT header: %v", err)
+	}
+	entries := make([]byte, primary.entriesSize())
+	if _, err := d.Backend.ReadAt(entries, int64(primary.entriesLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT partition entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != primary.entriesCRC {
+		return nil, fmt.Errorf("GPT partition entries do not match their checksum")
+	}
+
+	data := make([]byte, 0, backupEntriesSlot*backupSlotSize+len(entries))
+	data = append(data, mbr...)
+	data = append(data, primary.raw...)
+	data = append(data, backup.raw...)
+	data = append(data, entries...)
+	return data, nil
+}
+
+// RestorePartitionTable writes the GPT saved by BackupPartitionTable, or by
+// sgdisk --backup, in the file at path back to disk: the protective MBR, both
+// GPT headers and both copies of the partition entries, exactly where they
+// were. Only the table is restored; the data in the partitions is left as it
+// is. The disk must have the size, and sector size, of the disk the backup was
+// taken from.
+func RestorePartitionTable(disk, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < backupEntriesSlot*backupSlotSize {
+		return fmt.Errorf("partition table backup %s is truncated", path)
+	}
+	mbr := data[:backupSlotSize]
+	primary, err := parseGPTHeader(data[backupSlotSize : 2*backupSlotSize])
+	if err != nil {
+		return fmt.Errorf("primary GPT header in %s: %v", path, err)
+	}
+	backup, err := parseGPTHeader(data[2*backupSlotSize : 3*backupSlotSize])
+	if err != nil {
+		return fmt.Errorf("backup GPT header in %s: %v", path, err)
+	}
+	entries := data[backupEntriesSlot*backupSlotSize:]
+	if int64(len(entries)) < primary.entriesSize() {
+		return fmt.Errorf("partition table backup %s is truncated", path)
+	}
+	entries = entries[:primary.entriesSize()]
+	if crc32.ChecksumIEEE(entries) != primary.entriesCRC || backup.entriesCRC != primary.entriesCRC {
+		return fmt.Errorf("GPT partition entries in %s do not match their checksum", path)
+	}
+
+	backend, err := file.OpenFromPath(disk, false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return err
+	}
+	sectorSize := d.LogicalBlocksize
+	if lastLBA := uint64(d.Size/sectorSize) - 1; primary.myLBA != 1 || backup.myLBA != lastLBA || primary.alternateLBA != lastLBA {
+		return fmt.Errorf("partition table backup %s is of a disk of a different size or sector size than %s", path, disk)
+	}
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	writes := []struct {
+		what   string
+		data   []byte
+		offset int64
+	}{
+		{"protective MBR", mbr, 0},
+		{"primary GPT partition entries", entries, int64(primary.entriesLBA) * sectorSize},
+		{"backup GPT partition entries", entries, int64(backup.entriesLBA) * sectorSize},
+		{"backup GPT header", backup.raw, int64(backup.myLBA) * sectorSize},
+		{"primary GPT header", primary.raw, int64(primary.myLBA) * sectorSize},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, wr.offset); err != nil {
+			return fmt.Errorf("failed to write %s: %v", wr.what, err)
+		}
+	}
+	slog.Info("restored partition table", "disk", disk, "path", path)
+	if err := d.ReReadPartitionTable(); err != nil {
+		slog.Warn("partition table restored, but the kernel keeps the old one until the disk is no longer in use", "error", err)
+	}
+	return nil
+}
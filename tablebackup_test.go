@@ -0,0 +1,94 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// writeTestTable writes a GPT holding partitions to a new image of size bytes
+// at path.
+func writeTestTable(t *testing.T, path string, size int64, partitions []*gpt.Partition) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.OpenFromPath(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite), diskfs.WithSectorSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Partition(&gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: partitions}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestorePartitionTable(t *testing.T) {
+	dir := t.TempDir()
+	diskPath := filepath.Join(dir, "disk.img")
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"},
+		{Index: 2, Start: 9 * MB / 512, Size: 8 * MB, Type: gpt.LinuxSwap, Name: "swap"},
+	})
+	before, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(dir, "table.bak")
+	if err := BackupPartitionTable(diskPath, backupPath); err != nil {
+		t.Fatalf("BackupPartitionTable() error: %v", err)
+	}
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size of an sgdisk backup of a table of 128 entries
+	if len(backup) != 17920 {
+		t.Errorf("backup is %d bytes, want 17920", len(backup))
+	}
+	for _, slot := range []int{1, 2} {
+		if sig := string(backup[slot*512 : slot*512+8]); sig != gptSignature {
+			t.Errorf("slot %d of backup = %q, want a GPT header", slot, sig)
+		}
+	}
+
+	// a resize that went wrong
+	writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+		{Index: 1, Start: 20 * MB / 512, Size: 16 * MB, Type: gpt.LinuxFilesystem, Name: "data_resized2"},
+	})
+	if err := RestorePartitionTable(diskPath, backupPath); err != nil {
+		t.Fatalf("RestorePartitionTable() error: %v", err)
+	}
+	after, err := os.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("disk after restore differs from the disk backed up")
+	}
+
+	other := filepath.Join(dir, "other.img")
+	writeTestTable(t, other, 32*MB, nil)
+	if err := RestorePartitionTable(other, backupPath); err == nil {
+		t.Error("RestorePartitionTable() to a disk of another size returned no error")
+	}
+	if err := os.WriteFile(backupPath, backup[:1000], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestorePartitionTable(diskPath, backupPath); err == nil {
+		t.Error("RestorePartitionTable() of a truncated backup returned no error")
+	}
+}
@@ -0,0 +1,99 @@
+package partitionresizer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// throttleBurst is the longest a rateLimiter that has been idle lets through
+// at once, rather than catching up on all the time it was idle.
+const throttleBurst = time.Second
+
+// rateLimiter holds whoever waits on it to rate bytes a second, across all of
+// them. A nil rateLimiter does not hold anyone.
+type rateLimiter struct {
+	rate  int64
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+}
+
+// newRateLimiter returns a rateLimiter for rate bytes a second, nil if rate is
+// not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes can go through without exceeding the rate.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if due := l.due(); l.start.IsZero() || now.Sub(due) > throttleBurst {
+		l.start, l.bytes = now, 0
+	}
+	l.bytes += int64(n)
+	due := l.due()
+	l.mu.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+// due returns when the bytes through l so far are due, at its rate.
+func (l *rateLimiter) due() time.Time {
+	return l.start.Add(time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second)))
+}
+
+// throttledStorage is a backend whose reads, and writes, are each held to the
+// rate of their rateLimiter.
+type throttledStorage struct {
+	backend.Storage
+	reads, writes *rateLimiter
+}
+
+type throttledFile struct {
+	backend.WritableFile
+	reads, writes *rateLimiter
+}
+
+func (s throttledStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.reads.wait(len(p))
+	return s.Storage.ReadAt(p, off)
+}
+
+func (s throttledStorage) Writable() (backend.WritableFile, error) {
+	w, err := s.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	return throttledFile{WritableFile: w, reads: s.reads, writes: s.writes}, nil
+}
+
+func (f throttledFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.wait(len(p))
+	return f.WritableFile.ReadAt(p, off)
+}
+
+func (f throttledFile) WriteAt(p []byte, off int64) (int, error) {
+	f.writes.wait(len(p))
+	return f.WritableFile.WriteAt(p, off)
+}
+
+// throttledDisk returns d, reading and writing no more than rate bytes a
+// second each, see Options.MaxThroughput, or d itself if rate is not
+// positive. d is not changed: it is the disk returned that is throttled.
+func throttledDisk(d *disk.Disk, rate int64) *disk.Disk {
+	if rate <= 0 {
+		return d
+	}
+	throttled := *d
+	throttled.Backend = throttledStorage{Storage: d.Backend, reads: newRateLimiter(rate), writes: newRateLimiter(rate)}
+	return &throttled
+}
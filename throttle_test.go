@@ -0,0 +1,83 @@
+package partitionresizer
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *rateLimiter
+	nilLimiter.wait(1 * GB)
+	if l := newRateLimiter(0); l != nil {
+		t.Errorf("newRateLimiter(0) = %v, want nil", l)
+	}
+
+	l := newRateLimiter(1000)
+	started := time.Now()
+	for range 4 {
+		l.wait(100)
+	}
+	if took := time.Since(started); took < 350*time.Millisecond || took > 2*time.Second {
+		t.Errorf("400 bytes at 1000 bytes/s took %s, want about 400ms", took)
+	}
+	// a limiter idle for longer than throttleBurst does not let through
+	// everything it could have while idle
+	l = newRateLimiter(1000)
+	l.wait(100)
+	l.start = l.start.Add(-10 * time.Second)
+	started = time.Now()
+	l.wait(500)
+	if took := time.Since(started); took < 400*time.Millisecond {
+		t.Errorf("500 bytes after idling took %s, want about 500ms", took)
+	}
+}
+
+func TestThrottledDisk(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(diskPath, make([]byte, 16*MB), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := file.OpenFromPath(diskPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = storage.Close() }()
+	d := &disk.Disk{Backend: storage}
+	if got := throttledDisk(d, 0); got != d {
+		t.Error("throttledDisk() with no rate returned another disk")
+	}
+	throttled := throttledDisk(d, 24*MB)
+	if d.Backend != storage {
+		t.Error("throttledDisk() changed the disk it was given")
+	}
+	r := partitionResizeTarget{
+		original: partitionData{number: 1, start: 1 * MB, size: 6 * MB},
+		target:   partitionData{number: 2, start: 8 * MB, size: 8 * MB},
+	}
+	started := time.Now()
+	if err := copyPartitionRaw(context.Background(), slog.Default(), throttled, r, nopProgress{}); err != nil {
+		t.Fatalf("copyPartitionRaw() error: %v", err)
+	}
+	// 6 MB read to copy, and 6 MB read back to verify, at 24 MB/s
+	if took := time.Since(started); took < 400*time.Millisecond {
+		t.Errorf("copy of 6 MB, verified, at 24 MB/s took %s, want about 500ms", took)
+	}
+}
+
+func TestIOPriorityCheck(t *testing.T) {
+	for _, p := range []IOPriority{"", IOPriorityLow, IOPriorityIdle} {
+		if err := p.check(); err != nil {
+			t.Errorf("IOPriority(%q).check() error: %v", p, err)
+		}
+	}
+	if err := IOPriority("realtime").check(); err == nil {
+		t.Error("IOPriority(\"realtime\").check() succeeded")
+	}
+}
@@ -0,0 +1,152 @@
+package partitionresizer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// calibrationSample is how much of the source each of calibrationCandidates
+// reads in the calibration pass, see Options.AutoTune.
+const calibrationSample = 32 * MB
+
+// copyTuning is the size of the buffer a raw copy reads and writes in, and how
+// many streams it is copied with, see stripes.
+type copyTuning struct {
+	bufSize int64
+	streams int
+}
+
+// calibrationCandidates are the tunings the calibration pass times.
+var calibrationCandidates = []copyTuning{
+	{1 * MB, 1}, {4 * MB, 1}, {16 * MB, 1},
+	{1 * MB, 4}, {4 * MB, 4}, {16 * MB, 4},
+}
+
+// probeCopyTuning returns the tuning for the disk at path, from its queue in
+// sysfs at syspath, /sys if empty: a spinning disk is copied with a single
+// stream of copyBufSize, as more would only seek, and a solid-state one with
+// larger buffers and more streams, the most for NVMe. The buffer is rounded
+// up to a whole number of the largest request the disk takes, and of its
+// optimal I/O size. A disk sysfs does not know, e.g. an image file, gets a
+// single stream of copyBufSize.
+func probeCopyTuning(path, syspath string) copyTuning {
+	if syspath == "" {
+		syspath = sysDefaultPath
+	}
+	name := filepath.Base(resolvePath(path))
+	queue := filepath.Join(syspath, "class", "block", name, "queue")
+	t := copyTuning{bufSize: copyBufSize, streams: 1}
+	switch readSysString(queue, "rotational") {
+	case "":
+		return t
+	case "0":
+		t = copyTuning{bufSize: 8 * MB, streams: 2}
+		if strings.HasPrefix(name, "nvme") {
+			t = copyTuning{bufSize: 16 * MB, streams: 4}
+		}
+	}
+	maxSectorsKB, _ := strconv.ParseInt(readSysString(queue, "max_sectors_kb"), 10, 64)
+	optimal, _ := strconv.ParseInt(readSysString(queue, "optimal_io_size"), 10, 64)
+	for _, unit := range []int64{maxSectorsKB * KB, optimal} {
+		if unit > 0 {
+			t.bufSize = (t.bufSize + unit - 1) / unit * unit
+		}
+	}
+	return t
+}
+
+// calibrateCopy returns the one of calibrationCandidates that reads the
+// original partition of r fastest, and the bytes a second it reads at. Each
+// candidate reads a calibrationSample of its own, past the page cache where
+// the backend allows, so that none reads what another has just cached. It
+// fails should the partition be too small for them all.
+func calibrateCopy(d *disk.Disk, r partitionResizeTarget) (copyTuning, int64, error) {
+	if need := int64(len(calibrationCandidates)) * calibrationSample; r.original.size < need {
+		return copyTuning{}, 0, fmt.Errorf("partition of %d bytes is smaller than the %d bytes calibration reads", r.original.size, need)
+	}
+	var (
+		best     copyTuning
+		bestRate int64
+	)
+	for i, t := range calibrationCandidates {
+		start := r.original.start + int64(i)*calibrationSample
+		if f, err := d.Backend.Sys(); err == nil {
+			_ = dropCachedRange(f, start, calibrationSample)
+		}
+		stripe, n := stripes(calibrationSample, t.streams, t.bufSize)
+		started := time.Now()
+		err := forEachStripe(context.Background(), calibrationSample, stripe, n, func(_ context.Context, _ int, offset, size int64) error {
+			buf := make([]byte, min(t.bufSize, size))
+			for done := int64(0); done < size; {
+				n := min(int64(len(buf)), size-done)
+				if _, err := d.Backend.ReadAt(buf[:n], start+offset+done); err != nil {
+					return err
+				}
+				done += n
+			}
+			return nil
+		})
+		if err != nil {
+			return copyTuning{}, 0, err
+		}
+		elapsed := max(time.Since(started), time.Microsecond)
+		if rate := int64(float64(calibrationSample) / elapsed.Seconds()); rate > bestRate {
+			best, bestRate = t, rate
+		}
+	}
+	return best, bestRate, nil
+}
+
+// tuneCopies sets the buffer size of each partition to be copied to a new
+// location, and its number of streams unless already set, see
+// Options.CopyStreams: to what probeCopyTuning finds for d, or, with
+// Options.AutoTune, what calibrateCopy finds fastest on the largest of them,
+// should it be large enough. Options.BufferSize, if set, is the buffer size
+// whatever they find.
+func tuneCopies(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, opts Options) {
+	var largest *partitionResizeTarget
+	for i, r := range resizes {
+		if r.original.start != r.target.start && (largest == nil || r.original.size > largest.original.size) {
+			largest = &resizes[i]
+		}
+	}
+	if largest == nil {
+		return
+	}
+	t := probeCopyTuning(d.Backend.Path(), "")
+	by := "probe"
+	switch {
+	case !opts.AutoTune:
+	case opts.MaxThroughput > 0:
+		// the calibration would time the throttle, not the disk
+		logger.Warn("not calibrating copies, as they are held to a maximum throughput")
+	default:
+		calibrated, rate, err := calibrateCopy(d, *largest)
+		if err != nil {
+			logger.Warn("cannot calibrate copies, using the tuning probed", "partition", largest.original.number, "error", err)
+			break
+		}
+		logger.Info("calibrated copies", "partition", largest.original.number, "throughput", rate)
+		t, by = calibrated, "calibration"
+	}
+	if opts.BufferSize > 0 {
+		t.bufSize = opts.BufferSize
+	}
+	for i, r := range resizes {
+		if r.original.start == r.target.start {
+			continue
+		}
+		resizes[i].bufSize = t.bufSize
+		if r.streams == 0 {
+			resizes[i].streams = t.streams
+		}
+	}
+	logger.Info("tuned copies", "buffer", t.bufSize, "streams", t.streams, "by", by)
+}
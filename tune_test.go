@@ -0,0 +1,121 @@
+package partitionresizer
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+func TestProbeCopyTuning(t *testing.T) {
+	syspath := t.TempDir()
+	writeQueue := func(name string, files map[string]string) {
+		dir := filepath.Join(syspath, "class", "block", name, "queue")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for file, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(content+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeQueue("sda", map[string]string{"rotational": "1", "max_sectors_kb": "1280"})
+	writeQueue("sdb", map[string]string{"rotational": "0", "max_sectors_kb": "512", "optimal_io_size": "0"})
+	writeQueue("nvme0n1", map[string]string{"rotational": "0", "max_sectors_kb": "128"})
+	// a RAID stripe of 3 MiB
+	writeQueue("md0", map[string]string{"rotational": "0", "optimal_io_size": "3145728"})
+	tests := []struct {
+		path string
+		want copyTuning
+	}{
+		// rounded up to 4 requests of 1280 KiB
+		{"/dev/sda", copyTuning{4 * 1280 * KB, 1}},
+		{"/dev/sdb", copyTuning{8 * MB, 2}},
+		{"/dev/nvme0n1", copyTuning{16 * MB, 4}},
+		{"/dev/md0", copyTuning{9 * MB, 2}},
+		{"/var/lib/images/disk.img", copyTuning{copyBufSize, 1}},
+	}
+	for _, tt := range tests {
+		if got := probeCopyTuning(tt.path, syspath); got != tt.want {
+			t.Errorf("probeCopyTuning(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTuneCopies(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(512 * MB); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	storage, err := file.OpenFromPath(diskPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = storage.Close() }()
+	d := &disk.Disk{Backend: storage, Size: 512 * MB}
+	newResizes := func() []partitionResizeTarget {
+		return []partitionResizeTarget{
+			{original: partitionData{number: 1, start: 1 * MB, size: 8 * MB}, target: partitionData{number: 1, start: 1 * MB, size: 16 * MB}},
+			{original: partitionData{number: 2, start: 32 * MB, size: 256 * MB}, target: partitionData{number: 3, start: 300 * MB, size: 200 * MB}},
+			{original: partitionData{number: 4, start: 16 * MB, size: 8 * MB}, target: partitionData{number: 5, start: 24 * MB, size: 8 * MB}, streams: 3},
+		}
+	}
+	tests := []struct {
+		name string
+		opts Options
+		// want is the tuning of the partitions copied, other than the streams
+		// of the last, which are its own
+		want copyTuning
+	}{
+		{"probed", Options{}, copyTuning{copyBufSize, 1}},
+		{"buffer size", Options{BufferSize: 1 * MB}, copyTuning{1 * MB, 1}},
+		{"calibrated", Options{AutoTune: true}, copyTuning{}},
+		{"calibrated, buffer size", Options{AutoTune: true, BufferSize: 2 * MB}, copyTuning{2 * MB, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resizes := newResizes()
+			tuneCopies(slog.Default(), d, resizes, tt.opts)
+			if resizes[0].bufSize != 0 || resizes[0].streams != 0 {
+				t.Errorf("partition grown in place tuned to %d bytes, %d streams", resizes[0].bufSize, resizes[0].streams)
+			}
+			if resizes[2].streams != 3 {
+				t.Errorf("partition copied with 3 streams tuned to %d", resizes[2].streams)
+			}
+			got := copyTuning{resizes[1].bufSize, resizes[1].streams}
+			if resizes[2].bufSize != got.bufSize {
+				t.Errorf("partitions copied tuned to buffers of %d and %d bytes", got.bufSize, resizes[2].bufSize)
+			}
+			switch {
+			case tt.opts.AutoTune:
+				// which is fastest depends on the machine, but it is
+				// one of them, with the buffer size set kept
+				found := false
+				for _, c := range calibrationCandidates {
+					found = found || (got.streams == c.streams && (tt.want.bufSize != 0 || got.bufSize == c.bufSize))
+				}
+				if !found || (tt.want.bufSize != 0 && got.bufSize != tt.want.bufSize) {
+					t.Errorf("tuned to %+v, not a calibration candidate", got)
+				}
+			case got != tt.want:
+				t.Errorf("tuned to %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrateCopyTooSmall(t *testing.T) {
+	r := partitionResizeTarget{original: partitionData{number: 1, start: 1 * MB, size: 64 * MB}}
+	if _, _, err := calibrateCopy(&disk.Disk{}, r); err == nil {
+		t.Error("calibrateCopy() of a partition smaller than the calibration succeeded")
+	}
+}
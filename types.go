@@ -1,11 +1,54 @@
 package partitionresizer
 
+import (
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
 type Identifier string
 
 const (
 	IdentifierByName  Identifier = "name"
 	IdentifierByLabel Identifier = "label"
-	IdentifierByUUID  Identifier = "uuid"
+	// IdentifierByPartUUID identifies a partition by its PARTUUID, the GUID
+	// of the partition in the GPT.
+	IdentifierByPartUUID Identifier = "partuuid"
+	// IdentifierByFSUUID identifies a partition by the UUID of the filesystem
+	// on it, as blkid reports it and /etc/fstab refers to it by UUID=.
+	IdentifierByFSUUID Identifier = "fsuuid"
+	// IdentifierByFSLabel identifies a partition by the label of the
+	// filesystem on it, e.g. the volume label of an ext4 or FAT32 filesystem,
+	// rather than by the name of the partition in the GPT, as
+	// IdentifierByLabel does.
+	IdentifierByFSLabel Identifier = "fslabel"
+	// IdentifierByDevice identifies a partition by its device node, e.g.
+	// /dev/nvme0n1p2, or a link to it, e.g. one in /dev/disk/by-id. Only the
+	// partitions of a block device have one.
+	IdentifierByDevice Identifier = "dev"
+	// IdentifierByUUID identifies a partition by its PARTUUID, as
+	// IdentifierByPartUUID.
+	//
+	// Deprecated: use IdentifierByPartUUID or IdentifierByFSUUID, which say
+	// which UUID is meant.
+	IdentifierByUUID Identifier = "uuid"
+)
+
+// SizeMode describes how the size of a PartitionChange is to be interpreted.
+type SizeMode int
+
+const (
+	// SizeAbsolute means the size is the desired final size of the partition, in bytes.
+	SizeAbsolute SizeMode = iota
+	// SizeRelative means the size is a delta in bytes to apply to the current size of the partition,
+	// negative to shrink.
+	SizeRelative
+	// SizeMax means the partition grows to fill the largest free space left once all other grows
+	// have been placed; the size is ignored.
+	SizeMax
+	// SizeWeight means the size is a weight: the partitions grown this way divide the largest free
+	// space left once all other grows have been placed, in proportion to their weights.
+	SizeWeight
 )
 
 type PartitionIdentifier interface {
@@ -16,6 +59,7 @@ type PartitionIdentifier interface {
 type PartitionChange interface {
 	PartitionIdentifier
 	Size() int64 // in bytes
+	Mode() SizeMode
 }
 
 func NewPartitionIdentifier(by Identifier, value string) PartitionIdentifier {
@@ -29,6 +73,42 @@ func NewPartitionChange(by Identifier, value string, size int64) PartitionChange
 	return &partitionChangeImpl{
 		identifier: NewPartitionIdentifier(by, value),
 		size:       size,
+		mode:       SizeAbsolute,
+	}
+}
+
+// NewRelativePartitionChange returns a PartitionChange whose size is a delta, in bytes, relative to the current
+// size of the partition. As a grow partition, a positive delta grows the partition by that amount, without the
+// caller needing to know its current size. The delta is resolved against the size the partition has when the
+// resize is planned, and a Plan or journal records the absolute size it resolves to, so applying the plan or
+// resuming the resize does not apply it twice; running a new resize with the same delta does. As a shrink
+// partition, a negative delta shrinks the partition by exactly that amount, even should the grows fit without it;
+// a plan fails should its filesystem not have that much free.
+func NewRelativePartitionChange(by Identifier, value string, delta int64) PartitionChange {
+	return &partitionChangeImpl{
+		identifier: NewPartitionIdentifier(by, value),
+		size:       delta,
+		mode:       SizeRelative,
+	}
+}
+
+// NewMaxPartitionChange returns a PartitionChange that grows the partition to consume all of the free space
+// remaining after the other grows are satisfied, i.e. the largest contiguous free block left on the disk.
+func NewMaxPartitionChange(by Identifier, value string) PartitionChange {
+	return &partitionChangeImpl{
+		identifier: NewPartitionIdentifier(by, value),
+		mode:       SizeMax,
+	}
+}
+
+// NewWeightedPartitionChange returns a PartitionChange that grows the partition to a share of the free space
+// remaining after the fixed-size grows are satisfied. All weighted partitions divide the largest contiguous
+// free block left between them in proportion to their weights, e.g. weights 2 and 1 take two thirds and one third.
+func NewWeightedPartitionChange(by Identifier, value string, weight int64) PartitionChange {
+	return &partitionChangeImpl{
+		identifier: NewPartitionIdentifier(by, value),
+		size:       weight,
+		mode:       SizeWeight,
 	}
 }
 
@@ -47,6 +127,7 @@ func (p *partitionIdentifierImpl) Value() string {
 type partitionChangeImpl struct {
 	identifier PartitionIdentifier
 	size       int64 // in bytes
+	mode       SizeMode
 }
 
 func (p *partitionChangeImpl) By() Identifier {
@@ -59,18 +140,64 @@ func (p *partitionChangeImpl) Value() string {
 func (p *partitionChangeImpl) Size() int64 {
 	return p.size
 }
+func (p *partitionChangeImpl) Mode() SizeMode {
+	return p.mode
+}
 
 type partitionData struct {
-	name   string
-	label  string
-	size   int64 // in bytes
-	start  int64 // in bytes
-	end    int64 // in bytes
-	number int
-	uuid   string
+	name    string
+	label   string
+	size    int64 // in bytes
+	start   int64 // in bytes
+	end     int64 // in bytes
+	number  int
+	uuid    string // PARTUUID
+	fsUUID  string
+	fsLabel string
 }
 
 type partitionResizeTarget struct {
 	original partitionData
 	target   partitionData
+	mode     SizeMode // how target.size was requested
+	weight   int64    // share of the free space, for SizeWeight
+	inPlace  bool     // grow in place into the free space following the partition, see Options.OnlineGrow
+	// freezeTimeout, if non-zero, freezes the source filesystem around its copy
+	// if it is mounted, for at most this long, see Options.FreezeMounted
+	freezeTimeout time.Duration
+	// temporaryUUID gives the copy a temporary filesystem UUID until the
+	// original is removed, see Options.TemporaryUUID
+	temporaryUUID bool
+	// verify is how the copy is verified, if it is copied raw, see
+	// Options.Verify
+	verify VerifyMode
+	// streams is how many stripes a raw copy is split into, to copy
+	// concurrently, see Options.CopyStreams
+	streams int
+	// bufSize is the size of the buffer a raw copy reads and writes in, see
+	// tuneCopies
+	bufSize int64
+	// noCacheHints is set for a raw copy to give the kernel no page cache
+	// advice, see Options.NoCacheHints
+	noCacheHints bool
+	// noAtime is set for a file-by-file copy to give each file its
+	// modification time as its access time, see Options.NoAtime
+	noAtime bool
+	// discard is set to discard the space the original leaves once it is
+	// removed, see Options.Discard
+	discard bool
+	// wipe is how the original is overwritten once it is removed, if at all,
+	// see Options.WipeRemoved
+	wipe WipeMode
+	// updateBootEntries is set to re-register the UEFI boot entries on the
+	// partition once its copy replaced it, should it be an ESP, see
+	// Options.UpdateBootEntries
+	updateBootEntries bool
+	// setAttributes and clearAttributes are the GPT attributes the copy is
+	// given, and not given, rather than those of the original, as it
+	// replaces it, see Options.LegacyBootable
+	setAttributes, clearAttributes uint64
+	// partitionType, if set, is the GPT partition type the partition is
+	// given as its resize is committed, see WithPartitionType
+	partitionType gpt.Type
 }
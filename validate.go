@@ -0,0 +1,129 @@
+package partitionresizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// ValidationReport is how a disk compares with what a resize was to leave it
+// as, see ValidateResize. Valid is set if it is as expected: Problems lists how
+// it is not, and Checks the outcome of checking the filesystem of each
+// partition resized.
+type ValidationReport struct {
+	Disk     string        `json:"disk"`
+	Valid    bool          `json:"valid"`
+	Problems []string      `json:"problems,omitempty"`
+	Checks   []CheckResult `json:"checks,omitempty"`
+}
+
+// ValidateResize checks that disk is as a resize was to leave it, with each
+// partition of expected, as a Plan or Result lists them, at its final number,
+// start and size, with its label; that no partition the resize creates and
+// removes along the way remains, neither a copy under its temporary label nor
+// the original of a partition moved; and that each resized filesystem checks
+// cleanly, read-only. A mounted filesystem cannot be checked, and is skipped.
+// It changes nothing, and returns an error only if disk cannot be read. Of
+// opts, it uses only Logger, and ExecRunner and ToolTimeout to run the checks.
+func ValidateResize(ctx context.Context, disk string, expected []PartitionResult, opts Options) (*ValidationReport, error) {
+	ctx = withToolRunner(ctx, newToolRunner(opts))
+	backend, err := file.OpenFromPath(disk, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = backend.Close() }()
+	d, err := diskfs.OpenBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readGPT(d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", disk, err)
+	}
+	report := &ValidationReport{Disk: disk, Problems: tableProblems(table, expected)}
+	// a partition that is not where it is expected is a problem already,
+	// and its filesystem is not checked
+	var resizes []partitionResizeTarget
+	for _, p := range expected {
+		if !slices.ContainsFunc(table.Partitions, func(tp *gpt.Partition) bool {
+			return tp.Index == p.Final.Number && tp.GetStart() == p.Final.Start && tp.GetSize() == p.Final.Size
+		}) {
+			continue
+		}
+		final := partitionData{number: p.Final.Number, label: p.Label, start: p.Final.Start, size: p.Final.Size, end: p.Final.Start + p.Final.Size - 1}
+		resizes = append(resizes, partitionResizeTarget{original: final, target: final})
+	}
+	report.Checks = checkResizedFilesystems(ctx, opts.logger(), d, resizes, false, false)
+	for _, c := range report.Checks {
+		if c.Outcome == CheckFailed {
+			report.Problems = append(report.Problems, c.problem())
+		}
+	}
+	report.Valid = len(report.Problems) == 0
+	return report, nil
+}
+
+// ValidateJournal is ValidateResize for the resize recorded in the journal at
+// journalPath, see Options.JournalPath, or, once the resize has completed and
+// its journal has been moved aside, at journalPath with .completed appended.
+// A resize the journal records as unfinished is a problem in itself. opts is
+// used as ValidateResize uses it.
+func ValidateJournal(ctx context.Context, journalPath string, opts Options) (*ValidationReport, error) {
+	j, err := readJournal(journalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		j, err = readJournal(journalPath + completedJournalSuffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	report, err := ValidateResize(ctx, j.Disk, newResult(j.Disk, j.resizes(), j.PreserveNumbers).Partitions, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !j.Finished {
+		report.Problems = append([]string{fmt.Sprintf("the resize is unfinished, having completed phases %s; resume or roll it back", strings.Join(j.Completed, ", "))}, report.Problems...)
+		report.Valid = false
+	}
+	return report, nil
+}
+
+// tableProblems returns how table differs from what a resize was to leave it
+// as, with the partitions of expected.
+func tableProblems(table *gpt.Table, expected []PartitionResult) []string {
+	var problems []string
+	byNumber := make(map[int]*gpt.Partition)
+	for _, p := range table.Partitions {
+		byNumber[p.Index] = p
+		if strings.HasSuffix(p.Name, alternateLabelSuffix) {
+			problems = append(problems, fmt.Sprintf("partition %d (%s) is a temporary copy that was never removed or renamed", p.Index, p.Name))
+		}
+	}
+	for _, e := range expected {
+		p, ok := byNumber[e.Final.Number]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("partition %d (%s) is missing", e.Final.Number, e.Label))
+			continue
+		case p.GetStart() != e.Final.Start || p.GetSize() != e.Final.Size:
+			problems = append(problems, fmt.Sprintf("partition %d (%s) is %d bytes at %d, want %d bytes at %d", e.Final.Number, e.Label, p.GetSize(), p.GetStart(), e.Final.Size, e.Final.Start))
+		case p.Name != e.Label:
+			problems = append(problems, fmt.Sprintf("partition %d is labelled %q, want %q", e.Final.Number, p.Name, e.Label))
+		}
+		if !e.Moved {
+			continue
+		}
+		for _, o := range table.Partitions {
+			if o.Index != e.Final.Number && o.GetStart() == e.Original.Start {
+				problems = append(problems, fmt.Sprintf("partition %d (%s), the original of partition %d moved, was never removed", o.Index, o.Name, e.Final.Number))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,128 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestValidateResize validates a disk on which root was moved and grown and
+// home shrunk, first as the resize left it, then with it expected elsewhere,
+// and with the original of root and a temporary copy left behind.
+func TestValidateResize(t *testing.T) {
+	dir := t.TempDir()
+	expected := []PartitionResult{
+		{Label: "home", Original: PartitionGeometry{Number: 1, Start: 1 * MB, Size: 8 * MB}, Final: PartitionGeometry{Number: 1, Start: 1 * MB, Size: 4 * MB}},
+		{Label: "root", Original: PartitionGeometry{Number: 2, Start: 9 * MB, Size: 4 * MB}, Final: PartitionGeometry{Number: 3, Start: 13 * MB, Size: 8 * MB}, Moved: true},
+	}
+	home := &gpt.Partition{Index: 1, Start: 1 * MB / 512, Size: 4 * MB, Type: gpt.LinuxFilesystem, Name: "home"}
+	root := &gpt.Partition{Index: 3, Start: 13 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "root"}
+
+	good := filepath.Join(dir, "good.img")
+	writeTestTable(t, good, 32*MB, []*gpt.Partition{home, root})
+	report, err := ValidateResize(context.Background(), good, expected, Options{})
+	if err != nil {
+		t.Fatalf("ValidateResize() error: %v", err)
+	}
+	if !report.Valid || len(report.Problems) != 0 || len(report.Checks) != 2 {
+		t.Errorf("ValidateResize() of a disk as expected = %+v, want valid with 2 checks", report)
+	}
+
+	bad := filepath.Join(dir, "bad.img")
+	writeTestTable(t, bad, 32*MB, []*gpt.Partition{
+		{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "home"},
+		{Index: 2, Start: 9 * MB / 512, Size: 4 * MB, Type: gpt.LinuxFilesystem, Name: "root"},
+		{Index: 3, Start: 13 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "root" + alternateLabelSuffix},
+	})
+	report, err = ValidateResize(context.Background(), bad, expected, Options{})
+	if err != nil {
+		t.Fatalf("ValidateResize() error: %v", err)
+	}
+	if report.Valid {
+		t.Fatalf("ValidateResize() of a disk left mid-resize = %+v, want it invalid", report)
+	}
+	for _, want := range []string{
+		"partition 3 (root_resized2) is a temporary copy",
+		"partition 1 (home) is 8388608 bytes at 1048576, want 4194304 bytes at 1048576",
+		`partition 3 is labelled "root_resized2", want "root"`,
+		"partition 2 (root), the original of partition 3 moved, was never removed",
+	} {
+		if !strings.Contains(strings.Join(report.Problems, "\n"), want) {
+			t.Errorf("ValidateResize() problems = %q, want %q among them", report.Problems, want)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing.img")
+	writeTestTable(t, missing, 32*MB, []*gpt.Partition{home})
+	report, err = ValidateResize(context.Background(), missing, expected, Options{})
+	if err != nil {
+		t.Fatalf("ValidateResize() error: %v", err)
+	}
+	if report.Valid || len(report.Problems) != 1 || report.Problems[0] != "partition 3 (root) is missing" {
+		t.Errorf("ValidateResize() of a disk without root = %+v, want root missing", report)
+	}
+}
+
+// TestValidateJournal validates the resize a journal records, which is
+// unfinished until the journal is finished and moved aside.
+func TestValidateJournal(t *testing.T) {
+	dir := t.TempDir()
+	diskPath := filepath.Join(dir, "disk.img")
+	writeTestTable(t, diskPath, 32*MB, []*gpt.Partition{{Index: 1, Start: 1 * MB / 512, Size: 8 * MB, Type: gpt.LinuxFilesystem, Name: "data"}})
+	data := partitionData{number: 1, label: "data", start: 1 * MB, size: 4 * MB, end: 5*MB - 1}
+	grown := data
+	grown.size, grown.end = 8*MB, 9*MB-1
+	journalPath := filepath.Join(dir, "journal.json")
+	j, err := newJournal(journalPath, diskPath, &gpt.Table{}, []partitionResizeTarget{{original: data, target: grown}}, false, false, Options{})
+	if err != nil {
+		t.Fatalf("newJournal() error: %v", err)
+	}
+
+	report, err := ValidateJournal(context.Background(), journalPath, Options{})
+	if err != nil {
+		t.Fatalf("ValidateJournal() error: %v", err)
+	}
+	if report.Valid || len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "unfinished") {
+		t.Errorf("ValidateJournal() of an unfinished resize = %+v, want it unfinished", report)
+	}
+
+	if err := j.finish(); err != nil {
+		t.Fatalf("finish() error: %v", err)
+	}
+	report, err = ValidateJournal(context.Background(), journalPath, Options{})
+	if err != nil {
+		t.Fatalf("ValidateJournal() error: %v", err)
+	}
+	if !report.Valid {
+		t.Errorf("ValidateJournal() of a completed resize = %+v, want it valid", report)
+	}
+}
+
+// TestValidateResizeOptions checks a resized filesystem, logging to the
+// Logger of the options it is given.
+func TestValidateResizeOptions(t *testing.T) {
+	d, pd, closeDisk := newFat32SourceDisk(t)
+	defer closeDisk()
+	origF := execFsckFat
+	defer func() { execFsckFat = origF }()
+	var fatCalls int
+	execFsckFat = func(context.Context, string, bool) error { fatCalls++; return nil }
+
+	var logs bytes.Buffer
+	expected := []PartitionResult{{Label: pd.label, Original: PartitionGeometry{Number: 1, Start: pd.start, Size: pd.size}, Final: PartitionGeometry{Number: 1, Start: pd.start, Size: pd.size}}}
+	report, err := ValidateResize(context.Background(), d.Backend.Path(), expected, Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatalf("ValidateResize() error: %v", err)
+	}
+	if !report.Valid || fatCalls != 1 {
+		t.Errorf("ValidateResize() = %+v with fsck.fat run %d times, want it valid, checked once", report, fatCalls)
+	}
+	if !strings.Contains(logs.String(), "checking resized filesystem") {
+		t.Errorf("ValidateResize() logged %q, want the check logged to the options' Logger", logs.String())
+	}
+}
@@ -0,0 +1,81 @@
+package partitionresizer
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// Validator checks the contents of a partition copied to its new location
+// before its original is removed, beyond the byte-for-byte verification of the
+// copy itself: e.g. that /etc/os-release can be read from a root filesystem,
+// that a boot file is on an EFI System Partition, or that a dm-verity root hash
+// still matches. See Options.Validators.
+type Validator interface {
+	// Validate returns an error if p is not fit to replace its original.
+	Validate(p CopiedPartition) error
+}
+
+// ValidatorFunc adapts a function to a Validator.
+type ValidatorFunc func(p CopiedPartition) error
+
+// Validate calls f(p).
+func (f ValidatorFunc) Validate(p CopiedPartition) error {
+	return f(p)
+}
+
+// CopiedPartition is a partition copied to its new location, as a Validator
+// sees it: the original is still in the partition table, and the copy still
+// has the temporary name and type it was created with.
+type CopiedPartition struct {
+	// Disk is the disk being resized; the copy's filesystem can be read with
+	// Disk.GetFilesystem(Number), see Filesystem. Validators must not write
+	// to it.
+	Disk *disk.Disk
+	// Number is the partition number of the copy.
+	Number int
+	// OriginalNumber is the partition number of the original.
+	OriginalNumber int
+	// Label is the label of the original, which the copy is given when the
+	// original is removed.
+	Label string
+	// Start and Size are the offset and the size of the copy on the disk, in
+	// bytes.
+	Start int64
+	Size  int64
+}
+
+// Filesystem returns the filesystem on the copy.
+func (p CopiedPartition) Filesystem() (filesystem.FileSystem, error) {
+	return p.Disk.GetFilesystem(p.Number)
+}
+
+// runValidators runs each of validators against each partition resizes copy
+// to a new location, and returns the first error any of them returns.
+func runValidators(logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget, validators []Validator) error {
+	if len(validators) == 0 {
+		return nil
+	}
+	for _, r := range resizes {
+		if r.original.start == r.target.start {
+			continue
+		}
+		p := CopiedPartition{
+			Disk:           d,
+			Number:         r.target.number,
+			OriginalNumber: r.original.number,
+			Label:          r.original.label,
+			Start:          r.target.start,
+			Size:           r.target.size,
+		}
+		logger.Info("running validators", "partition", r.original.number, "target", r.target.number, "validators", len(validators))
+		for i, v := range validators {
+			if err := v.Validate(p); err != nil {
+				return fmt.Errorf("validator %d rejected copy of partition %d: %w", i+1, r.original.number, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package partitionresizer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestResizeValidators(t *testing.T) {
+	original := partitionData{number: 1, label: "data", start: 1 * MB, size: 8 * MB, end: 9*MB - 1}
+	target := partitionData{number: 2, label: getAlternateLabel(original.label), start: 20 * MB, size: 16 * MB, end: 36*MB - 1}
+	rejection := errors.New("no /etc/os-release")
+	tests := []struct {
+		name   string
+		reject bool
+	}{
+		{"accepted", false},
+		{"rejected", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "disk.img")
+			writeTestTable(t, diskPath, 64*MB, []*gpt.Partition{
+				{Index: 1, Start: uint64(original.start / 512), Size: uint64(original.size), Type: gpt.LinuxFilesystem, Name: original.label},
+			})
+			backend, err := file.OpenFromPath(diskPath, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = backend.Close() }()
+			d, err := diskfs.OpenBackend(backend, diskfs.WithOpenMode(diskfs.ReadWrite))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var validated []CopiedPartition
+			opts := Options{Validators: []Validator{ValidatorFunc(func(p CopiedPartition) error {
+				validated = append(validated, p)
+				if tt.reject {
+					return rejection
+				}
+				return nil
+			})}}
+			err = resize(context.Background(), d, []partitionResizeTarget{{original: original, target: target}}, false, false, opts, nil, nil)
+			if tt.reject != errors.Is(err, rejection) {
+				t.Fatalf("resize() error = %v, want rejected %v", err, tt.reject)
+			}
+			if !tt.reject && err != nil {
+				t.Fatalf("resize() error: %v", err)
+			}
+			want := CopiedPartition{Disk: d, Number: target.number, OriginalNumber: original.number, Label: original.label, Start: target.start, Size: target.size}
+			if len(validated) != 1 || validated[0] != want {
+				t.Errorf("validated %+v, want %+v", validated, want)
+			}
+
+			tableRaw, err := d.GetPartitionTable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var starts []int64
+			for _, p := range tableRaw.(*gpt.Table).Partitions {
+				if p.Type != gpt.Unused {
+					starts = append(starts, int64(p.Start)*512)
+				}
+			}
+			// a rejected copy is removed, an accepted one replaces its original
+			wantStart := target.start
+			if tt.reject {
+				wantStart = original.start
+			}
+			if len(starts) != 1 || starts[0] != wantStart {
+				t.Errorf("partitions start at %v, want only %d", starts, wantStart)
+			}
+		})
+	}
+}
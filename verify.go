@@ -0,0 +1,229 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// VerifyMode is how thoroughly a partition copied raw is verified against its
+// source, see Options.Verify.
+type VerifyMode string
+
+const (
+	// VerifyFull hashes all of the source with SHA-256 as it is copied, and
+	// all of the copy once it is written. This is the default.
+	VerifyFull VerifyMode = "full"
+	// VerifySampled compares the first and last sampleExtentSize bytes of the
+	// copy, and sampleExtents extents at random offsets in between, with the
+	// source.
+	VerifySampled VerifyMode = "sampled"
+	// VerifyNone does not verify copies.
+	VerifyNone VerifyMode = "none"
+)
+
+const (
+	// verifyWorkers is how many extents VerifySampled compares at once.
+	verifyWorkers = 4
+	// hashBuffers is how many buffers hashRange reads ahead.
+	hashBuffers = 3
+	// sampleExtentSize is the size of each extent VerifySampled compares.
+	sampleExtentSize = 1 * MB
+	// sampleExtents is how many extents at random offsets VerifySampled
+	// compares, beyond the first and the last.
+	sampleExtents = 16
+)
+
+// errCopyMismatch is returned by verifyCopy for a copy that does not match its
+// source.
+var errCopyMismatch = errors.New("copy does not match its source")
+
+// check returns an error unless m is a known VerifyMode, or empty for the
+// default.
+func (m VerifyMode) check() error {
+	switch m {
+	case "", VerifyFull, VerifySampled, VerifyNone:
+		return nil
+	}
+	return fmt.Errorf("unknown verification mode %q, must be one of %s, %s or %s", m, VerifyFull, VerifySampled, VerifyNone)
+}
+
+// markVerification sets the verification mode of every partition that is to be
+// copied to a new location to opts.Verify.
+func markVerification(resizes []partitionResizeTarget, opts Options) {
+	for i, r := range resizes {
+		if r.original.start != r.target.start {
+			resizes[i].verify = opts.Verify
+		}
+	}
+}
+
+// verifyCopy verifies the raw copy of r as its verification mode asks, see
+// VerifyMode. sums are the SHA-256 hashes of each stripe of the source, stripe
+// bytes long but for the last, see stripes, taken as it was copied, for
+// VerifyFull, and copySums those of the copy, where it was read back as it was
+// copied; each stripe of the copy not read back is read back and hashed
+// concurrently, from the device, past the page cache where the backend
+// allows, reading ahead as it hashes, see hashRange. VerifySampled compares
+// verifyWorkers extents at once, reading each from the source and the copy at
+// once. It returns the SHA-256 digests of the stripes for VerifyFull.
+func verifyCopy(logger *slog.Logger, d *disk.Disk, r partitionResizeTarget, stripe int64, sums, copySums [][]byte) ([]string, error) {
+	length := r.original.size
+	if r.verify == VerifyNone {
+		logger.Info("copy not verified", "partition", r.original.number, "target", r.target.number)
+		return nil, nil
+	}
+	if f, err := d.Backend.Sys(); err == nil {
+		if err := dropCachedRange(f, r.target.start, length); err != nil {
+			return nil, fmt.Errorf("flush copy: %w", err)
+		}
+	}
+	switch r.verify {
+	case "", VerifyFull:
+		got := make([]string, len(sums))
+		err := forEachStripe(context.Background(), length, stripe, len(sums), func(_ context.Context, i int, offset, size int64) error {
+			sum := copySums[i]
+			if sum == nil {
+				var err error
+				if sum, err = hashRange(d.Backend, r.target.start+offset, size); err != nil {
+					return fmt.Errorf("read back copy: %w", err)
+				}
+			}
+			if !bytes.Equal(sum, sums[i]) {
+				if len(sums) == 1 {
+					return fmt.Errorf("%w: SHA-256 %x, want %x", errCopyMismatch, sum, sums[i])
+				}
+				return fmt.Errorf("%w in bytes %d to %d: SHA-256 %x, want %x", errCopyMismatch, offset, offset+size-1, sum, sums[i])
+			}
+			got[i] = fmt.Sprintf("%x", sum)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("copy verified", "partition", r.original.number, "target", r.target.number, "sha256", strings.Join(got, ","))
+		return got, nil
+	case VerifySampled:
+		extents := sampleOffsets(length)
+		// the extents are compared verifyWorkers at a time, and the first
+		// to fail, in order, fails the verification
+		errs := make([]error, len(extents))
+		workers := make(chan struct{}, verifyWorkers)
+		var wg sync.WaitGroup
+		for i, offset := range extents {
+			workers <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-workers; wg.Done() }()
+				errs[i] = compareExtent(d.Backend, r, offset, min(sampleExtentSize, length-offset))
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		logger.Info("copy verified at sampled extents", "partition", r.original.number, "target", r.target.number, "extents", len(extents))
+	default:
+		return nil, fmt.Errorf("unknown verification mode %q", r.verify)
+	}
+	return nil, nil
+}
+
+// sampleOffsets returns the offsets of the extents VerifySampled compares in a
+// copy of length bytes: the first, the last, and sampleExtents at random
+// offsets in between, in order and without repeats.
+func sampleOffsets(length int64) []int64 {
+	last := max(length-sampleExtentSize, 0)
+	offsets := []int64{0}
+	if last > 0 {
+		seen := map[int64]bool{0: true, last: true}
+		for range sampleExtents {
+			// extents are aligned to their size, so they do not overlap
+			offset := rand.Int64N(last/sampleExtentSize+1) * sampleExtentSize
+			if !seen[offset] {
+				seen[offset] = true
+				offsets = append(offsets, offset)
+			}
+		}
+		offsets = append(offsets, last)
+	}
+	slices.Sort(offsets)
+	return offsets
+}
+
+// compareExtent compares size bytes at offset in the copy of r with the
+// source, reading both at once.
+func compareExtent(rd io.ReaderAt, r partitionResizeTarget, offset, size int64) error {
+	want, got := make([]byte, size), make([]byte, size)
+	var wantErr error
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		_, wantErr = rd.ReadAt(want, r.original.start+offset)
+	})
+	_, err := rd.ReadAt(got, r.target.start+offset)
+	wg.Wait()
+	switch {
+	case wantErr != nil:
+		return fmt.Errorf("read source: %w", wantErr)
+	case err != nil:
+		return fmt.Errorf("read back copy: %w", err)
+	case !bytes.Equal(got, want):
+		return fmt.Errorf("%w at offset %d", errCopyMismatch, offset)
+	}
+	return nil
+}
+
+// hashRange returns the SHA-256 hash of length bytes at offset in r, or of as
+// many as there are before r ends. The reads are overlapped with the hashing:
+// up to hashBuffers buffers are read ahead of the one being hashed, as on fast
+// storage, reading and hashing take about as long as each other.
+func hashRange(r io.ReaderAt, offset, length int64) ([]byte, error) {
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	free := make(chan []byte, hashBuffers)
+	for range hashBuffers {
+		free <- make([]byte, min(copyBufSize, length))
+	}
+	// the reader stops at the first error, once it has sent it, and the
+	// hasher at the first error it gets, so neither waits on the other
+	full := make(chan chunk, hashBuffers)
+	go func() {
+		defer close(full)
+		for done := int64(0); done < length; {
+			buf := <-free
+			n, err := r.ReadAt(buf[:min(int64(len(buf)), length-done)], offset+done)
+			if err == io.EOF {
+				full <- chunk{data: buf[:n]}
+				return
+			}
+			full <- chunk{data: buf[:n], err: err}
+			if err != nil {
+				return
+			}
+			done += int64(n)
+		}
+	}()
+	hash := sha256.New()
+	for c := range full {
+		if c.err != nil {
+			return nil, c.err
+		}
+		hash.Write(c.data)
+		free <- c.data[:cap(c.data)]
+	}
+	return hash.Sum(nil), nil
+}
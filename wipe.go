@@ -0,0 +1,87 @@
+package partitionresizer
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+// WipeMode is how the data of the partitions a resize removes is overwritten
+// once they are, see Options.WipeRemoved.
+type WipeMode string
+
+const (
+	// WipeZero overwrites the removed partitions with zeros.
+	WipeZero WipeMode = "zero"
+	// WipeRandom overwrites the removed partitions with random data, from
+	// crypto/rand, for storage that might compress or deduplicate zeros
+	// rather than writing them.
+	WipeRandom WipeMode = "random"
+)
+
+// check returns an error unless m is a known WipeMode, or empty for not
+// wiping.
+func (m WipeMode) check() error {
+	switch m {
+	case "", WipeZero, WipeRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown wipe mode %q, must be %s or %s", m, WipeZero, WipeRandom)
+}
+
+// markWipes marks each partition to be copied to a new location to have its
+// original wiped once it is removed as opts.WipeRemoved asks.
+func markWipes(resizes []partitionResizeTarget, opts Options) {
+	for i, r := range resizes {
+		if r.original.start != r.target.start {
+			resizes[i].wipe = opts.WipeRemoved
+		}
+	}
+}
+
+// wipeOriginals overwrites the space the originals of the relocated
+// partitions marked to be, see Options.WipeRemoved, left once
+// commitPartitions removed them, see removedRanges, and syncs it to the
+// device. Unlike discarding, wiping is not best effort: a range that cannot be
+// wiped fails the resize, for it to be wiped again on resume.
+func wipeOriginals(ctx context.Context, logger *slog.Logger, d *disk.Disk, resizes []partitionResizeTarget) error {
+	ranges, err := removedRanges(logger, d, resizes, func(r partitionResizeTarget) bool { return r.wipe != "" }, "wiping")
+	if err != nil || len(ranges) == 0 {
+		return err
+	}
+	mode := map[int]WipeMode{}
+	for _, r := range resizes {
+		mode[r.original.number] = r.wipe
+	}
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, copyBufSize)
+	for _, removed := range ranges {
+		logger.Info("wiping original partition", "partition", removed.number, "start", removed.start, "bytes", removed.size, "mode", mode[removed.number])
+		for offset := removed.start; offset < removed.start+removed.size; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			chunk := buf[:min(int64(len(buf)), removed.start+removed.size-offset)]
+			if mode[removed.number] == WipeRandom {
+				_, _ = rand.Read(chunk)
+			}
+			n, err := w.WriteAt(chunk, offset)
+			if err != nil {
+				return fmt.Errorf("wipe original partition %d: %w", removed.number, err)
+			}
+			offset += int64(n)
+		}
+	}
+	if f, err := d.Backend.Sys(); err == nil {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("sync wiped partitions: %w", err)
+		}
+	}
+	return nil
+}
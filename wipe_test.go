@@ -0,0 +1,50 @@
+package partitionresizer
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestWipeOriginals(t *testing.T) {
+	for _, mode := range []WipeMode{WipeZero, WipeRandom} {
+		t.Run(string(mode), func(t *testing.T) {
+			d, diskPath, data, resizes := removedOriginalDisk(t)
+			markWipes(resizes, Options{WipeRemoved: mode})
+			if err := wipeOriginals(context.Background(), slog.Default(), d, resizes); err != nil {
+				t.Fatalf("wipeOriginals() error: %v", err)
+			}
+			got, err := os.ReadFile(diskPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// what is left of the original is overwritten, and nothing
+			// else is
+			for _, tt := range []struct{ start, end int64 }{{1 * MB, 4 * MB}, {6 * MB, 9 * MB}} {
+				wiped := got[tt.start:tt.end]
+				if bytes.Contains(wiped, bytes.Repeat([]byte{0xa5}, 16)) {
+					t.Errorf("bytes %d to %d not wiped", tt.start, tt.end)
+				}
+				if zero := isZero(wiped); zero != (mode == WipeZero) {
+					t.Errorf("bytes %d to %d zero = %v after wiping with %s", tt.start, tt.end, zero, mode)
+				}
+			}
+			if !bytes.Equal(got[:1*MB], data[:1*MB]) || !bytes.Equal(got[4*MB:6*MB], data[4*MB:6*MB]) || !bytes.Equal(got[9*MB:], data[9*MB:]) {
+				t.Error("wipeOriginals() overwrote more than the original left")
+			}
+		})
+	}
+}
+
+func TestWipeModeCheck(t *testing.T) {
+	for _, mode := range []WipeMode{"", WipeZero, WipeRandom} {
+		if err := mode.check(); err != nil {
+			t.Errorf("WipeMode(%q).check() error: %v", mode, err)
+		}
+	}
+	if err := WipeMode("shred").check(); err == nil {
+		t.Error(`WipeMode("shred").check() succeeded, want an error`)
+	}
+}